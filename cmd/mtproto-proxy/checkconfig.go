@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/cli"
+	"github.com/skrashevich/MTProxy/internal/config"
+	"github.com/skrashevich/MTProxy/internal/proxy"
+)
+
+// runCheckConfig implements "mtproto-proxy checkconfig <config-file>": it
+// validates the config and the secret files given with the proxy's own
+// options, taken like the proxy does from the command line, MTPROXY_GO_*
+// variables and --config-yaml, resolves every target and, with --dial,
+// connects to each once, printing one line per check. It returns the exit
+// code: 0 if nothing failed, 1 if a check failed, 2 for bad arguments.
+func runCheckConfig(args []string) int {
+	var dial bool
+	var timeout float64
+	opts, positional, err := cli.ParseSubcommand("checkconfig", args, os.Stderr, func(fs *flag.FlagSet) {
+		fs.BoolVar(&dial, "dial", false, "connect to every target once")
+		fs.Float64Var(&timeout, "timeout", 5, "seconds each lookup and dial may take")
+	})
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 || timeout <= 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s checkconfig [--aes-pwd <path>] [--mtproto-secret-file <path>] [--dial] <config-file>\n", os.Args[0])
+		return 2
+	}
+	policy, err := config.ParseDuplicatePolicy(opts.DuplicateTargets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: --duplicate-targets: %v\n", err)
+		return 2
+	}
+
+	var report proxy.PreflightReport
+	sources, aesSecret := cli.CheckSecretSources(opts.SecretFile, opts.SecretDir, opts.AESPwdFile, opts.SecretsKeyEnv, opts.SecretsKeyCommand)
+	for _, s := range sources {
+		if s.Err != nil {
+			report = append(report, proxy.PreflightCheck{Name: s.Name, Status: proxy.PreflightFail, Detail: s.Err.Error(),
+				Hint: "the proxy refuses to start with it"})
+		} else {
+			report = append(report, proxy.PreflightCheck{Name: s.Name, Status: proxy.PreflightPass, Detail: s.Detail})
+		}
+	}
+	if opts.AESPwdFile == "" && dial {
+		report = append(report, proxy.PreflightCheck{Name: "--aes-pwd", Status: proxy.PreflightWarn,
+			Detail: "not given: --dial checks TCP only",
+			Hint:   "pass the proxy's --aes-pwd to check the RPC handshake with every target"})
+	}
+	resolver, err := proxy.NewResolver(opts.DNSServers)
+	if err != nil {
+		report = append(report, proxy.PreflightCheck{Name: "--dns", Status: proxy.PreflightFail, Detail: err.Error()})
+	}
+	report = append(report, proxy.CheckConfig(proxy.CheckConfigOptions{
+		ConfigFile: positional[0],
+		Duplicates: policy,
+		Resolver:   resolver,
+		Dial:       dial,
+		Secret:     aesSecret,
+		Timeout:    time.Duration(timeout * float64(time.Second)),
+	})...)
+	report.WriteAs(os.Stdout, "checkconfig")
+	if report.Failed() {
+		return 1
+	}
+	return 0
+}
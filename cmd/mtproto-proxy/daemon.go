@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv marks the detached copy of the process started by -d.
+const daemonEnv = "MTPROXY_DAEMON"
+
+// daemonize starts a detached copy of the process (-d): it runs in a new
+// session with stdin on /dev/null and stdout and stderr appended to
+// logFile, or on /dev/null without one. It returns the copy's pid; the
+// caller exits. Relative paths keep working since the working directory
+// is not changed.
+func daemonize(logFile string) (int, error) {
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer null.Close()
+	out := null
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return 0, fmt.Errorf("open log file %s: %w", logFile, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// checkPidFile fails when path names another process that is still alive,
+// so a second copy started by an init script fails instead of hiding the
+// first. A stale file is fine; it gets replaced.
+func checkPidFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && pid > 0 && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("pid file %s: process %d is running", path, pid)
+	}
+	return nil
+}
+
+// writePidFile writes the pid of the running process to path.
+func writePidFile(path string) error {
+	if err := checkPidFile(path); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("pid file: %w", err)
+	}
+	return nil
+}
+
+// removePidFile removes path on exit if it still names this process. After
+// -u the user may lack the right to; the stale file is then replaced by the
+// next start.
+func removePidFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("pid file: %v; left for the next start to replace", err)
+	}
+}
+
+// processAlive reports whether a process with pid exists. A zombie left
+// unreaped by a container's init does not count.
+func processAlive(pid int) bool {
+	if stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil {
+		// pid (comm) state ...; comm may itself contain ") ".
+		if i := strings.LastIndex(string(stat), ") "); i >= 0 && strings.HasPrefix(string(stat[i+2:]), "Z") {
+			return false
+		}
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
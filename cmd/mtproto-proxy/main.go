@@ -4,30 +4,137 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/skrashevich/MTProxy/internal/cli"
+	"github.com/skrashevich/MTProxy/internal/config"
+	"github.com/skrashevich/MTProxy/internal/crypto"
 	"github.com/skrashevich/MTProxy/internal/proxy"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "selftest":
+			os.Exit(runSelfTest(os.Args[2:]))
+		case "gensecret":
+			os.Exit(cli.GenSecret(os.Args[2:], os.Stdout, os.Stderr))
+		case "getlink":
+			os.Exit(cli.GetLink(os.Args[2:], os.Stdout, os.Stderr))
+		case "checkconfig":
+			os.Exit(runCheckConfig(os.Args[2:]))
+		}
+	}
 	opts := cli.Parse()
 
 	// Set up logging.
 	lw := NewLogWriter("[mtproxy] ", os.Stderr)
 	log.SetOutput(lw)
 	log.SetFlags(log.LstdFlags)
+	// The copy detached by -d already has stderr on the log file.
+	if opts.LogFile != "" && os.Getenv(daemonEnv) != "1" {
+		if err := lw.OpenFile(opts.LogFile); err != nil {
+			log.Fatalf("fatal: %v", err)
+		}
+		defer lw.Close()
+	}
 
 	if opts.Verbosity > 0 {
 		log.Printf("verbosity=%d", opts.Verbosity)
 	}
 
+	// Determine listen addresses from -H ports.
+	listenAddr := fmt.Sprintf(":%d", cli.DefaultPort)
+	var extraListenAddrs []string
+	if len(opts.HTTPPorts) > 0 {
+		listenAddr = fmt.Sprintf(":%d", opts.HTTPPorts[0])
+		for _, p := range opts.HTTPPorts[1:] {
+			extraListenAddrs = append(extraListenAddrs, fmt.Sprintf(":%d", p))
+		}
+	}
+	var udpListenAddrs []string
+	for _, p := range opts.UDPPorts {
+		udpListenAddrs = append(udpListenAddrs, fmt.Sprintf(":%d", p))
+	}
+
+	// HTTP stats address — --stats-addr if given, otherwise a separate port to
+	// avoid conflict with the MTProto listener, derived as listen_port + 8000
+	// (e.g., :4431 → :12431).
+	httpStatsAddr := opts.StatsAddr
+	if opts.HTTPStats && httpStatsAddr == "" {
+		statsPort := 8888 + 8000 // default
+		if len(opts.HTTPPorts) > 0 {
+			statsPort = opts.HTTPPorts[0] + 8000
+		}
+		httpStatsAddr = fmt.Sprintf(":%d", statsPort)
+	}
+
+	// Preflight runs once, before the supervisor forks workers or -d
+	// detaches, so a misconfiguration is reported on the terminal before
+	// anything is bound.
+	if os.Getenv("MTPROXY_WORKER_SLAVE") != "1" && os.Getenv(daemonEnv) != "1" {
+		report := proxy.Preflight(preflightOptions(opts, append([]string{listenAddr}, extraListenAddrs...), httpStatsAddr))
+		report.Write(os.Stderr)
+		if report.Failed() {
+			log.Fatalf("fatal: preflight failed")
+		}
+	}
+
+	if opts.Daemonize && os.Getenv(daemonEnv) != "1" {
+		if opts.PidFile != "" {
+			if err := checkPidFile(opts.PidFile); err != nil {
+				log.Fatalf("fatal: %v", err)
+			}
+		}
+		pid, err := daemonize(opts.LogFile)
+		if err != nil {
+			log.Fatalf("fatal: daemonize: %v", err)
+		}
+		log.Printf("running in the background, pid %d", pid)
+		return
+	}
+
+	// The pid file names the supervisor with -M, never a worker.
+	if opts.PidFile != "" && os.Getenv("MTPROXY_WORKER_SLAVE") != "1" {
+		if err := writePidFile(opts.PidFile); err != nil {
+			log.Fatalf("fatal: %v", err)
+		}
+		defer removePidFile(opts.PidFile)
+	}
+
 	// If -M > 1: run supervisor mode.
 	if opts.Workers > 1 {
 		if os.Getenv("MTPROXY_WORKER_SLAVE") != "1" {
-			workerArgs := buildWorkerArgs(opts)
-			runSupervisor(opts.Workers, workerArgs)
+			sc := supervisorConfig{
+				workers:   opts.Workers,
+				args:      buildWorkerArgs(opts),
+				statsAddr: httpStatsAddr,
+				user:      opts.Username,
+				standby:   opts.Standby,
+			}
+			if opts.InheritListeners {
+				sc.listenAddrs = append([]string{listenAddr}, extraListenAddrs...)
+				sc.workersBind = len(udpListenAddrs) > 0
+			}
+			if opts.ConfigFetchInterval > 0 {
+				dups, err := config.ParseDuplicatePolicy(opts.DuplicateTargets)
+				if err != nil {
+					log.Fatalf("fatal: %v", err)
+				}
+				sc.configFile = opts.ConfigFile
+				sc.parseOptions = config.ParseOptions{Duplicates: dups}
+				sc.minDefaultTargets = opts.MinDefaultTargets
+				sc.fetch = config.FetcherOptions{
+					URL:      opts.ConfigURL,
+					Interval: time.Duration(opts.ConfigFetchInterval * float64(time.Second)),
+					Jitter:   time.Duration(opts.ConfigFetchJitter * float64(time.Second)),
+				}
+			}
+			runSupervisor(sc)
 			return
 		}
 	}
@@ -36,56 +143,176 @@ func main() {
 		log.Println("warning: no mtproto secrets configured (-S)")
 	}
 
-	// Determine listen address from -H ports.
-	listenAddr := fmt.Sprintf(":%d", cli.DefaultPort)
-	if len(opts.HTTPPorts) > 0 {
-		listenAddr = fmt.Sprintf(":%d", opts.HTTPPorts[0])
-	}
-
 	// Read AES secret for outbound RPC connections.
 	var aesSecret []byte
 	if opts.AESPwdFile != "" {
-		data, err := os.ReadFile(opts.AESPwdFile)
+		pwd, err := crypto.LoadSealedPwdFile(opts.AESPwdFile, opts.SecretsKey())
 		if err != nil {
-			log.Fatalf("fatal: cannot read --aes-pwd %s: %v", opts.AESPwdFile, err)
+			log.Fatalf("fatal: cannot load --aes-pwd %s: %v", opts.AESPwdFile, err)
 		}
-		aesSecret = data
+		aesSecret = pwd.Secret
+		log.Printf("loaded %d-byte AES secret from %s (key signature %08x, md5 %x)",
+			len(pwd.Secret), opts.AESPwdFile, pwd.KeySignature(), pwd.MD5)
+	} else if !opts.TestBackend {
+		log.Println("warning: no --aes-pwd secret, RPC handshakes with Telegram middle proxies will fail")
 	}
-
-	// HTTP stats address — use a separate port to avoid conflict with the MTProto listener.
-	// Derives stats port as listen_port + 8000 (e.g., :4431 → :12431).
-	httpStatsAddr := ""
-	if opts.HTTPStats {
-		statsPort := 8888 + 8000 // default
-		if len(opts.HTTPPorts) > 0 {
-			statsPort = opts.HTTPPorts[0] + 8000
+	if opts.TestBackend {
+		if aesSecret == nil {
+			aesSecret = proxy.NewTestBackendSecret()
 		}
-		httpStatsAddr = fmt.Sprintf(":%d", statsPort)
+		backend, configFile, err := startTestBackend(aesSecret)
+		if err != nil {
+			log.Fatalf("fatal: --test-backend: %v", err)
+		}
+		defer backend.Close()
+		defer os.Remove(configFile)
+		opts.ConfigFile = configFile
 	}
 
 	// Build runtime options.
 	rtOpts := proxy.RuntimeOptions{
 		ListenAddr:              listenAddr,
+		ExtraListenAddrs:        extraListenAddrs,
+		UDPListenAddrs:          udpListenAddrs,
+		PreferIPv6:              opts.PreferIPv6,
 		HTTPStatsAddr:           httpStatsAddr,
+		AdminSocket:             opts.AdminSocket,
+		AdminUIDs:               opts.AdminUIDs,
+		IngressStats:            opts.IngressStats,
+		TraceConn:               opts.TraceConn,
 		ConfigFile:              opts.ConfigFile,
+		DuplicateTargets:        opts.DuplicateTargets,
+		Balance:                 opts.Balance,
+		SessionAffinity:         time.Duration(opts.SessionAffinity * float64(time.Second)),
+		SessionAffinityMax:      opts.SessionAffinityMax,
+		MinDefaultTargets:       opts.MinDefaultTargets,
+		ConfigURL:               opts.ConfigURL,
+		ConfigFetchInterval:     time.Duration(opts.ConfigFetchInterval * float64(time.Second)),
+		ConfigFetchJitter:       time.Duration(opts.ConfigFetchJitter * float64(time.Second)),
 		MaxConnectionsPerSecret: opts.MaxSpecialConnections,
+		MaxSessions:             opts.MaxSpecialConnections,
+		OverloadPolicy:          opts.OverloadPolicy,
+		MemoryBudget:            uint64(opts.MemoryBudget) << 20,
+		MaxHandlersPerCPU:       opts.MaxHandlersPerCPU,
+		AcceptLoops:             opts.AcceptLoops,
+		Sockets:                 clientSockets(opts),
+		MsgBuffersSize:          opts.MsgBuffersSize,
+		LatencySampleRate:       opts.LatencySampleRate,
+		LatencyReservoir:        opts.LatencyReservoir,
+		EnablePprof:             opts.EnablePprof,
+		SecretAllowed:           opts.SecretAllowed,
+		AuthorizerURL:           opts.AuthorizerURL,
+		AuthorizerTimeout:       time.Duration(opts.AuthorizerTimeout * float64(time.Second)),
+		AuthorizerFailOpen:      opts.AuthorizerFailOpen,
+		CrashDir:                opts.CrashDir,
+		CPUProfileDir:           opts.CPUProfileDir,
+		CPUProfileThreshold:     opts.CPUProfileThreshold,
+		CPUProfileAfter:         time.Duration(opts.CPUProfileAfter * float64(time.Second)),
+		CPUProfileKeep:          opts.CPUProfileKeep,
+		FinalStatsFile:          opts.FinalStatsFile,
+		ShutdownGrace:           time.Duration(opts.ShutdownGrace * float64(time.Second)),
+		HealthCheckInterval:     time.Duration(opts.HealthCheckInterval * float64(time.Second)),
+		HealthCheckTimeout:      time.Duration(opts.HealthCheckTimeout * float64(time.Second)),
+		HealthCheckRise:         opts.HealthCheckRise,
+		HealthCheckFall:         opts.HealthCheckFall,
+		DialBackoffMax:          time.Duration(opts.DialBackoffMax * float64(time.Second)),
+		ExitAudit:               opts.ExitAudit,
+		Standby:                 opts.Standby,
+		User:                    opts.Username,
+		PublicHost:              publicHost(opts),
+		DescriptorFile:          opts.DescriptorFile,
+		TLSDomains:              opts.Domains,
+		DecoyAddr:               opts.FallbackAddr,
+		Verbosity:               opts.Verbosity,
+		RoutingSeed:             opts.RoutingSeed,
+		AnswerPings:             opts.AnswerPings,
+		DedupFrames:             opts.DedupFrames,
+		WriteDelay: proxy.WriteDelay{
+			Base:   time.Duration(opts.InjectLatency * float64(time.Second)),
+			Jitter: time.Duration(opts.InjectJitter * float64(time.Second)),
+		},
+		FrameLimits: proxy.FrameLimits{
+			PreHandshake: opts.MaxFramePreHandshake,
+			Unencrypted:  opts.MaxFrameUnencrypted,
+			Encrypted:    opts.MaxFrameEncrypted,
+		},
+		BlockThreshold:  opts.BlockThreshold,
+		BlockWindow:     time.Duration(opts.BlockWindow * float64(time.Second)),
+		BlockTTL:        time.Duration(opts.BlockTTL * float64(time.Second)),
+		BlockFile:       opts.BlockFile,
+		SurgeFactor:     opts.SurgeFactor,
+		SurgeMinRate:    opts.SurgeMinRate,
+		SurgeCooldown:   time.Duration(opts.SurgeCooldown * float64(time.Second)),
+		MaxConnsPerIP:   opts.MaxConnsPerIP,
+		PerIPAcceptRate: opts.PerIPAcceptRate,
+	}
+	for _, st := range opts.Settings {
+		rtOpts.EffectiveConfig = append(rtOpts.EffectiveConfig, proxy.ConfigSetting(st))
+	}
+	if opts.WatchConfig {
+		rtOpts.WatchFiles = []string{opts.ConfigFile}
+		if opts.SecretFile != "" {
+			rtOpts.WatchFiles = append(rtOpts.WatchFiles, opts.SecretFile)
+		}
+		rtOpts.WatchConfigDebounce = time.Duration(opts.WatchConfigDebounce * float64(time.Second))
+	}
+	if opts.SecretsReloadable() {
+		rtOpts.SecretReload = opts.LoadSecrets
+		rtOpts.WatchSecretDir = opts.SecretDir != ""
+		rtOpts.SecretRevokeGrace = time.Duration(opts.SecretRevokeGrace * float64(time.Second))
+	}
+	if opts.Workers > 1 {
+		// Every worker binds the client ports with SO_REUSEPORT, or with
+		// --inherit-listeners serves the ones the supervisor bound; the
+		// supervisor owns the stats address and sums the workers' /stats,
+		// which it reads from their stats sockets. Only worker 0 serves
+		// the admin socket, the others could not bind it. Each worker
+		// keeps its own blocklist and final stats files. The supervisor
+		// fetches the config and reloads the workers.
+		lns, err := inheritedListeners(append([]string{listenAddr}, extraListenAddrs...))
+		if err != nil {
+			log.Fatalf("fatal: %v", err)
+		}
+		rtOpts.InheritedListeners = lns
+		rtOpts.ReusePort = lns == nil
+		rtOpts.WorkerStatsSocket = os.Getenv("MTPROXY_WORKER_STATS")
+		rtOpts.HTTPStatsAddr = ""
+		rtOpts.ConfigFetchInterval = 0
+		workerID := os.Getenv("MTPROXY_WORKER_ID")
+		rtOpts.FinalStatsFile = workerFile(opts.FinalStatsFile, workerID)
+		rtOpts.BlockFile = workerFile(opts.BlockFile, workerID)
+		if workerID != "0" {
+			rtOpts.AdminSocket = ""
+		}
+		if os.Getenv(workerActiveEnv) == "1" {
+			rtOpts.Standby = false
+		}
 	}
 
-	// Build NAT translation table: string IPs → uint32 LE
-	var natMap map[uint32]uint32
-	if len(opts.NatInfo) > 0 {
-		natMap = make(map[uint32]uint32)
-		for localStr, pubStr := range opts.NatInfo {
-			localIP := net.ParseIP(localStr).To4()
-			pubIP := net.ParseIP(pubStr).To4()
-			if localIP == nil || pubIP == nil {
-				log.Fatalf("fatal: --nat-info: invalid IP pair %s:%s", localStr, pubStr)
-			}
-			localU := uint32(localIP[0])<<24 | uint32(localIP[1])<<16 | uint32(localIP[2])<<8 | uint32(localIP[3])
-			pubU := uint32(pubIP[0])<<24 | uint32(pubIP[1])<<16 | uint32(pubIP[2])<<8 | uint32(pubIP[3])
-			natMap[localU] = pubU
-			log.Printf("nat-info: %s (0x%08x) → %s (0x%08x)", localStr, localU, pubStr, pubU)
+	// Build NAT translation table: string IPs → uint32
+	natMap, err := proxy.ParseNATInfo(opts.NatInfo)
+	if err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+	for localStr, pubStr := range opts.NatInfo {
+		log.Printf("nat-info: %s → %s", localStr, pubStr)
+	}
+
+	resolver, err := proxy.NewResolver(opts.DNSServers)
+	if err != nil {
+		log.Fatalf("fatal: --dns: %v", err)
+	}
+
+	var outDialer proxy.OutboundDialer
+	if len(opts.OutboundProxies) > 0 {
+		upstreams, err := proxy.NewUpstreamProxies(opts.OutboundProxies)
+		if err != nil {
+			log.Fatalf("fatal: --outbound-proxy: %v", err)
 		}
+		for _, u := range upstreams.Upstreams() {
+			log.Printf("outbound: connecting to DCs via %s", u)
+		}
+		outDialer = upstreams
 	}
 
 	outCfg := proxy.OutboundConfig{
@@ -93,6 +320,15 @@ func main() {
 		ProxyTag: opts.ProxyTag,
 		ForceDH:  false, // TODO: add --force-dh flag
 		NatInfo:  natMap,
+		Device:   opts.OutboundDevice,
+		Resolver: resolver,
+		Dialer:   outDialer,
+		Sockets:  outboundSockets(opts),
+
+		MaxResponseSize:  opts.MaxResponseSize,
+		FirstByteTimeout: time.Duration(opts.ResponseFirstByteTimeout * float64(time.Second)),
+		StallTimeout:     time.Duration(opts.ResponseStallTimeout * float64(time.Second)),
+		Loopback:         opts.LoopbackBackend,
 	}
 
 	rt, err := proxy.New(rtOpts, opts.Secrets, opts.ProxyTag, outCfg)
@@ -100,14 +336,101 @@ func main() {
 		log.Fatalf("fatal: %v", err)
 	}
 
+	defer rt.Crash.Recover()
+
 	ctx := context.Background()
 	if err := rt.Start(ctx); err != nil {
 		log.Fatalf("fatal: %v", err)
 	}
+	if leaks := rt.ExitLeaks(); len(leaks) > 0 {
+		log.Fatalf("fatal: exit audit found %d leaks", len(leaks))
+	}
 
 	log.Println("exiting")
 }
 
+// publicHost returns --public-host, falling back to the lowest public IP
+// from --nat-info.
+func publicHost(opts *cli.Options) string {
+	if opts.PublicHost != "" {
+		return opts.PublicHost
+	}
+	var hosts []string
+	for _, pub := range opts.NatInfo {
+		hosts = append(hosts, pub)
+	}
+	if len(hosts) == 0 {
+		return ""
+	}
+	sort.Strings(hosts)
+	return hosts[0]
+}
+
+// outboundSockets returns the TCP options of DC connections from the
+// --tcp-* flags.
+func outboundSockets(opts *cli.Options) proxy.SocketOptions {
+	return proxy.SocketOptions{
+		Nagle:       !opts.TCPNoDelay,
+		KeepAlive:   time.Duration(opts.TCPKeepAlive * float64(time.Second)),
+		UserTimeout: time.Duration(opts.TCPUserTimeout * float64(time.Second)),
+	}
+}
+
+// clientSockets returns the TCP options of client connections: those of DC
+// connections plus the -W window clamp.
+func clientSockets(opts *cli.Options) proxy.SocketOptions {
+	o := outboundSockets(opts)
+	o.WindowClamp = opts.WindowClamp
+	return o
+}
+
+// preflightOptions lists the limits, listen addresses and files the proxy
+// will need with opts.
+func preflightOptions(opts *cli.Options, listenAddrs []string, statsAddr string) proxy.PreflightOptions {
+	po := proxy.PreflightOptions{
+		Connections: opts.MaxSpecialConnections,
+		User:        opts.Username,
+		IPv6:        opts.PreferIPv6,
+	}
+	if opts.Workers > 1 && !opts.InheritListeners {
+		po.ReusePortAddrs = listenAddrs
+	} else {
+		po.ListenAddrs = listenAddrs
+	}
+	for local := range opts.NatInfo {
+		po.NATLocalIPs = append(po.NATLocalIPs, local)
+	}
+	sort.Strings(po.NATLocalIPs)
+	if statsAddr != "" {
+		po.ListenAddrs = append(po.ListenAddrs, statsAddr)
+	}
+	for _, p := range []string{opts.ConfigFile, opts.AESPwdFile, opts.SecretFile, opts.SecretDir} {
+		if p != "" {
+			po.ReadPaths = append(po.ReadPaths, p)
+		}
+	}
+	for _, d := range []string{opts.CrashDir, opts.CPUProfileDir} {
+		if d != "" {
+			po.WriteDirs = append(po.WriteDirs, d)
+		}
+	}
+	adminSocket := ""
+	if !strings.HasPrefix(opts.AdminSocket, "@") {
+		adminSocket = opts.AdminSocket
+	}
+	for _, p := range []string{opts.DescriptorFile, opts.FinalStatsFile, opts.BlockFile, adminSocket} {
+		if p != "" {
+			po.WriteDirs = append(po.WriteDirs, filepath.Dir(p))
+		}
+	}
+	// The config fetcher replaces the config file as the -u user, unless
+	// the supervisor, which keeps its privileges, does it for -M workers.
+	if opts.ConfigFetchInterval > 0 && opts.Workers <= 1 {
+		po.WriteDirs = append(po.WriteDirs, filepath.Dir(opts.ConfigFile))
+	}
+	return po
+}
+
 // buildWorkerArgs constructs the argv for a worker process.
 func buildWorkerArgs(opts *cli.Options) []string {
 	args := make([]string, len(os.Args))
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/proxy"
+)
+
+// runSelfTest implements "mtproto-proxy selftest": one client session
+// through the proxy and a mock middle proxy, all on loopback. It returns
+// the exit code: 0 if the session worked, 1 if not, 2 for bad arguments.
+func runSelfTest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	timeout := fs.Float64("timeout", 10, "seconds the session may take")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *timeout <= 0 || fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s selftest [--timeout <sec>]\n", os.Args[0])
+		return 2
+	}
+	if err := proxy.SelfTest(os.Stdout, time.Duration(*timeout*float64(time.Second))); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		fmt.Println("selftest: FAILED")
+		return 1
+	}
+	return 0
+}
+
+// startTestBackend implements --test-backend: it starts a mock middle
+// proxy accepting secret and writes a config routing every DC to it,
+// returning the config's path.
+func startTestBackend(secret []byte) (*proxy.TestBackend, string, error) {
+	backend, err := proxy.NewTestBackend(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.CreateTemp("", "mtproxy-test-backend-*.conf")
+	if err == nil {
+		_, err = f.WriteString(backend.Config())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		backend.Close()
+		return nil, "", err
+	}
+	log.Printf("WARNING: --test-backend: every DC is routed to a mock middle proxy on %s; for local testing only", backend.Addr())
+	return backend, f.Name(), nil
+}
@@ -1,22 +1,133 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+	"github.com/skrashevich/MTProxy/internal/proxy"
 )
 
-// supervisor forks N worker processes, restarts them if they die, and
-// forwards SIGINT/SIGTERM to all children.
-func runSupervisor(n int, args []string) {
+// workerActiveEnv tells a worker restarted after the supervisor forwarded
+// SIGUSR2 to skip --standby: its siblings are already accepting.
+const workerActiveEnv = "MTPROXY_WORKER_ACTIVE"
+
+// workerPollInterval is how often the supervisor asks starting workers
+// whether their client ports are bound.
+const workerPollInterval = 100 * time.Millisecond
+
+// listenFDsEnv tells a worker how many client listeners it inherited; they
+// are file descriptors 3, 4, ... in the order of the listen addresses.
+const listenFDsEnv = "MTPROXY_LISTEN_FDS"
+
+// supervisorConfig describes the workers runSupervisor starts.
+type supervisorConfig struct {
+	workers int
+	args    []string
+
+	// statsAddr, if set, is where the supervisor serves /stats summed over
+	// the workers' stats sockets.
+	statsAddr string
+
+	// listenAddrs, if set, are bound by the supervisor and passed to every
+	// worker (--inherit-listeners); otherwise workers bind them with
+	// SO_REUSEPORT.
+	listenAddrs []string
+
+	// workersBind is set when workers bind ports of their own even with
+	// listenAddrs: UDP ports (--udp-ports) are never inherited.
+	workersBind bool
+
+	// user, if set while running as root, is the account workers run as:
+	// with listenAddrs they are started as it, otherwise they switch to it
+	// once their ports are bound.
+	user string
+
+	// standby is set with --standby: the first SIGUSR2 is forwarded to
+	// every worker and workers started afterwards come up active.
+	standby bool
+
+	// fetch, with its Interval set, makes the supervisor download the
+	// config into configFile (--config-fetch-interval), checked with
+	// parseOptions and minDefaultTargets, and reload the workers whenever
+	// it changes. Workers do not fetch: they would all rewrite the file,
+	// and after dropping privileges they may not be allowed to.
+	fetch             config.FetcherOptions
+	configFile        string
+	parseOptions      config.ParseOptions
+	minDefaultTargets int
+}
+
+// supervisor forks N worker processes, restarts them if they die,
+// forwards SIGINT/SIGTERM and (with --standby) SIGUSR2 to all children and
+// reloads them on SIGHUP and after fetching a changed config.
+func runSupervisor(sc supervisorConfig) {
+	n := sc.workers
+	args := sc.args
 	log.Printf("supervisor: starting %d workers", n)
 
+	cred, err := workerCredential(sc.user, len(sc.listenAddrs) > 0 && !sc.workersBind)
+	if err != nil {
+		log.Fatalf("supervisor: %v", err)
+	}
+
+	// Listeners bound here survive worker restarts, so a restarting worker
+	// never races its predecessor for the port, and ports below 1024 can
+	// be served by workers without privileges.
+	var listenFiles []*os.File
+	for _, addr := range sc.listenAddrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("supervisor: %v", err)
+		}
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			log.Fatalf("supervisor: listener %s: %v", addr, err)
+		}
+		ln.Close() // f holds its own descriptor of the socket
+		defer f.Close()
+		listenFiles = append(listenFiles, f)
+		log.Printf("supervisor: listening on %s for the workers", addr)
+	}
+
+	statsDir, err := os.MkdirTemp("", "mtproxy-workers-")
+	if err != nil {
+		log.Fatalf("supervisor: stats sockets: %v", err)
+	}
+	defer os.RemoveAll(statsDir)
+	if cred != nil {
+		if err := os.Chown(statsDir, int(cred.Uid), int(cred.Gid)); err != nil {
+			log.Fatalf("supervisor: stats sockets: %v", err)
+		}
+	}
+	statsSockets := make([]string, n)
+	for i := range statsSockets {
+		statsSockets[i] = filepath.Join(statsDir, "worker-"+itoa(i)+".sock")
+	}
+	if statsAddr := sc.statsAddr; statsAddr != "" {
+		stats := proxy.NewWorkerStatsServer(statsAddr, statsSockets)
+		if err := stats.Start(); err != nil {
+			os.RemoveAll(statsDir)
+			log.Fatalf("supervisor: %v", err)
+		}
+		defer stats.Stop()
+		log.Printf("supervisor: stats of %d workers on %s", n, statsAddr)
+	}
+
 	sigCh := make(chan os.Signal, 8)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 	defer signal.Stop(sigCh)
 
 	type workerState struct {
@@ -25,6 +136,7 @@ func runSupervisor(n int, args []string) {
 		mu  sync.Mutex
 	}
 
+	var activated atomic.Bool
 	workers := make([]*workerState, n)
 	for i := range workers {
 		workers[i] = &workerState{id: i}
@@ -36,7 +148,18 @@ func runSupervisor(n int, args []string) {
 		cmd := exec.Command(args[0], args[1:]...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		cmd.Env = append(os.Environ(), "MTPROXY_WORKER_SLAVE=1", "MTPROXY_WORKER_ID="+itoa(ws.id))
+		cmd.Env = append(workerEnviron(), "MTPROXY_WORKER_SLAVE=1", "MTPROXY_WORKER_ID="+itoa(ws.id),
+			"MTPROXY_WORKER_STATS="+statsSockets[ws.id])
+		if activated.Load() {
+			cmd.Env = append(cmd.Env, workerActiveEnv+"=1")
+		}
+		if len(listenFiles) > 0 {
+			cmd.ExtraFiles = listenFiles
+			cmd.Env = append(cmd.Env, listenFDsEnv+"="+itoa(len(listenFiles)))
+		}
+		if cred != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		}
 		if err := cmd.Start(); err != nil {
 			log.Printf("supervisor: failed to start worker %d: %v", ws.id, err)
 			return
@@ -59,9 +182,93 @@ func runSupervisor(n int, args []string) {
 	for _, ws := range workers {
 		startWorker(ws)
 	}
+	stopping := make(chan struct{})
+
+	// Under systemd with Type=notify the supervisor is the main process and
+	// speaks for the workers, which it asks over their stats sockets: it is
+	// ready once every worker has bound its client ports, and the watchdog
+	// is fed only while at least one worker answers.
+	control := proxy.NewWorkerControl(statsSockets)
+	var sdMu sync.Mutex // orders READY=1 after a reload before STOPPING=1
+	stopped := false
+	notifyUnlessStopped := func(state ...string) {
+		sdMu.Lock()
+		defer sdMu.Unlock()
+		if !stopped {
+			notify(state...)
+		}
+	}
+	// Workers reload over their stats sockets so that READY=1 follows the
+	// end of every worker's reload, not the request.
+	var reloadMu sync.Mutex
+	reloadWorkers := func() {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		notifyUnlessStopped(proxy.SdReloadingState()...)
+		reloaded := control.Reload()
+		log.Printf("supervisor: reloaded %d of %d workers", reloaded, n)
+		notifyUnlessStopped(proxy.SdReady)
+	}
+	// The fetcher starts once the workers listen: a worker cannot reload
+	// before, and would keep the config it started with.
+	var mgr *config.Manager
+	var fetcher *config.Fetcher
+	fetching := false // guarded by sdMu until stopped
+	if sc.fetch.Interval > 0 {
+		mgr = config.NewManager(sc.configFile)
+		mgr.SetParseOptions(sc.parseOptions)
+		mgr.SetMinDefaultTargets(sc.minDefaultTargets)
+		if err := mgr.Load(); err != nil {
+			log.Fatalf("supervisor: %v", err)
+		}
+		fetcher = config.NewFetcher(mgr, sc.fetch)
+		fetcher.SetOnApply(func(_ *config.Config, err error) {
+			if err == nil {
+				log.Println("supervisor: fetched a new config, reloading workers")
+				reloadWorkers()
+			}
+		})
+	}
+	go func() {
+		for control.Listening() < n {
+			select {
+			case <-stopping:
+				return
+			case <-time.After(workerPollInterval):
+			}
+		}
+		log.Printf("supervisor: all %d workers listening", n)
+		notifyUnlessStopped(proxy.SdReady, "STATUS="+itoa(n)+" workers listening")
+		if fetcher != nil {
+			sdMu.Lock()
+			if !stopped {
+				fetcher.Start()
+				fetching = true
+				log.Printf("supervisor: config fetcher started (every %s + up to %s)", sc.fetch.Interval, sc.fetch.Jitter)
+			}
+			sdMu.Unlock()
+		}
+	}()
+	if wd := proxy.NewSdWatchdog(); wd != nil {
+		answering := true
+		wd.SetCheck(func() bool {
+			ok := control.Answering() > 0
+			if ok != answering {
+				if ok {
+					log.Println("supervisor: a worker answers again, resuming watchdog keepalives")
+				} else {
+					log.Println("supervisor: no worker answers, holding watchdog keepalives")
+				}
+				answering = ok
+			}
+			return ok
+		})
+		wd.Start()
+		defer wd.Stop()
+		log.Printf("supervisor: systemd watchdog every %s", wd.Interval())
+	}
 
 	// Monitor workers in background goroutines; restart on unexpected exit.
-	stopping := make(chan struct{})
 	var wg sync.WaitGroup
 	for _, ws := range workers {
 		wg.Add(1)
@@ -101,15 +308,120 @@ func runSupervisor(n int, args []string) {
 		switch sig {
 		case syscall.SIGINT, syscall.SIGTERM:
 			log.Printf("supervisor: received %v, shutting down workers", sig)
+			sdMu.Lock()
+			stopped = true
+			notify(proxy.SdStopping)
+			sdMu.Unlock()
 			close(stopping)
 			killAll(sig)
 			wg.Wait()
+			if fetching {
+				fetcher.Stop()
+			}
 			return
 		case syscall.SIGHUP:
-			log.Println("supervisor: received SIGHUP, forwarding to workers")
-			killAll(syscall.SIGHUP)
+			// The loop keeps handling signals while the workers reload.
+			// The fetcher's copy of the config follows the file, so that
+			// it compares downloads with what the workers run.
+			log.Println("supervisor: received SIGHUP, reloading workers")
+			go func() {
+				if mgr != nil {
+					mgr.Reload()
+				}
+				reloadWorkers()
+			}()
+		case syscall.SIGUSR2:
+			// A worker that is already active has no SIGUSR2 handler and
+			// would be killed by a second one, so it is forwarded once.
+			if !sc.standby || activated.Swap(true) {
+				log.Println("supervisor: received SIGUSR2, workers are already active")
+				continue
+			}
+			log.Println("supervisor: received SIGUSR2, activating workers")
+			killAll(syscall.SIGUSR2)
+		}
+	}
+}
+
+// notify sends state to systemd (Type=notify); a failure is only logged.
+func notify(state ...string) {
+	if _, err := proxy.SdNotify(state...); err != nil {
+		log.Printf("supervisor: sd_notify: %v", err)
+	}
+}
+
+// workerEnviron returns the supervisor's environment without the systemd
+// notification variables, so only the supervisor reports to systemd; with
+// NotifyAccess=all a worker's keepalives would keep a hung supervisor
+// looking alive.
+func workerEnviron() []string {
+	env := os.Environ()
+	return slices.DeleteFunc(env, func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(proxy.SdNotifyEnv, name)
+	})
+}
+
+// workerFile returns the file worker id writes in place of path, with the
+// id before the extension (stats.json → stats.1.json), so the workers do not
+// overwrite each other's files; "" stays "".
+func workerFile(path, id string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + id + ext
+}
+
+// workerCredential returns the credential workers are started with. Only
+// workers that inherit every client listener start as the -u account (with
+// its supplementary groups, as DropPrivileges sets them); workers that bind
+// ports themselves start as the supervisor and drop to -u after binding,
+// so they are given nil. Outside root it is always nil; as root without a
+// user workers are not started at all.
+func workerCredential(name string, inherited bool) (*syscall.Credential, error) {
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+	if name == "" {
+		return nil, proxy.ErrRootWithoutUser
+	}
+	if !inherited {
+		return nil, nil
+	}
+	a, err := proxy.LookupAccount(name)
+	if err != nil {
+		return nil, fmt.Errorf("worker user: %w", err)
+	}
+	cred := &syscall.Credential{Uid: uint32(a.UID), Gid: uint32(a.GID)}
+	for _, g := range a.Groups {
+		cred.Groups = append(cred.Groups, uint32(g))
+	}
+	return cred, nil
+}
+
+// inheritedListeners returns the client listeners passed down by the
+// supervisor, keyed by address, or nil if there are none.
+func inheritedListeners(addrs []string) (map[string]net.Listener, error) {
+	v := os.Getenv(listenFDsEnv)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n != len(addrs) {
+		return nil, fmt.Errorf("%s=%q does not match %d listen addresses", listenFDsEnv, v, len(addrs))
+	}
+	lns := make(map[string]net.Listener, n)
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %w", addr, err)
 		}
+		lns[addr] = ln
 	}
+	return lns, nil
 }
 
 func itoa(n int) string {
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/skrashevich/MTProxy/internal/crypto"
+)
+
+// SourceCheck is the outcome of loading one file named on the command
+// line, for "mtproto-proxy checkconfig".
+type SourceCheck struct {
+	Name   string // the flag, e.g. "--aes-pwd"
+	Detail string // what was loaded; set when Err is nil
+	Err    error
+}
+
+// CheckSecretSources loads the secrets key, --mtproto-secret-file,
+// --mtproto-secret-dir and --aes-pwd as the proxy does at startup and
+// reports each one; empty arguments are skipped. aesSecret is the loaded
+// --aes-pwd secret, or nil.
+func CheckSecretSources(secretFile, secretDir, aesPwdFile, keyEnv, keyCommand string) (checks []SourceCheck, aesSecret []byte) {
+	var key []byte
+	if keyEnv != "" || keyCommand != "" {
+		c := SourceCheck{Name: "--secrets-key-env"}
+		if keyEnv == "" {
+			c.Name = "--secrets-key-command"
+		}
+		if keyEnv != "" && keyCommand != "" {
+			c.Err = fmt.Errorf("--secrets-key-env and --secrets-key-command are mutually exclusive")
+		} else if key, c.Err = loadSecretsKey(keyEnv, keyCommand); c.Err == nil {
+			c.Detail = fmt.Sprintf("%d-byte key", len(key))
+		}
+		checks = append(checks, c)
+	}
+	if secretFile != "" {
+		var secrets [][]byte
+		c := SourceCheck{Name: "--mtproto-secret-file"}
+		if c.Err = loadSecretsFromFile(secretFile, key, &secrets, nil); c.Err == nil {
+			c.Detail = fmt.Sprintf("%s: %d secrets", secretFile, len(secrets))
+			if len(secrets) == 0 {
+				c.Err = fmt.Errorf("%s: no secrets", secretFile)
+			}
+		}
+		checks = append(checks, c)
+	}
+	if secretDir != "" {
+		var secrets [][]byte
+		c := SourceCheck{Name: "--mtproto-secret-dir"}
+		if c.Err = loadSecretsFromDir(secretDir, key, &secrets, nil); c.Err == nil {
+			c.Detail = fmt.Sprintf("%s: %d secrets", secretDir, len(secrets))
+		}
+		checks = append(checks, c)
+	}
+	if aesPwdFile != "" {
+		c := SourceCheck{Name: "--aes-pwd"}
+		pwd, err := crypto.LoadSealedPwdFile(aesPwdFile, key)
+		if err != nil {
+			c.Err = fmt.Errorf("%s: %w", aesPwdFile, err)
+		} else {
+			aesSecret = pwd.Secret
+			c.Detail = fmt.Sprintf("%s: %d bytes, key signature %08x, md5 %x", aesPwdFile, len(pwd.Secret), pwd.KeySignature(), pwd.MD5)
+		}
+		checks = append(checks, c)
+	}
+	return checks, aesSecret
+}
@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSecretSources(t *testing.T) {
+	dir := t.TempDir()
+	secrets := filepath.Join(dir, "secrets")
+	os.WriteFile(secrets, []byte("aabbccddeeff00112233445566778899,ffeeddccbbaa00112233445566778899"), 0600)
+	pwd := filepath.Join(dir, "proxy-secret")
+	os.WriteFile(pwd, bytes.Repeat([]byte{1, 2, 3, 4}, 8), 0600)
+
+	checks, aes := CheckSecretSources(secrets, "", pwd, "", "")
+	if len(checks) != 2 {
+		t.Fatalf("got %d checks, want 2: %+v", len(checks), checks)
+	}
+	for _, c := range checks {
+		if c.Err != nil {
+			t.Errorf("%s: %v", c.Name, c.Err)
+		}
+	}
+	if len(aes) != 32 {
+		t.Errorf("aes secret of %d bytes, want 32", len(aes))
+	}
+
+	os.WriteFile(pwd, []byte("short"), 0600)
+	checks, aes = CheckSecretSources("", filepath.Join(dir, "missing"), pwd, "", "")
+	if len(checks) != 2 || checks[0].Err == nil || checks[1].Err == nil || aes != nil {
+		t.Errorf("missing dir and short pwd: checks %+v, aes %x", checks, aes)
+	}
+	checks, _ = CheckSecretSources("", "", "", "A", "b")
+	if len(checks) != 1 || checks[0].Err == nil {
+		t.Errorf("both key flags: checks %+v", checks)
+	}
+}
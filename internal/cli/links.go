@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// ClientSecret returns the secret a client is given for the proxy secret
+// secret: "dd" + hex for the padded transport or, with a fake TLS domain,
+// "ee" + hex + the hex of the domain.
+func ClientSecret(secret []byte, domain string) string {
+	if domain != "" {
+		return "ee" + hex.EncodeToString(secret) + hex.EncodeToString([]byte(domain))
+	}
+	return "dd" + hex.EncodeToString(secret)
+}
+
+// ProxyLinks returns the tg:// link and the https://t.me link that add
+// the proxy at host:port with clientSecret to a Telegram client.
+func ProxyLinks(host string, port int, clientSecret string) (tg, web string) {
+	query := fmt.Sprintf("server=%s&port=%d&secret=%s", url.QueryEscape(host), port, clientSecret)
+	return "tg://proxy?" + query, "https://t.me/proxy?" + query
+}
+
+// checkDomain rejects values that cannot be a fake TLS domain.
+func checkDomain(domain string) error {
+	if domain == "" || len(domain) > 253 || strings.ContainsAny(domain, " \t/:") || !strings.Contains(domain, ".") {
+		return fmt.Errorf("%q is not a domain name", domain)
+	}
+	return nil
+}
+
+// GenSecret implements "mtproto-proxy gensecret [--ee domain]": it prints a
+// new random secret for -S and the client secret to hand out, dd-prefixed
+// or, with --ee, the fake TLS form for that domain (run the proxy with
+// -D domain then). It returns the exit code.
+func GenSecret(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("gensecret", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	domain := fs.String("ee", "", "make a fake TLS (ee) client secret for this domain")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintf(stderr, "usage: mtproto-proxy gensecret [--ee <domain>]\n")
+		return 2
+	}
+	if *domain != "" {
+		if err := checkDomain(*domain); err != nil {
+			fmt.Fprintf(stderr, "error: --ee: %v\n", err)
+			return 2
+		}
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "secret:        %s\n", hex.EncodeToString(secret))
+	fmt.Fprintf(stdout, "client secret: %s\n", ClientSecret(secret, *domain))
+	if *domain != "" {
+		fmt.Fprintf(stderr, "run the proxy with -S %s -D %s\n", hex.EncodeToString(secret), *domain)
+	}
+	return 0
+}
+
+// GetLink implements "mtproto-proxy getlink --host <host> [--port <port>]":
+// it prints the share links of every secret given with the proxy's own
+// options (-S, --mtproto-secret-file, --mtproto-secret-dir and the secrets
+// key options for sealed files), which it takes like the proxy does, from
+// the command line, MTPROXY_GO_* variables and --config-yaml; the rest of
+// the proxy's command line, config file included, is accepted and ignored.
+// With -D the links are for fake TLS with the first domain, as the proxy
+// then accepts nothing else. It returns the exit code.
+func GetLink(args []string, stdout, stderr io.Writer) int {
+	var host string
+	var port int
+	opts, positional, err := ParseSubcommand("getlink", args, stderr, func(fs *flag.FlagSet) {
+		fs.StringVar(&host, "host", "", "public host name or address clients connect to")
+		fs.IntVar(&port, "port", 443, "client port")
+	})
+	if err != nil {
+		return 2
+	}
+	if host == "" || len(positional) > 1 {
+		fmt.Fprintf(stderr, "usage: mtproto-proxy getlink --host <host> [--port <port>] -S <secret>... [-D <domain>]\n")
+		return 2
+	}
+	if port < 1 || port > 65535 {
+		fmt.Fprintf(stderr, "error: --port must be 1-65535, got %d\n", port)
+		return 2
+	}
+	if err := opts.readSecretsKey(); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+	secrets, err := opts.LoadSecrets()
+	if err != nil {
+		fmt.Fprintf(stderr, "error loading secrets: %v\n", err)
+		return 1
+	}
+	if len(secrets) == 0 {
+		fmt.Fprintf(stderr, "error: no secrets given (-S, --mtproto-secret-file or --mtproto-secret-dir)\n")
+		return 2
+	}
+	domain := ""
+	if len(opts.Domains) > 0 {
+		domain = opts.Domains[0]
+	}
+	for i, s := range secrets {
+		tg, web := ProxyLinks(host, port, ClientSecret(s, domain))
+		fmt.Fprintf(stdout, "secret %d:\n  %s\n  %s\n", i+1, tg, web)
+	}
+	return 0
+}
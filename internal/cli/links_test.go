@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestClientSecret(t *testing.T) {
+	secret, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+	if got := ClientSecret(secret, ""); got != "dd0123456789abcdef0123456789abcdef" {
+		t.Errorf("dd secret = %s", got)
+	}
+	ee := ClientSecret(secret, "example.com")
+	if ee != "ee0123456789abcdef0123456789abcdef"+hex.EncodeToString([]byte("example.com")) {
+		t.Errorf("ee secret = %s", ee)
+	}
+	// The proxy's own -S parsing takes both forms back.
+	for _, v := range []string{ClientSecret(secret, ""), ee} {
+		b, err := decodeHexSecret("-S", v, 16)
+		if err != nil || !bytes.Equal(b, secret) {
+			t.Errorf("decodeHexSecret(%s) = %x, %v", v, b, err)
+		}
+	}
+}
+
+func TestGenSecret(t *testing.T) {
+	var out, errOut bytes.Buffer
+	if code := GenSecret([]string{"--ee", "example.com"}, &out, &errOut); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("output:\n%s", out.String())
+	}
+	secret := strings.TrimSpace(strings.TrimPrefix(lines[0], "secret:"))
+	client := strings.TrimSpace(strings.TrimPrefix(lines[1], "client secret:"))
+	if len(secret) != 32 || client != "ee"+secret+hex.EncodeToString([]byte("example.com")) {
+		t.Errorf("secret %q, client secret %q", secret, client)
+	}
+	if code := GenSecret([]string{"--ee", "not a domain"}, &out, &errOut); code != 2 {
+		t.Errorf("bad domain: exit %d, want 2", code)
+	}
+}
+
+func TestGetLink(t *testing.T) {
+	var out, errOut bytes.Buffer
+	code := GetLink([]string{"--host", "proxy.example.com", "--port", "8443",
+		"-S", "0123456789abcdef0123456789abcdef", "-S", "ffffffffffffffffffffffffffffffff"}, &out, &errOut)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	for _, want := range []string{
+		"tg://proxy?server=proxy.example.com&port=8443&secret=dd0123456789abcdef0123456789abcdef",
+		"https://t.me/proxy?server=proxy.example.com&port=8443&secret=ddffffffffffffffffffffffffffffffff",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	GetLink([]string{"--host", "1.2.3.4", "-S", "0123456789abcdef0123456789abcdef", "-D", "example.com"}, &out, &errOut)
+	if !strings.Contains(out.String(), "port=443&secret=ee0123456789abcdef0123456789abcdef"+hex.EncodeToString([]byte("example.com"))) {
+		t.Errorf("fake TLS link missing in:\n%s", out.String())
+	}
+
+	if code := GetLink([]string{"-S", "0123456789abcdef0123456789abcdef"}, &out, &errOut); code != 2 {
+		t.Errorf("without --host: exit %d, want 2", code)
+	}
+	if code := GetLink([]string{"--host", "h"}, &out, &errOut); code != 2 {
+		t.Errorf("without secrets: exit %d, want 2", code)
+	}
+
+	// The secret comes from the environment as for the proxy, whose other
+	// options and config file are accepted.
+	t.Setenv(OptionsEnvPrefix+"MTPROTO_SECRET", "0123456789abcdef0123456789abcdef")
+	out.Reset()
+	if code := GetLink([]string{"--host", "h", "-M", "2", "proxy-multi.conf"}, &out, &errOut); code != 0 {
+		t.Fatalf("secret from the environment: exit %d: %s", code, errOut.String())
+	}
+	if !strings.Contains(out.String(), "secret=dd0123456789abcdef0123456789abcdef") {
+		t.Errorf("link missing in:\n%s", out.String())
+	}
+}
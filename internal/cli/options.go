@@ -4,14 +4,30 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+	"github.com/skrashevich/MTProxy/internal/proxy"
 )
 
 const (
 	DefaultPort    = 8888
 	DefaultWorkers = 1
+
+	DefaultAcceptLoops = 1
+
+	// MaxDedupFrames caps --dedup-frames.
+	MaxDedupFrames = 64
 )
 
 // Options holds all parsed CLI flags, matching the C mtproto-proxy flags exactly.
@@ -27,46 +43,333 @@ type Options struct {
 	// -M / --slaves — number of worker processes (default 1).
 	Workers int
 
+	// --inherit-listeners — with -M, the supervisor binds the client ports
+	// and passes them to the workers instead of each binding with SO_REUSEPORT.
+	InheritListeners bool
+
 	// -H / --http-ports — comma-separated list of HTTP listen ports.
 	HTTPPorts []int
 
+	// --udp-ports — comma-separated list of experimental UDP client ports.
+	UDPPorts []int
+
+	// --accept-loops — number of accept goroutines per client listener (default 1).
+	AcceptLoops int
+
+	// --latency-sample-rate — record timing for one in N frames (0 = disabled).
+	LatencySampleRate int
+
+	// --latency-reservoir — number of latency samples kept for /debug/latency
+	// (0 = proxy.DefaultLatencyReservoir).
+	LatencyReservoir int
+
+	// --enable-pprof — serve net/http/pprof under /debug/pprof/ on the stats
+	// listener.
+	EnablePprof bool
+
+	// --authorizer — external connection authorizer: http(s)://... or unix:/path.
+	AuthorizerURL string
+
+	// --authorizer-timeout — per-call authorizer timeout in seconds.
+	AuthorizerTimeout float64
+
+	// --authorizer-fail-open — allow connections when the authorizer fails.
+	AuthorizerFailOpen bool
+
+	// --duplicate-targets — "dedup" drops repeated proxy_for lines within a
+	// cluster, "weight" keeps them as extra selection weight.
+	DuplicateTargets string
+
+	// --balance — how a target is picked within a cluster: random,
+	// round-robin, least-outstanding, weighted or hash (by auth_key_id).
+	Balance string
+
+	// --session-affinity — seconds a session (auth_key_id) stays pinned to
+	// its target after its last packet (0 = off); --session-affinity-max
+	// caps the pinned sessions.
+	SessionAffinity    float64
+	SessionAffinityMax int
+
+	// --routing-seed — seed for random target selection (0 = random; the
+	// seed in use is logged at startup).
+	RoutingSeed int64
+
+	// --min-default-targets — refuse config reloads that leave the default
+	// cluster with fewer targets (0 = no check).
+	MinDefaultTargets int
+
+	// --config-url / --config-fetch-interval / --config-fetch-jitter —
+	// download proxy-multi.conf from the URL every interval plus a random
+	// delay up to the jitter, in seconds, and apply it (interval 0 = off).
+	ConfigURL           string
+	ConfigFetchInterval float64
+	ConfigFetchJitter   float64
+
+	// --watch-config / --watch-config-debounce — reload the config and the
+	// secret file like SIGHUP once they change and stay unchanged for the
+	// debounce time, in seconds.
+	WatchConfig         bool
+	WatchConfigDebounce float64
+
 	// --aes-pwd — path to file with AES RPC secret.
 	AESPwdFile string
 
 	// --http-stats — enable HTTP stats endpoint on the main port.
 	HTTPStats bool
 
+	// --stats-addr — explicit host:port for the stats listener. Implies
+	// --http-stats; when empty the address is derived from -H.
+	StatsAddr string
+
+	// --admin-socket — unix socket (path, or @name for the Linux abstract
+	// namespace) serving the stats and admin API.
+	AdminSocket string
+
+	// --admin-uid — UIDs besides the proxy's own allowed on the admin
+	// socket; repeatable.
+	AdminUIDs []uint32
+
+	// --ingress-stats — client networks (CIDR or bare IP, comma-separated
+	// or repeated) whose plain HTTP GET /stats on the client port is
+	// answered; empty = off.
+	IngressStats []netip.Prefix
+
+	// --trace-conn — clients (CIDR or bare IP, comma-separated or repeated)
+	// whose connections log every frame.
+	TraceConn []netip.Prefix
+
 	// --max-special-connections / -C — max accepted client connections per worker.
 	MaxSpecialConnections int
 
+	// --overload-policy — what to shed once -C sessions or --memory-budget
+	// is reached: accept, close or handshake.
+	OverloadPolicy string
+
+	// --memory-budget — heap size in MiB above which the proxy is overloaded (0 = off).
+	MemoryBudget int
+
+	// --max-handlers-per-cpu — connection handler goroutines allowed per
+	// GOMAXPROCS; connections over the cap are rejected at accept (0 = off).
+	MaxHandlersPerCPU int
+
 	// --window-clamp / -W — TCP window clamp for client connections.
 	WindowClamp int
 
-	// -u / --user — username for setuid.
+	// --msg-buffers-size — bytes of frame buffers kept for reuse, with an
+	// optional k/m/g/t suffix as in the C proxy (default 256m).
+	MsgBuffersSize int64
+
+	// --tcp-nodelay — disable Nagle's algorithm on client and DC sockets
+	// (the Go default); --tcp-keepalive — keepalive idle time and probe
+	// interval in seconds (0 = Go default); --tcp-user-timeout — seconds sent
+	// data may stay unacknowledged before the connection is dropped (0 = off).
+	TCPNoDelay     bool
+	TCPKeepAlive   float64
+	TCPUserTimeout float64
+
+	// --block-threshold — failed handshakes from one IP within --block-window
+	// seconds that get it blocked for --block-ttl seconds (0 = disabled).
+	BlockThreshold int
+	BlockWindow    float64
+	BlockTTL       float64
+
+	// --block-file — file the blocklist is persisted to across restarts.
+	BlockFile string
+
+	// --surge-factor — connection rate, as a multiple of the learned
+	// baseline, that tightens admission for --surge-cooldown seconds
+	// (0 = disabled); --surge-min-rate — connections per minute below which
+	// no surge is declared.
+	SurgeFactor   float64
+	SurgeMinRate  int
+	SurgeCooldown float64
+
+	// --max-conns-per-ip — open connections allowed from one source IP;
+	// --per-ip-accept-rate — new connections per second allowed from one
+	// source IP (0 = unlimited).
+	MaxConnsPerIP   int
+	PerIPAcceptRate float64
+
+	// --standby — bind listeners but accept only after SIGUSR2 or
+	// POST /admin/activate on --admin-socket.
+	Standby bool
+
+	// --public-host — host clients use to reach the proxy, reported in the
+	// registration descriptor.
+	PublicHost string
+
+	// --descriptor-file — where to write the registration descriptor (JSON).
+	DescriptorFile string
+
+	// --crash-dir — directory for crash reports written on panic.
+	CrashDir string
+
+	// --cpu-profile-dir / --cpu-profile-threshold / --cpu-profile-after /
+	// --cpu-profile-keep — capture a CPU profile into the directory when
+	// usage stays above the threshold (percent of GOMAXPROCS) for the given
+	// seconds, keeping the newest N profiles (empty dir = off).
+	CPUProfileDir       string
+	CPUProfileThreshold float64
+	CPUProfileAfter     float64
+	CPUProfileKeep      int
+
+	// --final-stats-file — where to write the last stats snapshot (JSON) on
+	// shutdown.
+	FinalStatsFile string
+
+	// --shutdown-grace — seconds that open client sessions may keep running
+	// after SIGTERM before they are closed.
+	ShutdownGrace float64
+
+	// --exit-audit — on shutdown, check that listeners, backend connections,
+	// sessions and goroutines were all released, and exit non-zero if not.
+	ExitAudit bool
+
+	// -u / --user — account a process started as root switches to once its
+	// ports are bound.
 	Username string
 
-	// -6 — prefer IPv6.
+	// --max-frame-pre-handshake / --max-frame-unencrypted / --max-frame-encrypted —
+	// client frame size caps: before the first encrypted frame, for DH
+	// (auth_key_id == 0) frames and for encrypted frames, in bytes.
+	MaxFramePreHandshake int
+	MaxFrameUnencrypted  int
+	MaxFrameEncrypted    int
+
+	// --answer-pings — answer client transport pings (RPC_PING frames)
+	// locally instead of forwarding them to a DC.
+	AnswerPings bool
+
+	// --dedup-frames — per-session (auth_key_id) window of recent client
+	// frames whose exact repeats are dropped before forwarding, whichever
+	// connection they arrive on (0 = off).
+	DedupFrames int
+
+	// --inject-latency / --inject-jitter — artificial delay, in seconds,
+	// added to every frame written to a client, plus a random share of
+	// the jitter (0 = off). For testing only.
+	InjectLatency float64
+	InjectJitter  float64
+
+	// --max-response-size — largest frame accepted from a DC, in bytes.
+	MaxResponseSize int
+
+	// --response-first-byte-timeout / --response-stall-timeout — how long a
+	// forwarded request waits for its response to start, and the longest gap
+	// allowed within a DC frame once it has started, in seconds.
+	ResponseFirstByteTimeout float64
+	ResponseStallTimeout     float64
+
+	// --dns — DNS servers for target lookups (udp://, tls:// or https://);
+	// repeatable. Empty means the system resolver.
+	DNSServers []string
+
+	// --outbound-device — bind outbound DC connections to this interface or
+	// VRF device (SO_BINDTODEVICE, Linux only).
+	OutboundDevice string
+
+	// --outbound-proxy — reach DCs through these SOCKS5 proxies
+	// (socks5://[user:password@]host:port), tried in order; repeatable.
+	// Empty means direct connections.
+	OutboundProxies []string
+
+	// --loopback-backend — answer every request with the client packet it
+	// carries instead of forwarding it to a DC (local testing only).
+	LoopbackBackend bool
+
+	// --test-backend — start an in-process mock middle proxy and route every
+	// DC to it instead of Telegram (local testing and CI only); the config
+	// file argument is then omitted.
+	TestBackend bool
+
+	// -6 / --ipv6 — prefer IPv6 targets, falling back to IPv4 ones.
 	PreferIPv6 bool
 
 	// -v / --verbosity — verbosity level.
 	Verbosity int
 
-	// -d / --daemonize — daemonize.
+	// -d / --daemonize — detach from the terminal and run in the background.
 	Daemonize bool
 
+	// -l / --log — log file; with -d stdout and stderr go there, otherwise
+	// log lines are written there as well as to stderr.
+	LogFile string
+
+	// --pid-file — file the process id is written to while running.
+	PidFile string
+
 	// --domain / -D — TLS domain(s), disables other transports when set.
 	Domains []string
 
+	// --fallback-addr — host:port of the web server that connections which
+	// are not proxy clients are handed to instead of being closed.
+	FallbackAddr string
+
 	// --ping-interval / -T — ping interval in seconds.
 	PingInterval float64
 
+	// --health-check-interval — seconds between active probes of every
+	// config target (0 = off); --health-check-timeout bounds one probe, and
+	// --health-check-rise / --health-check-fall are the successful and
+	// failed probes in a row that turn a target healthy and unhealthy.
+	HealthCheckInterval float64
+	HealthCheckTimeout  float64
+	HealthCheckRise     int
+	HealthCheckFall     int
+
+	// --dial-backoff-max — longest backoff, in seconds, of a target whose
+	// connects fail: the wait starts at 1s and doubles with each failure
+	// (0 = off, every request dials).
+	DialBackoffMax float64
+
 	// --mtproto-secret-file — path to file with secrets.
 	SecretFile string
 
+	// --mtproto-secret-dir — directory with one secret per file; watched for changes.
+	SecretDir string
+
+	// --secret-revoke-grace — seconds after which connections using a secret
+	// removed on reload are closed (0 = they run to completion).
+	SecretRevokeGrace float64
+
+	// --secrets-key-env / --secrets-key-command — where the key for sealed
+	// (encrypted) --aes-pwd and secret files comes from: an environment
+	// variable, or the output of a shell command such as a KMS decrypt.
+	SecretsKeyEnv     string
+	SecretsKeyCommand string
+
+	// --seal — encrypt this file with the secrets key to stdout and exit.
+	SealFile string
+
+	// secretsKey is the key read from SecretsKeyEnv or SecretsKeyCommand at
+	// startup, or nil.
+	secretsKey []byte
+
+	// proxyTagHex is -P / --proxy-tag as given, decoded into ProxyTag.
+	proxyTagHex string
+
+	// staticSecrets is the number of leading entries of Secrets that come from
+	// -S; the rest were loaded from SecretFile and SecretDir and are replaced
+	// on reload.
+	staticSecrets int
+
+	// Validity windows keyed by string(secret), from SecretFile and SecretDir
+	// entries; replaced by LoadSecrets under windowsMu.
+	windowsMu sync.RWMutex
+	windows   map[string]SecretWindow
+
 	// --nat-info — NAT translation rules: local_ip:public_ip.
 	// Maps local (private) IPs to public IPs for key derivation.
 	NatInfo map[string]string
 
+	// --config-yaml — YAML or TOML file with long options as keys, below the
+	// MTPROXY_GO_* environment variables and the command line in precedence.
+	ConfigYAML string
+
+	// Settings is the effective value and source of every option
+	// (/debug/config).
+	Settings []Setting
+
 	// Positional argument: path to proxy-multi.conf.
 	ConfigFile string
 }
@@ -91,18 +394,145 @@ type domainFlag struct {
 	domains *[]string
 }
 
-func (d *domainFlag) String() string { return "" }
+func (d *domainFlag) String() string {
+	if d.domains == nil {
+		return ""
+	}
+	return strings.Join(*d.domains, ",")
+}
 func (d *domainFlag) Set(v string) error {
 	*d.domains = append(*d.domains, v)
 	return nil
 }
 
+// dnsFlag accumulates multiple --dns values.
+type dnsFlag struct {
+	servers *[]string
+}
+
+func (d *dnsFlag) String() string {
+	if d.servers == nil {
+		return ""
+	}
+	return strings.Join(*d.servers, ",")
+}
+func (d *dnsFlag) Set(v string) error {
+	*d.servers = append(*d.servers, v)
+	return nil
+}
+
+// outboundProxyFlag accumulates multiple --outbound-proxy values.
+type outboundProxyFlag struct {
+	urls *[]string
+}
+
+// String hides the passwords of the proxy URLs.
+func (o *outboundProxyFlag) String() string {
+	if o.urls == nil {
+		return ""
+	}
+	out := make([]string, len(*o.urls))
+	for i, v := range *o.urls {
+		if u, err := url.Parse(v); err == nil {
+			v = u.Redacted()
+		}
+		out[i] = v
+	}
+	return strings.Join(out, ",")
+}
+
+// Set rejects http:// upstreams up front: an HTTP CONNECT reply does not
+// tell the address the upstream connects from, which the middle-proxy
+// handshake keys are derived from, so every handshake through one fails.
+func (o *outboundProxyFlag) Set(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "socks5":
+	case "http", "https":
+		return fmt.Errorf("%s: HTTP CONNECT upstreams cannot carry middle-proxy handshakes, use socks5://", u.Redacted())
+	default:
+		return fmt.Errorf("%s: scheme must be socks5", u.Redacted())
+	}
+	*o.urls = append(*o.urls, v)
+	return nil
+}
+
+// uidFlag accumulates multiple --admin-uid values.
+type uidFlag struct {
+	uids *[]uint32
+}
+
+func (u *uidFlag) String() string {
+	if u.uids == nil {
+		return ""
+	}
+	out := make([]string, len(*u.uids))
+	for i, uid := range *u.uids {
+		out[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	return strings.Join(out, ",")
+}
+func (u *uidFlag) Set(v string) error {
+	uid, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q", v)
+	}
+	*u.uids = append(*u.uids, uint32(uid))
+	return nil
+}
+
+// prefixFlag accumulates comma-separated CIDRs or bare IPs.
+type prefixFlag struct {
+	prefixes *[]netip.Prefix
+}
+
+func (f *prefixFlag) String() string {
+	if f.prefixes == nil {
+		return ""
+	}
+	out := make([]string, len(*f.prefixes))
+	for i, p := range *f.prefixes {
+		out[i] = p.String()
+	}
+	return strings.Join(out, ",")
+}
+func (f *prefixFlag) Set(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(part); err == nil {
+			*f.prefixes = append(*f.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(part)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", part)
+		}
+		*f.prefixes = append(*f.prefixes, p.Masked())
+	}
+	return nil
+}
+
 // httpPortsFlag parses comma-separated port list.
 type httpPortsFlag struct {
 	ports *[]int
 }
 
-func (h *httpPortsFlag) String() string { return "" }
+func (h *httpPortsFlag) String() string {
+	if h.ports == nil {
+		return ""
+	}
+	out := make([]string, len(*h.ports))
+	for i, p := range *h.ports {
+		out[i] = strconv.Itoa(p)
+	}
+	return strings.Join(out, ",")
+}
 func (h *httpPortsFlag) Set(v string) error {
 	for _, part := range strings.Split(v, ",") {
 		part = strings.TrimSpace(part)
@@ -118,16 +548,53 @@ func (h *httpPortsFlag) Set(v string) error {
 	return nil
 }
 
-// Parse parses os.Args[1:] and returns the filled Options.
-// On error it prints usage and calls os.Exit(2).
-func Parse() *Options {
+// newOptionSet returns Options with their defaults and a flag set named
+// name declaring every proxy option on them. Parse and the subcommands that
+// take the proxy's options (ParseSubcommand) share it, so they accept the
+// same flags.
+func newOptionSet(name string) (*Options, *flag.FlagSet) {
 	opts := &Options{
-		Workers:      DefaultWorkers,
-		PingInterval: 5.0,
+		Workers:           DefaultWorkers,
+		PingInterval:      5.0,
+		AcceptLoops:       DefaultAcceptLoops,
+		AuthorizerTimeout: 0.2,
+		DuplicateTargets:  "dedup",
+		Balance:           "random",
+		OverloadPolicy:    "accept",
+		BlockWindow:       60,
+		BlockTTL:          600,
+		SurgeMinRate:      600,
+		SurgeCooldown:     300,
+		MaxResponseSize:   2 * 1024 * 1024,
+		ConfigURL:         config.DefaultFetchURL,
+		ConfigFetchJitter: 60,
+
+		SessionAffinityMax: 100000,
+
+		CPUProfileThreshold: 80,
+		CPUProfileAfter:     30,
+		CPUProfileKeep:      10,
+		ShutdownGrace:       5,
+
+		HealthCheckTimeout: 5,
+		HealthCheckRise:    2,
+		HealthCheckFall:    3,
+
+		DialBackoffMax: 60,
+
+		TCPNoDelay: true,
+
+		MsgBuffersSize: 1 << 28,
+
+		ResponseFirstByteTimeout: 30,
+		ResponseStallTimeout:     5,
+
+		MaxFramePreHandshake: 128 * 1024,
+		MaxFrameUnencrypted:  8 * 1024,
+		MaxFrameEncrypted:    16 * 1024 * 1024,
 	}
 
-	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
-	fs.Usage = func() { PrintUsage(fs) }
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
 
 	// -S / --mtproto-secret (repeatable)
 	sf := &secretFlag{secrets: &opts.Secrets}
@@ -137,62 +604,250 @@ func Parse() *Options {
 	// --mtproto-secret-file
 	fs.StringVar(&opts.SecretFile, "mtproto-secret-file", "", "path to file with mtproto secrets (comma or whitespace-separated)")
 
+	// --mtproto-secret-dir
+	fs.StringVar(&opts.SecretDir, "mtproto-secret-dir", "", "directory with one mtproto secret per file; reloaded on change")
+
+	// --secret-revoke-grace
+	fs.Float64Var(&opts.SecretRevokeGrace, "secret-revoke-grace", 0, "close connections using a removed secret after this many seconds (0 = keep them)")
+
+	// --secrets-key-env / --secrets-key-command / --seal
+	fs.StringVar(&opts.SecretsKeyEnv, "secrets-key-env", "", "environment variable holding the key for encrypted secret files (hex or base64)")
+	fs.StringVar(&opts.SecretsKeyCommand, "secrets-key-command", "", "shell command printing the key for encrypted secret files")
+	fs.StringVar(&opts.SealFile, "seal", "", "encrypt this file with the secrets key to stdout and exit")
+
 	// -P / --proxy-tag
-	proxyTagStr := ""
-	fs.StringVar(&proxyTagStr, "P", "", "16-byte proxy tag in hex (32 hex chars)")
-	fs.StringVar(&proxyTagStr, "proxy-tag", "", "16-byte proxy tag in hex (32 hex chars)")
+	fs.StringVar(&opts.proxyTagHex, "P", "", "16-byte proxy tag in hex (32 hex chars)")
+	fs.StringVar(&opts.proxyTagHex, "proxy-tag", "", "16-byte proxy tag in hex (32 hex chars)")
 
 	// -M / --slaves
 	fs.IntVar(&opts.Workers, "M", DefaultWorkers, "number of worker processes")
 	fs.IntVar(&opts.Workers, "slaves", DefaultWorkers, "number of worker processes")
+	fs.BoolVar(&opts.InheritListeners, "inherit-listeners", false, "with -M, bind client ports in the supervisor and pass them to workers")
 
 	// -H / --http-ports
 	hpf := &httpPortsFlag{ports: &opts.HTTPPorts}
 	fs.Var(hpf, "H", "comma-separated list of HTTP listen ports")
 	fs.Var(hpf, "http-ports", "comma-separated list of HTTP listen ports")
 
+	// --udp-ports
+	fs.Var(&httpPortsFlag{ports: &opts.UDPPorts}, "udp-ports", "comma-separated list of experimental UDP client ports")
+
+	// --accept-loops
+	fs.IntVar(&opts.AcceptLoops, "accept-loops", DefaultAcceptLoops, "number of accept goroutines per client listener")
+
+	// --latency-sample-rate / --latency-reservoir
+	fs.IntVar(&opts.LatencySampleRate, "latency-sample-rate", 0, "record per-frame latency for one in N frames (0 = disabled)")
+	fs.IntVar(&opts.LatencyReservoir, "latency-reservoir", 0, fmt.Sprintf("number of latency samples kept for /debug/latency (0 = %d)", proxy.DefaultLatencyReservoir))
+
+	// --enable-pprof
+	fs.BoolVar(&opts.EnablePprof, "enable-pprof", false, "serve net/http/pprof under /debug/pprof/ on the stats listener")
+
+	// --authorizer / --authorizer-timeout / --authorizer-fail-open
+	fs.StringVar(&opts.AuthorizerURL, "authorizer", "", "external connection authorizer: http(s)://... or unix:/path")
+	fs.Float64Var(&opts.AuthorizerTimeout, "authorizer-timeout", 0.2, "authorizer call timeout in seconds")
+	fs.BoolVar(&opts.AuthorizerFailOpen, "authorizer-fail-open", false, "allow connections when the authorizer is unavailable")
+
+	// --duplicate-targets
+	fs.StringVar(&opts.DuplicateTargets, "duplicate-targets", "dedup", "repeated proxy_for targets: dedup or weight")
+
+	// --balance
+	fs.StringVar(&opts.Balance, "balance", "random", "target selection: random, round-robin, least-outstanding, weighted or hash")
+
+	// --session-affinity / --session-affinity-max
+	fs.Float64Var(&opts.SessionAffinity, "session-affinity", 0, "pin each session to its target for this many idle seconds (0 = off)")
+	fs.IntVar(&opts.SessionAffinityMax, "session-affinity-max", 100000, "most sessions pinned at once")
+
+	// --routing-seed
+	fs.Int64Var(&opts.RoutingSeed, "routing-seed", 0, "seed for random target selection (0 = random, logged at startup)")
+
+	// --min-default-targets
+	fs.IntVar(&opts.MinDefaultTargets, "min-default-targets", 0, "reject reloads leaving the default cluster with fewer targets (0 = off)")
+
+	// --config-url / --config-fetch-interval / --config-fetch-jitter
+	fs.StringVar(&opts.ConfigURL, "config-url", config.DefaultFetchURL, "URL to download proxy-multi.conf from")
+	fs.Float64Var(&opts.ConfigFetchInterval, "config-fetch-interval", 0, "download and apply the config every N seconds (0 = off)")
+	fs.Float64Var(&opts.ConfigFetchJitter, "config-fetch-jitter", 60, "random extra delay before each config download, seconds")
+
+	// --watch-config / --watch-config-debounce
+	fs.BoolVar(&opts.WatchConfig, "watch-config", false, "reload the config and secret file when they change, like SIGHUP")
+	fs.Float64Var(&opts.WatchConfigDebounce, "watch-config-debounce", 2, "seconds a changed file must stay unchanged before the reload")
+
 	// --aes-pwd
 	fs.StringVar(&opts.AESPwdFile, "aes-pwd", "", "path to AES secret file for RPC")
 
 	// --http-stats
 	fs.BoolVar(&opts.HTTPStats, "http-stats", false, "enable HTTP stats endpoint")
 
+	// --stats-addr
+	fs.StringVar(&opts.StatsAddr, "stats-addr", "", "host:port for the HTTP stats listener (implies --http-stats)")
+
+	// --admin-socket / --admin-uid (repeatable)
+	fs.StringVar(&opts.AdminSocket, "admin-socket", "", "unix socket for the stats and admin API: path or @name (abstract, Linux)")
+	fs.Var(&uidFlag{uids: &opts.AdminUIDs}, "admin-uid", "UID allowed on the admin socket besides the proxy's own; may be repeated")
+
+	// --ingress-stats (repeatable)
+	fs.Var(&prefixFlag{prefixes: &opts.IngressStats}, "ingress-stats", "answer HTTP GET /stats on the client port for these networks (CIDR or IP, comma-separated)")
+	// --trace-conn (repeatable)
+	fs.Var(&prefixFlag{prefixes: &opts.TraceConn}, "trace-conn", "log every frame of connections from these clients (CIDR or IP, comma-separated)")
+
 	// -C / --max-special-connections
 	fs.IntVar(&opts.MaxSpecialConnections, "C", 0, "max client connections per worker (0 = unlimited)")
 	fs.IntVar(&opts.MaxSpecialConnections, "max-special-connections", 0, "max client connections per worker (0 = unlimited)")
 
+	// --overload-policy / --memory-budget
+	fs.StringVar(&opts.OverloadPolicy, "overload-policy", "accept", "when overloaded: accept (reject new connections), close (fast-close sessions) or handshake (drop sessions yet to send a frame, oldest first)")
+	fs.IntVar(&opts.MemoryBudget, "memory-budget", 0, "heap size in MiB above which the proxy sheds load (0 = disabled)")
+
+	// --max-handlers-per-cpu
+	fs.IntVar(&opts.MaxHandlersPerCPU, "max-handlers-per-cpu", 0, "connection handler goroutines allowed per GOMAXPROCS (0 = unlimited)")
+
 	// -W / --window-clamp
 	fs.IntVar(&opts.WindowClamp, "W", 0, "TCP window clamp for client connections (0 = default 131072)")
 	fs.IntVar(&opts.WindowClamp, "window-clamp", 0, "TCP window clamp for client connections")
 
+	// --msg-buffers-size
+	fs.Var(&memoryLimitFlag{&opts.MsgBuffersSize}, "msg-buffers-size", "bytes of frame buffers kept for reuse, with an optional k/m/g/t suffix (default 256m)")
+
+	// --tcp-nodelay / --tcp-keepalive / --tcp-user-timeout
+	fs.BoolVar(&opts.TCPNoDelay, "tcp-nodelay", true, "set TCP_NODELAY on client and DC sockets")
+	fs.Float64Var(&opts.TCPKeepAlive, "tcp-keepalive", 0, "TCP keepalive idle time and interval in seconds (0 = default)")
+	fs.Float64Var(&opts.TCPUserTimeout, "tcp-user-timeout", 0, "seconds unacknowledged data may wait before the socket is dropped (0 = off)")
+
+	// --block-threshold / --block-window / --block-ttl / --block-file
+	fs.IntVar(&opts.BlockThreshold, "block-threshold", 0, "failed handshakes per window that block a source IP (0 = disabled)")
+	fs.Float64Var(&opts.BlockWindow, "block-window", 60, "window for counting failed handshakes, seconds")
+	fs.Float64Var(&opts.BlockTTL, "block-ttl", 600, "how long a source IP stays blocked, seconds")
+	fs.StringVar(&opts.BlockFile, "block-file", "", "persist the blocklist to this file across restarts")
+
+	// --surge-factor / --surge-min-rate / --surge-cooldown
+	fs.Float64Var(&opts.SurgeFactor, "surge-factor", 0, "connection rate, as a multiple of the baseline, that tightens admission (0 = disabled)")
+	fs.IntVar(&opts.SurgeMinRate, "surge-min-rate", 600, "connections per minute below which no surge is declared")
+	fs.Float64Var(&opts.SurgeCooldown, "surge-cooldown", 300, "how long admission stays tightened after a surge, seconds")
+
+	// --max-conns-per-ip / --per-ip-accept-rate
+	fs.IntVar(&opts.MaxConnsPerIP, "max-conns-per-ip", 0, "open connections allowed per source IP (0 = unlimited)")
+	fs.Float64Var(&opts.PerIPAcceptRate, "per-ip-accept-rate", 0, "new connections per second allowed per source IP (0 = unlimited)")
+
+	// --standby
+	fs.BoolVar(&opts.Standby, "standby", false, "start in warm standby: listen but accept only after SIGUSR2 or POST /admin/activate on --admin-socket")
+
+	// --public-host / --descriptor-file
+	fs.StringVar(&opts.PublicHost, "public-host", "", "public host or IP reported in the registration descriptor")
+	fs.StringVar(&opts.DescriptorFile, "descriptor-file", "", "write a JSON registration descriptor to this file after startup")
+
+	// --crash-dir
+	fs.StringVar(&opts.CrashDir, "crash-dir", "", "directory for crash reports (panic, stack, stats, build info)")
+
+	// --cpu-profile-dir / --cpu-profile-threshold / --cpu-profile-after / --cpu-profile-keep
+	fs.StringVar(&opts.CPUProfileDir, "cpu-profile-dir", "", "capture CPU profiles here when usage stays high")
+	fs.Float64Var(&opts.CPUProfileThreshold, "cpu-profile-threshold", 80, "CPU usage, percent of GOMAXPROCS, that triggers a profile")
+	fs.Float64Var(&opts.CPUProfileAfter, "cpu-profile-after", 30, "seconds the usage must stay above the threshold")
+	fs.IntVar(&opts.CPUProfileKeep, "cpu-profile-keep", 10, "number of CPU profiles kept on disk")
+
+	// --final-stats-file
+	fs.StringVar(&opts.FinalStatsFile, "final-stats-file", "", "write the final stats snapshot (JSON) here on shutdown")
+
+	// --shutdown-grace
+	fs.Float64Var(&opts.ShutdownGrace, "shutdown-grace", 5, "on shutdown, keep serving open sessions for up to this many seconds")
+
+	// --exit-audit
+	fs.BoolVar(&opts.ExitAudit, "exit-audit", false, "on shutdown, log leaked listeners, connections and goroutines and exit non-zero")
+
 	// -u / --user
-	fs.StringVar(&opts.Username, "u", "", "username for setuid")
-	fs.StringVar(&opts.Username, "user", "", "username for setuid")
+	fs.StringVar(&opts.Username, "u", "", "drop root to this user after binding ports")
+	fs.StringVar(&opts.Username, "user", "", "drop root to this user after binding ports")
+
+	// --max-frame-pre-handshake / --max-frame-unencrypted / --max-frame-encrypted
+	fs.IntVar(&opts.MaxFramePreHandshake, "max-frame-pre-handshake", 128*1024, "largest client frame before the first encrypted one, bytes")
+	fs.IntVar(&opts.MaxFrameUnencrypted, "max-frame-unencrypted", 8*1024, "largest unencrypted (DH) client frame, bytes")
+	fs.IntVar(&opts.MaxFrameEncrypted, "max-frame-encrypted", 16*1024*1024, "largest encrypted client frame, bytes")
+
+	// --answer-pings
+	fs.BoolVar(&opts.AnswerPings, "answer-pings", false, "answer client transport pings locally instead of forwarding them")
+
+	// --dedup-frames
+	fs.IntVar(&opts.DedupFrames, "dedup-frames", 0, "drop client frames repeating one of the last N frames of the session (0 = off)")
+
+	// --inject-latency / --inject-jitter
+	fs.Float64Var(&opts.InjectLatency, "inject-latency", 0, "delay every frame written to a client by this many seconds (testing only)")
+	fs.Float64Var(&opts.InjectJitter, "inject-jitter", 0, "add up to this many random seconds to --inject-latency per frame")
+
+	// --max-response-size
+	fs.IntVar(&opts.MaxResponseSize, "max-response-size", 2*1024*1024, "largest frame accepted from a DC, bytes")
+
+	// --response-first-byte-timeout / --response-stall-timeout
+	fs.Float64Var(&opts.ResponseFirstByteTimeout, "response-first-byte-timeout", 30, "wait for a DC response to start, seconds")
+	fs.Float64Var(&opts.ResponseStallTimeout, "response-stall-timeout", 5, "longest gap within a DC frame, seconds")
+
+	// --dns (repeatable)
+	fs.Var(&dnsFlag{servers: &opts.DNSServers}, "dns", "DNS server for target lookups: ip[:port], udp://, tls:// or https:// URL; may be repeated")
+
+	// --outbound-device
+	fs.StringVar(&opts.OutboundDevice, "outbound-device", "", "bind outbound connections to this interface or VRF (Linux)")
+
+	// --outbound-proxy (repeatable)
+	fs.Var(&outboundProxyFlag{urls: &opts.OutboundProxies}, "outbound-proxy", "reach DCs through this SOCKS5 proxy: socks5:// URL with optional user:password; may be repeated")
 
-	// -6
+	// --loopback-backend
+	fs.BoolVar(&opts.LoopbackBackend, "loopback-backend", false, "echo requests back instead of forwarding them to a DC (testing only)")
+	// --test-backend
+	fs.BoolVar(&opts.TestBackend, "test-backend", false, "route every DC to an in-process mock middle proxy (testing only)")
+
+	// -6 / --ipv6
 	fs.BoolVar(&opts.PreferIPv6, "6", false, "prefer IPv6 for outbound connections")
+	fs.BoolVar(&opts.PreferIPv6, "ipv6", false, "prefer IPv6 for outbound connections")
 
 	// -v / --verbosity
 	fs.IntVar(&opts.Verbosity, "v", 0, "verbosity level (0=silent, higher=more)")
 	fs.IntVar(&opts.Verbosity, "verbosity", 0, "verbosity level")
 
 	// -d / --daemonize
-	fs.BoolVar(&opts.Daemonize, "d", false, "daemonize")
-	fs.BoolVar(&opts.Daemonize, "daemonize", false, "daemonize")
+	fs.BoolVar(&opts.Daemonize, "d", false, "run in the background")
+	fs.BoolVar(&opts.Daemonize, "daemonize", false, "run in the background")
+
+	// -l / --log
+	fs.StringVar(&opts.LogFile, "l", "", "log file")
+	fs.StringVar(&opts.LogFile, "log", "", "log file")
+
+	// --pid-file
+	fs.StringVar(&opts.PidFile, "pid-file", "", "write the process id to this file")
 
 	// -D / --domain (repeatable)
 	df := &domainFlag{domains: &opts.Domains}
 	fs.Var(df, "D", "TLS domain; disables non-TLS transport when set; may be repeated")
 	fs.Var(df, "domain", "TLS domain; disables non-TLS transport when set; may be repeated")
 
+	// --fallback-addr
+	fs.StringVar(&opts.FallbackAddr, "fallback-addr", "", "hand connections that are not proxy clients to this host:port")
+
 	// -T / --ping-interval
 	fs.Float64Var(&opts.PingInterval, "T", 5.0, "ping interval in seconds")
 	fs.Float64Var(&opts.PingInterval, "ping-interval", 5.0, "ping interval in seconds")
 
+	// --health-check-interval / --health-check-timeout / --health-check-rise / --health-check-fall
+	fs.Float64Var(&opts.HealthCheckInterval, "health-check-interval", 0, "probe every config target this often, in seconds (0 = off)")
+	fs.Float64Var(&opts.HealthCheckTimeout, "health-check-timeout", 5, "seconds one target probe may take")
+	fs.IntVar(&opts.HealthCheckRise, "health-check-rise", 2, "successful probes in a row that mark a target healthy")
+	fs.IntVar(&opts.HealthCheckFall, "health-check-fall", 3, "failed probes in a row that mark a target unhealthy")
+
+	// --dial-backoff-max
+	fs.Float64Var(&opts.DialBackoffMax, "dial-backoff-max", 60, "longest backoff in seconds after failed connects to a target (0 = off)")
+
 	// --nat-info (repeatable)
 	nf := &natInfoFlag{info: &opts.NatInfo}
 	fs.Var(nf, "nat-info", "NAT translation rule: local_ip:public_ip (may be repeated)")
 
+	// --config-yaml
+	fs.StringVar(&opts.ConfigYAML, "config-yaml", "", "YAML or TOML file of long options; flags and MTPROXY_GO_* variables override it")
+
+	return opts, fs
+}
+
+// Parse parses os.Args[1:] and returns the filled Options.
+// On error it prints usage and calls os.Exit(2).
+func Parse() *Options {
+	opts, fs := newOptionSet(os.Args[0])
+	fs.Usage = func() { PrintUsage(fs) }
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		if err == flag.ErrHelp {
 			os.Exit(0)
@@ -201,19 +856,166 @@ func Parse() *Options {
 		PrintUsage(fs)
 		os.Exit(2)
 	}
+	sources, configFile, err := mergeOptionSources(fs, os.Environ())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+	opts.Settings = settings(fs, sources)
+
+	if err := opts.readSecretsKey(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+	if opts.SealFile != "" {
+		if err := sealFile(opts.SealFile, opts.secretsKey, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --seal: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	// Positional: config file
+	// Positional: config file, generated by --test-backend, or config-file
+	// from the environment or --config-yaml
 	args := fs.Args()
-	if len(args) != 1 {
+	if len(args) == 0 && configFile != "" {
+		args = []string{configFile}
+	}
+	if opts.TestBackend {
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "error: --test-backend generates its own config, got %q\n", args[0])
+			os.Exit(2)
+		}
+		if opts.LoopbackBackend {
+			fmt.Fprintf(os.Stderr, "error: --test-backend and --loopback-backend are mutually exclusive\n")
+			os.Exit(2)
+		}
+	} else if len(args) != 1 {
 		fmt.Fprintf(os.Stderr, "error: exactly one positional argument required: path to proxy-multi.conf\n")
 		PrintUsage(fs)
 		os.Exit(2)
+	} else {
+		opts.ConfigFile = args[0]
+	}
+
+	if opts.AcceptLoops < 1 {
+		fmt.Fprintf(os.Stderr, "error: --accept-loops must be at least 1, got %d\n", opts.AcceptLoops)
+		os.Exit(2)
+	}
+	if opts.StatsAddr != "" {
+		if _, _, err := net.SplitHostPort(opts.StatsAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --stats-addr: %v\n", err)
+			os.Exit(2)
+		}
+		opts.HTTPStats = true
+	}
+	if opts.FallbackAddr != "" {
+		if _, _, err := net.SplitHostPort(opts.FallbackAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --fallback-addr: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if opts.AuthorizerTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "error: --authorizer-timeout must be positive\n")
+		os.Exit(2)
+	}
+	if opts.DuplicateTargets != "dedup" && opts.DuplicateTargets != "weight" {
+		fmt.Fprintf(os.Stderr, "error: --duplicate-targets must be dedup or weight, got %q\n", opts.DuplicateTargets)
+		os.Exit(2)
+	}
+	switch opts.Balance {
+	case "random", "round-robin", "least-outstanding", "weighted", "hash":
+	default:
+		fmt.Fprintf(os.Stderr, "error: --balance must be random, round-robin, least-outstanding, weighted or hash, got %q\n", opts.Balance)
+		os.Exit(2)
+	}
+	if opts.SessionAffinity < 0 || opts.SessionAffinityMax < 1 {
+		fmt.Fprintf(os.Stderr, "error: --session-affinity must be >= 0 and --session-affinity-max >= 1\n")
+		os.Exit(2)
+	}
+	if opts.BlockThreshold < 0 || opts.BlockWindow <= 0 || opts.BlockTTL <= 0 {
+		fmt.Fprintf(os.Stderr, "error: --block-threshold must be >= 0, --block-window and --block-ttl positive\n")
+		os.Exit(2)
+	}
+	if opts.SurgeFactor != 0 && opts.SurgeFactor <= 1 {
+		fmt.Fprintf(os.Stderr, "error: --surge-factor must be above 1 (or 0 to disable), got %g\n", opts.SurgeFactor)
+		os.Exit(2)
+	}
+	if opts.SurgeMinRate < 0 || opts.SurgeCooldown <= 0 {
+		fmt.Fprintf(os.Stderr, "error: --surge-min-rate must be >= 0 and --surge-cooldown positive\n")
+		os.Exit(2)
+	}
+	if opts.MaxConnsPerIP < 0 || opts.PerIPAcceptRate < 0 {
+		fmt.Fprintf(os.Stderr, "error: --max-conns-per-ip and --per-ip-accept-rate must be >= 0\n")
+		os.Exit(2)
+	}
+	for _, f := range []struct {
+		name string
+		v    int
+	}{
+		{"--max-frame-pre-handshake", opts.MaxFramePreHandshake},
+		{"--max-frame-unencrypted", opts.MaxFrameUnencrypted},
+		{"--max-frame-encrypted", opts.MaxFrameEncrypted},
+	} {
+		if f.v < 64 || f.v > 16*1024*1024 {
+			fmt.Fprintf(os.Stderr, "error: %s must be between 64 and %d\n", f.name, 16*1024*1024)
+			os.Exit(2)
+		}
+	}
+	if opts.MaxResponseSize < 16 || opts.MaxResponseSize > 4*1024*1024 {
+		fmt.Fprintf(os.Stderr, "error: --max-response-size must be between 16 and %d\n", 4*1024*1024)
+		os.Exit(2)
+	}
+	if opts.ResponseFirstByteTimeout <= 0 || opts.ResponseStallTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "error: --response-first-byte-timeout and --response-stall-timeout must be positive\n")
+		os.Exit(2)
+	}
+	switch opts.OverloadPolicy {
+	case "accept", "close", "handshake":
+	default:
+		fmt.Fprintf(os.Stderr, "error: --overload-policy must be accept, close or handshake, got %q\n", opts.OverloadPolicy)
+		os.Exit(2)
+	}
+	if opts.MemoryBudget < 0 {
+		fmt.Fprintf(os.Stderr, "error: --memory-budget must be >= 0\n")
+		os.Exit(2)
+	}
+	if opts.MaxHandlersPerCPU < 0 {
+		fmt.Fprintf(os.Stderr, "error: --max-handlers-per-cpu must be >= 0\n")
+		os.Exit(2)
+	}
+	if opts.MinDefaultTargets < 0 {
+		fmt.Fprintf(os.Stderr, "error: --min-default-targets must be >= 0\n")
+		os.Exit(2)
+	}
+	if opts.CPUProfileThreshold <= 0 || opts.CPUProfileThreshold > 100 || opts.CPUProfileAfter < 0 || opts.CPUProfileKeep < 1 {
+		fmt.Fprintf(os.Stderr, "error: --cpu-profile-threshold must be in (0, 100], --cpu-profile-after >= 0 and --cpu-profile-keep >= 1\n")
+		os.Exit(2)
+	}
+	if opts.ConfigFetchInterval < 0 || opts.ConfigFetchJitter < 0 {
+		fmt.Fprintf(os.Stderr, "error: --config-fetch-interval and --config-fetch-jitter must be >= 0\n")
+		os.Exit(2)
+	}
+	if opts.WatchConfigDebounce <= 0 {
+		fmt.Fprintf(os.Stderr, "error: --watch-config-debounce must be > 0\n")
+		os.Exit(2)
+	}
+	if opts.DedupFrames < 0 || opts.DedupFrames > MaxDedupFrames {
+		fmt.Fprintf(os.Stderr, "error: --dedup-frames must be between 0 and %d\n", MaxDedupFrames)
+		os.Exit(2)
+	}
+	if opts.InjectLatency < 0 || opts.InjectJitter < 0 {
+		fmt.Fprintf(os.Stderr, "error: --inject-latency and --inject-jitter must be >= 0\n")
+		os.Exit(2)
+	}
+	if opts.LatencySampleRate < 0 || opts.LatencyReservoir < 0 {
+		fmt.Fprintf(os.Stderr, "error: --latency-sample-rate and --latency-reservoir must be >= 0\n")
+		os.Exit(2)
 	}
-	opts.ConfigFile = args[0]
 
 	// Parse proxy-tag
-	if proxyTagStr != "" {
-		b, err := decodeHexSecret("--proxy-tag", proxyTagStr, 16)
+	if opts.proxyTagHex != "" {
+		b, err := decodeHexSecret("--proxy-tag", opts.proxyTagHex, 16)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(2)
@@ -222,24 +1024,106 @@ func Parse() *Options {
 		opts.ProxyTagSet = true
 	}
 
-	// Load secrets from file if specified
-	if opts.SecretFile != "" {
-		if err := loadSecretsFromFile(opts.SecretFile, &opts.Secrets); err != nil {
-			fmt.Fprintf(os.Stderr, "error loading secret file: %v\n", err)
+	if opts.ShutdownGrace < 0 {
+		fmt.Fprintf(os.Stderr, "error: --shutdown-grace must be >= 0\n")
+		os.Exit(2)
+	}
+	if opts.HealthCheckInterval < 0 || opts.HealthCheckTimeout <= 0 || opts.HealthCheckRise < 1 || opts.HealthCheckFall < 1 {
+		fmt.Fprintf(os.Stderr, "error: --health-check-interval must be >= 0, --health-check-timeout > 0 and --health-check-rise/--health-check-fall >= 1\n")
+		os.Exit(2)
+	}
+	if opts.WindowClamp < 0 || opts.TCPKeepAlive < 0 || opts.TCPUserTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "error: --window-clamp, --tcp-keepalive and --tcp-user-timeout must be >= 0\n")
+		os.Exit(2)
+	}
+	if opts.DialBackoffMax < 0 {
+		fmt.Fprintf(os.Stderr, "error: --dial-backoff-max must be >= 0\n")
+		os.Exit(2)
+	}
+
+	if opts.SecretRevokeGrace < 0 {
+		fmt.Fprintf(os.Stderr, "error: --secret-revoke-grace must be >= 0\n")
+		os.Exit(2)
+	}
+
+	// Load secrets from the file and directory if specified
+	opts.staticSecrets = len(opts.Secrets)
+	if opts.SecretsReloadable() {
+		secrets, err := opts.LoadSecrets()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading secrets: %v\n", err)
 			os.Exit(2)
 		}
+		opts.Secrets = secrets
 	}
 
 	return opts
 }
 
+// ParseSubcommand parses the arguments of a subcommand that takes the
+// proxy's options: declare adds the subcommand's own flags to the proxy's,
+// and options may follow the positional arguments. MTPROXY_GO_* variables
+// and --config-yaml apply as for the proxy, and the config-file they name
+// is the positional argument when none is given. The secrets key and the
+// secret files are not loaded. Errors are printed to stderr.
+func ParseSubcommand(name string, args []string, stderr io.Writer, declare func(fs *flag.FlagSet)) (opts *Options, positional []string, err error) {
+	opts, fs := newOptionSet(name)
+	fs.SetOutput(stderr)
+	declare(fs)
+	for rest := args; ; {
+		if err := fs.Parse(rest); err != nil {
+			return nil, nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+	sources, configFile, err := mergeOptionSources(fs, os.Environ())
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return nil, nil, err
+	}
+	opts.Settings = settings(fs, sources)
+	opts.staticSecrets = len(opts.Secrets)
+	if len(positional) == 0 && configFile != "" {
+		positional = []string{configFile}
+	}
+	return opts, positional, nil
+}
+
+// readSecretsKey reads the key for sealed files from --secrets-key-env or
+// --secrets-key-command, if either is set.
+func (o *Options) readSecretsKey() error {
+	if o.SecretsKeyEnv == "" && o.SecretsKeyCommand == "" {
+		return nil
+	}
+	if o.SecretsKeyEnv != "" && o.SecretsKeyCommand != "" {
+		return fmt.Errorf("--secrets-key-env and --secrets-key-command are mutually exclusive")
+	}
+	key, err := loadSecretsKey(o.SecretsKeyEnv, o.SecretsKeyCommand)
+	if err != nil {
+		return err
+	}
+	o.secretsKey = key
+	return nil
+}
+
 // decodeHexSecret decodes a hex string into exactly wantBytes bytes.
 func decodeHexSecret(flag, value string, wantBytes int) ([]byte, error) {
-	// Support "dd" prefix for fake-TLS mode (skip first 2 chars)
+	// Support "dd" prefix for random padding (skip first 2 chars) and the
+	// client form of a fake-TLS secret, "ee" + secret + hex of the domain.
 	v := value
 	if len(v) == wantBytes*2+2 && strings.HasPrefix(strings.ToLower(v), "dd") {
 		v = v[2:]
 	}
+	if len(v) > wantBytes*2+2 && strings.HasPrefix(strings.ToLower(v), "ee") {
+		if _, err := hex.DecodeString(v[2+wantBytes*2:]); err != nil {
+			return nil, fmt.Errorf("%s: invalid domain hex in %q: %w", flag, value, err)
+		}
+		v = v[2 : 2+wantBytes*2]
+	}
 	if len(v) != wantBytes*2 {
 		return nil, fmt.Errorf("%s: expected %d hex chars, got %d in %q", flag, wantBytes*2, len(v), value)
 	}
@@ -251,11 +1135,59 @@ func decodeHexSecret(flag, value string, wantBytes int) ([]byte, error) {
 }
 
 // natInfoFlag accumulates --nat-info local_ip:public_ip values.
+// memoryLimitFlag parses a byte count with an optional k, m, g or t suffix
+// (parse_memory_limit in server-functions.c).
+type memoryLimitFlag struct {
+	n *int64
+}
+
+func (m *memoryLimitFlag) String() string {
+	if m.n == nil {
+		return ""
+	}
+	return strconv.FormatInt(*m.n, 10)
+}
+
+func (m *memoryLimitFlag) Set(s string) error {
+	v, shift := s, 0
+	if v != "" {
+		switch v[len(v)-1] | 0x20 {
+		case 'k':
+			shift = 10
+		case 'm':
+			shift = 20
+		case 'g':
+			shift = 30
+		case 't':
+			shift = 40
+		}
+	}
+	if shift > 0 {
+		v = v[:len(v)-1]
+	}
+	x, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || x <= 0 || x > math.MaxInt64>>shift {
+		return fmt.Errorf("expected a positive byte count with an optional k/m/g/t suffix, got %q", s)
+	}
+	*m.n = x << shift
+	return nil
+}
+
 type natInfoFlag struct {
 	info *map[string]string
 }
 
-func (n *natInfoFlag) String() string { return "" }
+func (n *natInfoFlag) String() string {
+	if n.info == nil {
+		return ""
+	}
+	out := make([]string, 0, len(*n.info))
+	for local, public := range *n.info {
+		out = append(out, local+":"+public)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
 func (n *natInfoFlag) Set(v string) error {
 	parts := strings.SplitN(v, ":", 2)
 	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
@@ -269,10 +1201,12 @@ func (n *natInfoFlag) Set(v string) error {
 }
 
 // loadSecretsFromFile reads secrets from a file (comma or whitespace separated).
-func loadSecretsFromFile(filename string, secrets *[][]byte) error {
-	data, err := os.ReadFile(filename)
+// Entries may carry a validity window (see parseSecretToken), which is
+// stored in windows if it is non-nil.
+func loadSecretsFromFile(filename string, key []byte, secrets *[][]byte, windows map[string]SecretWindow) error {
+	data, err := readSecretsFile(filename, key)
 	if err != nil {
-		return fmt.Errorf("open %s: %w", filename, err)
+		return err
 	}
 	content := string(data)
 	// Replace commas with spaces
@@ -282,10 +1216,72 @@ func loadSecretsFromFile(filename string, secrets *[][]byte) error {
 		if tok == "" {
 			continue
 		}
-		b, err := decodeHexSecret("--mtproto-secret-file", tok, 16)
+		b, w, hasWindow, err := parseSecretToken("--mtproto-secret-file", tok)
+		if err != nil {
+			return err
+		}
+		if hasWindow && windows != nil {
+			windows[string(b)] = w
+		}
+		*secrets = append(*secrets, b)
+	}
+	return nil
+}
+
+// SecretsReloadable reports whether any secrets come from a file or
+// directory that LoadSecrets can re-read at runtime.
+func (o *Options) SecretsReloadable() bool {
+	return o.SecretFile != "" || o.SecretDir != ""
+}
+
+// LoadSecrets returns the secrets given by -S followed by the current
+// contents of --mtproto-secret-file and --mtproto-secret-dir. It is called
+// at startup, whenever the directory is re-scanned and on SIGHUP.
+func (o *Options) LoadSecrets() ([][]byte, error) {
+	secrets := make([][]byte, o.staticSecrets, o.staticSecrets+8)
+	copy(secrets, o.Secrets[:o.staticSecrets])
+	windows := make(map[string]SecretWindow)
+	if o.SecretFile != "" {
+		if err := loadSecretsFromFile(o.SecretFile, o.secretsKey, &secrets, windows); err != nil {
+			return nil, err
+		}
+	}
+	if o.SecretDir != "" {
+		if err := loadSecretsFromDir(o.SecretDir, o.secretsKey, &secrets, windows); err != nil {
+			return nil, err
+		}
+	}
+	o.windowsMu.Lock()
+	o.windows = windows
+	o.windowsMu.Unlock()
+	return secrets, nil
+}
+
+// loadSecretsFromDir reads one secret per regular file in dir, in file name
+// order, using the same entry syntax as --mtproto-secret-file. Hidden files
+// (leading '.') and subdirectories are ignored so that editors and
+// provisioning tools can stage files next to live ones.
+func loadSecretsFromDir(dir string, key []byte, secrets *[][]byte, windows map[string]SecretWindow) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read dir %s: %w", dir, err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || !e.Type().IsRegular() {
+			continue
+		}
+		data, err := readSecretsFile(filepath.Join(dir, name), key)
 		if err != nil {
 			return err
 		}
+		b, w, hasWindow, err := parseSecretToken("--mtproto-secret-dir "+name, strings.TrimSpace(string(data)))
+		if err != nil {
+			return err
+		}
+		if hasWindow && windows != nil {
+			windows[string(b)] = w
+		}
 		*secrets = append(*secrets, b)
 	}
 	return nil
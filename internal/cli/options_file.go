@@ -0,0 +1,422 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OptionsEnvPrefix starts the environment variable of every long option:
+// MTPROXY_GO_HTTP_PORTS sets --http-ports.
+const OptionsEnvPrefix = "MTPROXY_GO_"
+
+// configFileKey names the positional proxy-multi.conf in an options file
+// (config-file) and the environment (MTPROXY_GO_CONFIG_FILE).
+const configFileKey = "config-file"
+
+// Where the effective value of an option came from (Setting.Source), in
+// rising precedence.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// redactedOptions never have their value shown in Settings.
+var redactedOptions = map[string]bool{"mtproto-secret": true, "proxy-tag": true}
+
+// Setting is the effective value of one option once the command line, the
+// environment and the --config-yaml file are merged (/debug/config).
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// optionGroups maps every flag.Value of fs to its names, longest first:
+// -S and --mtproto-secret share one value and so are one option.
+func optionGroups(fs *flag.FlagSet) (names map[flag.Value][]string, order []flag.Value) {
+	names = make(map[flag.Value][]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := names[f.Value]; !ok {
+			order = append(order, f.Value)
+		}
+		names[f.Value] = append(names[f.Value], f.Name)
+	})
+	for _, n := range names {
+		sort.SliceStable(n, func(i, j int) bool { return len(n[i]) > len(n[j]) })
+	}
+	return names, order
+}
+
+// optionKey normalizes an options file key or environment variable suffix
+// to a flag name: "HTTP_PORTS" and "http_ports" are "http-ports".
+func optionKey(s string) string {
+	return strings.ReplaceAll(strings.ToLower(s), "_", "-")
+}
+
+// mergeOptionSources fills the options fs did not get on the command line:
+// first from MTPROXY_GO_* variables in environ, then from the options file
+// named by --config-yaml once that is known. Only long names are accepted
+// from either; one environment variable sets a repeatable option once, a
+// file may give a list. It returns the source of every option set and the
+// config-file value, if any.
+func mergeOptionSources(fs *flag.FlagSet, environ []string) (sources map[flag.Value]string, configFile string, err error) {
+	groups, _ := optionGroups(fs)
+	sources = make(map[flag.Value]string)
+	fs.Visit(func(f *flag.Flag) { sources[f.Value] = SourceFlag })
+
+	lookup := func(key string) (flag.Value, error) {
+		f := fs.Lookup(key)
+		if f == nil || len(key) == 1 || key == "config-yaml" {
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+		return f.Value, nil
+	}
+
+	configSource := ""
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(k, OptionsEnvPrefix)
+		if !ok {
+			continue
+		}
+		key := optionKey(name)
+		if key == configFileKey {
+			configFile, configSource = v, SourceEnv
+			continue
+		}
+		// The options file itself may be named in the environment.
+		var val flag.Value
+		if key == "config-yaml" {
+			val = fs.Lookup(key).Value
+		} else if val, err = lookup(key); err != nil {
+			return nil, "", fmt.Errorf("%s: %w", k, err)
+		}
+		if sources[val] != "" {
+			continue
+		}
+		if err := val.Set(v); err != nil {
+			return nil, "", fmt.Errorf("%s: %w", k, err)
+		}
+		sources[val] = SourceEnv
+	}
+
+	path := fs.Lookup("config-yaml").Value.String()
+	if path == "" {
+		return sources, configFile, nil
+	}
+	values, keys, err := readOptionsFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, key := range keys {
+		if key == configFileKey {
+			if configSource == "" && len(values[key]) == 1 {
+				configFile = values[key][0]
+			} else if len(values[key]) != 1 {
+				return nil, "", fmt.Errorf("%s: %s takes one path", path, key)
+			}
+			continue
+		}
+		val, err := lookup(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", path, err)
+		}
+		if s := sources[val]; s != "" && s != SourceFile {
+			continue
+		}
+		if sources[val] == SourceFile {
+			return nil, "", fmt.Errorf("%s: %s given twice (also as --%s)", path, key, groups[val][0])
+		}
+		for _, v := range values[key] {
+			if err := val.Set(v); err != nil {
+				return nil, "", fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		}
+		sources[val] = SourceFile
+	}
+	return sources, configFile, nil
+}
+
+// settings lists the effective value of every option of fs by its longest
+// name, sorted, with secrets redacted.
+func settings(fs *flag.FlagSet, sources map[flag.Value]string) []Setting {
+	groups, order := optionGroups(fs)
+	out := make([]Setting, 0, len(order))
+	for _, val := range order {
+		name := groups[val][0]
+		s := Setting{Name: name, Value: val.String(), Source: sources[val]}
+		if s.Source == "" {
+			s.Source = SourceDefault
+		}
+		if redactedOptions[name] && s.Source != SourceDefault {
+			s.Value = "(redacted)"
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// readOptionsFile reads a --config-yaml file: TOML if its name ends in
+// .toml, YAML otherwise. It returns the values of every key, normalized to
+// flag names, and the keys in file order.
+func readOptionsFile(path string) (map[string][]string, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("--config-yaml: %w", err)
+	}
+	parse := parseYAMLOptions
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		parse = parseTOMLOptions
+	}
+	values, keys, err := parse(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return values, keys, nil
+}
+
+// optionsFile collects the entries of an options file.
+type optionsFile struct {
+	values map[string][]string
+	keys   []string
+}
+
+func (f *optionsFile) add(lineNo int, key string, vals []string) error {
+	key = optionKey(key)
+	if _, dup := f.values[key]; dup {
+		return fmt.Errorf("%d: %s given twice", lineNo, key)
+	}
+	f.values[key] = vals
+	f.keys = append(f.keys, key)
+	return nil
+}
+
+// parseYAMLOptions parses the YAML subset an options file needs: a flat
+// mapping of option names to scalars, to flow lists ([a, b]) or to block
+// lists of "- item" lines. Nested mappings are rejected.
+func parseYAMLOptions(data []byte) (map[string][]string, []string, error) {
+	f := &optionsFile{values: make(map[string][]string)}
+	var listKey string
+	var list []string
+	listLine := 0
+	flush := func() error {
+		if listKey == "" {
+			return nil
+		}
+		err := f.add(listLine, listKey, list)
+		listKey, list = "", nil
+		return err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimRight(stripComment(sc.Text()), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok || trimmed == "-" {
+			if listKey == "" || line[0] != ' ' && line[0] != '-' {
+				return nil, nil, fmt.Errorf("%d: list item outside a list", lineNo)
+			}
+			v, err := unquoteScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%d: %w", lineNo, err)
+			}
+			list = append(list, v)
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, nil, err
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, nil, fmt.Errorf("%d: nested mappings are not supported", lineNo)
+		}
+		key, rest, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, nil, fmt.Errorf("%d: expected \"option: value\"", lineNo)
+		}
+		key, rest = strings.TrimSpace(key), strings.TrimSpace(rest)
+		if rest == "" {
+			listKey, listLine = key, lineNo
+			continue
+		}
+		vals, err := parseValue(rest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%d: %w", lineNo, err)
+		}
+		if err := f.add(lineNo, key, vals); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, nil, err
+	}
+	return f.values, f.keys, sc.Err()
+}
+
+// parseTOMLOptions parses the TOML subset an options file needs: top-level
+// "option = value" pairs with strings, numbers, booleans and arrays, which
+// may span lines. Tables are rejected.
+func parseTOMLOptions(data []byte) (map[string][]string, []string, error) {
+	f := &optionsFile{values: make(map[string][]string)}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, nil, fmt.Errorf("%d: tables are not supported", lineNo)
+		}
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, nil, fmt.Errorf("%d: expected \"option = value\"", lineNo)
+		}
+		key, rest = strings.TrimSpace(key), strings.TrimSpace(rest)
+		if k, err := unquoteScalar(key); err == nil {
+			key = k
+		}
+		start := lineNo
+		// An array continues until its closing bracket.
+		for strings.HasPrefix(rest, "[") && !strings.HasSuffix(rest, "]") {
+			if !sc.Scan() {
+				return nil, nil, fmt.Errorf("%d: unterminated array", start)
+			}
+			lineNo++
+			rest += " " + strings.TrimSpace(stripComment(sc.Text()))
+		}
+		if !strings.HasPrefix(rest, "[") && !strings.HasPrefix(rest, "\"") && !strings.HasPrefix(rest, "'") &&
+			!isTOMLBare(rest) {
+			return nil, nil, fmt.Errorf("%d: strings must be quoted", start)
+		}
+		vals, err := parseValue(rest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%d: %w", start, err)
+		}
+		if err := f.add(start, key, vals); err != nil {
+			return nil, nil, err
+		}
+	}
+	return f.values, f.keys, sc.Err()
+}
+
+// isTOMLBare reports whether s is an unquoted TOML boolean or number.
+func isTOMLBare(s string) bool {
+	if s == "true" || s == "false" {
+		return true
+	}
+	_, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64)
+	return err == nil
+}
+
+// parseValue parses a scalar or a flow list ("[a, 'b', \"c\"]").
+func parseValue(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, err := unquoteScalar(s)
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %q", s)
+	}
+	var out []string
+	body := strings.TrimSpace(s[1 : len(s)-1])
+	for body != "" {
+		var item string
+		if body[0] == '"' || body[0] == '\'' {
+			end := closingQuote(body)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in %q", s)
+			}
+			item, body = body[:end+1], strings.TrimSpace(body[end+1:])
+		} else {
+			i := strings.IndexByte(body, ',')
+			if i < 0 {
+				i = len(body)
+			}
+			item, body = strings.TrimSpace(body[:i]), body[i:]
+		}
+		v, err := unquoteScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		if body != "" {
+			if body[0] != ',' {
+				return nil, fmt.Errorf("expected ',' in %q", s)
+			}
+			body = strings.TrimSpace(body[1:])
+		}
+	}
+	return out, nil
+}
+
+// unquoteScalar returns s without its quotes: "..." with Go/TOML escapes,
+// '...' literally, where two single quotes in a row stand for one, as in
+// YAML. Unquoted scalars are returned as they are.
+func unquoteScalar(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad string %s", s)
+		}
+		return v, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsAny(s[:min(len(s), 1)], "\"'{&*!|>%@`"):
+		return "", fmt.Errorf("unsupported value %s", s)
+	}
+	return s, nil
+}
+
+// closingQuote returns the index of the quote closing the string s starts
+// with, or -1.
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment cuts a '#' comment that starts the line or follows
+// whitespace outside quotes.
+func stripComment(line string) string {
+	var q byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case q != 0:
+			if c == '\\' && q == '"' {
+				i++
+			} else if c == q {
+				q = 0
+			}
+		case c == '"' || c == '\'':
+			q = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
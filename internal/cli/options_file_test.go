@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseYAMLOptions(t *testing.T) {
+	values, keys, err := parseYAMLOptions([]byte(`---
+# proxy options
+http-ports: 443   # client port
+mtproto_secret:
+  - aabbccddeeff00112233445566778899
+  - "ffeeddccbbaa00112233445566778899"
+domain: [example.com, 'it''s.example.org']
+tcp-nodelay: false
+aes-pwd: "/etc/mtproxy/proxy secret#1"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"http-ports":     {"443"},
+		"mtproto-secret": {"aabbccddeeff00112233445566778899", "ffeeddccbbaa00112233445566778899"},
+		"domain":         {"example.com", "it's.example.org"},
+		"tcp-nodelay":    {"false"},
+		"aes-pwd":        {"/etc/mtproxy/proxy secret#1"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %q", values)
+	}
+	if len(keys) != 5 || keys[0] != "http-ports" || keys[4] != "aes-pwd" {
+		t.Errorf("keys = %q", keys)
+	}
+
+	for _, bad := range []string{
+		"stats:\n  addr: 127.0.0.1:8888\n",
+		"- 443\n",
+		"http-ports: 443\nhttp_ports: 444\n",
+		"domain: [a.example, b.example\n",
+		"log: &anchor /var/log/x\n",
+	} {
+		if _, _, err := parseYAMLOptions([]byte(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestParseTOMLOptions(t *testing.T) {
+	values, _, err := parseTOMLOptions([]byte(`# proxy options
+http-ports = 443
+"stats-addr" = "127.0.0.1:8888"
+dns = [
+  "1.1.1.1",  # primary
+  'tls://dns.example',
+]
+tcp-nodelay = false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"http-ports":  {"443"},
+		"stats-addr":  {"127.0.0.1:8888"},
+		"dns":         {"1.1.1.1", "tls://dns.example"},
+		"tcp-nodelay": {"false"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %q", values)
+	}
+	for _, bad := range []string{"[stats]\naddr = \"x\"\n", "log = /var/log/x\n", "dns = [\"a\"\n"} {
+		if _, _, err := parseTOMLOptions([]byte(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestParse_OptionSources(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "proxy-multi.conf")
+	os.WriteFile(conf, []byte("default 2;\nproxy_for 2 149.154.161.144:8888;\n"), 0600)
+	file := filepath.Join(dir, "mtproxy.toml")
+	os.WriteFile(file, []byte(`config-file = "`+conf+`"
+http-ports = "4430,4431"
+balance = "round-robin"
+slaves = 3
+mtproto-secret = ["aabbccddeeff00112233445566778899"]
+`), 0600)
+	t.Setenv("MTPROXY_GO_BALANCE", "hash")
+	t.Setenv("MTPROXY_GO_CONFIG_YAML", file)
+
+	opts, _ := parseArgs(t, "-M", "2")
+	if opts.ConfigFile != conf {
+		t.Errorf("ConfigFile = %q, want %q", opts.ConfigFile, conf)
+	}
+	if !reflect.DeepEqual(opts.HTTPPorts, []int{4430, 4431}) || len(opts.Secrets) != 1 {
+		t.Errorf("HTTPPorts = %v, %d secrets: want the file's", opts.HTTPPorts, len(opts.Secrets))
+	}
+	if opts.Balance != "hash" || opts.Workers != 2 {
+		t.Errorf("Balance = %q, Workers = %d: want hash from env and 2 from the flag", opts.Balance, opts.Workers)
+	}
+	got := make(map[string]Setting)
+	for _, s := range opts.Settings {
+		got[s.Name] = s
+	}
+	for name, want := range map[string]Setting{
+		"slaves":         {"slaves", "2", SourceFlag},
+		"balance":        {"balance", "hash", SourceEnv},
+		"http-ports":     {"http-ports", "4430,4431", SourceFile},
+		"mtproto-secret": {"mtproto-secret", "(redacted)", SourceFile},
+		"ping-interval":  {"ping-interval", "5", SourceDefault},
+	} {
+		if got[name] != want {
+			t.Errorf("setting %s = %+v, want %+v", name, got[name], want)
+		}
+	}
+}
@@ -1,9 +1,17 @@
 package cli
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/crypto"
 )
 
 // parseArgs is a test helper that sets os.Args and calls Parse().
@@ -37,6 +45,21 @@ func TestDecodeHexSecret_Valid16(t *testing.T) {
 	}
 }
 
+func TestDecodeHexSecret_WithEEPrefix(t *testing.T) {
+	// ee + 32 hex chars + hex("example.com") = client-side fake-TLS secret
+	raw := "ee" + "aabbccddeeff00112233445566778899" + "6578616d706c652e636f6d"
+	b, err := decodeHexSecret("-S", raw, 16)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hex.EncodeToString(b) != "aabbccddeeff00112233445566778899" {
+		t.Errorf("secret = %x", b)
+	}
+	if _, err := decodeHexSecret("-S", raw+"zz", 16); err == nil {
+		t.Error("expected error for non-hex domain")
+	}
+}
+
 func TestDecodeHexSecret_WithDDPrefix(t *testing.T) {
 	// dd + 32 hex chars = fake-TLS mode secret
 	raw := "dd" + "aabbccddeeff00112233445566778899"
@@ -80,7 +103,7 @@ func TestLoadSecretsFromFile_Valid(t *testing.T) {
 	f.Close()
 
 	var secrets [][]byte
-	if err := loadSecretsFromFile(f.Name(), &secrets); err != nil {
+	if err := loadSecretsFromFile(f.Name(), nil, &secrets, nil); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if len(secrets) != 2 {
@@ -98,7 +121,7 @@ func TestLoadSecretsFromFile_Whitespace(t *testing.T) {
 	f.Close()
 
 	var secrets [][]byte
-	if err := loadSecretsFromFile(f.Name(), &secrets); err != nil {
+	if err := loadSecretsFromFile(f.Name(), nil, &secrets, nil); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if len(secrets) != 2 {
@@ -108,7 +131,7 @@ func TestLoadSecretsFromFile_Whitespace(t *testing.T) {
 
 func TestLoadSecretsFromFile_NotFound(t *testing.T) {
 	var secrets [][]byte
-	err := loadSecretsFromFile("/nonexistent/path/secrets.txt", &secrets)
+	err := loadSecretsFromFile("/nonexistent/path/secrets.txt", nil, &secrets, nil)
 	if err == nil {
 		t.Error("expected error for missing file")
 	}
@@ -123,7 +146,7 @@ func TestLoadSecretsFromFile_InvalidHex(t *testing.T) {
 	f.Close()
 
 	var secrets [][]byte
-	err = loadSecretsFromFile(f.Name(), &secrets)
+	err = loadSecretsFromFile(f.Name(), nil, &secrets, nil)
 	if err == nil {
 		t.Error("expected error for invalid hex secret")
 	}
@@ -171,6 +194,22 @@ func TestDomainFlag_Set(t *testing.T) {
 	}
 }
 
+func TestOutboundProxyFlag_Set(t *testing.T) {
+	var urls []string
+	of := &outboundProxyFlag{urls: &urls}
+	if err := of.Set("socks5://user:pw@10.0.0.5:1080"); err != nil {
+		t.Fatalf("socks5: %v", err)
+	}
+	for _, v := range []string{"http://10.0.0.5:3128", "https://10.0.0.5:3128", "socks4://10.0.0.5:1080"} {
+		if err := of.Set(v); err == nil {
+			t.Errorf("%s accepted", v)
+		}
+	}
+	if len(urls) != 1 {
+		t.Errorf("urls = %v, want only the socks5 one", urls)
+	}
+}
+
 func TestHTTPPortsFlag_Set_Single(t *testing.T) {
 	var ports []int
 	hf := &httpPortsFlag{ports: &ports}
@@ -296,3 +335,277 @@ func TestParse_Defaults(t *testing.T) {
 		t.Errorf("expected PingInterval=5.0, got %f", opts.PingInterval)
 	}
 }
+
+func TestParse_StatsAddrImpliesHTTPStats(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "proxy-*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("default 2;\nproxy_for 2 149.154.161.144:8888;\n")
+	f.Close()
+
+	opts, _ := parseArgs(t, "--stats-addr", "127.0.0.1:9100", f.Name())
+
+	if opts.StatsAddr != "127.0.0.1:9100" {
+		t.Errorf("expected StatsAddr=127.0.0.1:9100, got %q", opts.StatsAddr)
+	}
+	if !opts.HTTPStats {
+		t.Error("expected --stats-addr to enable HTTPStats")
+	}
+}
+
+func TestParse_TestBackendWithoutConfig(t *testing.T) {
+	opts, _ := parseArgs(t, "--test-backend", "-H", "4430")
+	if !opts.TestBackend || opts.ConfigFile != "" {
+		t.Errorf("TestBackend=%v ConfigFile=%q, want true and empty", opts.TestBackend, opts.ConfigFile)
+	}
+}
+
+func TestParse_DaemonizeLogPidFile(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "proxy-*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("default 2;\nproxy_for 2 149.154.161.144:8888;\n")
+	f.Close()
+
+	opts, _ := parseArgs(t, "-d", "-l", "/var/log/mtproxy.log", "--pid-file", "/run/mtproxy.pid", f.Name())
+
+	if !opts.Daemonize {
+		t.Error("expected -d to set Daemonize")
+	}
+	if opts.LogFile != "/var/log/mtproxy.log" {
+		t.Errorf("LogFile = %q", opts.LogFile)
+	}
+	if opts.PidFile != "/run/mtproxy.pid" {
+		t.Errorf("PidFile = %q", opts.PidFile)
+	}
+}
+
+func TestParse_AdminSocket(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "proxy-*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("default 2;\nproxy_for 2 149.154.161.144:8888;\n")
+	f.Close()
+
+	opts, _ := parseArgs(t, "--admin-socket", "@mtproxy", "--admin-uid", "1001", "--admin-uid", "0", f.Name())
+
+	if opts.AdminSocket != "@mtproxy" {
+		t.Errorf("AdminSocket = %q", opts.AdminSocket)
+	}
+	if len(opts.AdminUIDs) != 2 || opts.AdminUIDs[0] != 1001 || opts.AdminUIDs[1] != 0 {
+		t.Errorf("AdminUIDs = %v, want [1001 0]", opts.AdminUIDs)
+	}
+}
+
+func TestParse_IngressStats(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "proxy-*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("default 2;\nproxy_for 2 149.154.161.144:8888;\n")
+	f.Close()
+
+	opts, _ := parseArgs(t, "--ingress-stats", "10.1.2.3/8, 192.0.2.7", "--ingress-stats", "2001:db8::/32", f.Name())
+
+	want := []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::/32"}
+	if len(opts.IngressStats) != len(want) {
+		t.Fatalf("IngressStats = %v, want %v", opts.IngressStats, want)
+	}
+	for i, p := range opts.IngressStats {
+		if p.String() != want[i] {
+			t.Errorf("IngressStats[%d] = %s, want %s", i, p, want[i])
+		}
+	}
+}
+
+func TestMemoryLimitFlag(t *testing.T) {
+	for in, want := range map[string]int64{"4096": 4096, "64k": 64 << 10, "256m": 256 << 20, "2G": 2 << 30} {
+		var n int64
+		if err := (&memoryLimitFlag{&n}).Set(in); err != nil || n != want {
+			t.Errorf("Set(%q) = %d, %v; want %d", in, n, err, want)
+		}
+	}
+	for _, in := range []string{"", "m", "-1k", "0", "12x", "9999999t"} {
+		var n int64
+		if err := (&memoryLimitFlag{&n}).Set(in); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", in, n)
+		}
+	}
+}
+
+func TestLoadSecretsFromDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/alice", []byte("aabbccddeeff00112233445566778899\n"), 0600)
+	os.WriteFile(dir+"/bob", []byte("ffeeddccbbaa00112233445566778899"), 0600)
+	os.WriteFile(dir+"/.bob.swp", []byte("garbage"), 0600)
+	os.Mkdir(dir+"/sub", 0700)
+
+	opts := &Options{
+		Secrets:       [][]byte{make([]byte, 16)},
+		SecretDir:     dir,
+		staticSecrets: 1,
+	}
+	secrets, err := opts.LoadSecrets()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(secrets) != 3 {
+		t.Fatalf("expected 3 secrets (1 static + 2 from dir), got %d", len(secrets))
+	}
+	if secrets[1][0] != 0xaa || secrets[2][0] != 0xff {
+		t.Errorf("dir secrets not in file name order: %x %x", secrets[1], secrets[2])
+	}
+}
+
+func TestLoadSecretsFromDir_InvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/broken", []byte("not-valid-hex"), 0600)
+
+	var secrets [][]byte
+	if err := loadSecretsFromDir(dir, nil, &secrets, nil); err == nil {
+		t.Error("expected error for invalid secret file")
+	}
+}
+
+func TestParseSecretToken_Window(t *testing.T) {
+	b, w, ok, err := parseSecretToken("-f", "aabbccddeeff00112233445566778899@2026-01-01..2026-02-01T12:00:00Z")
+	if err != nil || !ok {
+		t.Fatalf("unexpected result: ok=%v err=%v", ok, err)
+	}
+	if len(b) != 16 {
+		t.Errorf("expected 16 bytes, got %d", len(b))
+	}
+	if w.Contains(time.Date(2025, 12, 31, 23, 0, 0, 0, time.UTC)) {
+		t.Error("window must not contain time before not-before")
+	}
+	if !w.Contains(time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Error("window must contain time inside the window")
+	}
+	if w.Contains(time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Error("not-after must be exclusive")
+	}
+}
+
+func TestParseSecretToken_OpenEndedAndErrors(t *testing.T) {
+	_, w, ok, err := parseSecretToken("-f", "aabbccddeeff00112233445566778899@..2026-02-01")
+	if err != nil || !ok || !w.NotBefore.IsZero() {
+		t.Errorf("open not-before: ok=%v err=%v w=%v", ok, err, w)
+	}
+	for _, tok := range []string{
+		"aabbccddeeff00112233445566778899@2026-01-01",
+		"aabbccddeeff00112233445566778899@2026-02-01..2026-01-01",
+		"aabbccddeeff00112233445566778899@yesterday..",
+	} {
+		if _, _, _, err := parseSecretToken("-f", tok); err == nil {
+			t.Errorf("expected error for %q", tok)
+		}
+	}
+}
+
+func TestLoadSecretsFromFile_Windows(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "secrets-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("aabbccddeeff00112233445566778899@..2000-01-01, ffeeddccbbaa00112233445566778899\n")
+	f.Close()
+
+	opts := &Options{windows: make(map[string]SecretWindow)}
+	if err := loadSecretsFromFile(f.Name(), nil, &opts.Secrets, opts.windows); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	if opts.SecretAllowed(opts.Secrets[0], now) {
+		t.Error("expired secret must not be allowed")
+	}
+	if !opts.SecretAllowed(opts.Secrets[1], now) {
+		t.Error("secret without window must be allowed")
+	}
+}
+
+func TestLoadSecrets_RereadsFile(t *testing.T) {
+	path := t.TempDir() + "/secrets.txt"
+	os.WriteFile(path, []byte("aabbccddeeff00112233445566778899"), 0600)
+	opts := &Options{
+		Secrets:       [][]byte{make([]byte, 16)},
+		SecretFile:    path,
+		staticSecrets: 1,
+	}
+	if !opts.SecretsReloadable() {
+		t.Fatal("a secret file must be reloadable")
+	}
+	secrets, err := opts.LoadSecrets()
+	if err != nil || len(secrets) != 2 || secrets[1][0] != 0xaa {
+		t.Fatalf("first load: %x, %v", secrets, err)
+	}
+
+	os.WriteFile(path, []byte("ffeeddccbbaa00112233445566778899@..2000-01-01"), 0600)
+	secrets, err = opts.LoadSecrets()
+	if err != nil || len(secrets) != 2 || secrets[1][0] != 0xff {
+		t.Fatalf("reload: %x, %v", secrets, err)
+	}
+	if opts.SecretAllowed(secrets[1], time.Now()) {
+		t.Error("window of the reloaded entry not applied")
+	}
+	if !opts.SecretAllowed(secrets[0], time.Now()) {
+		t.Error("-S secret must stay valid")
+	}
+}
+
+func TestLoadSecrets_Sealed(t *testing.T) {
+	t.Setenv("TEST_SECRETS_KEY", strings.Repeat("5a", crypto.SealKeySize))
+	key, err := loadSecretsKey("TEST_SECRETS_KEY", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "secrets.txt")
+	os.WriteFile(plain, []byte("aabbccddeeff00112233445566778899"), 0600)
+	var sealed bytes.Buffer
+	if err := sealFile(plain, key, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := sealFile(plain, nil, io.Discard); err == nil {
+		t.Error("--seal without a key: expected error")
+	}
+	path := filepath.Join(dir, "secrets.sealed")
+	os.WriteFile(path, sealed.Bytes(), 0600)
+	if err := sealFile(path, key, io.Discard); err == nil {
+		t.Error("sealing a sealed file: expected error")
+	}
+	secretDir := filepath.Join(dir, "secrets.d")
+	os.Mkdir(secretDir, 0700)
+	os.WriteFile(filepath.Join(secretDir, "a"), sealed.Bytes(), 0600)
+	os.WriteFile(filepath.Join(secretDir, "b"), []byte("ffeeddccbbaa00112233445566778899"), 0600)
+
+	opts := &Options{SecretFile: path, SecretDir: secretDir, secretsKey: key}
+	secrets, err := opts.LoadSecrets()
+	if err != nil || len(secrets) != 3 || secrets[0][0] != 0xaa || secrets[1][0] != 0xaa || secrets[2][0] != 0xff {
+		t.Fatalf("LoadSecrets = %x, %v", secrets, err)
+	}
+	opts.secretsKey = nil
+	if _, err := opts.LoadSecrets(); !errors.Is(err, crypto.ErrSealKeyMissing) {
+		t.Errorf("without a key: err = %v, want ErrSealKeyMissing", err)
+	}
+}
+
+func TestLoadSecretsKey(t *testing.T) {
+	want := bytes.Repeat([]byte{0x5a}, crypto.SealKeySize)
+	key, err := loadSecretsKey("", "printf '%s\\n' "+strings.Repeat("5a", crypto.SealKeySize))
+	if err != nil || !bytes.Equal(key, want) {
+		t.Fatalf("command key = %x, %v", key, err)
+	}
+	if _, err := loadSecretsKey("", "exit 3"); err == nil {
+		t.Error("failing command: expected error")
+	}
+	if _, err := loadSecretsKey("TEST_SECRETS_KEY_UNSET", ""); err == nil {
+		t.Error("unset variable: expected error")
+	}
+	t.Setenv("TEST_SECRETS_KEY", "not a key")
+	if _, err := loadSecretsKey("TEST_SECRETS_KEY", ""); err == nil {
+		t.Error("malformed key: expected error")
+	}
+}
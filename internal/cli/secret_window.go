@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SecretWindow limits the period in which a secret is accepted.
+// A zero NotBefore or NotAfter leaves that side of the window open.
+type SecretWindow struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Contains reports whether t falls inside the window.
+func (w SecretWindow) Contains(t time.Time) bool {
+	if !w.NotBefore.IsZero() && t.Before(w.NotBefore) {
+		return false
+	}
+	if !w.NotAfter.IsZero() && !t.Before(w.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// parseSecretToken parses one entry of a secrets file:
+//
+//	<hex>
+//	<hex>@<not-before>..<not-after>
+//
+// Either bound may be omitted ("<hex>@..2026-12-31"). Bounds are RFC 3339
+// timestamps or YYYY-MM-DD dates (midnight UTC). The returned bool reports
+// whether a window was present.
+func parseSecretToken(flag, tok string) ([]byte, SecretWindow, bool, error) {
+	var w SecretWindow
+	hexPart, windowPart, hasWindow := strings.Cut(tok, "@")
+	b, err := decodeHexSecret(flag, hexPart, 16)
+	if err != nil {
+		return nil, w, false, err
+	}
+	if !hasWindow {
+		return b, w, false, nil
+	}
+
+	from, to, ok := strings.Cut(windowPart, "..")
+	if !ok {
+		return nil, w, false, fmt.Errorf("%s: expected <not-before>..<not-after> after '@' in %q", flag, tok)
+	}
+	if w.NotBefore, err = parseWindowBound(from); err != nil {
+		return nil, w, false, fmt.Errorf("%s: not-before in %q: %w", flag, tok, err)
+	}
+	if w.NotAfter, err = parseWindowBound(to); err != nil {
+		return nil, w, false, fmt.Errorf("%s: not-after in %q: %w", flag, tok, err)
+	}
+	if !w.NotBefore.IsZero() && !w.NotAfter.IsZero() && !w.NotBefore.Before(w.NotAfter) {
+		return nil, w, false, fmt.Errorf("%s: empty validity window in %q", flag, tok)
+	}
+	return b, w, true, nil
+}
+
+// parseWindowBound parses a single window bound; "" means unbounded.
+func parseWindowBound(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// SecretWindow returns the validity window of secret. ok is false when the
+// secret has no window. Safe for concurrent use with LoadSecrets.
+func (o *Options) SecretWindow(secret []byte) (SecretWindow, bool) {
+	o.windowsMu.RLock()
+	defer o.windowsMu.RUnlock()
+	w, ok := o.windows[string(secret)]
+	return w, ok
+}
+
+// SecretAllowed reports whether secret may be used at time now according
+// to its validity window. Secrets without a window are always allowed.
+func (o *Options) SecretAllowed(secret []byte, now time.Time) bool {
+	w, ok := o.SecretWindow(secret)
+	return !ok || w.Contains(now)
+}
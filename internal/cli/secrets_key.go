@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/crypto"
+)
+
+// secretsKeyCommandTimeout bounds --secrets-key-command, which may call out
+// to a KMS.
+const secretsKeyCommandTimeout = 30 * time.Second
+
+// loadSecretsKey reads the key for sealed files from the environment
+// variable env or, if env is empty, from the output of command run with
+// /bin/sh. The key is kept in memory only.
+func loadSecretsKey(env, command string) ([]byte, error) {
+	if env != "" {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("--secrets-key-env: %s is not set", env)
+		}
+		key, err := crypto.ParseSealKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("--secrets-key-env %s: %w", env, err)
+		}
+		return key, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretsKeyCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("--secrets-key-command: %w", err)
+	}
+	key, err := crypto.ParseSealKey(out.String())
+	if err != nil {
+		return nil, fmt.Errorf("--secrets-key-command: %w", err)
+	}
+	return key, nil
+}
+
+// readSecretsFile reads a secrets file, decrypting it with key if it is
+// sealed.
+func readSecretsFile(path string, key []byte) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	data, err = crypto.Unseal(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, nil
+}
+
+// sealFile writes the contents of path, encrypted with key, to w (--seal).
+func sealFile(path string, key []byte, w io.Writer) error {
+	if key == nil {
+		return fmt.Errorf("no secrets key: give --secrets-key-env or --secrets-key-command")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if crypto.IsSealed(data) {
+		return fmt.Errorf("%s is already encrypted", path)
+	}
+	sealed, err := crypto.Seal(key, data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// SecretsKey returns the key for sealed files, or nil if none was given.
+func (o *Options) SecretsKey() []byte {
+	return o.secretsKey
+}
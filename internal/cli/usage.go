@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+	"github.com/skrashevich/MTProxy/internal/proxy"
 )
 
 const versionStr = "mtproxy-0.02 (Go port)"
@@ -12,24 +15,114 @@ const versionStr = "mtproxy-0.02 (Go port)"
 func PrintUsage(fs *flag.FlagSet) {
 	fmt.Fprintf(os.Stderr, "%s\n", versionStr)
 	fmt.Fprintf(os.Stderr, "\tSimple MT-Proto proxy\n\n")
-	fmt.Fprintf(os.Stderr, "Usage: %s [options] <config-file>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <config-file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s selftest [--timeout <sec>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s gensecret [--ee <domain>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s getlink --host <host> [--port <port>] -S <secret>... [-D <domain>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s checkconfig [--aes-pwd <path>] [--mtproto-secret-file <path>] [--dial] <config-file>\n\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "Options:\n")
 	fmt.Fprintf(os.Stderr, "  -S, --mtproto-secret <hex>      16-byte secret in hex (32 chars); repeatable\n")
 	fmt.Fprintf(os.Stderr, "      --mtproto-secret-file <path> file with secrets (comma/whitespace sep)\n")
+	fmt.Fprintf(os.Stderr, "      --mtproto-secret-dir <dir>  directory with one secret per file; hot-reloaded\n")
+	fmt.Fprintf(os.Stderr, "      --secret-revoke-grace <sec> close connections of a removed secret after N sec (default 0 = keep)\n")
+	fmt.Fprintf(os.Stderr, "      --secrets-key-env <var>     env variable with the key for encrypted secret files\n")
+	fmt.Fprintf(os.Stderr, "      --secrets-key-command <cmd> shell command printing that key (e.g. a KMS decrypt)\n")
+	fmt.Fprintf(os.Stderr, "      --seal <path>               encrypt a file with the secrets key to stdout and exit\n")
 	fmt.Fprintf(os.Stderr, "  -P, --proxy-tag <hex>           16-byte proxy tag in hex (32 chars)\n")
 	fmt.Fprintf(os.Stderr, "  -M, --slaves <N>                spawn N worker processes (default 1)\n")
+	fmt.Fprintf(os.Stderr, "      --inherit-listeners         with -M, workers inherit client ports bound by the supervisor\n")
 	fmt.Fprintf(os.Stderr, "  -H, --http-ports <ports>        comma-separated HTTP listen ports\n")
+	fmt.Fprintf(os.Stderr, "      --udp-ports <ports>         experimental UDP client ports (datagram sessions)\n")
+	fmt.Fprintf(os.Stderr, "      --accept-loops <N>          accept goroutines per client listener (default 1)\n")
+	fmt.Fprintf(os.Stderr, "      --latency-sample-rate <N>   trace latency of one in N frames (0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --latency-reservoir <N>     latency samples kept for /debug/latency (default %d)\n", proxy.DefaultLatencyReservoir)
+	fmt.Fprintf(os.Stderr, "      --enable-pprof              serve /debug/pprof/ on the stats listener\n")
+	fmt.Fprintf(os.Stderr, "      --authorizer <url>          external authorizer: http(s)://... or unix:/path\n")
+	fmt.Fprintf(os.Stderr, "      --authorizer-timeout <sec>  authorizer call timeout (default 0.2)\n")
+	fmt.Fprintf(os.Stderr, "      --authorizer-fail-open      allow connections when the authorizer fails\n")
+	fmt.Fprintf(os.Stderr, "      --duplicate-targets <mode>  repeated proxy_for targets: dedup (default) or weight\n")
+	fmt.Fprintf(os.Stderr, "      --balance <policy>          random (default), round-robin, least-outstanding, weighted, hash\n")
+	fmt.Fprintf(os.Stderr, "      --session-affinity <sec>    pin each session to its target while active (0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --session-affinity-max <N>  most sessions pinned at once (default 100000)\n")
+	fmt.Fprintf(os.Stderr, "      --routing-seed <N>          seed for random target selection (0 = random, logged)\n")
+	fmt.Fprintf(os.Stderr, "      --min-default-targets <N>   reject reloads leaving fewer default-cluster targets\n")
+	fmt.Fprintf(os.Stderr, "      --config-fetch-interval <sec>  download and apply the config periodically (default 0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --config-url <url>          config download URL (default %s)\n", config.DefaultFetchURL)
+	fmt.Fprintf(os.Stderr, "      --config-fetch-jitter <sec> random extra delay before each download (default 60)\n")
+	fmt.Fprintf(os.Stderr, "      --watch-config              reload the config and secret file when they change, like SIGHUP\n")
+	fmt.Fprintf(os.Stderr, "      --watch-config-debounce <sec>  how long a change must settle before the reload (default 2)\n")
 	fmt.Fprintf(os.Stderr, "      --aes-pwd <path>            AES secret file for RPC\n")
 	fmt.Fprintf(os.Stderr, "      --http-stats                enable HTTP stats on main port\n")
+	fmt.Fprintf(os.Stderr, "      --stats-addr <host:port>    stats listener address (implies --http-stats)\n")
+	fmt.Fprintf(os.Stderr, "      --admin-socket <path|@name> stats and admin API on a unix socket (@name: abstract)\n")
+	fmt.Fprintf(os.Stderr, "      --admin-uid <uid>           UID allowed on the admin socket besides our own; repeatable\n")
+	fmt.Fprintf(os.Stderr, "      --ingress-stats <cidr,...>  answer HTTP GET /stats on the client port for these networks\n")
+	fmt.Fprintf(os.Stderr, "      --trace-conn <cidr,...>     log every frame of connections from these clients\n")
 	fmt.Fprintf(os.Stderr, "  -C, --max-special-connections N max accepted client connections per worker\n")
-	fmt.Fprintf(os.Stderr, "  -W, --window-clamp N            TCP window clamp for client connections\n")
+	fmt.Fprintf(os.Stderr, "      --overload-policy <mode>    when overloaded: accept (default), close or handshake\n")
+	fmt.Fprintf(os.Stderr, "      --memory-budget <MiB>       heap size above which load is shed (0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --max-handlers-per-cpu N    handler goroutines per GOMAXPROCS before accepts are rejected (0 = off)\n")
+	fmt.Fprintf(os.Stderr, "  -W, --window-clamp N            TCP window clamp for client connections (default 131072 without -D)\n")
+	fmt.Fprintf(os.Stderr, "      --msg-buffers-size <N>      bytes of frame buffers kept for reuse, k/m/g suffix allowed (default 256m)\n")
+	fmt.Fprintf(os.Stderr, "      --tcp-nodelay=false         leave Nagle's algorithm on for client and DC sockets\n")
+	fmt.Fprintf(os.Stderr, "      --tcp-keepalive <sec>       TCP keepalive idle time and probe interval (0 = default)\n")
+	fmt.Fprintf(os.Stderr, "      --tcp-user-timeout <sec>    drop sockets whose sent data stays unacknowledged this long (0 = off)\n")
 	fmt.Fprintf(os.Stderr, "  -D, --domain <domain>           TLS domain; disables other transports; repeatable\n")
+	fmt.Fprintf(os.Stderr, "      --fallback-addr <host:port> hand connections that are not proxy clients to this web server\n")
 	fmt.Fprintf(os.Stderr, "  -T, --ping-interval <sec>       ping interval for local TCP (default 5.0)\n")
-	fmt.Fprintf(os.Stderr, "  -u, --user <username>           setuid to this user\n")
-	fmt.Fprintf(os.Stderr, "  -6                              prefer IPv6 for outbound\n")
+	fmt.Fprintf(os.Stderr, "      --health-check-interval <sec> probe every config target this often (0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --health-check-timeout <sec>  how long one probe may take (default 5)\n")
+	fmt.Fprintf(os.Stderr, "      --health-check-rise <N>     successful probes in a row that mark a target healthy (default 2)\n")
+	fmt.Fprintf(os.Stderr, "      --health-check-fall <N>     failed probes in a row that mark a target unhealthy (default 3)\n")
+	fmt.Fprintf(os.Stderr, "      --dial-backoff-max <sec>    longest wait before redialling a failing target (default 60, 0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --block-threshold <N>       block IPs after N failed handshakes per window (0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --block-window <sec>        window for counting failed handshakes (default 60)\n")
+	fmt.Fprintf(os.Stderr, "      --block-ttl <sec>           how long an IP stays blocked (default 600)\n")
+	fmt.Fprintf(os.Stderr, "      --block-file <path>         persist the blocklist across restarts\n")
+	fmt.Fprintf(os.Stderr, "      --surge-factor <x>          tighten admission at x times the baseline connection rate (0 = off)\n")
+	fmt.Fprintf(os.Stderr, "      --surge-min-rate <N>        connections per minute below which no surge is declared (default 600)\n")
+	fmt.Fprintf(os.Stderr, "      --surge-cooldown <sec>      how long admission stays tightened (default 300)\n")
+	fmt.Fprintf(os.Stderr, "      --max-conns-per-ip <N>      open connections allowed per source IP (0 = unlimited)\n")
+	fmt.Fprintf(os.Stderr, "      --per-ip-accept-rate <x>    new connections per second allowed per source IP (0 = unlimited)\n")
+	fmt.Fprintf(os.Stderr, "      --standby                   bind but accept only after SIGUSR2 or POST /admin/activate on --admin-socket\n")
+	fmt.Fprintf(os.Stderr, "      --public-host <host>        public host reported in the registration descriptor\n")
+	fmt.Fprintf(os.Stderr, "      --descriptor-file <path>    write a JSON registration descriptor after startup\n")
+	fmt.Fprintf(os.Stderr, "      --crash-dir <dir>           write crash reports to this directory\n")
+	fmt.Fprintf(os.Stderr, "      --cpu-profile-dir <dir>     capture CPU profiles here when usage stays high\n")
+	fmt.Fprintf(os.Stderr, "      --cpu-profile-threshold <pct>  CPU usage (percent of GOMAXPROCS) that triggers a profile (default 80)\n")
+	fmt.Fprintf(os.Stderr, "      --cpu-profile-after <sec>   how long usage must stay above the threshold (default 30)\n")
+	fmt.Fprintf(os.Stderr, "      --cpu-profile-keep <N>      CPU profiles kept on disk (default 10)\n")
+	fmt.Fprintf(os.Stderr, "      --final-stats-file <path>   write the final stats snapshot (JSON) on shutdown\n")
+	fmt.Fprintf(os.Stderr, "      --shutdown-grace <sec>      keep serving open sessions this long on shutdown (default 5)\n")
+	fmt.Fprintf(os.Stderr, "      --exit-audit                on shutdown, report leaked listeners, connections and goroutines\n")
+	fmt.Fprintf(os.Stderr, "  -u, --user <username>           drop root to this user after binding ports\n")
+	fmt.Fprintf(os.Stderr, "      --max-frame-pre-handshake <bytes> largest client frame before the first encrypted one (default 131072)\n")
+	fmt.Fprintf(os.Stderr, "      --max-frame-unencrypted <bytes>   largest unencrypted (DH) client frame (default 8192)\n")
+	fmt.Fprintf(os.Stderr, "      --max-frame-encrypted <bytes>     largest encrypted client frame (default 16777216)\n")
+	fmt.Fprintf(os.Stderr, "      --answer-pings              answer client transport pings locally\n")
+	fmt.Fprintf(os.Stderr, "      --dedup-frames <N>          drop repeats of the last N client frames per session (0 = off, max 64)\n")
+	fmt.Fprintf(os.Stderr, "      --inject-latency <sec>      delay every frame written to a client (testing only)\n")
+	fmt.Fprintf(os.Stderr, "      --inject-jitter <sec>       random extra delay per frame, up to this much\n")
+	fmt.Fprintf(os.Stderr, "      --max-response-size <bytes> largest frame accepted from a DC (default 2097152)\n")
+	fmt.Fprintf(os.Stderr, "      --response-first-byte-timeout <sec> wait for a DC response to start (default 30)\n")
+	fmt.Fprintf(os.Stderr, "      --response-stall-timeout <sec>      longest gap within a DC frame (default 5)\n")
+	fmt.Fprintf(os.Stderr, "      --dns <server>              DNS for targets: ip, udp://, tls:// (DoT), https:// (DoH); repeatable\n")
+	fmt.Fprintf(os.Stderr, "      --outbound-device <ifname>  bind outbound connections to interface/VRF (Linux)\n")
+	fmt.Fprintf(os.Stderr, "      --outbound-proxy <url>      reach DCs via a socks5:// proxy; repeatable\n")
+	fmt.Fprintf(os.Stderr, "      --loopback-backend          echo requests back instead of contacting DCs (testing only)\n")
+	fmt.Fprintf(os.Stderr, "      --test-backend              route DCs to an in-process mock middle proxy; no config file (testing only)\n")
+	fmt.Fprintf(os.Stderr, "  -6, --ipv6                      prefer IPv6 targets, fall back to IPv4 (Happy Eyeballs)\n")
 	fmt.Fprintf(os.Stderr, "  -v, --verbosity [N]             increase or set verbosity level\n")
-	fmt.Fprintf(os.Stderr, "  -d, --daemonize                 daemonize\n")
+	fmt.Fprintf(os.Stderr, "  -d, --daemonize                 run in the background (output to -l or /dev/null)\n")
+	fmt.Fprintf(os.Stderr, "  -l, --log <file>                log file\n")
+	fmt.Fprintf(os.Stderr, "      --pid-file <path>           write the process id to this file\n")
+	fmt.Fprintf(os.Stderr, "      --config-yaml <path>        YAML (or .toml) file of long options; MTPROXY_GO_* env and flags override it\n")
 	fmt.Fprintf(os.Stderr, "  -h, --help                      print this help\n")
 	fmt.Fprintf(os.Stderr, "\nPositional:\n")
-	fmt.Fprintf(os.Stderr, "  <config-file>                   path to proxy-multi.conf\n")
+	fmt.Fprintf(os.Stderr, "  <config-file>                   path to proxy-multi.conf (omitted with --test-backend or config-file set)\n")
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "  selftest                        run a client session through a mock backend, exit 0 if it works\n")
+	fmt.Fprintf(os.Stderr, "  gensecret                       print a new random secret and its dd (or --ee fake TLS) client form\n")
+	fmt.Fprintf(os.Stderr, "  getlink                         print tg:// and t.me/proxy links for the given secrets\n")
+	fmt.Fprintf(os.Stderr, "  checkconfig                     validate a config and the files it runs with, exit 1 on any failure\n")
 }
@@ -2,10 +2,16 @@ package config
 
 import (
 	"bufio"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Target represents a single backend server address.
@@ -15,22 +21,159 @@ type Target struct {
 }
 
 func (t Target) String() string {
-	return fmt.Sprintf("%s:%d", t.Addr, t.Port)
+	return net.JoinHostPort(t.Addr, strconv.Itoa(t.Port))
 }
 
 // Cluster represents a group of backend targets for a single DC ID.
 type Cluster struct {
 	ID      int
 	Targets []Target
+	// Canary, if set, receives CanaryPercent percent of new sessions for
+	// this DC instead of Targets ("canary <dc_id> <host>:<port> <percent>;").
+	Canary        *Target
+	CanaryPercent int
+	// Options holds the per-cluster settings of a v2 config.
+	Options ClusterOptions
+}
+
+// ClusterOptions are the per-cluster settings of a version 2 config
+// ("cluster <dc_id> { ... }"). Zero values mean the proxy-wide default.
+type ClusterOptions struct {
+	// Timeout is how long a request to one of the cluster's targets waits
+	// for its response to start arriving.
+	Timeout time.Duration
+	// MinConnections and MaxConnections bound the pool of connections per
+	// target: MinConnections are opened up front, and more up to
+	// MaxConnections while every pooled connection is busy.
+	MinConnections int
+	MaxConnections int
+	// SourceAddr is the local IP outbound connections are bound to.
+	SourceAddr string
+	// PingInterval is how often idle connections are pinged.
+	PingInterval time.Duration
+	// Balance picks the cluster's target for each request.
+	Balance BalancePolicy
 }
 
 // Config holds the parsed proxy-multi.conf configuration.
 type Config struct {
+	// Version is the config format: 1 for the flat proxy-multi.conf
+	// directives, 2 when the file starts with "version 2;".
+	Version int
 	// Clusters maps DC ID to cluster. Negative DC IDs are IPv6 clusters.
 	Clusters         map[int]*Cluster
 	DefaultClusterID int
 	// Raw bytes read, for md5
 	Bytes int
+	// MD5 is the hex MD5 of the raw file contents.
+	MD5 string
+	// Hosts maps lower-cased target host names to static addresses
+	// ("hosts <name> <ip>;"), bypassing DNS for those names.
+	Hosts map[string]string
+	// Warnings lists non-fatal problems found while parsing (duplicate
+	// targets, unusual ports, single-target clusters, very low timeouts).
+	Warnings []string
+}
+
+// DuplicatePolicy selects how repeated host:port lines within a cluster
+// are treated.
+type DuplicatePolicy int
+
+const (
+	// DuplicatesDedup keeps only the first occurrence of a target.
+	DuplicatesDedup DuplicatePolicy = iota
+	// DuplicatesWeight keeps every occurrence, so a target listed N times
+	// is picked N times as often.
+	DuplicatesWeight
+)
+
+// ParseDuplicatePolicy converts "dedup" or "weight" to a DuplicatePolicy.
+// The empty string selects DuplicatesDedup.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch s {
+	case "", "dedup":
+		return DuplicatesDedup, nil
+	case "weight":
+		return DuplicatesWeight, nil
+	}
+	return 0, fmt.Errorf("unknown duplicate target policy %q (want dedup or weight)", s)
+}
+
+func (p DuplicatePolicy) String() string {
+	if p == DuplicatesWeight {
+		return "weight"
+	}
+	return "dedup"
+}
+
+// BalancePolicy selects how a target is picked among a cluster's targets.
+type BalancePolicy int
+
+const (
+	// BalanceDefault leaves the choice to the proxy-wide policy.
+	BalanceDefault BalancePolicy = iota
+	// BalanceRandom picks a target at random, like choose_proxy_target().
+	BalanceRandom
+	// BalanceRoundRobin cycles through the targets in config order.
+	BalanceRoundRobin
+	// BalanceLeastOutstanding picks the target with the fewest requests
+	// waiting for an answer.
+	BalanceLeastOutstanding
+	// BalanceWeighted picks at random in proportion to each target's weight
+	// times its max_connections (or min_connections).
+	BalanceWeighted
+	// BalanceHash picks by a consistent hash of the client's auth_key_id,
+	// so a client keeps its target while the target list stays the same.
+	BalanceHash
+)
+
+var balancePolicyNames = [...]string{
+	BalanceDefault:          "default",
+	BalanceRandom:           "random",
+	BalanceRoundRobin:       "round-robin",
+	BalanceLeastOutstanding: "least-outstanding",
+	BalanceWeighted:         "weighted",
+	BalanceHash:             "hash",
+}
+
+// ParseBalancePolicy converts a policy name ("random", "round-robin",
+// "least-outstanding", "weighted" or "hash") to a BalancePolicy.
+func ParseBalancePolicy(s string) (BalancePolicy, error) {
+	for p, name := range balancePolicyNames {
+		if p != int(BalanceDefault) && name == s {
+			return BalancePolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown balance policy %q (want random, round-robin, least-outstanding, weighted or hash)", s)
+}
+
+func (p BalancePolicy) String() string {
+	if p < 0 || int(p) >= len(balancePolicyNames) {
+		return fmt.Sprintf("BalancePolicy(%d)", int(p))
+	}
+	return balancePolicyNames[p]
+}
+
+// ParseOptions controls optional parser behaviour.
+type ParseOptions struct {
+	Duplicates DuplicatePolicy
+}
+
+// minSaneTimeoutMs is the lowest `timeout` value accepted without a warning.
+const minSaneTimeoutMs = 100
+
+// maxTargetWeight caps the weight of a single v2 target line.
+const maxTargetWeight = 100
+
+// warnf records a non-fatal parse warning.
+func (c *Config) warnf(format string, args ...any) {
+	c.Warnings = append(c.Warnings, fmt.Sprintf(format, args...))
+}
+
+// usualPort reports whether port is one Telegram middle-proxies are
+// normally reachable on.
+func usualPort(port int) bool {
+	return port == 80 || port == 443 || port >= 1024
 }
 
 // ParseConfig reads and parses a proxy-multi.conf style configuration file.
@@ -39,9 +182,38 @@ type Config struct {
 //
 //	default <dc_id>;
 //	proxy_for <dc_id> <host>:<port>;
+//	hosts <host> <ip>;
+//	canary <dc_id> <host>:<port> <percent>;
+//
+// Lines starting with '#' are comments. Problems that do not prevent the
+// proxy from working are collected in Config.Warnings instead of failing.
+// Duplicate targets are dropped; see ParseConfigWithOptions.
+//
+// A file whose first directive is "version 2;" may additionally group a
+// DC's targets with per-cluster options in a block, one directive per line:
 //
-// Lines starting with '#' are comments.
+//	cluster <dc_id> {
+//	    target <host>:<port> [weight <n>];
+//	    canary <host>:<port> <percent>;
+//	    timeout <ms>;
+//	    min_connections <n>;
+//	    max_connections <n>;
+//	    tls off;
+//	    source <ip>;
+//	    ping_interval <seconds>;
+//	    balance <policy>;
+//	}
+//
+// Version 1 files keep parsing exactly as before.
 func ParseConfig(filename string) (*Config, error) {
+	return ParseConfigWithOptions(filename, ParseOptions{})
+}
+
+// ParseConfigWithOptions is ParseConfig with explicit parser options.
+// Target hosts are normalized (lower-cased, canonical IP form) before
+// duplicates are detected, so "[::0:1]:443" and "[::1]:443" are the same
+// target.
+func ParseConfigWithOptions(filename string, popts ParseOptions) (*Config, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("open config %s: %w", filename, err)
@@ -49,11 +221,86 @@ func ParseConfig(filename string) (*Config, error) {
 	defer f.Close()
 
 	cfg := &Config{
+		Version:          1,
 		Clusters:         make(map[int]*Cluster),
 		DefaultClusterID: 2, // telegram default
 	}
 
-	scanner := bufio.NewScanner(f)
+	// seen tracks host:port pairs per cluster for duplicate detection.
+	seen := make(map[int]map[string]int)
+	// canaries are attached once all proxy_for lines are known, so they
+	// may appear anywhere in the file.
+	type canaryLine struct {
+		lineNo, dcID, percent int
+		target                Target
+	}
+	var canaries []canaryLine
+
+	// addTarget adds addrPort to DC dcID weight times.
+	addTarget := func(lineNo, dcID int, addrPort string, weight int) error {
+		host, portStr, err := splitHostPort(addrPort)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid addr:port %q: %w", filename, lineNo, addrPort, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port >= 65536 {
+			return fmt.Errorf("%s:%d: invalid port %q", filename, lineNo, portStr)
+		}
+
+		if !usualPort(port) {
+			cfg.warnf("%s:%d: unusual port %d for DC %d", filename, lineNo, port, dcID)
+		}
+
+		cl, ok := cfg.Clusters[dcID]
+		if !ok {
+			cl = &Cluster{ID: dcID}
+			cfg.Clusters[dcID] = cl
+		}
+		if seen[dcID] == nil {
+			seen[dcID] = make(map[string]int)
+		}
+		t := Target{Addr: normalizeHost(host), Port: port}
+		key := net.JoinHostPort(t.Addr, portStr)
+		if first, dup := seen[dcID][key]; dup {
+			if popts.Duplicates == DuplicatesWeight {
+				cfg.warnf("%s:%d: duplicate target %s for DC %d (first at line %d), counted as extra weight", filename, lineNo, t, dcID, first)
+			} else {
+				cfg.warnf("%s:%d: duplicate target %s for DC %d (first at line %d), ignored", filename, lineNo, t, dcID, first)
+				return nil
+			}
+		} else {
+			seen[dcID][key] = lineNo
+		}
+		for range weight {
+			cl.Targets = append(cl.Targets, t)
+		}
+		return nil
+	}
+	// addCanary records a canary for DC dcID.
+	addCanary := func(lineNo, dcID int, addrPort, percentStr string) error {
+		host, portStr, err := splitHostPort(addrPort)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid addr:port %q: %w", filename, lineNo, addrPort, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port >= 65536 {
+			return fmt.Errorf("%s:%d: invalid port %q", filename, lineNo, portStr)
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(percentStr, "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return fmt.Errorf("%s:%d: invalid canary percentage %q (want 0-100)", filename, lineNo, percentStr)
+		}
+		canaries = append(canaries, canaryLine{lineNo, dcID, percent, Target{Addr: normalizeHost(host), Port: port}})
+		return nil
+	}
+
+	// block is the v2 cluster block being parsed, blockLine where it opened.
+	var block *Cluster
+	blockLine := 0
+	directives := 0
+
+	sum := md5.New()
+	scanner := bufio.NewScanner(io.TeeReader(f, sum))
 	lineNo := 0
 	for scanner.Scan() {
 		lineNo++
@@ -75,6 +322,28 @@ func ParseConfig(filename string) (*Config, error) {
 		if len(fields) == 0 {
 			continue
 		}
+		directives++
+
+		if fields[0] == "version" {
+			if directives != 1 {
+				return nil, fmt.Errorf("%s:%d: 'version' must be the first directive", filename, lineNo)
+			}
+			if len(fields) < 2 || (fields[1] != "1" && fields[1] != "2") {
+				return nil, fmt.Errorf("%s:%d: unsupported config version (want 1 or 2)", filename, lineNo)
+			}
+			cfg.Version, _ = strconv.Atoi(fields[1])
+			continue
+		}
+		if block != nil {
+			if fields[0] == "}" {
+				block = nil
+				continue
+			}
+			if err := parseClusterDirective(cfg, block, fields, filename, lineNo, addTarget, addCanary); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
 		switch fields[0] {
 		case "default":
@@ -95,22 +364,66 @@ func ParseConfig(filename string) (*Config, error) {
 			if err != nil {
 				return nil, fmt.Errorf("%s:%d: invalid DC id %q: %w", filename, lineNo, fields[1], err)
 			}
-			addrPort := fields[2]
-			host, portStr, err := splitHostPort(addrPort)
+			if err := addTarget(lineNo, dcID, fields[2], 1); err != nil {
+				return nil, err
+			}
+
+		case "canary":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("%s:%d: 'canary' requires dc_id, addr:port and a percentage", filename, lineNo)
+			}
+			dcID, err := strconv.Atoi(fields[1])
 			if err != nil {
-				return nil, fmt.Errorf("%s:%d: invalid addr:port %q: %w", filename, lineNo, addrPort, err)
+				return nil, fmt.Errorf("%s:%d: invalid DC id %q: %w", filename, lineNo, fields[1], err)
 			}
-			port, err := strconv.Atoi(portStr)
-			if err != nil || port <= 0 || port >= 65536 {
-				return nil, fmt.Errorf("%s:%d: invalid port %q", filename, lineNo, portStr)
+			if err := addCanary(lineNo, dcID, fields[2], fields[3]); err != nil {
+				return nil, err
 			}
 
+		case "cluster":
+			if cfg.Version < 2 {
+				return nil, fmt.Errorf("%s:%d: 'cluster' blocks need 'version 2;' at the top of the file", filename, lineNo)
+			}
+			if len(fields) != 3 || fields[2] != "{" {
+				return nil, fmt.Errorf("%s:%d: want 'cluster <dc_id> {'", filename, lineNo)
+			}
+			dcID, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid DC id %q: %w", filename, lineNo, fields[1], err)
+			}
 			cl, ok := cfg.Clusters[dcID]
 			if !ok {
 				cl = &Cluster{ID: dcID}
 				cfg.Clusters[dcID] = cl
 			}
-			cl.Targets = append(cl.Targets, Target{Addr: host, Port: port})
+			block, blockLine = cl, lineNo
+
+		case "hosts":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%s:%d: 'hosts' requires a name and an IP address", filename, lineNo)
+			}
+			ip := net.ParseIP(fields[2])
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: invalid IP address %q", filename, lineNo, fields[2])
+			}
+			if cfg.Hosts == nil {
+				cfg.Hosts = make(map[string]string)
+			}
+			cfg.Hosts[strings.ToLower(fields[1])] = ip.String()
+
+		case "timeout":
+			if len(fields) < 2 {
+				cfg.warnf("%s:%d: 'timeout' without a value, ignored", filename, lineNo)
+				break
+			}
+			ms, err := strconv.Atoi(fields[1])
+			if err != nil {
+				cfg.warnf("%s:%d: invalid timeout %q, ignored", filename, lineNo, fields[1])
+				break
+			}
+			if ms < minSaneTimeoutMs {
+				cfg.warnf("%s:%d: very low timeout %d ms", filename, lineNo, ms)
+			}
 
 		default:
 			// skip unknown directives (timeout, min_connections, etc.)
@@ -119,12 +432,240 @@ func ParseConfig(filename string) (*Config, error) {
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("reading config %s: %w", filename, err)
 	}
+	if block != nil {
+		return nil, fmt.Errorf("%s:%d: cluster %d block is not closed", filename, blockLine, block.ID)
+	}
+	for id, cl := range cfg.Clusters {
+		if len(cl.Targets) == 0 {
+			// A v2 block without targets would otherwise silently route
+			// the DC to the default cluster.
+			return nil, fmt.Errorf("config %s: cluster %d has no targets", filename, id)
+		}
+	}
 	if len(cfg.Clusters) == 0 {
 		return nil, fmt.Errorf("config %s: no proxy_for entries found", filename)
 	}
+	for _, c := range canaries {
+		cl, ok := cfg.Clusters[c.dcID]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: canary for DC %d, which has no proxy_for targets", filename, c.lineNo, c.dcID)
+		}
+		if cl.Canary != nil {
+			cfg.warnf("%s:%d: second canary for DC %d replaces %s", filename, c.lineNo, c.dcID, cl.Canary)
+		}
+		target := c.target
+		cl.Canary = &target
+		cl.CanaryPercent = c.percent
+		for _, t := range cl.Targets {
+			if t == target {
+				cfg.warnf("%s:%d: canary %s for DC %d is also a regular target", filename, c.lineNo, target, c.dcID)
+				break
+			}
+		}
+	}
+	cfg.MD5 = hex.EncodeToString(sum.Sum(nil))
+	for _, id := range sortedClusterIDs(cfg.Clusters) {
+		if len(cfg.Clusters[id].Targets) == 1 {
+			cfg.warnf("%s: DC %d has a single target %s", filename, id, cfg.Clusters[id].Targets[0])
+		}
+	}
 	return cfg, nil
 }
 
+// parseClusterDirective applies one directive inside a v2 "cluster" block.
+// Unlike top-level directives, unknown ones are errors: a mistyped option
+// would otherwise silently leave the cluster on the defaults.
+func parseClusterDirective(cfg *Config, cl *Cluster, fields []string, filename string, lineNo int,
+	addTarget func(lineNo, dcID int, addrPort string, weight int) error,
+	addCanary func(lineNo, dcID int, addrPort, percent string) error) error {
+	arg := func(name string) (string, error) {
+		if len(fields) != 2 {
+			return "", fmt.Errorf("%s:%d: '%s' takes one value", filename, lineNo, name)
+		}
+		return fields[1], nil
+	}
+	count := func(name string) (int, error) {
+		v, err := arg(name)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s:%d: invalid %s %q", filename, lineNo, name, v)
+		}
+		return n, nil
+	}
+	opts := &cl.Options
+	switch fields[0] {
+	case "target":
+		weight := 1
+		switch {
+		case len(fields) == 2:
+		case len(fields) == 4 && fields[2] == "weight":
+			w, err := strconv.Atoi(fields[3])
+			if err != nil || w < 1 || w > maxTargetWeight {
+				return fmt.Errorf("%s:%d: invalid weight %q (want 1-%d)", filename, lineNo, fields[3], maxTargetWeight)
+			}
+			weight = w
+		default:
+			return fmt.Errorf("%s:%d: want 'target <host>:<port> [weight <n>]'", filename, lineNo)
+		}
+		return addTarget(lineNo, cl.ID, fields[1], weight)
+
+	case "canary":
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: 'canary' requires addr:port and a percentage", filename, lineNo)
+		}
+		return addCanary(lineNo, cl.ID, fields[1], fields[2])
+
+	case "timeout":
+		ms, err := count("timeout")
+		if err != nil {
+			return err
+		}
+		if ms == 0 {
+			return fmt.Errorf("%s:%d: timeout must be positive", filename, lineNo)
+		}
+		if ms < minSaneTimeoutMs {
+			cfg.warnf("%s:%d: very low timeout %d ms for DC %d", filename, lineNo, ms, cl.ID)
+		}
+		opts.Timeout = time.Duration(ms) * time.Millisecond
+
+	case "min_connections":
+		n, err := count("min_connections")
+		if err != nil {
+			return err
+		}
+		opts.MinConnections = n
+
+	case "max_connections":
+		n, err := count("max_connections")
+		if err != nil {
+			return err
+		}
+		opts.MaxConnections = n
+
+	case "tls":
+		v, err := arg("tls")
+		if err != nil {
+			return err
+		}
+		// Connections to the DCs are plain TCP; a block asking for
+		// encryption must not run without it.
+		switch v {
+		case "off":
+		case "on":
+			return fmt.Errorf("%s:%d: tls on is not supported", filename, lineNo)
+		default:
+			return fmt.Errorf("%s:%d: tls must be on or off, got %q", filename, lineNo, v)
+		}
+
+	case "source":
+		v, err := arg("source")
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return fmt.Errorf("%s:%d: invalid source address %q", filename, lineNo, v)
+		}
+		opts.SourceAddr = ip.String()
+
+	case "ping_interval":
+		v, err := arg("ping_interval")
+		if err != nil {
+			return err
+		}
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil || sec <= 0 {
+			return fmt.Errorf("%s:%d: invalid ping_interval %q (want seconds > 0)", filename, lineNo, v)
+		}
+		opts.PingInterval = time.Duration(sec * float64(time.Second))
+
+	case "balance":
+		v, err := arg("balance")
+		if err != nil {
+			return err
+		}
+		p, err := ParseBalancePolicy(v)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, lineNo, err)
+		}
+		opts.Balance = p
+
+	default:
+		return fmt.Errorf("%s:%d: unknown cluster option %q", filename, lineNo, fields[0])
+	}
+	if opts.MinConnections > 0 && opts.MaxConnections > 0 && opts.MinConnections > opts.MaxConnections {
+		return fmt.Errorf("%s:%d: min_connections %d above max_connections %d for DC %d", filename, lineNo, opts.MinConnections, opts.MaxConnections, cl.ID)
+	}
+	return nil
+}
+
+// DialAddr returns the host:port to dial for t, applying any static
+// "hosts" override. Host names match case-insensitively, also for a
+// Target built outside the parser.
+func (c *Config) DialAddr(t Target) string {
+	if ip, ok := c.Hosts[strings.ToLower(t.Addr)]; ok {
+		t.Addr = ip
+	}
+	return t.String()
+}
+
+// DiffTargets counts targets present in b but not in a (added) and present
+// in a but not in b (removed), per cluster. Either config may be nil.
+func DiffTargets(a, b *Config) (added, removed int) {
+	as, bs := targetSet(a), targetSet(b)
+	for k, n := range bs {
+		if d := n - as[k]; d > 0 {
+			added += d
+		}
+	}
+	for k, n := range as {
+		if d := n - bs[k]; d > 0 {
+			removed += d
+		}
+	}
+	return added, removed
+}
+
+// targetSet returns the multiset of "dc/host:port" keys in cfg.
+func targetSet(cfg *Config) map[string]int {
+	set := make(map[string]int)
+	if cfg == nil {
+		return set
+	}
+	for id, cl := range cfg.Clusters {
+		for _, t := range cl.Targets {
+			set[fmt.Sprintf("%d/%s", id, net.JoinHostPort(t.Addr, strconv.Itoa(t.Port)))]++
+		}
+		if t := cl.Canary; t != nil {
+			set[fmt.Sprintf("%d/canary/%s", id, net.JoinHostPort(t.Addr, strconv.Itoa(t.Port)))]++
+		}
+	}
+	return set
+}
+
+// sortedClusterIDs returns the cluster IDs in ascending order so warnings
+// are reported deterministically.
+func sortedClusterIDs(clusters map[int]*Cluster) []int {
+	ids := make([]int, 0, len(clusters))
+	for id := range clusters {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// normalizeHost lower-cases host names and rewrites IP literals in their
+// canonical form, so equivalent spellings compare equal.
+func normalizeHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(host)
+}
+
 // splitHostPort handles both IPv6 [::1]:port and IPv4 host:port.
 func splitHostPort(s string) (host, port string, err error) {
 	if len(s) == 0 {
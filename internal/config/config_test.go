@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func writeTemp(t *testing.T, content string) string {
@@ -129,6 +131,225 @@ proxy_for 4 91.108.4.202:8888;
 	}
 }
 
+func TestParseConfig_Warnings(t *testing.T) {
+	content := `
+timeout 20;
+proxy_for 1 149.154.175.50:8888;
+proxy_for 2 149.154.161.144:8888;
+proxy_for 2 149.154.161.144:8888;
+proxy_for 2 149.154.161.145:22;
+`
+	path := writeTemp(t, content)
+	cfg, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"very low timeout 20 ms",
+		"duplicate target 149.154.161.144:8888 for DC 2 (first at line 4)",
+		"unusual port 22 for DC 2",
+		"DC 1 has a single target 149.154.175.50:8888",
+	}
+	if len(cfg.Warnings) != len(want) {
+		t.Fatalf("got %d warnings %q, want %d", len(cfg.Warnings), cfg.Warnings, len(want))
+	}
+	for i, w := range want {
+		if !strings.Contains(cfg.Warnings[i], w) {
+			t.Errorf("warning[%d] = %q, want it to contain %q", i, cfg.Warnings[i], w)
+		}
+	}
+}
+
+func TestParseConfig_NoWarnings(t *testing.T) {
+	content := `
+timeout 5000;
+proxy_for 4 91.108.4.225:8888;
+proxy_for 4 91.108.4.133:443;
+`
+	path := writeTemp(t, content)
+	cfg, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", cfg.Warnings)
+	}
+}
+
+func TestParseConfig_DuplicateTargets(t *testing.T) {
+	content := `
+proxy_for 4 91.108.4.225:8888;
+proxy_for 4 91.108.4.225:8888;
+proxy_for 4 DC4.Example.ORG:443;
+proxy_for 4 dc4.example.org:443;
+proxy_for -4 [2001:DB8:0::1]:443;
+proxy_for -4 [2001:db8::1]:443;
+`
+	path := writeTemp(t, content)
+
+	cfg, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(cfg.Clusters[4].Targets); got != 2 {
+		t.Errorf("dedup: expected 2 targets for DC=4, got %d", got)
+	}
+	if got := cfg.Clusters[4].Targets[1].Addr; got != "dc4.example.org" {
+		t.Errorf("host not lower-cased: %q", got)
+	}
+	if got := cfg.Clusters[-4].Targets; len(got) != 1 || got[0].Addr != "2001:db8::1" {
+		t.Errorf("dedup: DC=-4 targets = %v, want [2001:db8::1]", got)
+	}
+
+	cfg, err = ParseConfigWithOptions(path, ParseOptions{Duplicates: DuplicatesWeight})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(cfg.Clusters[4].Targets); got != 4 {
+		t.Errorf("weight: expected 4 targets for DC=4, got %d", got)
+	}
+	if got := len(cfg.Clusters[-4].Targets); got != 2 {
+		t.Errorf("weight: expected 2 targets for DC=-4, got %d", got)
+	}
+}
+
+func TestParseConfig_MD5AndDiff(t *testing.T) {
+	a := writeTemp(t, "proxy_for 1 10.0.0.1:8888;\nproxy_for 2 10.0.0.2:8888;\n")
+	b := writeTemp(t, "proxy_for 1 10.0.0.1:8888;\nproxy_for 2 10.0.0.3:8888;\nproxy_for 4 10.0.0.4:8888;\n")
+	ca, err := ParseConfig(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := ParseConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.MD5) != 32 || ca.MD5 == cb.MD5 {
+		t.Errorf("unexpected MD5 values %q, %q", ca.MD5, cb.MD5)
+	}
+	if added, removed := DiffTargets(ca, cb); added != 2 || removed != 1 {
+		t.Errorf("DiffTargets = +%d -%d, want +2 -1", added, removed)
+	}
+	if added, removed := DiffTargets(nil, ca); added != 2 || removed != 0 {
+		t.Errorf("DiffTargets(nil) = +%d -%d, want +2 -0", added, removed)
+	}
+}
+
+func TestDiffConfigs(t *testing.T) {
+	a := writeTemp(t, "default 2;\nproxy_for 1 10.0.0.1:8888;\nproxy_for 2 10.0.0.2:8888;\nproxy_for 3 10.0.0.3:8888;\n")
+	b := writeTemp(t, "version 2;\ndefault 4;\nproxy_for 1 10.0.0.1:8888;\n"+
+		"cluster 2 {\n target 10.0.0.5:8888;\n timeout 2000;\n}\nproxy_for 4 10.0.0.4:8888;\n")
+	ca, err := ParseConfig(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := ParseConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := DiffConfigs(ca, cb)
+	if got := strings.Join(d.TargetsAdded, "|"); got != "dc 2 10.0.0.5:8888|dc 4 10.0.0.4:8888" {
+		t.Errorf("TargetsAdded = %q", got)
+	}
+	if got := strings.Join(d.TargetsRemoved, "|"); got != "dc 2 10.0.0.2:8888|dc 3 10.0.0.3:8888" {
+		t.Errorf("TargetsRemoved = %q", got)
+	}
+	if len(d.ClustersAdded) != 1 || d.ClustersAdded[0] != 4 || len(d.ClustersRemoved) != 1 || d.ClustersRemoved[0] != 3 ||
+		len(d.ClustersChanged) != 1 || d.ClustersChanged[0] != 2 {
+		t.Errorf("clusters +%v -%v ~%v, want +[4] -[3] ~[2]", d.ClustersAdded, d.ClustersRemoved, d.ClustersChanged)
+	}
+	if len(d.TimeoutsChanged) != 1 || d.TimeoutsChanged[0] != "dc 2 timeout 0s -> 2s" {
+		t.Errorf("TimeoutsChanged = %q", d.TimeoutsChanged)
+	}
+	if want := "targets +2 -2, clusters +1 -1 ~1, 1 timeout changed, default 2 -> 4"; d.Summary() != want {
+		t.Errorf("Summary = %q, want %q", d.Summary(), want)
+	}
+	if len(d.Lines()) != 9 {
+		t.Errorf("Lines = %q", d.Lines())
+	}
+	if s := DiffConfigs(ca, ca).Summary(); s != "no changes" {
+		t.Errorf("unchanged config: %q", s)
+	}
+}
+
+func TestParseConfig_Hosts(t *testing.T) {
+	content := `
+hosts DC2.example.org 149.154.167.51;
+hosts v6.example.org 2001:db8::51;
+proxy_for 2 dc2.example.org:8888;
+proxy_for -2 v6.example.org:443;
+proxy_for 4 dc4.example.org:8888;
+`
+	path := writeTemp(t, content)
+	cfg, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.DialAddr(cfg.Clusters[2].Targets[0]); got != "149.154.167.51:8888" {
+		t.Errorf("DialAddr(dc2) = %q", got)
+	}
+	if got := cfg.DialAddr(cfg.Clusters[-2].Targets[0]); got != "[2001:db8::51]:443" {
+		t.Errorf("DialAddr(v6) = %q", got)
+	}
+	if got := cfg.DialAddr(cfg.Clusters[4].Targets[0]); got != "dc4.example.org:8888" {
+		t.Errorf("DialAddr(dc4) = %q", got)
+	}
+	if got := cfg.DialAddr(Target{Addr: "Dc2.Example.org", Port: 443}); got != "149.154.167.51:443" {
+		t.Errorf("DialAddr(Dc2) = %q", got)
+	}
+
+	bad := writeTemp(t, "hosts dc2.example.org not-an-ip;\nproxy_for 2 dc2.example.org:8888;\n")
+	if _, err := ParseConfig(bad); err == nil {
+		t.Error("expected error for invalid hosts address")
+	}
+}
+
+func TestParseConfig_Canary(t *testing.T) {
+	content := `
+canary 2 new-mp.example.org:8888 10%;
+proxy_for 2 149.154.167.50:8888;
+proxy_for 2 149.154.167.51:8888;
+canary 4 149.154.167.91:8888 100;
+proxy_for 4 149.154.167.91:8888;
+`
+	cfg, err := ParseConfig(writeTemp(t, content))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl := cfg.Clusters[2]
+	if cl.Canary == nil || cl.Canary.String() != "new-mp.example.org:8888" || cl.CanaryPercent != 10 {
+		t.Errorf("DC 2 canary = %v %d%%", cl.Canary, cl.CanaryPercent)
+	}
+	if len(cl.Targets) != 2 {
+		t.Errorf("canary counted as a regular target: %v", cl.Targets)
+	}
+	if len(cfg.Warnings) != 2 || !strings.Contains(cfg.Warnings[0], "also a regular target") {
+		t.Errorf("warnings = %q, want the DC 4 canary reported", cfg.Warnings)
+	}
+
+	for _, bad := range []string{
+		"proxy_for 2 149.154.167.50:8888;\ncanary 3 149.154.167.51:8888 5;\n",
+		"proxy_for 2 149.154.167.50:8888;\ncanary 2 149.154.167.51:8888 101;\n",
+		"proxy_for 2 149.154.167.50:8888;\ncanary 2 149.154.167.51:8888;\n",
+	} {
+		if _, err := ParseConfig(writeTemp(t, bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	for in, want := range map[string]DuplicatePolicy{"": DuplicatesDedup, "dedup": DuplicatesDedup, "weight": DuplicatesWeight} {
+		got, err := ParseDuplicatePolicy(in)
+		if err != nil || got != want {
+			t.Errorf("ParseDuplicatePolicy(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseDuplicatePolicy("random"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
 func TestParseConfig_DefaultCluster(t *testing.T) {
 	content := `
 default 5;
@@ -212,3 +433,130 @@ func TestManager_ReloadKeepsOldOnError(t *testing.T) {
 		t.Errorf("expected old DefaultClusterID=1 after failed reload, got %d", cfg.DefaultClusterID)
 	}
 }
+
+func TestManager_ReloadRejectsTooFewDefaultTargets(t *testing.T) {
+	content := "default 2;\nproxy_for 2 10.0.0.1:8888;\nproxy_for 2 10.0.0.2:8888;\n"
+	path := writeTemp(t, content)
+
+	m := NewManager(path)
+	m.SetMinDefaultTargets(2)
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Default cluster shrinks to a single target.
+	if err := os.WriteFile(path, []byte("default 2;\nproxy_for 2 10.0.0.1:8888;\nproxy_for 4 10.0.0.4:8888;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("expected reload to be rejected")
+	}
+	if got := len(m.Get().Clusters[2].Targets); got != 2 {
+		t.Errorf("old config should stay active, default cluster has %d targets", got)
+	}
+
+	// Default cluster disappears entirely.
+	if err := os.WriteFile(path, []byte("default 2;\nproxy_for 4 10.0.0.4:8888;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("expected reload without default cluster to be rejected")
+	}
+
+	if err := os.WriteFile(path, []byte("default 2;\nproxy_for 2 10.0.0.1:8888;\nproxy_for 2 10.0.0.3:8888;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	// With target health, a default cluster of failing targets only is
+	// rejected; one target not known to fail is enough.
+	failing := map[string]bool{"10.0.0.1:8888": true, "10.0.0.3:8888": true}
+	m.SetFailing(func(addr string) bool { return failing[addr] })
+	if err := m.Reload(); err == nil {
+		t.Fatal("expected reload with failing default targets only to be rejected")
+	}
+	failing["10.0.0.3:8888"] = false
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload with a healthy target: %v", err)
+	}
+}
+
+func TestParseConfig_V2Clusters(t *testing.T) {
+	content := `version 2;
+default 2;
+proxy_for 1 149.154.175.50:8888;
+proxy_for 1 149.154.175.51:8888;
+cluster 2 {
+    target 149.154.161.144:8888 weight 3;
+    target 149.154.161.145:8888;
+    canary 149.154.161.146:8888 10%;
+    timeout 3000;
+    source 10.0.0.5;
+    ping_interval 2.5;
+    balance least-outstanding;
+    tls off;
+}
+`
+	cfg, err := ParseConfig(writeTemp(t, content))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Version != 2 {
+		t.Errorf("Version = %d, want 2", cfg.Version)
+	}
+	cl := cfg.Clusters[2]
+	if cl == nil || len(cl.Targets) != 4 {
+		t.Fatalf("cluster 2 = %+v, want 4 weighted targets", cl)
+	}
+	if cl.Canary == nil || cl.CanaryPercent != 10 {
+		t.Errorf("canary = %v %d%%", cl.Canary, cl.CanaryPercent)
+	}
+	want := ClusterOptions{Timeout: 3 * time.Second, SourceAddr: "10.0.0.5", PingInterval: 2500 * time.Millisecond, Balance: BalanceLeastOutstanding}
+	if cl.Options != want {
+		t.Errorf("Options = %+v, want %+v", cl.Options, want)
+	}
+	if cfg.Clusters[1].Options != (ClusterOptions{}) {
+		t.Errorf("flat cluster got options %+v", cfg.Clusters[1].Options)
+	}
+	if len(cfg.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", cfg.Warnings)
+	}
+}
+
+func TestParseConfig_V1StillDefault(t *testing.T) {
+	cfg, err := ParseConfig(writeTemp(t, "proxy_for 1 10.0.0.1:443;\nproxy_for 1 10.0.0.2:443;\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Version != 1 {
+		t.Errorf("Version = %d, want 1", cfg.Version)
+	}
+}
+
+func TestParseConfig_V2Errors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"block in v1", "cluster 2 {\ntarget 10.0.0.1:443;\n}\n", "need 'version 2;'"},
+		{"version late", "proxy_for 1 10.0.0.1:443;\nversion 2;\n", "must be the first directive"},
+		{"bad version", "version 3;\nproxy_for 1 10.0.0.1:443;\n", "unsupported config version"},
+		{"unclosed", "version 2;\ncluster 2 {\ntarget 10.0.0.1:443;\n", "block is not closed"},
+		{"unknown option", "version 2;\ncluster 2 {\ntarget 10.0.0.1:443;\ntimout 100;\n}\n", "unknown cluster option"},
+		{"no targets", "version 2;\nproxy_for 1 10.0.0.1:443;\ncluster 2 {\ntimeout 100;\n}\n", "cluster 2 has no targets"},
+		{"bad weight", "version 2;\ncluster 2 {\ntarget 10.0.0.1:443 weight 0;\n}\n", "invalid weight"},
+		{"min above max", "version 2;\ncluster 2 {\ntarget 10.0.0.1:443;\nmax_connections 2;\nmin_connections 4;\n}\n", "above max_connections"},
+		{"bad balance", "version 2;\ncluster 2 {\ntarget 10.0.0.1:443;\nbalance fastest;\n}\n", "unknown balance policy"},
+		{"bad source", "version 2;\ncluster 2 {\ntarget 10.0.0.1:443;\nsource eth0;\n}\n", "invalid source address"},
+		{"tls on", "version 2;\ncluster 2 {\ntarget 10.0.0.1:443;\ntls on;\n}\n", "tls on is not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig(writeTemp(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Diff describes what changed from one config to the next, for the reload
+// log and stats.
+type Diff struct {
+	// TargetsAdded and TargetsRemoved list "dc <id> <host:port>" entries,
+	// canaries as "dc <id> canary <host:port>", sorted. A target listed
+	// twice more often counts twice.
+	TargetsAdded   []string
+	TargetsRemoved []string
+	// ClustersAdded and ClustersRemoved are DC IDs present in only one of
+	// the configs; ClustersChanged are DCs in both whose targets, canary or
+	// options differ. All ascending.
+	ClustersAdded   []int
+	ClustersRemoved []int
+	ClustersChanged []int
+	// TimeoutsChanged lists "dc <id> timeout <old> -> <new>" entries.
+	TimeoutsChanged []string
+	// DefaultBefore and DefaultAfter are the default DCs; they differ when
+	// the default changed.
+	DefaultBefore int
+	DefaultAfter  int
+}
+
+// DiffConfigs compares a with b. Either may be nil.
+func DiffConfigs(a, b *Config) Diff {
+	var d Diff
+	if a != nil {
+		d.DefaultBefore = a.DefaultClusterID
+	}
+	if b != nil {
+		d.DefaultAfter = b.DefaultClusterID
+	}
+	as, bs := targetSet(a), targetSet(b)
+	d.TargetsAdded = targetDelta(bs, as)
+	d.TargetsRemoved = targetDelta(as, bs)
+
+	ca, cb := clustersOf(a), clustersOf(b)
+	for _, id := range sortedClusterIDs(cb) {
+		old, ok := ca[id]
+		if !ok {
+			d.ClustersAdded = append(d.ClustersAdded, id)
+			continue
+		}
+		cl := cb[id]
+		if old.Options.Timeout != cl.Options.Timeout {
+			d.TimeoutsChanged = append(d.TimeoutsChanged, fmt.Sprintf("dc %d timeout %s -> %s", id, old.Options.Timeout, cl.Options.Timeout))
+		}
+		if !sameCluster(old, cl) {
+			d.ClustersChanged = append(d.ClustersChanged, id)
+		}
+	}
+	for _, id := range sortedClusterIDs(ca) {
+		if _, ok := cb[id]; !ok {
+			d.ClustersRemoved = append(d.ClustersRemoved, id)
+		}
+	}
+	return d
+}
+
+// Empty reports whether nothing that affects routing changed.
+func (d Diff) Empty() bool {
+	return len(d.TargetsAdded) == 0 && len(d.TargetsRemoved) == 0 &&
+		len(d.ClustersAdded) == 0 && len(d.ClustersRemoved) == 0 && len(d.ClustersChanged) == 0 &&
+		d.DefaultBefore == d.DefaultAfter
+}
+
+// Summary returns a one-line account of the diff, e.g.
+// "targets +2 -1, clusters +0 -0 ~1, 1 timeout changed, default 2 -> 4",
+// or "no changes".
+func (d Diff) Summary() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	s := fmt.Sprintf("targets +%d -%d, clusters +%d -%d ~%d", len(d.TargetsAdded), len(d.TargetsRemoved),
+		len(d.ClustersAdded), len(d.ClustersRemoved), len(d.ClustersChanged))
+	if n := len(d.TimeoutsChanged); n > 0 {
+		s += fmt.Sprintf(", %d timeout changed", n)
+	}
+	if d.DefaultBefore != d.DefaultAfter {
+		s += fmt.Sprintf(", default %d -> %d", d.DefaultBefore, d.DefaultAfter)
+	}
+	return s
+}
+
+// Lines returns one line per change, for logging.
+func (d Diff) Lines() []string {
+	var lines []string
+	for _, t := range d.TargetsAdded {
+		lines = append(lines, "target added: "+t)
+	}
+	for _, t := range d.TargetsRemoved {
+		lines = append(lines, "target removed: "+t)
+	}
+	ints := func(what string, ids []int) {
+		if len(ids) == 0 {
+			return
+		}
+		s := make([]string, len(ids))
+		for i, id := range ids {
+			s[i] = strconv.Itoa(id)
+		}
+		lines = append(lines, what+": dc "+strings.Join(s, ", "))
+	}
+	ints("clusters added", d.ClustersAdded)
+	ints("clusters removed", d.ClustersRemoved)
+	ints("clusters changed", d.ClustersChanged)
+	for _, t := range d.TimeoutsChanged {
+		lines = append(lines, "changed: "+t)
+	}
+	if d.DefaultBefore != d.DefaultAfter {
+		lines = append(lines, fmt.Sprintf("default cluster changed: %d -> %d", d.DefaultBefore, d.DefaultAfter))
+	}
+	return lines
+}
+
+// targetDelta returns the entries of a not matched in b, formatted and
+// sorted; see targetSet for the keys.
+func targetDelta(a, b map[string]int) []string {
+	var out []string
+	for k, n := range a {
+		dc, addr, _ := strings.Cut(k, "/")
+		if rest, ok := strings.CutPrefix(addr, "canary/"); ok {
+			addr = "canary " + rest
+		}
+		for i := b[k]; i < n; i++ {
+			out = append(out, "dc "+dc+" "+addr)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// clustersOf returns cfg's clusters, or none for a nil config.
+func clustersOf(cfg *Config) map[int]*Cluster {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.Clusters
+}
+
+// sameCluster reports whether a and b route the same way.
+func sameCluster(a, b *Cluster) bool {
+	if a.Options != b.Options || a.CanaryPercent != b.CanaryPercent || (a.Canary == nil) != (b.Canary == nil) ||
+		(a.Canary != nil && *a.Canary != *b.Canary) || len(a.Targets) != len(b.Targets) {
+		return false
+	}
+	for i, t := range a.Targets {
+		if t != b.Targets[i] {
+			return false
+		}
+	}
+	return true
+}
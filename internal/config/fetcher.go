@@ -0,0 +1,248 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultFetchURL is where Telegram publishes the current proxy-multi.conf.
+const DefaultFetchURL = "https://core.telegram.org/getProxyConfig"
+
+// maxFetchedConfig bounds a downloaded config; the real one is a few KB.
+const maxFetchedConfig = 1 << 20
+
+// defaultFetchTimeout bounds a single download.
+const defaultFetchTimeout = 30 * time.Second
+
+// FetcherOptions configures a Fetcher.
+type FetcherOptions struct {
+	// URL to download the config from; empty means DefaultFetchURL.
+	URL string
+	// Interval between downloads.
+	Interval time.Duration
+	// Jitter is the upper bound of a random delay added to every interval,
+	// so a fleet of proxies does not fetch in lockstep.
+	Jitter time.Duration
+	// Client performs the requests; nil uses a client with a 30s timeout.
+	Client *http.Client
+}
+
+// FetchStats are the counters of a Fetcher.
+type FetchStats struct {
+	// Fetches is the number of download attempts.
+	Fetches int64
+	// NotModified counts downloads that returned 304 or the config in use.
+	NotModified int64
+	// Updates counts downloaded configs that were applied.
+	Updates int64
+	// Errors counts failed downloads and configs rejected by the Manager.
+	Errors int64
+	// LastSuccess is the Unix time of the last successful download, 0 if none.
+	LastSuccess int64
+}
+
+// Fetcher periodically downloads proxy-multi.conf and installs it through
+// Manager.Apply, replacing the cron job plus SIGHUP operators used to run.
+// Conditional requests (If-None-Match / If-Modified-Since) keep unchanged
+// configs from being downloaded again.
+type Fetcher struct {
+	manager *Manager
+	opts    FetcherOptions
+	onApply func(before *Config, err error)
+	lock    sync.Locker // held while a config is installed; nil = none
+
+	// validators of the last 200 response; guarded by mu
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+
+	fetches     atomic.Int64
+	notModified atomic.Int64
+	updates     atomic.Int64
+	errors      atomic.Int64
+	lastSuccess atomic.Int64
+
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// NewFetcher creates a Fetcher that installs downloaded configs into m.
+func NewFetcher(m *Manager, opts FetcherOptions) *Fetcher {
+	if opts.URL == "" {
+		opts.URL = DefaultFetchURL
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultFetchTimeout}
+	}
+	return &Fetcher{
+		manager: m,
+		opts:    opts,
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// SetOnApply registers fn to be called after every attempt to install a
+// changed config, with the config in use before it and the Manager's error.
+// Must be called before Start.
+func (f *Fetcher) SetOnApply(fn func(before *Config, err error)) {
+	f.onApply = fn
+}
+
+// SetLocker makes the Fetcher hold l while it installs a downloaded config
+// and runs the SetOnApply callback, so that an install never interleaves
+// with reloads that take the same lock. Must be called before Start.
+func (f *Fetcher) SetLocker(l sync.Locker) {
+	f.lock = l
+}
+
+// Start launches the fetch loop. The first download happens after a random
+// delay within the jitter, then every interval plus jitter.
+func (f *Fetcher) Start() {
+	go func() {
+		defer close(f.done)
+		delay := f.jitter()
+		for {
+			t := time.NewTimer(delay)
+			select {
+			case <-f.stopCh:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-f.stopCh:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			if err := f.Fetch(ctx); err != nil {
+				log.Printf("config fetch: %v", err)
+			}
+			cancel()
+			delay = f.opts.Interval + f.jitter()
+		}
+	}()
+}
+
+// Stop stops the fetch loop, aborting a download in progress.
+func (f *Fetcher) Stop() {
+	close(f.stopCh)
+	<-f.done
+}
+
+func (f *Fetcher) jitter() time.Duration {
+	if f.opts.Jitter <= 0 {
+		return 0
+	}
+	return rand.N(f.opts.Jitter)
+}
+
+// Fetch downloads the config once and installs it if it changed.
+func (f *Fetcher) Fetch(ctx context.Context) error {
+	f.fetches.Add(1)
+	data, err := f.download(ctx)
+	if err != nil {
+		f.errors.Add(1)
+		return err
+	}
+	f.lastSuccess.Store(time.Now().Unix())
+	if data == nil {
+		f.notModified.Add(1)
+		return nil
+	}
+
+	if f.lock != nil {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+	}
+	before := f.manager.Get()
+	changed, err := f.manager.Apply(data)
+	if err != nil {
+		f.errors.Add(1)
+		// Forget the validators so the rejected config is fetched again
+		// rather than answered with 304 until it changes upstream.
+		f.setValidators("", "")
+	}
+	if !changed && err == nil {
+		f.notModified.Add(1)
+		return nil
+	}
+	if err == nil {
+		f.updates.Add(1)
+	}
+	if f.onApply != nil {
+		f.onApply(before, err)
+	}
+	return err
+}
+
+// download performs a conditional GET. It returns nil data when the server
+// answered 304 Not Modified.
+func (f *Fetcher) download(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.opts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	f.mu.Unlock()
+
+	resp, err := f.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("GET %s: %s", f.opts.URL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchedConfig+1))
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", f.opts.URL, err)
+	}
+	if len(data) > maxFetchedConfig {
+		return nil, fmt.Errorf("GET %s: config larger than %d bytes", f.opts.URL, maxFetchedConfig)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("GET " + f.opts.URL + ": empty config")
+	}
+	f.setValidators(resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	return data, nil
+}
+
+func (f *Fetcher) setValidators(etag, lastModified string) {
+	f.mu.Lock()
+	f.etag, f.lastModified = etag, lastModified
+	f.mu.Unlock()
+}
+
+// Stats returns the fetch counters.
+func (f *Fetcher) Stats() FetchStats {
+	return FetchStats{
+		Fetches:     f.fetches.Load(),
+		NotModified: f.notModified.Load(),
+		Updates:     f.updates.Load(),
+		Errors:      f.errors.Load(),
+		LastSuccess: f.lastSuccess.Load(),
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetcher(t *testing.T) {
+	path := writeTemp(t, "proxy_for 2 149.154.161.144:8888;\n")
+	m := NewManager(path)
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	type doc struct{ etag, body string }
+	var cur atomic.Pointer[doc]
+	cur.Store(&doc{`"v1"`, "proxy_for 2 149.154.161.144:8888;\nproxy_for 4 91.108.4.1:8888;\n"})
+	var ifNoneMatch atomic.Value
+	ifNoneMatch.Store("")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch.Store(r.Header.Get("If-None-Match"))
+		d := cur.Load()
+		if r.Header.Get("If-None-Match") == d.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", d.etag)
+		w.Write([]byte(d.body))
+	}))
+	defer srv.Close()
+
+	var applied []error
+	f := NewFetcher(m, FetcherOptions{URL: srv.URL})
+	f.SetOnApply(func(before *Config, err error) {
+		if before == nil {
+			t.Error("onApply without the previous config")
+		}
+		applied = append(applied, err)
+	})
+	ctx := context.Background()
+
+	// A new config is applied and written over the file.
+	if err := f.Fetch(ctx); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(m.Get().Clusters) != 2 {
+		t.Fatalf("clusters = %d after update, want 2", len(m.Get().Clusters))
+	}
+	if data, _ := os.ReadFile(path); string(data) != cur.Load().body {
+		t.Errorf("config file not replaced: %q", data)
+	}
+
+	// The ETag is sent back and a 304 changes nothing.
+	if err := f.Fetch(ctx); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if ifNoneMatch.Load().(string) != `"v1"` {
+		t.Error("If-None-Match not sent")
+	}
+
+	// A broken config is rejected and the old one kept.
+	cur.Store(&doc{`"v2"`, "proxy_for 2 bad-port;\n"})
+	if err := f.Fetch(ctx); err == nil {
+		t.Fatal("expected an error for a broken config")
+	}
+	if len(m.Get().Clusters) != 2 {
+		t.Error("broken config replaced the current one")
+	}
+	if data, _ := os.ReadFile(path); string(data) == cur.Load().body {
+		t.Error("broken config written to the file")
+	}
+
+	st := f.Stats()
+	if st.Fetches != 3 || st.Updates != 1 || st.NotModified != 1 || st.Errors != 1 || st.LastSuccess == 0 {
+		t.Errorf("stats = %+v", st)
+	}
+	if len(applied) != 2 || applied[0] != nil || applied[1] == nil {
+		t.Errorf("onApply results = %v, want [nil error]", applied)
+	}
+}
+
+func TestFetcher_ServerError(t *testing.T) {
+	m := NewManager(writeTemp(t, "proxy_for 2 149.154.161.144:8888;\n"))
+	m.Load()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(m, FetcherOptions{URL: srv.URL})
+	if err := f.Fetch(context.Background()); err == nil {
+		t.Fatal("expected an error for 502")
+	}
+	if st := f.Stats(); st.Errors != 1 || st.LastSuccess != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestFetcher_Locker(t *testing.T) {
+	m := NewManager(writeTemp(t, "proxy_for 2 149.154.161.144:8888;\n"))
+	m.Load()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxy_for 4 91.108.4.1:8888;\n"))
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	f := NewFetcher(m, FetcherOptions{URL: srv.URL})
+	f.SetLocker(&mu)
+	f.SetOnApply(func(*Config, error) {
+		if mu.TryLock() {
+			t.Error("onApply ran without the lock")
+			mu.Unlock()
+		}
+	})
+
+	// While a reload holds the lock the download is not installed.
+	mu.Lock()
+	done := make(chan error)
+	go func() { done <- f.Fetch(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Fetch returned %v while the lock was held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := m.Get().Clusters[4]; ok {
+		t.Fatal("config installed while the lock was held")
+	}
+	mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if _, ok := m.Get().Clusters[4]; !ok {
+		t.Error("config not installed after the lock was released")
+	}
+}
+
+func TestManager_ApplyUnchanged(t *testing.T) {
+	const conf = "proxy_for 2 149.154.161.144:8888;\n"
+	m := NewManager(writeTemp(t, conf))
+	m.Load()
+	changed, err := m.Apply([]byte(conf))
+	if err != nil || changed {
+		t.Errorf("Apply(same) = %v, %v; want unchanged", changed, err)
+	}
+}
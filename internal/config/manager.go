@@ -1,8 +1,11 @@
 package config
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
 	"sync"
 )
 
@@ -10,7 +13,16 @@ import (
 type Manager struct {
 	mu       sync.RWMutex
 	filename string
+	popts    ParseOptions
 	current  *Config
+
+	// minDefaultTargets is the fewest targets the default cluster may have
+	// after a reload; 0 disables the check.
+	minDefaultTargets int
+
+	// failing, if set, reports whether the target at a dial address is
+	// known to be failing (see SetFailing).
+	failing func(addr string) bool
 }
 
 // NewManager creates a new ConfigManager for the given config file.
@@ -19,9 +31,29 @@ func NewManager(filename string) *Manager {
 	return &Manager{filename: filename}
 }
 
+// SetParseOptions sets the options used by Load and Reload.
+// Must be called before Load.
+func (m *Manager) SetParseOptions(popts ParseOptions) {
+	m.popts = popts
+}
+
+// SetMinDefaultTargets makes Reload reject configs whose default cluster has
+// fewer than n targets. n <= 0 disables the check.
+func (m *Manager) SetMinDefaultTargets(n int) {
+	m.minDefaultTargets = n
+}
+
+// SetFailing makes the SetMinDefaultTargets check also reject configs whose
+// default cluster has no target but ones failing reports as known to be
+// failing. Targets never tried count as healthy, so a config may move to
+// new ones.
+func (m *Manager) SetFailing(failing func(addr string) bool) {
+	m.failing = failing
+}
+
 // Load reads and parses the configuration file, replacing the current config.
 func (m *Manager) Load() error {
-	cfg, err := ParseConfig(m.filename)
+	cfg, err := ParseConfigWithOptions(m.filename, m.popts)
 	if err != nil {
 		return fmt.Errorf("config load: %w", err)
 	}
@@ -29,13 +61,19 @@ func (m *Manager) Load() error {
 	m.current = cfg
 	m.mu.Unlock()
 	log.Printf("config loaded from %s (%d bytes, %d clusters)", m.filename, cfg.Bytes, len(cfg.Clusters))
+	logWarnings(cfg)
 	return nil
 }
 
-// Reload reloads the configuration file. If parsing fails, the current config
-// remains unchanged.
+// Reload reloads the configuration file. If parsing fails, or the new config
+// would leave the default cluster with fewer targets than allowed by
+// SetMinDefaultTargets or with failing ones only (SetFailing), the current
+// config remains unchanged.
 func (m *Manager) Reload() error {
-	cfg, err := ParseConfig(m.filename)
+	cfg, err := ParseConfigWithOptions(m.filename, m.popts)
+	if err == nil {
+		err = m.checkDefaultTargets(cfg)
+	}
 	if err != nil {
 		log.Printf("config reload failed, keeping old config: %v", err)
 		return err
@@ -44,9 +82,82 @@ func (m *Manager) Reload() error {
 	m.current = cfg
 	m.mu.Unlock()
 	log.Printf("config reloaded from %s (%d bytes, %d clusters)", m.filename, cfg.Bytes, len(cfg.Clusters))
+	logWarnings(cfg)
 	return nil
 }
 
+// Apply installs data as the new configuration file: it is parsed and
+// checked like Reload, then atomically renamed over the config file so a
+// later Reload sees the same contents. Data identical to the current config
+// is ignored and reported as unchanged. On error both the file and the
+// current config are left untouched.
+func (m *Manager) Apply(data []byte) (changed bool, err error) {
+	sum := md5.Sum(data)
+	if cur := m.Get(); cur != nil && cur.MD5 == hex.EncodeToString(sum[:]) {
+		return false, nil
+	}
+
+	perm := os.FileMode(0o600)
+	if fi, serr := os.Stat(m.filename); serr == nil {
+		perm = fi.Mode().Perm()
+	}
+	var cfg *Config
+	var parseErr error
+	err = WriteFileAtomic(m.filename, data, perm, func(tmp string) error {
+		cfg, parseErr = ParseConfigWithOptions(tmp, m.popts)
+		if parseErr == nil {
+			parseErr = m.checkDefaultTargets(cfg)
+		}
+		return parseErr
+	})
+	if parseErr != nil {
+		log.Printf("config apply failed, keeping old config: %v", parseErr)
+		return false, parseErr
+	}
+	if err != nil {
+		return false, fmt.Errorf("config apply: %w", err)
+	}
+	m.mu.Lock()
+	m.current = cfg
+	m.mu.Unlock()
+	log.Printf("config applied to %s (%d bytes, %d clusters)", m.filename, cfg.Bytes, len(cfg.Clusters))
+	logWarnings(cfg)
+	return true, nil
+}
+
+// checkDefaultTargets enforces the minimum target count of the default
+// cluster and, with SetFailing, that one of its targets is not failing.
+func (m *Manager) checkDefaultTargets(cfg *Config) error {
+	if m.minDefaultTargets <= 0 {
+		return nil
+	}
+	var targets []Target
+	if cl, ok := cfg.Clusters[cfg.DefaultClusterID]; ok {
+		targets = cl.Targets
+	}
+	if len(targets) < m.minDefaultTargets {
+		return fmt.Errorf("config %s: default cluster %d has %d target(s), need at least %d",
+			m.filename, cfg.DefaultClusterID, len(targets), m.minDefaultTargets)
+	}
+	if m.failing == nil {
+		return nil
+	}
+	for _, t := range targets {
+		if !m.failing(cfg.DialAddr(t)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("config %s: default cluster %d has no healthy target, all %d are failing",
+		m.filename, cfg.DefaultClusterID, len(targets))
+}
+
+// logWarnings logs every non-fatal parse warning of cfg.
+func logWarnings(cfg *Config) {
+	for _, w := range cfg.Warnings {
+		log.Printf("config warning: %s", w)
+	}
+}
+
 // Get returns the current config. Safe for concurrent use.
 func (m *Manager) Get() *Config {
 	m.mu.RLock()
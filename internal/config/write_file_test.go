@@ -0,0 +1,44 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := errors.New("rejected")
+	err := WriteFileAtomic(path, []byte("bad"), 0o644, func(tmp string) error {
+		if data, _ := os.ReadFile(tmp); string(data) != "bad" {
+			t.Errorf("check saw %q", data)
+		}
+		return rejected
+	})
+	if err != rejected {
+		t.Fatalf("err = %v, want the check's error", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Errorf("rejected write replaced the file: %q", data)
+	}
+
+	if err := WriteFileAtomic(path, []byte("new"), 0o644, nil); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" || fi.Mode().Perm() != 0o644 {
+		t.Errorf("file %q mode %v, want \"new\" 0644", data, fi.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want 1", len(entries))
+	}
+}
@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Bounds on the proxy-secret (--aes-pwd) file size.
+// Equivalent to C MIN_PWD_LEN / MAX_PWD_LEN in net-crypto-aes.c.
+const (
+	MinPwdLen = 32
+	MaxPwdLen = 256
+)
+
+// PwdFile is a loaded proxy-secret file: the shared secret used to derive
+// middle-proxy RPC keys (see AESCreateKeys).
+type PwdFile struct {
+	Secret []byte
+	// MD5 of the file contents, logged so operators can compare secrets
+	// across hosts without printing them (C: pwd_config_md5).
+	MD5 [16]byte
+}
+
+// KeySignature returns the first 4 bytes of the secret as sent in
+// RPC_NONCE key_select (C: main_secret.key_signature).
+func (p *PwdFile) KeySignature() uint32 {
+	return uint32(p.Secret[0]) | uint32(p.Secret[1])<<8 | uint32(p.Secret[2])<<16 | uint32(p.Secret[3])<<24
+}
+
+// LoadPwdFile reads a proxy-secret file and checks its size.
+// Equivalent to C aes_load_pwd_file.
+func LoadPwdFile(path string) (*PwdFile, error) {
+	return LoadSealedPwdFile(path, nil)
+}
+
+// LoadSealedPwdFile is LoadPwdFile for a file that may be sealed (see Seal)
+// with key. The MD5 is that of the decrypted secret, so it matches the
+// plain file on other hosts.
+func LoadSealedPwdFile(path string, key []byte) (*PwdFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, MaxPwdLen+SealOverhead+1))
+	if err != nil {
+		return nil, err
+	}
+	if IsSealed(data) {
+		if data, err = Unseal(key, data); err != nil {
+			return nil, err
+		}
+	}
+	return ParsePwd(data)
+}
+
+// ParsePwd validates proxy-secret file contents.
+func ParsePwd(data []byte) (*PwdFile, error) {
+	if len(data) < MinPwdLen {
+		return nil, fmt.Errorf("secret too short: %d bytes, need at least %d", len(data), MinPwdLen)
+	}
+	if len(data) > MaxPwdLen {
+		return nil, fmt.Errorf("secret too long: more than %d bytes", MaxPwdLen)
+	}
+	return &PwdFile{Secret: data, MD5: md5.Sum(data)}, nil
+}
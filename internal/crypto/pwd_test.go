@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/md5"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPwdFile(t *testing.T) {
+	dir := t.TempDir()
+	secret := bytes.Repeat([]byte{0x11, 0x22, 0x33, 0x44}, 32)
+	path := filepath.Join(dir, "proxy-secret")
+	if err := os.WriteFile(path, secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPwdFile(path)
+	if err != nil {
+		t.Fatalf("LoadPwdFile: %v", err)
+	}
+	if !bytes.Equal(p.Secret, secret) {
+		t.Error("secret differs from file contents")
+	}
+	if p.MD5 != md5.Sum(secret) {
+		t.Error("wrong md5")
+	}
+	if got := p.KeySignature(); got != 0x44332211 {
+		t.Errorf("KeySignature = %#x, want 0x44332211", got)
+	}
+
+	if _, err := LoadPwdFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file: expected error")
+	}
+	for _, n := range []int{0, MinPwdLen - 1, MaxPwdLen + 1, 4096} {
+		if _, err := ParsePwd(make([]byte, n)); err == nil {
+			t.Errorf("%d bytes: expected error", n)
+		}
+	}
+	for _, n := range []int{MinPwdLen, MaxPwdLen} {
+		if _, err := ParsePwd(make([]byte, n)); err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testSealKey() []byte {
+	return bytes.Repeat([]byte{0x5a}, SealKeySize)
+}
+
+func TestSealUnseal(t *testing.T) {
+	key := testSealKey()
+	plain := []byte("aabbccddeeff00112233445566778899\n")
+	sealed, err := Seal(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || len(sealed) != len(plain)+SealOverhead {
+		t.Fatalf("sealed file of %d bytes, want %d with the magic", len(sealed), len(plain)+SealOverhead)
+	}
+	if bytes.Contains(sealed, plain[:16]) {
+		t.Error("sealed file contains the plaintext")
+	}
+	got, err := Unseal(key, sealed)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Unseal = %q, %v", got, err)
+	}
+
+	if _, err := Unseal(nil, sealed); !errors.Is(err, ErrSealKeyMissing) {
+		t.Errorf("no key: err = %v, want ErrSealKeyMissing", err)
+	}
+	wrong := bytes.Repeat([]byte{0x5b}, SealKeySize)
+	if _, err := Unseal(wrong, sealed); err == nil {
+		t.Error("wrong key: expected error")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := Unseal(key, sealed); err == nil {
+		t.Error("corrupted file: expected error")
+	}
+	if _, err := Unseal(key, []byte(SealMagic+"short")); err == nil {
+		t.Error("truncated file: expected error")
+	}
+	// Plain data passes through, with or without a key.
+	if got, err := Unseal(nil, plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("plain data: %q, %v", got, err)
+	}
+}
+
+func TestParseSealKey(t *testing.T) {
+	key := testSealKey()
+	hexKey := strings.Repeat("5a", SealKeySize)
+	for _, s := range []string{hexKey, hexKey + "\n", base64.StdEncoding.EncodeToString(key) + "\n"} {
+		got, err := ParseSealKey(s)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("ParseSealKey(%q) = %x, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "passphrase", hexKey[:62], base64.StdEncoding.EncodeToString(key[:16])} {
+		if _, err := ParseSealKey(s); err == nil {
+			t.Errorf("ParseSealKey(%q): expected error", s)
+		}
+	}
+}
+
+func TestLoadSealedPwdFile(t *testing.T) {
+	key := testSealKey()
+	secret := bytes.Repeat([]byte{0x11, 0x22, 0x33, 0x44}, MaxPwdLen/4)
+	sealed, err := Seal(key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "proxy-secret.sealed")
+	if err := os.WriteFile(path, sealed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadSealedPwdFile(path, key)
+	if err != nil {
+		t.Fatalf("LoadSealedPwdFile: %v", err)
+	}
+	if !bytes.Equal(p.Secret, secret) || p.MD5 != md5.Sum(secret) {
+		t.Error("secret or md5 differs from the plaintext")
+	}
+	if _, err := LoadPwdFile(path); !errors.Is(err, ErrSealKeyMissing) {
+		t.Errorf("LoadPwdFile of a sealed file: err = %v, want ErrSealKeyMissing", err)
+	}
+}
@@ -67,8 +67,18 @@ func WriteTLString(data []byte) []byte {
 //
 // proxyTag — 16 байт proxy-тега (nil если не задан). Если задан, flags должен содержать FlagProxyTag.
 func BuildProxyReq(flags uint32, extConnID int64, remoteIP [16]byte, remotePort uint32, ourIP [16]byte, ourPort uint32, proxyTag []byte, data []byte) []byte {
-	buf := make([]byte, 0, 64+len(data)+32)
+	buf := make([]byte, 0, ProxyReqMaxOverhead+len(data))
+	return AppendProxyReq(buf, flags, extConnID, remoteIP, remotePort, ourIP, ourPort, proxyTag, data)
+}
+
+// ProxyReqMaxOverhead — наибольший размер RPC_PROXY_REQ без данных клиента:
+// заголовок (56 байт) и extra bytes с proxy_tag (4 + 4 + 20 байт).
+const ProxyReqMaxOverhead = 56 + 28
 
+// AppendProxyReq — BuildProxyReq, дописывающий RPC_PROXY_REQ в buf. Если
+// у buf ёмкость не меньше len(buf)+ProxyReqMaxOverhead+len(data), новый
+// буфер не выделяется.
+func AppendProxyReq(buf []byte, flags uint32, extConnID int64, remoteIP [16]byte, remotePort uint32, ourIP [16]byte, ourPort uint32, proxyTag []byte, data []byte) []byte {
 	buf = WriteTLInt(buf, RPCProxyReq)
 	buf = WriteTLInt(buf, flags)
 	buf = WriteTLLong(buf, uint64(extConnID))
@@ -83,15 +93,14 @@ func BuildProxyReq(flags uint32, extConnID int64, remoteIP [16]byte, remotePort
 
 	// extra bytes (только если есть proxy_tag или HTTP-данные)
 	if flags&0xC != 0 {
-		// Собираем extra bytes
-		var extra []byte
+		// Размер extra bytes, дописывается после них
+		sizeAt := len(buf)
+		buf = WriteTLInt(buf, 0)
 		if flags&FlagProxyTag != 0 && len(proxyTag) == 16 {
-			extra = WriteTLInt(extra, TLProxyTag)
-			extra = append(extra, WriteTLString(proxyTag)...)
+			buf = WriteTLInt(buf, TLProxyTag)
+			buf = append(buf, WriteTLString(proxyTag)...)
 		}
-		// Записываем размер extra bytes, затем сами bytes
-		buf = WriteTLInt(buf, uint32(len(extra)))
-		buf = append(buf, extra...)
+		binary.LittleEndian.PutUint32(buf[sizeAt:], uint32(len(buf)-sizeAt-4))
 	}
 
 	buf = append(buf, data...)
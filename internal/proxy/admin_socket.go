@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// adminListener serves the control API on a unix socket. Every connection
+// is checked with the peer's credentials: only the proxy's own UID and the
+// UIDs given with --admin-uid may issue commands; the socket's file mode
+// plays no part, which is what makes abstract sockets usable.
+type adminListener struct {
+	net.Listener
+	allowed map[uint32]bool
+}
+
+// listenAdmin binds the control socket addr: a filesystem path, or on Linux
+// "@name" for the abstract namespace, which needs no path management and
+// disappears with the process. A stale socket file left by a previous run
+// is replaced; one that still accepts connections is not.
+func listenAdmin(addr string, uids []uint32) (net.Listener, error) {
+	if err := checkAdminSocket(addr); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(addr, "@") {
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", addr); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("admin socket %s: in use by another process", addr)
+			}
+			os.Remove(addr)
+		}
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("admin socket: %w", err)
+	}
+	allowed := map[uint32]bool{uint32(os.Geteuid()): true}
+	for _, uid := range uids {
+		allowed[uid] = true
+	}
+	return &adminListener{Listener: ln, allowed: allowed}, nil
+}
+
+// Accept returns the next connection from an allowed peer; others are
+// logged and closed.
+func (l *adminListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err == nil && l.allowed[uid] {
+			return conn, nil
+		}
+		if err != nil {
+			log.Printf("admin socket: rejected connection: %v", err)
+		} else {
+			log.Printf("admin socket: rejected connection from uid %d", uid)
+		}
+		conn.Close()
+	}
+}
+
+// adminPeerKey is the request context key holding the UID of an admin
+// socket caller.
+type adminPeerKey struct{}
+
+// adminConnContext stores the peer UID of an admin socket connection in
+// the context of its requests, so changes can be logged with their author.
+func adminConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if uid, err := peerUID(conn); err == nil {
+		return context.WithValue(ctx, adminPeerKey{}, uid)
+	}
+	return ctx
+}
+
+// requester describes who sent r for the log: the UID on the admin
+// socket, otherwise the remote address.
+func requester(r *http.Request) string {
+	if uid, ok := r.Context().Value(adminPeerKey{}).(uint32); ok {
+		return fmt.Sprintf("uid %d on the admin socket", uid)
+	}
+	return r.RemoteAddr
+}
+
+// fromAdminSocket reports whether r arrived on --admin-socket, whose peers
+// are authenticated by UID.
+func fromAdminSocket(r *http.Request) bool {
+	_, ok := r.Context().Value(adminPeerKey{}).(uint32)
+	return ok
+}
+
+// loopbackOnly guards the control endpoints of the TCP stats listener:
+// /admin/* and /debug/* (pprof included) change the proxy or reveal client
+// data, so like the C proxy's stats they are answered only to loopback
+// peers. Everyone else gets the stats, health and dashboard endpoints.
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean(r.URL.Path)
+		if (strings.HasPrefix(p, "/admin/") || strings.HasPrefix(p, "/debug/")) && !isLoopbackPeer(r) {
+			writeAPIError(w, http.StatusForbidden, errCodeForbidden, p+" is served to loopback and --admin-socket callers only")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackPeer reports whether r comes from a loopback address.
+func isLoopbackPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unixClient returns an HTTP client that connects to the unix socket addr.
+func unixClient(addr string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		},
+	}
+}
+
+func TestAdminSocket_Abstract(t *testing.T) {
+	addr := fmt.Sprintf("@mtproxy-test-%d", os.Getpid())
+	h := NewHTTPStatsServer("", NewStats(), 1, nil, "test")
+	h.SetAdminSocket(addr, nil)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer h.Stop()
+
+	resp, err := unixClient(addr).Get("http://admin/stats")
+	if err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "uptime") {
+		t.Errorf("status %d, body %q", resp.StatusCode, body)
+	}
+}
+
+func TestAdminSocket_RejectsOtherUID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenAdmin(path, nil)
+	if err != nil {
+		t.Fatalf("listenAdmin: %v", err)
+	}
+	defer ln.Close()
+	// Pretend the proxy runs as someone else: our own UID is no longer allowed.
+	al := ln.(*adminListener)
+	al.allowed = map[uint32]bool{uint32(os.Geteuid()) + 1: true}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from rejected connection: %v, want EOF", err)
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Error("connection from a disallowed UID was accepted")
+	default:
+	}
+}
+
+func TestListenAdmin_StaleAndLiveSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+
+	// A socket file nobody listens on is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := listenAdmin(path, nil)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	defer ln.Close()
+
+	// A live one is left alone.
+	if _, err := listenAdmin(path, nil); err == nil {
+		t.Fatal("listenAdmin took over a socket in use")
+	}
+}
+
+func TestPeerUID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := net.Dial("unix", path); err == nil {
+			defer c.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	uid, err := peerUID(conn)
+	if err != nil {
+		t.Fatalf("peerUID: %v", err)
+	}
+	if uid != uint32(os.Geteuid()) {
+		t.Errorf("uid = %d, want %d", uid, os.Geteuid())
+	}
+}
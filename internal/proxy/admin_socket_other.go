@@ -0,0 +1,20 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// checkAdminSocket refuses the control socket: without SO_PEERCRED its
+// callers cannot be authenticated, and abstract sockets are Linux-only.
+func checkAdminSocket(addr string) error {
+	return fmt.Errorf("admin socket %s: not supported on %s", addr, runtime.GOOS)
+}
+
+// peerUID is unavailable outside Linux.
+func peerUID(conn net.Conn) (uint32, error) {
+	return 0, fmt.Errorf("peer credentials: not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAffinityMaxEntries caps the auth_key_id → target pins kept by
+// SessionAffinity (--session-affinity-max).
+const DefaultAffinityMaxEntries = 100000
+
+// affinityPruneInterval is the longest time an expired pin stays in the
+// table before it is dropped.
+const affinityPruneInterval = 30 * time.Second
+
+// SessionAffinity pins the encrypted packets of one MTProto session, as told
+// by their auth_key_id, to the target that took its first packet, so every
+// frame of the session reaches the same middle proxy while the target stays
+// in the cluster and answers. A pin lasts ttl after the session's last
+// packet; beyond maxEntries the least recently used pins are evicted. A nil
+// *SessionAffinity pins nothing.
+type SessionAffinity struct {
+	ttl        time.Duration
+	maxEntries int
+	stats      *Stats
+	stop       chan struct{}
+
+	mu   sync.Mutex
+	pins map[int64]*list.Element
+	lru  *list.List // of *affinityPin, most recently used first
+}
+
+type affinityPin struct {
+	key     int64
+	addr    string
+	expires time.Time
+}
+
+// NewSessionAffinity creates a table of pins lasting ttl after their last
+// use, at most maxEntries of them (0 = DefaultAffinityMaxEntries).
+func NewSessionAffinity(ttl time.Duration, maxEntries int, stats *Stats) *SessionAffinity {
+	if maxEntries <= 0 {
+		maxEntries = DefaultAffinityMaxEntries
+	}
+	return &SessionAffinity{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		stats:      stats,
+		stop:       make(chan struct{}),
+		pins:       make(map[int64]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Start begins dropping expired pins.
+func (a *SessionAffinity) Start() {
+	go runEvery(min(a.ttl, affinityPruneInterval), a.stop, func() { a.prune(time.Now()) })
+}
+
+// Stop ends the pruning.
+func (a *SessionAffinity) Stop() {
+	close(a.stop)
+}
+
+// Lookup returns the target pinned for key if valid accepts it, and
+// extends the pin, counting a hit. An absent or expired pin, or one valid
+// rejects (e.g. its target left the config), counts as a miss and is
+// dropped.
+func (a *SessionAffinity) Lookup(key int64, now time.Time, valid func(addr string) bool) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	a.mu.Lock()
+	e, ok := a.pins[key]
+	if ok {
+		pin := e.Value.(*affinityPin)
+		if now.Before(pin.expires) && valid(pin.addr) {
+			pin.expires = now.Add(a.ttl)
+			a.lru.MoveToFront(e)
+			a.mu.Unlock()
+			if a.stats != nil {
+				atomic.AddInt64(&a.stats.AffinityHits, 1)
+			}
+			return pin.addr, true
+		}
+		a.removeLocked(e)
+	}
+	a.mu.Unlock()
+	if a.stats != nil {
+		atomic.AddInt64(&a.stats.AffinityMisses, 1)
+	}
+	return "", false
+}
+
+// Pin records addr as key's target.
+func (a *SessionAffinity) Pin(key int64, addr string, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.pins[key]; ok {
+		pin := e.Value.(*affinityPin)
+		pin.addr, pin.expires = addr, now.Add(a.ttl)
+		a.lru.MoveToFront(e)
+		return
+	}
+	a.pins[key] = a.lru.PushFront(&affinityPin{key: key, addr: addr, expires: now.Add(a.ttl)})
+	evicted := 0
+	for a.lru.Len() > a.maxEntries {
+		a.removeLocked(a.lru.Back())
+		evicted++
+	}
+	if a.stats != nil {
+		atomic.AddInt64(&a.stats.AffinityEvictions, int64(evicted))
+	}
+	a.updateEntriesLocked()
+}
+
+// Unpin drops key's pin, so its next packet picks a target again.
+func (a *SessionAffinity) Unpin(key int64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if e, ok := a.pins[key]; ok {
+		a.removeLocked(e)
+	}
+	a.mu.Unlock()
+}
+
+// Len returns the number of pins held, expired ones included until pruned.
+func (a *SessionAffinity) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lru.Len()
+}
+
+// prune drops the pins that expired before now. The LRU order is also the
+// order of expiry, so it stops at the first live pin from the back.
+func (a *SessionAffinity) prune(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for e := a.lru.Back(); e != nil && !now.Before(e.Value.(*affinityPin).expires); e = a.lru.Back() {
+		a.removeLocked(e)
+	}
+}
+
+func (a *SessionAffinity) removeLocked(e *list.Element) {
+	a.lru.Remove(e)
+	delete(a.pins, e.Value.(*affinityPin).key)
+	a.updateEntriesLocked()
+}
+
+func (a *SessionAffinity) updateEntriesLocked() {
+	if a.stats != nil {
+		atomic.StoreInt64(&a.stats.AffinityEntries, int64(a.lru.Len()))
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionAffinity(t *testing.T) {
+	stats := NewStats()
+	a := NewSessionAffinity(time.Minute, 2, stats)
+	now := time.Unix(1700000000, 0)
+	all := func(string) bool { return true }
+
+	if _, ok := a.Lookup(1, now, all); ok {
+		t.Fatal("hit on an empty table")
+	}
+	a.Pin(1, "10.0.0.1:8888", now)
+	a.Pin(2, "10.0.0.2:8888", now)
+	if addr, ok := a.Lookup(1, now.Add(50*time.Second), all); !ok || addr != "10.0.0.1:8888" {
+		t.Fatalf("Lookup(1) = %q, %v", addr, ok)
+	}
+	// The lookup extended pin 1 and made it the most recently used, so the
+	// third pin evicts pin 2.
+	a.Pin(3, "10.0.0.3:8888", now.Add(50*time.Second))
+	if _, ok := a.Lookup(2, now.Add(50*time.Second), all); ok {
+		t.Error("pin 2 survived eviction")
+	}
+	if _, ok := a.Lookup(1, now.Add(100*time.Second), all); !ok {
+		t.Error("pin 1 expired although it was used 50 s ago")
+	}
+	if _, ok := a.Lookup(3, now.Add(100*time.Second), func(string) bool { return false }); ok {
+		t.Error("hit on a pin its target no longer accepts")
+	}
+	if a.Len() != 1 {
+		t.Errorf("Len = %d after dropping a rejected pin, want 1", a.Len())
+	}
+	a.prune(now.Add(200 * time.Second))
+	if a.Len() != 0 {
+		t.Errorf("Len = %d after pruning expired pins", a.Len())
+	}
+
+	a.Pin(4, "10.0.0.4:8888", now)
+	a.Unpin(4)
+	if _, ok := a.Lookup(4, now, all); ok {
+		t.Error("hit after Unpin")
+	}
+
+	snap := stats.Snapshot(0)
+	if snap["affinity_hits"] != 2 || snap["affinity_misses"] != 4 || snap["affinity_evictions"] != 1 || snap["affinity_entries"] != 0 {
+		t.Errorf("hits %d, misses %d, evictions %d, entries %d; want 2, 4, 1, 0",
+			snap["affinity_hits"], snap["affinity_misses"], snap["affinity_evictions"], snap["affinity_entries"])
+	}
+
+	var none *SessionAffinity
+	none.Pin(1, "10.0.0.1:8888", now)
+	if _, ok := none.Lookup(1, now, all); ok {
+		t.Error("nil affinity pinned a session")
+	}
+}
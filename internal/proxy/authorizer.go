@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultAuthorizerTimeout bounds a single authorizer call.
+const DefaultAuthorizerTimeout = 200 * time.Millisecond
+
+// Authorizer asks an external service whether a client connection may
+// proceed. It is called once per connection, right after the obfuscated2
+// handshake identified the secret.
+//
+// The request is a GET to the configured URL with query parameters
+// ip=<client ip> and secret=<secret fingerprint>. A 2xx status allows the
+// connection, 403 denies it; any other status, a transport error or a
+// timeout is treated according to FailOpen.
+//
+// An endpoint of the form "unix:/path/to.sock" sends the same HTTP request
+// over a unix socket; "http://" and "https://" URLs are used as-is.
+type Authorizer struct {
+	endpoint string
+	timeout  time.Duration
+	client   *http.Client
+
+	// FailOpen allows connections when the authorizer is unreachable or
+	// answers with an unexpected status. When false such connections are denied.
+	FailOpen bool
+}
+
+// NewAuthorizer creates an Authorizer for endpoint. timeout <= 0 uses
+// DefaultAuthorizerTimeout.
+func NewAuthorizer(endpoint string, timeout time.Duration, failOpen bool) (*Authorizer, error) {
+	if timeout <= 0 {
+		timeout = DefaultAuthorizerTimeout
+	}
+	a := &Authorizer{timeout: timeout, FailOpen: failOpen}
+
+	transport := &http.Transport{
+		MaxIdleConns:        16,
+		IdleConnTimeout:     30 * time.Second,
+		DisableCompression:  true,
+		TLSHandshakeTimeout: timeout,
+	}
+	switch {
+	case strings.HasPrefix(endpoint, "unix:"):
+		path := strings.TrimPrefix(endpoint, "unix:")
+		if path == "" {
+			return nil, fmt.Errorf("authorizer: empty unix socket path")
+		}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		a.endpoint = "http://unix/authorize"
+	case strings.HasPrefix(endpoint, "http://"), strings.HasPrefix(endpoint, "https://"):
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, fmt.Errorf("authorizer: %w", err)
+		}
+		a.endpoint = endpoint
+	default:
+		return nil, fmt.Errorf("authorizer: endpoint must be http(s)://... or unix:/path, got %q", endpoint)
+	}
+	a.client = &http.Client{Transport: transport, Timeout: timeout}
+	return a, nil
+}
+
+// Authorize reports whether the connection from ip using the secret with
+// the given fingerprint is allowed. err is non-nil when the decision was
+// made by the fail-open/fail-closed policy rather than by the authorizer.
+func (a *Authorizer) Authorize(ip net.IP, fingerprint string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	u, _ := url.Parse(a.endpoint)
+	q := u.Query()
+	q.Set("ip", ip.String())
+	q.Set("secret", fingerprint)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return a.FailOpen, fmt.Errorf("authorizer: %w", err)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return a.FailOpen, fmt.Errorf("authorizer: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return a.FailOpen, fmt.Errorf("authorizer: unexpected status %d", resp.StatusCode)
+	}
+}
+
+// secretFingerprint returns a short, non-reversible identifier of a secret
+// suitable for logs and external services: the first 8 bytes of its
+// SHA-256 in hex. An empty secret (no-secret mode) yields "".
+func secretFingerprint(secret []byte) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorizer_AllowDeny(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ip") == "10.0.0.1" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	a, err := NewAuthorizer(srv.URL, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.Authorize(net.ParseIP("10.0.0.1"), "abcd"); !ok || err != nil {
+		t.Errorf("10.0.0.1: allowed=%v err=%v, want allowed", ok, err)
+	}
+	if ok, err := a.Authorize(net.ParseIP("10.0.0.2"), "abcd"); ok || err != nil {
+		t.Errorf("10.0.0.2: allowed=%v err=%v, want denied", ok, err)
+	}
+}
+
+func TestAuthorizer_FailPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	for _, failOpen := range []bool{false, true} {
+		a, err := NewAuthorizer(srv.URL, 20*time.Millisecond, failOpen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := a.Authorize(net.ParseIP("10.0.0.1"), "")
+		if err == nil {
+			t.Errorf("fail-open=%v: expected timeout error", failOpen)
+		}
+		if ok != failOpen {
+			t.Errorf("fail-open=%v: allowed=%v", failOpen, ok)
+		}
+	}
+}
+
+func TestNewAuthorizer_BadEndpoint(t *testing.T) {
+	if _, err := NewAuthorizer("tcp://example", 0, false); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+}
+
+func TestSecretFingerprint(t *testing.T) {
+	if secretFingerprint(nil) != "" {
+		t.Error("empty secret must have empty fingerprint")
+	}
+	fp := secretFingerprint([]byte("aaaaaaaaaaaaaaaa"))
+	if len(fp) != 16 {
+		t.Errorf("fingerprint %q: want 16 hex chars", fp)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindDeviceControl returns a net.Dialer Control hook that binds the socket
+// to device with SO_BINDTODEVICE before connecting. Binding to a VRF master
+// device makes the connection use that VRF's routing table.
+func bindDeviceControl(device string) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("bind to device %s: %w", device, serr)
+		}
+		return nil
+	}
+}
+
+// CheckOutboundDevice verifies that device exists and that the process is
+// allowed to bind sockets to it. Binding usually requires CAP_NET_RAW
+// (before Linux 5.7) or running as root.
+func CheckOutboundDevice(device string) error {
+	if _, err := net.InterfaceByName(device); err != nil {
+		return fmt.Errorf("outbound device %s: %w", device, err)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("outbound device %s: probe socket: %w", device, err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device); err != nil {
+		if err == syscall.EPERM {
+			return fmt.Errorf("outbound device %s: SO_BINDTODEVICE not permitted (need CAP_NET_RAW or root): %w", device, err)
+		}
+		return fmt.Errorf("outbound device %s: %w", device, err)
+	}
+	return nil
+}
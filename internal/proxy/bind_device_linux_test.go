@@ -0,0 +1,18 @@
+//go:build linux
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckOutboundDevice_Missing(t *testing.T) {
+	err := CheckOutboundDevice("mtpx-nonexistent0")
+	if err == nil {
+		t.Fatal("expected error for missing device")
+	}
+	if !strings.Contains(err.Error(), "mtpx-nonexistent0") {
+		t.Errorf("error %q does not name the device", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// bindDeviceControl is unsupported outside Linux; every dial fails so a
+// misconfiguration cannot silently fall back to the default route.
+func bindDeviceControl(device string) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		return fmt.Errorf("bind to device %s: not supported on %s", device, runtime.GOOS)
+	}
+}
+
+// CheckOutboundDevice reports that device binding is unavailable on this platform.
+func CheckOutboundDevice(device string) error {
+	return fmt.Errorf("outbound device %s: SO_BINDTODEVICE is not supported on %s", device, runtime.GOOS)
+}
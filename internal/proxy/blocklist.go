@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// Blocklist temporarily bans source IPs that keep failing the handshake.
+//
+// Every failure is a strike. Strikes decay: the count restarts once window
+// has passed since the first strike. An IP reaching threshold strikes inside
+// one window is blocked for ttl. The list can be persisted to a file so bans
+// survive restarts.
+type Blocklist struct {
+	threshold int
+	window    time.Duration
+	ttl       time.Duration
+	path      string // persistence file; "" disables persistence
+	stats     *Stats
+
+	mu      sync.Mutex
+	strikes map[string]*strikeCount
+	blocked map[string]time.Time // IP → expiry
+
+	stopCh chan struct{}
+}
+
+type strikeCount struct {
+	n     int
+	first time.Time
+}
+
+// NewBlocklist creates a blocklist. threshold must be positive.
+func NewBlocklist(threshold int, window, ttl time.Duration, stats *Stats) *Blocklist {
+	return &Blocklist{
+		threshold: threshold,
+		window:    window,
+		ttl:       ttl,
+		stats:     stats,
+		strikes:   make(map[string]*strikeCount),
+		blocked:   make(map[string]time.Time),
+		stopCh:    make(chan struct{}),
+	}
+}
+
+// SetPersistFile enables loading and saving the list to path.
+// Must be called before Load/Start.
+func (b *Blocklist) SetPersistFile(path string) {
+	b.path = path
+}
+
+// Blocked reports whether ip is currently banned and counts the hit.
+func (b *Blocklist) Blocked(ip net.IP, now time.Time) bool {
+	key := ip.String()
+	b.mu.Lock()
+	exp, ok := b.blocked[key]
+	if ok && !now.Before(exp) {
+		delete(b.blocked, key)
+		ok = false
+		b.updateSizeLocked()
+	}
+	b.mu.Unlock()
+	if ok && b.stats != nil {
+		b.stats.IncBlocklistHit()
+	}
+	return ok
+}
+
+// Strike records one failure for ip and reports whether it is now blocked.
+func (b *Blocklist) Strike(ip net.IP, now time.Time) bool {
+	key := ip.String()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if exp, ok := b.blocked[key]; ok && now.Before(exp) {
+		return true
+	}
+	sc := b.strikes[key]
+	if sc == nil || now.Sub(sc.first) >= b.window {
+		sc = &strikeCount{first: now}
+		b.strikes[key] = sc
+	}
+	sc.n++
+	if sc.n < b.threshold {
+		return false
+	}
+	delete(b.strikes, key)
+	b.blocked[key] = now.Add(b.ttl)
+	b.updateSizeLocked()
+	if b.stats != nil {
+		b.stats.IncBlocklistAdded()
+	}
+	log.Printf("blocklist: %s blocked for %s after %d failed handshakes", key, b.ttl, sc.n)
+	return true
+}
+
+// Len returns the number of blocked IPs, including not yet pruned expired ones.
+func (b *Blocklist) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.blocked)
+}
+
+// Prune drops expired bans and decayed strike counters.
+func (b *Blocklist) Prune(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, exp := range b.blocked {
+		if !now.Before(exp) {
+			delete(b.blocked, k)
+		}
+	}
+	for k, sc := range b.strikes {
+		if now.Sub(sc.first) >= b.window {
+			delete(b.strikes, k)
+		}
+	}
+	b.updateSizeLocked()
+}
+
+func (b *Blocklist) updateSizeLocked() {
+	if b.stats != nil {
+		b.stats.SetBlocklistSize(len(b.blocked))
+	}
+}
+
+// Start launches a goroutine that prunes the list every window and, with
+// persistence enabled, saves it.
+func (b *Blocklist) Start() {
+	interval := b.window
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go runEvery(interval, b.stopCh, func() {
+		b.Prune(time.Now())
+		if err := b.Save(); err != nil {
+			log.Printf("blocklist: %v", err)
+		}
+	})
+}
+
+// Stop stops the background goroutine and saves the list.
+func (b *Blocklist) Stop() {
+	close(b.stopCh)
+	if err := b.Save(); err != nil {
+		log.Printf("blocklist: %v", err)
+	}
+}
+
+// Load reads bans saved by Save, skipping expired ones. A missing file is
+// not an error.
+func (b *Blocklist) Load(now time.Time) error {
+	if b.path == "" {
+		return nil
+	}
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load %s: %w", b.path, err)
+	}
+	defer f.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sc := bufio.NewScanner(f)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || net.ParseIP(fields[0]) == nil {
+			return fmt.Errorf("%s:%d: want \"<ip> <unix-expiry>\"", b.path, lineNo)
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", b.path, lineNo, err)
+		}
+		if exp := time.Unix(sec, 0); now.Before(exp) {
+			b.blocked[fields[0]] = exp
+		}
+	}
+	b.updateSizeLocked()
+	return sc.Err()
+}
+
+// Save writes the current bans to the persistence file atomically.
+func (b *Blocklist) Save() error {
+	if b.path == "" {
+		return nil
+	}
+	var sb strings.Builder
+	b.mu.Lock()
+	for ip, exp := range b.blocked {
+		fmt.Fprintf(&sb, "%s %d\n", ip, exp.Unix())
+	}
+	b.mu.Unlock()
+
+	if err := config.WriteFileAtomic(b.path, []byte(sb.String()), 0o600, nil); err != nil {
+		return fmt.Errorf("save %s: %w", b.path, err)
+	}
+	return nil
+}
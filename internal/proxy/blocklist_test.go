@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlocklist_StrikeAndExpire(t *testing.T) {
+	stats := NewStats()
+	b := NewBlocklist(3, time.Minute, 10*time.Minute, stats)
+	ip := net.ParseIP("198.51.100.7")
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 2; i++ {
+		if b.Strike(ip, now) {
+			t.Fatalf("blocked after %d strikes", i+1)
+		}
+	}
+	if b.Blocked(ip, now) {
+		t.Fatal("blocked before reaching threshold")
+	}
+	if !b.Strike(ip, now) {
+		t.Fatal("not blocked after 3 strikes")
+	}
+	if !b.Blocked(ip, now.Add(time.Minute)) {
+		t.Error("ban lifted too early")
+	}
+	if b.Blocked(ip, now.Add(10*time.Minute)) {
+		t.Error("ban not lifted after TTL")
+	}
+
+	snap := stats.Snapshot(0)
+	if snap["blocklist_added"] != 1 || snap["blocklist_hits"] != 1 || snap["blocklist_size"] != 0 {
+		t.Errorf("stats = added %d, hits %d, size %d", snap["blocklist_added"], snap["blocklist_hits"], snap["blocklist_size"])
+	}
+}
+
+func TestBlocklist_StrikesDecay(t *testing.T) {
+	b := NewBlocklist(2, time.Minute, time.Hour, nil)
+	ip := net.ParseIP("198.51.100.8")
+	now := time.Unix(1000, 0)
+
+	b.Strike(ip, now)
+	if b.Strike(ip, now.Add(2*time.Minute)) {
+		t.Error("strike outside the window should start a new count")
+	}
+	if !b.Strike(ip, now.Add(2*time.Minute+time.Second)) {
+		t.Error("expected block after two strikes in one window")
+	}
+}
+
+func TestBlocklist_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	now := time.Now()
+
+	b := NewBlocklist(1, time.Minute, time.Hour, nil)
+	b.SetPersistFile(path)
+	b.Strike(net.ParseIP("198.51.100.9"), now)
+	b.Strike(net.ParseIP("2001:db8::9"), now.Add(-2*time.Hour)) // already expired
+	if err := b.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	b2 := NewBlocklist(1, time.Minute, time.Hour, nil)
+	b2.SetPersistFile(path)
+	if err := b2.Load(now); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if b2.Len() != 1 || !b2.Blocked(net.ParseIP("198.51.100.9"), now) {
+		t.Errorf("loaded %d entries, want only 198.51.100.9", b2.Len())
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
 )
 
 // bootstrapSequence запускает компоненты в порядке зависимостей.
@@ -13,16 +16,35 @@ import (
 //  2. RateLimiter
 //  3. DataPlane (зависит от Router, Outbound, Stats)
 //  4. HTTPStatsServer (зависит от Stats)
-//  5. HotReloader (зависит от Config, Router)
+//  5. HotReloader (зависит от Config, Router) и ConfigWatcher (--watch-config)
+//  6. config.Fetcher (зависит от Config, HotReloader, Stats)
 func (rt *Runtime) bootstrapSequence(ctx context.Context) error {
 	cfg := rt.configMgr.Get()
 	if cfg == nil {
 		return fmt.Errorf("bootstrap: config not loaded")
 	}
+	rt.Stats.SetBootstrapWarnings(len(cfg.Warnings))
+	if len(cfg.Warnings) > 0 {
+		log.Printf("bootstrap: config has %d warning(s)", len(cfg.Warnings))
+	}
 
 	// 1. Router
 	rt.Router = NewRouter(cfg)
-	log.Printf("bootstrap: router initialized with %d clusters", len(cfg.Clusters))
+	seed := rt.opts.RoutingSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rt.Router.SetSeed(seed)
+	rt.Router.SetVerbose(rt.opts.Verbosity >= frameLogVerbosity)
+	rt.Router.SetPreferIPv6(rt.opts.PreferIPv6)
+	rt.Router.SetBalance(rt.balance)
+	rt.Router.SetOutstanding(rt.Outbound.Outstanding)
+	if rt.affinity != nil {
+		rt.Router.SetAffinity(rt.affinity)
+	}
+	rt.Outbound.SetTargetOptions(rt.Router.TargetOptions)
+	rt.Outbound.WarmUp(cfg)
+	log.Printf("bootstrap: router initialized with %d clusters (routing seed %d, balance %s)", len(cfg.Clusters), seed, rt.balance)
 
 	// 2. RateLimiter
 	rt.rateLimiter = NewRateLimiter(rt.opts.MaxConnectionsPerSecret)
@@ -30,27 +52,107 @@ func (rt *Runtime) bootstrapSequence(ctx context.Context) error {
 
 	// 3. DataPlane
 	rt.DataPlane = NewDataPlane(rt.Router, rt.Outbound, rt.Stats, rt.ProxyTag)
-	log.Println("bootstrap: data plane initialized")
+	rt.DataPlane.SetBuffers(rt.Buffers)
+	if len(rt.ProxyTag) == 16 {
+		log.Printf("bootstrap: data plane initialized, forwarding with proxy tag %x", rt.ProxyTag)
+	} else {
+		log.Println("bootstrap: data plane initialized (no proxy tag)")
+	}
+	if n := len(rt.Outbound.cfg.NatInfo); n > 0 {
+		log.Printf("bootstrap: data plane advertises public addresses of %d NAT rule(s) to DCs", n)
+	}
 
 	// 4. HTTPStatsServer
-	if rt.opts.HTTPStatsAddr != "" {
+	if rt.opts.HTTPStatsAddr != "" || rt.opts.AdminSocket != "" || len(rt.opts.IngressStats) > 0 || rt.opts.WorkerStatsSocket != "" {
 		rt.httpStats = NewHTTPStatsServer(
 			rt.opts.HTTPStatsAddr,
 			rt.Stats,
 			len(rt.Secrets),
 			rt.ProxyTag,
-			"mtproxy-go-0.1",
+			proxyVersion,
 		)
+		if rt.opts.LatencySampleRate > 0 {
+			rt.httpStats.SetLatencySampler(rt.Latency)
+		}
+		rt.httpStats.SetReloadHistory(rt.Reloads)
+		rt.httpStats.SetTargetHealth(rt.Outbound.Health())
+		rt.httpStats.SetOutboundConns(rt.Outbound.Conns)
+		rt.httpStats.SetOutboundPools(rt.Outbound.Pools)
+		rt.httpStats.SetRouter(rt.Router)
+		if rt.standby != nil {
+			rt.httpStats.SetActivator(rt.Activate)
+		}
+		rt.httpStats.SetDescriptor(rt.Descriptor)
+		rt.httpStats.SetEffectiveConfig(rt.opts.EffectiveConfig)
+		rt.httpStats.SetProber(rt.ProbeTargets)
+		rt.httpStats.SetHealthChecks(rt.Liveness, rt.Readiness)
+		rt.httpStats.SetListenerControl(rt.Listeners, rt.DrainListener)
+		rt.httpStats.SetLimitControl(rt.Limits, rt.SetLimits)
+		if rt.secretWatcher != nil {
+			rt.httpStats.SetSecretReloader(rt.ReloadSecrets)
+		}
+		if rt.opts.EnablePprof {
+			rt.httpStats.EnablePprof()
+		}
+		rt.httpStats.SetEventLog(rt.Events)
+		rt.httpStats.SetConnTable(rt.Conns)
+		if rt.ipLimits != nil {
+			rt.httpStats.SetIPLimiter(rt.ipLimits)
+		}
+		if rt.opts.AdminSocket != "" {
+			rt.httpStats.SetAdminSocket(rt.opts.AdminSocket, rt.opts.AdminUIDs)
+		}
+		if len(rt.opts.IngressStats) > 0 {
+			rt.httpStats.EnableIngress()
+		}
+		if rt.opts.WorkerStatsSocket != "" {
+			rt.httpStats.SetWorkerSocket(rt.opts.WorkerStatsSocket)
+			rt.httpStats.SetConfigReloader(rt.Reload)
+		}
 		if err := rt.httpStats.Start(); err != nil {
 			return fmt.Errorf("bootstrap: http stats: %w", err)
 		}
-		log.Printf("bootstrap: http stats listening on %s", rt.opts.HTTPStatsAddr)
+		if rt.opts.HTTPStatsAddr != "" {
+			log.Printf("bootstrap: http stats listening on %s", rt.opts.HTTPStatsAddr)
+		}
+		if rt.opts.AdminSocket != "" {
+			log.Printf("bootstrap: admin API listening on unix socket %s", rt.opts.AdminSocket)
+		}
+		if len(rt.opts.IngressStats) > 0 {
+			log.Printf("bootstrap: /stats served on the client port to %v", rt.opts.IngressStats)
+		}
 	}
 
-	// 5. HotReloader
+	// 5. HotReloader, ConfigWatcher
 	rt.hotReloader = NewHotReloader(rt.configMgr, rt.Router)
+	rt.hotReloader.SetHistory(rt.Reloads)
+	rt.hotReloader.SetStats(rt.Stats)
+	rt.hotReloader.SetEventLog(rt.Events)
+	rt.hotReloader.SetWarmUp(rt.Outbound.WarmUp)
+	if rt.secretWatcher != nil {
+		rt.hotReloader.SetSecretReload(rt.ReloadSecrets)
+	}
 	rt.hotReloader.Start()
 	log.Println("bootstrap: hot reloader started")
+	if len(rt.opts.WatchFiles) > 0 {
+		rt.configWatcher = NewConfigWatcher(rt.opts.WatchFiles, rt.opts.WatchConfigDebounce, rt.hotReloader.reload)
+		rt.configWatcher.Start()
+		log.Printf("bootstrap: watching %v for changes", rt.opts.WatchFiles)
+	}
+
+	// 6. config.Fetcher
+	if rt.opts.ConfigFetchInterval > 0 {
+		rt.configFetcher = config.NewFetcher(rt.configMgr, config.FetcherOptions{
+			URL:      rt.opts.ConfigURL,
+			Interval: rt.opts.ConfigFetchInterval,
+			Jitter:   rt.opts.ConfigFetchJitter,
+		})
+		rt.configFetcher.SetOnApply(rt.hotReloader.Applied)
+		rt.configFetcher.SetLocker(&rt.hotReloader.reloadMu)
+		rt.Stats.SetConfigFetcher(rt.configFetcher)
+		rt.configFetcher.Start()
+		log.Printf("bootstrap: config fetcher started (every %s + up to %s)", rt.opts.ConfigFetchInterval, rt.opts.ConfigFetchJitter)
+	}
 
 	return nil
 }
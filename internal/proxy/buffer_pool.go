@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMsgBuffersSize is the default --msg-buffers-size budget, as in the
+// C proxy (MSG_DEFAULT_MAX_ALLOCATED_BYTES).
+const DefaultMsgBuffersSize = 1 << 28
+
+// Size classes of BufferPool: powers of two from 512 bytes to 1 MiB. Larger
+// buffers are allocated and left to the garbage collector.
+const (
+	minBufferClassBits = 9
+	maxBufferClassBits = 20
+	numBufferClasses   = maxBufferClassBits - minBufferClassBits + 1
+)
+
+// BufferPool recycles the byte buffers of the frame hot path (RPC frames to
+// DCs, encrypted writes to clients) through one sync.Pool per size class,
+// so steady traffic allocates almost nothing. budget caps the bytes of
+// buffers handed out: past it Get still succeeds, but Put lets buffers go
+// to the garbage collector instead of keeping them. A nil *BufferPool
+// allocates every buffer.
+//
+// Every buffer from Get must be given back to Put exactly once, resliced
+// at most; the caller must not use it afterwards.
+type BufferPool struct {
+	budget  int64
+	stats   *Stats
+	classes [numBufferClasses]sync.Pool
+	inUse   atomic.Int64
+}
+
+// NewBufferPool creates a pool handing out at most budget bytes of pooled
+// buffers at a time (0 = DefaultMsgBuffersSize).
+func NewBufferPool(budget int64, stats *Stats) *BufferPool {
+	if budget <= 0 {
+		budget = DefaultMsgBuffersSize
+	}
+	if stats != nil {
+		atomic.StoreInt64(&stats.MaxBufferBytes, budget)
+	}
+	return &BufferPool{budget: budget, stats: stats}
+}
+
+// bufferClass returns the size class holding n bytes, or -1 if n is larger
+// than the largest class.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClassBits {
+		return 0
+	}
+	c := bits.Len(uint(n-1)) - minBufferClassBits
+	if c >= numBufferClasses {
+		return -1
+	}
+	return c
+}
+
+// Get returns a buffer of n bytes with undefined contents.
+func (bp *BufferPool) Get(n int) []byte {
+	c := bufferClass(n)
+	if bp == nil || c < 0 {
+		return make([]byte, n)
+	}
+	size := 1 << (c + minBufferClassBits)
+	used := bp.inUse.Add(int64(size))
+	var b []byte
+	if p, ok := bp.classes[c].Get().(*[]byte); ok {
+		b = *p
+	} else {
+		b = make([]byte, size)
+		if bp.stats != nil {
+			atomic.AddInt64(&bp.stats.BufferAllocs, 1)
+		}
+	}
+	if bp.stats != nil {
+		atomic.AddInt64(&bp.stats.BuffersUsed, 1)
+		atomic.AddInt64(&bp.stats.BuffersUsedBytes, int64(size))
+		if used > bp.budget {
+			atomic.AddInt64(&bp.stats.BufferOverBudget, 1)
+		}
+	}
+	return b[:n]
+}
+
+// Put gives back a buffer from Get.
+func (bp *BufferPool) Put(b []byte) {
+	c := bufferClass(cap(b))
+	if bp == nil || c < 0 || cap(b) != 1<<(c+minBufferClassBits) {
+		return
+	}
+	used := bp.inUse.Add(-int64(cap(b)))
+	if bp.stats != nil {
+		atomic.AddInt64(&bp.stats.BuffersUsed, -1)
+		atomic.AddInt64(&bp.stats.BuffersUsedBytes, -int64(cap(b)))
+	}
+	if used >= bp.budget {
+		return
+	}
+	b = b[:cap(b)]
+	bp.classes[c].Put(&b)
+}
+
+// InUse returns the bytes of pooled buffers handed out and not yet given back.
+func (bp *BufferPool) InUse() int64 {
+	if bp == nil {
+		return 0
+	}
+	return bp.inUse.Load()
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/skrashevich/MTProxy/internal/crypto"
+)
+
+func TestBufferClass(t *testing.T) {
+	for n, want := range map[int]int{0: 0, 1: 0, 512: 0, 513: 1, 4096: 3, 4097: 4, 1 << 20: 11, 1<<20 + 1: -1} {
+		if got := bufferClass(n); got != want {
+			t.Errorf("bufferClass(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	stats := &Stats{}
+	bp := NewBufferPool(8192, stats)
+
+	b := bp.Get(1000)
+	if len(b) != 1000 || cap(b) != 1024 {
+		t.Fatalf("Get(1000): len %d cap %d, want 1000 1024", len(b), cap(b))
+	}
+	if bp.InUse() != 1024 || stats.BuffersUsed != 1 || stats.BuffersUsedBytes != 1024 || stats.BufferAllocs != 1 {
+		t.Errorf("after Get: in use %d, %+v", bp.InUse(), stats)
+	}
+	bp.Put(b[:10])
+	if bp.InUse() != 0 || stats.BuffersUsed != 0 || stats.BuffersUsedBytes != 0 {
+		t.Errorf("after Put: in use %d, %+v", bp.InUse(), stats)
+	}
+
+	// Past the budget Get still hands out buffers, but they are not kept.
+	var held [][]byte
+	for range 3 {
+		held = append(held, bp.Get(4000))
+	}
+	if stats.BufferOverBudget != 1 || bp.InUse() != 3*4096 {
+		t.Errorf("over budget: in use %d, %+v", bp.InUse(), stats)
+	}
+	for _, b := range held {
+		bp.Put(b)
+	}
+	if bp.InUse() != 0 {
+		t.Errorf("in use %d after giving every buffer back", bp.InUse())
+	}
+
+	// Buffers larger than the largest class are not pooled.
+	big := bp.Get(2 << 20)
+	if len(big) != 2<<20 || bp.InUse() != 0 {
+		t.Errorf("large buffer: len %d, in use %d", len(big), bp.InUse())
+	}
+	bp.Put(big)
+
+	var none *BufferPool
+	if b := none.Get(100); len(b) != 100 {
+		t.Errorf("nil pool: len %d", len(b))
+	}
+	none.Put(make([]byte, 512))
+}
+
+// TestWriteEncryptedFrame_Pooled checks that a frame built in a pooled
+// buffer is the same as one built without a pool, and that the buffer is
+// given back.
+func TestWriteEncryptedFrame_Pooled(t *testing.T) {
+	var key [32]byte
+	var iv [16]byte
+	payload := bytes.Repeat([]byte{0xab}, 332)
+	var wire [2]bytes.Buffer
+	bp := NewBufferPool(0, nil)
+	for i, bufs := range []*BufferPool{nil, bp} {
+		sock := &frameCapture{}
+		c := newRPCOutboundConn("test", nil, false, nil)
+		c.conn = sock
+		c.cbcEnc, _ = crypto.NewAESCBCEncryptor(key, iv)
+		c.buffers = bufs
+		for range 3 {
+			if err := c.writeEncryptedFrame(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wire[i] = sock.written
+	}
+	if !bytes.Equal(wire[0].Bytes(), wire[1].Bytes()) {
+		t.Error("pooled frames differ from allocated ones")
+	}
+	if bp.InUse() != 0 {
+		t.Errorf("%d bytes still in use", bp.InUse())
+	}
+}
+
+// discardConn is a net.Conn that drops everything written to it.
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// benchPools runs fn without a buffer pool and with one, reporting the
+// garbage collections during the run and the heap in use at its end next
+// to the allocations.
+func benchPools(b *testing.B, fn func(b *testing.B, bufs *BufferPool)) {
+	for _, bc := range []struct {
+		name string
+		bufs *BufferPool
+	}{{"alloc", nil}, {"pool", NewBufferPool(0, nil)}} {
+		b.Run(bc.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			fn(b, bc.bufs)
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.NumGC-before.NumGC), "gcs")
+			b.ReportMetric(float64(after.HeapInuse), "heap-inuse-B")
+		})
+	}
+}
+
+// BenchmarkWriteEncryptedFrame measures building and encrypting an RPC
+// frame to a DC.
+func BenchmarkWriteEncryptedFrame(b *testing.B) {
+	payload := make([]byte, 16<<10)
+	benchPools(b, func(b *testing.B, bufs *BufferPool) {
+		c := newRPCOutboundConn("bench", nil, false, nil)
+		c.conn = discardConn{}
+		c.cbcEnc, _ = crypto.NewAESCBCEncryptor([32]byte{}, [16]byte{})
+		c.buffers = bufs
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			c.writeEncryptedFrame(payload)
+		}
+	})
+}
+
+// BenchmarkClientWritePacket measures encrypting a frame to a client.
+func BenchmarkClientWritePacket(b *testing.B) {
+	payload := make([]byte, 16<<10)
+	benchPools(b, func(b *testing.B, bufs *BufferPool) {
+		stream, err := newAESCTRStream([32]byte{}, [16]byte{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		enc := &AESStreamState{stream: stream}
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			writePacket(discardConn{}, payload, enc, TransportIntermediate, bufs)
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// CheckConfigOptions lists what CheckConfig validates.
+type CheckConfigOptions struct {
+	// ConfigFile is the proxy-multi.conf to parse.
+	ConfigFile string
+
+	// Duplicates is the --duplicate-targets policy the proxy would run with.
+	Duplicates config.DuplicatePolicy
+
+	// Resolver looks up target host names (--dns); nil means the system one.
+	Resolver *net.Resolver
+
+	// Dial connects to every target once. With Secret set the connection
+	// completes the RPC handshake, otherwise only TCP is checked.
+	Dial   bool
+	Secret []byte
+
+	// Timeout bounds each lookup and each dial.
+	Timeout time.Duration
+}
+
+// CheckConfig validates a config file the way a proxy starting with it
+// would use it (mtproto-proxy checkconfig): the file must parse, parser
+// warnings are reported, the default cluster must exist, every target host
+// must resolve and, with Dial, every target must accept a connection.
+func CheckConfig(o CheckConfigOptions) PreflightReport {
+	cfg, err := config.ParseConfigWithOptions(o.ConfigFile, config.ParseOptions{Duplicates: o.Duplicates})
+	if err != nil {
+		return PreflightReport{{Name: "config", Status: PreflightFail, Detail: err.Error(),
+			Hint: "fix the file; the proxy refuses to start with it"}}
+	}
+	targets := 0
+	for _, cl := range cfg.Clusters {
+		targets += len(cl.Targets)
+	}
+	report := PreflightReport{{Name: "config", Status: PreflightPass,
+		Detail: fmt.Sprintf("%s: version %d, %d clusters, %d targets, md5 %s", o.ConfigFile, cfg.Version, len(cfg.Clusters), targets, cfg.MD5)}}
+	for _, w := range cfg.Warnings {
+		report = append(report, PreflightCheck{Name: "config", Status: PreflightWarn, Detail: w})
+	}
+	if cl := cfg.Clusters[cfg.DefaultClusterID]; cl == nil || len(cl.Targets) == 0 {
+		report = append(report, PreflightCheck{Name: "default", Status: PreflightFail,
+			Detail: fmt.Sprintf("default cluster %d has no targets", cfg.DefaultClusterID),
+			Hint:   "add proxy_for lines for it or point \"default\" at a listed DC"})
+	} else {
+		report = append(report, PreflightCheck{Name: "default", Status: PreflightPass,
+			Detail: fmt.Sprintf("cluster %d, %d targets", cfg.DefaultClusterID, len(cl.Targets))})
+	}
+
+	report = append(report, checkResolve(cfg, o.Resolver, o.Timeout)...)
+	if o.Dial {
+		report = append(report, checkDial(cfg, o)...)
+	}
+	return report
+}
+
+// checkResolve looks up every target host name that is neither an IP
+// address nor covered by a "hosts" line.
+func checkResolve(cfg *config.Config, resolver *net.Resolver, timeout time.Duration) PreflightReport {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	hosts := make(map[string]bool)
+	for _, addr := range configTargetAddrs(cfg) {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && net.ParseIP(host) == nil {
+			hosts[host] = true
+		}
+	}
+	names := make([]string, 0, len(hosts))
+	for h := range hosts {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+
+	var report PreflightReport
+	for _, h := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ips, err := resolver.LookupHost(ctx, h)
+		cancel()
+		if err != nil {
+			report = append(report, PreflightCheck{Name: "resolve " + h, Status: PreflightFail, Detail: err.Error(),
+				Hint: "check the name and the resolver (--dns), or pin it with a \"hosts\" line"})
+			continue
+		}
+		report = append(report, PreflightCheck{Name: "resolve " + h, Status: PreflightPass, Detail: strings.Join(ips, ", ")})
+	}
+	return report
+}
+
+// checkDial connects to every target once, concurrently.
+func checkDial(cfg *config.Config, o CheckConfigOptions) PreflightReport {
+	var connect func(addr string) error
+	what := "TCP"
+	if len(o.Secret) > 0 {
+		out := NewOutboundProxy(OutboundConfig{Secret: o.Secret, Resolver: o.Resolver})
+		defer out.Close()
+		connect = out.Probe
+		what = "RPC handshake"
+	} else {
+		d := &net.Dialer{Timeout: o.Timeout, Resolver: o.Resolver}
+		connect = func(addr string) error {
+			c, err := d.Dial("tcp", addr)
+			if err != nil {
+				return err
+			}
+			return c.Close()
+		}
+	}
+
+	var report PreflightReport
+	for _, r := range probeTargets(cfg, connect, o.Timeout) {
+		c := PreflightCheck{Name: "dial " + r.Addr}
+		if r.Err != nil {
+			c.Status = PreflightFail
+			c.Detail = fmt.Sprintf("dc %s: %v", joinInts(r.DCs), r.Err)
+			c.Hint = "the proxy will keep retrying this target; remove it or fix the network path"
+		} else {
+			c.Status = PreflightPass
+			c.Detail = fmt.Sprintf("dc %s: %s in %s", joinInts(r.DCs), what, r.Latency.Round(time.Millisecond))
+		}
+		report = append(report, c)
+	}
+	return report
+}
+
+// configTargetAddrs returns the distinct dial addresses of cfg's targets
+// and canaries.
+func configTargetAddrs(cfg *config.Config) []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	add := func(t config.Target) {
+		if a := cfg.DialAddr(t); !seen[a] {
+			seen[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	for _, cl := range cfg.Clusters {
+		for _, t := range cl.Targets {
+			add(t)
+		}
+		if cl.Canary != nil {
+			add(*cl.Canary)
+		}
+	}
+	return addrs
+}
+
+// joinInts formats DC IDs as "1,2,-2".
+func joinInts(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCheckConfig writes a config file for CheckConfig and returns its path.
+func writeCheckConfig(t *testing.T, body string) string {
+	path := filepath.Join(t.TempDir(), "proxy-multi.conf")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckConfig(t *testing.T) {
+	secret := NewTestBackendSecret()
+	backend, err := NewTestBackend(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	// A port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	path := writeCheckConfig(t, fmt.Sprintf("default 2;\nproxy_for 2 %s;\nproxy_for 2 %s;\n", backend.Addr(), dead))
+	report := CheckConfig(CheckConfigOptions{ConfigFile: path, Dial: true, Secret: secret, Timeout: 5 * time.Second})
+	var out bytes.Buffer
+	report.WriteAs(&out, "checkconfig")
+	if !report.Failed() {
+		t.Fatalf("dead target not reported:\n%s", out.String())
+	}
+	for _, want := range []string{"PASS  config", "PASS  default", "PASS  dial " + backend.Addr(), "FAIL  dial " + dead} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+	if backend.Handshakes() != 1 {
+		t.Errorf("backend saw %d handshakes, want 1", backend.Handshakes())
+	}
+
+	// No default cluster and an unparsable file both fail.
+	path = writeCheckConfig(t, fmt.Sprintf("default 3;\nproxy_for 2 %s;\n", backend.Addr()))
+	if r := CheckConfig(CheckConfigOptions{ConfigFile: path, Timeout: time.Second}); !r.Failed() {
+		t.Errorf("missing default cluster passed: %+v", r)
+	}
+	path = writeCheckConfig(t, "proxy_for two 127.0.0.1:443;\n")
+	if r := CheckConfig(CheckConfigOptions{ConfigFile: path, Timeout: time.Second}); !r.Failed() || len(r) != 1 {
+		t.Errorf("bad config: %+v", r)
+	}
+}
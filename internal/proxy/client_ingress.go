@@ -1,10 +1,17 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -22,6 +29,27 @@ func nextExtConnID() int64 {
 	return atomic.AddInt64(&extConnIDCounter, 1)
 }
 
+// frameLogVerbosity is the verbosity at which every frame gets its own ID
+// and the dataplane logs per-frame progress.
+const frameLogVerbosity = 2
+
+// Client read timeouts: the obfuscated2 header must arrive within
+// clientHeaderTimeout, and an established connection may stay silent for
+// clientIdleTimeout. Both are tracked on the shared timer wheel rather than
+// by re-arming a read deadline for every packet.
+const (
+	clientHeaderTimeout = 30 * time.Second
+	clientIdleTimeout   = 60 * time.Second
+)
+
+// newConnID returns a short random ID included in every log line about one
+// client connection, so a session can be followed with a single grep.
+func newConnID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 // IncomingPacket is a decrypted MTProto packet received from a Telegram client.
 type IncomingPacket struct {
 	Data       []byte
@@ -29,6 +57,24 @@ type IncomingPacket struct {
 	ClientPort int
 	TargetDC   int16
 	ExtConnID  int64 // unique per client connection, used in RPC_PROXY_REQ
+
+	// LocalIP and LocalPort are the proxy address the client connected to
+	// (our_ip/our_port of RPC_PROXY_REQ); LocalIP is nil if unknown.
+	LocalIP   net.IP
+	LocalPort int
+
+	// ConnID is the log correlation ID of the client connection; FrameID
+	// ("<conn>/<n>") is set only at debug verbosity.
+	ConnID  string
+	FrameID string
+
+	// Trace is non-nil when this frame was chosen by the latency sampler;
+	// each stage fills in its own phase duration.
+	Trace *LatencySample
+
+	// Conn is the connection's entry in the connection table, if any; the
+	// dataplane records the backend it forwarded to.
+	Conn *ConnInfo
 }
 
 // DataplaneHandler receives decrypted MTProto packets from the ingress layer,
@@ -40,10 +86,62 @@ type DataplaneHandler interface {
 // ClientIngressServer wraps IngressServer and implements the obfuscated2 handshake
 // for every incoming Telegram-client TCP connection.
 type ClientIngressServer struct {
-	secrets   [][]byte // list of 16-byte proxy secrets
+	secrets   atomic.Pointer[secretMatcher] // 16-byte proxy secrets; swapped on reload
 	dataplane DataplaneHandler
-	inner     *IngressServer
+	listeners []*IngressServer    // one per client port
+	udp       []*UDPIngressServer // one per --udp-ports port
 	shutdown  *GracefulShutdown
+	sampler   *LatencySampler // optional per-frame latency sampler
+	authz     *Authorizer     // optional external connection authorizer
+	stats     *Stats
+	crash     *CrashReporter    // optional; writes a report if a handler panics
+	blocklist *Blocklist        // optional; bans IPs with repeated bad handshakes
+	shedder   *OverloadShedder  // optional; sheds load when overloaded
+	budget    *HandlerBudget    // optional; caps handler goroutines
+	surge     *SurgeGuard       // optional; tightens admission on rate spikes
+	ipLimits  *IPLimiter        // optional; per-source-IP connection and accept-rate caps
+	events    *EventLog         // optional; records opens, closes and rejections
+	conns     *ConnTable        // optional; lists established connections
+	limits    *FrameLimits      // optional; per-kind client frame size caps
+	tls       *fakeTLS          // optional; set with -D, serves only fake TLS clients
+	decoyAddr string            // optional; where connections that are not clients go
+	natInfo   map[uint32]uint32 // optional; --nat-info, local IPv4 → public IPv4
+	verbosity int
+
+	// writeQueue accounts the client write queues; nil without stats
+	writeQueue *QueueStats
+
+	// writeDelay is artificial latency added to client-bound frames; nil
+	// writes them at once
+	writeDelay *WriteDelay
+
+	// buffers provides the buffers client-bound frames are encrypted into;
+	// nil allocates them
+	buffers *BufferPool
+
+	// answerPings answers client transport pings locally instead of
+	// forwarding them
+	answerPings bool
+
+	// acceptLoops and standby apply to every listener
+	acceptLoops int
+	standby     <-chan struct{}
+	reusePort   bool
+	inherited   map[string]net.Listener
+	sockopts    SocketOptions
+
+	// dedup drops exact repeats of a session's recent frames, whichever
+	// connection they arrive on; nil disables deduplication
+	dedup *frameDedup
+
+	// statsNets are the client networks whose plain HTTP GET requests are
+	// handed to serveStats instead of the MTProto transport
+	statsNets  []netip.Prefix
+	serveStats func(conn net.Conn, head []byte)
+
+	// secretAllowed reports whether a secret is inside its validity window;
+	// nil means every secret is always valid.
+	secretAllowed func(secret []byte, now time.Time) bool
 }
 
 // NewClientIngressServer creates a ClientIngressServer that listens on addr.
@@ -51,23 +149,381 @@ type ClientIngressServer struct {
 // dp is the dataplane handler that receives decrypted packets.
 func NewClientIngressServer(addr string, secrets [][]byte, dp DataplaneHandler, shutdown *GracefulShutdown) *ClientIngressServer {
 	s := &ClientIngressServer{
-		secrets:   secrets,
 		dataplane: dp,
 		shutdown:  shutdown,
 	}
-	s.inner = NewIngressServer(addr, s.handleConn)
+	s.SetSecrets(secrets)
+	s.AddListener(addr)
 	return s
 }
 
-// ListenAndServe starts listening and blocks until ctx is cancelled.
+// AddListener adds another client port served the same way as the first.
+// Must be called before ListenAndServe.
+func (s *ClientIngressServer) AddListener(addr string) {
+	l := NewIngressServer(addr, func(conn net.Conn) {
+		s.handleConn(conn, s.stats.Handshakes(addr))
+	})
+	l.SetAcceptFilter(s.admit)
+	s.listeners = append(s.listeners, l)
+}
+
+// AddUDPListener adds a UDP port whose sessions (see UDPIngressServer) are
+// served like TCP connections. Must be called before ListenAndServe.
+func (s *ClientIngressServer) AddUDPListener(addr string) {
+	l := NewUDPIngressServer(addr, func(conn net.Conn) {
+		s.handleConn(conn, s.stats.Handshakes(udpListenerName(addr)))
+	})
+	l.SetAcceptFilter(s.admit)
+	s.udp = append(s.udp, l)
+}
+
+// udpListenerName is the name under which a UDP port's handshake stats are
+// kept, so ":443" is reported as listener_udp_443_* next to listener_443_*.
+func udpListenerName(addr string) string {
+	return "udp:" + strings.TrimPrefix(addr, ":")
+}
+
+// SetSecrets atomically replaces the list of accepted secrets. Connections
+// that already completed the handshake are not affected.
+func (s *ClientIngressServer) SetSecrets(secrets [][]byte) {
+	s.secrets.Store(newSecretMatcher(secrets))
+}
+
+// Secrets returns the current list of accepted secrets.
+func (s *ClientIngressServer) Secrets() [][]byte {
+	return s.secrets.Load().secrets
+}
+
+// SetAcceptLoops sets the number of accept goroutines on each client listener.
+func (s *ClientIngressServer) SetAcceptLoops(n int) {
+	s.acceptLoops = n
+}
+
+// SetSocketOptions sets the TCP options of connections accepted on every
+// TCP listener.
+func (s *ClientIngressServer) SetSocketOptions(o SocketOptions) {
+	s.sockopts = o
+}
+
+// SetReusePort binds every listener with SO_REUSEPORT, so supervised
+// workers share the client ports.
+func (s *ClientIngressServer) SetReusePort(on bool) {
+	s.reusePort = on
+}
+
+// SetInheritedListeners makes the listeners whose address is a key of lns
+// serve that already bound listener instead of binding their own.
+func (s *ClientIngressServer) SetInheritedListeners(lns map[string]net.Listener) {
+	s.inherited = lns
+}
+
+// SetStandby keeps the listeners bound but not accepting until gate is closed.
+func (s *ClientIngressServer) SetStandby(gate <-chan struct{}) {
+	s.standby = gate
+}
+
+// SetStats attaches the Stats instance used for ingress accounting.
+func (s *ClientIngressServer) SetStats(stats *Stats) {
+	s.stats = stats
+	if stats != nil {
+		s.writeQueue = stats.Queue(QueueClientWrite)
+	}
+}
+
+// SetSecretWindowCheck installs the validity-window check applied to the
+// matched secret of every new connection.
+func (s *ClientIngressServer) SetSecretWindowCheck(f func(secret []byte, now time.Time) bool) {
+	s.secretAllowed = f
+}
+
+// SetAuthorizer attaches an external authorizer consulted for every
+// connection after the secret has been identified.
+func (s *ClientIngressServer) SetAuthorizer(a *Authorizer) {
+	s.authz = a
+}
+
+// SetLatencySampler attaches the sampler used to trace frame latencies.
+func (s *ClientIngressServer) SetLatencySampler(l *LatencySampler) {
+	s.sampler = l
+}
+
+// SetCrashReporter makes connection handlers write a crash report on panic.
+func (s *ClientIngressServer) SetCrashReporter(c *CrashReporter) {
+	s.crash = c
+}
+
+// SetBlocklist makes the server drop connections from blocked IPs at accept
+// time and strike IPs that fail the handshake.
+func (s *ClientIngressServer) SetBlocklist(b *Blocklist) {
+	s.blocklist = b
+}
+
+// SetOverloadShedder attaches the shedder that applies the overload policy.
+func (s *ClientIngressServer) SetOverloadShedder(o *OverloadShedder) {
+	s.shedder = o
+}
+
+// SetHandlerBudget caps the handler goroutines of all client listeners
+// together; connections over the cap are closed at accept time.
+func (s *ClientIngressServer) SetHandlerBudget(b *HandlerBudget) {
+	s.budget = b
+}
+
+// SetSurgeGuard makes the server count accepts and tighten admission
+// while the guard detects a connection-rate spike.
+func (s *ClientIngressServer) SetSurgeGuard(g *SurgeGuard) {
+	s.surge = g
+}
+
+// SetIPLimiter caps the open connections and accept rate of each source
+// IP; connections over either are closed at accept time.
+func (s *ClientIngressServer) SetIPLimiter(l *IPLimiter) {
+	s.ipLimits = l
+}
+
+// SetFrameLimits enforces per-kind size limits on client frames.
+func (s *ClientIngressServer) SetFrameLimits(l FrameLimits) {
+	s.limits = &l
+}
+
+// SetAnswerPings makes the ingress answer client transport pings (RPC_PING
+// frames) with RPC_PONG itself, without a backend round trip.
+func (s *ClientIngressServer) SetAnswerPings(on bool) {
+	s.answerPings = on
+}
+
+// SetWriteDelay holds every frame written to a client back by d.Base plus
+// up to d.Jitter, to imitate a slow network. Testing aid only.
+func (s *ClientIngressServer) SetWriteDelay(d WriteDelay) {
+	if d.enabled() {
+		s.writeDelay = &d
+	}
+}
+
+// SetBuffers makes client writers encrypt frames into buffers from bp.
+func (s *ClientIngressServer) SetBuffers(bp *BufferPool) {
+	s.buffers = bp
+}
+
+// SetDedupFrames drops client frames that repeat one of the last n frames of
+// the same session (auth_key_id), also across reconnects, before they cost a
+// backend exchange; 0 turns deduplication off.
+func (s *ClientIngressServer) SetDedupFrames(n int) {
+	s.dedup = newFrameDedup(n)
+}
+
+// SetIngressStats makes connections from nets that start with a plain HTTP
+// GET go to serve (with the bytes already read) instead of the MTProto
+// transport, for hosts that can only expose the client port. Everything else,
+// including GETs from other addresses, is handled as before.
+func (s *ClientIngressServer) SetIngressStats(nets []netip.Prefix, serve func(conn net.Conn, head []byte)) {
+	s.statsNets = nets
+	s.serveStats = serve
+}
+
+// SetTLSDomains enables fake TLS for the given domains: clients must open
+// with a ClientHello for one of them whose random is signed with a secret,
+// and everything else is handed over to the first domain. No domains
+// disables it.
+func (s *ClientIngressServer) SetTLSDomains(domains []string) {
+	s.tls = newFakeTLS(domains, time.Now())
+}
+
+// SetDecoyAddr hands connections that are not proxy clients — a header
+// matching no secret, a plain HTTP request, or with -D a failed fake TLS
+// check — to the web server at addr instead of closing them, so active
+// probes see an ordinary site. With -D and no decoy they go to the first
+// domain's port 443.
+func (s *ClientIngressServer) SetDecoyAddr(addr string) {
+	s.decoyAddr = addr
+}
+
+// toDecoy relays conn to the decoy backend; consumed is what was already
+// read from it. It reports whether the relay ran. UDP sessions are never
+// relayed: no browser speaks their framing, and a site's pages sent back
+// in datagrams would make the port an amplifier.
+func (s *ClientIngressServer) toDecoy(conn net.Conn, connID, addr string, consumed []byte, idle *IdleTimer) bool {
+	if _, ok := conn.(*udpConn); ok {
+		return false
+	}
+	if err := relayDecoy(conn, addr, consumed, idle, s.stats); err != nil {
+		log.Printf("ingress: conn=%s decoy %s: %v", connID, addr, err)
+		return false
+	}
+	return true
+}
+
+// SetNATInfo sets the --nat-info rules used to report the public address
+// of each local address clients connect to.
+func (s *ClientIngressServer) SetNATInfo(nat map[uint32]uint32) {
+	s.natInfo = nat
+}
+
+// SetEventLog attaches the ring that records connection events.
+func (s *ClientIngressServer) SetEventLog(l *EventLog) {
+	s.events = l
+}
+
+// SetConnTable attaches the table that lists established connections.
+func (s *ClientIngressServer) SetConnTable(t *ConnTable) {
+	s.conns = t
+}
+
+// admit is the accept filter: it drops blocked IPs, connections over the
+// surge guard's tightened rate, under the accept policy connections
+// arriving while the proxy is overloaded, and connections over their
+// source IP's limits. An admitted connection holds its IP's slot until
+// handleConn returns.
+func (s *ClientIngressServer) admit(conn net.Conn) bool {
+	ip, port, err := parseRemoteAddr(conn.RemoteAddr())
+	if err != nil {
+		return true
+	}
+	if s.blocklist != nil && s.blocklist.Blocked(ip, time.Now()) {
+		s.events.Record(EventBlocked, "", eventAddr(ip, port), "")
+		return false
+	}
+	if !s.surge.Admit() {
+		s.events.Record(EventConnClose, "", eventAddr(ip, port), CloseSurge)
+		return false
+	}
+	if !s.shedder.AdmitAccept() {
+		s.events.Record(EventConnClose, "", eventAddr(ip, port), CloseOverload)
+		return false
+	}
+	if addr := eventAddr(ip, port); !s.ipLimits.Admit(addr.Addr(), time.Now()) {
+		s.events.Record(EventConnClose, "", addr, CloseIPLimit)
+		return false
+	}
+	return true
+}
+
+// SetVerbosity sets the log verbosity; at frameLogVerbosity and above
+// every frame is tagged with a FrameID.
+func (s *ClientIngressServer) SetVerbosity(v int) {
+	s.verbosity = v
+}
+
+// Listen binds every client port, TCP and UDP, without accepting yet, so
+// the process can drop privileges before the first client is served.
+// ListenAndServe binds whatever is not bound yet. If one port fails, the ones bound so far are
+// closed and its error is returned; a later Listen binds them afresh.
+func (s *ClientIngressServer) Listen(ctx context.Context) error {
+	for i, l := range s.listeners {
+		l.SetReusePort(s.reusePort)
+		if ln, ok := s.inherited[l.Addr()]; ok {
+			l.SetListener(ln)
+		}
+		if err := l.Listen(ctx); err != nil {
+			s.unbind(s.listeners[:i], nil)
+			return err
+		}
+	}
+	for i, l := range s.udp {
+		// UDP ports are never inherited: with inherited TCP listeners every
+		// worker still binds them itself.
+		l.SetReusePort(s.reusePort || s.inherited != nil)
+		if err := l.Listen(ctx); err != nil {
+			s.unbind(s.listeners, s.udp[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// unbind closes the listeners a failed Listen bound. Inherited listeners
+// among them are forgotten too, so a retry never serves a closed one.
+func (s *ClientIngressServer) unbind(tcp []*IngressServer, udp []*UDPIngressServer) {
+	for _, l := range tcp {
+		delete(s.inherited, l.Addr())
+		l.close()
+	}
+	for _, l := range udp {
+		l.close()
+	}
+}
+
+// ListenAndServe starts every listener and blocks until ctx is cancelled.
+// If one listener fails, the others are stopped and its error is returned.
 func (s *ClientIngressServer) ListenAndServe(ctx context.Context) error {
-	return s.inner.ListenAndServe(ctx)
+	if err := s.Listen(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, len(s.listeners)+len(s.udp))
+	for _, l := range s.udp {
+		l.SetStats(s.stats)
+		l.SetHandlerBudget(s.budget)
+		s.stats.Handshakes(udpListenerName(l.Addr()))
+		if s.standby != nil {
+			l.SetStandby(s.standby)
+		}
+		go func() {
+			errCh <- l.ListenAndServe(ctx)
+		}()
+	}
+	for _, l := range s.listeners {
+		l.SetAcceptLoops(s.acceptLoops)
+		l.SetSocketOptions(s.sockopts)
+		l.SetStats(s.stats)
+		l.SetHandlerBudget(s.budget)
+		s.stats.Handshakes(l.Addr()) // reported from start, before the first handshake
+		if s.standby != nil {
+			l.SetStandby(s.standby)
+		}
+		go func() {
+			errCh <- l.ListenAndServe(ctx)
+		}()
+	}
+	var firstErr error
+	for range len(s.listeners) + len(s.udp) {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
+
+// Listeners returns the state of every client listener.
+func (s *ClientIngressServer) Listeners() []ListenerStatus {
+	out := make([]ListenerStatus, len(s.listeners))
+	for i, l := range s.listeners {
+		out[i] = l.Status()
+	}
+	return out
+}
+
+// ErrUnknownListener is returned by DrainListener for an address that is
+// not one of the client listeners.
+var ErrUnknownListener = errors.New("no such listener")
+
+// DrainListener stops accepting on the listener for addr (as configured,
+// e.g. ":443", or just the port) while its connections run to completion
+// and the other listeners keep serving.
+func (s *ClientIngressServer) DrainListener(addr string) (ListenerStatus, error) {
+	for _, l := range s.listeners {
+		if l.Addr() != addr && l.Addr() != ":"+addr {
+			continue
+		}
+		if l.Drain() {
+			st := l.Status()
+			log.Printf("ingress: draining listener %s, %d connections left", st.Addr, st.Connections)
+			s.events.Record(EventDrain, "", netip.AddrPort{}, st.Addr)
+		}
+		return l.Status(), nil
+	}
+	return ListenerStatus{}, fmt.Errorf("%w: %s", ErrUnknownListener, addr)
 }
 
 // handleConn is called in its own goroutine for every accepted connection.
 // It performs the obfuscated2 handshake and then pumps decrypted packets to
-// the dataplane handler, writing responses back to the client.
-func (s *ClientIngressServer) handleConn(conn net.Conn) {
+// the dataplane handler, writing responses back to the client. handshakes,
+// if non-nil, receives the time from accept to the completed handshake.
+func (s *ClientIngressServer) handleConn(conn net.Conn, handshakes *HandshakeLatency) {
+	accepted := time.Now()
+	defer s.crash.Recover()
 	defer conn.Close()
 
 	// Track connection for graceful shutdown.
@@ -83,99 +539,460 @@ func (s *ClientIngressServer) handleConn(conn net.Conn) {
 		return
 	}
 
-	log.Printf("ingress: new connection from %s:%d", clientIP, clientPort)
+	defer s.ipLimits.Release(eventAddr(clientIP, clientPort).Addr())
+
+	// The address the client reached us at is advertised to the DC; an
+	// unusual LocalAddr (e.g. in tests) leaves it unknown.
+	localIP, localPort, _ := parseRemoteAddr(conn.LocalAddr())
+
+	if s.stats != nil {
+		s.stats.ObserveClientFamily(clientIP)
+		if localIP != nil {
+			s.stats.ObserveLocalAddr(localIP, natTranslate(s.natInfo, localIP))
+		}
+	}
+
+	connID := newConnID()
+	log.Printf("ingress: conn=%s new connection from %s:%d", connID, clientIP, clientPort)
+	evAddr := eventAddr(clientIP, clientPort)
+	s.events.Record(EventConnOpen, connID, evAddr, "")
+	closeReason := CloseEOF
+	defer func() { s.events.Record(EventConnClose, connID, evAddr, closeReason) }()
 
-	// Step 1: read the 64-byte obfuscated2 header (with timeout).
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// Step 1: read the 64-byte obfuscated2 header (with timeout). When the
+	// idle timer expires it unblocks the pending read with a past deadline.
+	idle := sharedTimerWheel().Watch(s.surge.HeaderTimeout(clientHeaderTimeout), func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer idle.Stop()
 
+	// The first four bytes tell a plain HTTP GET from an obfuscated2 header
+	// or a TLS record.
 	var raw [64]byte
-	if _, err := readExact(conn, raw[:]); err != nil {
-		log.Printf("ingress: read header from %s:%d: %v", clientIP, clientPort, err)
+	n, err := readExact(conn, raw[:len(httpGetPrefix)])
+	if err == nil && s.serveStats != nil && string(raw[:n]) == httpGetPrefix && prefixesContain(s.statsNets, evAddr.Addr()) {
+		idle.Stop()
+		conn.SetReadDeadline(time.Time{})
+		closeReason = CloseHTTPStats
+		s.serveStats(conn, raw[:n])
+		return
+	}
+	if err == nil && s.tls == nil && s.decoyAddr != "" && isDecoyPrefix(raw[:n]) {
+		log.Printf("ingress: conn=%s %s:%d is not a client (first bytes %q), handing over to %s", connID, clientIP, clientPort, raw[:n], s.decoyAddr)
+		closeReason = CloseDecoy
+		if s.stats != nil {
+			s.stats.IncFirstBytes(classifyFirstBytes(raw[:n], false))
+		}
+		if s.toDecoy(conn, connID, s.decoyAddr, raw[:n], idle) && s.stats != nil {
+			s.stats.IncDecoyRelayed()
+		}
 		return
 	}
+	if err == nil {
+		var m int
+		m, err = readExact(conn, raw[n:])
+		n += m
+	}
+	if err != nil {
+		log.Printf("ingress: conn=%s read header from %s:%d: %v", connID, clientIP, clientPort, err)
+		closeReason = readCloseReason(err)
+		if n > 0 && s.stats != nil {
+			s.stats.IncFirstBytes(classifyFirstBytes(raw[:n], false))
+		}
+		return
+	}
+
+	matcher := s.secrets.Load()
+	secrets := matcher.secrets
+
+	// With fake TLS the obfuscated2 header arrives in the first application
+	// data record, after the TLS handshake. Clients that fail the check get
+	// the real site; they are not struck in the blocklist, since a site that
+	// bans visitors would give the proxy away.
+	if s.tls != nil {
+		if s.stats != nil {
+			s.stats.IncFirstBytes(classifyFirstBytes(raw[:], false))
+		}
+		tconn, consumed, err := s.acceptFakeTLS(conn, raw[:], secrets)
+		var tlsErr *FakeTLSError
+		switch {
+		case errors.As(err, &tlsErr):
+			addr := s.decoyAddr
+			if addr == "" {
+				addr = net.JoinHostPort(s.tls.domains[0], "443")
+			}
+			log.Printf("ingress: conn=%s %v from %s:%d, handing over to %s", connID, err, clientIP, clientPort, addr)
+			closeReason = CloseFakeTLS
+			if s.stats != nil {
+				s.stats.IncFakeTLSRejected(tlsErr.Reason)
+			}
+			if s.toDecoy(conn, connID, addr, consumed, idle) && s.stats != nil {
+				s.stats.IncFakeTLSFallback()
+			}
+			return
+		case err != nil:
+			log.Printf("ingress: conn=%s fake tls handshake with %s:%d: %v", connID, clientIP, clientPort, err)
+			closeReason = readCloseReason(err)
+			return
+		}
+		if s.stats != nil {
+			s.stats.IncFakeTLSHandshake()
+		}
+		conn = tconn
+		if _, err := readExact(conn, raw[:]); err != nil {
+			log.Printf("ingress: conn=%s read header from %s:%d: %v", connID, clientIP, clientPort, err)
+			closeReason = readCloseReason(err)
+			return
+		}
+	}
 
 	// Step 2: try each secret until one yields a valid magic.
 	var (
 		hdr      Obfuscated2Header
 		decState *AESStreamState
 		encState *AESStreamState
+		matched  []byte
 	)
 
 	found := false
-	for _, secret := range s.secrets {
-		h, dec, enc, err2 := ParseObfuscated2Header(raw, secret)
-		if err2 != nil {
-			continue // wrong secret or bad magic
-		}
-		hdr = h
-		decState = dec
-		encState = enc
-		found = true
-		break
+	// secretID keys the per-secret stats of the connection for its whole
+	// life; an index would point at another secret after a reload.
+	secretID := ""
+	if matchedIdx := matcher.match(&raw); matchedIdx >= 0 {
+		secretID = matcher.ids[matchedIdx]
+		h, dec, enc, err2 := ParseObfuscated2Header(raw, secrets[matchedIdx])
+		if err2 == nil {
+			hdr = h
+			decState = dec
+			encState = enc
+			matched = secrets[matchedIdx]
+			found = true
+		} else {
+			s.countSecretFailure(secretID)
+		}
 	}
 
 	// If secrets list is empty, try without secret (legacy / no-secret mode).
-	if !found && len(s.secrets) == 0 {
+	if !found && len(secrets) == 0 {
 		hdr, decState, encState, err = ParseObfuscated2Header(raw, nil)
 		if err != nil {
+			closeReason = CloseBadHeader
 			return
 		}
 		found = true
 	}
 
+	firstBytes := classifyFirstBytes(raw[:], found)
+	if s.stats != nil && s.tls == nil {
+		s.stats.IncFirstBytes(firstBytes)
+	}
+
+	if !found && s.decoyAddr != "" && s.tls == nil {
+		// Like fake TLS clients that fail the check, these are not struck
+		// in the blocklist: a site that bans visitors gives the proxy away.
+		log.Printf("ingress: conn=%s no valid secret for %s:%d (first bytes: %s), handing over to %s", connID, clientIP, clientPort, firstBytes, s.decoyAddr)
+		closeReason = CloseDecoy
+		if s.toDecoy(conn, connID, s.decoyAddr, raw[:], idle) && s.stats != nil {
+			s.stats.IncDecoyRelayed()
+		}
+		return
+	}
 	if !found {
-		log.Printf("ingress: no valid secret for %s:%d", clientIP, clientPort)
+		log.Printf("ingress: conn=%s no valid secret for %s:%d (first bytes: %s)", connID, clientIP, clientPort, firstBytes)
+		if s.blocklist != nil {
+			s.blocklist.Strike(clientIP, time.Now())
+		}
+		closeReason = CloseNoSecret
 		return
 	}
 
-	log.Printf("ingress: handshake OK from %s:%d, transport=%d, targetDC=%d", clientIP, clientPort, hdr.Transport, hdr.TargetDC)
+	if s.secretAllowed != nil && matched != nil && !s.secretAllowed(matched, time.Now()) {
+		log.Printf("ingress: conn=%s secret %s used by %s:%d is outside its validity window", connID, secretFingerprint(matched), clientIP, clientPort)
+		if s.stats != nil {
+			s.stats.IncSecretWindowRejected()
+		}
+		s.countSecretFailure(secretID)
+		closeReason = CloseSecretWindow
+		return
+	}
 
-	// Generate unique ext_conn_id for this client session.
+	if s.authz != nil {
+		allowed, err := s.authz.Authorize(clientIP, secretFingerprint(matched))
+		if err != nil {
+			log.Printf("ingress: conn=%s authorizer for %s:%d: %v (fail-open=%v)", connID, clientIP, clientPort, err, s.authz.FailOpen)
+			if s.stats != nil {
+				s.stats.IncAuthorizerError()
+			}
+		}
+		if !allowed {
+			log.Printf("ingress: conn=%s connection from %s:%d denied by authorizer", connID, clientIP, clientPort)
+			if s.stats != nil {
+				s.stats.IncAuthorizerDenied()
+			}
+			s.countSecretFailure(secretID)
+			closeReason = CloseDenied
+			return
+		}
+	}
+
+	shedSess, ok := s.shedder.AdmitSession(func() { conn.Close() })
+	if !ok {
+		log.Printf("ingress: conn=%s overloaded, dropping handshake from %s:%d", connID, clientIP, clientPort)
+		s.countSecretFailure(secretID)
+		closeReason = CloseOverload
+		return
+	}
+	defer shedSess.Leave()
+
+	// Generate unique ext_conn_id for this client session. It is logged so
+	// outbound messages keyed by ext_conn_id can be tied to the connection.
 	extConnID := nextExtConnID()
 
+	handshakes.Observe(time.Since(accepted))
+	log.Printf("ingress: conn=%s handshake OK from %s:%d, transport=%s, targetDC=%d, ext_conn_id=%d", connID, clientIP, clientPort, hdr.Transport, hdr.TargetDC, extConnID)
+
+	// Per-secret accounting; legacy no-secret connections have no secret.
+	var traffic *secretTraffic
+	if s.stats != nil && secretID != "" {
+		traffic = s.stats.secretTrafficFor(secretID)
+		traffic.connections.Add(1)
+		s.stats.IncSecretConnections(secretID)
+		defer s.stats.DecSecretConnections(secretID)
+	}
+
+	var info *ConnInfo
+	if s.conns != nil {
+		info = &ConnInfo{
+			ID:        connID,
+			Addr:      evAddr,
+			Opened:    time.Now(),
+			Transport: hdr.Transport,
+			FakeTLS:   s.tls != nil,
+			Secret:    secretFingerprint(matched),
+			TargetDC:  hdr.TargetDC,
+			ExtConnID: extConnID,
+			closeConn: func() { conn.Close() },
+		}
+		s.conns.Add(info)
+		defer s.conns.Remove(info)
+	}
+
 	// Step 3: read MTProto packets in a loop and forward to dataplane.
+	// The reader reuses one buffer per connection; HandlePacket copies the
+	// payload into the RPC request before the next read overwrites it.
+	reader := NewPacketReader(conn, decState, hdr.Transport)
+	if s.limits != nil {
+		reader.SetLimits(*s.limits)
+	}
+	writer := newClientWriter(conn, encState, hdr.Transport, s.writeQueue, s.writeDelay, s.buffers)
+	defer writer.Close()
+	// frameNo numbers the frames forwarded to the dataplane, readNo every
+	// frame read (for --trace-conn).
+	var frameNo, readNo int64
+	idle.Reset(clientIdleTimeout)
 	for {
-		// Set read deadline for each packet (idle timeout).
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		// Only frames from the client count as activity, so the timer may
+		// fire while the proxy itself is busy with the last frame (a slow
+		// backend) and leave a past read deadline behind. The client is
+		// not idle then: clear the deadline and re-arm the timer.
+		if idle.Restart() {
+			conn.SetReadDeadline(time.Time{})
+		}
 
-		payload, err := ReadPacket(conn, decState, hdr.Transport)
+		info.SetState(ConnReading)
+		payload, err := reader.ReadPacket()
 		if err != nil {
-			log.Printf("ingress: read packet from %s:%d: %v", clientIP, clientPort, err)
+			log.Printf("ingress: conn=%s read packet from %s:%d: %v", connID, clientIP, clientPort, err)
+			closeReason = readCloseReason(err)
+			if info.Revoked() {
+				closeReason = CloseSecretRevoked
+			}
+			if shedSess.Shed() {
+				closeReason = CloseOverload
+			}
+			var tooLarge *FrameTooLargeError
+			if errors.As(err, &tooLarge) {
+				closeReason = CloseFrameTooLarge
+				if s.stats != nil {
+					s.stats.IncFrameRejected(tooLarge.Kind)
+				}
+			}
 			return
 		}
+		idle.Touch()
+		// The sample starts once the frame is in: the time the client took
+		// to send it is not proxy latency.
+		trace := s.sampler.Begin()
+		readNo++
+		traffic.add(len(payload), 0)
+		info.AddTraffic(len(payload), 0)
+		if s.answerPings && isTransportPing(payload) {
+			info.traceFrame("<-", readNo, payload, "ping")
+			if s.stats != nil {
+				s.stats.IncPingAnswered()
+			}
+			pong := transportPong(payload)
+			if err := writer.Send(pong); err != nil {
+				log.Printf("ingress: conn=%s write pong to %s:%d: %v", connID, clientIP, clientPort, err)
+				closeReason = CloseWriteError
+				return
+			}
+			traffic.add(0, len(pong))
+			info.AddTraffic(0, len(pong))
+			info.traceFrame("->", readNo, pong, "pong")
+			continue
+		}
+		if s.dedup.Seen(payload) {
+			info.traceFrame("<-", readNo, payload, "repeat, dropped")
+			if s.stats != nil {
+				s.stats.IncFrameDeduplicated()
+			}
+			if s.verbosity >= frameLogVerbosity {
+				log.Printf("ingress: conn=%s dropped repeated %d-byte frame from %s:%d", connID, len(payload), clientIP, clientPort)
+			}
+			continue
+		}
+		if trace != nil {
+			trace.Read = time.Since(trace.Start)
+			trace.TargetDC = hdr.TargetDC
+		}
+		info.traceFrame("<-", readNo, payload, "")
 
+		frameNo++
 		pkt := IncomingPacket{
+			ConnID:     connID,
 			Data:       payload,
 			ClientIP:   clientIP,
 			ClientPort: clientPort,
 			TargetDC:   hdr.TargetDC,
 			ExtConnID:  extConnID,
+			LocalIP:    localIP,
+			LocalPort:  localPort,
+			Trace:      trace,
+			Conn:       info,
 		}
+		if s.verbosity >= frameLogVerbosity || info.Traced() {
+			pkt.FrameID = fmt.Sprintf("%s/%d", connID, frameNo)
+		}
+
+		if !s.shedder.AdmitFrame() {
+			log.Printf("ingress: conn=%s overloaded, closing %s:%d", connID, clientIP, clientPort)
+			closeReason = CloseOverload
+			return
+		}
+		shedSess.Active()
 
+		info.SetState(ConnBackend)
 		resp, err := s.dataplane.HandlePacket(pkt)
 		if err != nil {
-			log.Printf("ingress: dataplane error for %s:%d: %v", clientIP, clientPort, err)
+			log.Printf("ingress: conn=%s dataplane error for %s:%d: %v", connID, clientIP, clientPort, err)
+			closeReason = CloseDataplane
 			return
 		}
 
-		// Write response back to client (encrypted with obfuscated2 encState).
+		// Queue response for the client (encrypted with obfuscated2 encState
+		// by the connection's writer goroutine).
 		if len(resp) > 0 {
-			conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
-			if err := WritePacket(conn, resp, encState, hdr.Transport); err != nil {
-				log.Printf("ingress: write response to %s:%d: %v", clientIP, clientPort, err)
+			info.SetState(ConnWriting)
+			info.traceFrame("->", readNo, resp, "")
+			send := writer.Send
+			if s.shedder.FastClose() {
+				send = writer.TrySend
+			}
+			if err := send(resp); err != nil {
+				closeReason = CloseWriteError
+				if errors.Is(err, errClientQueueFull) {
+					s.shedder.ShedFrame()
+					closeReason = CloseOverload
+				}
+				log.Printf("ingress: conn=%s write response to %s:%d: %v", connID, clientIP, clientPort, err)
 				return
 			}
+			traffic.add(0, len(resp))
+			info.AddTraffic(0, len(resp))
 		}
+		s.sampler.Record(trace)
+	}
+}
+
+// countSecretFailure records a connection refused after it matched the
+// secret with fingerprint id ("" when none matched).
+func (s *ClientIngressServer) countSecretFailure(id string) {
+	if s.stats != nil && id != "" {
+		s.stats.IncSecretHandshakeFailure(id)
+	}
+}
+
+// readCloseReason maps a client read error to a conn_close reason.
+func readCloseReason(err error) string {
+	if errors.Is(err, io.EOF) {
+		return CloseEOF
 	}
+	return CloseReadError
 }
 
-// parseRemoteAddr extracts IP and port from a net.Addr (typically *net.TCPAddr).
+// acceptFakeTLS reads the rest of the ClientHello whose first bytes are
+// head, checks it against secrets and answers with the ServerHello. It
+// returns conn wrapped to carry TLS records. A failed check is a
+// *FakeTLSError, returned with every byte read from the client so far.
+func (s *ClientIngressServer) acceptFakeTLS(conn net.Conn, head []byte, secrets [][]byte) (net.Conn, []byte, error) {
+	size := clientHelloLen(head)
+	if size == 0 {
+		return nil, head, fakeTLSErrorf(FakeTLSNotTLS, "first bytes are not a ClientHello")
+	}
+	if size < len(head) || size > tlsMaxClientHello {
+		return nil, head, fakeTLSErrorf(FakeTLSBadHello, "ClientHello of %d bytes", size)
+	}
+	hello := make([]byte, size)
+	copy(hello, head)
+	if n, err := readExact(conn, hello[len(head):]); err != nil {
+		return nil, hello[:len(head)+n], err
+	}
+
+	_, serverHello, err := s.tls.handshake(bytes.Clone(hello), secrets, time.Now())
+	if err != nil {
+		return nil, hello, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	if _, err := conn.Write(serverHello); err != nil {
+		return nil, nil, err
+	}
+	return newFakeTLSConn(conn), nil, nil
+}
+
+// Kinds of first bytes seen on accepted connections, counted by
+// Stats.IncFirstBytes.
+const (
+	FirstBytesTLS     = "tls"     // TLS ClientHello record (a faketls client or a scanner)
+	FirstBytesMTProto = "mtproto" // obfuscated2 header valid for a secret
+	FirstBytesOther   = "other"
+)
+
+// classifyFirstBytes classifies the first bytes a client sent. validHeader
+// reports whether they parsed as an obfuscated2 header for a known secret.
+func classifyFirstBytes(b []byte, validHeader bool) string {
+	// TLS record: type 0x16 (handshake), version 0x03xx, then a 2-byte
+	// length and handshake type 0x01 (ClientHello).
+	if len(b) >= 3 && b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x04 &&
+		(len(b) < 6 || b[5] == 0x01) {
+		return FirstBytesTLS
+	}
+	if validHeader {
+		return FirstBytesMTProto
+	}
+	return FirstBytesOther
+}
+
+// parseRemoteAddr extracts IP and port from a net.Addr (*net.TCPAddr, or
+// *net.UDPAddr for UDP sessions).
 func parseRemoteAddr(addr net.Addr) (net.IP, int, error) {
-	tcp, ok := addr.(*net.TCPAddr)
-	if !ok {
-		return nil, 0, fmt.Errorf("unexpected remote addr type %T", addr)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, nil
+	case *net.UDPAddr:
+		return a.IP, a.Port, nil
 	}
-	return tcp.IP, tcp.Port, nil
+	return nil, 0, fmt.Errorf("unexpected remote addr type %T", addr)
 }
 
 // readExact reads exactly len(buf) bytes from conn.
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassifyFirstBytes(t *testing.T) {
+	clientHello := []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc}
+	tests := []struct {
+		name  string
+		b     []byte
+		valid bool
+		want  string
+	}{
+		{"client hello", clientHello, false, FirstBytesTLS},
+		{"short tls prefix", clientHello[:3], false, FirstBytesTLS},
+		{"tls alert", []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02}, false, FirstBytesOther},
+		{"tls server hello", []byte{0x16, 0x03, 0x03, 0x00, 0x40, 0x02}, false, FirstBytesOther},
+		{"valid header", []byte{0xef, 0x12, 0x34}, true, FirstBytesMTProto},
+		{"http", []byte("GET / HTTP/1.1\r\n"), false, FirstBytesOther},
+	}
+	for _, tt := range tests {
+		if got := classifyFirstBytes(tt.b, tt.valid); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransportPing(t *testing.T) {
+	ping := []byte{0xdf, 0xa2, 0x30, 0x57, 1, 2, 3, 4, 5, 6, 7, 8}
+	if !isTransportPing(ping) {
+		t.Fatal("RPC_PING frame not detected")
+	}
+	if isTransportPing(append(ping, 0, 0, 0, 0)) {
+		t.Error("longer frame detected as ping")
+	}
+	if isTransportPing(make([]byte, transportPingLen)) {
+		t.Error("zero frame detected as ping")
+	}
+
+	pong := transportPong(ping)
+	want := []byte{0xa7, 0xea, 0x30, 0x84, 1, 2, 3, 4, 5, 6, 7, 8}
+	if !bytes.Equal(pong, want) {
+		t.Errorf("pong = %x, want %x", pong, want)
+	}
+}
+
+// TestSecretHandshakeFailure checks that a connection refused after its
+// secret matched is counted against that secret.
+func TestSecretHandshakeFailure(t *testing.T) {
+	secrets := [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)}
+	stats := NewStats()
+	stats.SetSecrets(secrets)
+	s := NewClientIngressServer("127.0.0.1:0", secrets, nil, nil)
+	s.SetStats(stats)
+	s.SetSecretWindowCheck(func(secret []byte, now time.Time) bool { return false })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			s.handleConn(conn, nil)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw := buildRawHeader(t, secrets[1], TransportMagicIntermediate, 2)
+	if _, err := conn.Write(raw[:]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConn did not return")
+	}
+
+	snap := stats.Snapshot(len(secrets))
+	if snap["secret_2_handshake_failures"] != 1 || snap["secret_1_handshake_failures"] != 0 {
+		t.Errorf("handshake failures: secret_1=%d secret_2=%d, want 0 and 1",
+			snap["secret_1_handshake_failures"], snap["secret_2_handshake_failures"])
+	}
+	if snap["secret_2_connections"] != 0 {
+		t.Errorf("secret_2_connections = %d, want 0", snap["secret_2_connections"])
+	}
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"encoding/binary"
+
+	"github.com/skrashevich/MTProxy/internal/protocol"
+)
+
+// transportPingLen is the size of a client transport ping: RPC_PING
+// followed by an 8-byte ping_id. No MTProto message is this short (an
+// unencrypted one carries at least auth_key_id, msg_id and length), so the
+// frame cannot be mistaken for client traffic.
+const transportPingLen = 12
+
+// isTransportPing reports whether a client frame is a transport-level ping
+// that the ingress can answer without a backend round trip.
+func isTransportPing(frame []byte) bool {
+	return len(frame) == transportPingLen &&
+		binary.LittleEndian.Uint32(frame) == protocol.RPCPing
+}
+
+// transportPong builds the RPC_PONG answer to ping, echoing its ping_id.
+func transportPong(ping []byte) []byte {
+	pong := make([]byte, transportPingLen)
+	binary.LittleEndian.PutUint32(pong, protocol.RPCPong)
+	copy(pong[4:], ping[4:transportPingLen])
+	return pong
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+
+	"github.com/skrashevich/MTProxy/internal/protocol"
 )
 
 // Transport magic bytes — from net-tcp-rpc-ext-server.c, tag values after decryption.
@@ -22,6 +24,18 @@ const (
 	TransportPadded                            // 4-byte LE length prefix, trailing pad allowed
 )
 
+func (t TransportType) String() string {
+	switch t {
+	case TransportAbridged:
+		return "abridged"
+	case TransportIntermediate:
+		return "intermediate"
+	case TransportPadded:
+		return "padded"
+	}
+	return "unknown"
+}
+
 // Obfuscated2Header is the parsed result of the 64-byte obfuscated2 handshake.
 //
 // Wire layout (C source net-tcp-rpc-ext-server.c, tcp_rpcs_compact_parse_execute):
@@ -55,12 +69,15 @@ func ParseObfuscated2Header(raw [64]byte, secret []byte) (
 ) {
 	// --- derive read (client→proxy) key/iv ---
 	// key = sha256(header[8:40] || secret[0:16])   (C: memcpy(k, header+8, 32); memcpy(k+32, secret, 16); sha256(k, 48, key))
-	var kBuf [48]byte
-	copy(kBuf[0:32], raw[8:40])
-	if len(secret) >= 16 {
-		copy(kBuf[32:48], secret[0:16])
+	// Without a secret (no -S) C uses header[8:40] as the key itself.
+	var readKey [32]byte
+	copy(readKey[:], raw[8:40])
+	if len(secret) > 0 {
+		var kBuf [48]byte
+		copy(kBuf[0:32], raw[8:40])
+		copy(kBuf[32:48], secret)
+		readKey = sha256Raw(kBuf[:])
 	}
-	readKey := sha256Raw(kBuf[:])
 	var readIV [16]byte
 	copy(readIV[:], raw[40:56])
 
@@ -75,12 +92,13 @@ func ParseObfuscated2Header(raw [64]byte, secret []byte) (
 		writeIV[i] = raw[23-i]
 	}
 	// if secret present: writeKey = sha256(writeKeyRaw || secret[0:16])
-	var writeBuf [48]byte
-	copy(writeBuf[0:32], writeKeyRaw[:])
-	if len(secret) >= 16 {
-		copy(writeBuf[32:48], secret[0:16])
+	writeKey := writeKeyRaw
+	if len(secret) > 0 {
+		var writeBuf [48]byte
+		copy(writeBuf[0:32], writeKeyRaw[:])
+		copy(writeBuf[32:48], secret)
+		writeKey = sha256Raw(writeBuf[:])
 	}
-	writeKey := sha256Raw(writeBuf[:])
 
 	// --- decrypt the raw header to check magic ---
 	decCipher, err := newAESCTRStream(readKey, readIV)
@@ -107,12 +125,14 @@ func ParseObfuscated2Header(raw [64]byte, secret []byte) (
 	hdr.TargetDC = int16(binary.LittleEndian.Uint16(decrypted[60:62]))
 
 	// Build ongoing stream states.
-	// Decrypt stream: already positioned at byte 64 (after header).
+	// Decrypt stream: already positioned at byte 64 (after header). The
+	// encrypt stream starts at 0: nothing has been sent to the client yet
+	// (C encrypts c->out with a fresh write_aeskey).
 	decStream, err := newAESCTRStreamAt(readKey, readIV, 64)
 	if err != nil {
 		return hdr, nil, nil, fmt.Errorf("obfuscated2: init decStream: %w", err)
 	}
-	encStream, err := newAESCTRStreamAt(writeKey, writeIV, 64)
+	encStream, err := newAESCTRStream(writeKey, writeIV)
 	if err != nil {
 		return hdr, nil, nil, fmt.Errorf("obfuscated2: init encStream: %w", err)
 	}
@@ -123,25 +143,120 @@ func ParseObfuscated2Header(raw [64]byte, secret []byte) (
 }
 
 // ReadPacket reads one MTProto packet from r, decrypting with dec if non-nil.
-// Returns the plaintext payload (without length prefix).
+// Returns the plaintext payload (without length prefix) in a freshly
+// allocated slice. Long-lived connections should use PacketReader instead.
 func ReadPacket(r io.Reader, dec *AESStreamState, transport TransportType) ([]byte, error) {
-	switch transport {
+	return NewPacketReader(r, dec, transport).ReadPacket()
+}
+
+// maxRetainedReadBuffer is the largest read buffer a PacketReader keeps
+// between packets; a bigger one, grown for an unusually large packet, is
+// dropped on the next read so idle connections do not pin megabytes.
+const maxRetainedReadBuffer = 64 * 1024
+
+// PacketReader reads MTProto packets from one client connection into a
+// reusable per-connection buffer, so a busy connection does not allocate
+// for every length prefix and payload.
+type PacketReader struct {
+	r         io.Reader
+	dec       *AESStreamState
+	transport TransportType
+	hdr       [4]byte // length prefix scratch space
+	keyID     [8]byte // auth_key_id scratch space for limit checks
+	buf       []byte  // payload buffer, reused across packets
+
+	// limits, if set, caps frames by kind; sawEncrypted ends the
+	// pre-handshake phase.
+	limits       *FrameLimits
+	sawEncrypted bool
+}
+
+// NewPacketReader creates a PacketReader over r using the given transport,
+// decrypting with dec if non-nil.
+func NewPacketReader(r io.Reader, dec *AESStreamState, transport TransportType) *PacketReader {
+	return &PacketReader{r: r, dec: dec, transport: transport}
+}
+
+// SetLimits enforces per-kind frame size limits; zero fields take their
+// value from DefaultFrameLimits.
+func (p *PacketReader) SetLimits(l FrameLimits) {
+	l = l.withDefaults()
+	p.limits = &l
+}
+
+// ReadPacket reads the next packet. The returned slice aliases the reader's
+// internal buffer and is only valid until the next call to ReadPacket;
+// callers that keep the payload must copy it.
+func (p *PacketReader) ReadPacket() ([]byte, error) {
+	switch p.transport {
 	case TransportAbridged:
-		return readAbridged(r, dec)
+		return p.readAbridged()
 	case TransportIntermediate, TransportPadded:
-		return readIntermediate(r, dec, transport == TransportPadded)
+		return p.readIntermediate(p.transport == TransportPadded)
 	default:
-		return nil, fmt.Errorf("ReadPacket: unknown transport %d", transport)
+		return nil, fmt.Errorf("ReadPacket: unknown transport %d", p.transport)
+	}
+}
+
+// readBody reads a frame body of length bytes. With limits set, the frame
+// is checked against the pre-handshake cap and, once its auth_key_id has been
+// read, against the cap for its kind — before the full buffer is allocated.
+func (p *PacketReader) readBody(length int) ([]byte, error) {
+	if p.limits == nil || length < 8 {
+		buf := p.payload(length)
+		if err := transportReadFull(p.r, p.dec, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	if !p.sawEncrypted && length > p.limits.PreHandshake {
+		return nil, &FrameTooLargeError{Kind: FrameKindPreHandshake, Size: length, Limit: p.limits.PreHandshake}
 	}
+
+	if err := transportReadFull(p.r, p.dec, p.keyID[:]); err != nil {
+		return nil, err
+	}
+	kind := protocol.PacketUnencrypted
+	limit := p.limits.Unencrypted
+	if protocol.IsEncrypted(p.keyID[:]) {
+		kind = protocol.PacketEncrypted
+		limit = p.limits.Encrypted
+	}
+	if length > limit {
+		return nil, &FrameTooLargeError{Kind: frameKindName(kind), Size: length, Limit: limit}
+	}
+
+	buf := p.payload(length)
+	copy(buf, p.keyID[:])
+	if err := transportReadFull(p.r, p.dec, buf[8:]); err != nil {
+		return nil, err
+	}
+	if kind == protocol.PacketEncrypted && !isTransportPing(buf) {
+		p.sawEncrypted = true
+	}
+	return buf, nil
+}
+
+// payload returns the reusable buffer resized to n bytes.
+func (p *PacketReader) payload(n int) []byte {
+	if cap(p.buf) < n || (cap(p.buf) > maxRetainedReadBuffer && n <= maxRetainedReadBuffer) {
+		p.buf = make([]byte, n, max(n, 4096))
+	}
+	return p.buf[:n]
 }
 
 // WritePacket writes one MTProto packet to w, encrypting with enc if non-nil.
 func WritePacket(w io.Writer, data []byte, enc *AESStreamState, transport TransportType) error {
+	return writePacket(w, data, enc, transport, nil)
+}
+
+// writePacket is WritePacket that encrypts into buffers from bufs.
+func writePacket(w io.Writer, data []byte, enc *AESStreamState, transport TransportType, bufs *BufferPool) error {
 	switch transport {
 	case TransportAbridged:
-		return writeAbridged(w, data, enc)
+		return writeAbridged(w, data, enc, bufs)
 	case TransportIntermediate, TransportPadded:
-		return writeIntermediate(w, data, enc, transport == TransportPadded)
+		return writeIntermediate(w, data, enc, transport == TransportPadded, bufs)
 	default:
 		return fmt.Errorf("WritePacket: unknown transport %d", transport)
 	}
@@ -149,31 +264,25 @@ func WritePacket(w io.Writer, data []byte, enc *AESStreamState, transport Transp
 
 // --- Abridged transport ---
 
-func readAbridged(r io.Reader, dec *AESStreamState) ([]byte, error) {
-	var b [1]byte
-	if err := transportReadFull(r, dec, b[:]); err != nil {
+func (p *PacketReader) readAbridged() ([]byte, error) {
+	if err := transportReadFull(p.r, p.dec, p.hdr[:1]); err != nil {
 		return nil, err
 	}
-	length := int(b[0])
+	length := int(p.hdr[0])
 	if length == 0x7f {
-		var lb [3]byte
-		if err := transportReadFull(r, dec, lb[:]); err != nil {
+		if err := transportReadFull(p.r, p.dec, p.hdr[:3]); err != nil {
 			return nil, err
 		}
-		length = int(lb[0]) | int(lb[1])<<8 | int(lb[2])<<16
+		length = int(p.hdr[0]) | int(p.hdr[1])<<8 | int(p.hdr[2])<<16
 	}
 	length *= 4
 	if length <= 0 || length > maxPacketSize {
 		return nil, fmt.Errorf("abridged: invalid length %d", length)
 	}
-	buf := make([]byte, length)
-	if err := transportReadFull(r, dec, buf); err != nil {
-		return nil, err
-	}
-	return buf, nil
+	return p.readBody(length)
 }
 
-func writeAbridged(w io.Writer, data []byte, enc *AESStreamState) error {
+func writeAbridged(w io.Writer, data []byte, enc *AESStreamState, bufs *BufferPool) error {
 	n := len(data)
 	if n%4 != 0 {
 		return fmt.Errorf("writeAbridged: data length %d not multiple of 4", n)
@@ -190,38 +299,35 @@ func writeAbridged(w io.Writer, data []byte, enc *AESStreamState) error {
 			byte(words >> 16),
 		}
 	}
-	return transportWriteFull(w, enc, header, data)
+	return transportWriteFull(w, enc, bufs, header, data)
 }
 
 // --- Intermediate / Padded transport ---
 
-func readIntermediate(r io.Reader, dec *AESStreamState, padded bool) ([]byte, error) {
-	var lb [4]byte
-	if err := transportReadFull(r, dec, lb[:]); err != nil {
+func (p *PacketReader) readIntermediate(padded bool) ([]byte, error) {
+	if err := transportReadFull(p.r, p.dec, p.hdr[:4]); err != nil {
 		return nil, err
 	}
-	length := int(binary.LittleEndian.Uint32(lb[:]))
+	length := int(binary.LittleEndian.Uint32(p.hdr[:4]))
 	// strip quickack flag (top bit in C: RPC_F_QUICKACK = 0x8000000)
 	length &^= 0x80000000
-	if padded {
-		// padded: actual data is length rounded down to multiple of 4
-		length = length &^ 3
-	}
 	if length <= 0 || length > maxPacketSize {
 		return nil, fmt.Errorf("intermediate: invalid length %d", length)
 	}
-	buf := make([]byte, length)
-	if err := transportReadFull(r, dec, buf); err != nil {
-		return nil, err
+	body, err := p.readBody(length)
+	if err != nil || !padded {
+		return body, err
 	}
-	return buf, nil
+	// padded: the length counts the random tail; the data is the length
+	// rounded down to a multiple of 4 (C: rwm_trunc (&msg, packet_len & -4))
+	return body[:length&^3], nil
 }
 
-func writeIntermediate(w io.Writer, data []byte, enc *AESStreamState, padded bool) error {
+func writeIntermediate(w io.Writer, data []byte, enc *AESStreamState, padded bool, bufs *BufferPool) error {
 	n := len(data)
 	var lb [4]byte
 	binary.LittleEndian.PutUint32(lb[:], uint32(n))
-	return transportWriteFull(w, enc, lb[:], data)
+	return transportWriteFull(w, enc, bufs, lb[:], data)
 }
 
 // --- helpers ---
@@ -240,15 +346,21 @@ func transportReadFull(r io.Reader, dec *AESStreamState, buf []byte) error {
 }
 
 // transportWriteFull encrypts (if enc != nil) and writes parts to w.
-// Encrypts into a temporary buffer to avoid modifying the caller's data.
-func transportWriteFull(w io.Writer, enc *AESStreamState, parts ...[]byte) error {
+// Encrypts into a temporary buffer from bufs to avoid modifying the
+// caller's data.
+func transportWriteFull(w io.Writer, enc *AESStreamState, bufs *BufferPool, parts ...[]byte) error {
 	for _, p := range parts {
-		out := p
-		if enc != nil {
-			out = make([]byte, len(p))
-			enc.stream.XORKeyStream(out, p)
+		if enc == nil {
+			if _, err := w.Write(p); err != nil {
+				return err
+			}
+			continue
 		}
-		if _, err := w.Write(out); err != nil {
+		out := bufs.Get(len(p))
+		enc.stream.XORKeyStream(out, p)
+		_, err := w.Write(out)
+		bufs.Put(out)
+		if err != nil {
 			return err
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"testing"
 )
 
@@ -18,7 +19,7 @@ import (
 //  4. Encrypt raw[0:64] with AES-CTR(readKey, readIV) to produce ciphertext.
 //  5. But we want the plaintext at [56:60] to be the magic, so we work
 //     backwards: start from desired plaintext, encrypt it to get the wire form.
-func buildRawHeader(t *testing.T, secret []byte, transportMagic uint32, targetDC int16) [64]byte {
+func buildRawHeader(t testing.TB, secret []byte, transportMagic uint32, targetDC int16) [64]byte {
 	t.Helper()
 
 	// Choose deterministic "random" bytes for the nonce/key material areas.
@@ -90,12 +91,14 @@ func buildRawHeader(t *testing.T, secret []byte, transportMagic uint32, targetDC
 		raw[i] = byte(i + 0x10)
 	}
 
-	// Derive read key/iv from the fixed raw bytes.
+	// Derive read key/iv from the fixed raw bytes; without a secret the key
+	// material is the key itself.
 	copy(kBuf[0:32], raw[8:40])
+	copy(readKey[:], raw[8:40])
 	if len(secret) >= 16 {
 		copy(kBuf[32:48], secret[0:16])
+		readKey = sha256.Sum256(kBuf[:])
 	}
-	readKey = sha256.Sum256(kBuf[:])
 	copy(readIV[:], raw[40:56])
 
 	// Generate keystream for positions 0..63.
@@ -339,3 +342,90 @@ func TestCryptoHelpers_SHA256(t *testing.T) {
 		t.Errorf("sha256Raw mismatch: got %x want %x", got, want)
 	}
 }
+
+func TestPacketReader_ReusesBuffer(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xab}, 256)
+	var stream bytes.Buffer
+	for i := 0; i < 200; i++ {
+		if err := WritePacket(&stream, payload, nil, TransportAbridged); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pr := NewPacketReader(bytes.NewReader(stream.Bytes()), nil, TransportAbridged)
+	if _, err := pr.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		got, err := pr.ReadPacket()
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("ReadPacket: err=%v len=%d", err, len(got))
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("ReadPacket allocates %.1f times per packet, want 0", allocs)
+	}
+}
+
+func TestPacketReader_ShrinksLargeBuffer(t *testing.T) {
+	var stream bytes.Buffer
+	WritePacket(&stream, make([]byte, 2*maxRetainedReadBuffer), nil, TransportIntermediate)
+	WritePacket(&stream, make([]byte, 64), nil, TransportIntermediate)
+
+	pr := NewPacketReader(&stream, nil, TransportIntermediate)
+	if _, err := pr.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if cap(pr.buf) > maxRetainedReadBuffer {
+		t.Errorf("buffer capacity %d retained after small packet, want <= %d", cap(pr.buf), maxRetainedReadBuffer)
+	}
+}
+
+func TestPacketReader_FrameLimits(t *testing.T) {
+	frame := func(authKeyID uint64, size int) []byte {
+		b := make([]byte, size)
+		binary.LittleEndian.PutUint64(b, authKeyID)
+		return b
+	}
+	limits := FrameLimits{PreHandshake: 1024, Unencrypted: 128, Encrypted: 4096}
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		kind   string // expected rejection kind of the last frame; "" = accepted
+	}{
+		{"small dh", [][]byte{frame(0, 64)}, ""},
+		{"large dh", [][]byte{frame(0, 256)}, FrameKindUnencrypted},
+		{"large first frame", [][]byte{frame(1, 2048)}, FrameKindPreHandshake},
+		{"large after encrypted", [][]byte{frame(1, 64), frame(1, 2048)}, ""},
+		{"over encrypted cap", [][]byte{frame(1, 64), frame(1, 8192)}, FrameKindEncrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			for _, f := range tt.frames {
+				WritePacket(&stream, f, nil, TransportIntermediate)
+			}
+			pr := NewPacketReader(&stream, nil, TransportIntermediate)
+			pr.SetLimits(limits)
+			var err error
+			for range tt.frames {
+				if _, err = pr.ReadPacket(); err != nil {
+					break
+				}
+			}
+			var tooLarge *FrameTooLargeError
+			switch {
+			case tt.kind == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.kind != "" && !errors.As(err, &tooLarge):
+				t.Fatalf("expected FrameTooLargeError, got %v", err)
+			case tt.kind != "" && tooLarge.Kind != tt.kind:
+				t.Errorf("kind = %s, want %s", tooLarge.Kind, tt.kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// clientWriteQueueDepth is the number of frames that may wait for the
+	// writer goroutine before Send blocks the producer.
+	clientWriteQueueDepth = 64
+
+	// clientWriteTimeout bounds writing a single frame to the client.
+	clientWriteTimeout = 30 * time.Second
+)
+
+// errClientWriterClosed is returned by Send after the writer has stopped.
+var errClientWriterClosed = errors.New("client writer closed")
+
+// errClientQueueFull is returned by TrySend when the queue has no room.
+var errClientQueueFull = errors.New("client write queue full")
+
+// clientWriter serialises all writes to one client connection through a
+// queue drained by a single goroutine. Several goroutines may call Send
+// concurrently: every frame is encrypted and written as a unit, and frames
+// reach the client in the order they were queued. This matters because the
+// obfuscated2 encryption stream is stateful — interleaved writers would
+// corrupt it.
+type clientWriter struct {
+	conn      net.Conn
+	enc       *AESStreamState
+	transport TransportType
+
+	queue chan queuedFrame
+	qs    *QueueStats // optional; shared by all client writers
+	delay *WriteDelay // optional; artificial latency per frame
+	bufs  *BufferPool // optional; encryption buffers
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	mu  sync.Mutex
+	err error // first write error; the writer stops after it
+}
+
+// queuedFrame is a frame waiting in a clientWriter queue.
+type queuedFrame struct {
+	data   []byte
+	queued time.Time // zero unless queue stats or a delay are kept
+}
+
+// newClientWriter starts the writer goroutine for conn. qs, if not nil,
+// accounts the queue's depth, capacity, waits and rejections; delay, if
+// enabled, holds every frame back before it is written; bufs, if not nil,
+// provides the buffers frames are encrypted into.
+func newClientWriter(conn net.Conn, enc *AESStreamState, transport TransportType, qs *QueueStats, delay *WriteDelay, bufs *BufferPool) *clientWriter {
+	if !delay.enabled() {
+		delay = nil
+	}
+	w := &clientWriter{
+		conn:      conn,
+		enc:       enc,
+		transport: transport,
+		queue:     make(chan queuedFrame, clientWriteQueueDepth),
+		qs:        qs,
+		delay:     delay,
+		bufs:      bufs,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	qs.AddCapacity(clientWriteQueueDepth)
+	go w.run()
+	return w
+}
+
+// frame wraps data for the queue, stamping it when queue stats or a delay
+// are kept.
+func (w *clientWriter) frame(data []byte) queuedFrame {
+	f := queuedFrame{data: data}
+	if w.qs != nil || w.delay != nil {
+		f.queued = time.Now()
+	}
+	return f
+}
+
+// Send queues data to be written as one frame. It blocks while the queue is
+// full and returns the writer's error once it has failed or been closed.
+// data must not be modified after the call.
+func (w *clientWriter) Send(data []byte) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	w.qs.Enter()
+	select {
+	case w.queue <- w.frame(data):
+		w.settle()
+		return nil
+	case <-w.done:
+		w.qs.Exit()
+		if err := w.Err(); err != nil {
+			return err
+		}
+		return errClientWriterClosed
+	}
+}
+
+// TrySend is Send that returns errClientQueueFull instead of blocking.
+func (w *clientWriter) TrySend(data []byte) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	w.qs.Enter()
+	select {
+	case w.queue <- w.frame(data):
+		w.settle()
+		return nil
+	case <-w.done:
+		w.qs.Exit()
+		if err := w.Err(); err != nil {
+			return err
+		}
+		return errClientWriterClosed
+	default:
+		w.qs.Exit()
+		w.qs.Reject()
+		return errClientQueueFull
+	}
+}
+
+// Err returns the first write error, if any.
+func (w *clientWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close flushes the frames already queued and stops the writer goroutine.
+func (w *clientWriter) Close() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+func (w *clientWriter) run() {
+	defer processCrash.Load().Recover()
+	defer w.release()
+	defer close(w.done)
+	for {
+		select {
+		case f := <-w.queue:
+			if !w.write(f) {
+				return
+			}
+		case <-w.stop:
+			for {
+				select {
+				case f := <-w.queue:
+					if !w.write(f) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// release takes the queue out of the queue stats once the writer has
+// stopped, including frames left in it after a write error.
+func (w *clientWriter) release() {
+	w.qs.AddCapacity(-clientWriteQueueDepth)
+	w.drain()
+}
+
+// settle runs after a frame was queued: if the writer has already stopped,
+// nothing will take the frame, so it is dropped from the queue stats. The
+// writer closes done before its final drain, so a frame queued after that
+// drain is always seen here.
+func (w *clientWriter) settle() {
+	select {
+	case <-w.done:
+		w.drain()
+	default:
+	}
+}
+
+// drain empties the queue of a stopped writer.
+func (w *clientWriter) drain() {
+	for {
+		select {
+		case <-w.queue:
+			w.qs.Exit()
+		default:
+			return
+		}
+	}
+}
+
+// write sends one frame; on failure it records the error, closes the
+// connection so the reader unblocks, and returns false.
+func (w *clientWriter) write(f queuedFrame) bool {
+	if w.qs != nil {
+		w.qs.Exit()
+		w.qs.ObserveWait(time.Since(f.queued))
+	}
+	if w.delay != nil {
+		w.delay.wait(f.queued, w.stop)
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	if err := writePacket(w.conn, f.data, w.enc, w.transport, w.bufs); err != nil {
+		w.mu.Lock()
+		w.err = err
+		w.mu.Unlock()
+		w.conn.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func matchedStreams(t *testing.T, seed string) (enc, dec *AESStreamState) {
+	t.Helper()
+	key := sha256.Sum256([]byte(seed))
+	var iv [16]byte
+	copy(iv[:], key[16:])
+	encStream, err := newAESCTRStream(key, iv)
+	if err != nil {
+		t.Fatalf("newAESCTRStream (enc): %v", err)
+	}
+	decStream, err := newAESCTRStream(key, iv)
+	if err != nil {
+		t.Fatalf("newAESCTRStream (dec): %v", err)
+	}
+	return &AESStreamState{stream: encStream}, &AESStreamState{stream: decStream}
+}
+
+// TestClientWriter_ConcurrentSenders checks that frames queued from several
+// goroutines arrive intact and that each sender's frames keep their order.
+func TestClientWriter_ConcurrentSenders(t *testing.T) {
+	const senders, perSender = 8, 50
+
+	enc, dec := matchedStreams(t, "test-client-writer")
+	server, client := net.Pipe()
+	defer client.Close()
+
+	w := newClientWriter(server, enc, TransportIntermediate, nil, nil, nil)
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				frame := make([]byte, 64)
+				binary.LittleEndian.PutUint32(frame[0:4], uint32(s))
+				binary.LittleEndian.PutUint32(frame[4:8], uint32(i))
+				for j := 8; j < len(frame); j++ {
+					frame[j] = byte(s)
+				}
+				if err := w.Send(frame); err != nil {
+					t.Errorf("Send: %v", err)
+					return
+				}
+			}
+		}(s)
+	}
+
+	next := make([]uint32, senders)
+	reader := NewPacketReader(client, dec, TransportIntermediate)
+	for n := 0; n < senders*perSender; n++ {
+		got, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket[%d]: %v", n, err)
+		}
+		s := binary.LittleEndian.Uint32(got[0:4])
+		i := binary.LittleEndian.Uint32(got[4:8])
+		if s >= senders {
+			t.Fatalf("frame %d: bad sender %d", n, s)
+		}
+		if !bytes.Equal(got[8:], bytes.Repeat([]byte{byte(s)}, 56)) {
+			t.Fatalf("frame %d from sender %d is corrupted", n, s)
+		}
+		if i != next[s] {
+			t.Fatalf("sender %d: got frame %d, want %d", s, i, next[s])
+		}
+		next[s]++
+	}
+
+	wg.Wait()
+	w.Close()
+}
+
+func TestClientWriter_SendAfterWriteError(t *testing.T) {
+	server, client := net.Pipe()
+	client.Close()
+
+	w := newClientWriter(server, nil, TransportIntermediate, nil, nil, nil)
+	defer w.Close()
+
+	// The first frame may be queued before the failure is observed.
+	w.Send([]byte{1, 2, 3, 4})
+	<-w.done
+	if err := w.Send([]byte{1, 2, 3, 4}); err == nil {
+		t.Fatal("Send after write error returned nil")
+	}
+	if w.Err() == nil {
+		t.Fatal("Err() = nil after write error")
+	}
+}
+
+// TestClientWriter_Delay checks that a write delay holds frames back, keeps
+// their order and is skipped when the writer is closed.
+func TestClientWriter_Delay(t *testing.T) {
+	const base = 50 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	w := newClientWriter(server, nil, TransportIntermediate, nil, &WriteDelay{Base: base, Jitter: base}, nil)
+	start := time.Now()
+	for i := byte(0); i < 3; i++ {
+		if err := w.Send([]byte{i, i, i, i}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	reader := NewPacketReader(client, nil, TransportIntermediate)
+	for i := byte(0); i < 3; i++ {
+		got, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket[%d]: %v", i, err)
+		}
+		if got[0] != i {
+			t.Fatalf("frame %d arrived as %d", i, got[0])
+		}
+		if i == 0 && time.Since(start) < base {
+			t.Fatalf("first frame arrived after %s, want at least %s", time.Since(start), base)
+		}
+	}
+
+	// A closed writer flushes the rest without waiting.
+	w2 := newClientWriter(server, nil, TransportIntermediate, nil, &WriteDelay{Base: time.Hour}, nil)
+	if err := w2.Send([]byte{9, 9, 9, 9}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	go w2.Close()
+	if got, err := reader.ReadPacket(); err != nil || got[0] != 9 {
+		t.Fatalf("ReadPacket after Close = %v, %v", got, err)
+	}
+	w.Close()
+}
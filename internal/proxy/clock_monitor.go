@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"log"
+	"net/netip"
+	"time"
+)
+
+const (
+	// clockCheckInterval is how often ClockMonitor compares the clocks.
+	clockCheckInterval = 5 * time.Second
+
+	// clockStepThreshold is the smallest change of the wall clock against
+	// the monotonic clock within one check that counts as a step rather
+	// than NTP slewing.
+	clockStepThreshold = time.Second
+)
+
+// ClockMonitor compares the wall clock with the monotonic clock. Handshake
+// timestamps (fake TLS replay window, secret validity) follow the wall
+// clock while rate limiters, idle eviction and timeouts follow the
+// monotonic one, so a wall clock that jumps (an NTP step, a VM resumed
+// from a snapshot, someone running date) makes them disagree in ways that
+// are hard to trace back. The monitor logs every step, records it in the
+// event log and keeps gauges of the accumulated skew and of the drift rate
+// between steps.
+type ClockMonitor struct {
+	interval  time.Duration
+	threshold time.Duration
+	stats     *Stats
+	events    *EventLog
+	stopCh    chan struct{}
+
+	// Wall and monotonic readings at start and at the previous check; only
+	// check touches them after Start.
+	baseWall time.Time
+	baseMono time.Time
+	lastSkew time.Duration
+	lastMono time.Duration
+}
+
+// NewClockMonitor creates a monitor checking every clockCheckInterval.
+func NewClockMonitor(stats *Stats) *ClockMonitor {
+	now := time.Now()
+	return &ClockMonitor{
+		interval:  clockCheckInterval,
+		threshold: clockStepThreshold,
+		stats:     stats,
+		stopCh:    make(chan struct{}),
+		baseWall:  now.Round(0),
+		baseMono:  now,
+	}
+}
+
+// SetEventLog records clock steps in l. Must be called before Start.
+func (m *ClockMonitor) SetEventLog(l *EventLog) {
+	m.events = l
+}
+
+// Start launches the periodic check.
+func (m *ClockMonitor) Start() {
+	go runEvery(m.interval, m.stopCh, func() {
+		now := time.Now()
+		m.check(now.Round(0), now.Sub(m.baseMono))
+	})
+}
+
+// Stop ends the periodic check.
+func (m *ClockMonitor) Stop() {
+	close(m.stopCh)
+}
+
+// check takes one reading: wall is the wall clock without its monotonic
+// part and mono the monotonic time elapsed since the monitor was created.
+func (m *ClockMonitor) check(wall time.Time, mono time.Duration) {
+	skew := wall.Sub(m.baseWall) - mono
+	step := skew - m.lastSkew
+	elapsed := mono - m.lastMono
+	m.lastSkew, m.lastMono = skew, mono
+
+	if step >= m.threshold || step <= -m.threshold {
+		log.Printf("clock: wall clock stepped %+dms against the monotonic clock (now %s, total skew %+dms)",
+			step.Milliseconds(), wall.Format(time.RFC3339), skew.Milliseconds())
+		m.events.Record(EventClockStep, "", netip.AddrPort{}, step.String())
+		if m.stats != nil {
+			m.stats.RecordClockStep(step)
+		}
+	} else if m.stats != nil && elapsed > 0 {
+		m.stats.SetClockDrift(int64(float64(step) / float64(elapsed) * 1e6))
+	}
+	if m.stats != nil {
+		m.stats.SetClockSkew(skew)
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockMonitor_Check(t *testing.T) {
+	stats := NewStats()
+	events := NewEventLog(16)
+	m := NewClockMonitor(stats)
+	m.SetEventLog(events)
+	wall := m.baseWall
+
+	// Slewing: the wall clock gains 1ms over 5s, 200 ppm.
+	m.check(wall.Add(5*time.Second+time.Millisecond), 5*time.Second)
+	snap := stats.Snapshot(0)
+	if snap["clock_steps"] != 0 || snap["clock_skew_ms"] != 1 || snap["clock_drift_ppm"] != 200 {
+		t.Errorf("after slew: steps=%d skew=%d drift=%d, want 0/1/200",
+			snap["clock_steps"], snap["clock_skew_ms"], snap["clock_drift_ppm"])
+	}
+
+	// NTP steps the wall clock back by 3s.
+	m.check(wall.Add(7*time.Second+time.Millisecond), 10*time.Second)
+	snap = stats.Snapshot(0)
+	if snap["clock_steps"] != 1 || snap["clock_last_step_ms"] != -3000 || snap["clock_skew_ms"] != -2999 {
+		t.Errorf("after step: steps=%d last=%d skew=%d, want 1/-3000/-2999",
+			snap["clock_steps"], snap["clock_last_step_ms"], snap["clock_skew_ms"])
+	}
+	if snap["clock_drift_ppm"] != 200 {
+		t.Errorf("drift = %d, a step must not count as drift", snap["clock_drift_ppm"])
+	}
+	got := events.Events(0)
+	if len(got) != 1 || got[0].Kind != EventClockStep || got[0].Reason != "-3s" {
+		t.Errorf("events = %+v, want one clock_step of -3s", got)
+	}
+
+	// The clocks agree again: no new step.
+	m.check(wall.Add(12*time.Second+time.Millisecond), 15*time.Second)
+	if snap = stats.Snapshot(0); snap["clock_steps"] != 1 || snap["clock_drift_ppm"] != 0 {
+		t.Errorf("steady: steps=%d drift=%d, want 1/0", snap["clock_steps"], snap["clock_drift_ppm"])
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"log"
+	"maps"
+	"os"
+	"time"
+)
+
+// configWatchInterval is how often ConfigWatcher reads the watched files.
+const configWatchInterval = time.Second
+
+// DefaultConfigWatchDebounce is how long the watched files must stay
+// unchanged after a change before the reload runs (--watch-config-debounce).
+const DefaultConfigWatchDebounce = 2 * time.Second
+
+// ConfigWatcher triggers a reload when the config or secret file changes
+// (--watch-config), for deployments that cannot send SIGHUP, such as a
+// container whose config is a mounted volume. A change is only acted on
+// once the files have stayed the same for the debounce time, so an editor
+// saving in several writes or a volume update swapping symlinks causes one
+// reload of the finished files.
+//
+// Like SecretWatcher it polls the file contents instead of using inotify:
+// the same on every platform, on network filesystems and across the
+// rename or symlink swap that replaces a watched path.
+type ConfigWatcher struct {
+	paths    []string
+	debounce time.Duration
+	reload   func()
+	stopCh   chan struct{}
+
+	// seen is the last read contents digest per path ("" if unreadable);
+	// changedAt is when it last differed, zero once the reload ran.
+	seen      map[string]string
+	changedAt time.Time
+}
+
+// NewConfigWatcher creates a watcher over paths calling reload after they
+// change. debounce <= 0 uses DefaultConfigWatchDebounce.
+func NewConfigWatcher(paths []string, debounce time.Duration, reload func()) *ConfigWatcher {
+	if debounce <= 0 {
+		debounce = DefaultConfigWatchDebounce
+	}
+	w := &ConfigWatcher{paths: paths, debounce: debounce, reload: reload, stopCh: make(chan struct{})}
+	w.seen = w.read()
+	return w
+}
+
+// Start polls the files in a background goroutine until Stop.
+func (w *ConfigWatcher) Start() {
+	go func() {
+		defer processCrash.Load().Recover()
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stopCh:
+				return
+			case now := <-ticker.C:
+				w.poll(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the poller.
+func (w *ConfigWatcher) Stop() {
+	close(w.stopCh)
+}
+
+// poll reads the files once and runs the reload when a change has settled
+// for the debounce time.
+func (w *ConfigWatcher) poll(now time.Time) {
+	if cur := w.read(); !maps.Equal(cur, w.seen) {
+		if w.changedAt.IsZero() {
+			log.Printf("watch-config: change detected, reloading in %s unless it changes again", w.debounce)
+		}
+		w.seen = cur
+		w.changedAt = now
+		return
+	}
+	if !w.changedAt.IsZero() && now.Sub(w.changedAt) >= w.debounce {
+		w.changedAt = time.Time{}
+		w.reload()
+	}
+}
+
+// read returns the digest of every watched file.
+func (w *ConfigWatcher) read() map[string]string {
+	sums := make(map[string]string, len(w.paths))
+	for _, p := range w.paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			sums[p] = ""
+			continue
+		}
+		sum := md5.Sum(data)
+		sums[p] = string(sum[:])
+	}
+	return sums
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcher_Debounce(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "proxy-multi.conf")
+	secrets := filepath.Join(dir, "secrets")
+	os.WriteFile(conf, []byte("proxy_for 2 10.0.0.1:8888;\n"), 0600)
+	os.WriteFile(secrets, []byte("aabbccddeeff00112233445566778899"), 0600)
+
+	reloads := 0
+	w := NewConfigWatcher([]string{conf, secrets}, 2*time.Second, func() { reloads++ })
+	now := time.Unix(1000, 0)
+	tick := func(d time.Duration) {
+		now = now.Add(d)
+		w.poll(now)
+	}
+
+	tick(time.Second)
+	if reloads != 0 {
+		t.Fatalf("reload without a change")
+	}
+	// A change that keeps changing waits until it settles.
+	os.WriteFile(conf, []byte("proxy_for 2 10.0.0.2:8888;\n"), 0600)
+	tick(time.Second)
+	os.WriteFile(conf, []byte("proxy_for 2 10.0.0.3:8888;\n"), 0600)
+	tick(time.Second)
+	tick(time.Second)
+	if reloads != 0 {
+		t.Fatalf("reloaded before the change settled")
+	}
+	tick(time.Second)
+	if reloads != 1 {
+		t.Fatalf("reloads = %d after the change settled, want 1", reloads)
+	}
+	tick(5 * time.Second)
+	if reloads != 1 {
+		t.Fatalf("reloads = %d with nothing changed, want 1", reloads)
+	}
+
+	// Replacing the secret file by rename counts too; a missing file is a
+	// change of its own.
+	os.Remove(secrets)
+	tick(time.Second)
+	os.WriteFile(secrets+".tmp", []byte("ffeeddccbbaa00112233445566778899"), 0600)
+	os.Rename(secrets+".tmp", secrets)
+	tick(time.Second)
+	tick(2 * time.Second)
+	if reloads != 2 {
+		t.Fatalf("reloads = %d after the secret file was replaced, want 2", reloads)
+	}
+}
@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is what a client connection is doing right now.
+type ConnState int32
+
+const (
+	ConnReading ConnState = iota // waiting for the client's next frame
+	ConnBackend                  // a frame is with the backend
+	ConnWriting                  // queueing the answer for the client
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnReading:
+		return "read"
+	case ConnBackend:
+		return "backend"
+	case ConnWriting:
+		return "write"
+	}
+	return "unknown"
+}
+
+// traceFrameHead is how many bytes of each frame a traced connection logs.
+const traceFrameHead = 32
+
+// ConnInfo describes one client connection that completed the handshake:
+// what the client negotiated and where its traffic goes. Everything but the
+// backend, the counters and the state is fixed at handshake time.
+type ConnInfo struct {
+	ID        string
+	Addr      netip.AddrPort
+	Opened    time.Time
+	Transport TransportType
+	FakeTLS   bool
+	Secret    string // secret fingerprint; "" when running without secrets
+	TargetDC  int16
+	ExtConnID int64
+
+	backend  atomic.Pointer[string] // last target the dataplane forwarded to
+	bytesIn  atomic.Int64           // payload bytes read from the client
+	bytesOut atomic.Int64           // payload bytes queued for the client
+	state    atomic.Int32           // ConnState
+	traced   atomic.Bool            // log every frame (--trace-conn, /admin/trace)
+
+	closeConn func()      // closes the client connection; nil in tests
+	revoked   atomic.Bool // set by ConnTable.Revoke before closing
+}
+
+// Revoked reports whether the connection was closed because its secret
+// was removed.
+func (c *ConnInfo) Revoked() bool {
+	return c != nil && c.revoked.Load()
+}
+
+// SetBackend records the target the connection's last frame was forwarded
+// to. It is safe to call on a nil *ConnInfo.
+func (c *ConnInfo) SetBackend(addr string) {
+	if c == nil {
+		return
+	}
+	if cur := c.backend.Load(); cur != nil && *cur == addr {
+		return
+	}
+	c.backend.Store(&addr)
+}
+
+// Backend returns the target set by SetBackend, or "" before the first
+// frame was forwarded.
+func (c *ConnInfo) Backend() string {
+	if p := c.backend.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// AddTraffic counts payload bytes read from and queued for the client. It is
+// safe to call on a nil *ConnInfo.
+func (c *ConnInfo) AddTraffic(in, out int) {
+	if c == nil {
+		return
+	}
+	if in > 0 {
+		c.bytesIn.Add(int64(in))
+	}
+	if out > 0 {
+		c.bytesOut.Add(int64(out))
+	}
+}
+
+// Traffic returns the payload bytes counted by AddTraffic.
+func (c *ConnInfo) Traffic() (in, out int64) {
+	return c.bytesIn.Load(), c.bytesOut.Load()
+}
+
+// SetState records what the connection is doing. It is safe to call on a
+// nil *ConnInfo.
+func (c *ConnInfo) SetState(s ConnState) {
+	if c != nil {
+		c.state.Store(int32(s))
+	}
+}
+
+// State returns the state set by SetState.
+func (c *ConnInfo) State() ConnState {
+	return ConnState(c.state.Load())
+}
+
+// Traced reports whether every frame of the connection is logged.
+func (c *ConnInfo) Traced() bool {
+	return c != nil && c.traced.Load()
+}
+
+// traceFrame logs one frame of a traced connection: its direction ("<-"
+// from the client, "->" to it), number, size and first bytes.
+func (c *ConnInfo) traceFrame(dir string, n int64, data []byte, note string) {
+	if !c.Traced() {
+		return
+	}
+	head := data
+	if len(head) > traceFrameHead {
+		head = head[:traceFrameHead]
+	}
+	if note != "" {
+		note = " " + note
+	}
+	log.Printf("trace: conn=%s %s frame=%d len=%d%s %x", c.ID, dir, n, len(data), note, head)
+}
+
+// ConnTable is the set of active client connections, dumped via
+// /debug/connections so a client that asks for the wrong DC or uses the
+// wrong secret can be spotted from the server. A nil *ConnTable tracks
+// nothing.
+type ConnTable struct {
+	mu    sync.Mutex
+	conns map[string]*ConnInfo
+	trace []netip.Prefix // clients whose connections are traced from the start
+}
+
+// NewConnTable creates an empty ConnTable.
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: make(map[string]*ConnInfo)}
+}
+
+// SetTraceAddrs makes every connection from a client in prefixes traced
+// from the handshake on (--trace-conn). Connection IDs are only known once
+// a client is connected; those are traced with Trace.
+func (t *ConnTable) SetTraceAddrs(prefixes []netip.Prefix) {
+	t.mu.Lock()
+	t.trace = prefixes
+	t.mu.Unlock()
+}
+
+// Add registers a connection under its ID.
+func (t *ConnTable) Add(c *ConnInfo) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.conns[c.ID] = c
+	for _, p := range t.trace {
+		if c.Addr.IsValid() && p.Contains(c.Addr.Addr().Unmap()) {
+			c.traced.Store(true)
+			break
+		}
+	}
+	t.mu.Unlock()
+	if c.Traced() {
+		log.Printf("trace: conn=%s from %s traced", c.ID, c.Addr)
+	}
+}
+
+// Trace turns frame logging for the connection id on or off and returns
+// it, or nil if no such connection is open.
+func (t *ConnTable) Trace(id string, on bool) *ConnInfo {
+	t.mu.Lock()
+	c := t.conns[id]
+	t.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	if c.traced.Swap(on) != on {
+		if on {
+			log.Printf("trace: conn=%s from %s traced", id, c.Addr)
+		} else {
+			log.Printf("trace: conn=%s tracing stopped", id)
+		}
+	}
+	return c
+}
+
+// Remove drops a connection registered with Add.
+func (t *ConnTable) Remove(c *ConnInfo) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.conns, c.ID)
+	t.mu.Unlock()
+}
+
+// Revoke closes every connection authenticated with the secret whose
+// fingerprint is secret and returns how many it closed.
+func (t *ConnTable) Revoke(secret string) int {
+	if t == nil || secret == "" {
+		return 0
+	}
+	t.mu.Lock()
+	var victims []*ConnInfo
+	for _, c := range t.conns {
+		if c.Secret == secret && !c.revoked.Swap(true) {
+			victims = append(victims, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range victims {
+		if c.closeConn != nil {
+			c.closeConn()
+		}
+	}
+	return len(victims)
+}
+
+// Len returns the number of tracked connections.
+func (t *ConnTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Conns returns the tracked connections, oldest first.
+func (t *ConnTable) Conns() []*ConnInfo {
+	t.mu.Lock()
+	out := make([]*ConnInfo, 0, len(t.conns))
+	for _, c := range t.conns {
+		out = append(out, c)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Opened.Equal(out[j].Opened) {
+			return out[i].Opened.Before(out[j].Opened)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// writeConnsText writes connections one per line:
+// "<conn>\t<addr>\t<opened RFC3339>\t<transport>\t<secret>\t<dc>\t<backend>\t<ext_conn_id>\t<age s>\t<bytes in>\t<bytes out>\t<state>",
+// with "-" for empty fields. Fake TLS connections have a "tls+" transport
+// prefix, traced ones a "+trace" state suffix. Unless fullAddr is set,
+// client addresses are cut to their network (see anonymizeAddr).
+func writeConnsText(w io.Writer, conns []*ConnInfo, now time.Time, fullAddr bool) {
+	for _, c := range conns {
+		addr := "-"
+		if c.Addr.IsValid() {
+			addr = c.Addr.String()
+			if !fullAddr {
+				addr = anonymizeAddr(c.Addr.Addr())
+			}
+		}
+		transport := c.Transport.String()
+		if c.FakeTLS {
+			transport = "tls+" + transport
+		}
+		state := c.State().String()
+		if c.Traced() {
+			state += "+trace"
+		}
+		in, out := c.Traffic()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%d\t%.0f\t%d\t%d\t%s\n",
+			c.ID, addr, c.Opened.UTC().Format(time.RFC3339), transport,
+			orDash(c.Secret), c.TargetDC, orDash(c.Backend()), c.ExtConnID,
+			now.Sub(c.Opened).Seconds(), in, out, state)
+	}
+}
+
+// anonymizeAddr cuts a client address to its /24 (IPv4) or /48 (IPv6)
+// network, enough to tell providers and regions apart without naming the
+// subscriber.
+func anonymizeAddr(a netip.Addr) string {
+	a = a.Unmap()
+	bits := 48
+	if a.Is4() {
+		bits = 24
+	}
+	p, _ := a.Prefix(bits)
+	return p.String()
+}
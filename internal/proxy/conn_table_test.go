@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnTable(t *testing.T) {
+	tbl := NewConnTable()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	a := &ConnInfo{
+		ID: "aaaa0001", Addr: netip.MustParseAddrPort("203.0.113.7:51000"), Opened: start.Add(time.Second),
+		Transport: TransportIntermediate, Secret: "0123456789abcdef", TargetDC: 2, ExtConnID: 42,
+	}
+	b := &ConnInfo{
+		ID: "bbbb0002", Addr: netip.MustParseAddrPort("198.51.100.1:40000"), Opened: start,
+		Transport: TransportPadded, FakeTLS: true, TargetDC: -4, ExtConnID: 43,
+	}
+	tbl.Add(a)
+	tbl.Add(b)
+	a.SetBackend("149.154.167.51:8888")
+	a.AddTraffic(100, 0)
+	a.AddTraffic(0, 250)
+	a.SetState(ConnBackend)
+
+	conns := tbl.Conns()
+	if len(conns) != 2 || conns[0] != b || conns[1] != a {
+		t.Fatalf("Conns() not ordered oldest first: %v", conns)
+	}
+	now := start.Add(time.Minute)
+	var sb strings.Builder
+	writeConnsText(&sb, conns, now, true)
+	want := "bbbb0002\t198.51.100.1:40000\t2024-05-01T12:00:00Z\ttls+padded\t-\t-4\t-\t43\t60\t0\t0\tread\n" +
+		"aaaa0001\t203.0.113.7:51000\t2024-05-01T12:00:01Z\tintermediate\t0123456789abcdef\t2\t149.154.167.51:8888\t42\t59\t100\t250\tbackend\n"
+	if sb.String() != want {
+		t.Errorf("dump:\n%s\nwant:\n%s", sb.String(), want)
+	}
+
+	sb.Reset()
+	writeConnsText(&sb, conns[1:], now, false)
+	if !strings.HasPrefix(sb.String(), "aaaa0001\t203.0.113.0/24\t") {
+		t.Errorf("anonymized dump: %s", sb.String())
+	}
+	if got := anonymizeAddr(netip.MustParseAddr("2001:db8:1234:5678::1")); got != "2001:db8:1234::/48" {
+		t.Errorf("anonymizeAddr(IPv6) = %s", got)
+	}
+
+	tbl.Remove(a)
+	if tbl.Len() != 1 {
+		t.Errorf("Len() = %d after Remove, want 1", tbl.Len())
+	}
+
+	// A nil table and a nil entry are no-ops, as when the dump is disabled.
+	var nilTable *ConnTable
+	nilTable.Add(a)
+	nilTable.Remove(a)
+	var nilInfo *ConnInfo
+	nilInfo.SetBackend("x")
+}
+
+func TestHandleConnections(t *testing.T) {
+	tbl := NewConnTable()
+	tbl.Add(&ConnInfo{ID: "c1", Opened: time.Now(), TargetDC: 2})
+	tbl.Add(&ConnInfo{ID: "c2", Opened: time.Now(), TargetDC: 5})
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetConnTable(tbl)
+
+	rec := httptest.NewRecorder()
+	h.handleConnections(rec, httptest.NewRequest(http.MethodGet, "/debug/connections?dc=5", nil))
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "# total 1\n") || !strings.Contains(body, "c2\t") || strings.Contains(body, "c1\t") {
+		t.Errorf("?dc=5 body:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleConnections(rec, httptest.NewRequest(http.MethodGet, "/debug/connections?dc=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad dc: status %d, want 400", rec.Code)
+	}
+
+	// Full client addresses only go to the admin socket.
+	rec = httptest.NewRecorder()
+	h.handleConnections(rec, httptest.NewRequest(http.MethodGet, "/debug/connections?addr=full", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("addr=full over TCP: status %d, want 403", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.handleConnections(rec, adminRequest(http.MethodGet, "/debug/connections?addr=full"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("addr=full on the admin socket: status %d, want 200", rec.Code)
+	}
+}
+
+func TestConnTable_Trace(t *testing.T) {
+	tbl := NewConnTable()
+	tbl.SetTraceAddrs([]netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")})
+	a := &ConnInfo{ID: "a", Addr: netip.MustParseAddrPort("[::ffff:203.0.113.7]:51000")}
+	b := &ConnInfo{ID: "b", Addr: netip.MustParseAddrPort("198.51.100.1:40000")}
+	tbl.Add(a)
+	tbl.Add(b)
+	if !a.Traced() || b.Traced() {
+		t.Fatalf("after Add: a traced %v, b traced %v; want only a", a.Traced(), b.Traced())
+	}
+
+	if c := tbl.Trace("b", true); c != b || !b.Traced() {
+		t.Error("Trace(b, on) did not trace b")
+	}
+	if c := tbl.Trace("a", false); c != a || a.Traced() {
+		t.Error("Trace(a, off) did not stop tracing a")
+	}
+	if tbl.Trace("nope", true) != nil {
+		t.Error("Trace of an unknown connection returned one")
+	}
+}
+
+func TestHandleTrace(t *testing.T) {
+	tbl := NewConnTable()
+	c := &ConnInfo{ID: "c1", Opened: time.Now()}
+	tbl.Add(c)
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetConnTable(tbl)
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.handleTrace(rec, adminRequest(method, target))
+		return rec
+	}
+	rec := httptest.NewRecorder()
+	h.handleTrace(rec, httptest.NewRequest(http.MethodPost, "/admin/trace?conn=c1", nil))
+	if rec.Code != http.StatusForbidden || c.Traced() {
+		t.Errorf("trace over TCP: status %d, traced %v; want 403", rec.Code, c.Traced())
+	}
+	if rec := do(http.MethodPost, "/admin/trace?conn=c1"); rec.Code != http.StatusOK || !c.Traced() ||
+		!strings.Contains(rec.Body.String(), "read+trace") {
+		t.Errorf("trace on: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/admin/trace?conn=c1&trace=off"); rec.Code != http.StatusOK || c.Traced() {
+		t.Errorf("trace off: status %d, traced %v", rec.Code, c.Traced())
+	}
+	for target, code := range map[string]int{
+		"/admin/trace":                 http.StatusBadRequest,
+		"/admin/trace?conn=c1&trace=x": http.StatusBadRequest,
+		"/admin/trace?conn=c2":         http.StatusNotFound,
+	} {
+		if rec := do(http.MethodPost, target); rec.Code != code {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, code)
+		}
+	}
+	if rec := do(http.MethodGet, "/admin/trace?conn=c1"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+}
+
+func TestConnTable_Revoke(t *testing.T) {
+	tbl := NewConnTable()
+	closed := 0
+	a := &ConnInfo{ID: "a", Secret: "0123456789abcdef", closeConn: func() { closed++ }}
+	b := &ConnInfo{ID: "b", Secret: "fedcba9876543210", closeConn: func() { closed++ }}
+	c := &ConnInfo{ID: "c"} // no-secret mode
+	tbl.Add(a)
+	tbl.Add(b)
+	tbl.Add(c)
+
+	if n := tbl.Revoke("0123456789abcdef"); n != 1 || closed != 1 || !a.Revoked() || b.Revoked() {
+		t.Fatalf("Revoke = %d, closed %d", n, closed)
+	}
+	if n := tbl.Revoke("0123456789abcdef"); n != 0 || closed != 1 {
+		t.Errorf("second Revoke = %d, closed %d; a connection is closed once", n, closed)
+	}
+	if n := tbl.Revoke(""); n != 0 || c.Revoked() {
+		t.Error("empty fingerprint must not match no-secret connections")
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// conntrackDir holds nf_conntrack_count and nf_conntrack_max on Linux.
+	conntrackDir = "/proc/sys/net/netfilter"
+
+	// conntrackPollInterval is how often ConntrackMonitor reads the counters.
+	conntrackPollInterval = 30 * time.Second
+
+	// conntrackWarnPercent is the table fill level that triggers a warning.
+	conntrackWarnPercent = 80
+)
+
+// ConntrackMonitor periodically reads the netfilter connection-tracking
+// counters and warns when the table is close to full. A full conntrack table
+// makes the kernel drop new connections, which looks like the proxy itself
+// failing.
+//
+// When the counters cannot be read (no netfilter, non-Linux, restricted
+// /proc) the monitor logs once and stops.
+type ConntrackMonitor struct {
+	dir      string
+	interval time.Duration
+	stats    *Stats
+	stopCh   chan struct{}
+
+	// warned is set while usage stays above conntrackWarnPercent, so the
+	// warning is logged on the transition rather than on every poll.
+	warned bool
+}
+
+// NewConntrackMonitor creates a monitor reading counters from dir
+// ("" = conntrackDir) every interval (<= 0 = conntrackPollInterval).
+func NewConntrackMonitor(dir string, interval time.Duration, stats *Stats) *ConntrackMonitor {
+	if dir == "" {
+		dir = conntrackDir
+	}
+	if interval <= 0 {
+		interval = conntrackPollInterval
+	}
+	return &ConntrackMonitor{
+		dir:      dir,
+		interval: interval,
+		stats:    stats,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start performs the first check synchronously and, if the counters are
+// readable, launches the polling goroutine.
+func (m *ConntrackMonitor) Start() {
+	if err := m.poll(); err != nil {
+		log.Printf("conntrack monitor: disabled: %v", err)
+		return
+	}
+	go runEvery(m.interval, m.stopCh, func() {
+		if err := m.poll(); err != nil {
+			log.Printf("conntrack monitor: %v", err)
+		}
+	})
+}
+
+// Stop stops the polling goroutine.
+func (m *ConntrackMonitor) Stop() {
+	close(m.stopCh)
+}
+
+// poll reads the counters once, updates the stats gauges and logs a warning
+// when usage crosses conntrackWarnPercent.
+func (m *ConntrackMonitor) poll() error {
+	count, err := readProcInt(filepath.Join(m.dir, "nf_conntrack_count"))
+	if err != nil {
+		return err
+	}
+	limit, err := readProcInt(filepath.Join(m.dir, "nf_conntrack_max"))
+	if err != nil {
+		return err
+	}
+	if m.stats != nil {
+		m.stats.SetConntrack(count, limit)
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	percent := count * 100 / limit
+	switch {
+	case percent >= conntrackWarnPercent && !m.warned:
+		log.Printf("WARNING: conntrack table %d%% full (%d/%d); new connections will be dropped when it fills up — raise net.netfilter.nf_conntrack_max or exempt the proxy port with NOTRACK",
+			percent, count, limit)
+		m.warned = true
+	case percent < conntrackWarnPercent && m.warned:
+		log.Printf("conntrack table back to %d%% (%d/%d)", percent, count, limit)
+		m.warned = false
+	}
+	return nil
+}
+
+// readProcInt reads a single integer from a /proc file.
+func readProcInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConntrack(t *testing.T, dir, count, max string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "nf_conntrack_count"), []byte(count), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nf_conntrack_max"), []byte(max), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConntrackMonitor_Poll(t *testing.T) {
+	dir := t.TempDir()
+	stats := NewStats()
+	m := NewConntrackMonitor(dir, 0, stats)
+
+	writeConntrack(t, dir, "100\n", "1000\n")
+	if err := m.poll(); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	snap := stats.Snapshot(0)
+	if snap["conntrack_count"] != 100 || snap["conntrack_max"] != 1000 {
+		t.Errorf("gauges = %d/%d, want 100/1000", snap["conntrack_count"], snap["conntrack_max"])
+	}
+	if m.warned {
+		t.Error("warned at 10% usage")
+	}
+
+	writeConntrack(t, dir, "900\n", "1000\n")
+	if err := m.poll(); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if !m.warned {
+		t.Error("expected warning at 90% usage")
+	}
+
+	writeConntrack(t, dir, "500\n", "1000\n")
+	if err := m.poll(); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if m.warned {
+		t.Error("warning not cleared after usage dropped")
+	}
+}
+
+func TestConntrackMonitor_Unavailable(t *testing.T) {
+	m := NewConntrackMonitor(filepath.Join(t.TempDir(), "missing"), 0, NewStats())
+	if err := m.poll(); err == nil {
+		t.Fatal("expected error when counters are missing")
+	}
+}
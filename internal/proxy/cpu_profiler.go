@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults of the CPU profiler trigger.
+const (
+	cpuProfileSampleInterval = time.Second
+	cpuProfileDuration       = 10 * time.Second
+)
+
+// CPUProfiler watches the process CPU usage and, once it has stayed above a
+// threshold for a while, captures a CPU profile into a directory that keeps
+// only the newest profiles. Performance incidents thus leave evidence even
+// when no operator is online to run pprof.
+type CPUProfiler struct {
+	dir       string
+	threshold float64       // percent of GOMAXPROCS
+	sustain   time.Duration // how long usage must stay above threshold
+	keep      int           // profiles kept on disk
+	duration  time.Duration // length of one profile
+	stats     *Stats
+
+	// cpuTime returns the CPU time used by the process so far.
+	cpuTime func() (time.Duration, bool)
+	// ncpu is GOMAXPROCS, which follows a cgroup CPU quota: usage is
+	// measured against the CPUs the process may use, not the host's.
+	ncpu int
+
+	lastWall time.Time
+	lastCPU  time.Duration
+	above    time.Duration // how long usage has been above threshold
+	stopCh   chan struct{}
+}
+
+// NewCPUProfiler creates a profiler writing into dir, which is created if
+// missing. threshold is a percentage of GOMAXPROCS; keep bounds the number of
+// profiles on disk.
+func NewCPUProfiler(dir string, threshold float64, sustain time.Duration, keep int, stats *Stats) (*CPUProfiler, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cpu profile dir %s: %w", dir, err)
+	}
+	return &CPUProfiler{
+		dir:       dir,
+		threshold: threshold,
+		sustain:   sustain,
+		keep:      max(keep, 1),
+		duration:  cpuProfileDuration,
+		stats:     stats,
+		cpuTime:   processCPUTime,
+		ncpu:      runtime.GOMAXPROCS(0),
+		stopCh:    make(chan struct{}),
+	}, nil
+}
+
+// Start launches the sampling goroutine. Without a way to read the process
+// CPU time on this platform the profiler stays off.
+func (p *CPUProfiler) Start() {
+	if _, ok := p.cpuTime(); !ok {
+		log.Println("cpu profiler: process CPU time is not available on this platform, disabled")
+		return
+	}
+	p.lastWall = time.Now()
+	p.lastCPU, _ = p.cpuTime()
+	go runEvery(cpuProfileSampleInterval, p.stopCh, p.sample)
+}
+
+// Stop stops sampling and aborts a capture in progress.
+func (p *CPUProfiler) Stop() {
+	close(p.stopCh)
+}
+
+// sample measures the CPU usage since the previous sample and starts a
+// capture once it has stayed above the threshold for sustain. Ticks that
+// fire during a capture are skipped by runEvery.
+func (p *CPUProfiler) sample() {
+	now := time.Now()
+	cpu, ok := p.cpuTime()
+	if !ok {
+		return
+	}
+	wall := now.Sub(p.lastWall)
+	used := cpu - p.lastCPU
+	p.lastWall, p.lastCPU = now, cpu
+	if wall <= 0 {
+		return
+	}
+	usage := 100 * float64(used) / float64(wall) / float64(p.ncpu)
+	if usage < p.threshold {
+		p.above = 0
+		return
+	}
+	p.above += wall
+	if p.above < p.sustain {
+		return
+	}
+	p.above = 0
+	log.Printf("cpu profiler: usage %.0f%% above %.0f%% for %s, capturing %s profile", usage, p.threshold, p.sustain, p.duration)
+	path, err := p.capture(now)
+	if err != nil {
+		log.Printf("cpu profiler: %v", err)
+		return
+	}
+	log.Printf("cpu profiler: profile written to %s", path)
+	// The capture took a while; measure the next interval from here.
+	p.lastWall = time.Now()
+	p.lastCPU, _ = p.cpuTime()
+}
+
+// capture writes one CPU profile and trims the directory to keep profiles.
+func (p *CPUProfiler) capture(now time.Time) (string, error) {
+	name := fmt.Sprintf("cpu-%s-%d.pprof", now.UTC().Format("20060102T150405"), os.Getpid())
+	path := filepath.Join(p.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", fmt.Errorf("start profile: %w", err)
+	}
+	t := time.NewTimer(p.duration)
+	select {
+	case <-t.C:
+	case <-p.stopCh:
+		t.Stop()
+	}
+	pprof.StopCPUProfile()
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("write %s: %w", path, err)
+	}
+	if p.stats != nil {
+		p.stats.IncCPUProfile()
+	}
+	pruneProfiles(p.dir, p.keep)
+	return path, nil
+}
+
+// pruneProfiles removes all but the newest keep profiles in dir. Profile
+// names start with a UTC timestamp, so name order is age order.
+func pruneProfiles(dir string, keep int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "cpu-") && strings.HasSuffix(e.Name(), ".pprof") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			log.Printf("cpu profiler: %v", err)
+		}
+		names = names[1:]
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCPUProfiler_CapturesAfterSustainedLoad(t *testing.T) {
+	dir := t.TempDir()
+	stats := NewStats()
+	p, err := NewCPUProfiler(dir, 50, 2*time.Second, 3, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.duration = 50 * time.Millisecond
+	p.ncpu = 1
+	var cpu time.Duration
+	p.cpuTime = func() (time.Duration, bool) { return cpu, true }
+
+	// Each step pretends one second passed with the given CPU time used.
+	step := func(used time.Duration) {
+		p.lastWall = time.Now().Add(-time.Second)
+		cpu += used
+		p.sample()
+	}
+
+	step(900 * time.Millisecond)
+	step(100 * time.Millisecond) // below the threshold: the streak restarts
+	step(900 * time.Millisecond)
+	if stats.CPUProfilesCaptured != 0 {
+		t.Fatal("profile captured before usage stayed high long enough")
+	}
+	step(900 * time.Millisecond)
+	if stats.CPUProfilesCaptured != 1 {
+		t.Fatalf("captured %d profiles, want 1", stats.CPUProfilesCaptured)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "cpu-*.pprof"))
+	if len(files) != 1 {
+		t.Fatalf("profiles on disk: %v", files)
+	}
+	if fi, err := os.Stat(files[0]); err != nil || fi.Size() == 0 {
+		t.Errorf("profile %s is empty or missing: %v", files[0], err)
+	}
+}
+
+// TestCPUProfiler_UsesGOMAXPROCS checks that usage is measured against
+// GOMAXPROCS, so a process capped below the host's cores can reach the
+// threshold.
+func TestCPUProfiler_UsesGOMAXPROCS(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	p, err := NewCPUProfiler(t.TempDir(), 70, time.Second, 1, NewStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ncpu != 2 {
+		t.Fatalf("ncpu = %d, want GOMAXPROCS 2", p.ncpu)
+	}
+	p.duration = 10 * time.Millisecond
+	var cpu time.Duration
+	p.cpuTime = func() (time.Duration, bool) { return cpu, true }
+	p.lastWall = time.Now().Add(-time.Second)
+	cpu = 1500 * time.Millisecond // 75% of two CPUs
+	p.sample()
+	if p.stats.CPUProfilesCaptured != 1 {
+		t.Errorf("captured %d profiles at 75%% of GOMAXPROCS, want 1", p.stats.CPUProfilesCaptured)
+	}
+}
+
+func TestPruneProfiles(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"cpu-20250101T000001-1.pprof",
+		"cpu-20250101T000003-1.pprof",
+		"cpu-20250101T000002-1.pprof",
+		"cpu-20250101T000004-1.pprof",
+		"notes.txt",
+	}
+	for _, n := range names {
+		os.WriteFile(filepath.Join(dir, n), []byte("x"), 0o600)
+	}
+	pruneProfiles(dir, 2)
+
+	entries, _ := os.ReadDir(dir)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	sort.Strings(left)
+	want := []string{"cpu-20250101T000003-1.pprof", "cpu-20250101T000004-1.pprof", "notes.txt"}
+	if len(left) != len(want) {
+		t.Fatalf("left %v, want %v", left, want)
+	}
+	for i := range want {
+		if left[i] != want[i] {
+			t.Errorf("left %v, want %v", left, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "time"
+
+// processCPUTime is not implemented off Linux; the CPU profiler stays off.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
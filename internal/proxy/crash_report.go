@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CrashReporter writes a report file when a goroutine it guards panics, so
+// that workers restarted by the supervisor leave forensic data behind even
+// after logs have rotated.
+//
+// A nil *CrashReporter is valid: Recover then lets the panic propagate.
+type CrashReporter struct {
+	dir     string
+	stats   *Stats
+	version string
+}
+
+// NewCrashReporter creates a reporter writing into dir. The directory is
+// created if missing so a misconfiguration shows up at startup rather than
+// at crash time.
+func NewCrashReporter(dir string, stats *Stats, version string) (*CrashReporter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("crash dir %s: %w", dir, err)
+	}
+	return &CrashReporter{dir: dir, stats: stats, version: version}, nil
+}
+
+// processCrash is the reporter of the running Runtime, set by New. The
+// package's background goroutines (timers, watchers, probers, outbound
+// connections) defer processCrash.Load().Recover(), so a panic in any of
+// them leaves a report like one in a connection handler.
+var processCrash atomic.Pointer[CrashReporter]
+
+// Recover must be deferred directly at the top of a goroutine:
+//
+//	defer crash.Recover()
+//
+// On panic it writes a crash report and terminates the process with exit
+// code 2, matching the status of an unrecovered panic.
+func (c *CrashReporter) Recover() {
+	if c == nil {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	path, err := c.Write(r, stack, time.Now())
+	if err != nil {
+		log.Printf("crash report: %v", err)
+	} else {
+		log.Printf("crash report written to %s", path)
+	}
+	fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", r, stack)
+	os.Exit(2)
+}
+
+// Write stores a crash report for the panic value v and returns its path.
+func (c *CrashReporter) Write(v any, stack []byte, now time.Time) (string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "time\t%s\n", now.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&sb, "pid\t%d\n", os.Getpid())
+	fmt.Fprintf(&sb, "version\t%s\n", c.version)
+	fmt.Fprintf(&sb, "go\t%s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&sb, "goroutines\t%d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&sb, "\n== panic ==\n%v\n", v)
+	fmt.Fprintf(&sb, "\n== stack ==\n%s", stack)
+
+	if c.stats != nil {
+		snap := c.stats.Snapshot(0)
+		keys := make([]string, 0, len(snap))
+		for k := range snap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(&sb, "\n== stats ==\nuptime\t%d\n", int64(c.stats.Uptime()))
+		for _, k := range keys {
+			fmt.Fprintf(&sb, "%s\t%d\n", k, snap[k])
+		}
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintf(&sb, "\n== build info ==\n%s", bi)
+	}
+
+	name := fmt.Sprintf("crash-%s-%d.txt", now.UTC().Format("20060102T150405"), os.Getpid())
+	path := filepath.Join(c.dir, name)
+	if err := os.WriteFile(path, []byte(sb.String()), 0o600); err != nil {
+		return "", fmt.Errorf("write %s: %w", path, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrashReporter_Write(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "crashes")
+	stats := NewStats()
+	stats.IncActiveConnections()
+
+	c, err := NewCrashReporter(dir, stats, "test-version")
+	if err != nil {
+		t.Fatalf("NewCrashReporter: %v", err)
+	}
+	path, err := c.Write("boom", []byte("goroutine 1 [running]:\n"), time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !strings.HasPrefix(filepath.Base(path), "crash-20260102T030405-") {
+		t.Errorf("unexpected report name %q", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"version\ttest-version", "== panic ==\nboom", "goroutine 1 [running]", "active_connections\t1"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("report missing %q", want)
+		}
+	}
+}
+
+func TestCrashReporter_NilRecover(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("panic not propagated through nil reporter: %v", r)
+		}
+	}()
+	func() {
+		var c *CrashReporter
+		defer c.Recover()
+		panic("boom")
+	}()
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+)
+
+// dashboardHTML is a single-page dashboard that polls stats.json (or the
+// text /stats of a supervisor) and shows connections, rates, errors and
+// target health, for operators without a metrics stack.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// wantsDashboard reports whether r is a browser asking for the stats root.
+// Tools that GET / for the text stats, as the C proxy serves them, do not
+// send Accept: text/html and keep getting text.
+func wantsDashboard(r *http.Request) bool {
+	return r.URL.Path == "/" && r.URL.RawQuery == "" &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// serveDashboard writes the dashboard page.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	h.Set("X-Frame-Options", "DENY")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(dashboardHTML)
+	}
+}
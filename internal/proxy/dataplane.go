@@ -2,8 +2,11 @@ package proxy
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"time"
 
 	"github.com/skrashevich/MTProxy/internal/protocol"
 )
@@ -17,16 +20,32 @@ type DataPlane struct {
 	proxyTag []byte // 16 байт или nil
 	ourIP    net.IP // proxy's own listening IP (for RPC_PROXY_REQ our_ip field)
 	ourPort  int    // proxy's own listening port
+
+	// natInfo — правила --nat-info (локальный IPv4 → публичный), см. natTranslate
+	natInfo map[uint32]uint32
+
+	// buffers — пул буферов для RPC_PROXY_REQ (nil = выделять каждый раз)
+	buffers *BufferPool
 }
 
 // NewDataPlane создаёт DataPlane.
 func NewDataPlane(router *Router, outbound *OutboundProxy, stats *Stats, proxyTag []byte) *DataPlane {
-	return &DataPlane{
+	dp := &DataPlane{
 		router:   router,
 		outbound: outbound,
 		stats:    stats,
 		proxyTag: proxyTag,
 	}
+	if outbound != nil {
+		dp.natInfo = outbound.cfg.NatInfo
+	}
+	return dp
+}
+
+// SetBuffers makes RPC_PROXY_REQ frames be built in buffers from bp and
+// given back once forwarded. Must be called before handling packets.
+func (dp *DataPlane) SetBuffers(bp *BufferPool) {
+	dp.buffers = bp
 }
 
 // SetListenAddr sets the proxy's own address for RPC_PROXY_REQ our_ip/our_port fields.
@@ -65,43 +84,85 @@ func (dp *DataPlane) HandlePacket(pkt IncomingPacket) ([]byte, error) {
 		flags = protocol.FlagExtNode // 0x1000
 	}
 
-	if len(dp.proxyTag) == 16 {
-		flags |= protocol.FlagProxyTag // 0x8
+	routeStart := time.Now()
+	target, err := dp.router.RoutePacket(int(pkt.TargetDC), pkt.ExtConnID, authKeyID)
+	if pkt.Trace != nil {
+		pkt.Trace.Route = time.Since(routeStart)
 	}
-
-	target, err := dp.router.Route(int(pkt.TargetDC))
 	if err != nil {
+		if errors.Is(err, ErrUnknownDC) {
+			dp.stats.IncUnknownDC()
+		}
 		dp.stats.IncDroppedQuery()
 		return nil, fmt.Errorf("dataplane: route dc=%d: %w", pkt.TargetDC, err)
 	}
+	// Per-DC counters exist only for configured clusters: the DC id comes
+	// from the client, and any of 65536 values would make a key of its own.
+	if target.DefaultRoute {
+		dp.stats.IncUnknownDC()
+	} else {
+		dp.stats.IncDCRouted(int(pkt.TargetDC))
+	}
+	pkt.Conn.SetBackend(target.Addr)
 
-	remoteIPv6 := ipToIPv6Wire(pkt.ClientIP)
-	ourIPv6 := ipToIPv6Wire(dp.ourIP)
+	req, tagged := dp.proxyReq(pkt, flags)
+	defer dp.buffers.Put(req)
+	if tagged {
+		flags |= protocol.FlagProxyTag
+	}
 
-	req := protocol.BuildProxyReq(
-		flags,
-		pkt.ExtConnID,
-		remoteIPv6,
-		uint32(pkt.ClientPort),
-		ourIPv6,
-		uint32(dp.ourPort),
-		dp.proxyTag,
-		data,
-	)
+	if pkt.FrameID != "" {
+		log.Printf("dataplane: frame=%s dc=%d -> %s flags=0x%x len=%d", pkt.FrameID, pkt.TargetDC, target.Addr, flags, len(data))
+	}
 
-	resp, err := dp.outbound.ForwardPacket(target.Addr, req)
+	forwardStart := time.Now()
+	resp, err := dp.outbound.ForwardTargetTraced(target, req, pkt.Trace)
+	dp.stats.ObserveRoute(target.Canary, time.Since(forwardStart), err != nil)
 	if err != nil {
+		dp.router.Unpin(authKeyID)
 		dp.stats.IncDroppedQuery()
 		return nil, fmt.Errorf("dataplane: forward to %s: %w", target.Addr, err)
 	}
+	if pkt.FrameID != "" {
+		log.Printf("dataplane: frame=%s answer from %s len=%d", pkt.FrameID, target.Addr, len(resp))
+	}
 
 	dp.stats.IncForwardedQuery()
+	dp.stats.IncTaggedForward(tagged)
 	dp.stats.AddBytesIn(int64(len(data)))
 	dp.stats.AddBytesOut(int64(len(resp)))
 
 	return resp, nil
 }
 
+// proxyReq заворачивает пакет клиента в RPC_PROXY_REQ. Если задан
+// proxy-тег (-P), он добавляется в extra-поля (TL_PROXY_TAG) с флагом
+// FlagProxyTag: по нему middle-прокси показывает спонсорский канал,
+// зарегистрированный в @MTProxybot. tagged сообщает, добавлен ли тег.
+// req взят из dp.buffers: после отправки его нужно вернуть.
+func (dp *DataPlane) proxyReq(pkt IncomingPacket, flags uint32) (req []byte, tagged bool) {
+	tagged = len(dp.proxyTag) == 16
+	if tagged {
+		flags |= protocol.FlagProxyTag // 0x8
+	}
+	ourIP, ourPort := dp.ourIP, dp.ourPort
+	if pkt.LocalIP != nil {
+		ourIP, ourPort = pkt.LocalIP, pkt.LocalPort
+	}
+	req = protocol.AppendProxyReq(
+		dp.buffers.Get(protocol.ProxyReqMaxOverhead + len(pkt.Data))[:0],
+		flags,
+		pkt.ExtConnID,
+		ipToIPv6Wire(pkt.ClientIP),
+		uint32(pkt.ClientPort),
+		ipToIPv6Wire(natTranslate(dp.natInfo, ourIP)),
+		uint32(ourPort),
+		dp.proxyTag,
+		pkt.Data,
+	)
+	return req, tagged
+}
+
 // validateDHPacket проверяет, что нешифрованный пакет является допустимым DH-запросом.
 func validateDHPacket(data []byte) error {
 	if len(data) < 24 {
@@ -126,6 +187,23 @@ func validateDHPacket(data []byte) error {
 	return fmt.Errorf("unknown DH function: 0x%08x", function)
 }
 
+// natTranslate заменяет локальный IPv4-адрес публичным по правилам
+// --nat-info, как nat_translate_ip() в C: за NAT middle-прокси должен видеть
+// в our_ip адрес, на который приходят клиенты. Остальные адреса не меняются.
+func natTranslate(natInfo map[uint32]uint32, ip net.IP) net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil || natInfo == nil {
+		return ip
+	}
+	pub, ok := natInfo[binary.BigEndian.Uint32(ip4)]
+	if !ok {
+		return ip
+	}
+	out := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(out, pub)
+	return out
+}
+
 // ipToIPv6Wire конвертирует net.IP в 16-байтный wire-формат.
 // IPv4 адреса кодируются как IPv4-mapped IPv6.
 func ipToIPv6Wire(ip net.IP) [16]byte {
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
 	"testing"
 
@@ -73,6 +74,36 @@ func TestDataPlane_HandlePacket_BadDHFunction(t *testing.T) {
 	}
 }
 
+// TestDataPlane_DCCounters checks the per-DC routed-frame counters, kept
+// for configured clusters only, and the unknown DC counter, both for frames
+// routed to the default cluster and for one dropped because there is none.
+func TestDataPlane_DCCounters(t *testing.T) {
+	stats := NewStats()
+	dp := NewDataPlane(makeTestRouterDP(), NewOutboundProxy(OutboundConfig{}), stats, nil)
+	for _, dc := range []int16{2, -2, 7} {
+		dp.HandlePacket(makeIncomingDP(makeEncPacketDP(), dc)) //nolint:errcheck
+	}
+	snap := stats.Snapshot(0)
+	for _, key := range []string{"dc_-2_routed_frames", "dc_7_routed_frames"} {
+		if _, ok := snap[key]; ok {
+			t.Errorf("%s counted for a DC without a cluster", key)
+		}
+	}
+	for key, want := range map[string]int64{"dc_2_routed_frames": 1, "unknown_dc_frames": 2} {
+		if snap[key] != want {
+			t.Errorf("%s = %d, want %d", key, snap[key], want)
+		}
+	}
+
+	dp = NewDataPlane(NewRouter(&config.Config{DefaultClusterID: 2}), NewOutboundProxy(OutboundConfig{}), stats, nil)
+	if _, err := dp.HandlePacket(makeIncomingDP(makeEncPacketDP(), 4)); !errors.Is(err, ErrUnknownDC) {
+		t.Errorf("HandlePacket without clusters: %v, want ErrUnknownDC", err)
+	}
+	if n := stats.Snapshot(0)["unknown_dc_frames"]; n != 3 {
+		t.Errorf("unknown_dc_frames = %d, want 3", n)
+	}
+}
+
 func TestDataPlane_DroppedOnShort(t *testing.T) {
 	out := NewOutboundProxy(OutboundConfig{})
 	stats := NewStats()
@@ -158,3 +189,91 @@ func TestIPToIPv6Wire_Nil(t *testing.T) {
 		t.Error("nil IP should give zero result")
 	}
 }
+
+func TestDataPlane_ProxyReqTag(t *testing.T) {
+	tag := []byte("0123456789abcdef")
+	pkt := makeIncomingDP(makeEncPacketDP(), 2)
+	pkt.ExtConnID = 77
+
+	req, tagged := makeTestDP(tag).proxyReq(pkt, protocol.FlagExtNode)
+	if !tagged {
+		t.Fatal("tag not reported as added")
+	}
+	if flags := binary.LittleEndian.Uint32(req[4:8]); flags&protocol.FlagProxyTag == 0 {
+		t.Errorf("flags = 0x%x, FlagProxyTag not set", flags)
+	}
+	// type, flags, ext_conn_id, remote and our addresses: 4+4+8+20+20 bytes,
+	// then the extra size and TL_PROXY_TAG with the tag as a TL string.
+	extra := req[56:]
+	if size := binary.LittleEndian.Uint32(extra); size != protocol.ProxyTagExtraBytes {
+		t.Fatalf("extra size = %d, want %d", size, protocol.ProxyTagExtraBytes)
+	}
+	if binary.LittleEndian.Uint32(extra[4:]) != protocol.TLProxyTag || extra[8] != 16 || string(extra[9:25]) != string(tag) {
+		t.Errorf("extra = %x", extra[:4+protocol.ProxyTagExtraBytes])
+	}
+	if got := req[56+4+protocol.ProxyTagExtraBytes:]; string(got) != string(pkt.Data) {
+		t.Error("client packet not at the end of the request")
+	}
+
+	req, tagged = makeTestDP(nil).proxyReq(pkt, protocol.FlagExtNode)
+	if tagged || binary.LittleEndian.Uint32(req[4:8])&protocol.FlagProxyTag != 0 {
+		t.Error("untagged data plane set FlagProxyTag")
+	}
+	if len(req) != 56+len(pkt.Data) {
+		t.Errorf("untagged request of %d bytes, want no extra fields", len(req))
+	}
+}
+
+// TestDataPlane_ProxyReqNAT checks that our_ip carries the public address of
+// a --nat-info rule and our_port the port the client connected to.
+func TestDataPlane_ProxyReqNAT(t *testing.T) {
+	out := NewOutboundProxy(OutboundConfig{NatInfo: map[uint32]uint32{0x0A00010A: 0xCB007105}}) // 10.0.1.10 → 203.0.113.5
+	dp := NewDataPlane(makeTestRouterDP(), out, NewStats(), nil)
+	pkt := makeIncomingDP(makeEncPacketDP(), 2)
+
+	for _, tc := range []struct {
+		local, want string
+	}{
+		{"10.0.1.10", "203.0.113.5"},
+		{"10.0.1.11", "10.0.1.11"},
+		{"2001:db8::1", "2001:db8::1"},
+	} {
+		pkt.LocalIP, pkt.LocalPort = net.ParseIP(tc.local), 443
+		req, _ := dp.proxyReq(pkt, protocol.FlagExtNode)
+		if got := net.IP(req[36:52]); !got.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("local %s: our_ip = %s, want %s", tc.local, got, tc.want)
+		}
+		if port := binary.LittleEndian.Uint32(req[52:56]); port != 443 {
+			t.Errorf("local %s: our_port = %d, want 443", tc.local, port)
+		}
+	}
+}
+
+func TestDataPlane_LoopbackBackend(t *testing.T) {
+	for _, tag := range [][]byte{nil, []byte("0123456789abcdef")} {
+		out := NewOutboundProxy(OutboundConfig{Loopback: true})
+		stats := NewStats()
+		dp := NewDataPlane(makeTestRouterDP(), out, stats, tag)
+		pkt := makeEncPacketDP()
+		pkt[40] = 0x5a
+
+		// The target in makeTestRouterDP does not listen; only the
+		// loopback answers.
+		resp, err := dp.HandlePacket(makeIncomingDP(pkt, 2))
+		if err != nil {
+			t.Fatalf("tag=%x: HandlePacket: %v", tag, err)
+		}
+		if string(resp) != string(pkt) {
+			t.Errorf("tag=%x: answer %x, want the client packet %x", tag, resp, pkt)
+		}
+		if got := stats.Snapshot(0)["tot_forwarded_queries"]; got != 1 {
+			t.Errorf("tag=%x: tot_forwarded_queries = %d, want 1", tag, got)
+		}
+	}
+	if err := NewOutboundProxy(OutboundConfig{Loopback: true}).Probe("127.0.0.1:1"); err != nil {
+		t.Errorf("loopback probe: %v", err)
+	}
+	if _, err := loopbackAnswer(make([]byte, 56)); err == nil {
+		t.Error("loopbackAnswer accepted a frame that is not RPC_PROXY_REQ")
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// decoyDialTimeout bounds connecting to the decoy backend for a client
+// that is not one of ours.
+const decoyDialTimeout = 5 * time.Second
+
+// decoyPrefixes are first bytes Telegram clients never send as an
+// obfuscated2 header (they draw a new one when it starts with these): plain
+// HTTP methods and a TLS ClientHello record. A connection starting with one
+// is a browser or a probe and can go to the decoy before 64 bytes arrive.
+var decoyPrefixes = []string{"GET ", "POST", "HEAD", "OPTI", "\x16\x03\x01\x02"}
+
+// isDecoyPrefix reports whether the first four bytes b rule out an
+// obfuscated2 client.
+func isDecoyPrefix(b []byte) bool {
+	for _, p := range decoyPrefixes {
+		if string(b) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// relayDecoy hands a connection that is not a proxy client to the decoy
+// backend at addr, so a probe sees an ordinary web server instead of a
+// connection that closes at once. consumed is what was already read from
+// the client. It returns when either side closes. On Linux the bytes are
+// spliced between the sockets in the kernel and counted in stats.
+func relayDecoy(conn net.Conn, addr string, consumed []byte, idle *IdleTimer, stats *Stats) error {
+	upstream, err := net.DialTimeout("tcp", addr, decoyDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	if _, err := upstream.Write(consumed); err != nil {
+		return err
+	}
+	idle.Reset(clientIdleTimeout)
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		defer processCrash.Load().Recover()
+		defer func() { done <- struct{}{} }()
+		n, ok, _ := spliceCopy(dst, src, idle.Touch)
+		if stats != nil && n > 0 {
+			stats.AddSplicedBytes(n)
+		}
+		if !ok {
+			io.Copy(dst, touchReader{src, idle})
+		}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	conn.Close()
+	upstream.Close()
+	<-done
+	return nil
+}
+
+// touchReader touches an idle timer on every read.
+type touchReader struct {
+	r    io.Reader
+	idle *IdleTimer
+}
+
+func (t touchReader) Read(p []byte) (int, error) {
+	t.idle.Touch()
+	return t.r.Read(p)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestIsDecoyPrefix(t *testing.T) {
+	for _, b := range []string{"GET ", "POST", "HEAD", "OPTI", "\x16\x03\x01\x02"} {
+		if !isDecoyPrefix([]byte(b)) {
+			t.Errorf("%q is not a decoy prefix", b)
+		}
+	}
+	for _, b := range []string{"PUT ", "\xef\x00\x00\x00", "GET"} {
+		if isDecoyPrefix([]byte(b)) {
+			t.Errorf("%q is a decoy prefix", b)
+		}
+	}
+}
+
+// TestClientIngress_Decoy checks that an HTTP request and a header that
+// matches no secret both reach the decoy backend unchanged, and that the
+// decoy's answer reaches the client.
+func TestClientIngress_Decoy(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		for {
+			c, err := decoy.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 64)
+			n, _ := io.ReadAtLeast(c, buf, 18)
+			got <- buf[:n]
+			c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			c.Close()
+		}
+	}()
+
+	secret := bytes.Repeat([]byte{1}, 16)
+	stats := NewStats()
+	s := NewClientIngressServer("127.0.0.1:0", [][]byte{secret}, nil, nil)
+	s.SetStats(stats)
+	s.SetDecoyAddr(decoy.Addr().String())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(conn, nil)
+		}
+	}()
+
+	wrong := buildRawHeader(t, bytes.Repeat([]byte{2}, 16), TransportMagicIntermediate, 2)
+	for _, req := range [][]byte{[]byte("GET / HTTP/1.1\r\n\r\n"), wrong[:]} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(resp) != "HTTP/1.1 200 OK\r\n\r\n" {
+			t.Fatalf("response %q, %v", resp, err)
+		}
+		if seen := <-got; !bytes.Equal(seen, req) {
+			t.Errorf("decoy got %q, want %q", seen, req)
+		}
+	}
+	// The count is taken after the relay returns, just after the client
+	// saw its connection close.
+	deadline := time.Now().Add(2 * time.Second)
+	for stats.Snapshot(1)["decoy_relayed"] != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := stats.Snapshot(1)["decoy_relayed"]; n != 2 {
+		t.Errorf("decoy_relayed = %d, want 2", n)
+	}
+	if n := stats.Snapshot(1)["spliced_bytes"]; runtime.GOOS == "linux" && n == 0 {
+		t.Error("spliced_bytes = 0 on Linux")
+	}
+}
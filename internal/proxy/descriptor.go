@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// Descriptor describes a running proxy for deployment automation that
+// registers it with @MTProxybot or an operator inventory. Secrets appear
+// only as fingerprints; the automation is expected to know the secrets it
+// provisioned and match them by fingerprint.
+type Descriptor struct {
+	Implementation string             `json:"implementation"`
+	Version        string             `json:"version"`
+	Host           string             `json:"host,omitempty"`
+	PublicAddrs    []string           `json:"public_addrs,omitempty"`
+	Port           int                `json:"port"`
+	Secrets        []DescriptorSecret `json:"secrets"`
+	ProxyTag       string             `json:"proxy_tag,omitempty"`
+	TLSDomains     []string           `json:"tls_domains,omitempty"`
+	Standby        bool               `json:"standby"`
+	GeneratedAt    time.Time          `json:"generated_at"`
+}
+
+// DescriptorSecret identifies one accepted secret.
+type DescriptorSecret struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+// buildDescriptor assembles a Descriptor. listenAddr supplies the port; its
+// host part is used only when publicHost is empty and it is not a wildcard.
+// publicAddrs are every public address of the --nat-info rules: on a host
+// with several addresses clients may reach the proxy at any of them.
+func buildDescriptor(publicHost, listenAddr string, publicAddrs []string, secrets [][]byte, proxyTag []byte, domains []string, standby bool, now time.Time) (Descriptor, error) {
+	host, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("descriptor: listen address %q: %w", listenAddr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("descriptor: listen port %q: %w", portStr, err)
+	}
+	if publicHost != "" {
+		host = publicHost
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+
+	d := Descriptor{
+		Implementation: implementationName,
+		Version:        proxyVersion,
+		Host:           host,
+		PublicAddrs:    publicAddrs,
+		Port:           port,
+		Secrets:        make([]DescriptorSecret, 0, len(secrets)),
+		TLSDomains:     domains,
+		Standby:        standby,
+		GeneratedAt:    now.UTC(),
+	}
+	for _, s := range secrets {
+		d.Secrets = append(d.Secrets, DescriptorSecret{Fingerprint: secretFingerprint(s)})
+	}
+	if len(proxyTag) > 0 {
+		d.ProxyTag = hex.EncodeToString(proxyTag)
+	}
+	return d, nil
+}
+
+// WriteDescriptor writes d to path as indented JSON. The file is replaced
+// atomically so readers never see a partial descriptor.
+func WriteDescriptor(path string, d Descriptor) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := config.WriteFileAtomic(path, data, 0o644, nil); err != nil {
+		return fmt.Errorf("descriptor: %w", err)
+	}
+	return nil
+}
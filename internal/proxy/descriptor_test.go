@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildDescriptor(t *testing.T) {
+	secret := make([]byte, 16)
+	tag := []byte{0xab, 0xcd}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	d, err := buildDescriptor("", ":443", nil, [][]byte{secret}, tag, nil, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Host != "" || d.Port != 443 {
+		t.Errorf("host=%q port=%d, want empty host and 443", d.Host, d.Port)
+	}
+	if len(d.Secrets) != 1 || d.Secrets[0].Fingerprint != secretFingerprint(secret) {
+		t.Errorf("secrets = %+v", d.Secrets)
+	}
+	if d.ProxyTag != "abcd" {
+		t.Errorf("proxy_tag = %q, want abcd", d.ProxyTag)
+	}
+
+	d, err = buildDescriptor("proxy.example.com", "0.0.0.0:8888", []string{"203.0.113.5"}, nil, nil, []string{"example.com"}, true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Host != "proxy.example.com" || !d.Standby || len(d.Secrets) != 0 || len(d.PublicAddrs) != 1 {
+		t.Errorf("got %+v", d)
+	}
+
+	if _, err := buildDescriptor("", "no-port", nil, nil, nil, nil, false, now); err == nil {
+		t.Error("expected error for listen address without port")
+	}
+}
+
+func TestWriteDescriptor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	want := Descriptor{Implementation: "go", Port: 443, Secrets: []DescriptorSecret{{Fingerprint: "00"}}}
+	if err := WriteDescriptor(path, want); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Descriptor
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Port != 443 || len(got.Secrets) != 1 || got.Secrets[0].Fingerprint != "00" {
+		t.Errorf("round trip = %+v", got)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temp file left behind: %d entries", len(entries))
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// durationRingSize is the number of most recent durations a durationRing
+// keeps to compute its percentiles.
+const durationRingSize = 1024
+
+// durationRing keeps the most recent durations, in µs, for percentiles over
+// them. Observe is lock-free, so hot paths record every event; the zero
+// value is ready to use.
+type durationRing struct {
+	samples [durationRingSize]atomic.Int64
+	next    atomic.Uint64 // durations recorded so far
+}
+
+// Observe records d, replacing the oldest duration once the ring is full.
+func (r *durationRing) Observe(d time.Duration) {
+	i := r.next.Add(1) - 1
+	r.samples[i%durationRingSize].Store(d.Microseconds())
+}
+
+// Count returns the number of durations recorded so far.
+func (r *durationRing) Count() int64 {
+	return int64(r.next.Load())
+}
+
+// Percentiles returns the given percentiles (0-100) of the durations in the
+// ring, all 0 before any was recorded.
+func (r *durationRing) Percentiles(ps ...int) []time.Duration {
+	out := make([]time.Duration, len(ps))
+	n := min(r.next.Load(), durationRingSize)
+	if n == 0 {
+		return out
+	}
+	samples := make([]int64, n)
+	for i := range samples {
+		samples[i] = r.samples[i].Load()
+	}
+	slices.Sort(samples)
+	for i, p := range ps {
+		idx := max((len(samples)*p+99)/100-1, 0)
+		out[i] = time.Duration(samples[idx]) * time.Microsecond
+	}
+	return out
+}
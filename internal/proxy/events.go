@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DefaultEventLogSize is the number of events kept by the runtime.
+const DefaultEventLogSize = 10000
+
+// EventKind classifies an entry in the EventLog.
+type EventKind uint8
+
+const (
+	EventConnOpen EventKind = iota + 1
+	EventConnClose
+	EventReload
+	EventActivate
+	EventBlocked
+	EventDrain
+	EventClockStep
+	EventTargetHealthy
+	EventTargetUnhealthy
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventConnOpen:
+		return "conn_open"
+	case EventConnClose:
+		return "conn_close"
+	case EventReload:
+		return "reload"
+	case EventActivate:
+		return "activate"
+	case EventBlocked:
+		return "blocked"
+	case EventDrain:
+		return "drain"
+	case EventClockStep:
+		return "clock_step"
+	case EventTargetHealthy:
+		return "target_healthy"
+	case EventTargetUnhealthy:
+		return "target_unhealthy"
+	}
+	return "unknown"
+}
+
+// Connection close reasons recorded in conn_close events.
+const (
+	CloseBadHeader     = "bad_header"
+	CloseNoSecret      = "no_secret"
+	CloseFakeTLS       = "faketls_rejected"
+	CloseDecoy         = "decoy"
+	CloseSecretWindow  = "secret_window"
+	CloseDenied        = "authorizer_denied"
+	CloseOverload      = "overload"
+	CloseSurge         = "surge"
+	CloseIPLimit       = "ip_limit"
+	CloseEOF           = "eof"
+	CloseReadError     = "read_error"
+	CloseFrameTooLarge = "frame_too_large"
+	CloseDataplane     = "dataplane_error"
+	CloseWriteError    = "write_error"
+	CloseHTTPStats     = "http_stats"
+	CloseSecretRevoked = "secret_revoked"
+)
+
+// Event is one entry in the EventLog. Every field is a value type or a
+// string the caller already holds, so recording does not allocate.
+type Event struct {
+	Time   time.Time
+	Kind   EventKind
+	ConnID string
+	Addr   netip.AddrPort
+	Reason string
+}
+
+// EventLog keeps the last N significant events in a fixed ring so they can
+// be inspected via /debug/events without verbose logging. A nil *EventLog
+// discards events.
+type EventLog struct {
+	mu    sync.Mutex
+	ring  []Event
+	next  int    // slot for the next event
+	total uint64 // events recorded since start
+}
+
+// NewEventLog creates an EventLog holding the last size events.
+func NewEventLog(size int) *EventLog {
+	if size < 1 {
+		size = 1
+	}
+	return &EventLog{ring: make([]Event, size)}
+}
+
+// Record stores an event, overwriting the oldest one when the ring is full.
+func (l *EventLog) Record(kind EventKind, connID string, addr netip.AddrPort, reason string) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	l.ring[l.next] = Event{Time: now, Kind: kind, ConnID: connID, Addr: addr, Reason: reason}
+	l.next++
+	if l.next == len(l.ring) {
+		l.next = 0
+	}
+	l.total++
+	l.mu.Unlock()
+}
+
+// Events returns up to n most recent events, oldest first; n <= 0 means all.
+func (l *EventLog) Events(n int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	have := len(l.ring)
+	if l.total < uint64(have) {
+		have = int(l.total)
+	}
+	if n <= 0 || n > have {
+		n = have
+	}
+	out := make([]Event, n)
+	start := l.next - n
+	if start < 0 {
+		start += len(l.ring)
+	}
+	for i := range out {
+		out[i] = l.ring[(start+i)%len(l.ring)]
+	}
+	return out
+}
+
+// Total returns the number of events recorded since start, including the
+// ones already overwritten.
+func (l *EventLog) Total() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// writeEventsText writes events one per line:
+// "<RFC3339Nano>\t<kind>\t<conn>\t<addr>\t<reason>", with "-" for empty fields.
+func writeEventsText(w io.Writer, events []Event) {
+	for _, e := range events {
+		addr := "-"
+		if e.Addr.IsValid() {
+			addr = e.Addr.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			e.Time.UTC().Format(time.RFC3339Nano), e.Kind, orDash(e.ConnID), addr, orDash(e.Reason))
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// eventAddr converts a client IP and port to a netip.AddrPort without
+// allocating.
+func eventAddr(ip net.IP, port int) netip.AddrPort {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port))
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestEventLogRing(t *testing.T) {
+	l := NewEventLog(3)
+	if got := l.Events(0); len(got) != 0 {
+		t.Fatalf("empty log returned %d events", len(got))
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		l.Record(EventConnOpen, id, netip.AddrPort{}, "")
+	}
+	got := l.Events(0)
+	if len(got) != 3 || got[0].ConnID != "b" || got[2].ConnID != "d" {
+		t.Fatalf("events = %+v, want b..d", got)
+	}
+	if last := l.Events(1); len(last) != 1 || last[0].ConnID != "d" {
+		t.Errorf("Events(1) = %+v, want d", last)
+	}
+	if l.Total() != 4 {
+		t.Errorf("Total = %d, want 4", l.Total())
+	}
+
+	var sb strings.Builder
+	l.Record(EventConnClose, "e", eventAddr(net.ParseIP("10.0.0.1"), 443), CloseNoSecret)
+	writeEventsText(&sb, l.Events(1))
+	if line := sb.String(); !strings.Contains(line, "\tconn_close\te\t10.0.0.1:443\tno_secret\n") {
+		t.Errorf("text line = %q", line)
+	}
+}
+
+// TestEventLogRecordNoAlloc verifies that recording an event does not allocate.
+func TestEventLogRecordNoAlloc(t *testing.T) {
+	l := NewEventLog(16)
+	ip := net.ParseIP("192.0.2.1")
+	allocs := testing.AllocsPerRun(100, func() {
+		l.Record(EventConnClose, "conn", eventAddr(ip, 1234), CloseReadError)
+	})
+	if allocs != 0 {
+		t.Errorf("Record allocated %.1f times per call", allocs)
+	}
+}
+
+func TestEventLogNil(t *testing.T) {
+	var l *EventLog
+	l.Record(EventReload, "", netip.AddrPort{}, "ok")
+}
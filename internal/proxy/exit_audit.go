@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exitAuditSettle is how long the exit audit (--exit-audit) waits for
+// resources that are still unwinding — read loops of sockets closed a
+// moment ago, handlers returning after a forced close — before it reports
+// them as leaked.
+const exitAuditSettle = 2 * time.Second
+
+// exitAuditAllowed lists the functions whose goroutines legitimately
+// outlive Shutdown: the main goroutine and the one running Shutdown, the
+// process-wide timer wheel and signal delivery. A goroutine is allowed if
+// any of its frames runs one of them; an entry ending in "." covers a
+// whole package.
+var exitAuditAllowed = []string{
+	"main.main",
+	"proxy.(*Runtime).Start",
+	"proxy.(*Runtime).Shutdown",
+	"proxy.(*TimerWheel).run",
+	"os/signal.",
+	"testing.",
+}
+
+// ExitLeak is one resource the exit audit found still open after
+// Shutdown.
+type ExitLeak struct {
+	Kind   string // "listener", "outbound", "session" or "goroutine"
+	Detail string
+	Stack  string // the goroutine's stack; "" for the other kinds
+}
+
+// exitAuditor checks that a runtime released everything it opened; each
+// source is optional.
+type exitAuditor struct {
+	ingress  *ClientIngressServer
+	outbound *OutboundProxy
+	sessions *GracefulShutdown
+	allowed  []string
+}
+
+// run polls until nothing is leaked or settle has passed, and returns the
+// leaks left at the end.
+func (a *exitAuditor) run(settle time.Duration) []ExitLeak {
+	deadline := time.Now().Add(settle)
+	for {
+		leaks := a.check()
+		if len(leaks) == 0 || !time.Now().Before(deadline) {
+			return leaks
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// check lists what is open right now.
+func (a *exitAuditor) check() []ExitLeak {
+	var leaks []ExitLeak
+	if a.ingress != nil {
+		for _, addr := range a.ingress.openSockets() {
+			leaks = append(leaks, ExitLeak{Kind: "listener", Detail: addr + " still open"})
+		}
+		for _, st := range a.ingress.Listeners() {
+			if st.Connections > 0 {
+				leaks = append(leaks, ExitLeak{Kind: "session",
+					Detail: fmt.Sprintf("%d handlers still running on %s", st.Connections, st.Addr)})
+			}
+		}
+	}
+	if a.outbound != nil {
+		for _, c := range a.outbound.Conns() {
+			leaks = append(leaks, ExitLeak{Kind: "outbound", Detail: c.ID + " to " + c.Addr + " still open"})
+		}
+		if n := a.outbound.dialingCount(); n > 0 {
+			leaks = append(leaks, ExitLeak{Kind: "outbound", Detail: fmt.Sprintf("%d connects still in progress", n)})
+		}
+	}
+	if a.sessions != nil {
+		if n := a.sessions.Remaining(); n > 0 {
+			leaks = append(leaks, ExitLeak{Kind: "session", Detail: fmt.Sprintf("%d client connections still tracked", n)})
+		}
+	}
+	for _, g := range leakedGoroutines(goroutineDump(), a.allowed) {
+		leaks = append(leaks, ExitLeak{Kind: "goroutine", Detail: g.header, Stack: g.stack})
+	}
+	return leaks
+}
+
+// logExitLeaks logs the audit result, one line per leak followed by its
+// stack.
+func logExitLeaks(leaks []ExitLeak) {
+	if len(leaks) == 0 {
+		log.Println("exit-audit: clean, no listeners, connections or goroutines left")
+		return
+	}
+	for _, l := range leaks {
+		if l.Stack != "" {
+			log.Printf("exit-audit: leaked %s: %s\n%s", l.Kind, l.Detail, l.Stack)
+		} else {
+			log.Printf("exit-audit: leaked %s: %s", l.Kind, l.Detail)
+		}
+	}
+	log.Printf("exit-audit: %d leaks", len(leaks))
+}
+
+// socketClosed reports whether the listener or connection x has been
+// closed. known is false for values that do not expose their socket
+// (wrappers used in tests), which the audit cannot check.
+func socketClosed(x any) (closed, known bool) {
+	sc, ok := x.(syscall.Conn)
+	if !ok {
+		return false, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return true, true
+	}
+	return rc.Control(func(uintptr) {}) != nil, true
+}
+
+// openSockets returns the addresses of client listeners, TCP and UDP,
+// whose socket is still open.
+func (s *ClientIngressServer) openSockets() []string {
+	var open []string
+	for _, l := range s.listeners {
+		if l.inherited == nil {
+			continue
+		}
+		if closed, known := socketClosed(l.inherited); known && !closed {
+			open = append(open, "tcp "+l.Addr())
+		}
+	}
+	for _, l := range s.udp {
+		if l.pc == nil {
+			continue
+		}
+		if closed, known := socketClosed(l.pc); known && !closed {
+			open = append(open, "udp "+l.Addr())
+		}
+	}
+	return open
+}
+
+// dialingCount returns the number of backend connects in progress.
+func (p *OutboundProxy) dialingCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.dialing)
+}
+
+// goroutineStack is one goroutine of a runtime.Stack dump.
+type goroutineStack struct {
+	header string // "goroutine 12 [chan receive]"
+	stack  string
+}
+
+// goroutineDump returns the stacks of all goroutines.
+func goroutineDump() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// leakedGoroutines returns the goroutines of dump none of whose frames
+// runs a function in allowed. Only frames count: a goroutine started by an
+// allowed function is still reported.
+func leakedGoroutines(dump []byte, allowed []string) []goroutineStack {
+	var leaked []goroutineStack
+	for _, g := range bytes.Split(bytes.TrimSpace(dump), []byte("\n\n")) {
+		header, frames, _ := strings.Cut(string(g), "\n")
+		if !strings.HasPrefix(header, "goroutine ") || goroutineAllowed(frames, allowed) {
+			continue
+		}
+		leaked = append(leaked, goroutineStack{
+			header: strings.TrimSuffix(header, ":"),
+			stack:  frames,
+		})
+	}
+	return leaked
+}
+
+// goroutineAllowed reports whether one of the frames runs a function in
+// allowed. Function lines are the ones without a leading tab; "created by"
+// lines name the parent, not a frame.
+func goroutineAllowed(frames string, allowed []string) bool {
+	for _, line := range strings.Split(frames, "\n") {
+		if line == "" || line[0] == '\t' || strings.HasPrefix(line, "created by ") {
+			continue
+		}
+		fn := line
+		if i := strings.LastIndexByte(fn, '('); i > 0 {
+			fn = fn[:i]
+		}
+		for _, a := range allowed {
+			if funcMatches(fn, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// funcMatches reports whether the fully qualified function fn is entry, or
+// lies in the package entry when it ends in ".". Closures started by a
+// function (Start.func1) do not match it.
+func funcMatches(fn, entry string) bool {
+	if strings.HasSuffix(entry, ".") {
+		return strings.HasPrefix(fn, entry) || strings.Contains(fn, "/"+entry)
+	}
+	return fn == entry || strings.HasSuffix(fn, "/"+entry)
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakedGoroutines(t *testing.T) {
+	dump := []byte(`goroutine 1 [chan receive]:
+main.main()
+	/src/cmd/mtproto-proxy/main.go:272 +0x1a5
+
+goroutine 7 [select]:
+github.com/skrashevich/MTProxy/internal/proxy.(*TimerWheel).run(0xc000120000)
+	/src/internal/proxy/timer_wheel.go:160 +0x8d
+created by github.com/skrashevich/MTProxy/internal/proxy.NewTimerWheel in goroutine 1
+	/src/internal/proxy/timer_wheel.go:64 +0x125
+
+goroutine 21 [IO wait]:
+internal/poll.runtime_pollWait(0x7f, 0x72)
+	/go/src/runtime/netpoll.go:351 +0x85
+github.com/skrashevich/MTProxy/internal/proxy.(*rpcOutboundConn).readLoop(0xc0001a2000)
+	/src/internal/proxy/rpc_outbound.go:300 +0x45
+created by github.com/skrashevich/MTProxy/internal/proxy.(*Runtime).Start in goroutine 1
+	/src/internal/proxy/runtime.go:470 +0x2b
+
+goroutine 22 [chan receive]:
+github.com/skrashevich/MTProxy/internal/proxy.(*Runtime).Start.func3()
+	/src/internal/proxy/runtime.go:466 +0x3c
+created by github.com/skrashevich/MTProxy/internal/proxy.(*Runtime).Start in goroutine 1
+	/src/internal/proxy/runtime.go:464 +0x2b
+
+goroutine 9 [syscall]:
+os/signal.signal_recv()
+	/go/src/runtime/sigqueue.go:152 +0x29
+os/signal.loop()
+	/go/src/os/signal/signal_unix.go:23 +0x13
+`)
+	leaked := leakedGoroutines(dump, exitAuditAllowed)
+	if len(leaked) != 2 {
+		t.Fatalf("leaked = %+v, want goroutines 21 and 22", leaked)
+	}
+	if leaked[0].header != "goroutine 21 [IO wait]" || !strings.Contains(leaked[0].stack, "readLoop") {
+		t.Errorf("leaked[0] = %+v", leaked[0])
+	}
+	if leaked[1].header != "goroutine 22 [chan receive]" {
+		t.Errorf("leaked[1] = %+v, want the closure started by Start", leaked[1])
+	}
+}
+
+func TestSocketClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed, known := socketClosed(ln); closed || !known {
+		t.Errorf("open listener: closed=%v known=%v", closed, known)
+	}
+	ln.Close()
+	if closed, known := socketClosed(ln); !closed || !known {
+		t.Errorf("closed listener: closed=%v known=%v", closed, known)
+	}
+	if _, known := socketClosed(struct{}{}); known {
+		t.Error("a value without a socket is reported as known")
+	}
+}
+
+// exitAuditParked blocks until release is closed; the audit test looks
+// for it by name.
+func exitAuditParked(parked chan<- struct{}, release <-chan struct{}) {
+	close(parked)
+	<-release
+}
+
+func TestExitAuditor(t *testing.T) {
+	ing := NewClientIngressServer("127.0.0.1:0", nil, nil, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ing.listeners[0].SetListener(ln)
+	sessions := NewGracefulShutdown()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sessions.Track(c1)
+	parked, release := make(chan struct{}), make(chan struct{})
+	go exitAuditParked(parked, release)
+	<-parked
+
+	a := exitAuditor{ingress: ing, sessions: sessions, allowed: exitAuditAllowed}
+	kinds := func(leaks []ExitLeak) map[string]bool {
+		found := make(map[string]bool)
+		for _, l := range leaks {
+			if l.Kind == "goroutine" && !strings.Contains(l.Stack, "exitAuditParked") {
+				continue // other tests' goroutines
+			}
+			found[l.Kind] = true
+		}
+		return found
+	}
+	if got := kinds(a.check()); !got["listener"] || !got["session"] || !got["goroutine"] {
+		t.Fatalf("before release: leak kinds %v, want listener, session and goroutine", got)
+	}
+
+	ln.Close()
+	sessions.Untrack(c1)
+	close(release)
+	if got := kinds(a.run(2 * time.Second)); len(got) != 0 {
+		t.Errorf("after release: leak kinds %v, want none", got)
+	}
+}
@@ -0,0 +1,370 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fake TLS ("ee" secrets): the client disguises the obfuscated2 stream as a
+// TLS 1.3 session with one of the -D domains. The ClientHello random is an
+// HMAC of the hello keyed by the proxy secret, so the proxy can tell its
+// clients apart from real browsers and active probes, and answers with a
+// ServerHello whose random is keyed the same way. Port of
+// tcp_rpcs_compact_parse_execute in net-tcp-rpc-ext-server.c.
+
+const (
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordHandshake        = 0x16
+	tlsRecordApplicationData  = 0x17
+
+	// tlsMaxClientHello bounds the ClientHello record the proxy accepts.
+	tlsMaxClientHello = 4096
+
+	// tlsMaxRecordPayload is the payload size of the application data
+	// records written to the client, as in the C proxy.
+	tlsMaxRecordPayload = 1425
+
+	// tlsMaxFutureSkew and tlsMaxPastSkew bound the ClientHello timestamp
+	// when the replay cache cannot vouch for it.
+	tlsMaxFutureSkew = 3 * time.Second
+	tlsMaxPastSkew   = 10 * time.Minute
+
+	// tlsReplayWindow is how long a ClientHello random is remembered, and
+	// tlsReplayMaxEntries caps the cache.
+	tlsReplayWindow     = 48 * time.Hour
+	tlsReplayMaxEntries = 1 << 20
+)
+
+// Reasons a client fails the fake TLS check, reported in FakeTLSError.
+const (
+	FakeTLSBadHello  = "bad_hello"  // malformed, or not for a -D domain
+	FakeTLSBadDigest = "bad_digest" // random does not match any secret
+	FakeTLSBadTime   = "bad_time"   // timestamp in the future or too old
+	FakeTLSReplay    = "replay"     // random seen before
+	FakeTLSNoCipher  = "no_cipher"  // no TLS 1.3 cipher suite offered
+	FakeTLSNotTLS    = "not_tls"    // plain obfuscated2 while -D is set
+)
+
+// FakeTLSError is returned when a ClientHello fails the fake TLS check.
+type FakeTLSError struct {
+	Reason string // FakeTLS* constant
+	Detail string
+}
+
+func (e *FakeTLSError) Error() string {
+	return fmt.Sprintf("fake tls: %s: %s", e.Reason, e.Detail)
+}
+
+func fakeTLSErrorf(reason, format string, args ...any) error {
+	return &FakeTLSError{Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// fakeTLS validates ClientHellos and builds ServerHellos for the -D domains.
+type fakeTLS struct {
+	domains []string // the first one receives clients that fail the check
+	replay  *clientRandomCache
+}
+
+// newFakeTLS enables fake TLS for domains; nil when none are given.
+func newFakeTLS(domains []string, now time.Time) *fakeTLS {
+	if len(domains) == 0 {
+		return nil
+	}
+	return &fakeTLS{domains: domains, replay: newClientRandomCache(now)}
+}
+
+func (f *fakeTLS) knownDomain(sni string) bool {
+	for _, d := range f.domains {
+		if d == sni {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHelloLen returns the size of the ClientHello record whose header
+// starts b, or 0 if b does not start a ClientHello record.
+func clientHelloLen(b []byte) int {
+	if len(b) < 6 || b[0] != tlsRecordHandshake || b[1] != 0x03 || b[2] != 0x01 || b[5] != 0x01 {
+		return 0
+	}
+	return 5 + int(binary.BigEndian.Uint16(b[3:5]))
+}
+
+// parseClientHello checks the fixed layout a Telegram client uses and
+// returns the SNI and the offered cipher suites.
+func parseClientHello(hello []byte) (sni string, ciphers []byte, err error) {
+	// record header (5), handshake header (4), version (2), random (32),
+	// session id length (1) and a 32-byte session id
+	const sessionEnd = 11 + 32 + 1 + 32
+	if len(hello) < sessionEnd+2 || hello[43] != 32 {
+		return "", nil, fakeTLSErrorf(FakeTLSBadHello, "truncated or no 32-byte session id")
+	}
+	pos := sessionEnd
+	n := int(binary.BigEndian.Uint16(hello[pos:]))
+	pos += 2
+	if pos+n+4 > len(hello) {
+		return "", nil, fakeTLSErrorf(FakeTLSBadHello, "cipher suites overrun the hello")
+	}
+	ciphers = hello[pos : pos+n]
+	pos += n + 4 // compression methods (1 + 1) and extensions length (2)
+
+	for pos+4 <= len(hello) {
+		id := binary.BigEndian.Uint16(hello[pos:])
+		size := int(binary.BigEndian.Uint16(hello[pos+2:]))
+		pos += 4
+		if pos+size > len(hello) {
+			break
+		}
+		if id == 0 { // server_name
+			ext := hello[pos : pos+size]
+			if size < 5 || int(binary.BigEndian.Uint16(ext)) != size-2 || ext[2] != 0 ||
+				int(binary.BigEndian.Uint16(ext[3:])) != size-5 {
+				return "", nil, fakeTLSErrorf(FakeTLSBadHello, "malformed server_name")
+			}
+			name := ext[5:]
+			if bytes.IndexByte(name, 0) >= 0 {
+				return "", nil, fakeTLSErrorf(FakeTLSBadHello, "NUL in server_name")
+			}
+			return string(name), ciphers, nil
+		}
+		pos += size
+	}
+	return "", nil, fakeTLSErrorf(FakeTLSBadHello, "no server_name")
+}
+
+// tls13Cipher returns the first TLS 1.3 suite (0x1301..0x1303) offered,
+// skipping GREASE values, or 0.
+func tls13Cipher(ciphers []byte) byte {
+	for len(ciphers) >= 2 && ciphers[0]&0x0f == 0x0a && ciphers[1]&0x0f == 0x0a {
+		ciphers = ciphers[2:]
+	}
+	if len(ciphers) < 2 || ciphers[0] != 0x13 || ciphers[1] < 0x01 || ciphers[1] > 0x03 {
+		return 0
+	}
+	return ciphers[1]
+}
+
+// handshake checks a complete ClientHello record against secrets and, on
+// success, returns the matching secret and the ServerHello flight to send.
+// hello is modified: its random is zeroed for the digest.
+func (f *fakeTLS) handshake(hello []byte, secrets [][]byte, now time.Time) (secret, serverHello []byte, err error) {
+	sni, ciphers, err := parseClientHello(hello)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !f.knownDomain(sni) {
+		return nil, nil, fakeTLSErrorf(FakeTLSBadHello, "unknown domain %q", sni)
+	}
+
+	var clientRandom [32]byte
+	copy(clientRandom[:], hello[11:43])
+	clear(hello[11:43])
+	var digest []byte
+	for _, s := range secrets {
+		mac := hmac.New(sha256.New, s)
+		mac.Write(hello)
+		digest = mac.Sum(digest[:0])
+		if hmac.Equal(digest[:28], clientRandom[:28]) {
+			secret = s
+			break
+		}
+	}
+	if secret == nil {
+		return nil, nil, fakeTLSErrorf(FakeTLSBadDigest, "client random matches no secret")
+	}
+
+	ts := time.Unix(int64(binary.LittleEndian.Uint32(digest[28:])^binary.LittleEndian.Uint32(clientRandom[28:])), 0)
+	if !f.replay.add(clientRandom, now) {
+		return nil, nil, fakeTLSErrorf(FakeTLSReplay, "client random seen before")
+	}
+	if !f.replay.timestampAllowed(ts, now) {
+		return nil, nil, fakeTLSErrorf(FakeTLSBadTime, "timestamp %s, now %s", ts.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+	}
+
+	cipher := tls13Cipher(ciphers)
+	if cipher == 0 {
+		return nil, nil, fakeTLSErrorf(FakeTLSNoCipher, "no TLS 1.3 cipher suite offered")
+	}
+
+	serverHello, err = buildServerHello(secret, clientRandom[:], hello[44:76], cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, serverHello, nil
+}
+
+// buildServerHello builds the proxy's answer: a ServerHello with key_share
+// and supported_versions, a dummy ChangeCipherSpec and one application data
+// record of random bytes standing in for the encrypted handshake. The
+// server random is the HMAC of client random and response under secret.
+//
+// The C proxy probes each domain at startup to copy its record sizes; here
+// the encrypted record always has the default size the C proxy falls back
+// to when that probe fails.
+func buildServerHello(secret, clientRandom, sessionID []byte, cipher byte) ([]byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encSize := 2500 + mrand.IntN(1120)
+
+	resp := make([]byte, 0, 138+encSize)
+	resp = append(resp, tlsRecordHandshake, 0x03, 0x03, 0x00, 0x7a) // record, 122 bytes
+	resp = append(resp, 0x02, 0x00, 0x00, 0x76, 0x03, 0x03)         // ServerHello, 118 bytes, TLS 1.2
+	resp = append(resp, make([]byte, 32)...)                        // server random, filled below
+	resp = append(resp, 0x20)
+	resp = append(resp, sessionID...)
+	resp = append(resp, 0x13, cipher, 0x00) // cipher suite, no compression
+	resp = append(resp, 0x00, 0x2e)         // extensions length
+	resp = append(resp, 0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20)
+	resp = append(resp, key.PublicKey().Bytes()...)         // key_share: x25519
+	resp = append(resp, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04) // supported_versions: TLS 1.3
+	resp = append(resp, tlsRecordChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01)
+	resp = append(resp, tlsRecordApplicationData, 0x03, 0x03, byte(encSize>>8), byte(encSize))
+	start := len(resp)
+	resp = resp[:start+encSize]
+	rand.Read(resp[start:])
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(clientRandom)
+	mac.Write(resp)
+	copy(resp[11:43], mac.Sum(nil))
+	return resp, nil
+}
+
+// clientRandomCache remembers recent ClientHello randoms to refuse replays.
+// Entries expire after tlsReplayWindow; when the cache is full the oldest
+// are dropped early.
+type clientRandomCache struct {
+	mu    sync.Mutex
+	seen  map[[32]byte]time.Time
+	order [][32]byte // insertion order, for expiry
+	head  int
+	// since is when the cache started covering every random: a timestamp
+	// after it can be checked for replays however old it is.
+	since time.Time
+}
+
+func newClientRandomCache(now time.Time) *clientRandomCache {
+	return &clientRandomCache{seen: make(map[[32]byte]time.Time), since: now}
+}
+
+// add records r and reports whether it was new.
+func (c *clientRandomCache) add(r [32]byte, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	if _, ok := c.seen[r]; ok {
+		return false
+	}
+	c.seen[r] = now
+	c.order = append(c.order, r)
+	return true
+}
+
+// expire drops entries past the window or over the cap. Caller holds c.mu.
+func (c *clientRandomCache) expire(now time.Time) {
+	for c.head < len(c.order) {
+		r := c.order[c.head]
+		at := c.seen[r]
+		if len(c.order)-c.head <= tlsReplayMaxEntries && now.Sub(at) < tlsReplayWindow {
+			break
+		}
+		delete(c.seen, r)
+		c.order[c.head] = [32]byte{}
+		c.head++
+		c.since = at
+	}
+	if c.head > len(c.order)/2 {
+		c.order = append(c.order[:0], c.order[c.head:]...)
+		c.head = 0
+	}
+}
+
+// timestampAllowed reports whether a ClientHello sent at ts may be
+// accepted: never from the future, and when older than tlsMaxPastSkew only
+// if the cache covers that time and so would have caught a replay.
+func (c *clientRandomCache) timestampAllowed(ts, now time.Time) bool {
+	if ts.After(now.Add(tlsMaxFutureSkew)) {
+		return false
+	}
+	c.mu.Lock()
+	since := c.since
+	c.mu.Unlock()
+	return ts.After(since.Add(tlsMaxFutureSkew)) || ts.After(now.Add(-tlsMaxPastSkew))
+}
+
+// fakeTLSConn carries the obfuscated2 stream of a fake TLS client inside
+// TLS application data records. The client's dummy ChangeCipherSpec before
+// its first record is skipped.
+type fakeTLSConn struct {
+	net.Conn
+	left int // payload bytes left in the current incoming record
+	hdr  [5]byte
+	wbuf []byte
+}
+
+func newFakeTLSConn(conn net.Conn) *fakeTLSConn {
+	return &fakeTLSConn{Conn: conn}
+}
+
+// Read returns payload bytes of incoming application data records.
+func (c *fakeTLSConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if _, err := io.ReadFull(c.Conn, c.hdr[:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(c.hdr[3:5]))
+		if c.hdr[1] != 0x03 || c.hdr[2] != 0x03 {
+			return 0, fmt.Errorf("fake tls: unexpected record version %x", c.hdr[1:3])
+		}
+		switch c.hdr[0] {
+		case tlsRecordApplicationData:
+			c.left = size
+		case tlsRecordChangeCipherSpec:
+			var b [1]byte
+			if size != 1 {
+				return 0, fmt.Errorf("fake tls: change cipher spec of %d bytes", size)
+			}
+			if _, err := io.ReadFull(c.Conn, b[:]); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("fake tls: unexpected record type %#x", c.hdr[0])
+		}
+	}
+	n, err := c.Conn.Read(p[:min(len(p), c.left)])
+	c.left -= n
+	return n, err
+}
+
+// Write sends p as application data records of at most
+// tlsMaxRecordPayload bytes, in a single write. It is not safe for
+// concurrent use; clientWriter serialises all writes.
+func (c *fakeTLSConn) Write(p []byte) (int, error) {
+	c.wbuf = c.wbuf[:0]
+	for rest := p; len(rest) > 0; {
+		n := min(len(rest), tlsMaxRecordPayload)
+		c.wbuf = append(c.wbuf, tlsRecordApplicationData, 0x03, 0x03, byte(n>>8), byte(n))
+		c.wbuf = append(c.wbuf, rest[:n]...)
+		rest = rest[n:]
+	}
+	if _, err := c.Conn.Write(c.wbuf); err != nil {
+		return 0, err
+	}
+	if cap(c.wbuf) > maxRetainedReadBuffer {
+		c.wbuf = nil
+	}
+	return len(p), nil
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClientHello builds a ClientHello the way a Telegram client does for
+// an "ee" secret: SNI domain, a GREASE and a TLS 1.3 cipher suite, and a
+// random signed with secret carrying ts.
+func testClientHello(secret []byte, domain string, ts time.Time) []byte {
+	var body []byte
+	body = append(body, 0x03, 0x03)
+	body = append(body, make([]byte, 32)...) // random, filled below
+	body = append(body, 0x20)
+	body = append(body, bytes.Repeat([]byte{0x5a}, 32)...)
+	body = append(body, 0x00, 0x04, 0x0a, 0x0a, 0x13, 0x01) // cipher suites
+	body = append(body, 0x01, 0x00)                         // compression
+
+	name := []byte(domain)
+	sni := binary.BigEndian.AppendUint16(nil, uint16(len(name)+3))
+	sni = append(sni, 0x00)
+	sni = binary.BigEndian.AppendUint16(sni, uint16(len(name)))
+	sni = append(sni, name...)
+	ext := []byte{0x00, 0x00}
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(sni)))
+	ext = append(ext, sni...)
+	ext = append(ext, 0x00, 0x15, 0x00, 0x03, 0x00, 0x00, 0x00) // padding
+	body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	hs := []byte{0x01, 0x00}
+	hs = binary.BigEndian.AppendUint16(hs, uint16(len(body)))
+	hs = append(hs, body...)
+	hello := []byte{tlsRecordHandshake, 0x03, 0x01}
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(hs)))
+	hello = append(hello, hs...)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(hello)
+	digest := mac.Sum(nil)
+	binary.LittleEndian.PutUint32(digest[28:], binary.LittleEndian.Uint32(digest[28:])^uint32(ts.Unix()))
+	copy(hello[11:43], digest)
+	return hello
+}
+
+var testTLSSecret = bytes.Repeat([]byte{0x11}, 16)
+
+func TestParseClientHello(t *testing.T) {
+	hello := testClientHello(testTLSSecret, "www.example.com", time.Now())
+	sni, ciphers, err := parseClientHello(hello)
+	if err != nil {
+		t.Fatalf("parseClientHello: %v", err)
+	}
+	if sni != "www.example.com" {
+		t.Errorf("sni = %q", sni)
+	}
+	if got := tls13Cipher(ciphers); got != 0x01 {
+		t.Errorf("cipher = %#x, want 0x01 after skipping GREASE", got)
+	}
+	if clientHelloLen(hello) != len(hello) {
+		t.Errorf("clientHelloLen = %d, want %d", clientHelloLen(hello), len(hello))
+	}
+
+	if _, _, err := parseClientHello(hello[:60]); err == nil {
+		t.Error("truncated hello parsed")
+	}
+}
+
+func TestFakeTLSHandshake(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	f := newFakeTLS([]string{"www.example.com"}, now.Add(-time.Hour))
+	other := bytes.Repeat([]byte{0x22}, 16)
+	secrets := [][]byte{other, testTLSSecret}
+
+	hello := testClientHello(testTLSSecret, "www.example.com", now)
+	var clientRandom [32]byte
+	copy(clientRandom[:], hello[11:43])
+
+	secret, resp, err := f.handshake(bytes.Clone(hello), secrets, now)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if !bytes.Equal(secret, testTLSSecret) {
+		t.Errorf("matched secret %x", secret)
+	}
+
+	if !bytes.Equal(resp[:11], []byte{0x16, 0x03, 0x03, 0x00, 0x7a, 0x02, 0x00, 0x00, 0x76, 0x03, 0x03}) {
+		t.Errorf("ServerHello header = %x", resp[:11])
+	}
+	if !bytes.Equal(resp[44:76], hello[44:76]) {
+		t.Error("session id not echoed")
+	}
+	if resp[76] != 0x13 || resp[77] != 0x01 {
+		t.Errorf("cipher suite = %x", resp[76:78])
+	}
+	if !bytes.Equal(resp[127:133], []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}) {
+		t.Errorf("change cipher spec = %x", resp[127:133])
+	}
+	if encSize := int(binary.BigEndian.Uint16(resp[136:138])); 138+encSize != len(resp) {
+		t.Errorf("encrypted record of %d bytes in a %d-byte response", encSize, len(resp))
+	}
+
+	// The client checks the server random the same way.
+	zeroed := bytes.Clone(resp)
+	clear(zeroed[11:43])
+	mac := hmac.New(sha256.New, testTLSSecret)
+	mac.Write(clientRandom[:])
+	mac.Write(zeroed)
+	if !hmac.Equal(mac.Sum(nil), resp[11:43]) {
+		t.Error("server random is not the HMAC of client random and response")
+	}
+
+	_, _, err = f.handshake(bytes.Clone(hello), secrets, now)
+	var tlsErr *FakeTLSError
+	if !errors.As(err, &tlsErr) || tlsErr.Reason != FakeTLSReplay {
+		t.Errorf("replayed hello: err = %v, want %s", err, FakeTLSReplay)
+	}
+}
+
+func TestFakeTLSHandshake_Rejects(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	cases := []struct {
+		name   string
+		hello  []byte
+		reason string
+	}{
+		{"wrong secret", testClientHello(bytes.Repeat([]byte{0x33}, 16), "www.example.com", now), FakeTLSBadDigest},
+		{"unknown domain", testClientHello(testTLSSecret, "evil.example.org", now), FakeTLSBadHello},
+		{"future", testClientHello(testTLSSecret, "www.example.com", now.Add(time.Minute)), FakeTLSBadTime},
+		{"too old", testClientHello(testTLSSecret, "www.example.com", now.Add(-time.Hour)), FakeTLSBadTime},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeTLS([]string{"www.example.com"}, now)
+			_, _, err := f.handshake(tc.hello, [][]byte{testTLSSecret}, now)
+			var tlsErr *FakeTLSError
+			if !errors.As(err, &tlsErr) || tlsErr.Reason != tc.reason {
+				t.Errorf("err = %v, want %s", err, tc.reason)
+			}
+		})
+	}
+}
+
+func TestClientRandomCache(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	c := newClientRandomCache(start)
+	r := [32]byte{1}
+	if !c.add(r, start) {
+		t.Fatal("first add reported a replay")
+	}
+	if c.add(r, start.Add(time.Hour)) {
+		t.Fatal("replay within the window accepted")
+	}
+	if !c.add(r, start.Add(tlsReplayWindow+time.Second)) {
+		t.Fatal("random not forgotten after the window")
+	}
+
+	// An hour-old hello is fine while the cache has covered that hour.
+	now := start.Add(2 * time.Hour)
+	c = newClientRandomCache(start)
+	if !c.timestampAllowed(now.Add(-time.Hour), now) {
+		t.Error("timestamp covered by the cache rejected")
+	}
+	if c.timestampAllowed(start.Add(-time.Hour), now) {
+		t.Error("timestamp before the cache started accepted")
+	}
+}
+
+func TestFakeTLSConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tc := newFakeTLSConn(server)
+
+	payload := bytes.Repeat([]byte("0123456789"), 300) // over two records
+	go func() {
+		var in []byte
+		in = append(in, 0x14, 0x03, 0x03, 0x00, 0x01, 0x01)
+		in = append(in, 0x17, 0x03, 0x03, 0x00, 0x05)
+		in = append(in, "hello"...)
+		in = append(in, 0x17, 0x03, 0x03, 0x00, 0x06)
+		in = append(in, " world"...)
+		client.Write(in)
+
+		var out []byte
+		for len(out) < len(payload) {
+			var hdr [5]byte
+			if _, err := io.ReadFull(client, hdr[:]); err != nil {
+				return
+			}
+			n := int(binary.BigEndian.Uint16(hdr[3:]))
+			if hdr[0] != 0x17 || n > tlsMaxRecordPayload {
+				t.Errorf("record header %x", hdr)
+				return
+			}
+			rec := make([]byte, n)
+			io.ReadFull(client, rec)
+			out = append(out, rec...)
+		}
+		if !bytes.Equal(out, payload) {
+			t.Error("written payload mangled")
+		}
+		client.Close()
+	}()
+
+	got := make([]byte, 11)
+	if _, err := io.ReadFull(tc, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("read %q", got)
+	}
+	if _, err := tc.Write(payload); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	io.ReadAll(tc)
+}
+
+func TestAcceptFakeTLS_NotTLS(t *testing.T) {
+	s := &ClientIngressServer{tls: newFakeTLS([]string{"www.example.com"}, time.Now())}
+	head := bytes.Repeat([]byte{0xef}, 64)
+	_, consumed, err := s.acceptFakeTLS(nil, head, [][]byte{testTLSSecret})
+	var tlsErr *FakeTLSError
+	if !errors.As(err, &tlsErr) || tlsErr.Reason != FakeTLSNotTLS {
+		t.Fatalf("err = %v, want %s", err, FakeTLSNotTLS)
+	}
+	if !bytes.Equal(consumed, head) {
+		t.Error("consumed bytes not returned for the fallback")
+	}
+}
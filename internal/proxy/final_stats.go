@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// finalStatsJSON is the document written to the final stats file: the
+// /stats.json body plus the time it was taken.
+type finalStatsJSON struct {
+	Time string `json:"time"`
+	statsJSON
+}
+
+// writeFinalStats writes the last stats snapshot taken at shutdown to path
+// as JSON, so short-lived runs keep their counters after the process and its
+// stats endpoint are gone. The file is replaced atomically.
+func writeFinalStats(path string, snap statsJSON, now time.Time) error {
+	data, err := json.MarshalIndent(finalStatsJSON{
+		Time:      now.UTC().Format(time.RFC3339Nano),
+		statsJSON: snap,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := config.WriteFileAtomic(path, data, 0o644, nil); err != nil {
+		return fmt.Errorf("final stats: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFinalStats(t *testing.T) {
+	stats := NewStats()
+	stats.IncForwardedQuery()
+	path := filepath.Join(t.TempDir(), "final.json")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	snap := buildStatsJSON(stats, 2, proxyVersion, DataplaneModeClient, nil, nil, nil)
+	if err := writeFinalStats(path, snap, now); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Time          string           `json:"time"`
+		DataplaneMode string           `json:"dataplane_mode"`
+		Counters      map[string]int64 `json:"counters"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Time != "2024-05-01T12:00:00Z" {
+		t.Errorf("time = %q", got.Time)
+	}
+	if got.DataplaneMode != DataplaneModeClient {
+		t.Errorf("dataplane_mode = %q", got.DataplaneMode)
+	}
+	if _, ok := got.Counters["secret_2_active_connections"]; !ok || got.Counters["tot_forwarded_queries"] != 1 {
+		t.Errorf("counters = %v", got.Counters)
+	}
+}
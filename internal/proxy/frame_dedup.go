@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/maphash"
+	"sync"
+)
+
+// dedupMaxSessions caps the sessions frameDedup keeps windows for; beyond it
+// the least recently active session's window is dropped.
+const dedupMaxSessions = 16384
+
+// dedupSeed is shared by all sessions; hashes never leave the process.
+var dedupSeed = maphash.MakeSeed()
+
+// frameDedup remembers hashes of the last few client frames of every MTProto
+// session, as told by their auth_key_id, and reports exact repeats, such as
+// whole frames a client retransmits on a flaky network, typically over the
+// connection it opens after losing the previous one. Encrypted MTProto
+// frames carry a fresh msg_key, so legitimate traffic never repeats a frame
+// byte for byte. Frames without an auth_key_id (the unencrypted handshake)
+// are never reported. A nil frameDedup (deduplication off) reports nothing.
+type frameDedup struct {
+	window      int
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[int64]*list.Element
+	lru      *list.List // of *dedupSession, most recently active first
+}
+
+type dedupSession struct {
+	key    int64
+	hashes []uint64
+	next   int
+}
+
+// newFrameDedup returns a dedup window of n frames per session (n is at
+// most cli.MaxDedupFrames), or nil when n <= 0.
+func newFrameDedup(n int) *frameDedup {
+	if n <= 0 {
+		return nil
+	}
+	return &frameDedup{
+		window:      n,
+		maxSessions: dedupMaxSessions,
+		sessions:    make(map[int64]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// Seen reports whether frame repeats one of the frames in its session's
+// window; otherwise it remembers the frame, evicting the oldest one.
+func (d *frameDedup) Seen(frame []byte) bool {
+	if d == nil || len(frame) < 8 {
+		return false
+	}
+	key := int64(binary.LittleEndian.Uint64(frame[0:8]))
+	if key == 0 {
+		return false
+	}
+	h := maphash.Bytes(dedupSeed, frame)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var s *dedupSession
+	if e, ok := d.sessions[key]; ok {
+		d.lru.MoveToFront(e)
+		s = e.Value.(*dedupSession)
+	} else {
+		s = &dedupSession{key: key, hashes: make([]uint64, 0, d.window)}
+		d.sessions[key] = d.lru.PushFront(s)
+		for d.lru.Len() > d.maxSessions {
+			oldest := d.lru.Back()
+			d.lru.Remove(oldest)
+			delete(d.sessions, oldest.Value.(*dedupSession).key)
+		}
+	}
+	for _, v := range s.hashes {
+		if v == h {
+			return true
+		}
+	}
+	if len(s.hashes) < cap(s.hashes) {
+		s.hashes = append(s.hashes, h)
+		return false
+	}
+	s.hashes[s.next] = h
+	s.next = (s.next + 1) % len(s.hashes)
+	return false
+}
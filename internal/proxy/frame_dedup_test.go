@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// dedupFrame builds an encrypted-looking frame of session key.
+func dedupFrame(key int64, body string) []byte {
+	frame := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint64(frame, uint64(key))
+	return append(frame, body...)
+}
+
+func TestFrameDedup(t *testing.T) {
+	var off *frameDedup
+	if off.Seen(dedupFrame(1, "a")) || off.Seen(dedupFrame(1, "a")) {
+		t.Error("nil dedup reported a repeat")
+	}
+	if newFrameDedup(0) != nil {
+		t.Error("newFrameDedup(0) should be nil")
+	}
+
+	d := newFrameDedup(2)
+	a, b, c := dedupFrame(1, "a"), dedupFrame(1, "b"), dedupFrame(1, "c")
+	if d.Seen(a) || d.Seen(b) {
+		t.Fatal("first frames reported as repeats")
+	}
+	if !d.Seen(a) || !d.Seen(b) {
+		t.Error("repeat within the window not detected")
+	}
+	// "c" evicts "a", the oldest entry.
+	if d.Seen(c) {
+		t.Error("new frame reported as a repeat")
+	}
+	if d.Seen(a) {
+		t.Error("evicted frame reported as a repeat")
+	}
+	if !d.Seen(c) {
+		t.Error("recent frame not detected")
+	}
+
+	d = newFrameDedup(4)
+	for i := 0; i < 40; i++ {
+		if d.Seen(dedupFrame(1, fmt.Sprint(i))) {
+			t.Fatalf("distinct frame %d reported as a repeat", i)
+		}
+	}
+	if s := d.sessions[1].Value.(*dedupSession); len(s.hashes) != 4 {
+		t.Errorf("window grew to %d", len(s.hashes))
+	}
+}
+
+func TestFrameDedup_Sessions(t *testing.T) {
+	d := newFrameDedup(1)
+	// The window is per session: another session's frame does not evict
+	// this one's, and a session's frames are caught whichever connection
+	// they arrive on, as d is shared by all of them.
+	if d.Seen(dedupFrame(1, "x")) || d.Seen(dedupFrame(2, "y")) {
+		t.Fatal("first frames reported as repeats")
+	}
+	if !d.Seen(dedupFrame(1, "x")) {
+		t.Error("repeat after another session's frame not detected")
+	}
+	// Unencrypted frames (auth_key_id 0) and runts are never dropped.
+	for i := 0; i < 2; i++ {
+		if d.Seen(dedupFrame(0, "req_pq")) || d.Seen([]byte("short")) {
+			t.Fatal("frame without an auth_key_id reported as a repeat")
+		}
+	}
+
+	d.maxSessions = 2
+	d.Seen(dedupFrame(3, "z")) // evicts session 2, the least recently active
+	if len(d.sessions) != 2 {
+		t.Fatalf("%d sessions kept, want 2", len(d.sessions))
+	}
+	if d.Seen(dedupFrame(2, "y")) {
+		t.Error("evicted session's frame reported as a repeat")
+	}
+	if !d.Seen(dedupFrame(3, "z")) {
+		t.Error("recent session's frame not detected")
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/skrashevich/MTProxy/internal/protocol"
+)
+
+// FrameLimits caps the size of client frames by kind. Frames are checked
+// against the cap for their kind as soon as their auth_key_id has been read,
+// before the rest of the frame is buffered.
+type FrameLimits struct {
+	// PreHandshake caps every frame until the connection has sent its first
+	// encrypted frame, bounding what an unauthenticated peer can make the
+	// proxy buffer.
+	PreHandshake int
+	// Unencrypted caps frames with auth_key_id == 0 (the DH key exchange).
+	Unencrypted int
+	// Encrypted caps frames carrying encrypted MTProto messages.
+	Encrypted int
+}
+
+// DefaultFrameLimits are used for limits left at zero.
+var DefaultFrameLimits = FrameLimits{
+	PreHandshake: 128 * 1024,
+	Unencrypted:  8 * 1024,
+	Encrypted:    maxPacketSize,
+}
+
+// withDefaults returns l with zero fields replaced by DefaultFrameLimits and
+// every field capped at maxPacketSize.
+func (l FrameLimits) withDefaults() FrameLimits {
+	fill := func(v, def int) int {
+		if v <= 0 {
+			v = def
+		}
+		return min(v, maxPacketSize)
+	}
+	return FrameLimits{
+		PreHandshake: fill(l.PreHandshake, DefaultFrameLimits.PreHandshake),
+		Unencrypted:  fill(l.Unencrypted, DefaultFrameLimits.Unencrypted),
+		Encrypted:    fill(l.Encrypted, DefaultFrameLimits.Encrypted),
+	}
+}
+
+// Frame kinds reported by FrameTooLargeError.
+const (
+	FrameKindPreHandshake = "pre_handshake"
+	FrameKindUnencrypted  = "unencrypted"
+	FrameKindEncrypted    = "encrypted"
+)
+
+// FrameTooLargeError is returned by PacketReader when a frame exceeds the
+// limit for its kind.
+type FrameTooLargeError struct {
+	Kind  string // one of the FrameKind* constants
+	Size  int
+	Limit int
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("%s frame of %d bytes exceeds limit of %d", e.Kind, e.Size, e.Limit)
+}
+
+// frameKindName maps a packet type to its FrameKind* name.
+func frameKindName(t protocol.PacketType) string {
+	if t == protocol.PacketEncrypted {
+		return FrameKindEncrypted
+	}
+	return FrameKindUnencrypted
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// HandlerBudget caps the number of connection handler goroutines running
+// across all client listeners. Under a connection flood every accepted
+// socket would otherwise get its own goroutine before any admission check,
+// and the scheduler spends its time switching between handshakes that never
+// finish; with a budget the excess is closed at accept time instead, which
+// costs no goroutine at all. A budget of 0, or a nil *HandlerBudget, admits
+// everything.
+type HandlerBudget struct {
+	limit atomic.Int64
+	stats *Stats
+
+	inUse atomic.Int64
+	full  atomic.Bool // logged transition into the rejecting state
+}
+
+// NewHandlerBudget creates a budget of limit handler goroutines; 0 is no
+// limit.
+func NewHandlerBudget(limit int, stats *Stats) *HandlerBudget {
+	b := &HandlerBudget{stats: stats}
+	b.SetLimit(int64(limit))
+	return b
+}
+
+// SetLimit changes the budget; 0 turns it off. Handlers already
+// running above a lowered limit are not interrupted, new connections are
+// rejected until enough of them finish.
+func (b *HandlerBudget) SetLimit(limit int64) {
+	b.limit.Store(limit)
+	if b.stats != nil {
+		atomic.StoreInt64(&b.stats.HandlerBudget, limit)
+	}
+}
+
+// Limit returns the budget, 0 for a nil *HandlerBudget.
+func (b *HandlerBudget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit.Load()
+}
+
+// Acquire reserves a handler slot; it reports false, and counts the
+// rejection, when the budget is exhausted. Every successful Acquire must be
+// paired with Release.
+func (b *HandlerBudget) Acquire() bool {
+	if b == nil {
+		return true
+	}
+	limit := b.limit.Load()
+	if n := b.inUse.Add(1); limit > 0 && n > limit {
+		b.inUse.Add(-1)
+		if b.stats != nil {
+			atomic.AddInt64(&b.stats.HandlerBudgetRejected, 1)
+		}
+		if !b.full.Swap(true) {
+			log.Printf("handler budget: %d handlers running, rejecting new connections", limit)
+		}
+		return false
+	}
+	if b.stats != nil {
+		atomic.AddInt64(&b.stats.HandlersActive, 1)
+	}
+	return true
+}
+
+// Release returns a slot taken by Acquire.
+func (b *HandlerBudget) Release() {
+	if b == nil {
+		return
+	}
+	n := b.inUse.Add(-1)
+	if b.stats != nil {
+		atomic.AddInt64(&b.stats.HandlersActive, -1)
+	}
+	// Re-arm the log once a tenth of the budget is free again so a flood
+	// hovering at the limit does not log on every accept.
+	limit := b.limit.Load()
+	if (limit == 0 || n <= limit-max(limit/10, 1)) && b.full.Swap(false) {
+		log.Printf("handler budget: back under limit (%d of %d in use)", n, limit)
+	}
+}
+
+// InUse returns the number of handler goroutines currently running.
+func (b *HandlerBudget) InUse() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.inUse.Load()
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+)
+
+// HandshakeLatency tracks how long client connections accepted on one
+// listener took from accept to a completed handshake (obfuscated2 header,
+// fake TLS if enabled, secret checks and admission). Slow handshakes with
+// a normal accept rate point at the proxy; a flat latency with a burst of
+// half-open connections points at the network. Percentiles cover the last
+// durationRingSize handshakes. All methods are lock-free and safe to call
+// on a nil *HandshakeLatency.
+type HandshakeLatency struct {
+	ring durationRing
+}
+
+// Observe records one completed handshake.
+func (h *HandshakeLatency) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.ring.Observe(d)
+}
+
+// Count returns the number of handshakes recorded since start.
+func (h *HandshakeLatency) Count() int64 {
+	if h == nil {
+		return 0
+	}
+	return h.ring.Count()
+}
+
+// Percentiles returns the given percentiles (0-100) of the recent
+// handshakes, all 0 before any was recorded.
+func (h *HandshakeLatency) Percentiles(ps ...int) []time.Duration {
+	if h == nil {
+		return make([]time.Duration, len(ps))
+	}
+	return h.ring.Percentiles(ps...)
+}
+
+// listenerStatsName turns a listen address into the name used in stats
+// keys: ":443" becomes "443", "10.0.0.1:443" becomes "10_0_0_1_443".
+func listenerStatsName(addr string) string {
+	addr = strings.TrimPrefix(addr, ":")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			return r
+		}
+		return '_'
+	}, addr)
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakeLatency(t *testing.T) {
+	var nilLatency *HandshakeLatency
+	nilLatency.Observe(time.Second)
+	if nilLatency.Count() != 0 {
+		t.Error("nil HandshakeLatency must count nothing")
+	}
+
+	s := NewStats()
+	h := s.Handshakes(":443")
+	if s.Handshakes(":443") != h {
+		t.Fatal("Handshakes must return the same tracker for one listener")
+	}
+	for i := 1; i <= 100; i++ {
+		h.Observe(time.Duration(i) * time.Millisecond)
+	}
+	ps := h.Percentiles(50, 95, 99)
+	if ps[0] != 50*time.Millisecond || ps[1] != 95*time.Millisecond || ps[2] != 99*time.Millisecond {
+		t.Errorf("percentiles = %v", ps)
+	}
+
+	s.Handshakes("10.0.0.1:4443")
+	snap := s.Snapshot(0)
+	if snap["listener_443_handshakes"] != 100 || snap["listener_443_handshake_p95_us"] != 95000 {
+		t.Errorf("listener_443: %d handshakes, p95 %d µs", snap["listener_443_handshakes"], snap["listener_443_handshake_p95_us"])
+	}
+	if v, ok := snap["listener_10_0_0_1_4443_handshake_p50_us"]; !ok || v != 0 {
+		t.Errorf("idle listener p50 = %d (present %v), want 0", v, ok)
+	}
+}
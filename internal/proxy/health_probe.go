@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// DefaultProbeTimeout bounds each target probe in an on-demand sweep. It is
+// kept below the stats listener's write timeout so results are returned in
+// the same response.
+const DefaultProbeTimeout = 5 * time.Second
+
+// ProbeResult is the outcome of probing one target address.
+type ProbeResult struct {
+	Addr    string
+	DCs     []int // clusters listing this address, ascending
+	Latency time.Duration
+	Err     error // nil if the target is reachable
+}
+
+// probeTargets probes every distinct target address in cfg concurrently
+// with connect and returns the results sorted by address. A probe that does
+// not finish within timeout is reported as failed; connect keeps running in
+// the background.
+func probeTargets(cfg *config.Config, connect func(addr string) error, timeout time.Duration) []ProbeResult {
+	if cfg == nil {
+		return nil
+	}
+	dcs := make(map[string][]int)
+	for id, cl := range cfg.Clusters {
+		for _, t := range cl.Targets {
+			addr := cfg.DialAddr(t)
+			dcs[addr] = append(dcs[addr], id)
+		}
+		if cl.Canary != nil {
+			addr := cfg.DialAddr(*cl.Canary)
+			dcs[addr] = append(dcs[addr], id)
+		}
+	}
+
+	results := make([]ProbeResult, 0, len(dcs))
+	for addr, ids := range dcs {
+		sort.Ints(ids)
+		results = append(results, ProbeResult{Addr: addr, DCs: slices.Compact(ids)})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Addr < results[j].Addr })
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(r *ProbeResult) {
+			defer processCrash.Load().Recover()
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				defer processCrash.Load().Recover()
+				done <- connect(r.Addr)
+			}()
+			select {
+			case r.Err = <-done:
+			case <-time.After(timeout):
+				r.Err = fmt.Errorf("no answer within %s", timeout)
+			}
+			r.Latency = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
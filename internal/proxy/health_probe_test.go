@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+func TestProbeTargets(t *testing.T) {
+	cfg := &config.Config{Clusters: map[int]*config.Cluster{
+		1: {ID: 1, Targets: []config.Target{{Addr: "10.0.0.1", Port: 8888}, {Addr: "10.0.0.2", Port: 8888}}},
+		2: {ID: 2, Targets: []config.Target{{Addr: "10.0.0.1", Port: 8888}, {Addr: "10.0.0.3", Port: 8888}}},
+	}}
+	connect := func(addr string) error {
+		switch addr {
+		case "10.0.0.2:8888":
+			return errors.New("connection refused")
+		case "10.0.0.3:8888":
+			time.Sleep(time.Second)
+		}
+		return nil
+	}
+
+	results := probeTargets(cfg, connect, 50*time.Millisecond)
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	if r := results[0]; r.Addr != "10.0.0.1:8888" || r.Err != nil || len(r.DCs) != 2 {
+		t.Errorf("shared target: %+v", r)
+	}
+	if r := results[1]; r.Addr != "10.0.0.2:8888" || r.Err == nil {
+		t.Errorf("refused target: %+v", r)
+	}
+	if r := results[2]; r.Addr != "10.0.0.3:8888" || r.Err == nil {
+		t.Errorf("slow target should time out: %+v", r)
+	}
+}
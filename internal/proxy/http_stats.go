@@ -1,11 +1,16 @@
 package proxy
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,62 +19,453 @@ import (
 type HTTPStatsServer struct {
 	addr        string
 	stats       *Stats
-	secretCount int
+	secretCount atomic.Int64
 	proxyTag    []byte
 	version     string
 	server      *http.Server
+
+	// adminAddr, если задан, — unix-сокет (путь или @имя), на котором тот же
+	// API доступен процессам с разрешёнными UID (adminUIDs и собственный)
+	adminAddr   string
+	adminUIDs   []uint32
+	adminServer *http.Server
+
+	// ingress, если задан, получает HTTP-запросы, пришедшие на клиентский
+	// порт (--ingress-stats); там доступны только /stats и /stats.json
+	ingress       *connListener
+	ingressServer *http.Server
+
+	// workerAddr, если задан, — unix-сокет, через который супервизор
+	// забирает /stats воркера для суммарной статистики (-M > 1)
+	workerAddr   string
+	workerServer *http.Server
+
+	latency *LatencySampler // optional; enables /debug/latency
+	// pprof включает /debug/pprof/ (--enable-pprof)
+	pprof bool
+	// liveness и readiness, если заданы, отвечают на /healthz и /readyz
+	liveness  func() HealthReport
+	readiness func() HealthReport
+	// readOnly отключает изменяющие эндпоинты (на время shutdown)
+	readOnly atomic.Bool
+	reloads *ReloadHistory  // optional; reload_history в /stats.json
+	events *EventLog // optional; enables /debug/events
+	conns  *ConnTable // optional; enables /debug/connections
+	ipLimits *IPLimiter // optional; enables /debug/ip-limits
+	// outboundConns, если задан, отдаёт соединения с backend'ами (/debug/outbound)
+	outboundConns func() []OutboundConnStatus
+	// outboundPools, если задан, отдаёт заполненность пулов соединений
+	// по target'ам (/stats, /stats.json)
+	outboundPools func() []TargetPoolStatus
+	health *TargetHealth // optional; per-target section in /stats and /stats.json
+	router *Router       // optional; per-cluster section in /stats.json
+	// descriptor, если задан, отдаётся на /descriptor.json
+	descriptor func() (Descriptor, error)
+	// effectiveConfig, если задан, отдаётся на /debug/config
+	effectiveConfig []ConfigSetting
+	// activate, если задан, выводит процесс из warm standby (POST /admin/activate)
+	activate func() bool
+	// probe, если задан, проверяет все target'ы (POST /admin/probe)
+	probe func() []ProbeResult
+	// listeners и drain, если заданы, показывают клиентские listener'ы
+	// (GET /admin/listeners) и выводят один из работы (POST /admin/drain)
+	listeners func() []ListenerStatus
+	drain     func(addr string) (ListenerStatus, error)
+	// reloadSecrets, если задан, перечитывает секреты (POST /admin/secrets/reload)
+	reloadSecrets func() (SecretReload, error)
+	// limits и setLimits, если заданы, показывают и меняют лимиты сессий и
+	// обработчиков (GET и POST /admin/limits)
+	limits    func() ConnLimits
+	setLimits func(u ConnLimitUpdate, who string) (ConnLimits, error)
+	// reloadConfig, если задан, перезагружает конфигурацию по запросу
+	// супервизора (POST /reload на сокете воркера)
+	reloadConfig func() error
+	// dataplaneMode — какой путь обслуживает трафик (DataplaneMode*)
+	dataplaneMode atomic.Value
 }
 
+// implementationName отличает Go-порт от C-версии при параллельном запуске.
+const implementationName = "go"
+
+// Значения dataplane_mode в /stats.
+const (
+	// DataplaneModeLegacy — IngressServer с собственным обработчиком, без клиентского транспорта
+	DataplaneModeLegacy = "legacy_ingress"
+	// DataplaneModeClient — ClientIngressServer (obfuscated2/fake-TLS → DataPlane)
+	DataplaneModeClient = "client_ingress"
+	// DataplaneModeDisabled — клиентский трафик не обслуживается
+	DataplaneModeDisabled = "disabled"
+)
+
 // NewHTTPStatsServer создаёт HTTP сервер статистики.
 func NewHTTPStatsServer(addr string, stats *Stats, secretCount int, proxyTag []byte, version string) *HTTPStatsServer {
-	return &HTTPStatsServer{
+	h := &HTTPStatsServer{
 		addr:        addr,
 		stats:       stats,
-		secretCount: secretCount,
 		proxyTag:    proxyTag,
 		version:     version,
 	}
+	h.secretCount.Store(int64(secretCount))
+	h.dataplaneMode.Store(DataplaneModeDisabled)
+	return h
+}
+
+// SetEventLog подключает кольцо событий и эндпоинт /debug/events.
+// Должен вызываться до Start.
+func (h *HTTPStatsServer) SetEventLog(l *EventLog) {
+	h.events = l
+}
+
+// SetConnTable подключает таблицу активных соединений и эндпоинт
+// /debug/connections. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetConnTable(t *ConnTable) {
+	h.conns = t
+}
+
+// SetIPLimiter подключает эндпоинт /debug/ip-limits со списком IP,
+// недавно упёршихся в лимиты. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetIPLimiter(l *IPLimiter) {
+	h.ipLimits = l
+}
+
+// SetOutboundConns подключает эндпоинт /debug/outbound со счётчиками
+// каждого соединения с backend'ами. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetOutboundConns(f func() []OutboundConnStatus) {
+	h.outboundConns = f
+}
+
+// SetOutboundPools подключает заполненность пулов соединений с
+// backend'ами в /stats и /stats.json.
+func (h *HTTPStatsServer) SetOutboundPools(f func() []TargetPoolStatus) {
+	h.outboundPools = f
+}
+
+// SetDescriptor подключает эндпоинт /descriptor.json с описанием прокси
+// для регистрации. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetDescriptor(f func() (Descriptor, error)) {
+	h.descriptor = f
+}
+
+// ConfigSetting — действующее значение одной опции и откуда оно взято:
+// default, file (--config-yaml), env (MTPROXY_GO_*) или flag.
+type ConfigSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// SetEffectiveConfig подключает эндпоинт /debug/config с действующими
+// значениями опций. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetEffectiveConfig(settings []ConfigSetting) {
+	h.effectiveConfig = settings
+}
+
+// SetActivator подключает эндпоинт POST /admin/activate, выводящий процесс
+// из warm standby. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetActivator(activate func() bool) {
+	h.activate = activate
+}
+
+// SetConfigReloader подключает POST /reload на сокете воркера: супервизор
+// перезагружает им конфигурацию воркеров и ждёт окончания. Должен
+// вызываться до Start.
+func (h *HTTPStatsServer) SetConfigReloader(reload func() error) {
+	h.reloadConfig = reload
+}
+
+// SetProber подключает эндпоинт POST /admin/probe, синхронно проверяющий
+// все target'ы. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetProber(probe func() []ProbeResult) {
+	h.probe = probe
+}
+
+// SetRouter подключает раскладку target'ов по кластерам в /stats.json.
+func (h *HTTPStatsServer) SetRouter(r *Router) {
+	h.router = r
+}
+
+// SetListenerControl подключает эндпоинты GET /admin/listeners и
+// POST /admin/drain?listener=<addr>. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetListenerControl(list func() []ListenerStatus, drain func(addr string) (ListenerStatus, error)) {
+	h.listeners = list
+	h.drain = drain
+}
+
+// SetSecretReloader подключает эндпоинт POST /admin/secrets/reload,
+// перечитывающий --mtproto-secret-file и --mtproto-secret-dir.
+func (h *HTTPStatsServer) SetSecretReloader(reload func() (SecretReload, error)) {
+	h.reloadSecrets = reload
+}
+
+// SetLimitControl подключает эндпоинт /admin/limits: GET отдаёт текущие
+// лимиты, POST меняет их. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetLimitControl(get func() ConnLimits, set func(u ConnLimitUpdate, who string) (ConnLimits, error)) {
+	h.limits = get
+	h.setLimits = set
+}
+
+// SetDataplaneMode сообщает, какой путь обслуживает клиентский трафик.
+func (h *HTTPStatsServer) SetDataplaneMode(mode string) {
+	h.dataplaneMode.Store(mode)
+}
+
+// DataplaneMode возвращает текущее значение dataplane_mode.
+func (h *HTTPStatsServer) DataplaneMode() string {
+	return h.dataplaneMode.Load().(string)
+}
+
+// SetSecretCount обновляет число секретов для per-secret счётчиков
+// (после горячей перезагрузки секретов).
+func (h *HTTPStatsServer) SetSecretCount(n int) {
+	h.secretCount.Store(int64(n))
+}
+
+// SetLatencySampler подключает сэмплер задержек и эндпоинт /debug/latency.
+// Должен вызываться до Start.
+func (h *HTTPStatsServer) SetLatencySampler(l *LatencySampler) {
+	h.latency = l
+}
+
+// SetReloadHistory подключает журнал перезагрузок конфигурации,
+// отдаваемый в /stats.json. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetReloadHistory(r *ReloadHistory) {
+	h.reloads = r
+}
+
+// SetTargetHealth подключает состояние target'ов (последняя ошибка, время,
+// число неудач подряд), выводимое в /stats и /stats.json.
+func (h *HTTPStatsServer) SetTargetHealth(t *TargetHealth) {
+	h.health = t
+}
+
+// SetAdminSocket дополнительно открывает API на unix-сокете addr: путь или
+// "@имя" в абстрактном пространстве имён Linux. Команды принимаются только
+// от процессов с UID прокси или из uids (SO_PEERCRED). Должен вызываться
+// до Start.
+func (h *HTTPStatsServer) SetAdminSocket(addr string, uids []uint32) {
+	h.adminAddr = addr
+	h.adminUIDs = uids
+}
+
+// EnableIngress включает обслуживание HTTP-соединений, переданных с
+// клиентского порта через ServeIngressConn. Должен вызываться до Start.
+func (h *HTTPStatsServer) EnableIngress() {
+	h.ingress = newConnListener()
+}
+
+// ServeIngressConn обслуживает соединение с клиентского порта, первые байты
+// которого head уже прочитаны, и возвращается, когда оно закрыто.
+func (h *HTTPStatsServer) ServeIngressConn(conn net.Conn, head []byte) {
+	h.ingress.Serve(conn, head)
+}
+
+// SetHealthChecks подключает эндпоинты /healthz (live) и /readyz (ready)
+// для оркестраторов. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetHealthChecks(live, ready func() HealthReport) {
+	h.liveness = live
+	h.readiness = ready
+}
+
+// EnablePprof подключает обработчики net/http/pprof под /debug/pprof/.
+// Должен вызываться до Start.
+func (h *HTTPStatsServer) EnablePprof() {
+	h.pprof = true
+}
+
+// SetWorkerSocket включает отдачу /stats, /stats.json, /healthz, /readyz и
+// /admin/listeners и перезагрузку по POST /reload супервизору на
+// unix-сокете path. Должен вызываться до Start.
+func (h *HTTPStatsServer) SetWorkerSocket(path string) {
+	h.workerAddr = path
+}
+
+// SetReadOnly переводит сервер в режим только для чтения: статистика
+// продолжает отдаваться, изменяющие запросы отклоняются с 503.
+func (h *HTTPStatsServer) SetReadOnly() {
+	h.readOnly.Store(true)
 }
 
 // Start запускает HTTP сервер в фоне. Возвращает ошибку если не удалось начать слушать.
 func (h *HTTPStatsServer) Start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/stats", h.handleStats)
-	mux.HandleFunc("/", h.handleStats) // C-прокси отвечает на любой GET
+	mux.HandleFunc("/stats.json", h.handleStatsJSON)
+	mux.HandleFunc("/debug/runtime", serveRuntimeDiag)
+	if h.liveness != nil {
+		mux.HandleFunc("/healthz", h.handleHealthz)
+		mux.HandleFunc("/readyz", h.handleReadyz)
+	}
+	if h.pprof {
+		registerPprof(mux)
+	}
+	if h.latency != nil {
+		mux.HandleFunc("/debug/latency", h.handleLatency)
+		mux.HandleFunc("/debug/latency/reset", h.handleLatencyReset)
+	}
+	if h.events != nil {
+		mux.HandleFunc("/debug/events", h.handleEvents)
+	}
+	if h.conns != nil {
+		mux.HandleFunc("/debug/connections", h.handleConnections)
+		mux.HandleFunc("/admin/trace", h.handleTrace)
+	}
+	if h.ipLimits != nil {
+		mux.HandleFunc("/debug/ip-limits", h.handleIPLimits)
+	}
+	if h.outboundConns != nil {
+		mux.HandleFunc("/debug/outbound", h.handleOutbound)
+	}
+	if h.descriptor != nil {
+		mux.HandleFunc("/descriptor.json", h.handleDescriptor)
+	}
+	if h.effectiveConfig != nil {
+		mux.HandleFunc("/debug/config", h.handleEffectiveConfig)
+	}
+	if h.activate != nil {
+		mux.HandleFunc("/admin/activate", h.handleActivate)
+	}
+	if h.probe != nil {
+		mux.HandleFunc("/admin/probe", h.handleProbe)
+	}
+	if h.listeners != nil {
+		mux.HandleFunc("/admin/listeners", h.handleListeners)
+		if h.workerAddr != "" {
+			mux.HandleFunc("/admin/drain", handleDrainUnsupported)
+		} else {
+			mux.HandleFunc("/admin/drain", h.handleDrain)
+		}
+	}
+	if h.reloadSecrets != nil {
+		if h.workerAddr != "" {
+			mux.HandleFunc("/admin/secrets/reload", handleSecretsReloadUnsupported)
+		} else {
+			mux.HandleFunc("/admin/secrets/reload", h.handleSecretsReload)
+		}
+	}
+	if h.limits != nil {
+		mux.HandleFunc("/admin/limits", h.handleLimits)
+	}
+	mux.HandleFunc("/ui", serveDashboard)
+	mux.HandleFunc("/", h.handleRoot) // C-прокси отвечает на любой GET
 
-	ln, err := net.Listen("tcp", h.addr)
-	if err != nil {
-		return fmt.Errorf("http_stats listen %s: %w", h.addr, err)
+	// TCP-адрес может быть пустым, если API нужен только на unix-сокете.
+	if h.addr != "" {
+		ln, err := net.Listen("tcp", h.addr)
+		if err != nil {
+			return fmt.Errorf("http_stats listen %s: %w", h.addr, err)
+		}
+		h.server = newStatsHTTPServer(loopbackOnly(mux))
+		go h.server.Serve(ln)
 	}
 
-	h.server = &http.Server{
+	if h.ingress != nil {
+		// На клиентском порту — только чтение статистики, без admin и debug.
+		ingressMux := http.NewServeMux()
+		ingressMux.HandleFunc("/stats", h.handleStats)
+		ingressMux.HandleFunc("/stats.json", h.handleStatsJSON)
+		h.ingressServer = newStatsHTTPServer(ingressMux)
+		go h.ingressServer.Serve(h.ingress)
+	}
+
+	if h.workerAddr != "" {
+		// Сокет мог остаться от предыдущего экземпляра воркера.
+		os.Remove(h.workerAddr)
+		ln, err := net.Listen("unix", h.workerAddr)
+		if err != nil {
+			h.Stop()
+			return fmt.Errorf("http_stats: worker socket: %w", err)
+		}
+		workerMux := http.NewServeMux()
+		workerMux.HandleFunc("/stats", h.handleStats)
+		workerMux.HandleFunc("/stats.json", h.handleStatsJSON)
+		if h.liveness != nil {
+			// По ним супервизор отвечает на свои /healthz и /readyz.
+			workerMux.HandleFunc("/healthz", h.handleHealthz)
+			workerMux.HandleFunc("/readyz", h.handleReadyz)
+		}
+		if h.listeners != nil {
+			// Супервизор сообщает systemd READY=1, когда порты привязаны.
+			workerMux.HandleFunc("/admin/listeners", h.handleListeners)
+		}
+		if h.reloadConfig != nil {
+			workerMux.HandleFunc("/reload", h.handleReload)
+		}
+		if h.reloadSecrets != nil {
+			// Супервизор перечитывает секреты во всех воркерах сразу.
+			workerMux.HandleFunc("/admin/secrets/reload", h.handleSecretsReload)
+		}
+		h.workerServer = newStatsHTTPServer(workerMux)
+		go h.workerServer.Serve(ln)
+	}
+
+	if h.adminAddr != "" {
+		ln, err := listenAdmin(h.adminAddr, h.adminUIDs)
+		if err != nil {
+			h.Stop()
+			return fmt.Errorf("http_stats: %w", err)
+		}
+		h.adminServer = newStatsHTTPServer(mux)
+		h.adminServer.ConnContext = adminConnContext
+		go h.adminServer.Serve(ln)
+	}
+	return nil
+}
+
+// newStatsHTTPServer создаёт http.Server с таймаутами stats-листенера.
+func newStatsHTTPServer(mux http.Handler) *http.Server {
+	return &http.Server{
 		Handler:      mux,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
-
-	go h.server.Serve(ln)
-	return nil
 }
 
-// Stop останавливает HTTP сервер.
+// Stop останавливает HTTP сервер и unix-сокет API.
 func (h *HTTPStatsServer) Stop() {
 	if h.server != nil {
 		h.server.Close()
 	}
+	if h.adminServer != nil {
+		h.adminServer.Close()
+	}
+	if h.ingressServer != nil {
+		h.ingressServer.Close()
+	}
+	if h.workerServer != nil {
+		h.workerServer.Close()
+	}
+}
+
+// handleRoot отдаёт браузеру дашборд, а остальным — текстовую статистику,
+// как C-прокси на любой GET.
+func (h *HTTPStatsServer) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if wantsDashboard(r) {
+		serveDashboard(w, r)
+		return
+	}
+	h.handleStats(w, r)
 }
 
 // handleStats рендерит статистику в формате "key\tvalue\n".
 // Совместим с форматом mtfront_prepare_stats() из C.
 func (h *HTTPStatsServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		h.handleStatsJSON(w, r)
+		return
+	case "", "text":
+	default:
+		writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "format must be text or json")
+		return
+	}
 	h.stats.IncHTTPQuery()
 
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	snap := h.stats.Snapshot(h.secretCount)
+	snap := h.stats.Snapshot(int(h.secretCount.Load()))
 	uptime := h.stats.Uptime()
 
 	var sb strings.Builder
@@ -99,9 +495,88 @@ func (h *HTTPStatsServer) handleStats(w http.ResponseWriter, r *http.Request) {
 	writeStat("ext_connections", snap["ext_connections"])
 	writeStat("ext_connections_created", snap["ext_connections_created"])
 	writeStat("mtproto_proxy_errors", snap["mtproto_proxy_errors"])
+	writeStat("tagged_forwards", snap["tagged_forwards"])
+	writeStat("untagged_forwards", snap["untagged_forwards"])
 	writeStat("http_queries", snap["http_queries"])
 	writeStat("http_bad_headers", snap["http_bad_headers"])
 	writeStat("http_qps", float64(snap["http_queries"])/uptime)
+	writeStat("authorizer_denied", snap["authorizer_denied"])
+	writeStat("authorizer_errors", snap["authorizer_errors"])
+	writeStat("rejected_by_secret_window", snap["rejected_by_secret_window"])
+	writeStat("bootstrap_warnings", snap["bootstrap_warnings"])
+	writeStat("oversize_responses", snap["oversize_responses"])
+	writeStat("first_byte_timeouts", snap["first_byte_timeouts"])
+	writeStat("response_stalls", snap["response_stalls"])
+	writeStat("frames_rejected_pre_handshake", snap["frames_rejected_pre_handshake"])
+	writeStat("frames_rejected_unencrypted", snap["frames_rejected_unencrypted"])
+	writeStat("frames_rejected_encrypted", snap["frames_rejected_encrypted"])
+	writeStat("client_pings_answered", snap["client_pings_answered"])
+	writeStat("client_frames_deduplicated", snap["client_frames_deduplicated"])
+	writeStat("cpu_profiles_captured", snap["cpu_profiles_captured"])
+	writeStat("revoked_secret_connections", snap["revoked_secret_connections"])
+	writeStat("faketls_handshakes", snap["faketls_handshakes"])
+	writeStat("faketls_rejected", snap["faketls_rejected"])
+	writeStat("faketls_replays", snap["faketls_replays"])
+	writeStat("faketls_fallbacks", snap["faketls_fallbacks"])
+	writeStat("decoy_relayed", snap["decoy_relayed"])
+	writeStat("spliced_bytes", snap["spliced_bytes"])
+	writeStat("unknown_dc_frames", snap["unknown_dc_frames"])
+	writeStat("config_generation", snap["config_generation"])
+	if d := h.stats.LastConfigDiff(); d != "" {
+		writeStat("config_last_diff", d)
+	}
+	writeStat("first_bytes_tls", snap["first_bytes_tls"])
+	writeStat("first_bytes_mtproto", snap["first_bytes_mtproto"])
+	writeStat("first_bytes_other", snap["first_bytes_other"])
+	writeStat("standby", snap["standby"])
+	writeStat("loopback_backend", snap["loopback_backend"])
+	writeStat("overload_shed_accept", snap["overload_shed_accept"])
+	writeStat("overload_shed_frames", snap["overload_shed_frames"])
+	writeStat("overload_shed_handshakes", snap["overload_shed_handshakes"])
+	writeStat("handler_budget", snap["handler_budget"])
+	writeStat("handlers_active", snap["handlers_active"])
+	writeStat("handler_budget_rejected", snap["handler_budget_rejected"])
+	writeStat("surge_active", snap["surge_active"])
+	writeStat("surge_events", snap["surge_events"])
+	writeStat("surge_rejected", snap["surge_rejected"])
+	writeStat("conn_rate_baseline_per_min", snap["conn_rate_baseline_per_min"])
+	writeStat("blocklist_size", snap["blocklist_size"])
+	writeStat("blocklist_hits", snap["blocklist_hits"])
+	writeStat("blocklist_added", snap["blocklist_added"])
+	writeStat("ip_conn_limit_rejected", snap["ip_conn_limit_rejected"])
+	writeStat("ip_rate_limit_rejected", snap["ip_rate_limit_rejected"])
+	writeStat("ip_limit_tracked", snap["ip_limit_tracked"])
+	writeStat("conntrack_count", snap["conntrack_count"])
+	writeStat("draining", snap["draining"])
+	writeStat("drain_remaining_connections", snap["drain_remaining_connections"])
+	writeStat("drain_closed_connections", snap["drain_closed_connections"])
+	writeStat("drain_force_closed", snap["drain_force_closed"])
+	writeStat("conntrack_max", snap["conntrack_max"])
+	writeStat("clock_steps", snap["clock_steps"])
+	writeStat("clock_last_step_ms", snap["clock_last_step_ms"])
+	writeStat("clock_skew_ms", snap["clock_skew_ms"])
+	writeStat("clock_drift_ppm", snap["clock_drift_ppm"])
+	writeStat("udp_sessions_active", snap["udp_sessions_active"])
+	writeStat("udp_sessions_total", snap["udp_sessions_total"])
+	writeStat("udp_datagrams_in", snap["udp_datagrams_in"])
+	writeStat("udp_datagrams_out", snap["udp_datagrams_out"])
+	writeStat("udp_datagrams_dropped", snap["udp_datagrams_dropped"])
+	writeStat("udp_cookies_sent", snap["udp_cookies_sent"])
+	writeStat("client_ipv4_connections", snap["client_ipv4_connections"])
+	writeStat("client_ipv6_connections", snap["client_ipv6_connections"])
+	writeStat("outbound_ipv4_connects", snap["outbound_ipv4_connects"])
+	writeStat("outbound_ipv6_connects", snap["outbound_ipv6_connects"])
+	writeStat("outbound_family_fallbacks", snap["outbound_family_fallbacks"])
+	for _, class := range []string{"canary", "stable"} {
+		queries := snap[class+"_queries"]
+		writeStat(class+"_queries", queries)
+		writeStat(class+"_errors", snap[class+"_errors"])
+		avg := int64(0)
+		if queries > 0 {
+			avg = snap[class+"_latency_us_total"] / queries
+		}
+		writeStat(class+"_avg_latency_us", avg)
+	}
 
 	proxyTagSet := 0
 	if len(h.proxyTag) == 16 {
@@ -109,13 +584,18 @@ func (h *HTTPStatsServer) handleStats(w http.ResponseWriter, r *http.Request) {
 	}
 	writeStat("proxy_tag_set", int64(proxyTagSet))
 	writeStat("version", h.version)
+	writeStat("implementation", implementationName)
+	writeStat("dataplane_mode", h.DataplaneMode())
 
-	// per-secret счётчики (secret_1_active_connections, ...)
+	// per-secret, per-loop, per-DC, per-listener, очереди, загрузчик конфига и вышестоящие прокси (secret_1_active_connections,
+	// accept_loop_0_accepted, dc_-2_routed_frames, listener_443_handshake_p95_us, queue_client_write_depth, config_fetch_total, outbound_proxy_1_failures, ...)
 	// собираем и сортируем для детерминированного вывода
 	type kv struct{ k string; v int64 }
 	var secretStats []kv
 	for k, v := range snap {
-		if strings.HasPrefix(k, "secret_") {
+		if strings.HasPrefix(k, "secret_") || strings.HasPrefix(k, "accept_loop_") || strings.HasPrefix(k, "dc_") || strings.HasPrefix(k, "queue_") ||
+			strings.HasPrefix(k, "listener_") || strings.HasPrefix(k, "config_fetch_") ||
+			strings.HasPrefix(k, "outbound_proxy_") || strings.HasPrefix(k, "local_addr_") {
 			secretStats = append(secretStats, kv{k, v})
 		}
 	}
@@ -125,9 +605,732 @@ func (h *HTTPStatsServer) handleStats(w http.ResponseWriter, r *http.Request) {
 	for _, s := range secretStats {
 		writeStat(s.k, s.v)
 	}
+	for _, a := range h.stats.LocalAddrs() {
+		writeStat("local_addr_"+a.Local+"_public", a.Public)
+	}
+	if h.health != nil {
+		writeTargetStats(writeStat, h.health.Targets())
+	}
+	if h.router != nil {
+		writeStat("balance_policy", h.router.Policy().String())
+		writeSelectedStats(writeStat, h.router.Selected())
+	}
+	if h.outboundPools != nil {
+		writePoolStats(writeStat, h.outboundPools())
+	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(sb.String()))
 }
+
+// statsJSON — тело ответа /stats.json.
+type statsJSON struct {
+	Uptime         int64              `json:"uptime"`
+	Version        string             `json:"version"`
+	Implementation string             `json:"implementation"`
+	DataplaneMode  string             `json:"dataplane_mode"`
+	Counters       map[string]int64   `json:"counters"`
+	LastConfigDiff string             `json:"last_config_diff,omitempty"`
+	ReloadHistory  []ReloadEvent      `json:"reload_history"`
+	Targets        []TargetStatus     `json:"targets"`
+	Clusters       []clusterJSON      `json:"clusters"`
+	Pools          []TargetPoolStatus `json:"pools,omitempty"`
+	LocalAddrs     []LocalAddrStatus  `json:"local_addrs"`
+}
+
+// clusterJSON — кластер в /stats.json с его target'ами.
+type clusterJSON struct {
+	DC             int                 `json:"dc"`
+	Default        bool                `json:"default,omitempty"`
+	Balance        string              `json:"balance"`
+	CanaryPercent  int                 `json:"canary_percent,omitempty"`
+	HealthyTargets int                 `json:"healthy_targets"`
+	Targets        []clusterTargetJSON `json:"targets"`
+}
+
+// clusterTargetJSON — target кластера; health пуст, пока к нему не было
+// ни одного запроса. Selected — сколько раз Router выбрал target.
+type clusterTargetJSON struct {
+	Addr     string        `json:"addr"`
+	Weight   int           `json:"weight"`
+	Canary   bool          `json:"canary,omitempty"`
+	Selected int64         `json:"selected"`
+	Health   *TargetStatus `json:"health,omitempty"`
+}
+
+// buildClustersJSON раскладывает состояние target'ов из health по
+// кластерам; повторяющиеся адреса схлопываются в weight.
+func buildClustersJSON(clusters []ClusterInfo, health *TargetHealth) []clusterJSON {
+	status := make(map[string]TargetStatus)
+	if health != nil {
+		for _, t := range health.Targets() {
+			status[t.Addr] = t
+		}
+	}
+	target := func(cl ClusterInfo, addr string, canary bool) clusterTargetJSON {
+		t := clusterTargetJSON{Addr: addr, Weight: 1, Canary: canary, Selected: cl.Selected[addr]}
+		if st, ok := status[addr]; ok {
+			t.Health = &st
+		}
+		return t
+	}
+
+	out := make([]clusterJSON, 0, len(clusters))
+	for _, cl := range clusters {
+		c := clusterJSON{DC: cl.ID, Default: cl.Default, Balance: cl.Balance.String(), Targets: []clusterTargetJSON{}}
+		index := make(map[string]int)
+		for _, addr := range cl.Targets {
+			if i, ok := index[addr]; ok {
+				c.Targets[i].Weight++
+				continue
+			}
+			index[addr] = len(c.Targets)
+			c.Targets = append(c.Targets, target(cl, addr, false))
+		}
+		if cl.Canary != "" {
+			c.CanaryPercent = cl.CanaryPercent
+			c.Targets = append(c.Targets, target(cl, cl.Canary, true))
+		}
+		for _, t := range c.Targets {
+			if t.Health != nil && t.Health.Healthy {
+				c.HealthyTargets++
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// writeTargetStats выводит по target'у: healthy, число неудач подряд,
+// время и задержку последней активной проверки, если она была, если
+// была ошибка, её текст, вид и время (unix), а с --dial-backoff-max —
+// состояние circuit breaker'а, текущий backoff и время следующей попытки.
+func writeTargetStats(writeStat func(string, interface{}), targets []TargetStatus) {
+	for _, t := range targets {
+		prefix := "target_" + t.Addr + "_"
+		healthy := int64(0)
+		if t.Healthy {
+			healthy = 1
+		}
+		writeStat(prefix+"healthy", healthy)
+		writeStat(prefix+"consecutive_failures", t.ConsecutiveFailures)
+		if !t.LastProbeAt.IsZero() {
+			writeStat(prefix+"last_probe_at", t.LastProbeAt.Unix())
+			writeStat(prefix+"last_probe_latency_us", t.LastProbeLatencyUs)
+		}
+		if t.LastError != "" {
+			writeStat(prefix+"last_error", t.LastError)
+			writeStat(prefix+"last_error_kind", t.LastErrorKind)
+			writeStat(prefix+"last_error_at", t.LastErrorAt.Unix())
+		}
+		if t.Circuit != "" {
+			writeStat(prefix+"circuit", t.Circuit)
+			writeStat(prefix+"backoff_ms", t.BackoffMs)
+		}
+		if !t.CircuitRetryAt.IsZero() {
+			writeStat(prefix+"circuit_retry_at", t.CircuitRetryAt.Unix())
+		}
+	}
+}
+
+// writeSelectedStats выводит target_<addr>_selected — сколько раз Router
+// выбрал target, по возрастанию адреса.
+func writeSelectedStats(writeStat func(string, interface{}), selected map[string]int64) {
+	addrs := make([]string, 0, len(selected))
+	for addr := range selected {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		writeStat("target_"+addr+"_selected", selected[addr])
+	}
+}
+
+// writePoolStats выводит по target'у число открытых соединений пула,
+// его пределы и запросы, ждущие ответа.
+func writePoolStats(writeStat func(string, interface{}), pools []TargetPoolStatus) {
+	for _, tp := range pools {
+		prefix := "target_" + tp.Addr + "_pool_"
+		writeStat(prefix+"open", tp.Open)
+		writeStat(prefix+"min", tp.Min)
+		writeStat(prefix+"max", tp.Max)
+		writeStat(prefix+"outstanding", tp.Outstanding)
+	}
+}
+
+// buildStatsJSON собирает тело /stats.json; reloads, health и router могут
+// быть nil, без router раздел clusters пуст.
+func buildStatsJSON(stats *Stats, secretCount int, version, mode string, reloads *ReloadHistory, health *TargetHealth, router *Router) statsJSON {
+	resp := statsJSON{
+		Uptime:         int64(stats.Uptime()),
+		Version:        version,
+		Implementation: implementationName,
+		DataplaneMode:  mode,
+		Counters:       stats.Snapshot(secretCount),
+		LastConfigDiff: stats.LastConfigDiff(),
+		ReloadHistory:  []ReloadEvent{},
+		Targets:        []TargetStatus{},
+		Clusters:       []clusterJSON{},
+		LocalAddrs:     stats.LocalAddrs(),
+	}
+	if resp.LocalAddrs == nil {
+		resp.LocalAddrs = []LocalAddrStatus{}
+	}
+	if reloads != nil {
+		resp.ReloadHistory = reloads.Events()
+	}
+	if health != nil {
+		resp.Targets = health.Targets()
+	}
+	if router != nil {
+		resp.Clusters = buildClustersJSON(router.Clusters(), health)
+	}
+	return resp
+}
+
+// handleStatsJSON отдаёт те же счётчики, что /stats, в JSON вместе с
+// историей последних перезагрузок конфигурации.
+func (h *HTTPStatsServer) handleStatsJSON(w http.ResponseWriter, r *http.Request) {
+	h.stats.IncHTTPQuery()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	resp := buildStatsJSON(h.stats, int(h.secretCount.Load()), h.version, h.DataplaneMode(), h.reloads, h.health, h.router)
+	if h.outboundPools != nil {
+		resp.Pools = h.outboundPools()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleLatency отдаёт содержимое резервуара сэмплов задержек.
+// Первые строки — сводка в формате "key\tvalue", далее по строке на сэмпл;
+// все длительности в микросекундах.
+func (h *HTTPStatsServer) handleLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	samples := h.latency.Samples()
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Start.Before(samples[j].Start)
+	})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "latency_sample_rate\t%d\n", h.latency.Rate())
+	fmt.Fprintf(&sb, "latency_sampled_total\t%d\n", h.latency.Sampled())
+	fmt.Fprintf(&sb, "latency_samples\t%d\n", len(samples))
+	sb.WriteString("\n# start\tdc\tread_us\troute_us\tdial_us\twrite_us\tresponse_us\ttotal_us\n")
+	for _, s := range samples {
+		fmt.Fprintf(&sb, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			s.Start.UTC().Format(time.RFC3339Nano),
+			s.TargetDC,
+			s.Read.Microseconds(),
+			s.Route.Microseconds(),
+			s.Dial.Microseconds(),
+			s.Write.Microseconds(),
+			s.Response.Microseconds(),
+			s.Total().Microseconds(),
+		)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleLatencyReset очищает резервуар сэмплов (только POST).
+func (h *HTTPStatsServer) handleLatencyReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.readOnly.Load() {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeDraining, "shutting down: stats are read-only")
+		return
+	}
+	h.latency.Reset()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleActivate выводит процесс из warm standby (только POST). Активация
+// пускает на порт клиентов, поэтому эндпоинт отвечает только на
+// --admin-socket.
+func (h *HTTPStatsServer) handleActivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !fromAdminSocket(r) {
+		writeAPIError(w, http.StatusForbidden, errCodeForbidden, "/admin/activate is served on --admin-socket only")
+		return
+	}
+	if h.readOnly.Load() {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeDraining, "shutting down: stats are read-only")
+		return
+	}
+	msg := "already active\n"
+	if h.activate() {
+		msg = "activated\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(msg))
+}
+
+// handleProbe проверяет все target'ы и отдаёт результаты (только POST):
+// сводка "key\tvalue", далее по строке на адрес, задержка в микросекундах.
+func (h *HTTPStatsServer) handleProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.readOnly.Load() {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeDraining, "shutting down: stats are read-only")
+		return
+	}
+	results := h.probe()
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "probe_targets\t%d\n", len(results))
+	fmt.Fprintf(&sb, "probe_failed\t%d\n", failed)
+	sb.WriteString("\n# addr\tdcs\tstatus\tlatency_us\terror\n")
+	for _, res := range results {
+		dcs := make([]string, len(res.DCs))
+		for i, dc := range res.DCs {
+			dcs[i] = strconv.Itoa(dc)
+		}
+		status, errText := "ok", ""
+		if res.Err != nil {
+			status, errText = "failed", res.Err.Error()
+		}
+		fmt.Fprintf(&sb, "%s\t%s\t%s\t%d\t%s\n",
+			res.Addr, strings.Join(dcs, ","), status, res.Latency.Microseconds(), errText)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleDescriptor отдаёт дескриптор для регистрации прокси.
+func (h *HTTPStatsServer) handleDescriptor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	d, err := h.descriptor()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(d)
+}
+
+// handleEffectiveConfig отдаёт действующие значения опций после слияния
+// флагов, переменных окружения и --config-yaml; секреты скрыты.
+func (h *HTTPStatsServer) handleEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Options []ConfigSetting `json:"options"`
+	}{h.effectiveConfig})
+}
+
+// handleEvents отдаёт последние события из кольца, старые первыми.
+// ?n=N ограничивает вывод N последними событиями.
+func (h *HTTPStatsServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	n := 0
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "bad n")
+			return
+		}
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# total %d\n", h.events.Total())
+	writeEventsText(&sb, h.events.Events(n))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleConnections отдаёт таблицу активных соединений, старые первыми:
+// транспорт, отпечаток секрета, запрошенный DC, backend, возраст, байты и
+// состояние каждого. ?dc=N оставляет только соединения к DC N. Адреса
+// клиентов обрезаются до сети; ?addr=full отдаёт их целиком, но только на
+// --admin-socket.
+func (h *HTTPStatsServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	full := r.URL.Query().Get("addr") == "full"
+	if full && !fromAdminSocket(r) {
+		writeAPIError(w, http.StatusForbidden, errCodeForbidden, "addr=full is served on --admin-socket only")
+		return
+	}
+	conns := h.conns.Conns()
+	if v := r.URL.Query().Get("dc"); v != "" {
+		dc, err := strconv.ParseInt(v, 10, 16)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "bad dc")
+			return
+		}
+		filtered := conns[:0]
+		for _, c := range conns {
+			if c.TargetDC == int16(dc) {
+				filtered = append(filtered, c)
+			}
+		}
+		conns = filtered
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# total %d\n", len(conns))
+	writeConnsText(&sb, conns, time.Now(), full)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleHealthz отвечает 200, пока процесс жив и конфигурация загружена,
+// иначе 503; тело — итог и строка на каждую проверку.
+func (h *HTTPStatsServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	serveHealthReport(w, r, h.liveness)
+}
+
+// handleReadyz отвечает 200, когда прокси готов принимать клиентов: есть
+// конфигурация, слушающий listener и здоровый target. Во время остановки,
+// standby и drain всех listener'ов — 503.
+func (h *HTTPStatsServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	serveHealthReport(w, r, h.readiness)
+}
+
+func serveHealthReport(w http.ResponseWriter, r *http.Request, check func() HealthReport) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	report := check()
+	var sb strings.Builder
+	writeHealthReport(&sb, report)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.OK() {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write([]byte(sb.String()))
+}
+
+// handleTrace включает (POST /admin/trace?conn=<id>) или выключает
+// (&trace=off) запись в лог каждого кадра одного соединения и отдаёт его
+// строку из /debug/connections. Трассировка пишет в лог содержимое кадров
+// клиента, поэтому эндпоинт отвечает только на --admin-socket.
+func (h *HTTPStatsServer) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !fromAdminSocket(r) {
+		writeAPIError(w, http.StatusForbidden, errCodeForbidden, "/admin/trace is served on --admin-socket only")
+		return
+	}
+	if h.readOnly.Load() {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeDraining, "shutting down: stats are read-only")
+		return
+	}
+	q := r.URL.Query()
+	id := q.Get("conn")
+	if id == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "conn parameter required")
+		return
+	}
+	var on bool
+	switch q.Get("trace") {
+	case "", "on":
+		on = true
+	case "off":
+	default:
+		writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "trace must be on or off")
+		return
+	}
+	c := h.conns.Trace(id, on)
+	if c == nil {
+		writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no open connection "+id)
+		return
+	}
+	var sb strings.Builder
+	writeConnsText(&sb, []*ConnInfo{c}, time.Now(), false)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleIPLimits отдаёт лимиты на IP источника и IP, которые недавно в них
+// упёрлись, последние первыми: сколько раз и по какому лимиту (conns или
+// rate) соединения были отклонены.
+func (h *HTTPStatsServer) handleIPLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	maxConns, rate := h.ipLimits.Limits()
+	offenders := h.ipLimits.Offenders()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# max_conns_per_ip %d\n# per_ip_accept_rate %g\n# total %d\n", maxConns, rate, len(offenders))
+	writeOffendersText(&sb, offenders)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleOutbound отдаёт живые соединения с backend'ами по target'ам, старые
+// первыми: возраст, число переподключений к target'у до этого соединения,
+// кадры, байты и ошибки за время жизни. ?target=addr оставляет один target.
+func (h *HTTPStatsServer) handleOutbound(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	conns := h.outboundConns()
+	if target := r.URL.Query().Get("target"); target != "" {
+		filtered := conns[:0]
+		for _, c := range conns {
+			if c.Addr == target {
+				filtered = append(filtered, c)
+			}
+		}
+		conns = filtered
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# total %d\n", len(conns))
+	writeOutboundConnsText(&sb, conns, time.Now())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleListeners отдаёт состояние клиентских listener'ов: по строке
+// "addr\tstate\tconnections", state — serving, draining или drained.
+func (h *HTTPStatsServer) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("# addr\tstate\tconnections\n")
+	for _, st := range h.listeners() {
+		writeListenerStatus(&sb, st)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleReload перезагружает конфигурацию и секреты, как SIGHUP, и
+// отвечает, когда перезагрузка закончена (только POST).
+func (h *HTTPStatsServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := h.reloadConfig(); err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeReloadFailed, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleDrain выводит из работы listener ?listener=<addr> (только POST) и
+// отдаёт его состояние; повторный вызов только сообщает, сколько
+// соединений осталось.
+func (h *HTTPStatsServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.readOnly.Load() {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeDraining, "shutting down: stats are read-only")
+		return
+	}
+	addr := r.URL.Query().Get("listener")
+	if addr == "" {
+		writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "listener parameter required")
+		return
+	}
+	st, err := h.drain(addr)
+	if errors.Is(err, ErrUnknownListener) {
+		writeAPIError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	var sb strings.Builder
+	writeListenerStatus(&sb, st)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleDrainUnsupported отвечает на /admin/drain при -M: порт слушают все
+// воркеры (с --inherit-listeners — и супервизор), и закрыть его у себя
+// одному воркеру недостаточно, чтобы порт перестал принимать.
+func handleDrainUnsupported(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusConflict, errCodeUnsupported, "draining a listener is not supported with -M: every worker accepts on the port")
+}
+
+// handleSecretsReloadUnsupported отвечает на /admin/secrets/reload на
+// --admin-socket воркера 0 при -M: он перечитал бы секреты только у себя, а
+// удалённый секрет продолжали бы принимать остальные воркеры.
+func handleSecretsReloadUnsupported(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusConflict, errCodeUnsupported, "with -M, reload secrets on the supervisor's stats address or with SIGHUP to the supervisor")
+}
+
+// Коды ошибок API. Тело ответа с ошибкой всегда JSON вида
+// {"code": "...", "message": "..."}: автоматика ветвится по code, message —
+// для людей и может меняться.
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeNotFound         = "not_found"
+	errCodeDraining         = "draining" // идёт остановка, изменения запрещены
+	errCodeReloadFailed     = "reload_failed"
+	errCodeUnsupported      = "unsupported" // недоступно при -M
+	errCodeForbidden        = "forbidden"   // эндпоинт не для этого клиента
+	errCodeInternal         = "internal"
+)
+
+// apiError — тело ответа с ошибкой.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeAPIError отвечает ошибкой status с машинно-читаемым code.
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Code: code, Message: message})
+}
+
+// handleSecretsReload перечитывает секреты (только POST) и отдаёт
+// "key\tvalue": сколько секретов в работе, сколько добавлено и удалено.
+func (h *HTTPStatsServer) handleSecretsReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.readOnly.Load() {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeDraining, "shutting down: stats are read-only")
+		return
+	}
+	res, err := h.reloadSecrets()
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, errCodeReloadFailed, err.Error())
+		return
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "secrets\t%d\n", res.Secrets)
+	fmt.Fprintf(&sb, "added\t%d\n", res.Added)
+	fmt.Fprintf(&sb, "removed\t%d\n", res.Removed)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleLimits отдаёт лимиты сессий и обработчиков строками "key\tvalue"
+// (GET) или меняет заданные параметрами max_sessions и handler_budget
+// (POST) и отдаёт получившиеся. Лимиты позволяют отключить обслуживание,
+// поэтому эндпоинт отвечает только на --admin-socket.
+func (h *HTTPStatsServer) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if !fromAdminSocket(r) {
+		writeAPIError(w, http.StatusForbidden, errCodeForbidden, "/admin/limits is served on --admin-socket only")
+		return
+	}
+	limits := h.limits()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if h.readOnly.Load() {
+			writeAPIError(w, http.StatusServiceUnavailable, errCodeDraining, "shutting down: stats are read-only")
+			return
+		}
+		var u ConnLimitUpdate
+		q := r.URL.Query()
+		for _, p := range []struct {
+			name  string
+			field **int64
+		}{{"max_sessions", &u.MaxSessions}, {"handler_budget", &u.HandlerBudget}} {
+			v := q.Get(p.name)
+			if v == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "bad "+p.name)
+				return
+			}
+			*p.field = &n
+		}
+		if u.MaxSessions == nil && u.HandlerBudget == nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "max_sessions or handler_budget parameter required")
+			return
+		}
+		var err error
+		limits, err = h.setLimits(u, requester(r))
+		switch {
+		case errors.Is(err, ErrLimitRange):
+			writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+			return
+		case err != nil:
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "max_sessions\t%d\n", limits.MaxSessions)
+	fmt.Fprintf(&sb, "handler_budget\t%d\n", limits.HandlerBudget)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+func writeListenerStatus(sb *strings.Builder, st ListenerStatus) {
+	fmt.Fprintf(sb, "%s\t%s\t%d\n", st.Addr, st.State(), st.Connections)
+}
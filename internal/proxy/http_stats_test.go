@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatsDataplaneMode verifies the implementation and dataplane_mode
+// labels in /stats and /stats.json.
+func TestStatsDataplaneMode(t *testing.T) {
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+
+	rec := httptest.NewRecorder()
+	h.handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	body := rec.Body.String()
+	for _, line := range []string{"implementation\tgo\n", "dataplane_mode\tdisabled\n"} {
+		if !strings.Contains(body, line) {
+			t.Errorf("/stats missing %q", line)
+		}
+	}
+
+	h.SetDataplaneMode(DataplaneModeClient)
+	rec = httptest.NewRecorder()
+	h.handleStatsJSON(rec, httptest.NewRequest(http.MethodGet, "/stats.json", nil))
+	var resp statsJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Implementation != "go" || resp.DataplaneMode != DataplaneModeClient {
+		t.Errorf("got implementation=%q dataplane_mode=%q", resp.Implementation, resp.DataplaneMode)
+	}
+}
+
+// TestHandleDrain checks the listener list and the drain endpoint.
+func TestHandleDrain(t *testing.T) {
+	listeners := []ListenerStatus{{Addr: ":443"}, {Addr: ":8443", Connections: 3}}
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetListenerControl(
+		func() []ListenerStatus { return listeners },
+		func(addr string) (ListenerStatus, error) {
+			for i := range listeners {
+				if listeners[i].Addr == addr {
+					listeners[i].Draining = true
+					return listeners[i], nil
+				}
+			}
+			return ListenerStatus{}, ErrUnknownListener
+		})
+
+	for _, tc := range []struct {
+		method, url string
+		code        int
+		body        string
+		errCode     string
+	}{
+		{http.MethodGet, "/admin/drain?listener=:8443", http.StatusMethodNotAllowed, "", errCodeMethodNotAllowed},
+		{http.MethodPost, "/admin/drain", http.StatusBadRequest, "", errCodeBadRequest},
+		{http.MethodPost, "/admin/drain?listener=:9999", http.StatusNotFound, "", errCodeNotFound},
+		{http.MethodPost, "/admin/drain?listener=:8443", http.StatusOK, ":8443\tdraining\t3\n", ""},
+	} {
+		rec := httptest.NewRecorder()
+		h.handleDrain(rec, httptest.NewRequest(tc.method, tc.url, nil))
+		if rec.Code != tc.code || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s %s: %d %q, want %d %q", tc.method, tc.url, rec.Code, rec.Body.String(), tc.code, tc.body)
+		}
+		if tc.errCode != "" {
+			if got := decodeAPIError(t, rec); got.Code != tc.errCode || got.Message == "" {
+				t.Errorf("%s %s: error %+v, want code %q", tc.method, tc.url, got, tc.errCode)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.handleListeners(rec, httptest.NewRequest(http.MethodGet, "/admin/listeners", nil))
+	want := "# addr\tstate\tconnections\n:443\tserving\t0\n:8443\tdraining\t3\n"
+	if rec.Body.String() != want {
+		t.Errorf("/admin/listeners = %q, want %q", rec.Body.String(), want)
+	}
+
+	// While shutting down, changes are refused with the draining code.
+	h.SetReadOnly()
+	rec = httptest.NewRecorder()
+	h.handleDrain(rec, httptest.NewRequest(http.MethodPost, "/admin/drain?listener=:443", nil))
+	if got := decodeAPIError(t, rec); rec.Code != http.StatusServiceUnavailable || got.Code != errCodeDraining {
+		t.Errorf("read-only drain: %d %+v", rec.Code, got)
+	}
+}
+
+// decodeAPIError decodes the JSON body of an error response.
+func decodeAPIError(t *testing.T, rec *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("error Content-Type = %q", ct)
+	}
+	var e apiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Errorf("decode error body %q: %v", rec.Body.String(), err)
+	}
+	return e
+}
+
+// TestStatsJSONClusters checks /stats?format=json and the per-cluster
+// breakdown with weights, canaries and target health.
+func TestStatsJSONClusters(t *testing.T) {
+	router := NewRouter(nil)
+	router.snap.Store(&routerSnapshot{
+		defaultID: 2,
+		clusters: map[int]*routeCluster{
+			2: {id: 2, addrs: []string{"10.0.0.1:8888", "10.0.0.2:8888", "10.0.0.1:8888"}, canary: "10.0.0.9:8888", canaryPercent: 10},
+			4: {id: 4, addrs: []string{"10.0.0.4:8888"}},
+		},
+	})
+	router.countSelected("10.0.0.1:8888")
+	health := NewTargetHealth()
+	health.Success("10.0.0.1:8888")
+	health.Failure("10.0.0.2:8888", errors.New("connection refused"), time.Now())
+
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetTargetHealth(health)
+	h.SetRouter(router)
+
+	rec := httptest.NewRecorder()
+	h.handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats?format=json", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var resp statsJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(resp.Clusters) != 2 || resp.Clusters[0].DC != 2 || resp.Clusters[1].DC != 4 {
+		t.Fatalf("clusters = %+v", resp.Clusters)
+	}
+	dc2 := resp.Clusters[0]
+	if !dc2.Default || dc2.Balance != "random" || dc2.CanaryPercent != 10 || dc2.HealthyTargets != 1 || len(dc2.Targets) != 3 {
+		t.Errorf("dc 2 = %+v", dc2)
+	}
+	if tg := dc2.Targets[0]; tg.Addr != "10.0.0.1:8888" || tg.Weight != 2 || tg.Selected != 1 || tg.Health == nil || !tg.Health.Healthy {
+		t.Errorf("first target = %+v", tg)
+	}
+	if tg := dc2.Targets[1]; tg.Health == nil || tg.Health.Healthy || tg.Health.LastError == "" {
+		t.Errorf("failed target = %+v", tg)
+	}
+	if tg := dc2.Targets[2]; !tg.Canary || tg.Health != nil {
+		t.Errorf("canary target = %+v", tg)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	for _, line := range []string{"balance_policy\trandom\n", "target_10.0.0.1:8888_selected\t1\n"} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("/stats has no %q", line)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats?format=xml", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("format=xml: status %d", rec.Code)
+	}
+}
+
+func TestHandleSecretsReload(t *testing.T) {
+	var reloadErr error
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetSecretReloader(func() (SecretReload, error) {
+		return SecretReload{Secrets: 3, Added: 1, Removed: 2}, reloadErr
+	})
+
+	rec := httptest.NewRecorder()
+	h.handleSecretsReload(rec, httptest.NewRequest(http.MethodPost, "/admin/secrets/reload", nil))
+	if want := "secrets\t3\nadded\t1\nremoved\t2\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("reload: %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+
+	reloadErr = errors.New("open secrets.txt: no such file or directory")
+	rec = httptest.NewRecorder()
+	h.handleSecretsReload(rec, httptest.NewRequest(http.MethodPost, "/admin/secrets/reload", nil))
+	if got := decodeAPIError(t, rec); rec.Code != http.StatusUnprocessableEntity || got.Code != errCodeReloadFailed {
+		t.Errorf("failed reload: %d %+v", rec.Code, got)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleSecretsReload(rec, httptest.NewRequest(http.MethodGet, "/admin/secrets/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", rec.Code)
+	}
+}
+
+func TestHandleLimits(t *testing.T) {
+	shedder := NewOverloadShedder(ShedAtAccept, 100, 0, nil)
+	budget := NewHandlerBudget(0, nil)
+	limits := func() ConnLimits {
+		return ConnLimits{MaxSessions: shedder.MaxSessions(), HandlerBudget: budget.Limit()}
+	}
+	var who string
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetLimitControl(limits, func(u ConnLimitUpdate, by string) (ConnLimits, error) {
+		if err := u.Validate(); err != nil {
+			return ConnLimits{}, err
+		}
+		if u.MaxSessions != nil {
+			shedder.SetMaxSessions(*u.MaxSessions)
+		}
+		if u.HandlerBudget != nil {
+			budget.SetLimit(*u.HandlerBudget)
+		}
+		who = by
+		return limits(), nil
+	})
+
+	rec := httptest.NewRecorder()
+	h.handleLimits(rec, httptest.NewRequest(http.MethodPost, "/admin/limits?max_sessions=10", nil))
+	if got := decodeAPIError(t, rec); rec.Code != http.StatusForbidden || got.Code != errCodeForbidden {
+		t.Errorf("POST over TCP: %d %+v, want 403 %s", rec.Code, got, errCodeForbidden)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleLimits(rec, adminRequest(http.MethodGet, "/admin/limits"))
+	if want := "max_sessions\t100\nhandler_budget\t0\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("GET: %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleLimits(rec, adminRequest(http.MethodPost, "/admin/limits?max_sessions=250"))
+	if want := "max_sessions\t250\nhandler_budget\t0\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("POST: %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+	if who != "uid 1001 on the admin socket" {
+		t.Errorf("change attributed to %q", who)
+	}
+
+	// A limit that was off at startup can be turned on.
+	rec = httptest.NewRecorder()
+	h.handleLimits(rec, adminRequest(http.MethodPost, "/admin/limits?handler_budget=1000"))
+	if want := "max_sessions\t250\nhandler_budget\t1000\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("POST handler_budget: %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+
+	for _, tc := range []struct {
+		query  string
+		status int
+		code   string
+	}{
+		{"", http.StatusBadRequest, errCodeBadRequest},
+		{"max_sessions=lots", http.StatusBadRequest, errCodeBadRequest},
+		{"max_sessions=1", http.StatusBadRequest, errCodeBadRequest},
+		{"max_sessions=20000000", http.StatusBadRequest, errCodeBadRequest},
+		{"handler_budget=8", http.StatusBadRequest, errCodeBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		h.handleLimits(rec, adminRequest(http.MethodPost, "/admin/limits?"+tc.query))
+		if got := decodeAPIError(t, rec); rec.Code != tc.status || got.Code != tc.code {
+			t.Errorf("POST ?%s: %d %+v, want %d %s", tc.query, rec.Code, got, tc.status, tc.code)
+		}
+	}
+	if got := shedder.MaxSessions(); got != 250 {
+		t.Errorf("max sessions %d after rejected changes, want 250", got)
+	}
+}
+
+func TestHandleActivate(t *testing.T) {
+	active := false
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetActivator(func() bool {
+		was := active
+		active = true
+		return !was
+	})
+
+	rec := httptest.NewRecorder()
+	h.handleActivate(rec, httptest.NewRequest(http.MethodPost, "/admin/activate", nil))
+	if got := decodeAPIError(t, rec); rec.Code != http.StatusForbidden || got.Code != errCodeForbidden || active {
+		t.Errorf("POST over TCP: %d %+v active=%v, want 403 %s", rec.Code, got, active, errCodeForbidden)
+	}
+
+	for _, want := range []string{"activated\n", "already active\n"} {
+		rec = httptest.NewRecorder()
+		h.handleActivate(rec, adminRequest(http.MethodPost, "/admin/activate"))
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("POST: %d %q, want %q", rec.Code, rec.Body.String(), want)
+		}
+	}
+}
+
+// adminRequest returns a request as if it came over --admin-socket from
+// uid 1001.
+func adminRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	return req.WithContext(context.WithValue(req.Context(), adminPeerKey{}, uint32(1001)))
+}
+
+// TestHandleRoot_Dashboard checks that browsers get the dashboard at /
+// while other clients keep getting the text stats.
+func TestHandleRoot_Dashboard(t *testing.T) {
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	rec := httptest.NewRecorder()
+	h.handleRoot(rec, req)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("browser got Content-Type %q, want text/html", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `fetch("stats.json"`) {
+		t.Error("dashboard does not poll stats.json")
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "*/*")
+	h.handleRoot(rec, req)
+	if !strings.Contains(rec.Body.String(), "implementation\tgo\n") {
+		t.Errorf("curl-style GET / did not get the text stats: %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	serveDashboard(rec, httptest.NewRequest(http.MethodPost, "/ui", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /ui: status %d, want 405", rec.Code)
+	}
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	mux.HandleFunc("/stats", ok)
+	mux.HandleFunc("/debug/events", ok)
+	mux.HandleFunc("/admin/limits", ok)
+	h := loopbackOnly(mux)
+
+	cases := []struct {
+		remote, path string
+		want         int
+	}{
+		{"192.0.2.1:5000", "/stats", http.StatusOK},
+		{"192.0.2.1:5000", "/debug/events", http.StatusForbidden},
+		{"192.0.2.1:5000", "/admin/limits", http.StatusForbidden},
+		{"192.0.2.1:5000", "/stats/../admin/limits", http.StatusForbidden},
+		{"127.0.0.1:5000", "/admin/limits", http.StatusOK},
+		{"[::1]:5000", "/debug/events", http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.RemoteAddr = tc.remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s from %s: status %d, want %d", tc.path, tc.remote, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusForbidden {
+			if e := decodeAPIError(t, rec); e.Code != errCodeForbidden {
+				t.Errorf("%s from %s: code %q, want %q", tc.path, tc.remote, e.Code, errCodeForbidden)
+			}
+		}
+	}
+}
+
+func TestHandleReload(t *testing.T) {
+	var err error
+	reloads := 0
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetConfigReloader(func() error {
+		reloads++
+		return err
+	})
+
+	rec := httptest.NewRecorder()
+	h.handleReload(rec, httptest.NewRequest(http.MethodGet, "/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed || reloads != 0 {
+		t.Errorf("GET: %d, %d reloads", rec.Code, reloads)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleReload(rec, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if rec.Code != http.StatusOK || reloads != 1 {
+		t.Errorf("POST: %d, %d reloads", rec.Code, reloads)
+	}
+
+	err = errors.New("not listening yet")
+	rec = httptest.NewRecorder()
+	h.handleReload(rec, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if got := decodeAPIError(t, rec); rec.Code != http.StatusServiceUnavailable || got.Code != errCodeReloadFailed {
+		t.Errorf("POST before listening: %d %+v", rec.Code, got)
+	}
+}
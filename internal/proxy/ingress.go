@@ -3,7 +3,10 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 // IngressServer is a generic TCP listener that accepts connections and
@@ -11,25 +14,204 @@ import (
 type IngressServer struct {
 	addr    string
 	handler func(conn net.Conn)
+
+	// acceptLoops is the number of goroutines calling Accept on the shared
+	// listener. Values below 1 are treated as 1.
+	acceptLoops int
+
+	// stats receives per-loop accept counters; nil disables accounting.
+	stats *Stats
+
+	// filter, if set, is consulted for every accepted connection; when it
+	// returns false the connection is closed without calling handler.
+	filter func(conn net.Conn) bool
+
+	// budget, if set, caps handler goroutines across listeners; connections
+	// over the cap are closed before the filter and without a goroutine.
+	budget *HandlerBudget
+
+	// reusePort binds the listener with SO_REUSEPORT so several processes
+	// can serve the same port.
+	reusePort bool
+
+	// sockopts are set on every accepted connection; the first failure is
+	// logged and the connection is served anyway.
+	sockopts       SocketOptions
+	sockoptsFailed atomic.Bool
+
+	// inherited, if set, is an already bound listener (passed down by the
+	// supervisor, or bound early by Listen) used instead of binding addr.
+	inherited net.Listener
+
+	// gate, if set, holds the accept loops until it is closed; the listener
+	// is bound meanwhile so activation is instant.
+	gate <-chan struct{}
+
+	// ln is the bound listener, kept so Drain can close it.
+	mu sync.Mutex
+	ln net.Listener
+
+	// draining is set by Drain; active counts connections whose handler is
+	// still running.
+	draining atomic.Bool
+	active   atomic.Int64
+}
+
+// ListenerStatus describes one client listener.
+type ListenerStatus struct {
+	Addr        string
+	Draining    bool
+	Connections int64
+}
+
+// State is "serving", "draining" (not accepting, connections left) or
+// "drained".
+func (st ListenerStatus) State() string {
+	switch {
+	case !st.Draining:
+		return "serving"
+	case st.Connections > 0:
+		return "draining"
+	}
+	return "drained"
 }
 
 // NewIngressServer creates an IngressServer listening on addr.
 // handler is called in a new goroutine for every accepted connection.
 func NewIngressServer(addr string, handler func(conn net.Conn)) *IngressServer {
 	return &IngressServer{
-		addr:    addr,
-		handler: handler,
+		addr:        addr,
+		handler:     handler,
+		acceptLoops: 1,
 	}
 }
 
-// ListenAndServe starts the TCP listener and blocks until ctx is cancelled or a
-// fatal listen error occurs. It closes the listener when ctx is done.
-func (s *IngressServer) ListenAndServe(ctx context.Context) error {
+// SetAcceptLoops sets the number of accept goroutines for the listener.
+// Must be called before ListenAndServe.
+func (s *IngressServer) SetAcceptLoops(n int) {
+	if n < 1 {
+		n = 1
+	}
+	s.acceptLoops = n
+}
+
+// SetStats attaches the Stats instance used for per-loop accept counters.
+// Must be called before ListenAndServe.
+func (s *IngressServer) SetStats(stats *Stats) {
+	s.stats = stats
+}
+
+// SetAcceptFilter installs a check run on every accepted connection before
+// the handler. Must be called before ListenAndServe.
+func (s *IngressServer) SetAcceptFilter(f func(conn net.Conn) bool) {
+	s.filter = f
+}
+
+// SetHandlerBudget makes the server reject connections at accept time while
+// budget is exhausted. Must be called before ListenAndServe.
+func (s *IngressServer) SetHandlerBudget(budget *HandlerBudget) {
+	s.budget = budget
+}
+
+// SetReusePort makes ListenAndServe bind with SO_REUSEPORT. Must be called
+// before ListenAndServe.
+func (s *IngressServer) SetReusePort(on bool) {
+	s.reusePort = on
+}
+
+// SetSocketOptions sets the TCP options of accepted connections. Must be
+// called before ListenAndServe.
+func (s *IngressServer) SetSocketOptions(o SocketOptions) {
+	s.sockopts = o
+}
+
+// SetListener makes ListenAndServe serve ln instead of binding addr. Must
+// be called before ListenAndServe.
+func (s *IngressServer) SetListener(ln net.Listener) {
+	s.inherited = ln
+}
+
+// Listen binds addr now rather than in ListenAndServe, so the caller can
+// act between binding and serving. It does nothing if a listener is already
+// set.
+func (s *IngressServer) Listen(ctx context.Context) error {
+	if s.inherited != nil {
+		return nil
+	}
 	lc := net.ListenConfig{}
+	if s.reusePort {
+		lc.Control = reusePortControl
+	}
 	ln, err := lc.Listen(ctx, "tcp", s.addr)
 	if err != nil {
 		return fmt.Errorf("ingress listen %s: %w", s.addr, err)
 	}
+	s.inherited = ln
+	return nil
+}
+
+// close releases a listener bound by Listen or set with SetListener that
+// will not be served, so a later Listen binds afresh.
+func (s *IngressServer) close() {
+	if s.inherited != nil {
+		s.inherited.Close()
+		s.inherited = nil
+	}
+}
+
+// SetStandby makes ListenAndServe bind the listener but not accept until
+// gate is closed. Must be called before ListenAndServe.
+func (s *IngressServer) SetStandby(gate <-chan struct{}) {
+	s.gate = gate
+}
+
+// Addr returns the address the server was created for.
+func (s *IngressServer) Addr() string {
+	return s.addr
+}
+
+// Drain stops accepting new connections while accepted ones keep running
+// to completion. The listener stays closed until the process exits. It
+// reports false if the listener was already draining.
+func (s *IngressServer) Drain() bool {
+	if s.draining.Swap(true) {
+		return false
+	}
+	s.mu.Lock()
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// Status returns the drain state and the number of open connections.
+func (s *IngressServer) Status() ListenerStatus {
+	return ListenerStatus{
+		Addr:        s.addr,
+		Draining:    s.draining.Load(),
+		Connections: s.active.Load(),
+	}
+}
+
+// ListenAndServe starts the TCP listener and blocks until ctx is cancelled or a
+// fatal listen error occurs. It closes the listener when ctx is done.
+// A drained listener stays idle until ctx is done.
+//
+// With more than one accept loop configured, every loop calls Accept on the
+// same listener; the first loop that fails closes the listener so the others
+// unblock, and its error is returned.
+func (s *IngressServer) ListenAndServe(ctx context.Context) error {
+	if err := s.Listen(ctx); err != nil {
+		return err
+	}
+	ln := s.inherited
+	s.mu.Lock()
+	s.ln = ln
+	if s.draining.Load() {
+		ln.Close()
+	}
+	s.mu.Unlock()
 
 	// Close listener when context is cancelled so Accept() unblocks.
 	go func() {
@@ -37,6 +219,43 @@ func (s *IngressServer) ListenAndServe(ctx context.Context) error {
 		ln.Close()
 	}()
 
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	loops := s.acceptLoops
+	if loops < 1 {
+		loops = 1
+	}
+
+	errCh := make(chan error, loops)
+	for i := 0; i < loops; i++ {
+		go func(loop int) {
+			defer processCrash.Load().Recover()
+			errCh <- s.acceptLoop(ctx, ln, loop)
+		}(i)
+	}
+
+	var firstErr error
+	for i := 0; i < loops; i++ {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+			ln.Close()
+		}
+	}
+	if firstErr == nil && s.draining.Load() {
+		<-ctx.Done()
+	}
+	return firstErr
+}
+
+// acceptLoop accepts connections on ln until it is closed.
+// loop is the zero-based index used for per-loop accept counters.
+func (s *IngressServer) acceptLoop(ctx context.Context, ln net.Listener, loop int) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -45,9 +264,32 @@ func (s *IngressServer) ListenAndServe(ctx context.Context) error {
 			case <-ctx.Done():
 				return nil
 			default:
-				return fmt.Errorf("ingress accept: %w", err)
+				if s.draining.Load() {
+					return nil
+				}
+				return fmt.Errorf("ingress accept (loop %d): %w", loop, err)
 			}
 		}
-		go s.handler(conn)
+		if s.stats != nil {
+			s.stats.IncAcceptLoop(loop)
+		}
+		if err := s.sockopts.apply(conn); err != nil && !s.sockoptsFailed.Swap(true) {
+			log.Printf("ingress %s: socket options: %v", s.addr, err)
+		}
+		if !s.budget.Acquire() {
+			conn.Close()
+			continue
+		}
+		if s.filter != nil && !s.filter(conn) {
+			s.budget.Release()
+			conn.Close()
+			continue
+		}
+		s.active.Add(1)
+		go func() {
+			defer s.budget.Release()
+			defer s.active.Add(-1)
+			s.handler(conn)
+		}()
 	}
 }
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// httpGetPrefix starts a plain HTTP GET request. It never starts an
+// obfuscated2 header: Telegram clients regenerate headers beginning with
+// "GET ", "POST", "HEAD" or a transport magic.
+const httpGetPrefix = "GET "
+
+// connListener is a net.Listener fed with connections accepted elsewhere,
+// so an http.Server can serve connections picked out of the client port.
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept returns the next handed-over connection.
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close makes Accept and Serve return.
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns an unspecified address: connections come from another
+// listener.
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// Serve hands conn, whose first bytes head were already read, to the
+// server and waits until the server closes it, so the caller's per-connection
+// bookkeeping (shutdown tracking, conn_close events) stays accurate.
+func (l *connListener) Serve(conn net.Conn, head []byte) {
+	hc := &handedConn{
+		Conn:   conn,
+		r:      io.MultiReader(bytes.NewReader(head), conn),
+		closed: make(chan struct{}),
+	}
+	select {
+	case l.conns <- hc:
+	case <-l.done:
+		return
+	}
+	<-hc.closed
+}
+
+// handedConn replays the bytes read before the hand-over and reports when
+// the server closes it.
+type handedConn struct {
+	net.Conn
+	r      io.Reader
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *handedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *handedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+
+// prefixesContain reports whether addr is inside one of nets.
+func prefixesContain(nets []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range nets {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ingressStatsGet sends req to a ClientIngressServer connection that only
+// serves stats to nets and returns everything the server wrote back.
+func ingressStatsGet(t *testing.T, nets []netip.Prefix, req string) string {
+	t.Helper()
+	h := NewHTTPStatsServer("", NewStats(), 1, nil, "test")
+	h.EnableIngress()
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	s := NewClientIngressServer("127.0.0.1:0", [][]byte{make([]byte, 16)}, nil, nil)
+	s.SetIngressStats(nets, h.ServeIngressConn)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			s.handleConn(conn, nil)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := io.ReadAll(conn)
+	return string(resp)
+}
+
+func TestIngressStats(t *testing.T) {
+	local := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	const get = "GET %s HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n"
+
+	resp := ingressStatsGet(t, local, strings.Replace(get, "%s", "/stats", 1))
+	if !strings.HasPrefix(resp, "HTTP/1.1 200") || !strings.Contains(resp, "uptime\t") {
+		t.Errorf("GET /stats: %q", resp)
+	}
+
+	// Only /stats and /stats.json are served on the client port.
+	resp = ingressStatsGet(t, local, strings.Replace(get, "%s", "/admin/probe", 1))
+	if !strings.HasPrefix(resp, "HTTP/1.1 404") {
+		t.Errorf("GET /admin/probe: %q", resp)
+	}
+
+	// From other networks a GET is just a client without a valid secret.
+	other := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	req := strings.Replace(get, "%s", "/stats", 1)
+	req += strings.Repeat("x", 64-len(req)%64)
+	if resp := ingressStatsGet(t, other, req); resp != "" {
+		t.Errorf("GET from a foreign network answered: %q", resp)
+	}
+}
+
+func TestPrefixesContain(t *testing.T) {
+	nets := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"::ffff:10.1.2.3": true,
+		"11.0.0.1":        false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+	} {
+		if got := prefixesContain(nets, netip.MustParseAddr(addr)); got != want {
+			t.Errorf("prefixesContain(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
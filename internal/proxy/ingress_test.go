@@ -0,0 +1,401 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIngressServer_MultipleAcceptLoops(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var wg sync.WaitGroup
+	const conns = 20
+	wg.Add(conns)
+	stats := NewStats()
+	srv := NewIngressServer(addr, func(c net.Conn) {
+		c.Close()
+		wg.Done()
+	})
+	srv.SetAcceptLoops(4)
+	srv.SetStats(stats)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe(ctx) }()
+
+	var c net.Conn
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c.Close()
+	for i := 1; i < conns; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		c.Close()
+	}
+	wg.Wait()
+
+	var total int64
+	for i := 0; i < 4; i++ {
+		total += stats.GetAcceptLoop(i)
+	}
+	if total != conns {
+		t.Errorf("accepted across loops = %d, want %d", total, conns)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe after cancel: %v", err)
+	}
+}
+
+func TestNewConnID(t *testing.T) {
+	a, b := newConnID(), newConnID()
+	if len(a) != 8 || len(b) != 8 {
+		t.Fatalf("conn IDs %q, %q: want 8 hex chars", a, b)
+	}
+	if a == b {
+		t.Errorf("two conn IDs are equal: %q", a)
+	}
+}
+
+// TestIngressServer_Standby verifies that a standby listener is bound but
+// hands connections to the handler only after the gate is closed.
+func TestIngressServer_Standby(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	handled := make(chan struct{}, 1)
+	srv := NewIngressServer(addr, func(c net.Conn) {
+		c.Close()
+		handled <- struct{}{}
+	})
+	gate := make(chan struct{})
+	srv.SetStandby(gate)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ListenAndServe(ctx)
+
+	var c net.Conn
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial in standby: %v", err)
+	}
+	defer c.Close()
+
+	select {
+	case <-handled:
+		t.Fatal("connection handled while in standby")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(gate)
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not handled after activation")
+	}
+}
+
+// freeAddr returns a loopback address with a port that was free a moment ago.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// dialRetry dials addr, retrying while the listener is starting.
+func dialRetry(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	var err error
+	for i := 0; i < 50; i++ {
+		var c net.Conn
+		if c, err = net.Dial("tcp", addr); err == nil {
+			return c
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("dial %s: %v", addr, err)
+	return nil
+}
+
+// TestIngressServer_Drain verifies that a drained listener stops accepting,
+// lets the open connection finish and keeps running until shutdown.
+func TestIngressServer_Drain(t *testing.T) {
+	addr := freeAddr(t)
+	release := make(chan struct{})
+	srv := NewIngressServer(addr, func(c net.Conn) {
+		<-release
+		c.Close()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe(ctx) }()
+
+	c := dialRetry(t, addr)
+	defer c.Close()
+	for srv.Status().Connections != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if st := srv.Status(); st.State() != "serving" {
+		t.Fatalf("state %q before drain", st.State())
+	}
+
+	if !srv.Drain() {
+		t.Fatal("first Drain reported already draining")
+	}
+	if srv.Drain() {
+		t.Error("second Drain reported a new drain")
+	}
+	if st := srv.Status(); st.State() != "draining" || st.Connections != 1 {
+		t.Errorf("after drain: %+v (%s)", st, st.State())
+	}
+	if c2, err := net.Dial("tcp", addr); err == nil {
+		c2.Close()
+		t.Error("drained listener still accepts")
+	}
+
+	close(release)
+	for srv.Status().Connections != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if st := srv.Status(); st.State() != "drained" {
+		t.Errorf("state %q after the last connection closed", st.State())
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("ListenAndServe returned before shutdown: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe after cancel: %v", err)
+	}
+}
+
+// TestHandlerBudget_Off checks that a budget of 0 admits everything and can
+// be turned on later.
+func TestHandlerBudget_Off(t *testing.T) {
+	budget := NewHandlerBudget(0, nil)
+	for i := 0; i < 100; i++ {
+		if !budget.Acquire() {
+			t.Fatalf("Acquire %d rejected with the budget off", i)
+		}
+	}
+	budget.SetLimit(100)
+	if budget.Acquire() {
+		t.Error("Acquire admitted above the budget turned on")
+	}
+	budget.Release()
+	if !budget.Acquire() {
+		t.Error("Acquire rejected after a release")
+	}
+}
+
+// TestIngressServer_HandlerBudget fills a budget of two handlers; the third
+// connection is closed at accept and counted, and a slot frees up again
+// once a handler returns.
+func TestIngressServer_HandlerBudget(t *testing.T) {
+	addr := freeAddr(t)
+	stats := NewStats()
+	budget := NewHandlerBudget(2, stats)
+	release := make(chan struct{})
+	srv := NewIngressServer(addr, func(c net.Conn) {
+		<-release
+		c.Close()
+	})
+	srv.SetHandlerBudget(budget)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe(ctx) }()
+
+	for i := 0; i < 2; i++ {
+		c := dialRetry(t, addr)
+		defer c.Close()
+	}
+	for budget.InUse() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection over budget not closed: %v", err)
+	}
+	snap := stats.Snapshot(0)
+	if snap["handler_budget_rejected"] != 1 || snap["handlers_active"] != 2 || snap["handler_budget"] != 2 {
+		t.Errorf("stats = rejected %d, active %d, budget %d", snap["handler_budget_rejected"], snap["handlers_active"], snap["handler_budget"])
+	}
+
+	close(release)
+	for budget.InUse() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !budget.Acquire() {
+		t.Error("Acquire failed after handlers returned")
+	}
+	budget.Release()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe after cancel: %v", err)
+	}
+}
+
+// TestIngressServer_InheritedListener serves a listener bound elsewhere,
+// as a worker does with --inherit-listeners.
+func TestIngressServer_InheritedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{}, 1)
+	srv := NewIngressServer("unused:0", func(c net.Conn) {
+		c.Close()
+		served <- struct{}{}
+	})
+	srv.SetListener(ln)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe(ctx) }()
+
+	dialRetry(t, ln.Addr().String()).Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection on the inherited listener not served")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe after cancel: %v", err)
+	}
+}
+
+// TestClientIngressServer_Listen binds the ports before serving, as the
+// runtime does to drop privileges in between; a second bind of a taken port
+// fails and releases the ports bound before it.
+func TestClientIngressServer_Listen(t *testing.T) {
+	a, b := freeAddr(t), freeAddr(t)
+	s := NewClientIngressServer(a, nil, nil, nil)
+	s.AddListener(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Listen(ctx); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	// The kernel completes the handshake before anything accepts.
+	c, err := net.Dial("tcp", b)
+	if err != nil {
+		t.Fatalf("dial before serving: %v", err)
+	}
+	c.Close()
+
+	other := NewClientIngressServer(freeAddr(t), nil, nil, nil)
+	other.AddListener(a)
+	if err := other.Listen(ctx); err == nil {
+		t.Fatal("second Listen on a bound port succeeded")
+	}
+	if ln, err := net.Listen("tcp", other.listeners[0].Addr()); err != nil {
+		t.Errorf("port bound before the failure not released: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	// Once the port is free, a retry binds every port again.
+	blocker, err := net.Listen("tcp", freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry := NewClientIngressServer(freeAddr(t), nil, nil, nil)
+	retry.AddListener(blocker.Addr().String())
+	if err := retry.Listen(ctx); err == nil {
+		t.Fatal("Listen on a bound port succeeded")
+	}
+	blocker.Close()
+	if err := retry.Listen(ctx); err != nil {
+		t.Fatalf("Listen after the port was freed: %v", err)
+	}
+	c, err = net.Dial("tcp", retry.listeners[0].Addr())
+	if err != nil {
+		t.Errorf("port released by the failed Listen not bound again: %v", err)
+	} else {
+		c.Close()
+	}
+	retry.unbind(retry.listeners, nil)
+
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx) }()
+	dialRetry(t, a).Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe after Listen: %v", err)
+	}
+}
+
+// TestClientIngressServer_DrainListener drains one of two client ports;
+// the other keeps accepting.
+func TestClientIngressServer_DrainListener(t *testing.T) {
+	a, b := freeAddr(t), freeAddr(t)
+	s := NewClientIngressServer(a, nil, nil, nil)
+	s.AddListener(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.ListenAndServe(ctx)
+	dialRetry(t, a).Close()
+	dialRetry(t, b).Close()
+
+	if _, err := s.DrainListener("127.0.0.1:1"); !errors.Is(err, ErrUnknownListener) {
+		t.Errorf("unknown listener: err = %v", err)
+	}
+	st, err := s.DrainListener(a)
+	if err != nil || !st.Draining || st.Addr != a {
+		t.Fatalf("DrainListener(%s) = %+v, %v", a, st, err)
+	}
+	if c, err := net.Dial("tcp", a); err == nil {
+		c.Close()
+		t.Error("drained port still accepts")
+	}
+	c := dialRetry(t, b)
+	c.Close()
+
+	list := s.Listeners()
+	if len(list) != 2 || !list[0].Draining || list[1].Draining {
+		t.Errorf("Listeners() = %+v", list)
+	}
+}
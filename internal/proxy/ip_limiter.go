@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons an IPLimiter turns a connection away, as listed in
+// /debug/ip-limits.
+const (
+	ipLimitConns = "conns" // --max-conns-per-ip reached
+	ipLimitRate  = "rate"  // --per-ip-accept-rate exceeded
+)
+
+const (
+	// ipOffenderCap is how many recently limited IPs are remembered.
+	ipOffenderCap = 256
+
+	// ipLimiterPruneInterval is how often the state of idle IPs is dropped.
+	ipLimiterPruneInterval = 10 * time.Second
+
+	// ipLimitIPv6Bits is the prefix an IPv6 client counts as: a host picks
+	// its addresses within its /64 at will (privacy extensions), so one
+	// address per connection would slip past any per-address limit.
+	ipLimitIPv6Bits = 64
+)
+
+// IPLimiter caps what one source IP may take: how many of its connections
+// may be open at once and how fast new ones are accepted, with a token
+// bucket that holds one second's worth of accepts. It tells a single
+// flooding address apart from a legitimate burst spread over many, which a
+// global rate cannot. An IPv6 client counts as its whole /64. The most
+// recently limited IPs are kept in an LRU for /debug/ip-limits. A nil
+// *IPLimiter admits everything.
+type IPLimiter struct {
+	maxConns int     // open connections per IP (0 = unlimited)
+	rate     float64 // accepts per second per IP (0 = unlimited)
+	burst    float64
+	stats    *Stats
+	stop     chan struct{}
+
+	mu        sync.Mutex
+	ips       map[netip.Addr]*ipState
+	offenders *list.List // of *IPOffender, most recently limited first
+	byIP      map[netip.Addr]*list.Element
+}
+
+type ipState struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+// IPOffender is an IP that IPLimiter recently turned away.
+type IPOffender struct {
+	IP       netip.Addr // for IPv6, the first address of the /64
+	Reason   string     // the limit it hit last: ipLimitConns or ipLimitRate
+	Rejected int64
+	First    time.Time
+	Last     time.Time
+}
+
+// NewIPLimiter creates a limiter allowing maxConns open connections and
+// rate new connections per second per source IP; zero turns either off.
+func NewIPLimiter(maxConns int, rate float64, stats *Stats) *IPLimiter {
+	return &IPLimiter{
+		maxConns:  maxConns,
+		rate:      rate,
+		burst:     max(rate, 1),
+		stats:     stats,
+		stop:      make(chan struct{}),
+		ips:       make(map[netip.Addr]*ipState),
+		offenders: list.New(),
+		byIP:      make(map[netip.Addr]*list.Element),
+	}
+}
+
+// Start begins dropping the state of IPs with no open connections and a
+// full bucket.
+func (l *IPLimiter) Start() {
+	go runEvery(ipLimiterPruneInterval, l.stop, func() { l.prune(time.Now()) })
+}
+
+// Stop ends the pruning.
+func (l *IPLimiter) Stop() {
+	close(l.stop)
+}
+
+// Limits returns the per-IP connection cap and accept rate.
+func (l *IPLimiter) Limits() (maxConns int, rate float64) {
+	return l.maxConns, l.rate
+}
+
+// Admit reports whether a new connection from ip may proceed and, if so,
+// counts it as open until Release.
+func (l *IPLimiter) Admit(ip netip.Addr, now time.Time) bool {
+	if l == nil || !ip.IsValid() {
+		return true
+	}
+	ip = ipLimitKey(ip)
+	l.mu.Lock()
+	st := l.ips[ip]
+	if st == nil {
+		st = &ipState{tokens: l.burst, last: now}
+		l.ips[ip] = st
+		l.updateTrackedLocked()
+	}
+	reason := ""
+	if l.maxConns > 0 && st.conns >= l.maxConns {
+		reason = ipLimitConns
+	} else if l.rate > 0 {
+		st.tokens = min(l.burst, st.tokens+now.Sub(st.last).Seconds()*l.rate)
+		st.last = now
+		if st.tokens < 1 {
+			reason = ipLimitRate
+		} else {
+			st.tokens--
+		}
+	}
+	if reason == "" {
+		st.conns++
+		l.mu.Unlock()
+		return true
+	}
+	isNew := l.recordLocked(ip, reason, now)
+	l.mu.Unlock()
+
+	if l.stats != nil {
+		if reason == ipLimitConns {
+			atomic.AddInt64(&l.stats.IPConnLimitRejected, 1)
+		} else {
+			atomic.AddInt64(&l.stats.IPRateLimitRejected, 1)
+		}
+	}
+	if isNew {
+		log.Printf("ingress: limiting %s (%s)", ipLimitString(ip), l.describe(reason))
+	}
+	return false
+}
+
+// Release ends a connection admitted for ip.
+func (l *IPLimiter) Release(ip netip.Addr) {
+	if l == nil || !ip.IsValid() {
+		return
+	}
+	ip = ipLimitKey(ip)
+	l.mu.Lock()
+	if st := l.ips[ip]; st != nil && st.conns > 0 {
+		st.conns--
+	}
+	l.mu.Unlock()
+}
+
+// ipLimitKey returns the address the limits of ip are kept under: ip
+// itself, or for IPv6 the first address of its /64.
+func ipLimitKey(ip netip.Addr) netip.Addr {
+	ip = ip.Unmap()
+	if ip.Is6() {
+		p, _ := ip.Prefix(ipLimitIPv6Bits)
+		return p.Addr()
+	}
+	return ip
+}
+
+// ipLimitString formats a key of ipLimitKey, IPv6 ones as their /64.
+func ipLimitString(ip netip.Addr) string {
+	if ip.Is6() {
+		return netip.PrefixFrom(ip, ipLimitIPv6Bits).String()
+	}
+	return ip.String()
+}
+
+// recordLocked notes a rejection of ip in the offender LRU and reports
+// whether ip was not in it.
+func (l *IPLimiter) recordLocked(ip netip.Addr, reason string, now time.Time) bool {
+	if e, ok := l.byIP[ip]; ok {
+		o := e.Value.(*IPOffender)
+		o.Reason = reason
+		o.Rejected++
+		o.Last = now
+		l.offenders.MoveToFront(e)
+		return false
+	}
+	l.byIP[ip] = l.offenders.PushFront(&IPOffender{IP: ip, Reason: reason, Rejected: 1, First: now, Last: now})
+	if l.offenders.Len() > ipOffenderCap {
+		oldest := l.offenders.Back()
+		l.offenders.Remove(oldest)
+		delete(l.byIP, oldest.Value.(*IPOffender).IP)
+	}
+	return true
+}
+
+func (l *IPLimiter) describe(reason string) string {
+	if reason == ipLimitConns {
+		return fmt.Sprintf("%d open connections", l.maxConns)
+	}
+	return fmt.Sprintf("over %g connections/s", l.rate)
+}
+
+// Offenders returns the recently limited IPs, most recent first.
+func (l *IPLimiter) Offenders() []IPOffender {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]IPOffender, 0, l.offenders.Len())
+	for e := l.offenders.Front(); e != nil; e = e.Next() {
+		out = append(out, *e.Value.(*IPOffender))
+	}
+	return out
+}
+
+// prune drops IPs with no open connections whose bucket has refilled, so
+// the table holds only addresses a limit still applies to.
+func (l *IPLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, st := range l.ips {
+		if st.conns == 0 && (l.rate <= 0 || st.tokens+now.Sub(st.last).Seconds()*l.rate >= l.burst) {
+			delete(l.ips, ip)
+		}
+	}
+	l.updateTrackedLocked()
+}
+
+func (l *IPLimiter) updateTrackedLocked() {
+	if l.stats != nil {
+		atomic.StoreInt64(&l.stats.IPLimitTracked, int64(len(l.ips)))
+	}
+}
+
+// writeOffendersText writes one "ip\treason\trejected\tfirst\tlast" line
+// per offender, an IPv6 one as its /64.
+func writeOffendersText(w io.Writer, offenders []IPOffender) {
+	for _, o := range offenders {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", ipLimitString(o.IP), o.Reason, o.Rejected,
+			o.First.UTC().Format(time.RFC3339), o.Last.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPLimiter_Conns(t *testing.T) {
+	stats := NewStats()
+	l := NewIPLimiter(2, 0, stats)
+	now := time.Unix(1700000000, 0)
+	a, b := netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("198.51.100.2")
+
+	if !l.Admit(a, now) || !l.Admit(a, now) {
+		t.Fatal("connections under the cap rejected")
+	}
+	if l.Admit(a, now) {
+		t.Fatal("third connection from one IP admitted")
+	}
+	if !l.Admit(b, now) {
+		t.Fatal("another IP was limited")
+	}
+	l.Release(a)
+	if !l.Admit(a, now) {
+		t.Fatal("slot not freed by Release")
+	}
+
+	snap := stats.Snapshot(0)
+	if snap["ip_conn_limit_rejected"] != 1 || snap["ip_rate_limit_rejected"] != 0 {
+		t.Errorf("stats: conns %d, rate %d", snap["ip_conn_limit_rejected"], snap["ip_rate_limit_rejected"])
+	}
+	off := l.Offenders()
+	if len(off) != 1 || off[0].IP != a || off[0].Reason != ipLimitConns || off[0].Rejected != 1 {
+		t.Errorf("offenders = %+v", off)
+	}
+}
+
+func TestIPLimiter_Rate(t *testing.T) {
+	stats := NewStats()
+	l := NewIPLimiter(0, 2, stats)
+	now := time.Unix(1700000000, 0)
+	ip := netip.MustParseAddr("2001:db8::1")
+
+	// The bucket holds one second's worth: 2 accepts, then 1 every 500ms.
+	admitted := 0
+	for range 5 {
+		if l.Admit(ip, now) {
+			admitted++
+		}
+	}
+	if admitted != 2 {
+		t.Errorf("admitted %d of a burst of 5, want 2", admitted)
+	}
+	if !l.Admit(ip, now.Add(500*time.Millisecond)) {
+		t.Error("refilled token not granted")
+	}
+	if l.Admit(ip, now.Add(600*time.Millisecond)) {
+		t.Error("accept over the rate admitted")
+	}
+	if got := stats.Snapshot(0)["ip_rate_limit_rejected"]; got != 4 {
+		t.Errorf("ip_rate_limit_rejected = %d, want 4", got)
+	}
+	if off := l.Offenders(); len(off) != 1 || off[0].Reason != ipLimitRate || off[0].Rejected != 4 {
+		t.Errorf("offenders = %+v", off)
+	}
+}
+
+func TestIPLimiter_Prune(t *testing.T) {
+	stats := NewStats()
+	l := NewIPLimiter(1, 1, stats)
+	now := time.Unix(1700000000, 0)
+	busy, idle := netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("198.51.100.2")
+	l.Admit(busy, now)
+	l.Admit(idle, now)
+	l.Release(idle)
+
+	// The idle IP's bucket is still empty right away.
+	l.prune(now)
+	if got := stats.Snapshot(0)["ip_limit_tracked"]; got != 2 {
+		t.Errorf("tracked %d right after release, want 2", got)
+	}
+	l.prune(now.Add(time.Second))
+	if got := stats.Snapshot(0)["ip_limit_tracked"]; got != 1 {
+		t.Errorf("tracked %d after refill, want 1 (the IP with an open connection)", got)
+	}
+	if l.Admit(busy, now.Add(2*time.Second)) {
+		t.Error("pruning forgot an open connection")
+	}
+}
+
+func TestIPLimiter_OffenderLRU(t *testing.T) {
+	l := NewIPLimiter(0, 1, nil)
+	now := time.Unix(1700000000, 0)
+	first := netip.AddrFrom4([4]byte{10, 0, 0, 0})
+	for i := range ipOffenderCap + 1 {
+		ip := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+		l.Admit(ip, now)
+		l.Admit(ip, now)
+	}
+	off := l.Offenders()
+	if len(off) != ipOffenderCap {
+		t.Fatalf("%d offenders kept, want %d", len(off), ipOffenderCap)
+	}
+	if off[0].IP != netip.AddrFrom4([4]byte{10, 0, 1, 0}) {
+		t.Errorf("most recent offender %s first, want 10.0.1.0", off[0].IP)
+	}
+	for _, o := range off {
+		if o.IP == first {
+			t.Error("oldest offender not evicted")
+		}
+	}
+}
+
+func TestIPLimiter_IPv6Prefix(t *testing.T) {
+	l := NewIPLimiter(2, 0, nil)
+	now := time.Unix(1700000000, 0)
+	a := netip.MustParseAddr("2001:db8:1:2::1")
+	b := netip.MustParseAddr("2001:db8:1:2:ffff::7") // same /64
+	other := netip.MustParseAddr("2001:db8:1:3::1")
+
+	if !l.Admit(a, now) || !l.Admit(b, now) {
+		t.Fatal("connections under the cap rejected")
+	}
+	if l.Admit(netip.MustParseAddr("2001:db8:1:2::3"), now) {
+		t.Fatal("third connection from one /64 admitted")
+	}
+	if !l.Admit(other, now) {
+		t.Fatal("another /64 was limited")
+	}
+	l.Release(b)
+	if !l.Admit(a, now) {
+		t.Fatal("slot not freed by Release from another address of the /64")
+	}
+
+	var sb strings.Builder
+	writeOffendersText(&sb, l.Offenders())
+	if !strings.HasPrefix(sb.String(), "2001:db8:1:2::/64\tconns\t1\t") {
+		t.Errorf("offenders = %q", sb.String())
+	}
+
+	// An IPv4-mapped address counts as its IPv4 address.
+	l = NewIPLimiter(1, 0, nil)
+	if !l.Admit(netip.MustParseAddr("::ffff:198.51.100.1"), now) {
+		t.Fatal("first connection rejected")
+	}
+	if l.Admit(netip.MustParseAddr("198.51.100.1"), now) {
+		t.Error("mapped and plain IPv4 address counted apart")
+	}
+}
+
+func TestIPLimiter_Nil(t *testing.T) {
+	var l *IPLimiter
+	ip := netip.MustParseAddr("198.51.100.1")
+	if !l.Admit(ip, time.Now()) {
+		t.Error("nil limiter rejected a connection")
+	}
+	l.Release(ip)
+}
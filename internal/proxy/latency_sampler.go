@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyReservoir is the default number of samples kept by LatencySampler.
+const DefaultLatencyReservoir = 256
+
+// LatencySample is the timing breakdown of a single forwarded frame, from
+// the moment it has been read from the client.
+//
+//	Read     — handling the frame read from the client up to routing
+//	Route    — choosing the target DC
+//	Dial     — obtaining (or establishing) the outbound RPC connection
+//	Write    — writing RPC_PROXY_REQ to the DC
+//	Response — waiting for the DC answer after the write completed
+type LatencySample struct {
+	Start    time.Time
+	TargetDC int16
+	Read     time.Duration
+	Route    time.Duration
+	Dial     time.Duration
+	Write    time.Duration
+	Response time.Duration
+}
+
+// Total returns the sum of all recorded phases.
+func (s *LatencySample) Total() time.Duration {
+	return s.Read + s.Route + s.Dial + s.Write + s.Response
+}
+
+// LatencySampler keeps a fixed-size reservoir of LatencySample values for
+// one in every rate frames. It is a lightweight alternative to a full
+// tracing stack: no allocations happen for frames that are not sampled.
+//
+// The reservoir uses Algorithm R, so after it fills up every sampled frame
+// has an equal chance of being retained.
+type LatencySampler struct {
+	rate uint64 // sample one in rate frames; 0 disables sampling
+
+	frames  uint64 // atomic: frames offered to Begin
+	sampled uint64 // atomic: frames recorded
+
+	mu      sync.Mutex
+	samples []LatencySample
+	size    int
+	seen    uint64 // samples offered to the reservoir since last Reset
+	rnd     *rand.Rand
+}
+
+// NewLatencySampler creates a sampler recording one in rate frames into a
+// reservoir of size entries. rate <= 0 disables sampling; size <= 0 uses
+// DefaultLatencyReservoir.
+func NewLatencySampler(rate, size int) *LatencySampler {
+	if size <= 0 {
+		size = DefaultLatencyReservoir
+	}
+	if rate < 0 {
+		rate = 0
+	}
+	return &LatencySampler{
+		rate:    uint64(rate),
+		size:    size,
+		samples: make([]LatencySample, 0, size),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Begin decides whether the next frame is sampled. It returns a fresh
+// LatencySample to fill in, or nil if the frame is not sampled.
+// Safe to call on a nil sampler.
+func (l *LatencySampler) Begin() *LatencySample {
+	if l == nil || l.rate == 0 {
+		return nil
+	}
+	if atomic.AddUint64(&l.frames, 1)%l.rate != 0 {
+		return nil
+	}
+	return &LatencySample{Start: time.Now()}
+}
+
+// Record adds a completed sample to the reservoir. Safe to call with a nil
+// sample or on a nil sampler.
+func (l *LatencySampler) Record(s *LatencySample) {
+	if l == nil || s == nil {
+		return
+	}
+	atomic.AddUint64(&l.sampled, 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seen++
+	if len(l.samples) < l.size {
+		l.samples = append(l.samples, *s)
+		return
+	}
+	if j := l.rnd.Int63n(int64(l.seen)); j < int64(l.size) {
+		l.samples[j] = *s
+	}
+}
+
+// Samples returns a copy of the current reservoir contents.
+func (l *LatencySampler) Samples() []LatencySample {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]LatencySample, len(l.samples))
+	copy(out, l.samples)
+	return out
+}
+
+// Sampled returns the total number of frames recorded since startup.
+func (l *LatencySampler) Sampled() uint64 {
+	return atomic.LoadUint64(&l.sampled)
+}
+
+// Rate returns the configured sampling rate (one in Rate frames).
+func (l *LatencySampler) Rate() int {
+	return int(l.rate)
+}
+
+// Reset discards all retained samples.
+func (l *LatencySampler) Reset() {
+	l.mu.Lock()
+	l.samples = l.samples[:0]
+	l.seen = 0
+	l.mu.Unlock()
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencySampler_Rate(t *testing.T) {
+	l := NewLatencySampler(4, 16)
+	n := 0
+	for i := 0; i < 40; i++ {
+		if l.Begin() != nil {
+			n++
+		}
+	}
+	if n != 10 {
+		t.Errorf("sampled %d of 40 frames at rate 4, want 10", n)
+	}
+}
+
+func TestLatencySampler_Disabled(t *testing.T) {
+	var nilSampler *LatencySampler
+	if nilSampler.Begin() != nil {
+		t.Error("nil sampler must not sample")
+	}
+	nilSampler.Record(&LatencySample{}) // must not panic
+
+	if NewLatencySampler(0, 16).Begin() != nil {
+		t.Error("rate 0 must disable sampling")
+	}
+}
+
+func TestLatencySampler_ReservoirBoundAndReset(t *testing.T) {
+	l := NewLatencySampler(1, 8)
+	for i := 0; i < 100; i++ {
+		s := l.Begin()
+		s.Read = time.Duration(i) * time.Microsecond
+		l.Record(s)
+	}
+	if got := len(l.Samples()); got != 8 {
+		t.Errorf("reservoir holds %d samples, want 8", got)
+	}
+	if got := l.Sampled(); got != 100 {
+		t.Errorf("Sampled() = %d, want 100", got)
+	}
+
+	l.Reset()
+	if got := len(l.Samples()); got != 0 {
+		t.Errorf("after Reset reservoir holds %d samples, want 0", got)
+	}
+}
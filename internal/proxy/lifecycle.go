@@ -9,7 +9,8 @@ import (
 )
 
 const (
-	// drainTimeout — максимальное время ожидания завершения соединений при shutdown.
+	// drainTimeout — время ожидания завершения соединений при shutdown по
+	// умолчанию (--shutdown-grace).
 	drainTimeout = 5 * time.Second
 )
 
@@ -20,6 +21,13 @@ type GracefulShutdown struct {
 	conns    map[net.Conn]struct{}
 	done     chan struct{}
 	once     sync.Once
+	stats    *Stats // опционально: прогресс drain в /stats
+
+	// grace — сколько ждать завершения соединений до принудительного закрытия
+	grace time.Duration
+	// итог drain: завершившиеся сами и закрытые принудительно; пишутся до
+	// закрытия done
+	drained, forced int
 }
 
 // NewGracefulShutdown создаёт новый экземпляр GracefulShutdown.
@@ -27,9 +35,21 @@ func NewGracefulShutdown() *GracefulShutdown {
 	return &GracefulShutdown{
 		conns: make(map[net.Conn]struct{}),
 		done:  make(chan struct{}),
+		grace: drainTimeout,
 	}
 }
 
+// SetGrace задаёт, сколько Shutdown ждёт завершения соединений, прежде чем
+// закрыть оставшиеся; 0 — закрыть сразу. Вызывать до Shutdown.
+func (g *GracefulShutdown) SetGrace(d time.Duration) {
+	g.grace = max(d, 0)
+}
+
+// SetStats подключает Stats, в которые публикуется прогресс drain.
+func (g *GracefulShutdown) SetStats(stats *Stats) {
+	g.stats = stats
+}
+
 // Track регистрирует соединение для отслеживания при shutdown.
 func (g *GracefulShutdown) Track(c net.Conn) {
 	g.mu.Lock()
@@ -44,51 +64,97 @@ func (g *GracefulShutdown) Untrack(c net.Conn) {
 	g.mu.Unlock()
 }
 
+// Remaining возвращает число соединений, всё ещё стоящих на учёте.
+func (g *GracefulShutdown) Remaining() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.conns)
+}
+
 // Shutdown выполняет graceful shutdown:
 //  1. Отменяет контекст (останавливает listeners через ctx cancel).
-//  2. Ждёт drainTimeout для завершения активных соединений.
+//  2. До grace ждёт, пока активные соединения завершатся сами.
 //  3. Принудительно закрывает оставшиеся соединения.
 func (g *GracefulShutdown) Shutdown(cancel context.CancelFunc) {
 	g.once.Do(func() {
-		log.Println("shutdown: cancelling context")
+		log.Printf("shutdown: cancelling context, draining connections for up to %s", g.grace)
 		cancel()
 
+		g.mu.Lock()
+		initial := len(g.conns)
+		g.mu.Unlock()
+		g.reportDrain(initial, initial)
+
 		// Ждём завершения соединений
-		deadline := time.NewTimer(drainTimeout)
+		deadline := time.NewTimer(g.grace)
 		defer deadline.Stop()
 
 		ticker := time.NewTicker(100 * time.Millisecond)
 		defer ticker.Stop()
 
+		last := initial
 		for {
 			select {
 			case <-deadline.C:
 				log.Println("shutdown: drain timeout, forcing close")
-				g.forceClose()
-				close(g.done)
+				forced := g.forceClose()
+				if g.stats != nil {
+					g.stats.SetDrainForceClosed(forced)
+				}
+				g.finish(initial, forced)
 				return
 			case <-ticker.C:
 				g.mu.Lock()
 				n := len(g.conns)
 				g.mu.Unlock()
+				g.reportDrain(initial, n)
 				if n == 0 {
 					log.Println("shutdown: all connections closed")
-					close(g.done)
+					g.finish(initial, 0)
 					return
 				}
-				log.Printf("shutdown: waiting for %d connections", n)
+				if n != last {
+					log.Printf("shutdown: waiting for %d connections", n)
+					last = n
+				}
 			}
 		}
 	})
 }
 
+// finish сохраняет итог drain и снимает блокировку с Wait.
+func (g *GracefulShutdown) finish(initial, forced int) {
+	g.drained = max(initial-forced, 0)
+	g.forced = forced
+	close(g.done)
+}
+
+// Result возвращает, сколько соединений завершилось за время drain само и
+// сколько было закрыто принудительно. Вызывать после Wait.
+func (g *GracefulShutdown) Result() (drained, forced int) {
+	return g.drained, g.forced
+}
+
 // Wait блокируется до завершения shutdown.
 func (g *GracefulShutdown) Wait() {
 	<-g.done
 }
 
-// forceClose принудительно закрывает все зарегистрированные соединения.
-func (g *GracefulShutdown) forceClose() {
+// reportDrain публикует число оставшихся и уже закрытых за время drain соединений.
+func (g *GracefulShutdown) reportDrain(initial, remaining int) {
+	if g.stats == nil {
+		return
+	}
+	drained := initial - remaining
+	if drained < 0 {
+		drained = 0
+	}
+	g.stats.SetDrainProgress(remaining, drained)
+}
+
+// forceClose принудительно закрывает все зарегистрированные соединения
+// и возвращает их число.
+func (g *GracefulShutdown) forceClose() int {
 	g.mu.Lock()
 	conns := make([]net.Conn, 0, len(g.conns))
 	for c := range g.conns {
@@ -99,4 +165,5 @@ func (g *GracefulShutdown) forceClose() {
 	for _, c := range conns {
 		c.Close()
 	}
+	return len(conns)
 }
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown_ReportsDrainProgress(t *testing.T) {
+	stats := NewStats()
+	g := NewGracefulShutdown()
+	g.SetStats(stats)
+
+	a, b := net.Pipe()
+	defer b.Close()
+	c, d := net.Pipe()
+	defer d.Close()
+	g.Track(a)
+	g.Track(c)
+
+	var cancelled atomic.Bool
+	go g.Shutdown(func() { cancelled.Store(true) })
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&stats.Draining) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("draining gauge never set")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !cancelled.Load() {
+		t.Error("cancel was not called")
+	}
+
+	g.Untrack(a)
+	for atomic.LoadInt64(&stats.DrainedConnections) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("drained = %d, want 1", atomic.LoadInt64(&stats.DrainedConnections))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&stats.DrainRemaining); got != 1 {
+		t.Errorf("remaining = %d, want 1", got)
+	}
+
+	g.Untrack(c)
+	g.Wait()
+	snap := stats.Snapshot(0)
+	if snap["drain_remaining_connections"] != 0 || snap["drain_closed_connections"] != 2 || snap["drain_force_closed"] != 0 {
+		t.Errorf("final drain stats = %d/%d/%d", snap["drain_remaining_connections"], snap["drain_closed_connections"], snap["drain_force_closed"])
+	}
+}
+
+func TestGracefulShutdown_GraceForcesClose(t *testing.T) {
+	stats := NewStats()
+	g := NewGracefulShutdown()
+	g.SetStats(stats)
+	g.SetGrace(200 * time.Millisecond)
+
+	a, b := net.Pipe()
+	defer b.Close()
+	c, d := net.Pipe()
+	defer d.Close()
+	g.Track(a)
+	g.Track(c)
+	// a finishes on its own during the grace period; c never does.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		g.Untrack(a)
+	}()
+
+	start := time.Now()
+	g.Shutdown(func() {})
+	g.Wait()
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("shutdown returned after %s, before the grace period", elapsed)
+	}
+	if drained, forced := g.Result(); drained != 1 || forced != 1 {
+		t.Errorf("Result() = %d drained, %d forced; want 1, 1", drained, forced)
+	}
+	if _, err := c.Write([]byte{1}); err == nil {
+		t.Error("remaining connection was not closed")
+	}
+	if got := stats.Snapshot(0)["drain_force_closed"]; got != 1 {
+		t.Errorf("drain_force_closed = %d, want 1", got)
+	}
+}
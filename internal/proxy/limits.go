@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Bounds for limits changed at run time. The floors keep a typo from
+// shutting every client out; the ceilings keep one from removing the
+// protection a limit exists for.
+const (
+	minSessionLimit  = 10
+	maxSessionLimit  = 10_000_000
+	minHandlerBudget = 16
+	maxHandlerBudget = 1_000_000
+)
+
+// ErrLimitRange is returned for a value outside a limit's bounds.
+var ErrLimitRange = errors.New("limit out of range")
+
+// ConnLimits are the connection limits that can be changed without a
+// restart (GET and POST /admin/limits). Zero means the limit is off.
+type ConnLimits struct {
+	MaxSessions   int64 // established sessions before shedding (-C)
+	HandlerBudget int64 // handler goroutines across client listeners
+}
+
+// ConnLimitUpdate is a change of ConnLimits; nil fields are left as they are.
+// Either limit may be 0 to turn it off.
+type ConnLimitUpdate struct {
+	MaxSessions   *int64
+	HandlerBudget *int64
+}
+
+// Validate checks every set field against its bounds.
+func (u ConnLimitUpdate) Validate() error {
+	if n := u.MaxSessions; n != nil && *n != 0 && (*n < minSessionLimit || *n > maxSessionLimit) {
+		return fmt.Errorf("%w: max_sessions %d not 0 or in [%d, %d]", ErrLimitRange, *n, minSessionLimit, maxSessionLimit)
+	}
+	if n := u.HandlerBudget; n != nil && *n != 0 && (*n < minHandlerBudget || *n > maxHandlerBudget) {
+		return fmt.Errorf("%w: handler_budget %d not 0 or in [%d, %d]", ErrLimitRange, *n, minHandlerBudget, maxHandlerBudget)
+	}
+	return nil
+}
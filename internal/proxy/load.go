@@ -2,9 +2,12 @@ package proxy
 
 import (
 	"log"
+	"net/netip"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/skrashevich/MTProxy/internal/config"
 )
@@ -14,7 +17,21 @@ import (
 type HotReloader struct {
 	manager *config.Manager
 	router  *Router
+	history *ReloadHistory
+	events  *EventLog
+	stats   *Stats
 	stopCh  chan struct{}
+
+	// reloadMu не даёт SIGHUP, --watch-config и загрузчику config.Fetcher
+	// менять конфигурацию одновременно
+	reloadMu sync.Mutex
+
+	// reloadSecrets, если задан, перечитывает секреты вместе с конфигом
+	reloadSecrets func() (SecretReload, error)
+
+	// warmUp, если задан, открывает min_connections соединений к target'ам
+	// нового конфига
+	warmUp func(*config.Config)
 }
 
 // NewHotReloader создаёт HotReloader, связывающий ConfigManager с Router.
@@ -26,12 +43,40 @@ func NewHotReloader(manager *config.Manager, router *Router) *HotReloader {
 	}
 }
 
+// SetHistory подключает журнал последних перезагрузок. Вызывать до Start.
+func (h *HotReloader) SetHistory(history *ReloadHistory) {
+	h.history = history
+}
+
+// SetEventLog подключает кольцо событий, куда пишется результат перезагрузки.
+func (h *HotReloader) SetEventLog(events *EventLog) {
+	h.events = events
+}
+
+// SetStats подключает счётчик поколений конфигурации и сводку последних
+// изменений (config_generation, config_last_diff). Вызывать до Start.
+func (h *HotReloader) SetStats(stats *Stats) {
+	h.stats = stats
+}
+
+// SetWarmUp подключает прогрев пулов соединений после перезагрузки.
+// Вызывать до Start.
+func (h *HotReloader) SetWarmUp(warmUp func(*config.Config)) {
+	h.warmUp = warmUp
+}
+
+// SetSecretReload подключает перечитывание секретов по SIGHUP. Вызывать до Start.
+func (h *HotReloader) SetSecretReload(reload func() (SecretReload, error)) {
+	h.reloadSecrets = reload
+}
+
 // Start запускает горутину, ожидающую SIGHUP.
 func (h *HotReloader) Start() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP)
 
 	go func() {
+		defer processCrash.Load().Recover()
 		defer signal.Stop(sigCh)
 		for {
 			select {
@@ -50,13 +95,48 @@ func (h *HotReloader) Stop() {
 	close(h.stopCh)
 }
 
-// reload выполняет перезагрузку конфигурации и обновляет Router.
+// reload выполняет перезагрузку конфигурации и обновляет Router, затем
+// перечитывает секреты. Ошибка в одном не мешает другому. systemd на это
+// время видит сервис в состоянии reloading.
 func (h *HotReloader) reload() {
-	if err := h.manager.Reload(); err != nil {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	sdNotify(SdReloadingState()...)
+	defer sdNotify(SdReady)
+	before := h.manager.Get()
+	h.Applied(before, h.manager.Reload())
+	if h.reloadSecrets != nil {
+		if res, err := h.reloadSecrets(); err != nil {
+			log.Printf("hot reload: secrets: %v", err)
+		} else {
+			log.Printf("hot reload: %d secrets (%d added, %d removed)", res.Secrets, res.Added, res.Removed)
+		}
+	}
+}
+
+// Applied записывает результат замены конфигурации (SIGHUP или загрузчик
+// config.Fetcher) в историю и журнал событий и при успехе обновляет Router.
+func (h *HotReloader) Applied(before *config.Config, err error) {
+	if h.history != nil {
+		h.history.Record(time.Now(), before, h.manager.Get(), err)
+	}
+	if err != nil {
 		log.Printf("hot reload failed: %v", err)
+		h.events.Record(EventReload, "", netip.AddrPort{}, err.Error())
 		return
 	}
+	h.events.Record(EventReload, "", netip.AddrPort{}, "ok")
 	cfg := h.manager.Get()
+	diff := config.DiffConfigs(before, cfg)
+	for _, line := range diff.Lines() {
+		log.Printf("hot reload: %s", line)
+	}
+	if h.stats != nil && (before == nil || before.MD5 != cfg.MD5) {
+		h.stats.ConfigApplied(diff.Summary())
+	}
 	h.router.Reload(cfg)
-	log.Printf("hot reload complete: %d clusters", len(cfg.Clusters))
+	if h.warmUp != nil {
+		h.warmUp(cfg)
+	}
+	log.Printf("hot reload complete: %d clusters (%s)", len(cfg.Clusters), diff.Summary())
 }
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/skrashevich/MTProxy/internal/protocol"
+)
+
+// proxyReqHeaderSize is the fixed part of RPC_PROXY_REQ: type, flags,
+// ext_conn_id and the remote and local address/port pairs.
+const proxyReqHeaderSize = 4 + 4 + 8 + 20 + 20
+
+// loopbackAnswer implements --loopback-backend: instead of forwarding an
+// RPC_PROXY_REQ frame to a DC it returns the client packet carried in the
+// frame, as if the DC had echoed it. The answer is a copy so the caller
+// may reuse req.
+func loopbackAnswer(req []byte) ([]byte, error) {
+	if len(req) < proxyReqHeaderSize {
+		return nil, fmt.Errorf("loopback: req too short: %d bytes", len(req))
+	}
+	if typ := binary.LittleEndian.Uint32(req[0:4]); typ != protocol.RPCProxyReq {
+		return nil, fmt.Errorf("loopback: not RPC_PROXY_REQ: 0x%08x", typ)
+	}
+	data := req[proxyReqHeaderSize:]
+	if flags := binary.LittleEndian.Uint32(req[4:8]); flags&0xC != 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("loopback: truncated extra bytes")
+		}
+		n := binary.LittleEndian.Uint32(data[0:4])
+		if uint64(n) > uint64(len(data)-4) {
+			return nil, fmt.Errorf("loopback: bad extra bytes size: %d", n)
+		}
+		data = data[4+n:]
+	}
+	return append([]byte(nil), data...), nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// ParseNATInfo converts --nat-info rules (local IPv4 → public IPv4) into
+// the table natTranslate and the RPC key derivation use.
+func ParseNATInfo(rules map[string]string) (map[uint32]uint32, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	nat := make(map[uint32]uint32, len(rules))
+	for localStr, pubStr := range rules {
+		local := net.ParseIP(localStr).To4()
+		pub := net.ParseIP(pubStr).To4()
+		if local == nil || pub == nil {
+			return nil, fmt.Errorf("--nat-info: invalid IPv4 pair %s:%s", localStr, pubStr)
+		}
+		nat[binary.BigEndian.Uint32(local)] = binary.BigEndian.Uint32(pub)
+	}
+	return nat, nil
+}
+
+// natPublicAddrs returns the distinct public addresses of the --nat-info
+// rules, sorted.
+func natPublicAddrs(nat map[uint32]uint32) []string {
+	seen := make(map[uint32]bool, len(nat))
+	var out []uint32
+	for _, pub := range nat {
+		if !seen[pub] {
+			seen[pub] = true
+			out = append(out, pub)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	addrs := make([]string, len(out))
+	for i, pub := range out {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, pub)
+		addrs[i] = ip.String()
+	}
+	return addrs
+}
+
+// checkNATLocal verifies that the --nat-info local address local is
+// assigned to one of the host's interfaces (ifaceAddrs); a rule for an
+// address the host does not have never matches, so clients reaching the
+// host's real address would be advertised unchanged.
+func checkNATLocal(local string, ifaceAddrs []net.Addr) PreflightCheck {
+	c := PreflightCheck{Name: "nat-info " + local}
+	ip := net.ParseIP(local)
+	if ip == nil {
+		c.Status, c.Detail = PreflightFail, "not an IP address"
+		return c
+	}
+	for _, a := range ifaceAddrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			c.Status, c.Detail = PreflightPass, "assigned to a local interface"
+			return c
+		}
+	}
+	c.Status, c.Detail = PreflightFail, "not assigned to any local interface"
+	c.Hint = "use the address the host itself has (ip addr) as the local side of --nat-info"
+	return c
+}
+
+// localAddrStat counts client connections that arrived on one local
+// address, and the public address it is advertised as.
+type localAddrStat struct {
+	public      string
+	connections atomic.Int64
+}
+
+// LocalAddrStatus is the traffic of one local address clients connected to.
+type LocalAddrStatus struct {
+	Local       string `json:"local"`
+	Public      string `json:"public"`
+	Connections int64  `json:"connections"`
+}
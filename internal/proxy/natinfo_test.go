@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseNATInfo(t *testing.T) {
+	nat, err := ParseNATInfo(map[string]string{
+		"10.0.1.10": "203.0.113.5",
+		"10.0.2.10": "198.51.100.7",
+		"10.0.3.10": "203.0.113.5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := natTranslate(nat, net.ParseIP("10.0.2.10")); !got.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("natTranslate(10.0.2.10) = %s", got)
+	}
+	if got, want := natPublicAddrs(nat), []string{"198.51.100.7", "203.0.113.5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("natPublicAddrs = %v, want %v", got, want)
+	}
+
+	if _, err := ParseNATInfo(map[string]string{"10.0.1.10": "2001:db8::1"}); err == nil {
+		t.Error("IPv6 public address accepted")
+	}
+	if nat, err := ParseNATInfo(nil); nat != nil || err != nil {
+		t.Errorf("ParseNATInfo(nil) = %v, %v", nat, err)
+	}
+}
+
+func TestCheckNATLocal(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.1.0/24")
+	ifaceAddrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.1.10"), Mask: lan.Mask},
+	}
+	if c := checkNATLocal("10.0.1.10", ifaceAddrs); c.Status != PreflightPass {
+		t.Errorf("assigned address: %+v", c)
+	}
+	if c := checkNATLocal("10.0.1.11", ifaceAddrs); c.Status != PreflightFail || c.Hint == "" {
+		t.Errorf("unassigned address in the same subnet: %+v", c)
+	}
+}
+
+func TestStats_LocalAddrs(t *testing.T) {
+	s := NewStats()
+	s.ObserveLocalAddr(net.ParseIP("10.0.2.10"), net.ParseIP("198.51.100.7"))
+	s.ObserveLocalAddr(net.ParseIP("10.0.1.10"), net.ParseIP("203.0.113.5"))
+	s.ObserveLocalAddr(net.ParseIP("10.0.2.10"), net.ParseIP("198.51.100.7"))
+
+	want := []LocalAddrStatus{
+		{Local: "10.0.1.10", Public: "203.0.113.5", Connections: 1},
+		{Local: "10.0.2.10", Public: "198.51.100.7", Connections: 2},
+	}
+	if got := s.LocalAddrs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LocalAddrs = %+v, want %+v", got, want)
+	}
+	if n := s.Snapshot(0)["local_addr_10.0.2.10_connections"]; n != 2 {
+		t.Errorf("local_addr_10.0.2.10_connections = %d, want 2", n)
+	}
+}
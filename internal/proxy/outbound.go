@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/skrashevich/MTProxy/internal/config"
 	"github.com/skrashevich/MTProxy/internal/protocol"
 )
 
@@ -14,36 +19,129 @@ type OutboundConfig struct {
 	ProxyTag []byte            // 16-byte proxy tag, or nil
 	ForceDH  bool              // require DH key exchange
 	NatInfo  map[uint32]uint32 // local IPv4 → public IPv4 (for key derivation behind NAT)
+	Device   string            // bind outbound sockets to this interface or VRF (SO_BINDTODEVICE), or ""
+	Resolver *net.Resolver     // resolver for target host names (--dns), or nil for the system one
+	Dialer   OutboundDialer    // reaches DCs through upstream proxies (--outbound-proxy), or nil to dial directly
+	Sockets  SocketOptions     // TCP options of DC connections (--tcp-*)
+
+	MaxResponseSize int // largest accepted DC frame in bytes (0 = DefaultMaxResponseSize)
+
+	// FirstByteTimeout is how long a request waits for its response to start
+	// arriving (0 = DefaultFirstByteTimeout); StallTimeout is the longest gap
+	// allowed between reads once a DC frame has started (0 = DefaultStallTimeout).
+	FirstByteTimeout time.Duration
+	StallTimeout     time.Duration
+
+	// Loopback answers every request with the client packet it carries
+	// instead of contacting a DC (--loopback-backend, local testing only).
+	Loopback bool
 }
 
-// OutboundProxy manages a pool of RPC connections to Telegram DC servers.
-// There is at most one active rpcOutboundConn per target address.
+// ErrNoResponse is returned when a DC does not start answering a request
+// within the first-byte timeout.
+var ErrNoResponse = errors.New("no response")
+
+// OutboundProxy manages a pool of RPC connections to Telegram DC servers:
+// one connection per target address, or between min_connections and
+// max_connections of them for targets of a v2 cluster (see targetPool).
 //
 // Implements the Outbounder interface expected by DataPlane.
 // Corresponds to the outbound connection management in net/net-connections.c.
 type OutboundProxy struct {
 	cfg OutboundConfig
 
-	mu    sync.Mutex
-	conns map[string]*rpcOutboundConn // keyed by "host:port"
+	mu      sync.Mutex
+	conns   map[string]*targetPool   // keyed by "host:port"
+	dialing map[string]*outboundDial // connects in progress, keyed like conns
+
+	// connects counts the connections opened to each target, for the
+	// reconnect count in /debug/outbound; connSeq numbers them all
+	connects map[string]int64
+	connSeq  atomic.Uint64
+
+	stats   *Stats      // optional; counts oversize responses, stalls and timeouts
+	buffers *BufferPool // optional; recycles the buffers of outgoing frames
+	health  *TargetHealth
+
+	// targetOptions, if set, returns the per-cluster settings of a target
+	// (config v2); they override the timeout, source address and ping
+	// interval for that target.
+	targetOptions func(addr string) config.ClusterOptions
 }
 
 // NewOutboundProxy creates a new outbound proxy connection pool.
 func NewOutboundProxy(cfg OutboundConfig) *OutboundProxy {
 	return &OutboundProxy{
-		cfg:   cfg,
-		conns: make(map[string]*rpcOutboundConn),
+		cfg:      cfg,
+		conns:    make(map[string]*targetPool),
+		dialing:  make(map[string]*outboundDial),
+		connects: make(map[string]int64),
+		health:   NewTargetHealth(),
+	}
+}
+
+// Health returns the per-target record of outbound successes and errors.
+func (p *OutboundProxy) Health() *TargetHealth {
+	return p.health
+}
+
+// SetStats attaches the Stats instance for outbound accounting.
+// Must be called before the first packet is forwarded.
+func (p *OutboundProxy) SetStats(stats *Stats) {
+	p.stats = stats
+}
+
+// SetBuffers makes connections build outgoing frames in buffers from bp.
+// Must be called before the first packet is forwarded.
+func (p *OutboundProxy) SetBuffers(bp *BufferPool) {
+	p.buffers = bp
+}
+
+// SetTargetOptions installs the lookup of per-cluster target settings.
+// Must be called before the first packet is forwarded.
+func (p *OutboundProxy) SetTargetOptions(f func(addr string) config.ClusterOptions) {
+	p.targetOptions = f
+}
+
+// options returns the per-cluster settings of target addr.
+func (p *OutboundProxy) options(addr string) config.ClusterOptions {
+	if p.targetOptions == nil {
+		return config.ClusterOptions{}
 	}
+	return p.targetOptions(addr)
 }
 
 // ForwardPacket implements the Outbounder interface used by DataPlane.
 // It sends an already-serialised RPC_PROXY_REQ frame (req) to the target DC
 // and returns the raw RPC_PROXY_ANS payload bytes.
 func (p *OutboundProxy) ForwardPacket(target string, req []byte) ([]byte, error) {
-	conn, err := p.getConnection(target)
+	return p.ForwardPacketTraced(target, req, nil)
+}
+
+// ForwardPacketTraced is ForwardPacket that additionally records the dial,
+// write and response phases into trace when it is non-nil.
+func (p *OutboundProxy) ForwardPacketTraced(target string, req []byte, trace *LatencySample) ([]byte, error) {
+	return p.ForwardTargetTraced(Target{Addr: target}, req, trace)
+}
+
+// ForwardTargetTraced is ForwardPacketTraced for a routed target: if
+// target.Addr has no live connection and does not connect quickly, the
+// request goes to target.Fallback instead (see getConnectionFallback).
+func (p *OutboundProxy) ForwardTargetTraced(t Target, req []byte, trace *LatencySample) ([]byte, error) {
+	if p.cfg.Loopback {
+		return loopbackAnswer(req)
+	}
+	phaseStart := time.Now()
+	conn, err := p.getConnectionFallback(t.Addr, t.Fallback)
+	if trace != nil {
+		trace.Dial = time.Since(phaseStart)
+		phaseStart = time.Now()
+	}
 	if err != nil {
+		p.health.Failure(t.Addr, err, time.Now())
 		return nil, err
 	}
+	target := conn.addr
 
 	// The caller (DataPlane / protocol.BuildProxyReq) has already serialised
 	// the full RPC_PROXY_REQ frame including the ext_conn_id.
@@ -61,74 +159,338 @@ func (p *OutboundProxy) ForwardPacket(target string, req []byte) ([]byte, error)
 	// Send the frame as-is (already fully serialised by BuildProxyReq)
 	if err := conn.writeEncryptedFrame(req); err != nil {
 		conn.UnregisterPending(extConnID)
+		p.health.Failure(target, err, time.Now())
 		return nil, fmt.Errorf("outbound: send to %s: %w", target, err)
 	}
+	if trace != nil {
+		trace.Write = time.Since(phaseStart)
+		phaseStart = time.Now()
+	}
 
-	select {
-	case resp := <-respCh:
-		// RPC_CLOSE_EXT from DC means "close this client connection"
-		if resp.Flags == int32(protocol.RPCCloseExt) {
-			return nil, fmt.Errorf("outbound: DC requested close for conn %d", extConnID)
+	firstByte := p.cfg.FirstByteTimeout
+	if t := p.options(target).Timeout; t > 0 {
+		firstByte = t
+	}
+	if firstByte <= 0 {
+		firstByte = DefaultFirstByteTimeout
+	}
+	timer := time.NewTimer(firstByte)
+	defer timer.Stop()
+	waited, extended := firstByte, false
+	for {
+		select {
+		case resp := <-respCh:
+			if trace != nil {
+				trace.Response = time.Since(phaseStart)
+			}
+			p.health.Success(target)
+			// RPC_CLOSE_EXT from DC means "close this client connection"
+			if resp.Flags == int32(protocol.RPCCloseExt) {
+				return nil, fmt.Errorf("outbound: DC requested close for conn %d", extConnID)
+			}
+			return resp.Data, nil
+		case <-conn.closed:
+			err := conn.readError()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			p.health.Failure(target, err, time.Now())
+			return nil, fmt.Errorf("outbound: connection to %s closed: %w", target, err)
+		case <-timer.C:
+			// A frame in flight may be this response arriving slowly; the
+			// read loop's stall timeout bounds it, so wait once more for
+			// that long. Only once: on a busy shared connection some frame
+			// is nearly always in flight, and a lost answer must still time
+			// out.
+			if !extended && conn.stall.receiving() {
+				extended = true
+				waited += conn.stallTimeout
+				timer.Reset(conn.stallTimeout)
+				continue
+			}
+			conn.UnregisterPending(extConnID)
+			conn.counters.errors.Add(1)
+			if p.stats != nil {
+				p.stats.IncFirstByteTimeout()
+			}
+			err := fmt.Errorf("outbound: %w from %s within %s", ErrNoResponse, target, waited)
+			p.health.Failure(target, err, time.Now())
+			return nil, err
 		}
-		return resp.Data, nil
-	case <-conn.closed:
-		return nil, fmt.Errorf("outbound: connection to %s closed", target)
-	case <-time.After(30 * time.Second):
-		conn.UnregisterPending(extConnID)
-		return nil, fmt.Errorf("outbound: timeout waiting for response from %s", target)
 	}
 }
 
+// Probe checks that target answers with CheckTarget, waiting up to
+// DefaultProbeTimeout for a pong, and records the outcome in the target's
+// health. A new connection stays in the pool, so a successful probe leaves
+// the target ready for traffic. With Loopback every probe succeeds.
+func (p *OutboundProxy) Probe(target string) error {
+	if _, err := p.CheckTarget(target, DefaultProbeTimeout); err != nil {
+		p.health.Failure(target, err, time.Now())
+		return err
+	}
+	p.health.Success(target)
+	return nil
+}
+
+// CheckTarget tells whether target answers and how fast: over a live pooled
+// connection it sends RPC_PING and waits up to timeout for the pong,
+// otherwise it dials and handshakes a new connection, kept in the pool, and
+// reports how long that took. It leaves target health to the caller
+// (Probe, TargetProber). With Loopback every check succeeds at once.
+func (p *OutboundProxy) CheckTarget(target string, timeout time.Duration) (time.Duration, error) {
+	if p.cfg.Loopback {
+		return 0, nil
+	}
+	p.mu.Lock()
+	conn := p.conns[target].pick()
+	p.mu.Unlock()
+	if conn != nil {
+		return conn.Ping(timeout)
+	}
+	start := time.Now()
+	if _, err := p.getConnection(target); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Outstanding returns the number of requests sent to target that still
+// wait for a response (Router's least-outstanding policy).
+func (p *OutboundProxy) Outstanding(target string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[target].outstanding()
+}
+
 // GetConnection returns an active connection to the given Target, establishing
 // a new one if necessary. Thread-safe. Used by DataPlane.
 func (p *OutboundProxy) GetConnection(target Target) (*rpcOutboundConn, error) {
 	return p.getConnection(target.Addr)
 }
 
-// getConnection returns an active connection to the given addr, establishing
-// a new one if necessary. Thread-safe.
+// getConnection returns an active connection to the given addr, the next
+// one of its pool in turn, establishing a new one if necessary. When the
+// pool is below its minimum, or every member is busy and it is below its
+// maximum, another connection is opened in the background. Thread-safe.
 func (p *OutboundProxy) getConnection(addr string) (*rpcOutboundConn, error) {
 	p.mu.Lock()
-	conn, ok := p.conns[addr]
+	pool := p.conns[addr]
+	conn := pool.pick()
+	grow := conn != nil && p.needsConnLocked(addr, pool)
 	p.mu.Unlock()
 
-	if ok && !conn.isClosed() {
+	if conn != nil {
+		if grow {
+			go p.grow(addr)
+		}
 		return conn, nil
 	}
 
 	return p.reconnect(addr)
 }
 
-// reconnect creates and connects a new rpcOutboundConn for the given addr,
-// replacing any previous (closed) connection.
-func (p *OutboundProxy) reconnect(addr string) (*rpcOutboundConn, error) {
+// fallbackDelay is how long a connect to a target's own address family
+// runs before one to its fallback target starts alongside it (the
+// Connection Attempt Delay of RFC 8305).
+const fallbackDelay = 250 * time.Millisecond
+
+// getConnectionFallback returns a connection to primary or, Happy Eyeballs
+// style, to fallback: if primary has no live connection, a connect to
+// fallback starts when primary's fails or after fallbackDelay, and the
+// first to succeed is used. A connect that loses the race still completes
+// and stays in the pool.
+func (p *OutboundProxy) getConnectionFallback(primary, fallback string) (*rpcOutboundConn, error) {
+	if fallback == "" {
+		return p.getConnection(primary)
+	}
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	conn := p.conns[primary].pick()
+	p.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	type result struct {
+		conn *rpcOutboundConn
+		err  error
+	}
+	primaryCh := make(chan result, 1)
+	go func() {
+		defer processCrash.Load().Recover()
+		c, err := p.reconnect(primary)
+		primaryCh <- result{c, err}
+	}()
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+	var primaryErr error
+	select {
+	case r := <-primaryCh:
+		if r.err == nil {
+			return r.conn, nil
+		}
+		primaryErr = r.err
+		primaryCh = nil
+	case <-timer.C:
+	}
 
+	fallbackCh := make(chan result, 1)
+	go func() {
+		defer processCrash.Load().Recover()
+		c, err := p.getConnection(fallback)
+		fallbackCh <- result{c, err}
+	}()
+	var fallbackErr error
+	for primaryCh != nil || fallbackCh != nil {
+		select {
+		case r := <-primaryCh:
+			if r.err == nil {
+				return r.conn, nil
+			}
+			primaryErr = r.err
+			primaryCh = nil
+		case r := <-fallbackCh:
+			if r.err == nil {
+				if p.stats != nil {
+					atomic.AddInt64(&p.stats.OutboundFamilyFallbacks, 1)
+				}
+				return r.conn, nil
+			}
+			fallbackErr = r.err
+			fallbackCh = nil
+		}
+	}
+	return nil, fmt.Errorf("%w (fallback: %w)", primaryErr, fallbackErr)
+}
+
+// outboundDial is a connect in progress; callers asking for the same
+// address while it runs wait for it instead of dialling again.
+type outboundDial struct {
+	done chan struct{}
+	conn *rpcOutboundConn
+	err  error
+}
+
+// reconnect returns a live connection of addr's pool or, if it has none,
+// creates and connects a new rpcOutboundConn for addr. Connects to
+// different addresses run in parallel.
+func (p *OutboundProxy) reconnect(addr string) (*rpcOutboundConn, error) {
+	return p.dial(addr, false)
+}
+
+// dial connects a new member of addr's pool. Unless extra, a live member
+// found under the lock is returned instead; with extra, a full pool
+// returns errPoolFull. Only one connect per address runs at a time:
+// callers arriving meanwhile wait for it and share its result.
+func (p *OutboundProxy) dial(addr string, extra bool) (*rpcOutboundConn, error) {
+	p.mu.Lock()
 	// Double-check after acquiring lock
-	if conn, ok := p.conns[addr]; ok && !conn.isClosed() {
+	if conn := p.conns[addr].pick(); conn != nil && !extra {
+		p.mu.Unlock()
 		return conn, nil
 	}
+	if d, ok := p.dialing[addr]; ok {
+		p.mu.Unlock()
+		<-d.done
+		return d.conn, d.err
+	}
+	if _, hi := p.poolLimits(addr); extra && p.conns[addr].live() >= hi {
+		p.mu.Unlock()
+		return nil, errPoolFull
+	}
+	if err := p.health.allowDial(addr, time.Now()); err != nil {
+		p.mu.Unlock()
+		if p.stats != nil {
+			atomic.AddInt64(&p.stats.CircuitRejects, 1)
+		}
+		return nil, err
+	}
+	d := &outboundDial{done: make(chan struct{})}
+	p.dialing[addr] = d
+	p.mu.Unlock()
+
+	d.conn, d.err = p.connect(addr)
+	p.recordDial(addr, d.err)
+	p.mu.Lock()
+	delete(p.dialing, addr)
+	if d.err == nil {
+		d.conn.reconnects = p.connects[addr]
+		p.connects[addr]++
+		pool := p.conns[addr]
+		if pool == nil {
+			pool = &targetPool{}
+			p.conns[addr] = pool
+		}
+		pool.members = append(pool.members, d.conn)
+	}
+	p.mu.Unlock()
+	close(d.done)
+	if d.err != nil {
+		return nil, d.err
+	}
+	// Remove from pool when connection closes
+	go p.watchConn(addr, d.conn)
+	return d.conn, nil
+}
 
+// recordDial updates the circuit breaker of addr with the outcome of a
+// connect, logging when a failure opens a closed circuit.
+func (p *OutboundProxy) recordDial(addr string, err error) {
+	if err == nil {
+		p.health.dialSucceeded(addr)
+		return
+	}
+	backoff, opened := p.health.dialFailed(addr, time.Now())
+	if !opened {
+		return
+	}
+	if p.stats != nil {
+		atomic.AddInt64(&p.stats.CircuitOpens, 1)
+	}
+	log.Printf("outbound: circuit of %s open for %s: %v", addr, backoff, err)
+}
+
+// connect dials and handshakes a new rpcOutboundConn to addr.
+func (p *OutboundProxy) connect(addr string) (*rpcOutboundConn, error) {
 	conn := newRPCOutboundConn(addr, p.cfg.Secret, p.cfg.ForceDH, p.cfg.NatInfo)
+	conn.id = newOutboundConnID(p.connSeq.Add(1))
+	conn.device = p.cfg.Device
+	conn.resolver = p.cfg.Resolver
+	conn.dialer = p.cfg.Dialer
+	conn.sockopts = p.cfg.Sockets
+	conn.buffers = p.buffers
+	opts := p.options(addr)
+	conn.sourceAddr = opts.SourceAddr
+	conn.pingInterval = opts.PingInterval
+	conn.maxResponse = p.cfg.MaxResponseSize
+	if conn.maxResponse <= 0 {
+		conn.maxResponse = DefaultMaxResponseSize
+	}
+	conn.stallTimeout = p.cfg.StallTimeout
+	if conn.stallTimeout <= 0 {
+		conn.stallTimeout = DefaultStallTimeout
+	}
+	conn.stats = p.stats
+	if p.stats != nil {
+		conn.writeQueue = p.stats.Queue(QueueOutboundWrite)
+	}
 	if err := conn.Connect(); err != nil {
 		return nil, fmt.Errorf("connect to %s: %w", addr, err)
 	}
-
-	p.conns[addr] = conn
-
-	// Remove from pool when connection closes
-	go p.watchConn(addr, conn)
-
+	conn.opened = time.Now()
+	if p.stats != nil {
+		p.stats.ObserveOutboundFamily(conn.conn.RemoteAddr())
+	}
 	return conn, nil
 }
 
 // watchConn blocks until the connection closes, then removes it from the pool.
 func (p *OutboundProxy) watchConn(addr string, conn *rpcOutboundConn) {
+	defer processCrash.Load().Recover()
 	<-conn.closed
 
 	p.mu.Lock()
-	if p.conns[addr] == conn {
+	if pool := p.conns[addr]; pool != nil && pool.remove(conn) && len(pool.members) == 0 {
 		delete(p.conns, addr)
 	}
 	p.mu.Unlock()
@@ -137,11 +499,11 @@ func (p *OutboundProxy) watchConn(addr string, conn *rpcOutboundConn) {
 // Close shuts down all connections in the pool.
 func (p *OutboundProxy) Close() {
 	p.mu.Lock()
-	conns := make([]*rpcOutboundConn, 0, len(p.conns))
-	for _, c := range p.conns {
-		conns = append(conns, c)
+	var conns []*rpcOutboundConn
+	for _, pool := range p.conns {
+		conns = append(conns, pool.members...)
 	}
-	p.conns = make(map[string]*rpcOutboundConn)
+	p.conns = make(map[string]*targetPool)
 	p.mu.Unlock()
 
 	for _, c := range conns {
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// outboundConnStats counts one backend connection's traffic and errors
+// over its lifetime. Bytes are RPC payload bytes, without framing and
+// padding.
+type outboundConnStats struct {
+	framesOut atomic.Int64
+	framesIn  atomic.Int64
+	bytesOut  atomic.Int64
+	bytesIn   atomic.Int64
+	errors    atomic.Int64 // failed writes, unanswered requests and the error that closed it
+}
+
+// OutboundConnStatus is a snapshot of one live backend connection, dumped
+// via /debug/outbound so a single bad socket stands out among healthy ones.
+type OutboundConnStatus struct {
+	ID     string
+	Addr   string
+	Local  string // local address of the socket; "" if unknown
+	Opened time.Time
+	// Reconnects is how many connections to Addr were opened before this
+	// one since the proxy started.
+	Reconnects int64
+	FramesOut  int64
+	FramesIn   int64
+	BytesOut   int64
+	BytesIn    int64
+	Errors     int64
+}
+
+// newOutboundConnID returns the ID of the n-th backend connection.
+func newOutboundConnID(n uint64) string {
+	return "out-" + strconv.FormatUint(n, 10)
+}
+
+// status returns the connection's counters.
+func (c *rpcOutboundConn) status() OutboundConnStatus {
+	st := OutboundConnStatus{
+		ID:         c.id,
+		Addr:       c.addr,
+		Opened:     c.opened,
+		Reconnects: c.reconnects,
+		FramesOut:  c.counters.framesOut.Load(),
+		FramesIn:   c.counters.framesIn.Load(),
+		BytesOut:   c.counters.bytesOut.Load(),
+		BytesIn:    c.counters.bytesIn.Load(),
+		Errors:     c.counters.errors.Load(),
+	}
+	if c.conn != nil {
+		st.Local = c.conn.LocalAddr().String()
+	}
+	return st
+}
+
+// Conns returns the live backend connections, by target and then oldest
+// first.
+func (p *OutboundProxy) Conns() []OutboundConnStatus {
+	p.mu.Lock()
+	out := make([]OutboundConnStatus, 0, len(p.conns))
+	for _, pool := range p.conns {
+		for _, c := range pool.members {
+			if !c.isClosed() {
+				out = append(out, c.status())
+			}
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Addr != out[j].Addr {
+			return out[i].Addr < out[j].Addr
+		}
+		return out[i].Opened.Before(out[j].Opened)
+	})
+	return out
+}
+
+// writeOutboundConnsText writes connections one per line:
+// "<id>\t<addr>\t<local>\t<opened RFC3339>\t<age_s>\t<reconnects>\t<frames_out>\t<frames_in>\t<bytes_out>\t<bytes_in>\t<errors>",
+// with "-" for an unknown local address.
+func writeOutboundConnsText(w io.Writer, conns []OutboundConnStatus, now time.Time) {
+	for _, c := range conns {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			c.ID, c.Addr, orDash(c.Local), c.Opened.UTC().Format(time.RFC3339),
+			int64(now.Sub(c.Opened)/time.Second), c.Reconnects,
+			c.FramesOut, c.FramesIn, c.BytesOut, c.BytesIn, c.Errors)
+	}
+}
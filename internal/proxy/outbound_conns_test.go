@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleOutbound(t *testing.T) {
+	opened := time.Now().Add(-90 * time.Second)
+	h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	h.SetOutboundConns(func() []OutboundConnStatus {
+		return []OutboundConnStatus{
+			{ID: "out-1", Addr: "10.0.0.1:8888", Opened: opened, FramesOut: 3},
+			{ID: "out-4", Addr: "10.0.0.2:8888", Local: "10.0.0.9:40000", Opened: opened, Reconnects: 2, Errors: 5},
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	h.handleOutbound(rec, httptest.NewRequest(http.MethodGet, "/debug/outbound", nil))
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "# total 2\n") || !strings.Contains(body, "out-1\t10.0.0.1:8888\t-\t") {
+		t.Errorf("body:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.handleOutbound(rec, httptest.NewRequest(http.MethodGet, "/debug/outbound?target=10.0.0.2:8888", nil))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 || lines[0] != "# total 1" {
+		t.Fatalf("?target body:\n%s", rec.Body.String())
+	}
+	fields := strings.Split(lines[1], "\t")
+	if len(fields) != 11 || fields[0] != "out-4" || fields[2] != "10.0.0.9:40000" || fields[5] != "2" || fields[10] != "5" {
+		t.Errorf("?target line %q", lines[1])
+	}
+	if age := fields[4]; age != "90" && age != "91" {
+		t.Errorf("age %s, want 90", age)
+	}
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// OutboundDialer opens the connections to DCs in place of a direct dial
+// (--outbound-proxy). d dials the first hop, with --outbound-device, the
+// source address and --dns applied. The connection returned must report
+// the DC as its remote address and the address the DC sees it come from as
+// its local one: the RPC handshake derives its keys from both.
+type OutboundDialer interface {
+	Dial(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error)
+}
+
+// ErrUpstreamAuth is wrapped by dial errors caused by rejected upstream
+// proxy credentials.
+var ErrUpstreamAuth = errors.New("upstream proxy authentication failed")
+
+// UpstreamProxies is the OutboundDialer for --outbound-proxy: it reaches
+// DCs through SOCKS5 proxies, tried in the order given until one connects,
+// and counts connects and failures per upstream.
+//
+// HTTP CONNECT proxies are not supported: their reply does not tell the
+// address they connect from, and the RPC handshake keys are derived from
+// it (AESCreateKeys), so no handshake with a middle proxy could succeed.
+type UpstreamProxies struct {
+	upstreams []*upstreamProxy
+}
+
+// upstreamProxy is one --outbound-proxy value.
+type upstreamProxy struct {
+	addr string // host:port
+	user *url.Userinfo
+
+	connects     atomic.Int64
+	failures     atomic.Int64
+	authFailures atomic.Int64
+}
+
+// NewUpstreamProxies parses --outbound-proxy values of the form
+// socks5://[user:password@]host:port.
+func NewUpstreamProxies(urls []string) (*UpstreamProxies, error) {
+	u := &UpstreamProxies{}
+	for _, raw := range urls {
+		p, err := parseUpstreamProxy(raw)
+		if err != nil {
+			return nil, err
+		}
+		u.upstreams = append(u.upstreams, p)
+	}
+	return u, nil
+}
+
+func parseUpstreamProxy(raw string) (*upstreamProxy, error) {
+	pu, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("outbound proxy: %w", err)
+	}
+	if pu.Scheme != "socks5" {
+		return nil, fmt.Errorf("outbound proxy %s: scheme must be socks5", pu.Redacted())
+	}
+	if pu.Port() == "" || (pu.Path != "" && pu.Path != "/") {
+		return nil, fmt.Errorf("outbound proxy %s: want socks5://[user:password@]host:port", pu.Redacted())
+	}
+	if pu.User != nil {
+		pass, _ := pu.User.Password()
+		if len(pu.User.Username()) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("outbound proxy %s: SOCKS5 user name and password are limited to 255 bytes", pu.Redacted())
+		}
+	}
+	return &upstreamProxy{addr: pu.Host, user: pu.User}, nil
+}
+
+// String names the upstream without its credentials.
+func (p *upstreamProxy) String() string {
+	return "socks5://" + p.addr
+}
+
+// Upstreams names every upstream, in order, without credentials.
+func (u *UpstreamProxies) Upstreams() []string {
+	names := make([]string, len(u.upstreams))
+	for i, p := range u.upstreams {
+		names[i] = p.String()
+	}
+	return names
+}
+
+// Dial connects to addr through the first upstream that succeeds.
+func (u *UpstreamProxies) Dial(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	var errs []error
+	for _, p := range u.upstreams {
+		conn, err := p.dial(ctx, d, addr)
+		if err == nil {
+			p.connects.Add(1)
+			return conn, nil
+		}
+		p.failures.Add(1)
+		if errors.Is(err, ErrUpstreamAuth) {
+			p.authFailures.Add(1)
+		}
+		errs = append(errs, fmt.Errorf("via %s: %w", p, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// snapshot adds the per-upstream counters to a stats snapshot, numbered
+// from 1 in --outbound-proxy order.
+func (u *UpstreamProxies) snapshot(m map[string]int64) {
+	for i, p := range u.upstreams {
+		prefix := "outbound_proxy_" + strconv.Itoa(i+1) + "_"
+		m[prefix+"connects"] = p.connects.Load()
+		m[prefix+"failures"] = p.failures.Load()
+		m[prefix+"auth_failures"] = p.authFailures.Load()
+	}
+}
+
+// dial opens a tunnel to addr. The DC host is resolved here, with --dns,
+// so the connection can report the DC's IP as its remote address.
+func (p *upstreamProxy) dial(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	target, err := resolveTCPAddr(ctx, d.Resolver, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tc, err := p.socks5Connect(conn, target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// resolveTCPAddr resolves host:port to one TCP address with r, or with the
+// system resolver if r is nil.
+func resolveTCPAddr(ctx context.Context, r *net.Resolver, addr string) (*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("bad port in %s", addr)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		if r == nil {
+			r = net.DefaultResolver
+		}
+		ips, lerr := r.LookupNetIP(ctx, "ip", host)
+		if lerr != nil {
+			return nil, lerr
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no address for %s", host)
+		}
+		ip = ips[0]
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port))), nil
+}
+
+// upstreamConn is a tunnel through an upstream proxy. Its addresses are the
+// DC and the upstream's side of the connection to it, as far as known.
+type upstreamConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *upstreamConn) LocalAddr() net.Addr  { return c.local }
+func (c *upstreamConn) RemoteAddr() net.Addr { return c.remote }
+
+// SOCKS5 (RFC 1928, RFC 1929) constants.
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 1
+	socks5AtypIPv4     = 1
+	socks5AtypDomain   = 3
+	socks5AtypIPv6     = 4
+)
+
+// socks5Connect asks a SOCKS5 server to connect to target. The server's
+// reply tells the address it connects from, which becomes the tunnel's
+// local address; a server that does not say (0.0.0.0) is assumed to
+// connect from its own address.
+func (p *upstreamProxy) socks5Connect(conn net.Conn, target *net.TCPAddr) (*upstreamConn, error) {
+	method := byte(socks5AuthNone)
+	if p.user != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return nil, fmt.Errorf("socks5 greeting: %w", err)
+	}
+	if resp[0] != socks5Version {
+		return nil, fmt.Errorf("socks5 greeting: version %d", resp[0])
+	}
+	if resp[1] == socks5NoAcceptable {
+		if p.user == nil {
+			return nil, fmt.Errorf("%w: server requires credentials", ErrUpstreamAuth)
+		}
+		return nil, fmt.Errorf("%w: server refuses password authentication", ErrUpstreamAuth)
+	}
+	if resp[1] != method {
+		return nil, fmt.Errorf("socks5 greeting: unexpected method %d", resp[1])
+	}
+	if method == socks5AuthPassword {
+		pass, _ := p.user.Password()
+		req := []byte{1, byte(len(p.user.Username()))}
+		req = append(req, p.user.Username()...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return nil, fmt.Errorf("socks5 auth: %w", err)
+		}
+		if resp[1] != 0 {
+			return nil, fmt.Errorf("%w: status %d", ErrUpstreamAuth, resp[1])
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip4 := target.IP.To4(); ip4 != nil {
+		req = append(append(req, socks5AtypIPv4), ip4...)
+	} else {
+		req = append(append(req, socks5AtypIPv6), target.IP.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(target.Port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, fmt.Errorf("socks5 connect: %w", err)
+	}
+	if head[1] != 0 {
+		return nil, fmt.Errorf("socks5 connect to %s: %s", target, socks5ReplyText(head[1]))
+	}
+	var bound net.IP
+	switch head[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		n := net.IPv4len
+		if head[3] == socks5AtypIPv6 {
+			n = net.IPv6len
+		}
+		bound = make(net.IP, n)
+		if _, err := io.ReadFull(conn, bound); err != nil {
+			return nil, fmt.Errorf("socks5 connect: %w", err)
+		}
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, fmt.Errorf("socks5 connect: %w", err)
+		}
+		if _, err := io.CopyN(io.Discard, conn, int64(l[0])); err != nil {
+			return nil, fmt.Errorf("socks5 connect: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("socks5 connect: address type %d", head[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, fmt.Errorf("socks5 connect: %w", err)
+	}
+	if bound == nil || bound.IsUnspecified() {
+		bound = upstreamIP(conn)
+	}
+	return &upstreamConn{
+		Conn:   conn,
+		local:  &net.TCPAddr{IP: bound, Port: int(binary.BigEndian.Uint16(port[:]))},
+		remote: target,
+	}, nil
+}
+
+// socks5ReplyText describes a SOCKS5 reply code.
+func socks5ReplyText(rep byte) string {
+	switch rep {
+	case 1:
+		return "general failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("reply %d", rep)
+}
+
+// upstreamIP returns the IP of the upstream proxy conn is connected to.
+func upstreamIP(conn net.Conn) net.IP {
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return net.IPv4zero
+}
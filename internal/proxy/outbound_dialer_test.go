@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPEcho returns the address of a server that echoes every connection.
+func startTCPEcho(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// serve accepts connections on a new listener and hands each to handle.
+func serve(t *testing.T, handle func(c net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// fakeSOCKS5 is a minimal SOCKS5 server that requires user/password if user
+// is set and reports bound as the address it connects from.
+func fakeSOCKS5(t *testing.T, user, pass string, bound *net.TCPAddr) string {
+	return serve(t, func(c net.Conn) {
+		var head [2]byte
+		if _, err := io.ReadFull(c, head[:]); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		io.ReadFull(c, methods)
+		want := byte(socks5AuthNone)
+		if user != "" {
+			want = socks5AuthPassword
+		}
+		found := false
+		for _, m := range methods {
+			found = found || m == want
+		}
+		if !found {
+			c.Write([]byte{socks5Version, socks5NoAcceptable})
+			return
+		}
+		c.Write([]byte{socks5Version, want})
+		if user != "" {
+			r := bufio.NewReader(c)
+			r.ReadByte()
+			ul, _ := r.ReadByte()
+			u := make([]byte, ul)
+			io.ReadFull(r, u)
+			pl, _ := r.ReadByte()
+			p := make([]byte, pl)
+			io.ReadFull(r, p)
+			if string(u) != user || string(p) != pass {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		}
+		var req [4]byte
+		if _, err := io.ReadFull(c, req[:]); err != nil || req[1] != socks5CmdConnect || req[3] != socks5AtypIPv4 {
+			return
+		}
+		var dst [6]byte
+		io.ReadFull(c, dst[:])
+		target, err := net.Dial("tcp", (&net.TCPAddr{IP: net.IP(dst[:4]), Port: int(binary.BigEndian.Uint16(dst[4:]))}).String())
+		if err != nil {
+			c.Write([]byte{socks5Version, 5, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		reply := append([]byte{socks5Version, 0, 0, socks5AtypIPv4}, bound.IP.To4()...)
+		c.Write(binary.BigEndian.AppendUint16(reply, uint16(bound.Port)))
+		go io.Copy(target, c)
+		io.Copy(c, target)
+	})
+}
+
+// roundTrip checks that conn carries data both ways.
+func roundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo %q, %v", buf, err)
+	}
+}
+
+func dialUpstreams(t *testing.T, urls []string, target string) (*UpstreamProxies, net.Conn, error) {
+	t.Helper()
+	u, err := NewUpstreamProxies(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := u.Dial(ctx, &net.Dialer{}, target)
+	return u, conn, err
+}
+
+func TestUpstreamProxies_SOCKS5(t *testing.T) {
+	target := startTCPEcho(t)
+	bound := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	proxyAddr := fakeSOCKS5(t, "alice", "s3cret", bound)
+
+	u, conn, err := dialUpstreams(t, []string{"socks5://alice:s3cret@" + proxyAddr}, target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+	// The handshake keys need the DC's view of the connection.
+	if got := conn.LocalAddr().String(); got != bound.String() {
+		t.Errorf("LocalAddr = %s, want %s", got, bound)
+	}
+	if got := conn.RemoteAddr().String(); got != target.String() {
+		t.Errorf("RemoteAddr = %s, want %s", got, target)
+	}
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("RemoteAddr is %T, want *net.TCPAddr", conn.RemoteAddr())
+	}
+
+	snap := map[string]int64{}
+	u.snapshot(snap)
+	if snap["outbound_proxy_1_connects"] != 1 || snap["outbound_proxy_1_failures"] != 0 {
+		t.Errorf("stats %v", snap)
+	}
+}
+
+func TestUpstreamProxies_SOCKS5BadPassword(t *testing.T) {
+	target := startTCPEcho(t)
+	proxyAddr := fakeSOCKS5(t, "alice", "s3cret", &net.TCPAddr{IP: net.IPv4zero})
+
+	u, _, err := dialUpstreams(t, []string{"socks5://alice:wrong@" + proxyAddr}, target.String())
+	if !errors.Is(err, ErrUpstreamAuth) {
+		t.Fatalf("err = %v, want ErrUpstreamAuth", err)
+	}
+	snap := map[string]int64{}
+	u.snapshot(snap)
+	if snap["outbound_proxy_1_failures"] != 1 || snap["outbound_proxy_1_auth_failures"] != 1 {
+		t.Errorf("stats %v", snap)
+	}
+}
+
+// TestUpstreamProxies_Failover checks that a dead upstream is skipped and
+// counted against itself only.
+func TestUpstreamProxies_Failover(t *testing.T) {
+	target := startTCPEcho(t)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	live := fakeSOCKS5(t, "", "", &net.TCPAddr{IP: net.IPv4zero, Port: 1234})
+
+	u, conn, err := dialUpstreams(t, []string{"socks5://" + deadAddr, "socks5://" + live}, target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+	// An unspecified bound address stands for the upstream's own.
+	if got := conn.LocalAddr().String(); got != "127.0.0.1:1234" {
+		t.Errorf("LocalAddr = %s, want 127.0.0.1:1234", got)
+	}
+
+	snap := map[string]int64{}
+	u.snapshot(snap)
+	if snap["outbound_proxy_1_failures"] != 1 || snap["outbound_proxy_1_auth_failures"] != 0 ||
+		snap["outbound_proxy_2_connects"] != 1 || snap["outbound_proxy_2_failures"] != 0 {
+		t.Errorf("stats %v", snap)
+	}
+}
+
+func TestNewUpstreamProxies_Invalid(t *testing.T) {
+	for _, raw := range []string{
+		"socks4://10.0.0.1:1080",
+		"socks5://10.0.0.1",
+		"http://10.0.0.1:3128",
+		"10.0.0.1:1080",
+	} {
+		if _, err := NewUpstreamProxies([]string{raw}); err == nil {
+			t.Errorf("%q accepted", raw)
+		}
+	}
+	u, err := NewUpstreamProxies([]string{"socks5://user:pw@10.0.0.1:1080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Upstreams()[0]; got != "socks5://10.0.0.1:1080" {
+		t.Errorf("Upstreams()[0] = %q, credentials must not be shown", got)
+	}
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// errPoolFull is returned by OutboundProxy.dial when a target's pool
+// already holds max_connections live connections.
+var errPoolFull = errors.New("connection pool full")
+
+// targetPool holds the connections to one target. Requests are spread over
+// the live members in turn. It is guarded by OutboundProxy.mu; a nil
+// *targetPool is an empty pool.
+type targetPool struct {
+	members []*rpcOutboundConn
+	next    int // round-robin cursor
+}
+
+// pick returns the next live member in turn, or nil if there is none.
+func (tp *targetPool) pick() *rpcOutboundConn {
+	if tp == nil {
+		return nil
+	}
+	for range tp.members {
+		c := tp.members[tp.next%len(tp.members)]
+		tp.next++
+		if !c.isClosed() {
+			return c
+		}
+	}
+	return nil
+}
+
+// live returns the number of members that are not closed.
+func (tp *targetPool) live() int {
+	if tp == nil {
+		return 0
+	}
+	n := 0
+	for _, c := range tp.members {
+		if !c.isClosed() {
+			n++
+		}
+	}
+	return n
+}
+
+// outstanding returns the requests waiting for a response over all members.
+func (tp *targetPool) outstanding() int {
+	if tp == nil {
+		return 0
+	}
+	n := 0
+	for _, c := range tp.members {
+		n += c.Outstanding()
+	}
+	return n
+}
+
+// busy reports whether every live member has a request in flight.
+func (tp *targetPool) busy() bool {
+	if tp == nil {
+		return false
+	}
+	for _, c := range tp.members {
+		if !c.isClosed() && c.Outstanding() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// remove drops conn from the members and reports whether it was one.
+func (tp *targetPool) remove(conn *rpcOutboundConn) bool {
+	for i, c := range tp.members {
+		if c == conn {
+			tp.members = append(tp.members[:i], tp.members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// poolLimits returns how many connections addr's pool keeps open at least
+// (min_connections, 0 = opened on demand) and at most (max_connections;
+// by default min_connections, and no fewer than one).
+func (p *OutboundProxy) poolLimits(addr string) (lo, hi int) {
+	opts := p.options(addr)
+	lo, hi = opts.MinConnections, opts.MaxConnections
+	if hi == 0 {
+		hi = max(lo, 1)
+	}
+	return lo, hi
+}
+
+// needsConnLocked reports whether addr's pool should open another
+// connection: it is below its minimum, or every member is busy and it is
+// below its maximum. p.mu must be held.
+func (p *OutboundProxy) needsConnLocked(addr string, pool *targetPool) bool {
+	if _, ok := p.dialing[addr]; ok {
+		return false
+	}
+	lo, hi := p.poolLimits(addr)
+	n := pool.live()
+	return n < lo || (n < hi && pool.busy())
+}
+
+// grow opens connections to addr until its pool needs no more or a connect
+// fails.
+func (p *OutboundProxy) grow(addr string) {
+	defer processCrash.Load().Recover()
+	for {
+		p.mu.Lock()
+		need := p.needsConnLocked(addr, p.conns[addr])
+		p.mu.Unlock()
+		if !need {
+			return
+		}
+		if _, err := p.dial(addr, true); err != nil {
+			if !errors.Is(err, errPoolFull) {
+				log.Printf("outbound: growing pool of %s: %v", addr, err)
+			}
+			return
+		}
+	}
+}
+
+// WarmUp opens min_connections connections in the background to every
+// target of cfg that sets it, so the first requests do not wait for
+// connects. It is called at startup and after each config reload.
+func (p *OutboundProxy) WarmUp(cfg *config.Config) {
+	if p.cfg.Loopback || cfg == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, cl := range cfg.Clusters {
+		targets := cl.Targets
+		if cl.Canary != nil {
+			targets = append(targets[:len(targets):len(targets)], *cl.Canary)
+		}
+		for _, t := range targets {
+			addr := cfg.DialAddr(t)
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			if lo, _ := p.poolLimits(addr); lo > 0 {
+				go p.grow(addr)
+			}
+		}
+	}
+}
+
+// TargetPoolStatus is the occupancy of one target's connection pool.
+type TargetPoolStatus struct {
+	Addr        string `json:"addr"`
+	Open        int    `json:"open"`
+	Min         int    `json:"min"`
+	Max         int    `json:"max"`
+	Outstanding int    `json:"outstanding"`
+}
+
+// Pools returns the occupancy of every target's pool, by address.
+func (p *OutboundProxy) Pools() []TargetPoolStatus {
+	p.mu.Lock()
+	out := make([]TargetPoolStatus, 0, len(p.conns))
+	for addr, pool := range p.conns {
+		lo, hi := p.poolLimits(addr)
+		out = append(out, TargetPoolStatus{Addr: addr, Open: pool.live(), Min: lo, Max: hi, Outstanding: pool.outstanding()})
+	}
+	p.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
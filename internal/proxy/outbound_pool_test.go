@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// TestOutboundPool warms a pool up to min_connections, spreads requests
+// over its members in turn and grows it up to max_connections while every
+// member is busy.
+func TestOutboundPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	go func() {
+		for {
+			mp, err := fakeMiddleProxy(ln, secret)
+			if err != nil {
+				return
+			}
+			go func() {
+				defer mp.Close()
+				for {
+					if _, _, err := mp.readEncryptedFrame(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	addr := ln.Addr().String()
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	cfg := &config.Config{Clusters: map[int]*config.Cluster{2: {ID: 2, Targets: []config.Target{{Addr: host, Port: portNum}}}}}
+	p := NewOutboundProxy(OutboundConfig{Secret: secret})
+	defer p.Close()
+	p.SetTargetOptions(func(string) config.ClusterOptions {
+		return config.ClusterOptions{MinConnections: 2, MaxConnections: 3}
+	})
+	open := func() int {
+		pools := p.Pools()
+		if len(pools) == 0 {
+			return 0
+		}
+		return pools[0].Open
+	}
+	waitOpen := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); open() != n; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("pool has %d connections, want %d", open(), n)
+			}
+		}
+	}
+
+	p.WarmUp(cfg)
+	waitOpen(2)
+	if got := p.Pools()[0]; got != (TargetPoolStatus{Addr: addr, Open: 2, Min: 2, Max: 3}) {
+		t.Errorf("Pools()[0] = %+v", got)
+	}
+	c1, _ := p.getConnection(addr)
+	c2, _ := p.getConnection(addr)
+	if c1 == c2 {
+		t.Error("two requests in a row used the same pool member")
+	}
+	if c3, _ := p.getConnection(addr); c3 != c1 {
+		t.Error("round-robin did not return to the first member")
+	}
+
+	// Both members busy: the pool grows to max_connections, and no further.
+	c1.RegisterPending(1, make(chan ProxyResponse, 1))
+	c2.RegisterPending(2, make(chan ProxyResponse, 1))
+	p.getConnection(addr)
+	waitOpen(3)
+	if p.Outstanding(addr) != 2 {
+		t.Errorf("Outstanding = %d, want 2", p.Outstanding(addr))
+	}
+	p.mu.Lock()
+	for _, m := range p.conns[addr].members {
+		m.RegisterPending(3, make(chan ProxyResponse, 1))
+	}
+	p.mu.Unlock()
+	p.getConnection(addr)
+	time.Sleep(50 * time.Millisecond)
+	if n := open(); n != 3 {
+		t.Errorf("pool grew to %d connections past max_connections 3", n)
+	}
+
+	// A closed member leaves the pool; the next request tops it up.
+	c1.Close()
+	waitOpen(2)
+	p.getConnection(addr)
+	waitOpen(3)
+}
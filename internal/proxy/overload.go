@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShedPolicy selects what the proxy gives up first when it is overloaded.
+type ShedPolicy int
+
+const (
+	// ShedAtAccept closes new connections right after accept; established
+	// sessions are untouched.
+	ShedAtAccept ShedPolicy = iota
+	// ShedFastClose keeps accepting but closes a session as soon as it
+	// sends a frame (or its response queue is full) while overloaded.
+	ShedFastClose
+	// ShedHandshakeFirst drops connections that have only completed the
+	// handshake, the oldest first, so sessions already carrying traffic keep
+	// running; a new session is refused only when there are none left.
+	ShedHandshakeFirst
+)
+
+// ParseShedPolicy parses the --overload-policy value.
+func ParseShedPolicy(s string) (ShedPolicy, error) {
+	switch s {
+	case "", "accept":
+		return ShedAtAccept, nil
+	case "close":
+		return ShedFastClose, nil
+	case "handshake":
+		return ShedHandshakeFirst, nil
+	}
+	return 0, fmt.Errorf("unknown overload policy %q (want accept, close or handshake)", s)
+}
+
+func (p ShedPolicy) String() string {
+	switch p {
+	case ShedFastClose:
+		return "close"
+	case ShedHandshakeFirst:
+		return "handshake"
+	}
+	return "accept"
+}
+
+// overloadPollInterval is how often heap usage is compared to the budget.
+const overloadPollInterval = time.Second
+
+// heapMetric is the runtime/metrics sample compared to the memory budget.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// OverloadShedder decides whether to shed load based on the number of
+// established sessions and heap usage. A nil *OverloadShedder admits
+// everything.
+type OverloadShedder struct {
+	policy    ShedPolicy
+	memBudget uint64 // bytes; 0 = no memory budget
+	stats     *Stats
+	pool      *QueueStats // sessions as a pool in stats; nil without stats
+
+	maxSessions atomic.Int64 // 0 = no session limit
+	sessions    atomic.Int64
+	memOver     atomic.Bool
+
+	mu         sync.Mutex
+	handshakes *list.List // of *ShedSession yet to forward a frame, oldest first
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewOverloadShedder creates a shedder applying policy once maxSessions
+// sessions are established or the heap exceeds memBudget bytes.
+func NewOverloadShedder(policy ShedPolicy, maxSessions int, memBudget uint64, stats *Stats) *OverloadShedder {
+	o := &OverloadShedder{
+		policy:    policy,
+		memBudget: memBudget,
+		stats:     stats,
+		stop:      make(chan struct{}),
+
+		handshakes: list.New(),
+	}
+	if stats != nil {
+		o.pool = stats.Queue(QueueSessions)
+	}
+	o.SetMaxSessions(int64(max(maxSessions, 0)))
+	return o
+}
+
+// SetMaxSessions changes the session limit; 0 turns it off. Sessions
+// already above a lowered limit are shed the way the policy sheds any
+// other excess.
+func (o *OverloadShedder) SetMaxSessions(n int64) {
+	old := o.maxSessions.Swap(n)
+	if o.pool != nil {
+		o.pool.AddCapacity(n - old)
+	}
+	if o.policy == ShedHandshakeFirst && n > 0 {
+		for excess := o.sessions.Load() - n; excess > 0; excess-- {
+			if !o.shedHandshake() {
+				break
+			}
+		}
+	}
+}
+
+// MaxSessions returns the session limit, 0 if there is none.
+func (o *OverloadShedder) MaxSessions() int64 {
+	if o == nil {
+		return 0
+	}
+	return o.maxSessions.Load()
+}
+
+// Start begins polling heap usage when a memory budget is set.
+func (o *OverloadShedder) Start() {
+	if o.memBudget == 0 {
+		return
+	}
+	o.pollMemory()
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		runEvery(overloadPollInterval, o.stop, o.pollMemory)
+	}()
+}
+
+// Stop ends heap polling.
+func (o *OverloadShedder) Stop() {
+	close(o.stop)
+	o.wg.Wait()
+}
+
+func (o *OverloadShedder) pollMemory() {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return
+	}
+	o.setHeap(sample[0].Value.Uint64())
+}
+
+// setHeap records the current heap size and logs budget transitions.
+func (o *OverloadShedder) setHeap(heap uint64) {
+	over := heap > o.memBudget
+	if o.memOver.Swap(over) != over {
+		if over {
+			log.Printf("overload: heap %d MiB above budget %d MiB, shedding (policy=%s)", heap>>20, o.memBudget>>20, o.policy)
+		} else {
+			log.Printf("overload: heap back under budget")
+		}
+	}
+}
+
+// overloaded reports whether the limits are reached; slack is the number of
+// sessions the caller already accounts for itself.
+func (o *OverloadShedder) overloaded(slack int64) bool {
+	if o.memOver.Load() {
+		return true
+	}
+	limit := o.maxSessions.Load()
+	return limit > 0 && o.sessions.Load()-slack >= limit
+}
+
+// AdmitAccept reports whether a freshly accepted connection may proceed.
+func (o *OverloadShedder) AdmitAccept() bool {
+	if o == nil || o.policy != ShedAtAccept || !o.overloaded(0) {
+		return true
+	}
+	if o.stats != nil {
+		o.stats.IncShedAccept()
+	}
+	o.pool.Reject()
+	return false
+}
+
+// ShedSession is a session admitted by AdmitSession. Under the handshake
+// policy it may be closed for a newer one until it calls Active. A nil
+// *ShedSession (no shedder) is never shed.
+type ShedSession struct {
+	o         *OverloadShedder
+	closeConn func()
+	active    bool          // owned by the session's goroutine
+	elem      *list.Element // in o.handshakes until Active or shed; guarded by o.mu
+	shed      atomic.Bool
+}
+
+// AdmitSession is called once the handshake has succeeded; closeConn ends
+// the session should the shedder drop it. Under the handshake policy an
+// overloaded shedder first closes the oldest session that has not carried
+// traffic yet and refuses the new one only when there is none. On success
+// the session is counted until its Leave.
+func (o *OverloadShedder) AdmitSession(closeConn func()) (*ShedSession, bool) {
+	if o == nil {
+		return nil, true
+	}
+	sess := &ShedSession{o: o, closeConn: closeConn}
+	if o.policy == ShedHandshakeFirst {
+		if o.overloaded(0) && !o.shedHandshake() {
+			if o.stats != nil {
+				o.stats.IncShedHandshake()
+			}
+			o.pool.Reject()
+			return nil, false
+		}
+		o.mu.Lock()
+		sess.elem = o.handshakes.PushBack(sess)
+		o.mu.Unlock()
+	}
+	o.sessions.Add(1)
+	o.pool.Enter()
+	return sess, true
+}
+
+// shedHandshake closes the oldest session that has not carried traffic yet
+// and reports whether there was one.
+func (o *OverloadShedder) shedHandshake() bool {
+	o.mu.Lock()
+	e := o.handshakes.Front()
+	if e == nil {
+		o.mu.Unlock()
+		return false
+	}
+	sess := o.handshakes.Remove(e).(*ShedSession)
+	sess.elem = nil
+	o.mu.Unlock()
+
+	sess.shed.Store(true)
+	if o.stats != nil {
+		o.stats.IncShedHandshake()
+	}
+	o.pool.Reject()
+	sess.closeConn()
+	return true
+}
+
+// Active marks the session as carrying traffic, so it is no longer shed for
+// newer ones. Call it before forwarding each frame; only the first call
+// does anything.
+func (s *ShedSession) Active() {
+	if s == nil || s.active {
+		return
+	}
+	s.active = true
+	s.release()
+}
+
+// Shed reports whether the shedder closed the session.
+func (s *ShedSession) Shed() bool {
+	return s != nil && s.shed.Load()
+}
+
+// Leave releases the session.
+func (s *ShedSession) Leave() {
+	if s == nil {
+		return
+	}
+	s.release()
+	s.o.sessions.Add(-1)
+	s.o.pool.Exit()
+}
+
+// release takes the session off the handshake list.
+func (s *ShedSession) release() {
+	s.o.mu.Lock()
+	if s.elem != nil {
+		s.o.handshakes.Remove(s.elem)
+		s.elem = nil
+	}
+	s.o.mu.Unlock()
+}
+
+// AdmitFrame reports whether a session may forward its next frame.
+func (o *OverloadShedder) AdmitFrame() bool {
+	// The calling session is itself counted, hence the slack of one: the
+	// session that reaches the limit is not closed, the ones above it are.
+	if o == nil || o.policy != ShedFastClose || !o.overloaded(1) {
+		return true
+	}
+	o.ShedFrame()
+	o.pool.Reject()
+	return false
+}
+
+// FastClose reports whether sessions should be closed instead of blocking
+// when their response queue is full: under the fast-close policy while a
+// session limit or memory budget is set.
+func (o *OverloadShedder) FastClose() bool {
+	return o != nil && o.policy == ShedFastClose && (o.memBudget > 0 || o.maxSessions.Load() > 0)
+}
+
+// ShedFrame counts a session closed under the fast-close policy.
+func (o *OverloadShedder) ShedFrame() {
+	if o.stats != nil {
+		o.stats.IncShedFrame()
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import "testing"
+
+// admit calls AdmitSession for a session that cannot be closed.
+func admit(o *OverloadShedder) (*ShedSession, bool) {
+	return o.AdmitSession(func() {})
+}
+
+func admitted(o *OverloadShedder) bool {
+	_, ok := admit(o)
+	return ok
+}
+
+// TestOverloadShedderPolicies checks that each policy sheds only at its own
+// stage and counts what it sheds.
+func TestOverloadShedderPolicies(t *testing.T) {
+	t.Run("accept", func(t *testing.T) {
+		stats := NewStats()
+		o := NewOverloadShedder(ShedAtAccept, 1, 0, stats)
+		if !o.AdmitAccept() {
+			t.Fatal("first connection should be admitted")
+		}
+		first, _ := admit(o)
+		if o.AdmitAccept() {
+			t.Error("accept should be rejected at the session limit")
+		}
+		second, ok := admit(o)
+		if !ok || !o.AdmitFrame() {
+			t.Error("accept policy must not shed handshakes or frames")
+		}
+		first.Leave()
+		second.Leave()
+		if !o.AdmitAccept() {
+			t.Error("accept should be admitted again below the limit")
+		}
+		if stats.ShedAccept != 1 {
+			t.Errorf("ShedAccept = %d, want 1", stats.ShedAccept)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		stats := NewStats()
+		o := NewOverloadShedder(ShedFastClose, 1, 0, stats)
+		admit(o)
+		if !o.AdmitFrame() {
+			t.Error("session at the limit should keep forwarding")
+		}
+		if !o.AdmitAccept() || !admitted(o) {
+			t.Error("close policy must not shed accepts or handshakes")
+		}
+		if o.AdmitFrame() {
+			t.Error("frame should be rejected above the limit")
+		}
+		if !o.FastClose() || stats.ShedFrames != 1 {
+			t.Errorf("FastClose = %v, ShedFrames = %d", o.FastClose(), stats.ShedFrames)
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		stats := NewStats()
+		o := NewOverloadShedder(ShedHandshakeFirst, 0, 1<<20, stats)
+		o.setHeap(2 << 20)
+		if !o.AdmitAccept() || !o.AdmitFrame() {
+			t.Error("handshake policy must not shed accepts or frames")
+		}
+		if admitted(o) {
+			t.Error("handshake should be dropped over the memory budget")
+		}
+		o.setHeap(1 << 10)
+		if !admitted(o) {
+			t.Error("handshake should be admitted under the budget")
+		}
+		if stats.ShedHandshakes != 1 {
+			t.Errorf("ShedHandshakes = %d, want 1", stats.ShedHandshakes)
+		}
+	})
+}
+
+// TestOverloadShedderNil verifies that a nil shedder admits everything.
+func TestOverloadShedderNil(t *testing.T) {
+	var o *OverloadShedder
+	sess, ok := admit(o)
+	if !o.AdmitAccept() || !ok || !o.AdmitFrame() || o.FastClose() {
+		t.Error("nil shedder should admit everything")
+	}
+	sess.Active()
+	sess.Leave()
+	if sess.Shed() {
+		t.Error("nil session reported as shed")
+	}
+}
+
+// TestOverloadShedderShedsHandshakes checks that the handshake policy closes
+// the oldest sessions yet to carry traffic to make room for new ones, and
+// leaves active sessions alone.
+func TestOverloadShedderShedsHandshakes(t *testing.T) {
+	stats := NewStats()
+	o := NewOverloadShedder(ShedHandshakeFirst, 3, 0, stats)
+	var closed []int
+	sessions := make([]*ShedSession, 3)
+	for i := range sessions {
+		sessions[i], _ = o.AdmitSession(func() { closed = append(closed, i) })
+	}
+	sessions[0].Active()
+
+	// At the limit: the oldest idle session (1) makes room for the new one.
+	sess, ok := o.AdmitSession(func() { closed = append(closed, 3) })
+	if !ok {
+		t.Fatal("new session refused while idle ones could be shed")
+	}
+	if len(closed) != 1 || closed[0] != 1 || !sessions[1].Shed() || sessions[0].Shed() {
+		t.Fatalf("closed %v, want [1]", closed)
+	}
+	sessions[1].Leave()
+
+	// Lowering the limit sheds the excess, idle sessions only.
+	sess.Active()
+	o.SetMaxSessions(1)
+	if len(closed) != 2 || closed[1] != 2 {
+		t.Fatalf("closed %v, want [1 2]", closed)
+	}
+	sessions[2].Leave()
+
+	// With every session active the new one is refused.
+	if admitted(o) {
+		t.Error("new session admitted with no idle session to shed")
+	}
+	if stats.ShedHandshakes != 3 {
+		t.Errorf("ShedHandshakes = %d, want 3", stats.ShedHandshakes)
+	}
+}
+
+// TestOverloadShedderSetMaxSessions checks that a limit changed at run time
+// takes effect at once and moves the sessions pool capacity with it.
+func TestOverloadShedderSetMaxSessions(t *testing.T) {
+	stats := NewStats()
+	o := NewOverloadShedder(ShedAtAccept, 2, 0, stats)
+	admit(o)
+	o.SetMaxSessions(1)
+	if o.AdmitAccept() {
+		t.Error("accept admitted above the lowered limit")
+	}
+	o.SetMaxSessions(0)
+	if !o.AdmitAccept() {
+		t.Error("accept rejected with the limit off")
+	}
+	o.SetMaxSessions(5)
+	if got := stats.Snapshot(0)["queue_sessions_capacity"]; got != 5 {
+		t.Errorf("queue_sessions_capacity = %d, want 5", got)
+	}
+
+	// A shedder built without limits sheds nothing until one is set.
+	o = NewOverloadShedder(ShedFastClose, 0, 0, nil)
+	admit(o)
+	if !o.AdmitFrame() || o.FastClose() {
+		t.Error("shedding with no limit set")
+	}
+	o.SetMaxSessions(10)
+	if !o.FastClose() {
+		t.Error("FastClose = false once a limit is set")
+	}
+}
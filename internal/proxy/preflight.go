@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+)
+
+// Preflight check outcomes.
+const (
+	PreflightPass = "PASS"
+	PreflightWarn = "WARN"
+	PreflightFail = "FAIL"
+)
+
+// preflightFDReserve is the number of descriptors kept for listeners, DC
+// connections, log and config files on top of one per client connection.
+const preflightFDReserve = 128
+
+// PreflightOptions lists what the process will need once it starts serving.
+type PreflightOptions struct {
+	// Connections is the client connection limit (-C); 0 means unlimited.
+	Connections int
+
+	// ListenAddrs are the addresses the process will bind.
+	ListenAddrs []string
+
+	// ReusePortAddrs are bound with SO_REUSEPORT (-M without
+	// --inherit-listeners). A predecessor that bound them the same way
+	// shares them during a restart, so they are probed with it too.
+	ReusePortAddrs []string
+
+	// User is the account the process runs as (-u); "" means the current one.
+	User string
+
+	// ReadPaths must be readable (files) or listable (directories) by User.
+	ReadPaths []string
+
+	// WriteDirs must accept new files from User. A missing directory is
+	// checked through its nearest existing parent.
+	WriteDirs []string
+
+	// IPv6 requires an IPv6 stack (-6).
+	IPv6 bool
+
+	// NATLocalIPs are the local sides of the --nat-info rules; each must be
+	// assigned to an interface.
+	NATLocalIPs []string
+}
+
+// PreflightCheck is the result of one preflight check.
+type PreflightCheck struct {
+	Name   string
+	Status string // PreflightPass, PreflightWarn or PreflightFail
+	Detail string
+	Hint   string // what to change; set for WARN and FAIL
+}
+
+// PreflightReport collects the results of a preflight run.
+type PreflightReport []PreflightCheck
+
+// Failed reports whether any check failed.
+func (r PreflightReport) Failed() bool {
+	for _, c := range r {
+		if c.Status == PreflightFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints the report as an aligned table followed by a summary line.
+func (r PreflightReport) Write(w io.Writer) {
+	r.WriteAs(w, "preflight")
+}
+
+// WriteAs is Write with every line prefixed by name instead of "preflight".
+func (r PreflightReport) WriteAs(w io.Writer, name string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, c := range r {
+		fmt.Fprintf(tw, "%s: %s\t%s\t%s\n", name, c.Status, c.Name, c.Detail)
+		if c.Hint != "" {
+			fmt.Fprintf(tw, "%s:\t\t  → %s\n", name, c.Hint)
+		}
+		if c.Status == PreflightFail {
+			failed++
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%s: %d checks, %d failed\n", name, len(r), failed)
+}
+
+// Preflight checks, before anything is bound, that the process can serve
+// with the given options: enough file descriptors for -C, permission to bind
+// every listen address, and access to its files as the target user. It may
+// raise the soft RLIMIT_NOFILE up to the hard limit.
+func Preflight(o PreflightOptions) PreflightReport {
+	var report PreflightReport
+	report = append(report, checkNoFile(o.Connections))
+
+	id, check := preflightIdentity(o.User)
+	report = append(report, check)
+
+	for _, addr := range o.ReusePortAddrs {
+		report = append(report, checkListen(addr, true))
+	}
+	for _, addr := range o.ListenAddrs {
+		report = append(report, checkListen(addr, false))
+	}
+	if o.IPv6 {
+		report = append(report, checkIPv6())
+	}
+	if len(o.NATLocalIPs) > 0 {
+		ifaceAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			report = append(report, PreflightCheck{Name: "nat-info", Status: PreflightWarn,
+				Detail: fmt.Sprintf("cannot list interface addresses: %v", err)})
+		} else {
+			for _, ip := range o.NATLocalIPs {
+				report = append(report, checkNATLocal(ip, ifaceAddrs))
+			}
+		}
+	}
+	if id == nil {
+		return report
+	}
+	for _, p := range o.ReadPaths {
+		report = append(report, checkReadable(p, id))
+	}
+	for _, d := range o.WriteDirs {
+		report = append(report, checkWritableDir(d, id))
+	}
+	return report
+}
+
+// checkNoFile compares RLIMIT_NOFILE with what -C needs, raising the soft
+// limit when the hard limit allows it.
+func checkNoFile(connections int) PreflightCheck {
+	c := PreflightCheck{Name: "rlimit_nofile"}
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		c.Status, c.Detail = PreflightWarn, fmt.Sprintf("getrlimit: %v", err)
+		return c
+	}
+	if connections <= 0 {
+		c.Status = PreflightPass
+		c.Detail = fmt.Sprintf("soft=%d hard=%d (-C unlimited)", lim.Cur, lim.Max)
+		return c
+	}
+	need := uint64(connections) + preflightFDReserve
+	switch {
+	case uint64(lim.Cur) >= need:
+		c.Status = PreflightPass
+		c.Detail = fmt.Sprintf("soft=%d hard=%d, -C %d needs %d", lim.Cur, lim.Max, connections, need)
+	case uint64(lim.Max) >= need:
+		old := lim.Cur
+		lim.Cur = lim.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+			c.Status = PreflightFail
+			c.Detail = fmt.Sprintf("soft=%d, -C %d needs %d; raising it failed: %v", old, connections, need, err)
+			c.Hint = "raise the limit with ulimit -n or LimitNOFILE= in the systemd unit"
+			return c
+		}
+		c.Status = PreflightPass
+		c.Detail = fmt.Sprintf("raised soft limit %d → %d, -C %d needs %d", old, lim.Cur, connections, need)
+	default:
+		c.Status = PreflightFail
+		c.Detail = fmt.Sprintf("hard=%d, -C %d needs %d", lim.Max, connections, need)
+		c.Hint = "raise the hard limit (LimitNOFILE= in the systemd unit, limits.conf) or lower -C"
+	}
+	return c
+}
+
+// preflightID is the account whose permissions file checks use.
+type preflightID struct {
+	name string
+	uid  int
+	gids map[int]bool
+}
+
+// preflightIdentity resolves the target user; it returns nil with a failed
+// check when the user does not exist.
+func preflightIdentity(name string) (*preflightID, PreflightCheck) {
+	c := PreflightCheck{Name: "user"}
+	if name == "" {
+		id := &preflightID{uid: os.Geteuid(), gids: map[int]bool{os.Getegid(): true}}
+		if groups, err := os.Getgroups(); err == nil {
+			for _, g := range groups {
+				id.gids[g] = true
+			}
+		}
+		if u, err := user.LookupId(strconv.Itoa(id.uid)); err == nil {
+			id.name = u.Username
+		} else {
+			id.name = strconv.Itoa(id.uid)
+		}
+		c.Status, c.Detail = PreflightPass, fmt.Sprintf("running as %s (uid %d)", id.name, id.uid)
+		return id, c
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		c.Status, c.Detail = PreflightFail, err.Error()
+		c.Hint = "create the user or fix -u"
+		return nil, c
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	id := &preflightID{name: u.Username, uid: uid, gids: map[int]bool{}}
+	if gid, err := strconv.Atoi(u.Gid); err == nil {
+		id.gids[gid] = true
+	}
+	if groups, err := u.GroupIds(); err == nil {
+		for _, g := range groups {
+			if gid, err := strconv.Atoi(g); err == nil {
+				id.gids[gid] = true
+			}
+		}
+	}
+	c.Status, c.Detail = PreflightPass, fmt.Sprintf("target user %s (uid %d)", id.name, id.uid)
+	return id, c
+}
+
+// checkIPv6 verifies that the host has an IPv6 stack, without which -6
+// would leave the listeners IPv4 only and the IPv6 targets unreachable.
+func checkIPv6() PreflightCheck {
+	c := PreflightCheck{Name: "ipv6"}
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		c.Status, c.Detail = PreflightFail, fmt.Sprintf("no IPv6 stack: %v", err)
+		c.Hint = "enable IPv6 on the host or drop -6"
+		return c
+	}
+	ln.Close()
+	c.Status, c.Detail = PreflightPass, "IPv6 stack available"
+	return c
+}
+
+// checkListen verifies that addr may be bound: privileged ports need root or
+// CAP_NET_BIND_SERVICE, and the port must be free, or with reusePort held
+// only by sockets that set SO_REUSEPORT as well. The trial listener is
+// closed immediately.
+func checkListen(addr string, reusePort bool) PreflightCheck {
+	c := PreflightCheck{Name: "listen " + addr}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		c.Status, c.Detail = PreflightFail, err.Error()
+		return c
+	}
+	port, _ := strconv.Atoi(portStr)
+	if start := unprivilegedPortStart(); port > 0 && port < start && !canBindPrivileged() {
+		c.Status = PreflightFail
+		c.Detail = fmt.Sprintf("ports below %d need root or CAP_NET_BIND_SERVICE", start)
+		c.Hint = "grant CAP_NET_BIND_SERVICE (setcap, or AmbientCapabilities= in systemd) or use a higher port"
+		return c
+	}
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		c.Status, c.Detail = PreflightFail, err.Error()
+		if errors.Is(err, syscall.EADDRINUSE) {
+			c.Hint = "stop the process holding the port or choose another one"
+		}
+		return c
+	}
+	ln.Close()
+	c.Status, c.Detail = PreflightPass, "bindable"
+	return c
+}
+
+// checkReadable verifies that id can read path and search every directory
+// leading to it.
+func checkReadable(path string, id *preflightID) PreflightCheck {
+	c := PreflightCheck{Name: "read " + path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		c.Status, c.Detail = PreflightFail, err.Error()
+		return c
+	}
+	want := os.FileMode(4)
+	if fi.IsDir() {
+		want |= 1
+	}
+	if err := id.access(path, fi, want); err != nil {
+		c.Status, c.Detail = PreflightFail, err.Error()
+		c.Hint = fmt.Sprintf("make it readable by %s (chown/chmod)", id.name)
+		return c
+	}
+	c.Status, c.Detail = PreflightPass, "readable by "+id.name
+	return c
+}
+
+// checkWritableDir verifies that id can create files in dir, or in its
+// nearest existing parent when dir does not exist yet.
+func checkWritableDir(dir string, id *preflightID) PreflightCheck {
+	c := PreflightCheck{Name: "write " + dir}
+	p := filepath.Clean(dir)
+	fi, err := os.Stat(p)
+	for errors.Is(err, os.ErrNotExist) && filepath.Dir(p) != p {
+		p = filepath.Dir(p)
+		fi, err = os.Stat(p)
+	}
+	if err != nil {
+		c.Status, c.Detail = PreflightFail, err.Error()
+		return c
+	}
+	if !fi.IsDir() {
+		c.Status, c.Detail = PreflightFail, p+" is not a directory"
+		return c
+	}
+	if err := id.access(p, fi, 2|1); err != nil {
+		c.Status, c.Detail = PreflightFail, err.Error()
+		c.Hint = fmt.Sprintf("make it writable by %s (chown/chmod)", id.name)
+		return c
+	}
+	c.Status, c.Detail = PreflightPass, "writable by "+id.name
+	return c
+}
+
+// access checks the permission bits want (4 read, 2 write, 1 execute/search)
+// on path for id, and search permission on each parent directory.
+func (id *preflightID) access(path string, fi os.FileInfo, want os.FileMode) error {
+	if !id.allowed(fi, want) {
+		return fmt.Errorf("%s: permission denied for %s (mode %s)", path, id.name, fi.Mode().Perm())
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		if dfi, err := os.Stat(dir); err == nil && !id.allowed(dfi, 1) {
+			return fmt.Errorf("%s: %s cannot enter directory %s (mode %s)", path, id.name, dir, dfi.Mode().Perm())
+		}
+		if dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+// allowed evaluates the owner, group or other permission class of fi for id.
+func (id *preflightID) allowed(fi os.FileInfo, want os.FileMode) bool {
+	if id.uid == 0 {
+		return true
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	perm := fi.Mode().Perm()
+	switch {
+	case int(st.Uid) == id.uid:
+		perm >>= 6
+	case id.gids[int(st.Gid)]:
+		perm >>= 3
+	}
+	return perm&want == want
+}
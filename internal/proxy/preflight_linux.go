@@ -0,0 +1,45 @@
+//go:build linux
+
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capNetBindService is the CAP_NET_BIND_SERVICE bit in the capability sets.
+const capNetBindService = 10
+
+// unprivilegedPortStart returns the lowest port an unprivileged process may
+// bind (net.ipv4.ip_unprivileged_port_start, 1024 by default).
+func unprivilegedPortStart() int {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 1024
+	}
+	return n
+}
+
+// canBindPrivileged reports whether the process runs as root or holds
+// CAP_NET_BIND_SERVICE in its effective set.
+func canBindPrivileged() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return err == nil && caps&(1<<capNetBindService) != 0
+		}
+	}
+	return false
+}
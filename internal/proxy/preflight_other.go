@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import "os"
+
+// unprivilegedPortStart returns the lowest port an unprivileged process may
+// bind.
+func unprivilegedPortStart() int {
+	return 1024
+}
+
+// canBindPrivileged reports whether the process runs as root.
+func canBindPrivileged() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreflight_FileAccess(t *testing.T) {
+	dir := t.TempDir()
+	os.Chmod(filepath.Dir(dir), 0o755)
+	os.Chmod(dir, 0o755)
+	open := filepath.Join(dir, "proxy-multi.conf")
+	private := filepath.Join(dir, "proxy-secret")
+	os.WriteFile(open, []byte("x"), 0o644)
+	os.WriteFile(private, []byte("x"), 0o600)
+
+	// An unrelated unprivileged account: only the "other" bits apply.
+	id := &preflightID{name: "nobody", uid: 65534, gids: map[int]bool{65534: true}}
+
+	if c := checkReadable(open, id); c.Status != PreflightPass {
+		t.Errorf("world-readable file: %+v", c)
+	}
+	if c := checkReadable(private, id); c.Status != PreflightFail || c.Hint == "" {
+		t.Errorf("owner-only file: %+v", c)
+	}
+	if c := checkReadable(filepath.Join(dir, "missing"), id); c.Status != PreflightFail {
+		t.Errorf("missing file: %+v", c)
+	}
+	if c := checkWritableDir(filepath.Join(dir, "crash", "nested"), id); c.Status != PreflightFail {
+		t.Errorf("directory not writable by other: %+v", c)
+	}
+	os.Chmod(dir, 0o777)
+	if c := checkWritableDir(filepath.Join(dir, "crash", "nested"), id); c.Status != PreflightPass {
+		t.Errorf("missing directory under a writable parent: %+v", c)
+	}
+}
+
+func TestPreflight_Report(t *testing.T) {
+	report := Preflight(PreflightOptions{ListenAddrs: []string{"127.0.0.1:0"}})
+	if report.Failed() {
+		var sb strings.Builder
+		report.Write(&sb)
+		t.Fatalf("unexpected failure:\n%s", sb.String())
+	}
+
+	report = append(report, PreflightCheck{Name: "listen :443", Status: PreflightFail, Detail: "denied", Hint: "use a higher port"})
+	if !report.Failed() {
+		t.Error("Failed() = false with a failing check")
+	}
+	var sb strings.Builder
+	report.Write(&sb)
+	out := sb.String()
+	for _, want := range []string{"PASS", "rlimit_nofile", "FAIL", "→ use a higher port", "1 failed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report missing %q:\n%s", want, out)
+		}
+	}
+}
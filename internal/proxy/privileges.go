@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// ErrRootWithoutUser is returned by DropPrivileges when the process runs as
+// root and no -u user was given to switch to.
+var ErrRootWithoutUser = errors.New("running as root without -u; pass -u <user> to drop privileges after binding the ports")
+
+// Account is the identity of a -u user: uid, primary gid and the
+// supplementary groups, the primary gid first.
+type Account struct {
+	Name   string
+	UID    int
+	GID    int
+	Groups []int
+}
+
+// LookupAccount resolves the -u user name.
+func LookupAccount(name string) (Account, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return Account{}, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return Account{}, fmt.Errorf("user %s: uid %q: %w", name, u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return Account{}, fmt.Errorf("user %s: gid %q: %w", name, u.Gid, err)
+	}
+	groups := []int{gid}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil && g != gid {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return Account{Name: name, UID: uid, GID: gid, Groups: groups}, nil
+}
+
+// DropPrivileges switches a process running as root to the account name
+// once its ports are bound, like change_user() in the C engine: the
+// supplementary groups become name's groups, then the gid and uid are set.
+// A process that is not root keeps its identity; -u then only takes effect
+// in the preflight file checks.
+func DropPrivileges(name string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	if name == "" {
+		return ErrRootWithoutUser
+	}
+	a, err := LookupAccount(name)
+	if err != nil {
+		return fmt.Errorf("drop privileges: %w", err)
+	}
+	if err := setIdentity(a.UID, a.GID, a.Groups); err != nil {
+		return fmt.Errorf("drop privileges to %s: %w", name, err)
+	}
+	log.Printf("privileges: dropped root, running as %s (uid %d, gid %d, %d groups)", name, a.UID, a.GID, len(a.Groups))
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// setIdentity replaces the supplementary groups, gid and uid of every
+// thread of the process; the uid goes last since it ends the right to
+// change the others.
+func setIdentity(uid, gid int, groups []int) error {
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// setIdentity is unsupported outside Linux; the process refuses to serve
+// as root rather than keep its privileges silently.
+func setIdentity(uid, gid int, groups []int) error {
+	return fmt.Errorf("changing user is not supported on %s", runtime.GOOS)
+}
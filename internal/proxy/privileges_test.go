@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDropPrivileges_RootWithoutUser(t *testing.T) {
+	err := DropPrivileges("")
+	if os.Geteuid() == 0 {
+		if !errors.Is(err, ErrRootWithoutUser) {
+			t.Errorf("as root without a user: err = %v, want ErrRootWithoutUser", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("without root: err = %v, want nil", err)
+	}
+}
@@ -33,5 +33,14 @@ type ClientMeta struct {
 // Target представляет один backend-адрес Telegram DC.
 type Target struct {
 	Addr string // "host:port"
+	// DCID — id кластера, из которого выбран target
 	DCID int
+	// DefaultRoute — у запрошенного DC нет своего кластера, target взят
+	// из default-кластера
+	DefaultRoute bool
+	// Canary — target выбран как canary кластера (RouteSession)
+	Canary bool
+	// Fallback — target другого семейства адресов того же кластера, к
+	// которому OutboundProxy подключается, если Addr не отвечает; "" — нет
+	Fallback string
 }
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Names of the queues and pools reported in stats as
+// queue_<name>_{depth,capacity,wait_p95_us,rejected}.
+const (
+	// QueueClientWrite is the sum of all per-connection client write
+	// queues: frames waiting for the connection's writer goroutine,
+	// including ones whose sender is blocked on a full queue.
+	QueueClientWrite = "client_write"
+	// QueueOutboundWrite counts requests waiting for, or holding, the
+	// write lock of a DC connection. It is unbounded, so its capacity is 0.
+	QueueOutboundWrite = "outbound_write"
+	// QueueSessions is the session pool limited by -C
+	// (--max-special-connections); with --memory-budget it also sheds when
+	// the heap is over budget. It has no waiting, so its wait p95 stays 0.
+	QueueSessions = "sessions"
+)
+
+// QueueStats reports how full one bounded queue or pool is: current depth
+// against capacity, how long entries waited recently and how many were
+// turned away. Every queue is reported the same way, so saturation shows
+// up in /stats before clients notice latency. The wait p95 covers the last
+// durationRingSize waits. All methods are lock-free and safe to call on a
+// nil *QueueStats.
+type QueueStats struct {
+	depth    atomic.Int64
+	capacity atomic.Int64
+	rejected atomic.Int64
+
+	waits durationRing
+}
+
+// Enter counts an entry added to the queue.
+func (q *QueueStats) Enter() {
+	if q != nil {
+		q.depth.Add(1)
+	}
+}
+
+// Exit counts an entry leaving the queue.
+func (q *QueueStats) Exit() {
+	if q != nil {
+		q.depth.Add(-1)
+	}
+}
+
+// ObserveWait records how long an entry waited before it was served.
+func (q *QueueStats) ObserveWait(d time.Duration) {
+	if q == nil {
+		return
+	}
+	q.waits.Observe(d)
+}
+
+// Reject counts an entry turned away because the queue was full.
+func (q *QueueStats) Reject() {
+	if q != nil {
+		q.rejected.Add(1)
+	}
+}
+
+// AddCapacity grows (or, with a negative n, shrinks) the capacity. Queues
+// made of many per-connection queues add each one's size.
+func (q *QueueStats) AddCapacity(n int64) {
+	if q != nil {
+		q.capacity.Add(n)
+	}
+}
+
+// WaitP95 returns the 95th percentile of the recent waits, or 0 before any
+// wait was recorded.
+func (q *QueueStats) WaitP95() time.Duration {
+	return q.waits.Percentiles(95)[0]
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQueueStats(t *testing.T) {
+	var q QueueStats
+	if q.WaitP95() != 0 {
+		t.Fatal("p95 without samples")
+	}
+	for i := 1; i <= 100; i++ {
+		q.ObserveWait(time.Duration(i) * time.Millisecond)
+	}
+	if got := q.WaitP95(); got != 95*time.Millisecond {
+		t.Errorf("p95 = %s, want 95ms", got)
+	}
+	// Only the most recent durationRingSize waits count.
+	for range durationRingSize {
+		q.ObserveWait(time.Millisecond)
+	}
+	if got := q.WaitP95(); got != time.Millisecond {
+		t.Errorf("p95 after old samples rolled out = %s, want 1ms", got)
+	}
+
+	var nilQueue *QueueStats
+	nilQueue.Enter()
+	nilQueue.ObserveWait(time.Second)
+	nilQueue.Reject()
+}
+
+func TestQueueStats_Snapshot(t *testing.T) {
+	s := NewStats()
+	q := s.Queue(QueueSessions)
+	if s.Queue(QueueSessions) != q {
+		t.Fatal("Queue returned a different instance for the same name")
+	}
+	q.AddCapacity(10)
+	q.Enter()
+	q.Enter()
+	q.Exit()
+	q.Reject()
+	q.ObserveWait(3 * time.Millisecond)
+
+	snap := s.Snapshot(0)
+	want := map[string]int64{
+		"queue_sessions_depth":       1,
+		"queue_sessions_capacity":    10,
+		"queue_sessions_rejected":    1,
+		"queue_sessions_wait_p95_us": 3000,
+	}
+	for k, v := range want {
+		if snap[k] != v {
+			t.Errorf("%s = %d, want %d", k, snap[k], v)
+		}
+	}
+}
+
+func TestClientWriter_QueueStats(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	var q QueueStats
+	w := newClientWriter(server, nil, TransportIntermediate, &q, nil, nil)
+	if q.capacity.Load() != clientWriteQueueDepth {
+		t.Fatalf("capacity = %d, want %d", q.capacity.Load(), clientWriteQueueDepth)
+	}
+
+	// Nobody reads the client side, so the writer blocks on the first
+	// frame and the rest fill the queue.
+	if err := w.TrySend([]byte("abcd")); err != nil {
+		t.Fatalf("TrySend: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for q.depth.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for range clientWriteQueueDepth {
+		if err := w.TrySend([]byte("abcd")); err != nil {
+			t.Fatalf("TrySend: %v", err)
+		}
+	}
+	if err := w.TrySend([]byte("abcd")); err != errClientQueueFull {
+		t.Fatalf("TrySend on a full queue: %v", err)
+	}
+	if q.depth.Load() != clientWriteQueueDepth || q.rejected.Load() != 1 {
+		t.Errorf("depth %d rejected %d, want %d and 1", q.depth.Load(), q.rejected.Load(), clientWriteQueueDepth)
+	}
+
+	// Dropping the connection fails the blocked write; the frames left
+	// behind must not linger in the stats.
+	client.Close()
+	w.Close()
+	if q.depth.Load() != 0 || q.capacity.Load() != 0 {
+		t.Errorf("after Close: depth %d capacity %d, want 0 and 0", q.depth.Load(), q.capacity.Load())
+	}
+}
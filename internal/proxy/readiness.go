@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// readyProbeInterval is how often /readyz may start a probe of all targets
+// when none is known to be healthy, e.g. right after startup before any
+// client was forwarded.
+const readyProbeInterval = 30 * time.Second
+
+// HealthCheck is one condition of /healthz or /readyz.
+type HealthCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// HealthReport is the result of /healthz or /readyz: it passes when every
+// check does.
+type HealthReport []HealthCheck
+
+// OK reports whether every check passed.
+func (r HealthReport) OK() bool {
+	for _, c := range r {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// writeHealthReport writes "ok" or "fail" followed by one
+// "<check>\t<ok|fail>\t<detail>" line per check.
+func writeHealthReport(w io.Writer, r HealthReport) {
+	if r.OK() {
+		fmt.Fprintln(w, "ok")
+	} else {
+		fmt.Fprintln(w, "fail")
+	}
+	for _, c := range r {
+		state := "ok"
+		if !c.OK {
+			state = "fail"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, state, c.Detail)
+	}
+}
+
+// readyProber starts a background probe of all targets at most once per
+// interval.
+type readyProber struct {
+	probe   func() []ProbeResult
+	running atomic.Bool
+	last    atomic.Int64 // unix nanoseconds of the last start
+}
+
+// kick starts a probe unless one is running or started within interval. It
+// reports whether it started one.
+func (p *readyProber) kick(now time.Time, interval time.Duration) bool {
+	if last := p.last.Load(); last != 0 && now.Sub(time.Unix(0, last)) < interval {
+		return false
+	}
+	if p.running.Swap(true) {
+		return false
+	}
+	p.last.Store(now.UnixNano())
+	go func() {
+		defer processCrash.Load().Recover()
+		defer p.running.Store(false)
+		p.probe()
+	}()
+	return true
+}
+
+// configCheck passes once a DC config is loaded.
+func (rt *Runtime) configCheck() HealthCheck {
+	cfg := rt.configMgr.Get()
+	if cfg == nil {
+		return HealthCheck{Name: "config", Detail: "no config loaded"}
+	}
+	return HealthCheck{Name: "config", OK: true, Detail: fmt.Sprintf("%d clusters", len(cfg.Clusters))}
+}
+
+// Liveness is the /healthz report: the process answers and has a config.
+// It stays OK during shutdown so an orchestrator does not kill a draining
+// proxy.
+func (rt *Runtime) Liveness() HealthReport {
+	return HealthReport{rt.configCheck()}
+}
+
+// Readiness is the /readyz report: the config is loaded, a client listener
+// accepts connections, and at least one target is healthy.
+func (rt *Runtime) Readiness() HealthReport {
+	return HealthReport{rt.configCheck(), rt.ingressCheck(), rt.targetsCheck(time.Now())}
+}
+
+// ingressCheck passes while at least one client listener accepts
+// connections: bound, not drained, not in warm standby and not shutting
+// down.
+func (rt *Runtime) ingressCheck() HealthCheck {
+	c := HealthCheck{Name: "ingress"}
+	switch {
+	case rt.shuttingDown.Load():
+		c.Detail = "shutting down"
+		return c
+	case rt.inStandby():
+		c.Detail = "warm standby"
+		return c
+	}
+	ls := rt.Listeners()
+	if len(ls) == 0 {
+		c.Detail = "not listening yet"
+		return c
+	}
+	serving := 0
+	for _, l := range ls {
+		if !l.Draining {
+			serving++
+		}
+	}
+	c.OK = serving > 0
+	c.Detail = fmt.Sprintf("%d of %d listeners serving", serving, len(ls))
+	return c
+}
+
+// inStandby reports whether the process waits for activation.
+func (rt *Runtime) inStandby() bool {
+	if rt.standby == nil {
+		return false
+	}
+	select {
+	case <-rt.standby:
+		return false
+	default:
+		return true
+	}
+}
+
+// targetsCheck passes if a target has an open connection or answered the
+// last request sent to it. When none has and the targets are not
+// health-checked already, it starts a probe of all targets so the next
+// check can pass without waiting for client traffic.
+func (rt *Runtime) targetsCheck(now time.Time) HealthCheck {
+	c := HealthCheck{Name: "targets"}
+	if rt.Outbound.cfg.Loopback {
+		c.OK, c.Detail = true, "loopback backend"
+		return c
+	}
+	healthy := make(map[string]bool)
+	for _, o := range rt.Outbound.Conns() {
+		healthy[o.Addr] = true
+	}
+	failing := 0
+	for _, t := range rt.Outbound.Health().Targets() {
+		switch {
+		case t.Healthy:
+			healthy[t.Addr] = true
+		case !healthy[t.Addr]:
+			failing++
+		}
+	}
+	if len(healthy) > 0 {
+		c.OK, c.Detail = true, fmt.Sprintf("%d healthy, %d failing", len(healthy), failing)
+		return c
+	}
+	c.Detail = fmt.Sprintf("no healthy target, %d failing", failing)
+	if rt.targetProber == nil && rt.readyProbe.kick(now, readyProbeInterval) {
+		log.Println("runtime: readyz found no healthy target, probing all targets")
+		c.Detail += "; probing"
+	}
+	return c
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+func TestRuntime_Readiness(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy-multi.conf")
+	os.WriteFile(path, []byte("proxy_for 2 149.154.161.144:8888;\n"), 0o644)
+	mgr := config.NewManager(path)
+	if err := mgr.Load(); err != nil {
+		t.Fatal(err)
+	}
+	rt := &Runtime{configMgr: mgr, Outbound: NewOutboundProxy(OutboundConfig{})}
+	var probes atomic.Int32
+	probed := make(chan struct{}, 1)
+	rt.readyProbe.probe = func() []ProbeResult {
+		probes.Add(1)
+		probed <- struct{}{}
+		return nil
+	}
+
+	checks := func(r HealthReport) map[string]bool {
+		m := make(map[string]bool)
+		for _, c := range r {
+			m[c.Name] = c.OK
+		}
+		return m
+	}
+	if !rt.Liveness().OK() {
+		t.Errorf("Liveness with a config: %v", rt.Liveness())
+	}
+	got := checks(rt.Readiness())
+	if !got["config"] || got["ingress"] || got["targets"] {
+		t.Errorf("before listening, without targets: %v", rt.Readiness())
+	}
+	<-probed
+	rt.Readiness()
+	if n := probes.Load(); n != 1 {
+		t.Errorf("%d probes started within %s, want 1", n, readyProbeInterval)
+	}
+
+	ci := NewClientIngressServer("127.0.0.1:0", nil, nil, nil)
+	rt.ingressCtl.Store(ci)
+	rt.Outbound.Health().Success("149.154.161.144:8888")
+	if r := rt.Readiness(); !r.OK() {
+		t.Errorf("listening with a healthy target: %v", r)
+	}
+
+	rt.standby = make(chan struct{})
+	if checks(rt.Readiness())["ingress"] {
+		t.Error("ready in warm standby")
+	}
+	close(rt.standby)
+	ci.DrainListener("127.0.0.1:0")
+	if checks(rt.Readiness())["ingress"] {
+		t.Error("ready with every listener drained")
+	}
+	rt.shuttingDown.Store(true)
+	if !rt.Liveness().OK() {
+		t.Error("not alive while shutting down")
+	}
+}
+
+func TestServeHealthReport(t *testing.T) {
+	report := HealthReport{{Name: "config", OK: true, Detail: "1 clusters"}}
+	check := func() HealthReport { return report }
+
+	rec := httptest.NewRecorder()
+	serveHealthReport(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil), check)
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\nconfig\tok\t1 clusters\n" {
+		t.Errorf("passing: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	report = append(report, HealthCheck{Name: "targets", Detail: "no healthy target"})
+	rec = httptest.NewRecorder()
+	serveHealthReport(rec, httptest.NewRequest(http.MethodHead, "/readyz", nil), check)
+	if rec.Code != http.StatusServiceUnavailable || !strings.HasPrefix(rec.Body.String(), "fail\n") {
+		t.Errorf("failing: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	serveHealthReport(rec, httptest.NewRequest(http.MethodPost, "/readyz", nil), check)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
+
+func TestReadyProberKick(t *testing.T) {
+	release := make(chan struct{})
+	p := readyProber{probe: func() []ProbeResult { <-release; return nil }}
+	now := time.Now()
+	if !p.kick(now, time.Minute) {
+		t.Fatal("first kick did not start a probe")
+	}
+	if p.kick(now.Add(2*time.Minute), time.Minute) {
+		t.Error("kick started a second probe while one is running")
+	}
+	close(release)
+	for p.running.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if p.kick(now.Add(30*time.Second), time.Minute) {
+		t.Error("kick within the interval started a probe")
+	}
+	if !p.kick(now.Add(2*time.Minute), time.Minute) {
+		t.Error("kick after the interval did not start a probe")
+	}
+}
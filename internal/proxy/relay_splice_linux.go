@@ -0,0 +1,97 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// spliceChunk is the most one splice(2) call moves into the pipe: the
+// default pipe capacity, so a chunk always fits.
+const spliceChunk = 64 << 10
+
+// splice(2) flags missing from package syscall.
+const (
+	spliceFMove     = 0x1
+	spliceFNonblock = 0x2
+)
+
+// spliceCopy moves bytes from src to dst inside the kernel: splice(2) reads
+// from the source socket into a pipe and from the pipe into the destination
+// socket, so the payload never reaches user space. touch is called after
+// every chunk read. It returns at EOF on src or at the first error, with
+// the bytes written to dst. ok is false when splicing is impossible —
+// either side is not a TCP socket or no pipe can be made — and nothing was
+// read then; the caller copies the usual way.
+func spliceCopy(dst, src net.Conn, touch func()) (written int64, ok bool, err error) {
+	s, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	d, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	srcRC, err := s.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	dstRC, err := d.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	for {
+		n, err := spliceOnce(srcRC.Read, func(fd int) (int64, error) {
+			return syscall.Splice(fd, nil, p[1], nil, spliceChunk, spliceFMove|spliceFNonblock)
+		})
+		if err != nil {
+			return written, true, err
+		}
+		if n == 0 {
+			return written, true, nil
+		}
+		touch()
+		// The pipe is drained completely before the next read, so the
+		// read never waits for room in it.
+		for n > 0 {
+			m, err := spliceOnce(dstRC.Write, func(fd int) (int64, error) {
+				return syscall.Splice(p[0], nil, fd, nil, n, spliceFMove|spliceFNonblock)
+			})
+			if err != nil {
+				return written, true, err
+			}
+			n -= m
+			written += int64(m)
+		}
+	}
+}
+
+// spliceOnce runs one splice call on a socket through wait (RawConn.Read or
+// RawConn.Write), which parks the goroutine in the netpoller until the
+// socket is ready and honours its deadlines and Close.
+func spliceOnce(wait func(func(fd uintptr) bool) error, call func(fd int) (int64, error)) (int, error) {
+	var n int
+	var serr error
+	err := wait(func(fd uintptr) bool {
+		for {
+			var m int64
+			m, serr = call(int(fd))
+			n = int(m)
+			if serr != syscall.EINTR {
+				return serr != syscall.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, serr
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+// TestSpliceCopy checks that a payload larger than the pipe crosses
+// unchanged from one TCP connection to another.
+func TestSpliceCopy(t *testing.T) {
+	in, src := tcpPair(t)
+	dst, out := tcpPair(t)
+	payload := make([]byte, 1<<20+123)
+	rand.Read(payload)
+	go func() {
+		in.Write(payload)
+		in.Close()
+	}()
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(out)
+		got <- b
+	}()
+	touches := 0
+	n, ok, err := spliceCopy(dst, src, func() { touches++ })
+	if !ok || err != nil || n != int64(len(payload)) {
+		t.Fatalf("spliceCopy = %d, %v, %v", n, ok, err)
+	}
+	if touches == 0 {
+		t.Error("touch never called")
+	}
+	dst.Close()
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, payload) {
+			t.Errorf("got %d bytes, not the payload", len(b))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payload never arrived")
+	}
+
+	// Connections that are not TCP sockets are left to the caller.
+	p, q := net.Pipe()
+	defer p.Close()
+	defer q.Close()
+	if _, ok, _ := spliceCopy(dst, p, func() {}); ok {
+		t.Error("spliceCopy accepted a net.Pipe source")
+	}
+}
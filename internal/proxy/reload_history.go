@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// DefaultReloadHistory is the number of reload events kept by ReloadHistory.
+const DefaultReloadHistory = 16
+
+// ReloadEvent describes one configuration reload attempt.
+type ReloadEvent struct {
+	Time           time.Time `json:"time"`
+	OK             bool      `json:"ok"`
+	Error          string    `json:"error,omitempty"`
+	MD5Before      string    `json:"md5_before"`
+	MD5After       string    `json:"md5_after"`
+	TargetsAdded   int       `json:"targets_added"`
+	TargetsRemoved int       `json:"targets_removed"`
+	Diff           string    `json:"diff,omitempty"`
+}
+
+// ReloadHistory is a fixed-size ring of the most recent reload events.
+// It is safe for concurrent use.
+type ReloadHistory struct {
+	mu     sync.Mutex
+	events []ReloadEvent
+	next   int
+	full   bool
+}
+
+// NewReloadHistory creates a history keeping the last size events.
+// size < 1 selects DefaultReloadHistory.
+func NewReloadHistory(size int) *ReloadHistory {
+	if size < 1 {
+		size = DefaultReloadHistory
+	}
+	return &ReloadHistory{events: make([]ReloadEvent, size)}
+}
+
+// Record stores the outcome of a reload from before to after. err is the
+// reload error; on failure after is normally the unchanged old config.
+func (h *ReloadHistory) Record(at time.Time, before, after *config.Config, err error) {
+	ev := ReloadEvent{Time: at, OK: err == nil}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if before != nil {
+		ev.MD5Before = before.MD5
+	}
+	if after != nil {
+		ev.MD5After = after.MD5
+	}
+	if err == nil {
+		ev.TargetsAdded, ev.TargetsRemoved = config.DiffTargets(before, after)
+		ev.Diff = config.DiffConfigs(before, after).Summary()
+	}
+
+	h.mu.Lock()
+	h.events[h.next] = ev
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.mu.Unlock()
+}
+
+// Events returns the recorded events, oldest first.
+func (h *ReloadHistory) Events() []ReloadEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]ReloadEvent(nil), h.events[:h.next]...)
+	}
+	out := make([]ReloadEvent, 0, len(h.events))
+	out = append(out, h.events[h.next:]...)
+	return append(out, h.events[:h.next]...)
+}
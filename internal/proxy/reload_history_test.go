@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+func TestReloadHistory_RecordsDiff(t *testing.T) {
+	before := makeTestConfig()
+	before.MD5 = "aaaa"
+	after := makeTestConfig()
+	after.MD5 = "bbbb"
+	after.Clusters[2].Targets = []config.Target{
+		{Addr: "dc2a.example.com", Port: 443},
+		{Addr: "dc2c.example.com", Port: 443},
+		{Addr: "dc2d.example.com", Port: 443},
+	}
+
+	h := NewReloadHistory(4)
+	h.Record(time.Unix(100, 0), before, after, nil)
+	h.Record(time.Unix(200, 0), after, after, errors.New("bad config"))
+
+	ev := h.Events()
+	if len(ev) != 2 {
+		t.Fatalf("len(Events) = %d, want 2", len(ev))
+	}
+	if !ev[0].OK || ev[0].MD5Before != "aaaa" || ev[0].MD5After != "bbbb" {
+		t.Errorf("event 0 = %+v", ev[0])
+	}
+	if ev[0].TargetsAdded != 2 || ev[0].TargetsRemoved != 1 {
+		t.Errorf("event 0 diff = +%d -%d, want +2 -1", ev[0].TargetsAdded, ev[0].TargetsRemoved)
+	}
+	if want := "targets +2 -1, clusters +0 -0 ~1"; ev[0].Diff != want {
+		t.Errorf("event 0 summary = %q, want %q", ev[0].Diff, want)
+	}
+	if ev[1].OK || ev[1].Error != "bad config" || ev[1].TargetsAdded != 0 {
+		t.Errorf("event 1 = %+v", ev[1])
+	}
+}
+
+func TestReloadHistory_KeepsLastN(t *testing.T) {
+	h := NewReloadHistory(3)
+	for i := 1; i <= 5; i++ {
+		h.Record(time.Unix(int64(i), 0), nil, nil, nil)
+	}
+	ev := h.Events()
+	if len(ev) != 3 {
+		t.Fatalf("len(Events) = %d, want 3", len(ev))
+	}
+	for i, e := range ev {
+		if want := int64(i + 3); e.Time.Unix() != want {
+			t.Errorf("event %d time = %d, want %d", i, e.Time.Unix(), want)
+		}
+	}
+}
+
+func TestHotReloader_AppliedCountsGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy-multi.conf")
+	os.WriteFile(path, []byte("proxy_for 2 10.0.0.1:8888;\n"), 0600)
+	mgr := config.NewManager(path)
+	if err := mgr.Load(); err != nil {
+		t.Fatal(err)
+	}
+	stats := NewStats()
+	h := NewHotReloader(mgr, NewRouter(mgr.Get()))
+	h.SetStats(stats)
+
+	os.WriteFile(path, []byte("proxy_for 2 10.0.0.2:8888;\n"), 0600)
+	h.reload()
+	if g := stats.Snapshot(0)["config_generation"]; g != 1 {
+		t.Errorf("config_generation = %d, want 1", g)
+	}
+	if d := stats.LastConfigDiff(); d != "targets +1 -1, clusters +0 -0 ~1" {
+		t.Errorf("last diff = %q", d)
+	}
+	// A failed reload is not a new generation.
+	os.WriteFile(path, []byte("proxy_for x;\n"), 0600)
+	h.reload()
+	if g := stats.Snapshot(0)["config_generation"]; g != 1 {
+		t.Errorf("config_generation after a failed reload = %d, want 1", g)
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsDialTimeout bounds connecting to a configured DNS server.
+const dnsDialTimeout = 5 * time.Second
+
+// dnsServer is one upstream from --dns.
+type dnsServer struct {
+	kind string // "udp", "tls" or "https"
+	addr string // host:port for udp/tls, URL for https
+	host string // TLS server name for "tls"
+}
+
+// NewResolver builds a resolver for outbound target lookups that queries
+// the given servers instead of the system configuration. Each spec is one of
+//
+//	1.1.1.1 | 1.1.1.1:53 | udp://1.1.1.1:53   plain DNS
+//	tls://1.1.1.1:853 | tls://dns.example       DNS-over-TLS (RFC 7858)
+//	https://dns.example/dns-query              DNS-over-HTTPS (RFC 8484)
+//
+// Servers are used in rotation, so a retry after a failed query goes to the
+// next one. With no specs NewResolver returns nil, meaning the system
+// resolver.
+func NewResolver(specs []string) (*net.Resolver, error) {
+	return newResolver(specs, &http.Client{})
+}
+
+// newResolver is NewResolver with an explicit HTTP client for DoH.
+func newResolver(specs []string, client *http.Client) (*net.Resolver, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	servers := make([]dnsServer, 0, len(specs))
+	for _, spec := range specs {
+		s, err := parseDNSServer(spec)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, s)
+	}
+
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			s := servers[int(next.Add(1)-1)%len(servers)]
+			return s.dial(ctx, client)
+		},
+	}, nil
+}
+
+// parseDNSServer parses one --dns value.
+func parseDNSServer(spec string) (dnsServer, error) {
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		scheme, rest = "udp", spec
+	}
+	switch scheme {
+	case "udp", "tls":
+		port := "53"
+		if scheme == "tls" {
+			port = "853"
+		}
+		host, p, err := net.SplitHostPort(rest)
+		if err != nil {
+			host, p = strings.Trim(rest, "[]"), port
+		}
+		if host == "" {
+			return dnsServer{}, fmt.Errorf("dns server %q: missing host", spec)
+		}
+		return dnsServer{kind: scheme, addr: net.JoinHostPort(host, p), host: host}, nil
+	case "https":
+		u, err := url.Parse(spec)
+		if err != nil || u.Host == "" {
+			return dnsServer{}, fmt.Errorf("dns server %q: invalid DoH URL", spec)
+		}
+		return dnsServer{kind: scheme, addr: spec}, nil
+	}
+	return dnsServer{}, fmt.Errorf("dns server %q: unsupported scheme %q (want udp, tls or https)", spec, scheme)
+}
+
+// dial opens a connection the Go resolver can exchange DNS messages over.
+// UDP connections use datagram framing; TLS and DoH connections are streams
+// with the 2-byte length prefix of DNS over TCP.
+func (s dnsServer) dial(ctx context.Context, client *http.Client) (net.Conn, error) {
+	d := net.Dialer{Timeout: dnsDialTimeout}
+	switch s.kind {
+	case "udp":
+		return d.DialContext(ctx, "udp", s.addr)
+	case "tls":
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: s.host}}
+		return td.DialContext(ctx, "tcp", s.addr)
+	default:
+		return &dohConn{ctx: ctx, url: s.addr, client: client}, nil
+	}
+}
+
+// dohConn adapts DNS-over-HTTPS to the stream interface expected by
+// net.Resolver: every length-prefixed query written is POSTed to the server
+// and the length-prefixed answer is returned by subsequent reads.
+type dohConn struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	deadline time.Time
+	resp     bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, errors.New("doh: short query")
+	}
+	n := int(b[0])<<8 | int(b[1])
+	if n != len(b)-2 {
+		return 0, fmt.Errorf("doh: query length %d does not match frame %d", n, len(b)-2)
+	}
+
+	c.mu.Lock()
+	ctx, deadline := c.ctx, c.deadline
+	c.mu.Unlock()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("doh: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("doh: %s returned %s", c.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return 0, fmt.Errorf("doh: read answer: %w", err)
+	}
+
+	c.mu.Lock()
+	c.resp.WriteByte(byte(len(body) >> 8))
+	c.resp.WriteByte(byte(len(body)))
+	c.resp.Write(body)
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resp.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.resp.Read(b)
+}
+
+func (c *dohConn) Close() error { return nil }
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+
+// dohAddr is the net.Addr of a DoH endpoint.
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseDNSServer(t *testing.T) {
+	cases := []struct {
+		spec, kind, addr string
+	}{
+		{"1.1.1.1", "udp", "1.1.1.1:53"},
+		{"1.1.1.1:5353", "udp", "1.1.1.1:5353"},
+		{"udp://[2606:4700::1111]:53", "udp", "[2606:4700::1111]:53"},
+		{"tls://dns.example", "tls", "dns.example:853"},
+		{"https://dns.example/dns-query", "https", "https://dns.example/dns-query"},
+	}
+	for _, c := range cases {
+		s, err := parseDNSServer(c.spec)
+		if err != nil {
+			t.Errorf("parseDNSServer(%q): %v", c.spec, err)
+			continue
+		}
+		if s.kind != c.kind || s.addr != c.addr {
+			t.Errorf("parseDNSServer(%q) = %s %s, want %s %s", c.spec, s.kind, s.addr, c.kind, c.addr)
+		}
+	}
+	for _, bad := range []string{"ftp://x", "https://", "tls://"} {
+		if _, err := parseDNSServer(bad); err == nil {
+			t.Errorf("parseDNSServer(%q): expected error", bad)
+		}
+	}
+}
+
+// dohAnswer builds a DNS answer to query with one A record for ip when the
+// question type is A, and no records otherwise.
+func dohAnswer(t *testing.T, query []byte, ip [4]byte) []byte {
+	t.Helper()
+	off := 12
+	for query[off] != 0 {
+		off += int(query[off]) + 1
+	}
+	off++
+	qtype := binary.BigEndian.Uint16(query[off:])
+	off += 4
+
+	resp := append([]byte(nil), query[:off]...)
+	binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, RD, RA
+	binary.BigEndian.PutUint16(resp[10:], 0)     // drop additional records
+	if qtype != 1 {
+		binary.BigEndian.PutUint16(resp[6:], 0)
+		return resp
+	}
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	resp = append(resp, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+	return append(resp, ip[:]...)
+}
+
+func TestResolver_DoH(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dohAnswer(t, query, [4]byte{192, 0, 2, 7}))
+	}))
+	defer ts.Close()
+
+	r, err := newResolver([]string{ts.URL + "/dns-query"}, ts.Client())
+	if err != nil {
+		t.Fatalf("newResolver: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.LookupIPAddr(ctx, "dc.example.org")
+	if err != nil {
+		t.Fatalf("LookupIPAddr: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].IP.String() != "192.0.2.7" {
+		t.Errorf("addrs = %v, want [192.0.2.7]", addrs)
+	}
+}
+
+func TestNewResolver_Empty(t *testing.T) {
+	r, err := NewResolver(nil)
+	if err != nil || r != nil {
+		t.Errorf("NewResolver(nil) = %v, %v; want nil, nil", r, err)
+	}
+}
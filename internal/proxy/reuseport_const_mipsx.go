@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package proxy
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define.
+const soReusePort = 0x200
@@ -0,0 +1,24 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// reusePortControl is a net.ListenConfig Control hook that sets SO_REUSEPORT
+// before bind, so every supervised worker can bind the same client port and
+// the kernel spreads new connections across them.
+func reusePortControl(network, address string, rc syscall.RawConn) error {
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("SO_REUSEPORT on %s: %w", address, serr)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestIngressServer_ReusePort binds two servers to the same port, the way
+// supervised workers do, and checks both come up.
+func TestIngressServer_ReusePort(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		srv := NewIngressServer(addr, func(c net.Conn) { c.Close() })
+		srv.SetReusePort(true)
+		go func() { done <- srv.ListenAndServe(ctx) }()
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("second listener failed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	dialRetry(t, addr).Close()
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("ListenAndServe after cancel: %v", err)
+		}
+	}
+}
+
+// TestCheckListen_ReusePort checks that preflight lets workers share a port
+// a predecessor holds with SO_REUSEPORT, and fails it for a plain bind.
+func TestCheckListen_ReusePort(t *testing.T) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	if c := checkListen(addr, true); c.Status != PreflightPass {
+		t.Errorf("with SO_REUSEPORT: %s %s", c.Status, c.Detail)
+	}
+	if c := checkListen(addr, false); c.Status != PreflightFail {
+		t.Errorf("plain bind: %s %s, want %s", c.Status, c.Detail, PreflightFail)
+	}
+}
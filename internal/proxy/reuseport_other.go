@@ -0,0 +1,15 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// reusePortControl is unsupported outside Linux; the listen fails so a
+// second worker never silently runs without a client port.
+func reusePortControl(network, address string, rc syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT on %s: not supported on %s", address, runtime.GOOS)
+}
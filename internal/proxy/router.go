@@ -1,88 +1,584 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/skrashevich/MTProxy/internal/config"
 )
 
 // Router выбирает целевой backend для клиентского соединения.
 // Соответствует логике choose_proxy_target() из mtproto-proxy.c.
+//
+// Состояние маршрутизации — неизменяемый снимок, который Reload целиком
+// заменяет атомарно (copy-on-write): Route читает его без блокировок и
+// никогда не видит наполовину применённую конфигурацию.
 type Router struct {
-	mu  sync.RWMutex
-	cfg *config.Config
+	snap atomic.Pointer[routerSnapshot]
+
+	// Источник случайности для Route: без SetSeed — глобальный
+	// math/rand/v2, с ним — PCG от (seed, номер выбора), так что выбор
+	// воспроизводим и обходится без общей блокировки.
+	seeded atomic.Bool
+	seed   atomic.Int64
+	draws  atomic.Int64 // число выборов с момента SetSeed
+
+	// verbose включает лог входных данных каждого выбора
+	verbose bool
+
+	// preferIPv6 — выбирать IPv6-target'ы кластера, если они есть (-6);
+	// иначе предпочитаются IPv4
+	preferIPv6 bool
+
+	// balance — политика выбора target'а (--balance) для кластеров без
+	// своей; BalanceDefault = случайный выбор, как в C
+	balance config.BalancePolicy
+	// outstanding возвращает число запросов к target'у, ждущих ответа
+	// (политика least-outstanding); nil — все считаются свободными
+	outstanding func(addr string) int
+
+	// affinity закрепляет сессии (auth_key_id) за target'ами
+	// (--session-affinity); nil — каждый пакет выбирается заново
+	affinity *SessionAffinity
+
+	// selected — сколько раз выбран каждый target (addr → *atomic.Int64);
+	// переживает Reload, как TargetHealth
+	selected sync.Map
+}
 
-	// Индекс round-robin на DC (dcID -> следующий индекс)
-	rrIdx map[int]int
+// routerSnapshot — состояние маршрутизации для одной версии конфигурации.
+// После публикации не изменяется, кроме атомарных счётчиков round-robin.
+type routerSnapshot struct {
+	defaultID int
+	clusters  map[int]*routeCluster
+
+	// options — настройки кластера (config v2) по адресу target'а
+	options map[string]config.ClusterOptions
+}
+
+// routeCluster — кластер с заранее вычисленными адресами target'ов.
+type routeCluster struct {
+	id    int
+	addrs []string
+	rr    atomic.Uint64 // следующий индекс round-robin
+
+	// addrs, разложенные по семействам адресов: v6 — IPv6-литералы,
+	// v4 — все остальные (IPv4 и имена хостов)
+	v4, v6 []string
+	// members — все адреса кластера, включая canary
+	members map[string]bool
+
+	// canary получает canaryPercent процентов сессий (RouteSession);
+	// пустой — canary для кластера не задан
+	canary        string
+	canaryPercent int
+
+	// balance — политика кластера из config v2; BalanceDefault — политика
+	// Router'а
+	balance config.BalancePolicy
+	// wv4, wv6 — состояние взвешенного round-robin по v4 и v6
+	wv4, wv6 *weightedRR
+	// fallbacks чередует запасные target'ы при политиках, отличных от
+	// random (там их выбирает номер выбора)
+	fallbacks atomic.Uint64
+}
+
+// newRouterSnapshot строит снимок из cfg; для nil возвращает nil.
+func newRouterSnapshot(cfg *config.Config) *routerSnapshot {
+	if cfg == nil {
+		return nil
+	}
+	snap := &routerSnapshot{
+		defaultID: cfg.DefaultClusterID,
+		clusters:  make(map[int]*routeCluster, len(cfg.Clusters)),
+		options:   make(map[string]config.ClusterOptions),
+	}
+	// Обход по возрастанию DC id: если target входит в несколько
+	// кластеров, действуют настройки кластера с меньшим id.
+	ids := make([]int, 0, len(cfg.Clusters))
+	for id := range cfg.Clusters {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		cl := cfg.Clusters[id]
+		if len(cl.Targets) == 0 {
+			continue
+		}
+		rc := &routeCluster{id: cl.ID, addrs: make([]string, len(cl.Targets)), members: make(map[string]bool)}
+		for i, t := range cl.Targets {
+			rc.addrs[i] = cfg.DialAddr(t)
+			rc.members[rc.addrs[i]] = true
+			if isIPv6Addr(rc.addrs[i]) {
+				rc.v6 = append(rc.v6, rc.addrs[i])
+			} else {
+				rc.v4 = append(rc.v4, rc.addrs[i])
+			}
+		}
+		if cl.Canary != nil && cl.CanaryPercent > 0 {
+			rc.canary = cfg.DialAddr(*cl.Canary)
+			rc.canaryPercent = cl.CanaryPercent
+			rc.members[rc.canary] = true
+		}
+		rc.balance = cl.Options.Balance
+		snap.clusters[id] = rc
+		if cl.Options != (config.ClusterOptions{}) {
+			addrs := append([]string{rc.canary}, rc.addrs...)
+			for _, addr := range addrs {
+				if _, ok := snap.options[addr]; !ok && addr != "" {
+					snap.options[addr] = cl.Options
+				}
+			}
+		}
+	}
+	// Веса взвешенного round-robin считаются, когда настройки всех
+	// target'ов уже известны.
+	for _, rc := range snap.clusters {
+		rc.wv4 = newWeightedRR(rc.v4, snap.options)
+		rc.wv6 = newWeightedRR(rc.v6, snap.options)
+	}
+	return snap
+}
+
+// TargetOptions возвращает настройки кластера (config v2), которому
+// принадлежит target addr; нулевые — если их нет.
+func (r *Router) TargetOptions(addr string) config.ClusterOptions {
+	snap := r.snap.Load()
+	if snap == nil {
+		return config.ClusterOptions{}
+	}
+	return snap.options[addr]
+}
+
+// ErrUnknownDC — у запрошенного DC нет кластера в конфигурации, а
+// default-кластера тоже нет.
+var ErrUnknownDC = errors.New("router: unknown dc")
+
+// cluster возвращает кластер для targetDC. Если его нет, в том числе для
+// медиа-DC (отрицательный id) без своего кластера, выбирается
+// default-кластер и dflt = true, как mf_cluster_lookup в C.
+func (r *Router) cluster(targetDC int) (cl *routeCluster, dflt bool, err error) {
+	snap := r.snap.Load()
+	if snap == nil {
+		return nil, false, fmt.Errorf("router: config not loaded")
+	}
+	if cl, ok := snap.clusters[targetDC]; ok {
+		return cl, false, nil
+	}
+	cl, ok := snap.clusters[snap.defaultID]
+	if !ok {
+		return nil, true, fmt.Errorf("%w: no targets for dc=%d and no default cluster", ErrUnknownDC, targetDC)
+	}
+	return cl, true, nil
 }
 
 // NewRouter создаёт Router с начальной конфигурацией.
 func NewRouter(cfg *config.Config) *Router {
-	return &Router{
-		cfg:   cfg,
-		rrIdx: make(map[int]int),
+	r := &Router{}
+	r.snap.Store(newRouterSnapshot(cfg))
+	return r
+}
+
+// SetSeed делает случайный выбор target детерминированным: при том же seed
+// и той же последовательности вызовов Route выбор повторяется.
+func (r *Router) SetSeed(seed int64) {
+	r.seed.Store(seed)
+	r.draws.Store(0)
+	r.seeded.Store(true)
+}
+
+// SetVerbose включает лог входных данных каждого выбора target
+// (seed, номер выбора, кластер, число target'ов, индекс).
+func (r *Router) SetVerbose(v bool) {
+	r.verbose = v
+}
+
+// SetPreferIPv6 включает предпочтение IPv6-target'ов (-6).
+func (r *Router) SetPreferIPv6(v bool) {
+	r.preferIPv6 = v
+}
+
+// SetBalance задаёт политику выбора target'а для кластеров, у которых
+// нет своей (--balance).
+func (r *Router) SetBalance(p config.BalancePolicy) {
+	r.balance = p
+}
+
+// SetOutstanding подключает счётчик запросов, ждущих ответа от target'а,
+// для политики least-outstanding.
+func (r *Router) SetOutstanding(f func(addr string) int) {
+	r.outstanding = f
+}
+
+// SetAffinity включает закрепление сессий за target'ами (--session-affinity).
+func (r *Router) SetAffinity(a *SessionAffinity) {
+	r.affinity = a
+}
+
+// Unpin снимает закрепление сессии authKeyID, например после ошибки её
+// target'а: следующий пакет выберет target заново.
+func (r *Router) Unpin(authKeyID int64) {
+	if authKeyID != 0 {
+		r.affinity.Unpin(authKeyID)
+	}
+}
+
+// Policy возвращает политику выбора по умолчанию.
+func (r *Router) Policy() config.BalancePolicy {
+	if r.balance == config.BalanceDefault {
+		return config.BalanceRandom
 	}
+	return r.balance
 }
 
-// Reload атомарно заменяет конфигурацию маршрутизатора.
+// policy возвращает политику, действующую для кластера cl.
+func (r *Router) policy(cl *routeCluster) config.BalancePolicy {
+	if cl.balance != config.BalanceDefault {
+		return cl.balance
+	}
+	return r.Policy()
+}
+
+// pick возвращает случайный индекс из [0, n) и номер выбора.
+func (r *Router) pick(n int) (int, int64) {
+	draw := r.draws.Add(1)
+	if !r.seeded.Load() {
+		return rand.IntN(n), draw
+	}
+	return rand.New(rand.NewPCG(uint64(r.seed.Load()), uint64(draw))).IntN(n), draw
+}
+
+// Reload атомарно заменяет конфигурацию маршрутизатора. Выборы, начатые
+// до замены, завершаются на старом снимке.
 func (r *Router) Reload(cfg *config.Config) {
-	r.mu.Lock()
-	r.cfg = cfg
-	r.rrIdx = make(map[int]int)
-	r.mu.Unlock()
+	r.snap.Store(newRouterSnapshot(cfg))
 }
 
 // Route возвращает Target для заданного targetDC.
 //
 // Логика (из choose_proxy_target в C):
 //   - Ищем кластер с id == targetDC.
-//   - Если не найден — используем DefaultClusterID.
-//   - Из кластера выбираем target случайным образом.
+//   - Если не найден — используем DefaultClusterID и помечаем
+//     Target.DefaultRoute.
+//   - Из кластера выбираем target по политике кластера (по умолчанию —
+//     случайным образом).
 func (r *Router) Route(targetDC int) (Target, error) {
-	r.mu.RLock()
-	cfg := r.cfg
-	r.mu.RUnlock()
+	return r.RoutePacket(targetDC, 0, 0)
+}
 
-	if cfg == nil {
-		return Target{}, fmt.Errorf("router: config not loaded")
+// RouteSession — Route для кадра сессии session (ext_conn_id): если у
+// кластера задан canary, сессия попадает на него с вероятностью
+// canaryPercent. Решение детерминировано по session, поэтому все кадры
+// сессии идут в одну сторону, пока конфигурация не изменится.
+func (r *Router) RouteSession(targetDC int, session int64) (Target, error) {
+	return r.RoutePacket(targetDC, session, 0)
+}
+
+// RoutePacket — RouteSession для пакета с auth_key_id authKeyID: по нему
+// выбирает политика hash (для DH-пакетов, где он 0, — по session). С
+// SetAffinity зашифрованные пакеты сессии идут на тот target, который
+// получил её первый пакет, пока он остаётся в кластере, — в том числе
+// после переподключения клиента с новым ext_conn_id.
+func (r *Router) RoutePacket(targetDC int, session, authKeyID int64) (Target, error) {
+	cl, dflt, err := r.cluster(targetDC)
+	if err != nil {
+		return Target{}, err
 	}
+	t := r.routePacketIn(cl, targetDC, session, authKeyID)
+	t.DCID, t.DefaultRoute = cl.id, dflt
+	return t, nil
+}
 
-	cl, ok := cfg.Clusters[targetDC]
-	if !ok || len(cl.Targets) == 0 {
-		cl, ok = cfg.Clusters[cfg.DefaultClusterID]
-		if !ok || len(cl.Targets) == 0 {
-			return Target{}, fmt.Errorf("router: no targets for dc=%d and no default cluster", targetDC)
+// routePacketIn — RoutePacket внутри уже найденного кластера cl.
+func (r *Router) routePacketIn(cl *routeCluster, targetDC int, session, authKeyID int64) Target {
+	if authKeyID == 0 || r.affinity == nil {
+		return r.routeNew(cl, targetDC, session, authKeyID)
+	}
+	now := time.Now()
+	if addr, ok := r.affinity.Lookup(authKeyID, now, func(addr string) bool { return cl.members[addr] }); ok {
+		t := Target{Addr: addr, Canary: addr == cl.canary, Fallback: r.fallbackFor(cl, addr)}
+		if r.verbose {
+			log.Printf("router: dc=%d cluster=%d auth_key_id=%x pinned addr=%s fallback=%s", targetDC, cl.id, uint64(authKeyID), t.Addr, t.Fallback)
 		}
+		r.countSelected(addr)
+		return t
 	}
+	t := r.routeNew(cl, targetDC, session, authKeyID)
+	r.affinity.Pin(authKeyID, t.Addr, now)
+	return t
+}
 
-	idx := rand.Intn(len(cl.Targets))
-	ct := cl.Targets[idx]
-	return Target{Addr: ct.String()}, nil
+// routeNew выбирает target для пакета без закрепления: canary по session,
+// иначе по политике кластера.
+func (r *Router) routeNew(cl *routeCluster, targetDC int, session, authKeyID int64) Target {
+	if cl.canary != "" && canaryBucket(session) < cl.canaryPercent {
+		if r.verbose {
+			log.Printf("router: dc=%d cluster=%d session=%d canary addr=%s", targetDC, cl.id, session, cl.canary)
+		}
+		r.countSelected(cl.canary)
+		return Target{Addr: cl.canary, Canary: true}
+	}
+	key := authKeyID
+	if key == 0 {
+		key = session
+	}
+	return r.routeIn(cl, targetDC, key)
 }
 
-// RouteRoundRobin выбирает target по round-robin.
-func (r *Router) RouteRoundRobin(targetDC int) (Target, error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// fallbackFor возвращает запасной target другого семейства адресов для
+// addr из кластера cl или "", если таких нет.
+func (r *Router) fallbackFor(cl *routeCluster, addr string) string {
+	other := cl.v6
+	if isIPv6Addr(addr) {
+		other = cl.v4
+	}
+	if len(other) == 0 {
+		return ""
+	}
+	return other[(cl.fallbacks.Add(1)-1)%uint64(len(other))]
+}
 
-	cfg := r.cfg
-	if cfg == nil {
-		return Target{}, fmt.Errorf("router: config not loaded")
+// canaryBucket отображает сессию в [0, 100). ext_conn_id идут подряд,
+// поэтому перед делением они перемешиваются.
+func canaryBucket(session int64) int {
+	return int(mix64(uint64(session)) % 100)
+}
+
+// mix64 — финализатор splitmix64: перемешивает биты x.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// routeIn выбирает target предпочитаемого семейства адресов из кластера cl
+// по политике кластера, а если в кластере есть target'ы другого
+// семейства — ещё и запасной из них (Happy Eyeballs в OutboundProxy).
+// key — ключ политики hash.
+func (r *Router) routeIn(cl *routeCluster, targetDC int, key int64) Target {
+	primary, other := cl.v4, cl.v6
+	wrr, otherWRR := cl.wv4, cl.wv6
+	if r.preferIPv6 {
+		primary, other = other, primary
+		wrr, otherWRR = otherWRR, wrr
+	}
+	if len(primary) == 0 {
+		primary, other = other, nil
+		wrr = otherWRR
+	}
+	policy := r.policy(cl)
+	var idx int
+	var draw int64
+	switch policy {
+	case config.BalanceRoundRobin:
+		idx = int((cl.rr.Add(1) - 1) % uint64(len(primary)))
+	case config.BalanceLeastOutstanding:
+		idx = r.leastOutstanding(primary, int(cl.rr.Add(1)-1))
+	case config.BalanceWeighted:
+		idx = wrr.next()
+	case config.BalanceHash:
+		idx = hashPick(primary, key)
+	default:
+		idx, draw = r.pick(len(primary))
+	}
+	t := Target{Addr: primary[idx]}
+	if len(other) > 0 {
+		fb := uint64(draw)
+		if policy != config.BalanceRandom {
+			fb = cl.fallbacks.Add(1) - 1
+		}
+		t.Fallback = other[fb%uint64(len(other))]
+	}
+	r.countSelected(t.Addr)
+	if r.verbose {
+		log.Printf("router: dc=%d cluster=%d policy=%s seed=%d draw=%d targets=%d pick=%d addr=%s fallback=%s",
+			targetDC, cl.id, policy, r.seed.Load(), draw, len(primary), idx, t.Addr, t.Fallback)
+	}
+	return t
+}
+
+// leastOutstanding возвращает индекс target'а с наименьшим числом
+// запросов, ждущих ответа; при равенстве обход начинается с start, чтобы
+// равные target'ы чередовались.
+func (r *Router) leastOutstanding(addrs []string, start int) int {
+	best, bestN := start%len(addrs), -1
+	if r.outstanding == nil {
+		return best
+	}
+	for i := range addrs {
+		j := (start + i) % len(addrs)
+		if n := r.outstanding(addrs[j]); bestN < 0 || n < bestN {
+			best, bestN = j, n
+		}
+	}
+	return best
+}
+
+// hashPick выбирает target по rendezvous-хешированию ключа key: у каждого
+// ключа свой target, и при удалении target'а из списка переезжают только
+// ключи, которые были на нём.
+func hashPick(addrs []string, key int64) int {
+	best, bestScore := 0, uint64(0)
+	for i, addr := range addrs {
+		h := fnv.New64a()
+		h.Write([]byte(addr))
+		if score := mix64(h.Sum64() ^ uint64(key)); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
 	}
+	return best
+}
+
+// weightedRR — плавный взвешенный round-robin (как в nginx) по
+// уникальным адресам списка target'ов: за каждые W выборов, где W — сумма
+// весов, target выбирается ровно weight раз, без серий подряд.
+type weightedRR struct {
+	mu      sync.Mutex
+	index   []int // индекс адреса в исходном списке
+	weight  []int
+	current []int
+	total   int
+}
 
-	cl, ok := cfg.Clusters[targetDC]
-	if !ok || len(cl.Targets) == 0 {
-		cl, ok = cfg.Clusters[cfg.DefaultClusterID]
-		if !ok || len(cl.Targets) == 0 {
-			return Target{}, fmt.Errorf("router: no targets for dc=%d and no default cluster", targetDC)
+// newWeightedRR строит weightedRR для addrs: вес адреса — число его
+// повторов (weight в конфиге), умноженное на max_connections (или
+// min_connections) его кластера из options. Для пустого addrs — nil.
+func newWeightedRR(addrs []string, options map[string]config.ClusterOptions) *weightedRR {
+	if len(addrs) == 0 {
+		return nil
+	}
+	w := &weightedRR{}
+	pos := make(map[string]int)
+	for i, addr := range addrs {
+		j, ok := pos[addr]
+		if !ok {
+			j = len(w.index)
+			pos[addr] = j
+			w.index = append(w.index, i)
+			w.weight = append(w.weight, 0)
 		}
+		w.weight[j] += targetCapacity(options[addr])
+	}
+	w.current = make([]int, len(w.weight))
+	for _, n := range w.weight {
+		w.total += n
+	}
+	return w
+}
+
+// targetCapacity — число соединений, на которое рассчитан target:
+// max_connections, иначе min_connections, иначе 1.
+func targetCapacity(o config.ClusterOptions) int {
+	switch {
+	case o.MaxConnections > 0:
+		return o.MaxConnections
+	case o.MinConnections > 0:
+		return o.MinConnections
+	}
+	return 1
+}
+
+// next возвращает индекс следующего target'а в исходном списке.
+func (w *weightedRR) next() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	best := 0
+	for i := range w.current {
+		w.current[i] += w.weight[i]
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+	return w.index[best]
+}
+
+// countSelected учитывает выбор target'а addr.
+func (r *Router) countSelected(addr string) {
+	c, ok := r.selected.Load(addr)
+	if !ok {
+		c, _ = r.selected.LoadOrStore(addr, new(atomic.Int64))
 	}
+	c.(*atomic.Int64).Add(1)
+}
+
+// Selected возвращает, сколько раз выбран каждый target.
+func (r *Router) Selected() map[string]int64 {
+	out := make(map[string]int64)
+	r.selected.Range(func(k, v any) bool {
+		out[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return out
+}
 
-	idx := r.rrIdx[cl.ID] % len(cl.Targets)
-	r.rrIdx[cl.ID] = idx + 1
+// isIPv6Addr сообщает, что host:port addr задан IPv6-литералом.
+func isIPv6Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Is6() && !ip.Is4In6()
+}
 
-	ct := cl.Targets[idx]
-	return Target{Addr: ct.String()}, nil
+// RouteRoundRobin выбирает target по round-robin.
+func (r *Router) RouteRoundRobin(targetDC int) (Target, error) {
+	cl, dflt, err := r.cluster(targetDC)
+	if err != nil {
+		return Target{}, err
+	}
+	idx := (cl.rr.Add(1) - 1) % uint64(len(cl.addrs))
+	return Target{Addr: cl.addrs[idx], DCID: cl.id, DefaultRoute: dflt}, nil
+}
+
+// ClusterInfo — кластер текущего снимка маршрутизации для отчётов.
+type ClusterInfo struct {
+	ID      int
+	Default bool
+	// Targets — адреса для dial в порядке конфига; при --duplicate-targets
+	// weight адрес повторяется столько раз, каков его вес
+	Targets       []string
+	Canary        string
+	CanaryPercent int
+	// Balance — действующая политика выбора target'а
+	Balance config.BalancePolicy
+	// Selected — сколько раз выбран каждый target (общая для всех
+	// кластеров карта, только для чтения)
+	Selected map[string]int64
+}
+
+// Clusters возвращает кластеры текущего снимка, упорядоченные по ID.
+func (r *Router) Clusters() []ClusterInfo {
+	snap := r.snap.Load()
+	if snap == nil {
+		return nil
+	}
+	selected := r.Selected()
+	out := make([]ClusterInfo, 0, len(snap.clusters))
+	for id, cl := range snap.clusters {
+		out = append(out, ClusterInfo{
+			ID:            id,
+			Default:       id == snap.defaultID,
+			Targets:       cl.addrs,
+			Canary:        cl.canary,
+			CanaryPercent: cl.canaryPercent,
+			Balance:       r.policy(cl),
+			Selected:      selected,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
 }
@@ -1,7 +1,11 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/skrashevich/MTProxy/internal/config"
 )
@@ -45,6 +49,35 @@ func TestRouter_RouteUnknownDCFallback(t *testing.T) {
 	}
 }
 
+// TestRouter_MediaDC checks that a media DC goes to its own cluster, that
+// a DC with no cluster, a media DC included, is marked as routed to the
+// default one as in the C proxy, and that without a default cluster it
+// fails with ErrUnknownDC.
+func TestRouter_MediaDC(t *testing.T) {
+	cfg := makeTestConfig()
+	cfg.Clusters[-5] = &config.Cluster{ID: -5, Targets: []config.Target{{Addr: "media5.example.com", Port: 443}}}
+	r := NewRouter(cfg)
+	for _, tc := range []struct {
+		dc, cluster int
+		dflt        bool
+	}{{-5, -5, false}, {-1, 2, true}, {1, 1, false}, {-99, 2, true}, {99, 2, true}} {
+		target, err := r.Route(tc.dc)
+		if err != nil {
+			t.Fatalf("Route(%d) error: %v", tc.dc, err)
+		}
+		if target.DCID != tc.cluster || target.DefaultRoute != tc.dflt {
+			t.Errorf("Route(%d) = cluster %d default %v, want %d %v", tc.dc, target.DCID, target.DefaultRoute, tc.cluster, tc.dflt)
+		}
+	}
+
+	cfg = makeTestConfig()
+	cfg.DefaultClusterID = 7
+	r = NewRouter(cfg)
+	if _, err := r.Route(99); !errors.Is(err, ErrUnknownDC) {
+		t.Errorf("Route(99) without default cluster: %v, want ErrUnknownDC", err)
+	}
+}
+
 func TestRouter_RouteRandomMultiTarget(t *testing.T) {
 	r := NewRouter(makeTestConfig())
 	seen := map[string]bool{}
@@ -97,9 +130,317 @@ func TestRouter_Reload(t *testing.T) {
 }
 
 func TestRouter_NilConfig(t *testing.T) {
-	r := &Router{rrIdx: make(map[int]int)}
+	r := &Router{}
 	_, err := r.Route(1)
 	if err == nil {
 		t.Error("Route with nil config should return error")
 	}
 }
+
+func TestRouter_SetSeedDeterministic(t *testing.T) {
+	sequence := func() []string {
+		cfg := makeTestConfig()
+		cfg.Clusters[2].Targets = append(cfg.Clusters[2].Targets,
+			config.Target{Addr: "dc2c.example.com", Port: 443},
+			config.Target{Addr: "dc2d.example.com", Port: 443})
+		r := NewRouter(cfg)
+		r.SetSeed(42)
+		var out []string
+		for i := 0; i < 20; i++ {
+			target, err := r.Route(2)
+			if err != nil {
+				t.Fatalf("Route(2) error: %v", err)
+			}
+			out = append(out, target.Addr)
+		}
+		return out
+	}
+	a, b := sequence(), sequence()
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("selection %d differs with the same seed: %s vs %s", i, a[i], b[i])
+		}
+	}
+}
+
+// TestRouter_ConcurrentReload routes from many goroutines while the config is
+// swapped; run with -race to check that readers never see a torn snapshot.
+func TestRouter_ConcurrentReload(t *testing.T) {
+	r := NewRouter(makeTestConfig())
+	alt := &config.Config{
+		DefaultClusterID: 2,
+		Clusters: map[int]*config.Cluster{
+			2: {ID: 2, Targets: []config.Target{{Addr: "alt.example.com", Port: 443}}},
+		},
+	}
+	valid := map[string]bool{
+		"dc2a.example.com:443": true,
+		"dc2b.example.com:443": true,
+		"alt.example.com:443":  true,
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, route := range []func(int) (Target, error){r.Route, r.RouteRoundRobin} {
+					target, err := route(2)
+					if err != nil {
+						t.Errorf("route: %v", err)
+						return
+					}
+					if !valid[target.Addr] {
+						t.Errorf("unexpected target %q", target.Addr)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			r.Reload(alt)
+		} else {
+			r.Reload(makeTestConfig())
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRouter_RouteSessionCanary(t *testing.T) {
+	cfg := makeTestConfig()
+	cfg.Clusters[2].Canary = &config.Target{Addr: "canary.example.com", Port: 443}
+	cfg.Clusters[2].CanaryPercent = 20
+	r := NewRouter(cfg)
+
+	const sessions = 10000
+	canary := 0
+	for session := int64(1); session <= sessions; session++ {
+		target, err := r.RouteSession(2, session)
+		if err != nil {
+			t.Fatalf("RouteSession error: %v", err)
+		}
+		if target.Canary != (target.Addr == "canary.example.com:443") {
+			t.Fatalf("target %+v: Canary flag does not match the address", target)
+		}
+		if target.Canary {
+			canary++
+		}
+		// Every frame of a session takes the same side.
+		again, _ := r.RouteSession(2, session)
+		if again.Canary != target.Canary {
+			t.Fatalf("session %d flipped between canary and stable", session)
+		}
+	}
+	if canary < sessions*17/100 || canary > sessions*23/100 {
+		t.Errorf("%d of %d sessions on the canary, want about 20%%", canary, sessions)
+	}
+
+	// Clusters without a canary never route to one.
+	for session := int64(1); session <= 100; session++ {
+		if target, _ := r.RouteSession(1, session); target.Canary {
+			t.Fatal("DC 1 has no canary but a session was routed to one")
+		}
+	}
+}
+
+func TestRouter_TargetOptions(t *testing.T) {
+	cfg := makeTestConfig()
+	opts := config.ClusterOptions{Timeout: time.Second, SourceAddr: "10.0.0.5"}
+	cfg.Clusters[2].Options = opts
+	r := NewRouter(cfg)
+	if got := r.TargetOptions("dc2b.example.com:443"); got != opts {
+		t.Errorf("TargetOptions(dc2b) = %+v, want %+v", got, opts)
+	}
+	if got := r.TargetOptions("dc1.example.com:443"); got != (config.ClusterOptions{}) {
+		t.Errorf("TargetOptions(dc1) = %+v, want zero", got)
+	}
+
+	cfg = makeTestConfig()
+	r.Reload(cfg)
+	if got := r.TargetOptions("dc2b.example.com:443"); got != (config.ClusterOptions{}) {
+		t.Errorf("options survived reload: %+v", got)
+	}
+}
+
+func TestRouter_PreferFamily(t *testing.T) {
+	cfg := makeTestConfig()
+	cfg.Clusters[2].Targets = []config.Target{
+		{Addr: "149.154.167.50", Port: 8888},
+		{Addr: "2001:b28:f23d:f001::a", Port: 8888},
+		{Addr: "dc2.example.com", Port: 8888},
+	}
+	cfg.Clusters[3] = &config.Cluster{ID: 3, Targets: []config.Target{{Addr: "2001:b28:f23d:f003::a", Port: 8888}}}
+	r := NewRouter(cfg)
+	const v6 = "[2001:b28:f23d:f001::a]:8888"
+
+	for range 20 {
+		target, _ := r.Route(2)
+		if target.Addr == v6 || target.Fallback != v6 {
+			t.Fatalf("without -6: Addr %s Fallback %s, want an IPv4 target with the IPv6 fallback", target.Addr, target.Fallback)
+		}
+	}
+	// A cluster with IPv6 targets only is still served without -6.
+	if target, _ := r.Route(3); target.Addr != "[2001:b28:f23d:f003::a]:8888" || target.Fallback != "" {
+		t.Errorf("IPv6-only cluster: %+v", target)
+	}
+
+	r.SetPreferIPv6(true)
+	seen := map[string]bool{}
+	for range 50 {
+		target, _ := r.Route(2)
+		if target.Addr != v6 || target.Fallback == "" || target.Fallback == v6 {
+			t.Fatalf("with -6: Addr %s Fallback %s, want the IPv6 target with an IPv4 fallback", target.Addr, target.Fallback)
+		}
+		seen[target.Fallback] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("fallbacks %v, want both IPv4 targets in turn", seen)
+	}
+	if target, _ := r.Route(1); target.Addr != "dc1.example.com:443" || target.Fallback != "" {
+		t.Errorf("cluster without IPv6 targets with -6: %+v", target)
+	}
+}
+
+func TestRouter_BalancePolicies(t *testing.T) {
+	cfg := makeTestConfig()
+	cfg.Clusters[2].Targets = []config.Target{
+		{Addr: "dc2a.example.com", Port: 443},
+		{Addr: "dc2a.example.com", Port: 443}, // weight 2
+		{Addr: "dc2b.example.com", Port: 443},
+		{Addr: "dc2c.example.com", Port: 443},
+	}
+	const a, b, c = "dc2a.example.com:443", "dc2b.example.com:443", "dc2c.example.com:443"
+	route := func(r *Router, n int, authKey func(i int) int64) []string {
+		var out []string
+		for i := range n {
+			target, err := r.RoutePacket(2, int64(i+1), authKey(i))
+			if err != nil {
+				t.Fatalf("RoutePacket: %v", err)
+			}
+			out = append(out, target.Addr)
+		}
+		return out
+	}
+	counts := func(addrs []string) map[string]int {
+		m := make(map[string]int)
+		for _, addr := range addrs {
+			m[addr]++
+		}
+		return m
+	}
+	noKey := func(int) int64 { return 0 }
+
+	r := NewRouter(cfg)
+	if r.Policy() != config.BalanceRandom {
+		t.Errorf("default policy %s, want random", r.Policy())
+	}
+	r.SetBalance(config.BalanceRoundRobin)
+	if got := route(r, 8, noKey); fmt.Sprint(got) != fmt.Sprint([]string{a, a, b, c, a, a, b, c}) {
+		t.Errorf("round-robin: %v", got)
+	}
+
+	// weighted: dc2a has twice the weight, spread evenly over the round.
+	r = NewRouter(cfg)
+	r.SetBalance(config.BalanceWeighted)
+	if got := counts(route(r, 40, noKey)); got[a] != 20 || got[b] != 10 || got[c] != 10 {
+		t.Errorf("weighted: %v, want 20/10/10", got)
+	}
+	if got := route(r, 4, noKey); got[0] == got[1] && got[1] == got[2] {
+		t.Errorf("weighted picks in a run: %v", got)
+	}
+
+	outstanding := map[string]int{a: 3, b: 1, c: 1}
+	r = NewRouter(cfg)
+	r.SetBalance(config.BalanceLeastOutstanding)
+	r.SetOutstanding(func(addr string) int { return outstanding[addr] })
+	if got := counts(route(r, 10, noKey)); got[a] != 0 || got[b] == 0 || got[c] == 0 {
+		t.Errorf("least-outstanding: %v, want b and c only", got)
+	}
+
+	// hash: every auth_key_id sticks to one target, and removing a target
+	// moves only the keys that were on it.
+	r = NewRouter(cfg)
+	r.SetBalance(config.BalanceHash)
+	key := func(i int) int64 { return int64(i)*7919 + 1 }
+	first := route(r, 300, key)
+	if fmt.Sprint(route(r, 300, key)) != fmt.Sprint(first) {
+		t.Error("hash: the same auth_key_ids routed differently")
+	}
+	if got := counts(first); got[a] == 0 || got[b] == 0 || got[c] == 0 {
+		t.Errorf("hash spread: %v", got)
+	}
+	cfg2 := makeTestConfig()
+	cfg2.Clusters[2].Targets = []config.Target{{Addr: "dc2a.example.com", Port: 443}, {Addr: "dc2b.example.com", Port: 443}}
+	r.Reload(cfg2)
+	for i, addr := range route(r, 300, key) {
+		if first[i] != c && addr != first[i] {
+			t.Fatalf("hash: key %d moved from %s to %s though its target stayed", key(i), first[i], addr)
+		}
+	}
+
+	// A v2 cluster policy overrides the proxy-wide one.
+	cfg.Clusters[2].Options.Balance = config.BalanceRoundRobin
+	r = NewRouter(cfg)
+	r.SetBalance(config.BalanceHash)
+	if got := route(r, 4, func(int) int64 { return 42 }); got[0] == got[2] {
+		t.Errorf("cluster round-robin under proxy-wide hash: %v", got)
+	}
+	info := r.Clusters()
+	if info[1].ID != 2 || info[1].Balance != config.BalanceRoundRobin || info[0].Balance != config.BalanceHash {
+		t.Errorf("Clusters balance: %+v", info)
+	}
+	if sel := r.Selected(); sel[a] != 2 || sel[b] != 1 || sel[c] != 1 {
+		t.Errorf("Selected = %v", sel)
+	}
+}
+
+func TestRouter_SessionAffinity(t *testing.T) {
+	cfg := makeTestConfig()
+	r := NewRouter(cfg)
+	r.SetAffinity(NewSessionAffinity(time.Minute, 0, nil))
+
+	// Every packet of a session follows its first one, across connections.
+	pinned := make(map[int64]string)
+	for authKey := int64(1); authKey <= 20; authKey++ {
+		for session := int64(1); session <= 5; session++ {
+			target, err := r.RoutePacket(2, session, authKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr, ok := pinned[authKey]; ok && addr != target.Addr {
+				t.Fatalf("auth_key_id %d moved from %s to %s", authKey, addr, target.Addr)
+			}
+			pinned[authKey] = target.Addr
+		}
+	}
+
+	// A pin to a target that left the config is replaced.
+	var gone int64
+	for authKey, addr := range pinned {
+		if addr == "dc2b.example.com:443" {
+			gone = authKey
+		}
+	}
+	cfg = makeTestConfig()
+	cfg.Clusters[2].Targets = cfg.Clusters[2].Targets[:1]
+	r.Reload(cfg)
+	if target, _ := r.RoutePacket(2, 1, gone); target.Addr != "dc2a.example.com:443" {
+		t.Errorf("session pinned to a removed target routed to %s", target.Addr)
+	}
+
+	// After Unpin the session picks again.
+	r.Unpin(gone)
+	if _, ok := r.affinity.Lookup(gone, time.Now(), func(string) bool { return true }); ok {
+		t.Error("Unpin left the pin")
+	}
+}
@@ -4,8 +4,10 @@
 package proxy
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -14,6 +16,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/skrashevich/MTProxy/internal/crypto"
@@ -33,8 +36,44 @@ const (
 	rpcDHParamsSelect = 0x00620b93
 
 	pingInterval = 5 * time.Second
+
+	// maxRPCFrameSize caps any RPC frame read from a DC.
+	maxRPCFrameSize = 4 * 1024 * 1024
+
+	// DefaultMaxResponseSize is the default cap for frames received from a
+	// DC, kept below maxPacketSize, the cap for client requests.
+	DefaultMaxResponseSize = 2 * 1024 * 1024
+
+	// DefaultFirstByteTimeout is how long a forwarded request waits for the
+	// DC to start answering before it counts as unanswered.
+	DefaultFirstByteTimeout = 30 * time.Second
+
+	// DefaultStallTimeout bounds the gap between reads once a DC frame has
+	// started arriving.
+	DefaultStallTimeout = 5 * time.Second
 )
 
+// ResponseTooLargeError is returned when a DC sends a frame larger than the
+// configured response limit. The backend connection is closed.
+type ResponseTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response frame of %d bytes exceeds limit of %d", e.Size, e.Limit)
+}
+
+// ResponseStallError is returned when a DC stops sending in the middle of a
+// frame for longer than the stall timeout. The backend connection is closed.
+type ResponseStallError struct {
+	Timeout time.Duration
+}
+
+func (e *ResponseStallError) Error() string {
+	return fmt.Sprintf("response stalled mid-frame for %s", e.Timeout)
+}
+
 // rpcDHPrime is the 2048-bit safe prime used for DH key exchange.
 // From net/net-crypto-dh.c: rpc_dh_prime_bin[256].
 var rpcDHPrime = []byte{
@@ -74,9 +113,27 @@ type rpcOutboundConn struct {
 	addr   string
 	secret []byte // AES secret (proxy password)
 
+	// id tags the connection in logs and /debug/outbound; opened is when
+	// the handshake finished and reconnects how many connections to addr
+	// the pool opened before this one. All are fixed before the connection
+	// enters the pool.
+	id         string
+	opened     time.Time
+	reconnects int64
+	counters   outboundConnStats
+
 	conn     net.Conn
 	writeMu  sync.Mutex
-	outSeqno int32 // atomic; starts at -2 per C protocol
+	// outSeqno is the sequence number of the next frame to the DC, guarded
+	// by writeMu; it starts at -2 per C protocol. The proxy numbers these
+	// frames itself and the DC checks them, so unlike inSeqno there is
+	// nothing to validate on this side.
+	outSeqno int32
+
+	// inSeqno is the sequence number the next frame from the DC must carry;
+	// it starts at -2 (RPC_NONCE) like outSeqno. Only the handshake and then
+	// the read loop touch it.
+	inSeqno int32
 
 	// AES-256-CBC encrypt/decrypt state (set after handshake).
 	// RPC client connections use CBC (not CTR). CTR is only for client-facing ext-server.
@@ -84,11 +141,16 @@ type rpcOutboundConn struct {
 	cbcEnc    *crypto.AESCBCEncryptor
 	cbcDec    *crypto.AESCBCDecryptor
 	cbcReader *cbcDecryptReader // wraps conn with transparent CBC decryption
+	stall     *stallReader      // conn reader that applies stallTimeout mid-frame
 
 	// pending response channels keyed by ext_conn_id
 	pendingMu sync.Mutex
 	pending   map[int64]chan<- ProxyResponse
 
+	// pings awaiting RPC_PONG (Ping), keyed by ping_id
+	pingsMu sync.Mutex
+	pings   map[int64]chan struct{}
+
 	// closed signals the read loop to exit
 	closed chan struct{}
 
@@ -97,6 +159,41 @@ type rpcOutboundConn struct {
 
 	// natInfo maps local IPv4 → public IPv4 for NAT traversal in key derivation
 	natInfo map[uint32]uint32
+
+	// device, if set, is the interface or VRF the socket is bound to (--outbound-device)
+	device string
+
+	// resolver, if set, resolves target host names instead of the system resolver (--dns)
+	resolver *net.Resolver
+
+	// dialer, if set, reaches the target through upstream proxies (--outbound-proxy)
+	dialer OutboundDialer
+
+	// sockopts are the TCP options set on the socket after connect
+	sockopts SocketOptions
+
+	// buffers, if set, recycles the buffers of outgoing frames
+	buffers *BufferPool
+
+	// sourceAddr, if set, is the local IP the socket is bound to, and
+	// pingInterval replaces pingInterval (per-cluster options of config v2)
+	sourceAddr   string
+	pingInterval time.Duration
+
+	// maxResponse caps received frames (0 = maxRPCFrameSize); stats counts violations
+	maxResponse int
+	stats       *Stats
+
+	// writeQueue accounts requests waiting for writeMu (optional)
+	writeQueue *QueueStats
+
+	// stallTimeout bounds the gap between reads within a DC frame
+	// (0 = no limit)
+	stallTimeout time.Duration
+
+	// closeErr is the reason the read loop stopped, reported to waiting callers
+	closeErrMu sync.Mutex
+	closeErr   error
 }
 
 // newRPCOutboundConn creates a new unconnected outbound RPC connection.
@@ -107,19 +204,41 @@ func newRPCOutboundConn(addr string, secret []byte, forceDH bool, natInfo map[ui
 		forceDH: forceDH,
 		natInfo: natInfo,
 		pending: make(map[int64]chan<- ProxyResponse),
+		pings:   make(map[int64]chan struct{}),
 		closed:  make(chan struct{}),
 	}
-	// C protocol: out_packet_num starts at -2 (tcp_rpcc_connected, line 455)
+	// C protocol: out_packet_num starts at -2 (tcp_rpcc_connected, line 455),
+	// in_packet_num likewise (tcp_rpcc_init_outbound)
 	c.outSeqno = -2
+	c.inSeqno = -2
 	return c
 }
 
 // Connect dials the target, performs the RPC handshake, and starts the read loop.
 func (c *rpcOutboundConn) Connect() error {
-	conn, err := net.DialTimeout("tcp", c.addr, 10*time.Second)
+	d := net.Dialer{Timeout: 10 * time.Second, Resolver: c.resolver}
+	if c.device != "" {
+		d.Control = bindDeviceControl(c.device)
+	}
+	if c.sourceAddr != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(c.sourceAddr)}
+	}
+	var conn net.Conn
+	var err error
+	if c.dialer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+		conn, err = c.dialer.Dial(ctx, &d, c.addr)
+		cancel()
+	} else {
+		conn, err = d.Dial("tcp", c.addr)
+	}
 	if err != nil {
 		return fmt.Errorf("dial %s: %w", c.addr, err)
 	}
+	if err := c.sockopts.apply(conn); err != nil {
+		conn.Close()
+		return fmt.Errorf("socket options for %s: %w", c.addr, err)
+	}
 	c.conn = conn
 
 	if err := c.handshake(); err != nil {
@@ -271,7 +390,8 @@ func (c *rpcOutboundConn) handshake() error {
 
 	c.cbcEnc = enc
 	c.cbcDec = dec
-	c.cbcReader = &cbcDecryptReader{r: c.conn, dec: dec}
+	c.stall = &stallReader{conn: c.conn, timeout: c.stallTimeout}
+	c.cbcReader = &cbcDecryptReader{r: c.stall, dec: dec}
 
 	// --- send RPC_HANDSHAKE (ENCRYPTED — crypto is now active) ---
 	if err := c.sendHandshake(); err != nil {
@@ -434,70 +554,120 @@ func (c *rpcOutboundConn) writeRawFrame(payload []byte) error {
 //
 // In C this is not an issue because the event loop is single-threaded.
 func (c *rpcOutboundConn) writeEncryptedFrame(payload []byte) error {
+	c.writeQueue.Enter()
+	defer c.writeQueue.Exit()
+	waitStart := time.Now()
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
+	c.writeQueue.ObserveWait(time.Since(waitStart))
 
 	seqno := c.outSeqno
 	c.outSeqno++
-	totalLen := uint32(4 + 4 + len(payload) + 4)
+	totalLen := 4 + 4 + len(payload) + 4
 
-	frame := make([]byte, int(totalLen))
-	binary.LittleEndian.PutUint32(frame[0:4], totalLen)
+	// Pad to 16-byte alignment for CBC (matching C's tcp_rpc_flush).
+	// Padding consists of 4-byte words with value 4 (LE uint32).
+	// The parser recognizes packet_len==4 as a skip-packet.
+	padBytes := (16 - totalLen%16) % 16
+	frame := c.buffers.Get(totalLen + padBytes)
+	defer c.buffers.Put(frame)
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(totalLen))
 	binary.LittleEndian.PutUint32(frame[4:8], uint32(seqno))
 	copy(frame[8:8+len(payload)], payload)
 
 	crc := crc32.ChecksumIEEE(frame[:8+len(payload)])
 	binary.LittleEndian.PutUint32(frame[8+len(payload):], crc)
+	for i := totalLen; i < len(frame); i += 4 {
+		binary.LittleEndian.PutUint32(frame[i:], 4)
+	}
 
-	// Pad to 16-byte alignment for CBC (matching C's tcp_rpc_flush).
-	// Padding consists of 4-byte words with value 4 (LE uint32).
-	// The parser recognizes packet_len==4 as a skip-packet.
-	padBytes := (16 - (len(frame) % 16)) % 16
-	for i := 0; i < padBytes; i += 4 {
-		frame = append(frame, 4, 0, 0, 0)
+	// Encrypt with AES-256-CBC in place
+	c.cbcEnc.Encrypt(frame, frame)
+
+	if _, err := c.conn.Write(frame); err != nil {
+		c.counters.errors.Add(1)
+		return err
 	}
+	c.counters.framesOut.Add(1)
+	c.counters.bytesOut.Add(int64(len(payload)))
+	return nil
+}
 
-	// Encrypt with AES-256-CBC
-	encrypted := make([]byte, len(frame))
-	c.cbcEnc.Encrypt(encrypted, frame)
+// SeqnoError is returned when a DC frame carries an unexpected sequence
+// number: a frame was lost, repeated or injected, so the stream can no
+// longer be trusted. Matches the packet_num check in tcp_rpcc_parse_execute.
+type SeqnoError struct {
+	Got, Want int32
+}
 
-	_, err := c.conn.Write(encrypted)
-	return err
+func (e *SeqnoError) Error() string {
+	return fmt.Sprintf("got packet num %d, expected %d", e.Got, e.Want)
+}
+
+// checkInSeqno verifies the sequence number of a received frame and
+// advances the expected one.
+func (c *rpcOutboundConn) checkInSeqno(seqno int32) error {
+	if seqno != c.inSeqno {
+		return &SeqnoError{Got: seqno, Want: c.inSeqno}
+	}
+	c.inSeqno++
+	return nil
 }
 
 // readRawFrame reads one RPC frame from the connection (unencrypted, used during handshake).
 // Returns (payloadLen, payloadBytes, error).
 func (c *rpcOutboundConn) readRawFrame() (int, []byte, error) {
-	return readRawFrame(c.conn)
+	seqno, payload, err := readRawFrameSeq(c.conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := c.checkInSeqno(seqno); err != nil {
+		return 0, nil, err
+	}
+	return len(payload), payload, nil
 }
 
 // readEncryptedFrame reads and decrypts one CBC-encrypted RPC frame.
 // Skips padding packets (packet_len == 4) automatically.
 func (c *rpcOutboundConn) readEncryptedFrame() (int, []byte, error) {
-	return readCBCFrame(c.cbcReader)
+	seqno, payload, err := readCBCFrameSeq(c.cbcReader, c.maxResponse)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := c.checkInSeqno(seqno); err != nil {
+		return 0, nil, err
+	}
+	return len(payload), payload, nil
 }
 
 // readRawFrame reads one unencrypted RPC frame.
 // Frame layout: [4B total_len LE][4B seqno LE][payload][4B CRC32]
 func readRawFrame(r io.Reader) (int, []byte, error) {
+	_, payload, err := readRawFrameSeq(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(payload), payload, nil
+}
+
+// readRawFrameSeq is readRawFrame that returns the frame's sequence number
+// instead of the payload length.
+func readRawFrameSeq(r io.Reader) (int32, []byte, error) {
 	var lenBuf [4]byte
 	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
 		return 0, nil, err
 	}
 
 	totalLen := binary.LittleEndian.Uint32(lenBuf[:])
-	if totalLen < 16 || totalLen > 4*1024*1024 {
+	if totalLen < 16 || totalLen > maxRPCFrameSize {
 		return 0, nil, fmt.Errorf("invalid frame length: %d", totalLen)
 	}
 
-	rest := make([]byte, totalLen-4)
-	if _, err := io.ReadFull(r, rest); err != nil {
-		return 0, nil, err
-	}
-
 	fullFrame := make([]byte, totalLen)
 	copy(fullFrame[0:4], lenBuf[:])
-	copy(fullFrame[4:], rest)
+	if _, err := io.ReadFull(r, fullFrame[4:]); err != nil {
+		return 0, nil, err
+	}
 
 	payloadEnd := int(totalLen) - 4
 	expectedCRC := crc32.ChecksumIEEE(fullFrame[:payloadEnd])
@@ -506,13 +676,28 @@ func readRawFrame(r io.Reader) (int, []byte, error) {
 		return 0, nil, fmt.Errorf("CRC32 mismatch: expected 0x%08x got 0x%08x", expectedCRC, gotCRC)
 	}
 
-	payload := fullFrame[8:payloadEnd]
+	seqno := int32(binary.LittleEndian.Uint32(fullFrame[4:8]))
+	return seqno, fullFrame[8:payloadEnd], nil
+}
+
+// readCBCFrameLimit reads one frame from a CBC-decrypted stream, skipping
+// padding packets (packet_len == 4) automatically, and rejects frames
+// longer than limit bytes with a *ResponseTooLargeError before reading
+// their body. limit <= 0 means maxRPCFrameSize.
+func readCBCFrameLimit(r io.Reader, limit int) (int, []byte, error) {
+	_, payload, err := readCBCFrameSeq(r, limit)
+	if err != nil {
+		return 0, nil, err
+	}
 	return len(payload), payload, nil
 }
 
-// readCBCFrame reads one frame from a CBC-decrypted stream,
-// skipping padding packets (packet_len == 4) automatically.
-func readCBCFrame(r io.Reader) (int, []byte, error) {
+// readCBCFrameSeq is readCBCFrameLimit that returns the frame's sequence
+// number instead of the payload length.
+func readCBCFrameSeq(r io.Reader, limit int) (int32, []byte, error) {
+	if limit <= 0 || limit > maxRPCFrameSize {
+		limit = maxRPCFrameSize
+	}
 	for {
 		var lenBuf [4]byte
 		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
@@ -526,18 +711,18 @@ func readCBCFrame(r io.Reader) (int, []byte, error) {
 			continue
 		}
 
-		if totalLen < 16 || totalLen > 4*1024*1024 {
+		if totalLen < 16 {
 			return 0, nil, fmt.Errorf("invalid frame length: %d", totalLen)
 		}
-
-		rest := make([]byte, totalLen-4)
-		if _, err := io.ReadFull(r, rest); err != nil {
-			return 0, nil, err
+		if int64(totalLen) > int64(limit) {
+			return 0, nil, &ResponseTooLargeError{Size: int(totalLen), Limit: limit}
 		}
 
 		fullFrame := make([]byte, totalLen)
 		copy(fullFrame[0:4], lenBuf[:])
-		copy(fullFrame[4:], rest)
+		if _, err := io.ReadFull(r, fullFrame[4:]); err != nil {
+			return 0, nil, err
+		}
 
 		payloadEnd := int(totalLen) - 4
 		expectedCRC := crc32.ChecksumIEEE(fullFrame[:payloadEnd])
@@ -546,8 +731,8 @@ func readCBCFrame(r io.Reader) (int, []byte, error) {
 			return 0, nil, fmt.Errorf("CRC32 mismatch: expected 0x%08x got 0x%08x", expectedCRC, gotCRC)
 		}
 
-		payload := fullFrame[8:payloadEnd]
-		return len(payload), payload, nil
+		seqno := int32(binary.LittleEndian.Uint32(fullFrame[4:8]))
+		return seqno, fullFrame[8:payloadEnd], nil
 	}
 }
 
@@ -560,6 +745,11 @@ type cbcDecryptReader struct {
 	dec    *crypto.AESCBCDecryptor
 	rawBuf []byte // encrypted bytes not yet forming a full 16-byte block
 	decBuf []byte // decrypted bytes ready to consume
+
+	// readBuf and plain are reused by every Read: plain is only overwritten
+	// once decBuf, which points into it, has been consumed
+	readBuf []byte
+	plain   []byte
 }
 
 func (cr *cbcDecryptReader) Read(p []byte) (int, error) {
@@ -571,18 +761,23 @@ func (cr *cbcDecryptReader) Read(p []byte) (int, error) {
 	}
 
 	// Keep reading until we have at least one full block to decrypt
+	if cr.readBuf == nil {
+		cr.readBuf = make([]byte, 4096)
+	}
 	for {
-		buf := make([]byte, 4096)
-		n, err := cr.r.Read(buf)
+		n, err := cr.r.Read(cr.readBuf)
 		if n > 0 {
-			cr.rawBuf = append(cr.rawBuf, buf[:n]...)
+			cr.rawBuf = append(cr.rawBuf, cr.readBuf[:n]...)
 		}
 
 		blocks := (len(cr.rawBuf) / 16) * 16
 		if blocks > 0 {
-			decrypted := make([]byte, blocks)
+			if cap(cr.plain) < blocks {
+				cr.plain = make([]byte, blocks)
+			}
+			decrypted := cr.plain[:blocks]
 			cr.dec.Decrypt(decrypted, cr.rawBuf[:blocks])
-			cr.rawBuf = cr.rawBuf[blocks:]
+			cr.rawBuf = append(cr.rawBuf[:0], cr.rawBuf[blocks:]...)
 
 			nn := copy(p, decrypted)
 			if nn < len(decrypted) {
@@ -597,6 +792,58 @@ func (cr *cbcDecryptReader) Read(p []byte) (int, error) {
 	}
 }
 
+// pendingFrame reports whether part of a frame is buffered: undecrypted
+// bytes, or decrypted bytes other than padding words.
+func (cr *cbcDecryptReader) pendingFrame() bool {
+	if len(cr.rawBuf) > 0 {
+		return true
+	}
+	for i := 0; i+4 <= len(cr.decBuf); i += 4 {
+		if binary.LittleEndian.Uint32(cr.decBuf[i:]) != 4 {
+			return true
+		}
+	}
+	return len(cr.decBuf)%4 != 0
+}
+
+// stallReader reads from a DC connection. Once bytes of a frame have
+// arrived, every further read must complete within timeout; idle clears
+// the deadline between frames. Only the read loop calls Read and idle.
+type stallReader struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	active      atomic.Bool // a frame is partly received
+	deadlineSet bool
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	if sr.timeout > 0 && sr.active.Load() {
+		sr.conn.SetReadDeadline(time.Now().Add(sr.timeout))
+		sr.deadlineSet = true
+	}
+	n, err := sr.conn.Read(p)
+	if n > 0 {
+		sr.active.Store(true)
+	}
+	return n, err
+}
+
+// idle marks the stream as between frames.
+func (sr *stallReader) idle() {
+	sr.active.Store(false)
+	if sr.deadlineSet {
+		sr.conn.SetReadDeadline(time.Time{})
+		sr.deadlineSet = false
+	}
+}
+
+// receiving reports whether a frame is partly received. Safe for
+// concurrent use.
+func (sr *stallReader) receiving() bool {
+	return sr != nil && sr.active.Load()
+}
+
 // SendProxyRequest builds and sends a RPC_PROXY_REQ frame to the Telegram DC.
 //
 // This is a port of the forwarding logic from mtproto/mtproto-proxy.c
@@ -690,11 +937,19 @@ func (c *rpcOutboundConn) UnregisterPending(connID int64) {
 	c.pendingMu.Unlock()
 }
 
+// Outstanding returns the number of requests waiting for a response.
+func (c *rpcOutboundConn) Outstanding() int {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	return len(c.pending)
+}
+
 // readLoop is the goroutine that continuously reads encrypted RPC frames from the server
 // and dispatches responses to waiting goroutines via the pending map.
 //
 // Handles: RPC_PROXY_ANS, RPC_SIMPLE_ACK, RPC_CLOSE_EXT, RPC_PONG (keepalive).
 func (c *rpcOutboundConn) readLoop() {
+	defer processCrash.Load().Recover()
 	for {
 		select {
 		case <-c.closed:
@@ -702,18 +957,44 @@ func (c *rpcOutboundConn) readLoop() {
 		default:
 		}
 
+		// Between frames the DC may stay silent indefinitely; only a frame
+		// that has started arriving is subject to the stall timeout.
+		if !c.cbcReader.pendingFrame() {
+			c.stall.idle()
+		}
+
 		_, payload, err := c.readEncryptedFrame()
 		if err != nil {
+			var tooLarge *ResponseTooLargeError
+			if errors.As(err, &tooLarge) {
+				log.Printf("outbound: %s %s: %v, closing connection", c.id, c.addr, err)
+				if c.stats != nil {
+					c.stats.IncOversizeResponse()
+				}
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && c.stall.receiving() {
+				err = &ResponseStallError{Timeout: c.stallTimeout}
+				log.Printf("outbound: %s %s: %v, closing connection", c.id, c.addr, err)
+				if c.stats != nil {
+					c.stats.IncResponseStall()
+				}
+			}
+			c.closeErrMu.Lock()
+			c.closeErr = err
+			c.closeErrMu.Unlock()
 			select {
 			case <-c.closed:
 			default:
 				// connection error — signal closure
+				c.counters.errors.Add(1)
 				close(c.closed)
 				c.conn.Close()
 			}
 			return
 		}
 
+		c.counters.framesIn.Add(1)
+		c.counters.bytesIn.Add(int64(len(payload)))
 		if len(payload) < 4 {
 			continue
 		}
@@ -723,6 +1004,13 @@ func (c *rpcOutboundConn) readLoop() {
 	}
 }
 
+// readError returns the error that stopped the read loop, if any.
+func (c *rpcOutboundConn) readError() error {
+	c.closeErrMu.Lock()
+	defer c.closeErrMu.Unlock()
+	return c.closeErr
+}
+
 // handleFrame dispatches a received frame by opcode.
 // Corresponds to the execute() dispatch in mtproto-proxy.c.
 func (c *rpcOutboundConn) handleFrame(opcode int32, payload []byte) {
@@ -733,8 +1021,26 @@ func (c *rpcOutboundConn) handleFrame(opcode int32, payload []byte) {
 		c.handleSimpleAck(payload)
 	case protocol.RPCCloseExt:
 		c.handleCloseExt(payload)
+	case protocol.RPCPing:
+		c.handlePing(payload)
 	case protocol.RPCPong:
-		// keepalive response — no action needed
+		c.handlePong(payload)
+	}
+}
+
+// handlePing answers RPC_PING from the middle proxy with RPC_PONG carrying
+// the same ping_id, as tcp_rpc_default_execute does in C; middle proxies
+// drop links that stop answering.
+// Layout: [type(4)][ping_id(8)]
+func (c *rpcOutboundConn) handlePing(payload []byte) {
+	if len(payload) != 12 {
+		return
+	}
+	pong := make([]byte, 12)
+	binary.LittleEndian.PutUint32(pong[0:4], uint32(protocol.RPCPong))
+	copy(pong[4:12], payload[4:12])
+	if err := c.writeEncryptedFrame(pong); err != nil {
+		log.Printf("rpc_outbound: pong to %s: %v", c.addr, err)
 	}
 }
 
@@ -810,21 +1116,17 @@ func (c *rpcOutboundConn) handleCloseExt(payload []byte) {
 	}
 }
 
-// pingLoop sends RPC_PING frames every pingInterval to keep the connection alive.
-// Corresponds to StartPingLoop / tcp_rpc_send_ping in C.
+// pingLoop sends RPC_PING frames every pingInterval (or the cluster's
+// ping_interval) to keep the connection alive.
+// Corresponds to StartPingLoop / tcp_rpc_send_ping in C. A failed ping is not
+// retried on its own: the read loop sees the broken connection and closes it.
 func (c *rpcOutboundConn) pingLoop() {
-	ticker := time.NewTicker(pingInterval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-c.closed:
-			return
-		case <-ticker.C:
-			if err := c.sendPing(); err != nil {
-				return
-			}
-		}
+	defer processCrash.Load().Recover()
+	interval := c.pingInterval
+	if interval <= 0 {
+		interval = pingInterval
 	}
+	runEvery(interval, c.closed, func() { c.sendPing() })
 }
 
 // sendPing sends a RPC_PING frame.
@@ -834,12 +1136,69 @@ func (c *rpcOutboundConn) sendPing() error {
 	if _, err := rand.Read(pingID[:]); err != nil {
 		return err
 	}
+	return c.writePing(int64(binary.LittleEndian.Uint64(pingID[:])))
+}
+
+func (c *rpcOutboundConn) writePing(id int64) error {
 	pkt := make([]byte, 12)
 	binary.LittleEndian.PutUint32(pkt[0:4], uint32(protocol.RPCPing))
-	copy(pkt[4:12], pingID[:])
+	binary.LittleEndian.PutUint64(pkt[4:12], uint64(id))
 	return c.writeEncryptedFrame(pkt)
 }
 
+// Ping sends RPC_PING and waits up to timeout for the middle proxy's
+// RPC_PONG, returning the round trip. Keepalive pings of pingLoop are not
+// waited for; their pongs are dropped.
+func (c *rpcOutboundConn) Ping(timeout time.Duration) (time.Duration, error) {
+	var idBuf [8]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return 0, err
+	}
+	id := int64(binary.LittleEndian.Uint64(idBuf[:]))
+	pong := make(chan struct{})
+	c.pingsMu.Lock()
+	c.pings[id] = pong
+	c.pingsMu.Unlock()
+	defer func() {
+		c.pingsMu.Lock()
+		delete(c.pings, id)
+		c.pingsMu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := c.writePing(id); err != nil {
+		return 0, fmt.Errorf("ping %s: %w", c.addr, err)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-c.closed:
+		if err := c.readError(); err != nil {
+			return 0, fmt.Errorf("ping %s: %w", c.addr, err)
+		}
+		return 0, fmt.Errorf("ping %s: %w", c.addr, net.ErrClosed)
+	case <-timer.C:
+		return 0, fmt.Errorf("ping %s: %w", c.addr, ErrNoResponse)
+	}
+}
+
+// handlePong wakes the Ping waiting for ping_id.
+// Layout: [type(4)][ping_id(8)]
+func (c *rpcOutboundConn) handlePong(payload []byte) {
+	if len(payload) < 12 {
+		return
+	}
+	id := int64(binary.LittleEndian.Uint64(payload[4:12]))
+	c.pingsMu.Lock()
+	if ch, ok := c.pings[id]; ok {
+		close(ch)
+		delete(c.pings, id)
+	}
+	c.pingsMu.Unlock()
+}
+
 // natTranslateIP applies NAT translation to an IPv4 address.
 // Matches C: nat_translate_ip() in net/net-connections.c.
 func (c *rpcOutboundConn) natTranslateIP(ip uint32) uint32 {
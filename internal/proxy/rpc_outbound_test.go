@@ -1,9 +1,14 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"hash/crc32"
 	"net"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -101,6 +106,74 @@ func TestRPCFrameRoundtrip(t *testing.T) {
 	}
 }
 
+// TestReadRawFrame_Seqno verifies that frames from the DC must carry
+// consecutive sequence numbers starting at -2.
+func TestReadRawFrame_Seqno(t *testing.T) {
+	frame := func(seqno int32) []byte {
+		buf := make([]byte, 16)
+		binary.LittleEndian.PutUint32(buf[0:4], 16)
+		binary.LittleEndian.PutUint32(buf[4:8], uint32(seqno))
+		binary.LittleEndian.PutUint32(buf[8:12], 0xdeadbeef)
+		binary.LittleEndian.PutUint32(buf[12:16], crc32.ChecksumIEEE(buf[:12]))
+		return buf
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	c := newRPCOutboundConn("pipe", nil, false, nil)
+	c.conn = clientConn
+
+	go func() {
+		var stream []byte
+		for _, seq := range []int32{-2, -1, 0, 2} {
+			stream = append(stream, frame(seq)...)
+		}
+		serverConn.Write(stream)
+	}()
+
+	for _, want := range []int32{-2, -1, 0} {
+		if _, _, err := c.readRawFrame(); err != nil {
+			t.Fatalf("frame %d: %v", want, err)
+		}
+	}
+	_, _, err := c.readRawFrame()
+	var seqErr *SeqnoError
+	if !errors.As(err, &seqErr) {
+		t.Fatalf("skipped seqno: err = %v, want SeqnoError", err)
+	}
+	if seqErr.Got != 2 || seqErr.Want != 1 {
+		t.Errorf("got %d want %d, expected 2/1", seqErr.Got, seqErr.Want)
+	}
+}
+
+// TestWriteRawFrame_Seqno verifies that frames to the DC carry consecutive
+// sequence numbers starting at -2, which the DC checks like
+// TestReadRawFrame_Seqno checks ours.
+func TestWriteRawFrame_Seqno(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	c := newRPCOutboundConn("pipe", nil, false, nil)
+	c.conn = clientConn
+
+	go func() {
+		for range 3 {
+			c.writeRawFrame([]byte{1, 2, 3, 4})
+		}
+	}()
+
+	for _, want := range []int32{-2, -1, 0} {
+		frame := make([]byte, 16)
+		if _, err := readFull(serverConn, frame); err != nil {
+			t.Fatal(err)
+		}
+		if got := int32(binary.LittleEndian.Uint32(frame[4:8])); got != want {
+			t.Errorf("seqno %d, want %d", got, want)
+		}
+	}
+}
+
 // TestHandleFrameDispatch verifies that handleFrame routes opcodes correctly.
 func TestHandleFrameDispatch(t *testing.T) {
 	c := newRPCOutboundConn("test", nil, false, nil)
@@ -298,3 +371,256 @@ func readFull(conn net.Conn, buf []byte) (int, error) {
 	}
 	return total, nil
 }
+
+// TestReadCBCFrameLimit verifies that frames above the response limit are
+// rejected with a typed error before their body is read.
+func TestReadCBCFrameLimit(t *testing.T) {
+	frame := func(payloadLen int) []byte {
+		total := 12 + payloadLen
+		buf := make([]byte, total)
+		binary.LittleEndian.PutUint32(buf[0:4], uint32(total))
+		binary.LittleEndian.PutUint32(buf[4:8], 0)
+		binary.LittleEndian.PutUint32(buf[total-4:], crc32.ChecksumIEEE(buf[:total-4]))
+		return buf
+	}
+
+	small := frame(64)
+	_, payload, err := readCBCFrameLimit(bytes.NewReader(small), 128)
+	if err != nil {
+		t.Fatalf("small frame: %v", err)
+	}
+	if len(payload) != 64 {
+		t.Errorf("payload len = %d, want 64", len(payload))
+	}
+
+	// Only the header is supplied: the limit must trip before the body is read.
+	header := frame(1024)[:4]
+	_, _, err = readCBCFrameLimit(bytes.NewReader(header), 128)
+	var tooLarge *ResponseTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected ResponseTooLargeError, got %v", err)
+	}
+	if tooLarge.Size != 1036 || tooLarge.Limit != 128 {
+		t.Errorf("got size=%d limit=%d, want 1036/128", tooLarge.Size, tooLarge.Limit)
+	}
+}
+
+// TestStallReader verifies that the stall timeout applies only once a frame
+// has started arriving.
+func TestStallReader(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	sr := &stallReader{conn: clientConn, timeout: 50 * time.Millisecond}
+
+	// Idle: no deadline, the read waits for the DC however long it takes.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		serverConn.Write([]byte{1, 2, 3, 4})
+	}()
+	buf := make([]byte, 4)
+	if _, err := sr.Read(buf); err != nil {
+		t.Fatalf("idle read: %v", err)
+	}
+	if !sr.receiving() {
+		t.Fatal("expected receiving after first bytes")
+	}
+
+	// Mid-frame: the DC goes silent and the read must time out.
+	if _, err := sr.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("mid-frame read: expected deadline error, got %v", err)
+	}
+
+	sr.idle()
+	if sr.receiving() {
+		t.Error("expected not receiving after idle")
+	}
+	go serverConn.Write([]byte{5})
+	if _, err := sr.Read(buf); err != nil {
+		t.Fatalf("read after idle: %v", err)
+	}
+}
+
+func TestCBCDecryptReader_PendingFrame(t *testing.T) {
+	padding := []byte{4, 0, 0, 0, 4, 0, 0, 0}
+	tests := []struct {
+		name   string
+		raw    []byte
+		dec    []byte
+		expect bool
+	}{
+		{"empty", nil, nil, false},
+		{"padding only", nil, padding, false},
+		{"frame header", nil, []byte{32, 0, 0, 0}, true},
+		{"undecrypted bytes", []byte{1}, nil, true},
+	}
+	for _, tt := range tests {
+		cr := &cbcDecryptReader{rawBuf: tt.raw, decBuf: tt.dec}
+		if got := cr.pendingFrame(); got != tt.expect {
+			t.Errorf("%s: pendingFrame() = %v, want %v", tt.name, got, tt.expect)
+		}
+	}
+}
+
+// fakeMiddleProxy plays the middle-proxy side of the RPC protocol on one
+// connection accepted from ln. It returns the link ready for encrypted
+// frames.
+func fakeMiddleProxy(ln net.Listener, secret []byte) (*rpcOutboundConn, error) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return acceptRPC(conn, secret)
+}
+
+// TestOutbound_MiddleProxyLoopback runs the outbound against a fake middle
+// proxy over TCP: handshake, an RPC_PROXY_REQ answered with RPC_PROXY_ANS,
+// and an RPC_PING from the middle proxy answered with RPC_PONG.
+func TestOutbound_MiddleProxyLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	pingID := []byte("pingpong")
+	ponged := make(chan struct{})
+	go func() {
+		mp, err := fakeMiddleProxy(ln, secret)
+		if err != nil {
+			t.Errorf("middle proxy: %v", err)
+			return
+		}
+		defer mp.Close()
+		mp.writeEncryptedFrame(append(binary.LittleEndian.AppendUint32(nil, protocol.RPCPing), pingID...))
+		for {
+			_, frame, err := mp.readEncryptedFrame()
+			if err != nil {
+				return
+			}
+			switch binary.LittleEndian.Uint32(frame[0:4]) {
+			case protocol.RPCPong:
+				if !bytes.Equal(frame[4:], pingID) {
+					t.Errorf("pong carries % x, want the ping id", frame[4:])
+				}
+				close(ponged)
+			case protocol.RPCProxyReq:
+				ans := binary.LittleEndian.AppendUint32(nil, protocol.RPCProxyAns)
+				ans = binary.LittleEndian.AppendUint32(ans, 0)
+				ans = append(ans, frame[8:16]...) // ext_conn_id
+				ans = append(ans, "answered"...)
+				mp.writeEncryptedFrame(ans)
+			}
+		}
+	}()
+
+	p := NewOutboundProxy(OutboundConfig{Secret: secret})
+	var zero [16]byte
+	req := protocol.BuildProxyReq(protocol.FlagExtNode, 42, zero, 1234, zero, 443, nil, make([]byte, 32))
+	resp, err := p.ForwardPacket(ln.Addr().String(), req)
+	if err != nil {
+		t.Fatalf("ForwardPacket: %v", err)
+	}
+	if string(resp) != "answered" {
+		t.Errorf("response %q, want %q", resp, "answered")
+	}
+	select {
+	case <-ponged:
+	case <-time.After(2 * time.Second):
+		t.Error("RPC_PING from the middle proxy was not answered")
+	}
+	conns := p.Conns()
+	if len(conns) != 1 {
+		t.Fatalf("Conns() = %+v, want one connection", conns)
+	}
+	if c := conns[0]; c.ID != "out-1" || c.Addr != ln.Addr().String() || c.Reconnects != 0 ||
+		c.FramesIn < 2 || c.FramesOut < 2 || c.BytesIn == 0 || c.Errors != 0 {
+		t.Errorf("Conns()[0] = %+v", c)
+	}
+	p.Close()
+}
+
+// TestOutbound_FamilyFallback checks that a request whose target accepts
+// but never answers the handshake is carried by the fallback target once
+// fallbackDelay has passed.
+func TestOutbound_FamilyFallback(t *testing.T) {
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	var held []net.Conn
+	var heldMu sync.Mutex
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			heldMu.Lock()
+			held = append(held, c)
+			heldMu.Unlock()
+		}
+	}()
+	defer func() {
+		heldMu.Lock()
+		for _, c := range held {
+			c.Close()
+		}
+		heldMu.Unlock()
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	go func() {
+		mp, err := fakeMiddleProxy(ln, secret)
+		if err != nil {
+			t.Errorf("middle proxy: %v", err)
+			return
+		}
+		defer mp.Close()
+		for {
+			_, frame, err := mp.readEncryptedFrame()
+			if err != nil {
+				return
+			}
+			if binary.LittleEndian.Uint32(frame[0:4]) == protocol.RPCProxyReq {
+				ans := binary.LittleEndian.AppendUint32(nil, protocol.RPCProxyAns)
+				ans = binary.LittleEndian.AppendUint32(ans, 0)
+				ans = append(ans, frame[8:16]...)
+				mp.writeEncryptedFrame(append(ans, "fallback"...))
+			}
+		}
+	}()
+
+	stats := NewStats()
+	p := NewOutboundProxy(OutboundConfig{Secret: secret})
+	p.SetStats(stats)
+	var zero [16]byte
+	req := protocol.BuildProxyReq(protocol.FlagExtNode, 7, zero, 1234, zero, 443, nil, make([]byte, 32))
+	start := time.Now()
+	resp, err := p.ForwardTargetTraced(Target{Addr: silent.Addr().String(), Fallback: ln.Addr().String()}, req, nil)
+	if err != nil {
+		t.Fatalf("ForwardTargetTraced: %v", err)
+	}
+	if string(resp) != "fallback" {
+		t.Errorf("response %q, want %q", resp, "fallback")
+	}
+	if d := time.Since(start); d < fallbackDelay {
+		t.Errorf("fallback used after %s, before fallbackDelay", d)
+	}
+	snap := stats.Snapshot(0)
+	if snap["outbound_family_fallbacks"] != 1 || snap["outbound_ipv4_connects"] != 1 {
+		t.Errorf("outbound_family_fallbacks=%d outbound_ipv4_connects=%d, want 1 and 1",
+			snap["outbound_family_fallbacks"], snap["outbound_ipv4_connects"])
+	}
+	p.Close()
+}
@@ -2,28 +2,241 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/skrashevich/MTProxy/internal/config"
 )
 
+// proxyVersion — версия, отдаваемая в /stats и в отчётах о падении.
+const proxyVersion = "mtproxy-go-0.1"
+
 // RuntimeOptions содержит параметры запуска из CLI/конфига.
 type RuntimeOptions struct {
 	// Адрес для прослушивания клиентских соединений
 	ListenAddr string
 
+	// Дополнительные клиентские порты (остальные -H); каждый можно вывести
+	// из работы отдельно через POST /admin/drain
+	ExtraListenAddrs []string
+
+	// Экспериментальные UDP-порты для клиентов (--udp-ports), для сетей,
+	// где долгие TCP-соединения режутся
+	UDPListenAddrs []string
+
+	// Предпочитать IPv6-target'ы кластеров (-6); IPv4 остаются запасными
+	PreferIPv6 bool
+
+	// Воркер супервизора (-M > 1): клиентские порты открываются с
+	// SO_REUSEPORT, /stats отдаётся супервизору на unix-сокете WorkerStatsSocket
+	ReusePort         bool
+	WorkerStatsSocket string
+
+	// Клиентские listener'ы, открытые супервизором и унаследованные
+	// воркером (--inherit-listeners), по адресу; вместо bind
+	InheritedListeners map[string]net.Listener
+
 	// Адрес HTTP /stats эндпоинта (пустой = отключён)
 	HTTPStatsAddr string
 
+	// Unix-сокет для того же API (путь или @имя — абстрактный, Linux) и UID,
+	// которым кроме собственного разрешено им пользоваться
+	AdminSocket string
+	AdminUIDs   []uint32
+
+	// Сети клиентов, чьи HTTP GET /stats на клиентском порту обслуживаются
+	// (пусто = выключено)
+	IngressStats []netip.Prefix
+
+	// Клиенты, у чьих соединений в лог пишется каждый кадр (--trace-conn)
+	TraceConn []netip.Prefix
+
 	// Путь к файлу конфигурации DC
 	ConfigFile string
 
+	// Обработка повторяющихся proxy_for внутри кластера: "dedup" (по умолчанию) или "weight"
+	DuplicateTargets string
+
+	// Политика выбора target'а в кластере: "random" (по умолчанию, как в C),
+	// "round-robin", "least-outstanding", "weighted" или "hash"
+	Balance string
+
+	// Закрепление сессий (auth_key_id) за target'ами: сколько живёт
+	// закрепление после последнего пакета (0 = выключено) и сколько их
+	// хранится (0 = DefaultAffinityMaxEntries)
+	SessionAffinity    time.Duration
+	SessionAffinityMax int
+
+	// Минимум target'ов в default-кластере, при котором reload применяется (0 = без проверки)
+	MinDefaultTargets int
+
 	// Максимум соединений на один секрет (0 = без ограничений)
 	MaxConnectionsPerSecret int
+
+	// Перегрузка: MaxSessions установленных сессий или куча больше MemoryBudget
+	// байт (0 = без лимита); OverloadPolicy — accept, close или handshake
+	MaxSessions    int
+	MemoryBudget   uint64
+	OverloadPolicy string
+
+	// Лимит горутин-обработчиков соединений на один GOMAXPROCS; сверх него
+	// соединения закрываются сразу при accept (0 = без лимита)
+	MaxHandlersPerCPU int
+
+	// Число accept-горутин на клиентский listener (0 или 1 = одна)
+	AcceptLoops int
+
+	// Бюджет пула буферов кадров в байтах (--msg-buffers-size,
+	// 0 = DefaultMsgBuffersSize)
+	MsgBuffersSize int64
+
+	// TCP-опции клиентских соединений (-W, --tcp-*); без -W и fake-TLS
+	// доменов окно ограничивается DefaultWindowClamp, как в C-версии
+	Sockets SocketOptions
+
+	// Сэмплирование задержек: один из LatencySampleRate кадров (0 = выключено)
+	LatencySampleRate int
+
+	// Размер резервуара сэмплов задержек (0 = DefaultLatencyReservoir)
+	LatencyReservoir int
+
+	// Обработчики net/http/pprof на stats-листенере (--enable-pprof)
+	EnablePprof bool
+
+	// Активная проверка target'ов: интервал (0 = выключена), таймаут одной
+	// проверки и сколько успешных и неудачных проверок подряд меняют
+	// состояние target'а (0 = по умолчанию)
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	HealthCheckRise     int
+	HealthCheckFall     int
+
+	// Наибольший backoff circuit breaker'а после неудачных подключений к
+	// target'у (0 = выключен, подключение пробуется при каждом запросе)
+	DialBackoffMax time.Duration
+
+	// Периодическая загрузка proxy-multi.conf: URL, интервал (0 = выключена)
+	// и случайная добавка к интервалу
+	ConfigURL           string
+	ConfigFetchInterval time.Duration
+	ConfigFetchJitter   time.Duration
+
+	// Перечитывает список секретов (--mtproto-secret-file, --mtproto-secret-dir)
+	// по SIGHUP и POST /admin/secrets/reload; nil = секреты статичны
+	SecretReload func() ([][]byte, error)
+	// Опрашивать SecretReload каждые 2 секунды (--mtproto-secret-dir)
+	WatchSecretDir bool
+	// Через сколько закрывать соединения удалённого секрета (0 = не закрывать)
+	SecretRevokeGrace time.Duration
+
+	// Файлы, при изменении которых конфигурация и секреты перечитываются
+	// как по SIGHUP (--watch-config), и сколько изменения должны
+	// отстояться перед перезагрузкой; пусто = не следить
+	WatchFiles          []string
+	WatchConfigDebounce time.Duration
+
+	// Сколько при остановке ждать завершения клиентских сессий, прежде чем
+	// закрыть оставшиеся (0 = закрыть сразу)
+	ShutdownGrace time.Duration
+
+	// Проверка при остановке, что listener'ы, соединения к DC, сессии и
+	// горутины освобождены; утечки пишутся в лог со стеками (--exit-audit)
+	ExitAudit bool
+
+	// Действующие значения опций для /debug/config; nil = эндпоинт выключен
+	EffectiveConfig []ConfigSetting
+
+	// Проверка окна действия секрета (nil = секреты бессрочны)
+	SecretAllowed func(secret []byte, now time.Time) bool
+
+	// Внешний авторизатор соединений: http(s)://... или unix:/path (пустой = отключён)
+	AuthorizerURL      string
+	AuthorizerTimeout  time.Duration
+	AuthorizerFailOpen bool
+
+	// Блоклист IP: бан после BlockThreshold неудачных рукопожатий за BlockWindow
+	// на BlockTTL (0 = выключен); BlockFile — файл для сохранения между перезапусками
+	BlockThreshold int
+	BlockWindow    time.Duration
+	BlockTTL       time.Duration
+	BlockFile      string
+
+	// Всплеск частоты соединений в SurgeFactor раз выше базовой (и не ниже
+	// SurgeMinRate в минуту) ужесточает приём на SurgeCooldown (0 = выключено)
+	SurgeFactor   float64
+	SurgeMinRate  int
+	SurgeCooldown time.Duration
+
+	// Лимиты на IP источника: открытых соединений и новых соединений в
+	// секунду (0 = без ограничения)
+	MaxConnsPerIP   int
+	PerIPAcceptRate float64
+
+	// Уровень подробности логов (-v); с 2 — ID на каждый кадр и входные
+	// данные каждого выбора target
+	Verbosity int
+
+	// Лимиты размера клиентских кадров по виду (нули = DefaultFrameLimits)
+	FrameLimits FrameLimits
+
+	// Отвечать на транспортные пинги клиента (RPC_PING) локально, без DC
+	AnswerPings bool
+
+	// Окно подавления повторных кадров клиента в сессии (0 = выключено)
+	DedupFrames int
+
+	// Искусственная задержка кадров клиенту: база и случайная добавка до
+	// Jitter (нули = выключено; только для тестов)
+	WriteDelay WriteDelay
+
+	// Seed случайного выбора target (0 = случайный, выводится в лог при старте)
+	RoutingSeed int64
+
+	// Каталог для отчётов о падении (пустой = отчёты не пишутся)
+	CrashDir string
+
+	// Автоматические CPU-профили: каталог (пустой = выключено), порог
+	// загрузки в процентах всех CPU, сколько он должен держаться и сколько
+	// профилей хранить
+	CPUProfileDir       string
+	CPUProfileThreshold float64
+	CPUProfileAfter     time.Duration
+	CPUProfileKeep      int
+
+	// Файл, куда при завершении пишется последний снимок статистики в JSON
+	// (пустой = не пишется)
+	FinalStatsFile string
+
+	// Warm standby: listener привязан, но соединения принимаются только
+	// после Activate (SIGUSR2 или POST /admin/activate)
+	Standby bool
+
+	// Пользователь (-u), на которого процесс, запущенный от root, переходит
+	// после привязки портов; root без него не запускается
+	User string
+
+	// Публичный адрес для дескриптора регистрации (пустой = хост из ListenAddr),
+	// файл, куда дескриптор пишется после старта и при смене секретов,
+	// и fake-TLS домены (-D)
+	PublicHost     string
+	DescriptorFile string
+	TLSDomains     []string
+
+	// Куда передавать соединения, не являющиеся клиентами прокси, вместо
+	// закрытия (--fallback-addr); пустой = закрывать, а с -D — на 443 порт
+	// первого домена
+	DecoyAddr string
 }
 
 // Runtime — центральный координатор прокси.
@@ -36,6 +249,13 @@ type Runtime struct {
 	Router    *Router
 	DataPlane *DataPlane
 	Outbound  *OutboundProxy
+	Latency   *LatencySampler
+	Reloads   *ReloadHistory
+	Events    *EventLog
+	Conns     *ConnTable
+	Crash     *CrashReporter // nil, если --crash-dir не задан
+	Profiler  *CPUProfiler   // nil, если --cpu-profile-dir не задан
+	Buffers   *BufferPool    // буферы кадров с бюджетом --msg-buffers-size
 
 	// Секреты и proxy-тег
 	Secrets  [][]byte
@@ -46,15 +266,80 @@ type Runtime struct {
 	clientIngress  *ClientIngressServer
 	httpStats      *HTTPStatsServer
 	hotReloader *HotReloader
+	configFetcher *config.Fetcher
+	configWatcher *ConfigWatcher
+	// watchdog шлёт systemd WATCHDOG=1 (WatchdogSec=); nil — не просили
+	watchdog *SdWatchdog
+	// ingressCtl публикует clientIngress для admin-эндпоинтов, работающих
+	// с момента bootstrap, когда clientIngress ещё не создан
+	ingressCtl atomic.Pointer[ClientIngressServer]
+	secretWatcher *SecretWatcher
+	conntrack     *ConntrackMonitor
+	clock         *ClockMonitor
+	targetProber  *TargetProber
+	blocklist     *Blocklist
+	shedder       *OverloadShedder
+	budget        *HandlerBudget
+	surge         *SurgeGuard
+	ipLimits      *IPLimiter
+	affinity      *SessionAffinity
+	authorizer    *Authorizer
 	rateLimiter *RateLimiter
 	shutdown    *GracefulShutdown
 
+	// liveSecrets — текущий список секретов (меняется при перезагрузке)
+	liveSecrets atomic.Pointer[[][]byte]
+
+	// standby закрывается при активации; nil, если процесс стартовал активным
+	standby      chan struct{}
+	activateOnce sync.Once
+
 	cancelFn context.CancelFunc
+
+	// shuttingDown выставляется в начале Shutdown, shutdownDone закрывается
+	// в его конце
+	shuttingDown atomic.Bool
+	shutdownDone chan struct{}
+
+	// exitLeaks — итог проверки при остановке (--exit-audit); пишется до
+	// закрытия shutdownDone
+	exitLeaks []ExitLeak
+
+	// readyProbe проверяет target'ы, когда /readyz не находит ни одного
+	// здорового
+	readyProbe readyProber
+
+	// balance — политика выбора target'а (--balance) для Router'а
+	balance config.BalancePolicy
 }
 
 // New создаёт Runtime из опций.
 func New(opts RuntimeOptions, secrets [][]byte, proxyTag []byte, outboundCfg OutboundConfig) (*Runtime, error) {
+	dups, err := config.ParseDuplicatePolicy(opts.DuplicateTargets)
+	if err != nil {
+		return nil, fmt.Errorf("runtime: %w", err)
+	}
+	if outboundCfg.Device != "" {
+		if err := CheckOutboundDevice(outboundCfg.Device); err != nil {
+			return nil, fmt.Errorf("runtime: %w", err)
+		}
+	}
+	balance := config.BalanceRandom
+	if opts.Balance != "" {
+		if balance, err = config.ParseBalancePolicy(opts.Balance); err != nil {
+			return nil, fmt.Errorf("runtime: %w", err)
+		}
+	}
+	shedPolicy, err := ParseShedPolicy(opts.OverloadPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("runtime: %w", err)
+	}
+	if opts.User == "" && os.Geteuid() == 0 {
+		return nil, fmt.Errorf("runtime: %w", ErrRootWithoutUser)
+	}
 	mgr := config.NewManager(opts.ConfigFile)
+	mgr.SetParseOptions(config.ParseOptions{Duplicates: dups})
+	mgr.SetMinDefaultTargets(opts.MinDefaultTargets)
 	if err := mgr.Load(); err != nil {
 		return nil, fmt.Errorf("runtime: load config: %w", err)
 	}
@@ -67,6 +352,70 @@ func New(opts RuntimeOptions, secrets [][]byte, proxyTag []byte, outboundCfg Out
 		configMgr: mgr,
 		shutdown:  NewGracefulShutdown(),
 		Outbound:  NewOutboundProxy(outboundCfg),
+		Latency:   NewLatencySampler(opts.LatencySampleRate, opts.LatencyReservoir),
+		Reloads:   NewReloadHistory(DefaultReloadHistory),
+		Events:    NewEventLog(DefaultEventLogSize),
+		Conns:     NewConnTable(),
+		balance:   balance,
+
+		shutdownDone: make(chan struct{}),
+	}
+	rt.readyProbe.probe = rt.ProbeTargets
+	rt.liveSecrets.Store(&secrets)
+	rt.Stats.SetSecrets(secrets)
+	if opts.SecretReload != nil {
+		rt.secretWatcher = NewSecretWatcher(secrets, opts.SecretReload, rt.applySecrets, 0)
+	}
+	rt.shutdown.SetStats(rt.Stats)
+	rt.shutdown.SetGrace(opts.ShutdownGrace)
+	rt.Outbound.SetStats(rt.Stats)
+	rt.Buffers = NewBufferPool(opts.MsgBuffersSize, rt.Stats)
+	rt.Outbound.SetBuffers(rt.Buffers)
+	rt.Outbound.Health().SetDialBackoff(DefaultDialBackoffInitial, opts.DialBackoffMax)
+	rt.Outbound.Health().SetEventLog(rt.Events)
+	mgr.SetFailing(rt.Outbound.Health().Failing)
+	if u, ok := outboundCfg.Dialer.(*UpstreamProxies); ok {
+		rt.Stats.SetUpstreamProxies(u)
+	}
+	if outboundCfg.Loopback {
+		log.Printf("WARNING: --loopback-backend: requests are echoed back instead of being sent to Telegram; for local testing only")
+		atomic.StoreInt64(&rt.Stats.LoopbackBackend, 1)
+	}
+	if opts.Standby {
+		rt.standby = make(chan struct{})
+		rt.Stats.SetStandby(true)
+	}
+	// Лимиты создаются всегда, с нулём — без ограничения: /admin/limits
+	// может включить выключенный при старте лимит.
+	rt.shedder = NewOverloadShedder(shedPolicy, opts.MaxSessions, opts.MemoryBudget, rt.Stats)
+	if opts.MaxConnsPerIP > 0 || opts.PerIPAcceptRate > 0 {
+		rt.ipLimits = NewIPLimiter(opts.MaxConnsPerIP, opts.PerIPAcceptRate, rt.Stats)
+	}
+	if opts.SessionAffinity > 0 {
+		rt.affinity = NewSessionAffinity(opts.SessionAffinity, opts.SessionAffinityMax, rt.Stats)
+	}
+	rt.budget = NewHandlerBudget(opts.MaxHandlersPerCPU*runtime.GOMAXPROCS(0), rt.Stats)
+	if opts.CrashDir != "" {
+		c, err := NewCrashReporter(opts.CrashDir, rt.Stats, proxyVersion)
+		if err != nil {
+			return nil, fmt.Errorf("runtime: %w", err)
+		}
+		rt.Crash = c
+		processCrash.Store(c)
+	}
+	if opts.CPUProfileDir != "" {
+		p, err := NewCPUProfiler(opts.CPUProfileDir, opts.CPUProfileThreshold, opts.CPUProfileAfter, opts.CPUProfileKeep, rt.Stats)
+		if err != nil {
+			return nil, fmt.Errorf("runtime: %w", err)
+		}
+		rt.Profiler = p
+	}
+	if opts.AuthorizerURL != "" {
+		a, err := NewAuthorizer(opts.AuthorizerURL, opts.AuthorizerTimeout, opts.AuthorizerFailOpen)
+		if err != nil {
+			return nil, fmt.Errorf("runtime: %w", err)
+		}
+		rt.authorizer = a
 	}
 	return rt, nil
 }
@@ -81,12 +430,149 @@ func (rt *Runtime) Start(ctx context.Context) error {
 		return fmt.Errorf("runtime start: %w", err)
 	}
 
-	rt.clientIngress = NewClientIngressServer(rt.opts.ListenAddr, rt.Secrets, rt.DataPlane, rt.shutdown)
-	log.Printf("runtime: listening on %s", rt.opts.ListenAddr)
+	rt.clientIngress = NewClientIngressServer(rt.opts.ListenAddr, *rt.liveSecrets.Load(), rt.DataPlane, rt.shutdown)
+	for _, addr := range rt.opts.ExtraListenAddrs {
+		rt.clientIngress.AddListener(addr)
+	}
+	for _, addr := range rt.opts.UDPListenAddrs {
+		rt.clientIngress.AddUDPListener(addr)
+	}
+	rt.clientIngress.SetStats(rt.Stats)
+	rt.clientIngress.SetEventLog(rt.Events)
+	rt.Conns.SetTraceAddrs(rt.opts.TraceConn)
+	rt.clientIngress.SetConnTable(rt.Conns)
+	rt.clientIngress.SetFrameLimits(rt.opts.FrameLimits)
+	rt.clientIngress.SetAnswerPings(rt.opts.AnswerPings)
+	rt.clientIngress.SetDedupFrames(rt.opts.DedupFrames)
+	rt.clientIngress.SetWriteDelay(rt.opts.WriteDelay)
+	rt.clientIngress.SetBuffers(rt.Buffers)
+	if d := rt.opts.WriteDelay; d.enabled() {
+		log.Printf("runtime: WARNING: delaying every client-bound frame by %s + up to %s (testing aid)", d.Base, d.Jitter)
+	}
+	rt.clientIngress.SetTLSDomains(rt.opts.TLSDomains)
+	rt.clientIngress.SetDecoyAddr(rt.opts.DecoyAddr)
+	rt.clientIngress.SetNATInfo(rt.Outbound.cfg.NatInfo)
+	if rt.httpStats != nil && len(rt.opts.IngressStats) > 0 {
+		rt.clientIngress.SetIngressStats(rt.opts.IngressStats, rt.httpStats.ServeIngressConn)
+	}
+	if rt.standby != nil {
+		rt.clientIngress.SetStandby(rt.standby)
+		go rt.activateOnSignal(ctx)
+		log.Println("runtime: warm standby, send SIGUSR2 or POST /admin/activate on the admin socket to start accepting")
+	}
+	rt.clientIngress.SetCrashReporter(rt.Crash)
+	rt.clientIngress.SetVerbosity(rt.opts.Verbosity)
+	if rt.opts.BlockThreshold > 0 {
+		rt.blocklist = NewBlocklist(rt.opts.BlockThreshold, rt.opts.BlockWindow, rt.opts.BlockTTL, rt.Stats)
+		rt.blocklist.SetPersistFile(rt.opts.BlockFile)
+		if err := rt.blocklist.Load(time.Now()); err != nil {
+			log.Printf("runtime: blocklist: %v", err)
+		}
+		rt.blocklist.Start()
+		rt.clientIngress.SetBlocklist(rt.blocklist)
+		log.Printf("runtime: blocklist enabled (%d failures in %s → ban for %s, %d loaded)",
+			rt.opts.BlockThreshold, rt.opts.BlockWindow, rt.opts.BlockTTL, rt.blocklist.Len())
+	}
+	rt.shedder.Start()
+	rt.clientIngress.SetOverloadShedder(rt.shedder)
+	if rt.opts.MaxSessions > 0 || rt.opts.MemoryBudget > 0 {
+		log.Printf("runtime: overload shedding enabled (policy=%s, sessions=%d, memory=%d MiB)",
+			rt.shedder.policy, rt.opts.MaxSessions, rt.opts.MemoryBudget>>20)
+	}
+	if rt.opts.SurgeFactor > 0 {
+		rt.surge = NewSurgeGuard(rt.opts.SurgeFactor, rt.opts.SurgeMinRate, rt.opts.SurgeCooldown, rt.Stats)
+		rt.surge.Start()
+		rt.clientIngress.SetSurgeGuard(rt.surge)
+		log.Printf("runtime: surge guard enabled (%.1fx baseline, at least %d/min, cool-down %s)",
+			rt.opts.SurgeFactor, rt.opts.SurgeMinRate, rt.opts.SurgeCooldown)
+	}
+	if rt.ipLimits != nil {
+		rt.ipLimits.Start()
+		rt.clientIngress.SetIPLimiter(rt.ipLimits)
+		log.Printf("runtime: per-IP limits enabled (%d connections, %g accepts/s; 0 = unlimited)",
+			rt.opts.MaxConnsPerIP, rt.opts.PerIPAcceptRate)
+	}
+	if rt.affinity != nil {
+		rt.affinity.Start()
+		log.Printf("runtime: session affinity enabled (idle %s, up to %d sessions)",
+			rt.opts.SessionAffinity, rt.affinity.maxEntries)
+	}
+	rt.clientIngress.SetHandlerBudget(rt.budget)
+	if rt.budget.Limit() > 0 {
+		log.Printf("runtime: handler budget %d goroutines (%d per CPU × GOMAXPROCS=%d)",
+			rt.budget.Limit(), rt.opts.MaxHandlersPerCPU, runtime.GOMAXPROCS(0))
+	}
+	rt.clientIngress.SetAcceptLoops(rt.opts.AcceptLoops)
+	rt.clientIngress.SetReusePort(rt.opts.ReusePort)
+	sockets := rt.opts.Sockets
+	if sockets.WindowClamp == 0 && len(rt.opts.TLSDomains) == 0 {
+		sockets.WindowClamp = DefaultWindowClamp
+	}
+	rt.clientIngress.SetSocketOptions(sockets)
+	rt.clientIngress.SetInheritedListeners(rt.opts.InheritedListeners)
+	rt.clientIngress.SetLatencySampler(rt.Latency)
+	rt.clientIngress.SetSecretWindowCheck(rt.opts.SecretAllowed)
+	if rt.authorizer != nil {
+		rt.clientIngress.SetAuthorizer(rt.authorizer)
+		log.Printf("runtime: external authorizer %s (fail-open=%v)", rt.opts.AuthorizerURL, rt.opts.AuthorizerFailOpen)
+	}
+
+	if rt.secretWatcher != nil && rt.opts.WatchSecretDir {
+		rt.secretWatcher.Start()
+		log.Println("runtime: secret directory watcher started")
+	}
+	rt.conntrack = NewConntrackMonitor("", 0, rt.Stats)
+	rt.conntrack.Start()
+	rt.clock = NewClockMonitor(rt.Stats)
+	rt.clock.SetEventLog(rt.Events)
+	rt.clock.Start()
+	if rt.opts.HealthCheckInterval > 0 {
+		rt.targetProber = NewTargetProber(rt.opts.HealthCheckInterval, rt.opts.HealthCheckTimeout,
+			rt.opts.HealthCheckRise, rt.opts.HealthCheckFall, rt.configMgr.Get, rt.Outbound, rt.Stats)
+		rt.targetProber.Start()
+		log.Printf("runtime: health-checking targets every %s (rise %d, fall %d)",
+			rt.opts.HealthCheckInterval, rt.targetProber.rise, rt.targetProber.fall)
+	}
+	if rt.Profiler != nil {
+		rt.Profiler.Start()
+		log.Printf("runtime: cpu profiler armed (above %.0f%% for %s, keeping %d in %s)",
+			rt.opts.CPUProfileThreshold, rt.opts.CPUProfileAfter, rt.opts.CPUProfileKeep, rt.opts.CPUProfileDir)
+	}
+	if rt.httpStats != nil {
+		rt.httpStats.SetDataplaneMode(DataplaneModeClient)
+	}
+
+	// Порты привязываются до сброса прав (-u), как в C: без root порты ниже
+	// 1024 недоступны.
+	if err := rt.clientIngress.Listen(ctx); err != nil {
+		return fmt.Errorf("runtime: ingress: %w", err)
+	}
+	if err := DropPrivileges(rt.opts.User); err != nil {
+		return fmt.Errorf("runtime: %w", err)
+	}
+
+	rt.ingressCtl.Store(rt.clientIngress)
+	// Секреты, перезагруженные во время bootstrap, ещё не попали в ingress.
+	rt.clientIngress.SetSecrets(*rt.liveSecrets.Load())
+	log.Printf("runtime: listening on %s (%d accept loops)",
+		strings.Join(append([]string{rt.opts.ListenAddr}, rt.opts.ExtraListenAddrs...), ", "), max(rt.opts.AcceptLoops, 1))
+	if len(rt.opts.UDPListenAddrs) > 0 {
+		log.Printf("runtime: experimental UDP ingress on %s", strings.Join(rt.opts.UDPListenAddrs, ", "))
+	}
+	rt.writeDescriptor()
+
+	// Type=notify: systemd считает сервис запущенным только теперь, когда
+	// порты привязаны.
+	sdNotify(SdReady, "STATUS=listening on "+strings.Join(append([]string{rt.opts.ListenAddr}, rt.opts.ExtraListenAddrs...), ", "))
+	if rt.watchdog = NewSdWatchdog(); rt.watchdog != nil {
+		rt.watchdog.Start()
+		log.Printf("runtime: systemd watchdog every %s", rt.watchdog.Interval())
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
+		defer processCrash.Load().Recover()
 		select {
 		case sig := <-sigCh:
 			log.Printf("runtime: received signal %s", sig)
@@ -98,26 +584,314 @@ func (rt *Runtime) Start(ctx context.Context) error {
 	if err := rt.clientIngress.ListenAndServe(ctx); err != nil {
 		return fmt.Errorf("runtime: ingress: %w", err)
 	}
+	// Shutdown закрывает listener'ы в самом начале; без ожидания процесс
+	// завершился бы, не дождавшись drain.
+	if rt.shuttingDown.Load() {
+		<-rt.shutdownDone
+	}
+	return nil
+}
+
+// Activate выводит процесс из warm standby: listener начинает принимать
+// соединения. Возвращает false, если процесс уже активен.
+func (rt *Runtime) Activate() bool {
+	if rt.standby == nil {
+		return false
+	}
+	activated := false
+	rt.activateOnce.Do(func() {
+		close(rt.standby)
+		rt.Stats.SetStandby(false)
+		activated = true
+		log.Println("runtime: activated, accepting connections")
+		rt.Events.Record(EventActivate, "", netip.AddrPort{}, "")
+	})
+	if activated {
+		rt.writeDescriptor()
+	}
+	return activated
+}
+
+// Reload перезагружает конфигурацию и секреты, как SIGHUP, и возвращается,
+// когда перезагрузка закончена. До привязки портов возвращает ошибку:
+// bootstrap ещё не закончен.
+func (rt *Runtime) Reload() error {
+	if rt.ingressCtl.Load() == nil {
+		return errors.New("not listening yet")
+	}
+	rt.hotReloader.reload()
+	return nil
+}
+
+// Listeners возвращает состояние клиентских listener'ов (пусто до запуска ingress).
+func (rt *Runtime) Listeners() []ListenerStatus {
+	if ci := rt.ingressCtl.Load(); ci != nil {
+		return ci.Listeners()
+	}
 	return nil
 }
 
+// DrainListener выводит из работы один клиентский listener: новые
+// соединения на нём не принимаются, текущие дорабатывают, остальные порты
+// продолжают обслуживаться.
+func (rt *Runtime) DrainListener(addr string) (ListenerStatus, error) {
+	ci := rt.ingressCtl.Load()
+	if ci == nil {
+		return ListenerStatus{}, fmt.Errorf("%w: %s", ErrUnknownListener, addr)
+	}
+	return ci.DrainListener(addr)
+}
+
+// Limits возвращает текущие лимиты сессий и горутин-обработчиков.
+func (rt *Runtime) Limits() ConnLimits {
+	return ConnLimits{
+		MaxSessions:   rt.shedder.MaxSessions(),
+		HandlerBudget: rt.budget.Limit(),
+	}
+}
+
+// SetLimits меняет лимиты без перезапуска (POST /admin/limits). Изменение
+// применяется целиком или не применяется вовсе; who — кто его запросил,
+// пишется в лог вместе со старыми и новыми значениями.
+func (rt *Runtime) SetLimits(u ConnLimitUpdate, who string) (ConnLimits, error) {
+	if err := u.Validate(); err != nil {
+		return rt.Limits(), err
+	}
+	old := rt.Limits()
+	if u.MaxSessions != nil {
+		rt.shedder.SetMaxSessions(*u.MaxSessions)
+	}
+	if u.HandlerBudget != nil {
+		rt.budget.SetLimit(*u.HandlerBudget)
+	}
+	cur := rt.Limits()
+	log.Printf("runtime: limits changed by %s: max_sessions %d -> %d, handler_budget %d -> %d",
+		who, old.MaxSessions, cur.MaxSessions, old.HandlerBudget, cur.HandlerBudget)
+	return cur, nil
+}
+
+// activateOnSignal активирует процесс по SIGUSR2.
+func (rt *Runtime) activateOnSignal(ctx context.Context) {
+	defer processCrash.Load().Recover()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
+	select {
+	case <-sigCh:
+		log.Println("runtime: received SIGUSR2")
+		rt.Activate()
+	case <-rt.standby:
+	case <-ctx.Done():
+	}
+}
+
 // Shutdown выполняет graceful остановку всех компонентов.
 func (rt *Runtime) Shutdown() {
+	if rt.shuttingDown.Swap(true) {
+		<-rt.shutdownDone
+		return
+	}
+	defer close(rt.shutdownDone)
 	log.Println("runtime: shutting down")
+	sdNotify(SdStopping)
 
 	if rt.hotReloader != nil {
 		rt.hotReloader.Stop()
 	}
+	if rt.configFetcher != nil {
+		rt.configFetcher.Stop()
+	}
+	if rt.configWatcher != nil {
+		rt.configWatcher.Stop()
+	}
+	if rt.secretWatcher != nil {
+		rt.secretWatcher.Stop()
+	}
+	if rt.conntrack != nil {
+		rt.conntrack.Stop()
+	}
+	if rt.clock != nil {
+		rt.clock.Stop()
+	}
+	if rt.targetProber != nil {
+		rt.targetProber.Stop()
+	}
+	if rt.Profiler != nil {
+		rt.Profiler.Stop()
+	}
+	if rt.blocklist != nil {
+		rt.blocklist.Stop()
+	}
+	if rt.shedder != nil {
+		rt.shedder.Stop()
+	}
+	if rt.surge != nil {
+		rt.surge.Stop()
+	}
+	if rt.ipLimits != nil {
+		rt.ipLimits.Stop()
+	}
+	if rt.affinity != nil {
+		rt.affinity.Stop()
+	}
+	// HTTP stats остаются доступными (только чтение) до конца drain,
+	// чтобы оркестратор видел его прогресс.
 	if rt.httpStats != nil {
-		rt.httpStats.Stop()
+		rt.httpStats.SetReadOnly()
 	}
+
+	// Соединения к DC закрываются только после drain: до конца grace
+	// сессии клиентов продолжают обмениваться данными.
+	rt.shutdown.Shutdown(rt.cancelFn)
+	rt.shutdown.Wait()
 	if rt.Outbound != nil {
 		rt.Outbound.Close()
 	}
 
-	rt.shutdown.Shutdown(rt.cancelFn)
-	rt.shutdown.Wait()
+	rt.writeFinalStats()
+	if rt.httpStats != nil {
+		rt.httpStats.Stop()
+	}
+
+	// Keepalive'ы идут до конца drain: сервис ещё работает.
+	if rt.watchdog != nil {
+		rt.watchdog.Stop()
+	}
+
+	drained, forced := rt.shutdown.Result()
+	log.Printf("runtime: shutdown complete: %d connections drained, %d force-closed", drained, forced)
+
+	if rt.opts.ExitAudit {
+		a := exitAuditor{
+			ingress:  rt.clientIngress,
+			outbound: rt.Outbound,
+			sessions: rt.shutdown,
+			allowed:  exitAuditAllowed,
+		}
+		rt.exitLeaks = a.run(exitAuditSettle)
+		logExitLeaks(rt.exitLeaks)
+	}
+}
+
+// ExitLeaks возвращает утечки, найденные проверкой при остановке
+// (--exit-audit); пусто, если проверка выключена или всё освобождено.
+// Вызывать после Shutdown.
+func (rt *Runtime) ExitLeaks() []ExitLeak {
+	return rt.exitLeaks
+}
+
+// ProbeTargets немедленно проверяет доступность всех target'ов текущей
+// конфигурации и возвращает результаты. Успешная проверка оставляет
+// соединение в пуле, так что трафик идёт без ожидания повторного dial.
+func (rt *Runtime) ProbeTargets() []ProbeResult {
+	results := probeTargets(rt.configMgr.Get(), rt.Outbound.Probe, DefaultProbeTimeout)
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			log.Printf("runtime: probe %s: %v", r.Addr, r.Err)
+		}
+	}
+	log.Printf("runtime: probed %d targets, %d failed", len(results), failed)
+	return results
+}
 
-	log.Println("runtime: shutdown complete")
+// writeFinalStats записывает итоговый снимок статистики в --final-stats-file,
+// если он задан. Вызывается после drain, чтобы попали и его счётчики.
+func (rt *Runtime) writeFinalStats() {
+	if rt.opts.FinalStatsFile == "" {
+		return
+	}
+	mode := DataplaneModeDisabled
+	if rt.httpStats != nil {
+		mode = rt.httpStats.DataplaneMode()
+	} else if rt.clientIngress != nil {
+		mode = DataplaneModeClient
+	}
+	snap := buildStatsJSON(rt.Stats, len(*rt.liveSecrets.Load()), proxyVersion, mode, rt.Reloads, rt.Outbound.Health(), rt.Router)
+	if err := writeFinalStats(rt.opts.FinalStatsFile, snap, time.Now()); err != nil {
+		log.Printf("runtime: %v", err)
+		return
+	}
+	log.Printf("runtime: final stats written to %s", rt.opts.FinalStatsFile)
 }
 
+// applySecrets применяет новый список секретов без перезапуска:
+// новые соединения сразу проверяются по нему, активные продолжают работать,
+// а с SecretRevokeGrace соединения удалённых секретов закрываются позже.
+func (rt *Runtime) applySecrets(secrets [][]byte) {
+	old := *rt.liveSecrets.Swap(&secrets)
+	if ci := rt.ingressCtl.Load(); ci != nil {
+		ci.SetSecrets(secrets)
+	}
+	rt.Stats.SetSecrets(secrets)
+	if rt.httpStats != nil {
+		rt.httpStats.SetSecretCount(len(secrets))
+	}
+	log.Printf("runtime: applied %d secrets", len(secrets))
+	if rt.opts.SecretRevokeGrace > 0 {
+		for _, secret := range missingSecrets(old, secrets) {
+			rt.revokeAfterGrace(secret)
+		}
+	}
+	rt.writeDescriptor()
+}
+
+// revokeAfterGrace закрывает соединения удалённого секрета через
+// SecretRevokeGrace, если за это время секрет не вернули.
+func (rt *Runtime) revokeAfterGrace(secret []byte) {
+	fp := secretFingerprint(secret)
+	log.Printf("runtime: secret %s removed, closing its connections in %s", fp, rt.opts.SecretRevokeGrace)
+	sharedTimerWheel().Watch(rt.opts.SecretRevokeGrace, func() {
+		if len(missingSecrets([][]byte{secret}, *rt.liveSecrets.Load())) == 0 {
+			log.Printf("runtime: secret %s is back, keeping its connections", fp)
+			return
+		}
+		n := rt.Conns.Revoke(fp)
+		rt.Stats.AddSecretRevoked(int64(n))
+		log.Printf("runtime: closed %d connections of removed secret %s", n, fp)
+	})
+}
+
+// ErrSecretsStatic возвращается ReloadSecrets, когда секреты заданы только
+// через -S и перечитывать нечего.
+var ErrSecretsStatic = errors.New("secrets are static: no --mtproto-secret-file or --mtproto-secret-dir")
+
+// ReloadSecrets перечитывает --mtproto-secret-file и --mtproto-secret-dir
+// (SIGHUP, POST /admin/secrets/reload). При ошибке остаются текущие секреты.
+func (rt *Runtime) ReloadSecrets() (SecretReload, error) {
+	if rt.secretWatcher == nil {
+		return SecretReload{}, ErrSecretsStatic
+	}
+	return rt.secretWatcher.Reload()
+}
+
+// Descriptor возвращает машиночитаемое описание прокси для регистрации.
+func (rt *Runtime) Descriptor() (Descriptor, error) {
+	standby := false
+	if rt.standby != nil {
+		select {
+		case <-rt.standby:
+		default:
+			standby = true
+		}
+	}
+	return buildDescriptor(rt.opts.PublicHost, rt.opts.ListenAddr, natPublicAddrs(rt.Outbound.cfg.NatInfo), *rt.liveSecrets.Load(),
+		rt.ProxyTag, rt.opts.TLSDomains, standby, time.Now())
+}
+
+// writeDescriptor записывает дескриптор в --descriptor-file, если он задан.
+func (rt *Runtime) writeDescriptor() {
+	if rt.opts.DescriptorFile == "" {
+		return
+	}
+	d, err := rt.Descriptor()
+	if err == nil {
+		err = WriteDescriptor(rt.opts.DescriptorFile, d)
+	}
+	if err != nil {
+		log.Printf("runtime: %v", err)
+		return
+	}
+	log.Printf("runtime: descriptor written to %s", rt.opts.DescriptorFile)
+}
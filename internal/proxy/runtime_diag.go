@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pprofMaxSeconds caps ?seconds= of the CPU profile and execution trace
+// handlers, which hold their connection for that long.
+const pprofMaxSeconds = 120
+
+// registerPprof adds the net/http/pprof handlers under /debug/pprof/
+// (--enable-pprof).
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.Handle("/debug/pprof/profile", longPprof(pprof.Profile))
+	mux.Handle("/debug/pprof/trace", longPprof(pprof.Trace))
+}
+
+// longPprof lets a profile run past the stats listener's 10-second write
+// timeout: the connection gets a deadline of ?seconds= plus a margin, and
+// the handler sees a server without WriteTimeout, which pprof would
+// otherwise refuse a longer profile for.
+func longPprof(f http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sec, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+		if err != nil || sec <= 0 {
+			sec = 30 // pprof's default
+		}
+		if sec > pprofMaxSeconds {
+			writeAPIError(w, http.StatusBadRequest, errCodeBadRequest,
+				fmt.Sprintf("seconds must be at most %d", pprofMaxSeconds))
+			return
+		}
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Duration(sec+10) * time.Second))
+		if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok && srv.WriteTimeout > 0 {
+			unlimited := &http.Server{ReadTimeout: srv.ReadTimeout}
+			r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, unlimited))
+		}
+		f(w, r)
+	})
+}
+
+// serveRuntimeDiag answers /debug/runtime with the Go runtime's view of
+// the process: goroutines, heap and GC, one "key\tvalue" per line like
+// /stats.
+func serveRuntimeDiag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var sb strings.Builder
+	writeRuntimeDiag(&sb)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// writeRuntimeDiag writes the runtime counters of /debug/runtime.
+func writeRuntimeDiag(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	line := func(key string, v any) { fmt.Fprintf(w, "%s\t%v\n", key, v) }
+	line("go_version", runtime.Version())
+	line("gomaxprocs", runtime.GOMAXPROCS(0))
+	line("num_cpu", runtime.NumCPU())
+	line("goroutines", runtime.NumGoroutine())
+	line("heap_alloc_bytes", ms.HeapAlloc)
+	line("heap_inuse_bytes", ms.HeapInuse)
+	line("heap_idle_bytes", ms.HeapIdle)
+	line("heap_released_bytes", ms.HeapReleased)
+	line("heap_objects", ms.HeapObjects)
+	line("stack_inuse_bytes", ms.StackInuse)
+	line("sys_bytes", ms.Sys)
+	line("total_alloc_bytes", ms.TotalAlloc)
+	line("mallocs", ms.Mallocs)
+	line("frees", ms.Frees)
+	line("next_gc_bytes", ms.NextGC)
+	line("memory_limit_bytes", debug.SetMemoryLimit(-1))
+	line("gc_cycles", ms.NumGC)
+	line("gc_forced", ms.NumForcedGC)
+	line("gc_cpu_fraction", strconv.FormatFloat(ms.GCCPUFraction, 'f', 6, 64))
+	line("gc_pause_total_seconds", strconv.FormatFloat(gc.PauseTotal.Seconds(), 'f', 6, 64))
+	last, lastPause := "-", "0.000000"
+	if !gc.LastGC.IsZero() {
+		last = gc.LastGC.UTC().Format(time.RFC3339)
+	}
+	if len(gc.Pause) > 0 {
+		lastPause = strconv.FormatFloat(gc.Pause[0].Seconds(), 'f', 6, 64)
+	}
+	line("gc_last", last)
+	line("gc_pause_last_seconds", lastPause)
+}
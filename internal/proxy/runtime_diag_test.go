@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeRuntimeDiag(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveRuntimeDiag(rec, httptest.NewRequest(http.MethodGet, "/debug/runtime", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	keys := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		k, v, ok := strings.Cut(line, "\t")
+		if !ok {
+			t.Fatalf("line without a tab: %q", line)
+		}
+		keys[k] = v
+	}
+	for _, k := range []string{"goroutines", "heap_alloc_bytes", "gc_cycles", "gc_pause_total_seconds", "gc_last"} {
+		if keys[k] == "" {
+			t.Errorf("no %s in:\n%s", k, rec.Body.String())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	serveRuntimeDiag(rec, httptest.NewRequest(http.MethodPost, "/debug/runtime", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
+
+// A CPU profile as long as the server's write timeout is refused by pprof
+// unless longPprof lifts it.
+func TestPprofPastWriteTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.WriteTimeout = time.Second
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/pprof/profile?seconds=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Errorf("profile: status %d, %d bytes: %.200s", resp.StatusCode, len(body), body)
+	}
+
+	resp, err = http.Get(srv.URL + "/debug/pprof/profile?seconds=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("seconds=1000: status %d, want 400", resp.StatusCode)
+	}
+}
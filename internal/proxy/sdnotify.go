@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemd notification states, see sd_notify(3).
+const (
+	SdReady     = "READY=1"
+	SdReloading = "RELOADING=1"
+	SdStopping  = "STOPPING=1"
+	SdKeepalive = "WATCHDOG=1"
+)
+
+// SdNotifyEnv lists the environment variables through which systemd hands
+// the notification socket and the watchdog interval to a Type=notify
+// service. A process that starts children of its own (the -M supervisor)
+// removes them from their environment, so only the main process reports.
+var SdNotifyEnv = []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"}
+
+// SdNotify sends state to the systemd notification socket named by
+// $NOTIFY_SOCKET; several states are joined with newlines. Without the
+// variable, that is when not started by systemd with Type=notify, it does
+// nothing and reports false.
+func SdNotify(state ...string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	if addr[0] == '@' {
+		// abstract socket namespace
+		addr = "\x00" + addr[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sdNotify is SdNotify for the lifecycle points of the runtime: a failure
+// is logged, the proxy keeps running.
+func sdNotify(state ...string) {
+	if _, err := SdNotify(state...); err != nil {
+		log.Printf("sd_notify: %v", err)
+	}
+}
+
+// SdReloadingState returns the RELOADING=1 notification; where the
+// monotonic clock is available it carries MONOTONIC_USEC, which
+// Type=notify-reload requires.
+func SdReloadingState() []string {
+	if usec, ok := monotonicUsec(); ok {
+		return []string{SdReloading, "MONOTONIC_USEC=" + strconv.FormatInt(usec, 10)}
+	}
+	return []string{SdReloading}
+}
+
+// SdWatchdogInterval returns how often systemd expects WATCHDOG=1
+// (WatchdogSec= of the unit), or 0 when the watchdog is off or meant for
+// another process.
+func SdWatchdogInterval() time.Duration {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// SdWatchdog sends WATCHDOG=1 at half the interval systemd asked for, so
+// one late keepalive does not get the process killed. A process that stops
+// being scheduled, is stopped or spends its time in a GC spiral misses the
+// interval and systemd restarts it.
+type SdWatchdog struct {
+	interval time.Duration
+	stopCh   chan struct{}
+
+	// check, if set, must pass for a keepalive to be sent
+	check func() bool
+}
+
+// NewSdWatchdog returns a watchdog for SdWatchdogInterval, or nil when
+// systemd does not supervise the process with one.
+func NewSdWatchdog() *SdWatchdog {
+	interval := SdWatchdogInterval()
+	if interval <= 0 {
+		return nil
+	}
+	return &SdWatchdog{interval: interval, stopCh: make(chan struct{})}
+}
+
+// Interval returns the interval systemd enforces.
+func (w *SdWatchdog) Interval() time.Duration {
+	return w.interval
+}
+
+// SetCheck makes every keepalive depend on check: while it fails none is
+// sent, and systemd restarts the service once the interval runs out. Call
+// before Start.
+func (w *SdWatchdog) SetCheck(check func() bool) {
+	w.check = check
+}
+
+// Start sends keepalives in a background goroutine until Stop.
+func (w *SdWatchdog) Start() {
+	go func() {
+		defer processCrash.Load().Recover()
+		ticker := time.NewTicker(w.interval / 2)
+		defer ticker.Stop()
+		failing := false
+		for {
+			select {
+			case <-w.stopCh:
+				return
+			case <-ticker.C:
+				if w.check != nil && !w.check() {
+					continue
+				}
+				// only the first of a run of failures is logged
+				_, err := SdNotify(SdKeepalive)
+				if err != nil && !failing {
+					log.Printf("sd_notify: watchdog: %v", err)
+				}
+				failing = err != nil
+			}
+		}
+	}()
+}
+
+// Stop stops the keepalives.
+func (w *SdWatchdog) Stop() {
+	close(w.stopCh)
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package proxy
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// clockMonotonic is CLOCK_MONOTONIC of clock_gettime(2).
+const clockMonotonic = 1
+
+// monotonicUsec returns CLOCK_MONOTONIC in microseconds, the clock systemd
+// compares MONOTONIC_USEC against.
+func monotonicUsec() (int64, bool) {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, false
+	}
+	return ts.Nano() / 1000, true
+}
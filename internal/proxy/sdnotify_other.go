@@ -0,0 +1,9 @@
+//go:build !linux
+
+package proxy
+
+// monotonicUsec is not implemented off Linux, where systemd does not run;
+// RELOADING=1 goes without MONOTONIC_USEC.
+func monotonicUsec() (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenNotify binds a notification socket and points NOTIFY_SOCKET at it.
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return c
+}
+
+func readNotify(t *testing.T, c *net.UnixConn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	c := listenNotify(t)
+	sent, err := SdNotify(SdReady, "STATUS=listening")
+	if err != nil || !sent {
+		t.Fatalf("SdNotify = %v, %v", sent, err)
+	}
+	if got := readNotify(t, c); got != "READY=1\nSTATUS=listening" {
+		t.Errorf("got %q", got)
+	}
+
+	reloading := SdReloadingState()
+	if reloading[0] != SdReloading {
+		t.Errorf("SdReloadingState = %q", reloading)
+	}
+	if _, ok := monotonicUsec(); ok && (len(reloading) != 2 || !strings.HasPrefix(reloading[1], "MONOTONIC_USEC=")) {
+		t.Errorf("SdReloadingState = %q, want MONOTONIC_USEC", reloading)
+	}
+}
+
+func TestSdNotify_NoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := SdNotify(SdReady); sent || err != nil {
+		t.Errorf("SdNotify = %v, %v, want no-op", sent, err)
+	}
+	if d := SdWatchdogInterval(); d != 0 {
+		t.Errorf("SdWatchdogInterval = %s without NOTIFY_SOCKET", d)
+	}
+	if NewSdWatchdog() != nil {
+		t.Error("NewSdWatchdog != nil without NOTIFY_SOCKET")
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if d := SdWatchdogInterval(); d != 30*time.Second {
+		t.Errorf("interval = %s, want 30s", d)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d := SdWatchdogInterval(); d != 30*time.Second {
+		t.Errorf("interval for own pid = %s, want 30s", d)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d := SdWatchdogInterval(); d != 0 {
+		t.Errorf("interval for another pid = %s, want 0", d)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "junk")
+	if d := SdWatchdogInterval(); d != 0 {
+		t.Errorf("interval for junk = %s, want 0", d)
+	}
+}
+
+func TestSdWatchdog_SendsKeepalives(t *testing.T) {
+	c := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "")
+	w := NewSdWatchdog()
+	if w == nil {
+		t.Fatal("NewSdWatchdog = nil")
+	}
+	w.Start()
+	defer w.Stop()
+	for range 2 {
+		if got := readNotify(t, c); got != SdKeepalive {
+			t.Errorf("got %q, want %q", got, SdKeepalive)
+		}
+	}
+}
+
+func TestSdWatchdog_Check(t *testing.T) {
+	c := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "")
+	w := NewSdWatchdog()
+	var pass atomic.Bool
+	checked := make(chan struct{}, 1)
+	w.SetCheck(func() bool {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+		return pass.Load()
+	})
+	w.Start()
+	defer w.Stop()
+
+	for range 2 {
+		<-checked
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 64)); err == nil {
+		t.Error("keepalive sent while the check fails")
+	}
+	pass.Store(true)
+	if got := readNotify(t, c); got != SdKeepalive {
+		t.Errorf("got %q, want %q", got, SdKeepalive)
+	}
+}
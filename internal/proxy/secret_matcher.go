@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"runtime"
+	"sync"
+)
+
+// parallelMatchThreshold is the secret count from which secretMatcher splits
+// the trial decryption across several goroutines. Below it the goroutine
+// start-up cost outweighs the gain.
+const parallelMatchThreshold = 64
+
+// secretMatcher finds which of the configured secrets a raw obfuscated2
+// header was built with.
+//
+// The naive approach runs the full ParseObfuscated2Header for every secret:
+// two SHA-256, three AES key schedules and two 64-byte keystream skips per
+// attempt. The only thing that tells secrets apart, however, is whether the
+// decrypted transport magic at bytes 56..59 is valid, and that lives in the
+// fourth AES-CTR block. So each trial here costs one SHA-256 of a
+// precomputed 48-byte buffer, one AES key schedule and a single block
+// encryption; the full derivation is done once, for the matching secret.
+type secretMatcher struct {
+	secrets [][]byte
+	keyBufs [][48]byte // per secret: [32 bytes filled per header][secret[0:16]]
+	ids     []string   // per secret: secretFingerprint, the key of its stats
+}
+
+// newSecretMatcher precomputes the per-secret key buffers and fingerprints.
+func newSecretMatcher(secrets [][]byte) *secretMatcher {
+	m := &secretMatcher{
+		secrets: secrets,
+		keyBufs: make([][48]byte, len(secrets)),
+		ids:     make([]string, len(secrets)),
+	}
+	for i, s := range secrets {
+		copy(m.keyBufs[i][32:48], s)
+		m.ids[i] = secretFingerprint(s)
+	}
+	return m
+}
+
+// match returns the index of the secret whose derived read key decrypts raw
+// to a known transport magic, or -1 if none does.
+func (m *secretMatcher) match(raw *[64]byte) int {
+	n := len(m.secrets)
+	if n < parallelMatchThreshold {
+		return m.matchRange(raw, 0, n)
+	}
+
+	workers := min(runtime.GOMAXPROCS(0), n/(parallelMatchThreshold/4))
+	if workers < 2 {
+		return m.matchRange(raw, 0, n)
+	}
+	chunk := (n + workers - 1) / workers
+
+	results := make([]int, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		lo, hi := w*chunk, min((w+1)*chunk, n)
+		wg.Add(1)
+		go func(w, lo, hi int) {
+			defer wg.Done()
+			results[w] = m.matchRange(raw, lo, hi)
+		}(w, lo, hi)
+	}
+	wg.Wait()
+
+	// Lowest index wins, matching the sequential order.
+	for _, r := range results {
+		if r >= 0 {
+			return r
+		}
+	}
+	return -1
+}
+
+// matchRange trial-decrypts the tag block for secrets [lo, hi).
+func (m *secretMatcher) matchRange(raw *[64]byte, lo, hi int) int {
+	// Counter for block 3 (bytes 48..63): IV + 3 as a 128-bit big-endian
+	// integer, exactly as crypto/cipher's CTR mode increments it.
+	var ctr [16]byte
+	hiIV := binary.BigEndian.Uint64(raw[40:48])
+	loIV := binary.BigEndian.Uint64(raw[48:56])
+	loCtr := loIV + 3
+	if loCtr < loIV {
+		hiIV++
+	}
+	binary.BigEndian.PutUint64(ctr[0:8], hiIV)
+	binary.BigEndian.PutUint64(ctr[8:16], loCtr)
+
+	var ks [16]byte
+	for i := lo; i < hi; i++ {
+		kb := m.keyBufs[i]
+		copy(kb[0:32], raw[8:40])
+		key := sha256.Sum256(kb[:])
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			continue
+		}
+		block.Encrypt(ks[:], ctr[:])
+		tag := binary.LittleEndian.Uint32(raw[56:60]) ^ binary.LittleEndian.Uint32(ks[8:12])
+		switch tag {
+		case TransportMagicAbridged, TransportMagicIntermediate, TransportMagicPadded:
+			return i
+		}
+	}
+	return -1
+}
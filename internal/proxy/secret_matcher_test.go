@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func makeTestSecrets(n int) [][]byte {
+	secrets := make([][]byte, n)
+	for i := range secrets {
+		secrets[i] = make([]byte, 16)
+		binary.LittleEndian.PutUint64(secrets[i], uint64(i)*0x9e3779b97f4a7c15+1)
+	}
+	return secrets
+}
+
+// sealHeader overwrites raw[56:60] so that raw decrypts to the intermediate
+// magic with secret, keeping the key material and IV in raw[8:56].
+func sealHeader(t testing.TB, raw *[64]byte, secret []byte) {
+	t.Helper()
+	var kBuf [48]byte
+	copy(kBuf[0:32], raw[8:40])
+	copy(kBuf[32:48], secret)
+	var iv [16]byte
+	copy(iv[:], raw[40:56])
+	ks, err := newAESCTRStream(sha256.Sum256(kBuf[:]), iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := make([]byte, 64)
+	ks.XORKeyStream(stream, stream)
+	binary.LittleEndian.PutUint32(raw[56:60], TransportMagicIntermediate^binary.LittleEndian.Uint32(stream[56:60]))
+}
+
+func TestSecretMatcher_MatchesParse(t *testing.T) {
+	for _, n := range []int{1, 8, parallelMatchThreshold, 200} {
+		secrets := makeTestSecrets(n)
+		m := newSecretMatcher(secrets)
+		for _, want := range []int{0, n / 2, n - 1} {
+			raw := buildRawHeader(t, secrets[want], TransportMagicAbridged, 2)
+			if got := m.match(&raw); got != want {
+				t.Errorf("n=%d: match = %d, want %d", n, got, want)
+			}
+			if _, _, _, err := ParseObfuscated2Header(raw, secrets[want]); err != nil {
+				t.Errorf("n=%d: matched secret fails full parse: %v", n, err)
+			}
+		}
+	}
+}
+
+func TestSecretMatcher_NoMatch(t *testing.T) {
+	raw := buildRawHeader(t, []byte("zzzzzzzzzzzzzzzz"), TransportMagicAbridged, 2)
+	if got := newSecretMatcher(makeTestSecrets(100)).match(&raw); got != -1 {
+		t.Errorf("match = %d, want -1", got)
+	}
+	if got := newSecretMatcher(nil).match(&raw); got != -1 {
+		t.Errorf("empty matcher: match = %d, want -1", got)
+	}
+}
+
+func TestSecretMatcher_CounterCarry(t *testing.T) {
+	secrets := makeTestSecrets(4)
+	var raw [64]byte
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	// Low 64 bits of the IV overflow when advanced to block 3.
+	for i := 48; i < 56; i++ {
+		raw[i] = 0xff
+	}
+	sealHeader(t, &raw, secrets[2])
+	if got := newSecretMatcher(secrets).match(&raw); got != 2 {
+		t.Errorf("match with IV carry = %d, want 2", got)
+	}
+}
+
+// BenchmarkSecretLookup compares the previous sequential full-parse lookup
+// with secretMatcher for 1 and 128 secrets, with the matching secret last.
+func BenchmarkSecretLookup(b *testing.B) {
+	for _, n := range []int{1, 128} {
+		secrets := makeTestSecrets(n)
+		raw := buildRawHeader(b, secrets[n-1], TransportMagicAbridged, 2)
+
+		b.Run(fmt.Sprintf("sequential/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, s := range secrets {
+					if _, _, _, err := ParseObfuscated2Header(raw, s); err == nil {
+						break
+					}
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("matcher/%d", n), func(b *testing.B) {
+			m := newSecretMatcher(secrets)
+			for i := 0; i < b.N; i++ {
+				if idx := m.match(&raw); idx >= 0 {
+					ParseObfuscated2Header(raw, secrets[idx])
+				}
+			}
+		})
+	}
+}
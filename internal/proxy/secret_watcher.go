@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// secretPollInterval is how often SecretWatcher re-reads the secret sources.
+const secretPollInterval = 2 * time.Second
+
+// errEmptySecrets is returned by Reload when the sources hold no secrets.
+var errEmptySecrets = errors.New("refusing to apply empty secret set")
+
+// SecretReload is the outcome of one SecretWatcher.Reload.
+type SecretReload struct {
+	Secrets int // secrets in use afterwards
+	Added   int
+	Removed int
+}
+
+// SecretWatcher reloads the list of client secrets and applies it when it
+// changes. With Start it polls, which is used for --mtproto-secret-dir,
+// where secrets are provisioned as individual files that may be added or
+// removed at runtime; Reload re-reads the sources on demand (SIGHUP and
+// POST /admin/secrets/reload), which also covers --mtproto-secret-file.
+//
+// Polling is used instead of inotify so the watcher behaves the same on
+// every platform and on network filesystems.
+type SecretWatcher struct {
+	load     func() ([][]byte, error)
+	apply    func([][]byte)
+	interval time.Duration
+	stopCh   chan struct{}
+
+	// mu serializes reloads from the poller, signals and the API.
+	mu      sync.Mutex
+	current [][]byte
+
+	// emptyLogged suppresses repeated warnings while the source stays empty.
+	emptyLogged bool
+}
+
+// NewSecretWatcher creates a watcher that calls load every interval and
+// passes the result to apply whenever it differs from current.
+// interval <= 0 uses secretPollInterval.
+func NewSecretWatcher(current [][]byte, load func() ([][]byte, error), apply func([][]byte), interval time.Duration) *SecretWatcher {
+	if interval <= 0 {
+		interval = secretPollInterval
+	}
+	return &SecretWatcher{
+		load:     load,
+		apply:    apply,
+		interval: interval,
+		current:  current,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start launches the polling goroutine.
+func (w *SecretWatcher) Start() {
+	go runEvery(w.interval, w.stopCh, w.poll)
+}
+
+// Stop stops the polling goroutine.
+func (w *SecretWatcher) Stop() {
+	close(w.stopCh)
+}
+
+// poll reloads the secrets once and applies them if they changed.
+// A failed load or an empty result keeps the current set: an empty list
+// would switch the ingress into no-secret mode and accept every client.
+func (w *SecretWatcher) poll() {
+	_, err := w.Reload()
+	switch {
+	case errors.Is(err, errEmptySecrets):
+		if !w.emptyLogged {
+			log.Printf("secret watcher: %v", err)
+			w.emptyLogged = true
+		}
+	case err != nil:
+		log.Printf("secret watcher: %v", err)
+	default:
+		w.emptyLogged = false
+	}
+}
+
+// Reload re-reads the secret sources now and applies the result if it
+// changed. On error the current secrets stay in use.
+func (w *SecretWatcher) Reload() (SecretReload, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	secrets, err := w.load()
+	if err != nil {
+		return SecretReload{Secrets: len(w.current)}, fmt.Errorf("reload failed, keeping %d secrets: %w", len(w.current), err)
+	}
+	if len(secrets) == 0 {
+		return SecretReload{Secrets: len(w.current)}, fmt.Errorf("%w, keeping %d secrets", errEmptySecrets, len(w.current))
+	}
+	if secretsEqual(secrets, w.current) {
+		return SecretReload{Secrets: len(secrets)}, nil
+	}
+	res := SecretReload{
+		Secrets: len(secrets),
+		Added:   countMissing(secrets, w.current),
+		Removed: countMissing(w.current, secrets),
+	}
+	log.Printf("secret watcher: secrets changed (%d → %d, %d added, %d removed)", len(w.current), len(secrets), res.Added, res.Removed)
+	w.current = secrets
+	w.apply(secrets)
+	return res, nil
+}
+
+// countMissing returns how many secrets of a are not in b.
+func countMissing(a, b [][]byte) int {
+	return len(missingSecrets(a, b))
+}
+
+// missingSecrets returns the secrets of a that are not in b.
+func missingSecrets(a, b [][]byte) [][]byte {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[string(s)] = true
+	}
+	var out [][]byte
+	for _, s := range a {
+		if !in[string(s)] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// secretsEqual reports whether a and b contain the same secrets in the same order.
+func secretsEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
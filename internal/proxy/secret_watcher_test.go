@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSecretWatcher_Poll(t *testing.T) {
+	a := []byte("aaaaaaaaaaaaaaaa")
+	b := []byte("bbbbbbbbbbbbbbbb")
+
+	var next [][]byte
+	var loadErr error
+	var applied [][]byte
+	applies := 0
+
+	w := NewSecretWatcher([][]byte{a},
+		func() ([][]byte, error) { return next, loadErr },
+		func(s [][]byte) { applied = s; applies++ },
+		0)
+
+	next = [][]byte{a}
+	w.poll()
+	if applies != 0 {
+		t.Fatal("unchanged secrets must not be applied")
+	}
+
+	next = [][]byte{a, b}
+	w.poll()
+	if applies != 1 || len(applied) != 2 {
+		t.Fatalf("added secret not applied: applies=%d len=%d", applies, len(applied))
+	}
+
+	loadErr = errors.New("boom")
+	w.poll()
+	if applies != 1 {
+		t.Error("failed load must keep current secrets")
+	}
+
+	loadErr = nil
+	next = nil
+	w.poll()
+	if applies != 1 {
+		t.Error("empty secret set must not be applied")
+	}
+
+	next = [][]byte{b}
+	w.poll()
+	if applies != 2 || len(applied) != 1 {
+		t.Errorf("removed secret not applied: applies=%d len=%d", applies, len(applied))
+	}
+}
+
+func TestSecretWatcher_Reload(t *testing.T) {
+	a := []byte("aaaaaaaaaaaaaaaa")
+	b := []byte("bbbbbbbbbbbbbbbb")
+	c := []byte("cccccccccccccccc")
+
+	next := [][]byte{a, b}
+	w := NewSecretWatcher([][]byte{a, c},
+		func() ([][]byte, error) { return next, nil },
+		func([][]byte) {},
+		0)
+
+	res, err := w.Reload()
+	if err != nil || res != (SecretReload{Secrets: 2, Added: 1, Removed: 1}) {
+		t.Fatalf("Reload() = %+v, %v", res, err)
+	}
+	res, err = w.Reload()
+	if err != nil || res != (SecretReload{Secrets: 2}) {
+		t.Errorf("unchanged Reload() = %+v, %v", res, err)
+	}
+	next = nil
+	if res, err := w.Reload(); !errors.Is(err, errEmptySecrets) || res.Secrets != 2 {
+		t.Errorf("empty Reload() = %+v, %v", res, err)
+	}
+}
+
+// TestRuntime_RevokeRemovedSecret checks that connections of a removed
+// secret are closed after the grace period and others are kept.
+func TestRuntime_RevokeRemovedSecret(t *testing.T) {
+	a := []byte("aaaaaaaaaaaaaaaa")
+	b := []byte("bbbbbbbbbbbbbbbb")
+	rt := &Runtime{
+		opts:  RuntimeOptions{SecretRevokeGrace: time.Millisecond},
+		Stats: NewStats(),
+		Conns: NewConnTable(),
+	}
+	secrets := [][]byte{a, b}
+	rt.liveSecrets.Store(&secrets)
+
+	var closedA, closedB atomic.Bool
+	connA := &ConnInfo{ID: "a", Secret: secretFingerprint(a), closeConn: func() { closedA.Store(true) }}
+	connB := &ConnInfo{ID: "b", Secret: secretFingerprint(b), closeConn: func() { closedB.Store(true) }}
+	rt.Conns.Add(connA)
+	rt.Conns.Add(connB)
+
+	rt.applySecrets([][]byte{b})
+	deadline := time.Now().Add(5 * time.Second)
+	for !closedA.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !closedA.Load() || !connA.Revoked() {
+		t.Fatal("connection of the removed secret was not closed")
+	}
+	if closedB.Load() || connB.Revoked() {
+		t.Error("connection of a kept secret was closed")
+	}
+	if got := rt.Stats.Snapshot(0)["revoked_secret_connections"]; got != 1 {
+		t.Errorf("revoked_secret_connections = %d, want 1", got)
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientObfuscated2Header(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, 16)
+	raw, enc, dec, err := clientObfuscated2Header(secret, TransportMagicPadded, -3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, proxyDec, proxyEnc, err := ParseObfuscated2Header(raw, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Transport != TransportPadded || hdr.TargetDC != -3 {
+		t.Errorf("header = %+v, want padded dc -3", hdr)
+	}
+	// Both directions must line up after the header.
+	msg := []byte("ping")
+	for _, pair := range [][2]*AESStreamState{{enc, proxyDec}, {proxyEnc, dec}} {
+		buf := append([]byte(nil), msg...)
+		pair[0].stream.XORKeyStream(buf, buf)
+		pair[1].stream.XORKeyStream(buf, buf)
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("stream mismatch: %q", buf)
+		}
+	}
+}
+
+// TestSelfTest runs the selftest subcommand's session end to end.
+func TestSelfTest(t *testing.T) {
+	var out bytes.Buffer
+	if err := SelfTest(&out, 10*time.Second); err != nil {
+		t.Fatalf("SelfTest: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "selftest: OK") {
+		t.Errorf("output:\n%s", out.String())
+	}
+}
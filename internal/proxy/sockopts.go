@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// DefaultWindowClamp is the TCP window clamp of client connections when -W
+// is not given and no fake-TLS domain is set (DEFAULT_WINDOW_CLAMP in
+// mtproto-proxy.c).
+const DefaultWindowClamp = 131072
+
+// tcpKeepAliveCount is the number of unanswered keepalive probes after
+// which a connection is dropped, as in the C proxy (TCP_KEEPCNT 5).
+const tcpKeepAliveCount = 5
+
+// SocketOptions are the TCP options set on client sockets after accept and
+// on outbound sockets after connect. Zero values keep Go's defaults
+// (TCP_NODELAY on, keepalive every 15s). Only *net.TCPConn sockets are
+// tuned; a connection through an upstream proxy dialer keeps its own.
+type SocketOptions struct {
+	WindowClamp int           // TCP_WINDOW_CLAMP in bytes (-W; Linux only)
+	Nagle       bool          // leave Nagle's algorithm on, i.e. TCP_NODELAY off
+	KeepAlive   time.Duration // keepalive idle time and probe interval
+	UserTimeout time.Duration // TCP_USER_TIMEOUT: drop after data stays unacked this long (Linux only)
+}
+
+// apply sets o on conn.
+func (o SocketOptions) apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.Nagle {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.KeepAlive > 0 {
+		if err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     o.KeepAlive,
+			Interval: o.KeepAlive,
+			Count:    tcpKeepAliveCount,
+		}); err != nil {
+			return err
+		}
+	}
+	if o.WindowClamp <= 0 && o.UserTimeout <= 0 {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setTCPTuning(rc, o.WindowClamp, o.UserTimeout)
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, which the syscall package does not
+// define.
+const tcpUserTimeout = 0x12
+
+// setTCPTuning sets TCP_WINDOW_CLAMP to clamp bytes and TCP_USER_TIMEOUT to
+// userTimeout on the socket, skipping zero values.
+func setTCPTuning(rc syscall.RawConn, clamp int, userTimeout time.Duration) error {
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		if clamp > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_WINDOW_CLAMP, clamp); err != nil {
+				serr = fmt.Errorf("TCP_WINDOW_CLAMP %d: %w", clamp, err)
+				return
+			}
+		}
+		if userTimeout > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(userTimeout.Milliseconds())); err != nil {
+				serr = fmt.Errorf("TCP_USER_TIMEOUT %s: %w", userTimeout, err)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestIngressServer_SocketOptions checks that accepted connections get the
+// window clamp, user timeout and TCP_NODELAY setting.
+func TestIngressServer_SocketOptions(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan map[int]int, 1)
+	srv := NewIngressServer(addr, func(c net.Conn) {
+		defer c.Close()
+		rc, err := c.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		opts := make(map[int]int)
+		rc.Control(func(fd uintptr) {
+			for _, opt := range []int{syscall.TCP_WINDOW_CLAMP, tcpUserTimeout, syscall.TCP_NODELAY} {
+				v, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+				if err != nil {
+					t.Errorf("getsockopt %d: %v", opt, err)
+				}
+				opts[opt] = v
+			}
+		})
+		got <- opts
+	})
+	srv.SetSocketOptions(SocketOptions{WindowClamp: 65536, Nagle: true, KeepAlive: 40 * time.Second, UserTimeout: 30 * time.Second})
+	go srv.ListenAndServe(ctx)
+	dialRetry(t, addr).Close()
+
+	opts := <-got
+	if clamp := opts[syscall.TCP_WINDOW_CLAMP]; clamp != 65536 {
+		t.Errorf("TCP_WINDOW_CLAMP = %d, want 65536", clamp)
+	}
+	if ut := opts[tcpUserTimeout]; ut != 30000 {
+		t.Errorf("TCP_USER_TIMEOUT = %d, want 30000", ut)
+	}
+	if opts[syscall.TCP_NODELAY] != 0 {
+		t.Error("TCP_NODELAY set with Nagle")
+	}
+}
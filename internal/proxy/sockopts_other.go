@@ -0,0 +1,14 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"syscall"
+	"time"
+)
+
+// setTCPTuning does nothing outside Linux: like the C proxy built without
+// TCP_WINDOW_CLAMP, sockets keep the system's window and timeout.
+func setTCPTuning(rc syscall.RawConn, clamp int, userTimeout time.Duration) error {
+	return nil
+}
@@ -2,9 +2,13 @@ package proxy
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
 )
 
 // Stats содержит атомарные счётчики производительности прокси.
@@ -27,6 +31,10 @@ type Stats struct {
 	DroppedSimpleAck      int64
 	MtprotoProxyErrors    int64
 
+	// Forwarded queries carrying the proxy tag (-P) and without it
+	TaggedForwards   int64
+	UntaggedForwards int64
+
 	// ext_connections (client ↔ backend mapping table)
 	ExtConnections        int64
 	ExtConnectionsCreated int64
@@ -35,9 +43,210 @@ type Stats struct {
 	HTTPQueries    int64
 	HTTPBadHeaders int64
 
-	// Per-secret counters (sync.Map: string(hex secret) -> *int64)
+	// External authorizer decisions
+	AuthorizerDenied int64
+	AuthorizerErrors int64
+
+	// Connections rejected because the secret is outside its validity window
+	SecretWindowRejected int64
+
+	// Non-fatal config warnings found at startup
+	BootstrapWarnings int64
+
+	// DC frames rejected for exceeding the response size limit
+	OversizeResponses int64
+
+	// Outbound requests with no response within the first-byte timeout, and
+	// DC connections closed for stalling mid-frame
+	FirstByteTimeouts int64
+	ResponseStalls    int64
+
+	// 1, пока процесс в warm standby и не принимает соединения
+	Standby int64
+
+	// 1, если запросы не уходят к DC, а возвращаются эхом (--loopback-backend)
+	LoopbackBackend int64
+
+	// Кадры клиента, отклонённые лимитом размера, по виду кадра
+	FramesRejectedPreHandshake int64
+	FramesRejectedUnencrypted  int64
+	FramesRejectedEncrypted    int64
+
+	// Client transport pings answered by the ingress itself
+	PingsAnswered int64
+
+	// Active target probes (--health-check-interval) and how many failed
+	HealthChecks        int64
+	HealthCheckFailures int64
+
+	// Buffer pool (--msg-buffers-size), named as in the C proxy: pooled
+	// buffers and bytes handed out, buffers newly allocated, budget, and
+	// buffers handed out past it
+	BuffersUsed      int64
+	BuffersUsedBytes int64
+	BufferAllocs     int64
+	MaxBufferBytes   int64
+	BufferOverBudget int64
+
+	// Dial circuit breaker (--dial-backoff-max): circuits opened by a failed
+	// connect and connects refused while a circuit was open
+	CircuitOpens   int64
+	CircuitRejects int64
+
+	// Client frames dropped as exact repeats of a recent frame (--dedup-frames)
+	FramesDeduplicated int64
+
+	// Session affinity (--session-affinity): packets routed to the target
+	// pinned for their auth_key_id, packets that had to pick one, pins
+	// dropped for the entry cap, and pins held
+	AffinityHits      int64
+	AffinityMisses    int64
+	AffinityEvictions int64
+	AffinityEntries   int64
+
+	// Соединения, закрытые после удаления их секрета (--secret-revoke-grace)
+	SecretRevokedConnections int64
+
+	// CPU-профили, снятые автоматически при высокой нагрузке (--cpu-profile-dir)
+	CPUProfilesCaptured int64
+
+	// Fake TLS: completed handshakes, rejected clients (replays counted
+	// separately as well) and clients handed to the real domain
+	FakeTLSHandshakes int64
+	FakeTLSRejected   int64
+	FakeTLSReplays    int64
+	FakeTLSFallbacks  int64
+
+	// Соединения без валидного заголовка obfuscated2, переданные на
+	// --fallback-addr
+	DecoyRelayed int64
+	// Bytes of decoy relays moved by splice(2) without a copy to user space
+	SplicedBytes int64
+
+	// Frames for a DC with no cluster of its own in the config: routed to
+	// the default cluster, or dropped when there is none
+	UnknownDCFrames int64
+
+	// Changed configs applied since start (SIGHUP, --watch-config or
+	// --config-fetch-interval); lastConfigDiff is the summary of the latest
+	ConfigGeneration int64
+	lastConfigDiff   atomic.Pointer[string]
+
+	// Accepted connections by their first bytes (FirstBytes*)
+	FirstBytesTLS     int64
+	FirstBytesMTProto int64
+	FirstBytesOther   int64
+
+	// Overload shedding: connections rejected at accept, sessions closed
+	// on a frame, handshakes dropped
+	ShedAccept     int64
+	ShedFrames     int64
+	ShedHandshakes int64
+
+	// Бюджет горутин-обработчиков: лимит (0 = выключен), занято сейчас,
+	// соединений отклонено при accept из-за исчерпания
+	HandlerBudget         int64
+	HandlersActive        int64
+	HandlerBudgetRejected int64
+
+	// Всплески частоты соединений: 1 пока приём ужесточён, число всплесков,
+	// соединений отклонено при accept, базовая частота (соединений в минуту)
+	SurgeActive   int64
+	SurgeEvents   int64
+	SurgeRejected int64
+	SurgeBaseline int64
+
+	// Source IP blocklist: current size, rejected connections, new bans
+	BlocklistSize  int64
+	BlocklistHits  int64
+	BlocklistAdded int64
+
+	// Лимиты на IP источника: соединений отклонено по числу открытых
+	// (--max-conns-per-ip) и по частоте (--per-ip-accept-rate), IP в таблице
+	IPConnLimitRejected int64
+	IPRateLimitRejected int64
+	IPLimitTracked      int64
+
+	// Graceful shutdown progress: 1 while draining, connections still open,
+	// connections closed since drain started, connections force-closed
+	Draining           int64
+	DrainRemaining     int64
+	DrainedConnections int64
+	DrainForceClosed   int64
+
+	// Netfilter conntrack table gauges (0 when unavailable)
+	ConntrackCount int64
+	ConntrackMax   int64
+
+	// Расхождение настенных и монотонных часов: число скачков настенных
+	// часов, последний скачок и накопленное расхождение с запуска в мс,
+	// скорость ухода между скачками в ppm
+	ClockSteps      int64
+	ClockLastStepMs int64
+	ClockSkewMs     int64
+	ClockDriftPPM   int64
+
+	// UDP ingress (--udp-ports): открытые и всего созданные сессии,
+	// датаграммы от клиентов и к ним, отброшенные датаграммы (вне
+	// сессии, слишком далеко за пропуском номера, при переполнении очереди
+	// сессии) и отправленные cookie в ответ на датаграмму 0 без cookie
+	UDPSessionsActive   int64
+	UDPSessionsTotal    int64
+	UDPDatagramsIn      int64
+	UDPDatagramsOut     int64
+	UDPDatagramsDropped int64
+	UDPCookiesSent      int64
+
+	// Соединения по семействам адресов: клиентские (IPv4-mapped считаются
+	// IPv4), установленные к DC, и подключения к запасному target'у
+	// другого семейства (Happy Eyeballs)
+	ClientIPv4Connections   int64
+	ClientIPv6Connections   int64
+	OutboundIPv4Connects    int64
+	OutboundIPv6Connects    int64
+	OutboundFamilyFallbacks int64
+
+	// Запросы к canary и к стабильным target'ам: число, ошибки и
+	// суммарная задержка ответа в микросекундах
+	CanaryQueries   int64
+	CanaryErrors    int64
+	CanaryLatencyUs int64
+	StableQueries   int64
+	StableErrors    int64
+	StableLatencyUs int64
+
+	// Per-secret counters (sync.Map: secretFingerprint -> *int64). Keyed by
+	// fingerprint, not by position, so a reload that reorders or removes
+	// secrets does not move counts to another secret.
 	perSecretConnections sync.Map
 	perSecretAuthKeys    sync.Map
+	perSecretTraffic     sync.Map // secretFingerprint -> *secretTraffic
+	// secretIDs — отпечатки текущих секретов по порядку: secret_<N>_ в
+	// /stats — N-й из них
+	secretIDs atomic.Pointer[[]string]
+
+	// Per-accept-loop counters (sync.Map: loop index -> *int64)
+	perLoopAccepts sync.Map
+
+	// Frames routed per requested DC (sync.Map: signed DC id -> *int64)
+	perDCRouted sync.Map
+
+	// Queues and pools (sync.Map: name -> *QueueStats)
+	queues sync.Map
+
+	// Accept-to-handshake latency per client listener
+	// (sync.Map: listen addr -> *HandshakeLatency)
+	handshakes sync.Map
+
+	// Client connections by the local address they arrived on
+	// (sync.Map: local IP -> *localAddrStat)
+	localAddrs sync.Map
+
+	// Загрузчик proxy-multi.conf (--config-fetch-interval); nil, если выключен
+	configFetch atomic.Pointer[config.Fetcher]
+
+	// Вышестоящие прокси для исходящих соединений (--outbound-proxy); nil, если не заданы
+	upstreams atomic.Pointer[UpstreamProxies]
 
 	startTime time.Time
 }
@@ -60,6 +269,48 @@ func (s *Stats) DecActiveConnections() {
 	atomic.AddInt64(&s.ActiveConnections, -1)
 }
 
+// ObserveClientFamily учитывает клиентское соединение с адреса ip.
+func (s *Stats) ObserveClientFamily(ip net.IP) {
+	if ip.To4() != nil {
+		atomic.AddInt64(&s.ClientIPv4Connections, 1)
+	} else {
+		atomic.AddInt64(&s.ClientIPv6Connections, 1)
+	}
+}
+
+// ObserveLocalAddr учитывает клиентское соединение, пришедшее на локальный
+// адрес local; public — адрес, под которым он объявляется (--nat-info).
+func (s *Stats) ObserveLocalAddr(local, public net.IP) {
+	key := local.String()
+	v, ok := s.localAddrs.Load(key)
+	if !ok {
+		v, _ = s.localAddrs.LoadOrStore(key, &localAddrStat{public: public.String()})
+	}
+	v.(*localAddrStat).connections.Add(1)
+}
+
+// LocalAddrs возвращает счётчики соединений по локальным адресам,
+// отсортированные по адресу.
+func (s *Stats) LocalAddrs() []LocalAddrStatus {
+	var out []LocalAddrStatus
+	s.localAddrs.Range(func(k, v any) bool {
+		st := v.(*localAddrStat)
+		out = append(out, LocalAddrStatus{Local: k.(string), Public: st.public, Connections: st.connections.Load()})
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Local < out[j].Local })
+	return out
+}
+
+// ObserveOutboundFamily учитывает соединение с DC по адресу addr.
+func (s *Stats) ObserveOutboundFamily(addr net.Addr) {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.To4() == nil {
+		atomic.AddInt64(&s.OutboundIPv6Connects, 1)
+	} else {
+		atomic.AddInt64(&s.OutboundIPv4Connects, 1)
+	}
+}
+
 // AddBytesIn атомарно добавляет n к счётчику входящих байт.
 func (s *Stats) AddBytesIn(n int64) {
 	atomic.AddInt64(&s.BytesIn, n)
@@ -75,6 +326,16 @@ func (s *Stats) IncForwardedQuery() {
 	atomic.AddInt64(&s.TotForwardedQueries, 1)
 }
 
+// IncTaggedForward учитывает переданный запрос с proxy-тегом (tagged=true)
+// или без него.
+func (s *Stats) IncTaggedForward(tagged bool) {
+	if tagged {
+		atomic.AddInt64(&s.TaggedForwards, 1)
+	} else {
+		atomic.AddInt64(&s.UntaggedForwards, 1)
+	}
+}
+
 // IncDroppedQuery увеличивает счётчик отброшенных запросов.
 func (s *Stats) IncDroppedQuery() {
 	atomic.AddInt64(&s.DroppedQueries, 1)
@@ -106,81 +367,561 @@ func (s *Stats) IncHTTPQuery() {
 	atomic.AddInt64(&s.HTTPQueries, 1)
 }
 
-// secretKey возвращает строковый ключ для per-secret map.
-func secretKey(secretIndex int) string {
-	return fmt.Sprintf("%d", secretIndex)
+// IncAuthorizerDenied увеличивает счётчик соединений, отклонённых авторизатором.
+func (s *Stats) IncAuthorizerDenied() {
+	atomic.AddInt64(&s.AuthorizerDenied, 1)
+}
+
+// IncAuthorizerError увеличивает счётчик ошибок обращения к авторизатору.
+func (s *Stats) IncAuthorizerError() {
+	atomic.AddInt64(&s.AuthorizerErrors, 1)
+}
+
+// IncSecretWindowRejected увеличивает счётчик соединений с просроченным
+// или ещё не действующим секретом.
+func (s *Stats) IncSecretWindowRejected() {
+	atomic.AddInt64(&s.SecretWindowRejected, 1)
+}
+
+// SetBootstrapWarnings сохраняет число предупреждений разбора конфигурации
+// при запуске.
+func (s *Stats) SetBootstrapWarnings(n int) {
+	atomic.StoreInt64(&s.BootstrapWarnings, int64(n))
+}
+
+// IncOversizeResponse увеличивает счётчик слишком больших ответов DC.
+func (s *Stats) IncOversizeResponse() {
+	atomic.AddInt64(&s.OversizeResponses, 1)
+}
+
+// IncFirstByteTimeout увеличивает счётчик запросов, не получивших ответа DC
+// за время ожидания первого байта.
+func (s *Stats) IncFirstByteTimeout() {
+	atomic.AddInt64(&s.FirstByteTimeouts, 1)
+}
+
+// IncResponseStall увеличивает счётчик соединений с DC, закрытых из-за
+// остановки передачи посреди кадра.
+func (s *Stats) IncResponseStall() {
+	atomic.AddInt64(&s.ResponseStalls, 1)
+}
+
+// SetStandby отмечает, находится ли процесс в warm standby.
+func (s *Stats) SetStandby(on bool) {
+	var v int64
+	if on {
+		v = 1
+	}
+	atomic.StoreInt64(&s.Standby, v)
+}
+
+// IncFrameRejected увеличивает счётчик кадров, отклонённых лимитом размера
+// для вида kind (FrameKind*).
+func (s *Stats) IncFrameRejected(kind string) {
+	switch kind {
+	case FrameKindPreHandshake:
+		atomic.AddInt64(&s.FramesRejectedPreHandshake, 1)
+	case FrameKindUnencrypted:
+		atomic.AddInt64(&s.FramesRejectedUnencrypted, 1)
+	case FrameKindEncrypted:
+		atomic.AddInt64(&s.FramesRejectedEncrypted, 1)
+	}
+}
+
+// IncPingAnswered увеличивает счётчик транспортных пингов клиента,
+// на которые ingress ответил сам.
+func (s *Stats) IncPingAnswered() {
+	atomic.AddInt64(&s.PingsAnswered, 1)
+}
+
+// IncHealthCheck увеличивает счётчик активных проверок target'ов и, если
+// проверка не прошла, счётчик неудачных.
+func (s *Stats) IncHealthCheck(failed bool) {
+	atomic.AddInt64(&s.HealthChecks, 1)
+	if failed {
+		atomic.AddInt64(&s.HealthCheckFailures, 1)
+	}
+}
+
+// IncFrameDeduplicated увеличивает счётчик кадров клиента, отброшенных
+// как повтор недавнего кадра сессии.
+func (s *Stats) IncFrameDeduplicated() {
+	atomic.AddInt64(&s.FramesDeduplicated, 1)
+}
+
+// AddSecretRevoked добавляет n соединений, закрытых после удаления их секрета.
+func (s *Stats) AddSecretRevoked(n int64) {
+	atomic.AddInt64(&s.SecretRevokedConnections, n)
+}
+
+// IncCPUProfile увеличивает счётчик автоматически снятых CPU-профилей.
+func (s *Stats) IncCPUProfile() {
+	atomic.AddInt64(&s.CPUProfilesCaptured, 1)
+}
+
+// IncFakeTLSHandshake увеличивает счётчик успешных fake-TLS рукопожатий.
+func (s *Stats) IncFakeTLSHandshake() {
+	atomic.AddInt64(&s.FakeTLSHandshakes, 1)
+}
+
+// IncFakeTLSRejected увеличивает счётчик клиентов, не прошедших проверку
+// fake TLS по причине reason (FakeTLS*); повторы считаются и отдельно.
+func (s *Stats) IncFakeTLSRejected(reason string) {
+	atomic.AddInt64(&s.FakeTLSRejected, 1)
+	if reason == FakeTLSReplay {
+		atomic.AddInt64(&s.FakeTLSReplays, 1)
+	}
+}
+
+// IncFakeTLSFallback увеличивает счётчик клиентов, переданных на настоящий домен.
+func (s *Stats) IncFakeTLSFallback() {
+	atomic.AddInt64(&s.FakeTLSFallbacks, 1)
+}
+
+// ConfigApplied увеличивает номер поколения конфигурации и запоминает
+// сводку изменений diff применённой перезагрузки.
+func (s *Stats) ConfigApplied(diff string) {
+	atomic.AddInt64(&s.ConfigGeneration, 1)
+	s.lastConfigDiff.Store(&diff)
+}
+
+// LastConfigDiff возвращает сводку изменений последней применённой
+// перезагрузки конфигурации или "", если перезагрузок не было.
+func (s *Stats) LastConfigDiff() string {
+	if d := s.lastConfigDiff.Load(); d != nil {
+		return *d
+	}
+	return ""
+}
+
+// AddSplicedBytes добавляет n к счётчику байт, переданных через splice(2).
+func (s *Stats) AddSplicedBytes(n int64) {
+	atomic.AddInt64(&s.SplicedBytes, n)
+}
+
+// IncDecoyRelayed увеличивает счётчик соединений, переданных на --fallback-addr.
+func (s *Stats) IncDecoyRelayed() {
+	atomic.AddInt64(&s.DecoyRelayed, 1)
+}
+
+// IncFirstBytes увеличивает счётчик соединений, начавшихся с байтов вида
+// kind (FirstBytes*).
+func (s *Stats) IncFirstBytes(kind string) {
+	switch kind {
+	case FirstBytesTLS:
+		atomic.AddInt64(&s.FirstBytesTLS, 1)
+	case FirstBytesMTProto:
+		atomic.AddInt64(&s.FirstBytesMTProto, 1)
+	default:
+		atomic.AddInt64(&s.FirstBytesOther, 1)
+	}
+}
+
+// IncShedAccept увеличивает счётчик соединений, отклонённых при accept из-за перегрузки.
+func (s *Stats) IncShedAccept() {
+	atomic.AddInt64(&s.ShedAccept, 1)
+}
+
+// IncShedFrame увеличивает счётчик сессий, закрытых на кадре из-за перегрузки.
+func (s *Stats) IncShedFrame() {
+	atomic.AddInt64(&s.ShedFrames, 1)
+}
+
+// IncShedHandshake увеличивает счётчик рукопожатий, сброшенных из-за перегрузки.
+func (s *Stats) IncShedHandshake() {
+	atomic.AddInt64(&s.ShedHandshakes, 1)
 }
 
-// IncSecretConnections увеличивает счётчик активных соединений для секрета с индексом idx.
-func (s *Stats) IncSecretConnections(idx int) {
-	key := secretKey(idx)
-	v, _ := s.perSecretConnections.LoadOrStore(key, new(int64))
+// SetBlocklistSize обновляет число заблокированных IP.
+func (s *Stats) SetBlocklistSize(n int) {
+	atomic.StoreInt64(&s.BlocklistSize, int64(n))
+}
+
+// IncBlocklistHit увеличивает счётчик соединений, отклонённых блоклистом.
+func (s *Stats) IncBlocklistHit() {
+	atomic.AddInt64(&s.BlocklistHits, 1)
+}
+
+// IncBlocklistAdded увеличивает счётчик добавленных в блоклист IP.
+func (s *Stats) IncBlocklistAdded() {
+	atomic.AddInt64(&s.BlocklistAdded, 1)
+}
+
+// SetDrainProgress отмечает, что идёт drain, и обновляет его прогресс.
+func (s *Stats) SetDrainProgress(remaining, drained int) {
+	atomic.StoreInt64(&s.Draining, 1)
+	atomic.StoreInt64(&s.DrainRemaining, int64(remaining))
+	atomic.StoreInt64(&s.DrainedConnections, int64(drained))
+}
+
+// SetDrainForceClosed сохраняет число соединений, закрытых принудительно
+// по истечении drainTimeout.
+func (s *Stats) SetDrainForceClosed(n int) {
+	atomic.StoreInt64(&s.DrainForceClosed, int64(n))
+}
+
+// SetConntrack обновляет текущее заполнение и размер таблицы conntrack.
+func (s *Stats) SetConntrack(count, max int64) {
+	atomic.StoreInt64(&s.ConntrackCount, count)
+	atomic.StoreInt64(&s.ConntrackMax, max)
+}
+
+// RecordClockStep учитывает скачок настенных часов на step.
+func (s *Stats) RecordClockStep(step time.Duration) {
+	atomic.AddInt64(&s.ClockSteps, 1)
+	atomic.StoreInt64(&s.ClockLastStepMs, step.Milliseconds())
+}
+
+// SetClockSkew обновляет накопленное с запуска расхождение настенных часов
+// с монотонными.
+func (s *Stats) SetClockSkew(skew time.Duration) {
+	atomic.StoreInt64(&s.ClockSkewMs, skew.Milliseconds())
+}
+
+// SetClockDrift обновляет скорость ухода настенных часов от монотонных.
+func (s *Stats) SetClockDrift(ppm int64) {
+	atomic.StoreInt64(&s.ClockDriftPPM, ppm)
+}
+
+// SetSecrets задаёт текущий список секретов: secret_<N>_ в Snapshot —
+// счётчики N-го из них. Вызывается при старте и после каждой перезагрузки.
+func (s *Stats) SetSecrets(secrets [][]byte) {
+	ids := make([]string, len(secrets))
+	for i, secret := range secrets {
+		ids[i] = secretFingerprint(secret)
+	}
+	s.secretIDs.Store(&ids)
+}
+
+// IncSecretConnections увеличивает счётчик активных соединений секрета с
+// отпечатком id.
+func (s *Stats) IncSecretConnections(id string) {
+	v, _ := s.perSecretConnections.LoadOrStore(id, new(int64))
 	atomic.AddInt64(v.(*int64), 1)
 }
 
-// DecSecretConnections уменьшает счётчик активных соединений для секрета с индексом idx.
-func (s *Stats) DecSecretConnections(idx int) {
-	key := secretKey(idx)
-	if v, ok := s.perSecretConnections.Load(key); ok {
+// DecSecretConnections уменьшает счётчик активных соединений секрета с
+// отпечатком id.
+func (s *Stats) DecSecretConnections(id string) {
+	if v, ok := s.perSecretConnections.Load(id); ok {
 		atomic.AddInt64(v.(*int64), -1)
 	}
 }
 
-// GetSecretConnections возвращает текущее количество активных соединений для секрета.
-func (s *Stats) GetSecretConnections(idx int) int64 {
-	key := secretKey(idx)
-	if v, ok := s.perSecretConnections.Load(key); ok {
+// GetSecretConnections возвращает текущее количество активных соединений секрета.
+func (s *Stats) GetSecretConnections(id string) int64 {
+	if v, ok := s.perSecretConnections.Load(id); ok {
 		return atomic.LoadInt64(v.(*int64))
 	}
 	return 0
 }
 
-// IncSecretAuthKeys увеличивает счётчик активных auth_key для секрета с индексом idx.
-func (s *Stats) IncSecretAuthKeys(idx int) {
-	key := secretKey(idx)
-	v, _ := s.perSecretAuthKeys.LoadOrStore(key, new(int64))
+// IncSecretAuthKeys увеличивает счётчик активных auth_key секрета с
+// отпечатком id.
+func (s *Stats) IncSecretAuthKeys(id string) {
+	v, _ := s.perSecretAuthKeys.LoadOrStore(id, new(int64))
 	atomic.AddInt64(v.(*int64), 1)
 }
 
-// DecSecretAuthKeys уменьшает счётчик активных auth_key для секрета с индексом idx.
-func (s *Stats) DecSecretAuthKeys(idx int) {
-	key := secretKey(idx)
-	if v, ok := s.perSecretAuthKeys.Load(key); ok {
+// DecSecretAuthKeys уменьшает счётчик активных auth_key секрета с
+// отпечатком id.
+func (s *Stats) DecSecretAuthKeys(id string) {
+	if v, ok := s.perSecretAuthKeys.Load(id); ok {
 		atomic.AddInt64(v.(*int64), -1)
 	}
 }
 
 // GetSecretAuthKeys возвращает текущее количество активных auth_key для секрета.
-func (s *Stats) GetSecretAuthKeys(idx int) int64 {
-	key := secretKey(idx)
-	if v, ok := s.perSecretAuthKeys.Load(key); ok {
+func (s *Stats) GetSecretAuthKeys(id string) int64 {
+	if v, ok := s.perSecretAuthKeys.Load(id); ok {
 		return atomic.LoadInt64(v.(*int64))
 	}
 	return 0
 }
 
-// Snapshot возвращает снимок всех счётчиков в виде map для рендеринга.
+// secretTraffic — накопительные счётчики одного секрета: принятые
+// соединения, байты от клиента и к клиенту, отказы после того, как секрет
+// был опознан.
+type secretTraffic struct {
+	connections       atomic.Int64
+	bytesIn           atomic.Int64
+	bytesOut          atomic.Int64
+	handshakeFailures atomic.Int64
+}
+
+// secretTrafficFor возвращает счётчики секрета с отпечатком id, создавая
+// их при первом обращении. Ingress берёт их один раз на соединение, чтобы
+// не искать в map на каждом кадре.
+func (s *Stats) secretTrafficFor(id string) *secretTraffic {
+	v, _ := s.perSecretTraffic.LoadOrStore(id, new(secretTraffic))
+	return v.(*secretTraffic)
+}
+
+// add засчитывает in байт от клиента и out байт к клиенту; nil — no-op.
+func (t *secretTraffic) add(in, out int) {
+	if t == nil {
+		return
+	}
+	t.bytesIn.Add(int64(in))
+	t.bytesOut.Add(int64(out))
+}
+
+// IncSecretHandshakeFailure засчитывает секрету с отпечатком id
+// соединение, отклонённое после того, как секрет был опознан.
+func (s *Stats) IncSecretHandshakeFailure(id string) {
+	s.secretTrafficFor(id).handshakeFailures.Add(1)
+}
+
+// snapshotSecretTraffic добавляет в m накопительные счётчики секрета с
+// отпечатком id под префиксом prefix.
+func (s *Stats) snapshotSecretTraffic(m map[string]int64, prefix, id string) {
+	var t *secretTraffic
+	if v, ok := s.perSecretTraffic.Load(id); ok {
+		t = v.(*secretTraffic)
+	} else {
+		t = new(secretTraffic)
+	}
+	m[prefix+"connections"] = t.connections.Load()
+	m[prefix+"bytes_in"] = t.bytesIn.Load()
+	m[prefix+"bytes_out"] = t.bytesOut.Load()
+	m[prefix+"handshake_failures"] = t.handshakeFailures.Load()
+}
+
+// IncAcceptLoop увеличивает счётчик принятых соединений для accept-цикла loop.
+func (s *Stats) IncAcceptLoop(loop int) {
+	v, _ := s.perLoopAccepts.LoadOrStore(loop, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// IncDCRouted засчитывает кадр, направленный в кластер для DC dc
+// (запрошенного клиентом, со знаком). Вызывается только для DC со своим
+// кластером, кадры остальных считает IncUnknownDC.
+func (s *Stats) IncDCRouted(dc int) {
+	v, ok := s.perDCRouted.Load(dc)
+	if !ok {
+		v, _ = s.perDCRouted.LoadOrStore(dc, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// IncUnknownDC засчитывает кадр для DC без своего кластера.
+func (s *Stats) IncUnknownDC() {
+	atomic.AddInt64(&s.UnknownDCFrames, 1)
+}
+
+// GetAcceptLoop возвращает число соединений, принятых accept-циклом loop.
+func (s *Stats) GetAcceptLoop(loop int) int64 {
+	if v, ok := s.perLoopAccepts.Load(loop); ok {
+		return atomic.LoadInt64(v.(*int64))
+	}
+	return 0
+}
+
+// ObserveRoute учитывает запрос к canary (canary=true) или стабильному
+// target'у: задержку d и, если failed, ошибку.
+func (s *Stats) ObserveRoute(canary bool, d time.Duration, failed bool) {
+	queries, errs, latency := &s.StableQueries, &s.StableErrors, &s.StableLatencyUs
+	if canary {
+		queries, errs, latency = &s.CanaryQueries, &s.CanaryErrors, &s.CanaryLatencyUs
+	}
+	atomic.AddInt64(queries, 1)
+	atomic.AddInt64(latency, d.Microseconds())
+	if failed {
+		atomic.AddInt64(errs, 1)
+	}
+}
+
+// Queue возвращает статистику очереди или пула name, создавая её при
+// первом обращении.
+func (s *Stats) Queue(name string) *QueueStats {
+	if q, ok := s.queues.Load(name); ok {
+		return q.(*QueueStats)
+	}
+	q, _ := s.queues.LoadOrStore(name, &QueueStats{})
+	return q.(*QueueStats)
+}
+
+// Handshakes возвращает задержку рукопожатий для listener'а addr, создавая
+// её при первом обращении. На nil *Stats возвращает nil.
+func (s *Stats) Handshakes(addr string) *HandshakeLatency {
+	if s == nil {
+		return nil
+	}
+	if h, ok := s.handshakes.Load(addr); ok {
+		return h.(*HandshakeLatency)
+	}
+	h, _ := s.handshakes.LoadOrStore(addr, &HandshakeLatency{})
+	return h.(*HandshakeLatency)
+}
+
+// SetConfigFetcher подключает счётчики загрузчика конфигурации к снимку.
+func (s *Stats) SetConfigFetcher(f *config.Fetcher) {
+	s.configFetch.Store(f)
+}
+
+// SetUpstreamProxies подключает счётчики вышестоящих прокси к снимку.
+func (s *Stats) SetUpstreamProxies(u *UpstreamProxies) {
+	s.upstreams.Store(u)
+}
+
+// Snapshot возвращает снимок всех счётчиков в виде map для рендеринга;
+// per-secret счётчики — для первых secretCount секретов из SetSecrets.
 func (s *Stats) Snapshot(secretCount int) map[string]int64 {
 	m := map[string]int64{
-		"active_connections":           atomic.LoadInt64(&s.ActiveConnections),
-		"total_connections":            atomic.LoadInt64(&s.TotalConnections),
-		"bytes_in":                     atomic.LoadInt64(&s.BytesIn),
-		"bytes_out":                    atomic.LoadInt64(&s.BytesOut),
-		"tot_forwarded_queries":        atomic.LoadInt64(&s.TotForwardedQueries),
-		"tot_forwarded_responses":      atomic.LoadInt64(&s.TotForwardedResponses),
-		"dropped_queries":              atomic.LoadInt64(&s.DroppedQueries),
-		"dropped_responses":            atomic.LoadInt64(&s.DroppedResponses),
-		"tot_forwarded_simple_acks":    atomic.LoadInt64(&s.TotForwardedSimpleAck),
-		"dropped_simple_acks":          atomic.LoadInt64(&s.DroppedSimpleAck),
-		"mtproto_proxy_errors":         atomic.LoadInt64(&s.MtprotoProxyErrors),
-		"ext_connections":              atomic.LoadInt64(&s.ExtConnections),
-		"ext_connections_created":      atomic.LoadInt64(&s.ExtConnectionsCreated),
-		"http_queries":                 atomic.LoadInt64(&s.HTTPQueries),
-		"http_bad_headers":             atomic.LoadInt64(&s.HTTPBadHeaders),
+		"active_connections":            atomic.LoadInt64(&s.ActiveConnections),
+		"total_connections":             atomic.LoadInt64(&s.TotalConnections),
+		"bytes_in":                      atomic.LoadInt64(&s.BytesIn),
+		"bytes_out":                     atomic.LoadInt64(&s.BytesOut),
+		"tot_forwarded_queries":         atomic.LoadInt64(&s.TotForwardedQueries),
+		"tot_forwarded_responses":       atomic.LoadInt64(&s.TotForwardedResponses),
+		"dropped_queries":               atomic.LoadInt64(&s.DroppedQueries),
+		"dropped_responses":             atomic.LoadInt64(&s.DroppedResponses),
+		"tot_forwarded_simple_acks":     atomic.LoadInt64(&s.TotForwardedSimpleAck),
+		"dropped_simple_acks":           atomic.LoadInt64(&s.DroppedSimpleAck),
+		"mtproto_proxy_errors":          atomic.LoadInt64(&s.MtprotoProxyErrors),
+		"tagged_forwards":               atomic.LoadInt64(&s.TaggedForwards),
+		"untagged_forwards":             atomic.LoadInt64(&s.UntaggedForwards),
+		"ext_connections":               atomic.LoadInt64(&s.ExtConnections),
+		"ext_connections_created":       atomic.LoadInt64(&s.ExtConnectionsCreated),
+		"http_queries":                  atomic.LoadInt64(&s.HTTPQueries),
+		"http_bad_headers":              atomic.LoadInt64(&s.HTTPBadHeaders),
+		"authorizer_denied":             atomic.LoadInt64(&s.AuthorizerDenied),
+		"authorizer_errors":             atomic.LoadInt64(&s.AuthorizerErrors),
+		"rejected_by_secret_window":     atomic.LoadInt64(&s.SecretWindowRejected),
+		"bootstrap_warnings":            atomic.LoadInt64(&s.BootstrapWarnings),
+		"oversize_responses":            atomic.LoadInt64(&s.OversizeResponses),
+		"first_byte_timeouts":           atomic.LoadInt64(&s.FirstByteTimeouts),
+		"response_stalls":               atomic.LoadInt64(&s.ResponseStalls),
+		"frames_rejected_pre_handshake": atomic.LoadInt64(&s.FramesRejectedPreHandshake),
+		"frames_rejected_unencrypted":   atomic.LoadInt64(&s.FramesRejectedUnencrypted),
+		"frames_rejected_encrypted":     atomic.LoadInt64(&s.FramesRejectedEncrypted),
+		"client_pings_answered":         atomic.LoadInt64(&s.PingsAnswered),
+		"health_checks":                 atomic.LoadInt64(&s.HealthChecks),
+		"health_check_failures":         atomic.LoadInt64(&s.HealthCheckFailures),
+		"total_used_buffers":            atomic.LoadInt64(&s.BuffersUsed),
+		"total_used_buffers_size":       atomic.LoadInt64(&s.BuffersUsedBytes),
+		"buffer_chunk_alloc_ops":        atomic.LoadInt64(&s.BufferAllocs),
+		"max_allocated_buffer_bytes":    atomic.LoadInt64(&s.MaxBufferBytes),
+		"buffers_over_budget":           atomic.LoadInt64(&s.BufferOverBudget),
+		"circuit_opens":                 atomic.LoadInt64(&s.CircuitOpens),
+		"circuit_rejects":               atomic.LoadInt64(&s.CircuitRejects),
+		"affinity_hits":                 atomic.LoadInt64(&s.AffinityHits),
+		"affinity_misses":               atomic.LoadInt64(&s.AffinityMisses),
+		"affinity_evictions":            atomic.LoadInt64(&s.AffinityEvictions),
+		"affinity_entries":              atomic.LoadInt64(&s.AffinityEntries),
+		"client_frames_deduplicated":    atomic.LoadInt64(&s.FramesDeduplicated),
+		"cpu_profiles_captured":         atomic.LoadInt64(&s.CPUProfilesCaptured),
+		"revoked_secret_connections":    atomic.LoadInt64(&s.SecretRevokedConnections),
+		"faketls_handshakes":            atomic.LoadInt64(&s.FakeTLSHandshakes),
+		"faketls_rejected":              atomic.LoadInt64(&s.FakeTLSRejected),
+		"faketls_replays":               atomic.LoadInt64(&s.FakeTLSReplays),
+		"faketls_fallbacks":             atomic.LoadInt64(&s.FakeTLSFallbacks),
+		"decoy_relayed":                 atomic.LoadInt64(&s.DecoyRelayed),
+		"spliced_bytes":                 atomic.LoadInt64(&s.SplicedBytes),
+		"unknown_dc_frames":             atomic.LoadInt64(&s.UnknownDCFrames),
+		"config_generation":             atomic.LoadInt64(&s.ConfigGeneration),
+		"first_bytes_tls":               atomic.LoadInt64(&s.FirstBytesTLS),
+		"first_bytes_mtproto":           atomic.LoadInt64(&s.FirstBytesMTProto),
+		"first_bytes_other":             atomic.LoadInt64(&s.FirstBytesOther),
+		"standby":                       atomic.LoadInt64(&s.Standby),
+		"loopback_backend":              atomic.LoadInt64(&s.LoopbackBackend),
+		"overload_shed_accept":          atomic.LoadInt64(&s.ShedAccept),
+		"overload_shed_frames":          atomic.LoadInt64(&s.ShedFrames),
+		"overload_shed_handshakes":      atomic.LoadInt64(&s.ShedHandshakes),
+		"handler_budget":                atomic.LoadInt64(&s.HandlerBudget),
+		"handlers_active":               atomic.LoadInt64(&s.HandlersActive),
+		"handler_budget_rejected":       atomic.LoadInt64(&s.HandlerBudgetRejected),
+		"surge_active":                  atomic.LoadInt64(&s.SurgeActive),
+		"surge_events":                  atomic.LoadInt64(&s.SurgeEvents),
+		"surge_rejected":                atomic.LoadInt64(&s.SurgeRejected),
+		"conn_rate_baseline_per_min":    atomic.LoadInt64(&s.SurgeBaseline),
+		"blocklist_size":                atomic.LoadInt64(&s.BlocklistSize),
+		"blocklist_hits":                atomic.LoadInt64(&s.BlocklistHits),
+		"blocklist_added":               atomic.LoadInt64(&s.BlocklistAdded),
+		"ip_conn_limit_rejected":        atomic.LoadInt64(&s.IPConnLimitRejected),
+		"ip_rate_limit_rejected":        atomic.LoadInt64(&s.IPRateLimitRejected),
+		"ip_limit_tracked":              atomic.LoadInt64(&s.IPLimitTracked),
+		"draining":                      atomic.LoadInt64(&s.Draining),
+		"drain_remaining_connections":   atomic.LoadInt64(&s.DrainRemaining),
+		"drain_closed_connections":      atomic.LoadInt64(&s.DrainedConnections),
+		"drain_force_closed":            atomic.LoadInt64(&s.DrainForceClosed),
+		"conntrack_count":               atomic.LoadInt64(&s.ConntrackCount),
+		"conntrack_max":                 atomic.LoadInt64(&s.ConntrackMax),
+		"clock_steps":                   atomic.LoadInt64(&s.ClockSteps),
+		"clock_last_step_ms":            atomic.LoadInt64(&s.ClockLastStepMs),
+		"clock_skew_ms":                 atomic.LoadInt64(&s.ClockSkewMs),
+		"clock_drift_ppm":               atomic.LoadInt64(&s.ClockDriftPPM),
+		"udp_sessions_active":           atomic.LoadInt64(&s.UDPSessionsActive),
+		"udp_sessions_total":            atomic.LoadInt64(&s.UDPSessionsTotal),
+		"udp_datagrams_in":              atomic.LoadInt64(&s.UDPDatagramsIn),
+		"udp_datagrams_out":             atomic.LoadInt64(&s.UDPDatagramsOut),
+		"udp_datagrams_dropped":         atomic.LoadInt64(&s.UDPDatagramsDropped),
+		"udp_cookies_sent":              atomic.LoadInt64(&s.UDPCookiesSent),
+		"client_ipv4_connections":       atomic.LoadInt64(&s.ClientIPv4Connections),
+		"client_ipv6_connections":       atomic.LoadInt64(&s.ClientIPv6Connections),
+		"outbound_ipv4_connects":        atomic.LoadInt64(&s.OutboundIPv4Connects),
+		"outbound_ipv6_connects":        atomic.LoadInt64(&s.OutboundIPv6Connects),
+		"outbound_family_fallbacks":     atomic.LoadInt64(&s.OutboundFamilyFallbacks),
+		"canary_queries":                atomic.LoadInt64(&s.CanaryQueries),
+		"canary_errors":                 atomic.LoadInt64(&s.CanaryErrors),
+		"canary_latency_us_total":       atomic.LoadInt64(&s.CanaryLatencyUs),
+		"stable_queries":                atomic.LoadInt64(&s.StableQueries),
+		"stable_errors":                 atomic.LoadInt64(&s.StableErrors),
+		"stable_latency_us_total":       atomic.LoadInt64(&s.StableLatencyUs),
+	}
+	var ids []string
+	if p := s.secretIDs.Load(); p != nil {
+		ids = *p
 	}
 	for i := 0; i < secretCount; i++ {
-		m[fmt.Sprintf("secret_%d_active_connections", i+1)] = s.GetSecretConnections(i)
-		m[fmt.Sprintf("secret_%d_active_auth_keys", i+1)] = s.GetSecretAuthKeys(i)
+		id := "" // секрет, которого ещё нет в SetSecrets, без счётчиков
+		if i < len(ids) {
+			id = ids[i]
+		}
+		prefix := fmt.Sprintf("secret_%d_", i+1)
+		m[prefix+"active_connections"] = s.GetSecretConnections(id)
+		m[prefix+"active_auth_keys"] = s.GetSecretAuthKeys(id)
+		s.snapshotSecretTraffic(m, prefix, id)
+	}
+	s.perLoopAccepts.Range(func(k, v any) bool {
+		m[fmt.Sprintf("accept_loop_%d_accepted", k.(int))] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	s.perDCRouted.Range(func(k, v any) bool {
+		m[fmt.Sprintf("dc_%d_routed_frames", k.(int))] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	s.queues.Range(func(k, v any) bool {
+		prefix, q := "queue_"+k.(string)+"_", v.(*QueueStats)
+		m[prefix+"depth"] = q.depth.Load()
+		m[prefix+"capacity"] = q.capacity.Load()
+		m[prefix+"wait_p95_us"] = q.WaitP95().Microseconds()
+		m[prefix+"rejected"] = q.rejected.Load()
+		return true
+	})
+	s.handshakes.Range(func(k, v any) bool {
+		prefix, h := "listener_"+listenerStatsName(k.(string))+"_", v.(*HandshakeLatency)
+		ps := h.Percentiles(50, 95, 99)
+		m[prefix+"handshakes"] = h.Count()
+		m[prefix+"handshake_p50_us"] = ps[0].Microseconds()
+		m[prefix+"handshake_p95_us"] = ps[1].Microseconds()
+		m[prefix+"handshake_p99_us"] = ps[2].Microseconds()
+		return true
+	})
+	s.localAddrs.Range(func(k, v any) bool {
+		m["local_addr_"+k.(string)+"_connections"] = v.(*localAddrStat).connections.Load()
+		return true
+	})
+	if f := s.configFetch.Load(); f != nil {
+		fs := f.Stats()
+		m["config_fetch_total"] = fs.Fetches
+		m["config_fetch_not_modified"] = fs.NotModified
+		m["config_fetch_updates"] = fs.Updates
+		m["config_fetch_errors"] = fs.Errors
+		m["config_fetch_last_success"] = fs.LastSuccess
+	}
+	if u := s.upstreams.Load(); u != nil {
+		u.snapshot(m)
 	}
 	return m
 }
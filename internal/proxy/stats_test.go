@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"sync"
 	"testing"
 )
@@ -42,20 +43,20 @@ func TestStats_ByteCounters(t *testing.T) {
 
 func TestStats_PerSecret(t *testing.T) {
 	s := NewStats()
-	s.IncSecretConnections(0)
-	s.IncSecretConnections(0)
-	s.IncSecretConnections(1)
+	s.IncSecretConnections("a")
+	s.IncSecretConnections("a")
+	s.IncSecretConnections("b")
 
-	if got := s.GetSecretConnections(0); got != 2 {
-		t.Errorf("secret 0 connections = %d, want 2", got)
+	if got := s.GetSecretConnections("a"); got != 2 {
+		t.Errorf("secret a connections = %d, want 2", got)
 	}
-	if got := s.GetSecretConnections(1); got != 1 {
-		t.Errorf("secret 1 connections = %d, want 1", got)
+	if got := s.GetSecretConnections("b"); got != 1 {
+		t.Errorf("secret b connections = %d, want 1", got)
 	}
 
-	s.DecSecretConnections(0)
-	if got := s.GetSecretConnections(0); got != 1 {
-		t.Errorf("secret 0 connections after dec = %d, want 1", got)
+	s.DecSecretConnections("a")
+	if got := s.GetSecretConnections("a"); got != 1 {
+		t.Errorf("secret a connections after dec = %d, want 1", got)
 	}
 }
 
@@ -82,9 +83,11 @@ func TestStats_Concurrent(t *testing.T) {
 
 func TestStats_Snapshot(t *testing.T) {
 	s := NewStats()
+	secrets := [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)}
+	s.SetSecrets(secrets)
 	s.IncActiveConnections()
-	s.IncSecretConnections(0)
-	s.IncSecretAuthKeys(0)
+	s.IncSecretConnections(secretFingerprint(secrets[0]))
+	s.IncSecretAuthKeys(secretFingerprint(secrets[0]))
 
 	snap := s.Snapshot(2)
 
@@ -102,3 +105,78 @@ func TestStats_Snapshot(t *testing.T) {
 		t.Errorf("snapshot secret_2_active_connections = %d, want 0", snap["secret_2_active_connections"])
 	}
 }
+
+func TestStats_AcceptLoops(t *testing.T) {
+	s := NewStats()
+	s.IncAcceptLoop(0)
+	s.IncAcceptLoop(1)
+	s.IncAcceptLoop(1)
+
+	if got := s.GetAcceptLoop(1); got != 2 {
+		t.Errorf("GetAcceptLoop(1) = %d, want 2", got)
+	}
+	snap := s.Snapshot(0)
+	if snap["accept_loop_0_accepted"] != 1 {
+		t.Errorf("accept_loop_0_accepted = %d, want 1", snap["accept_loop_0_accepted"])
+	}
+	if _, ok := snap["accept_loop_2_accepted"]; ok {
+		t.Error("unused loop must not appear in snapshot")
+	}
+}
+
+func TestStats_SecretTraffic(t *testing.T) {
+	s := NewStats()
+	secrets := [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)}
+	s.SetSecrets(secrets)
+	id := secretFingerprint(secrets[1])
+	tr := s.secretTrafficFor(id)
+	tr.connections.Add(1)
+	tr.add(100, 0)
+	tr.add(0, 40)
+	s.IncSecretHandshakeFailure(id)
+	s.IncSecretHandshakeFailure(id)
+	var none *secretTraffic
+	none.add(1, 1) // legacy no-secret connection
+
+	snap := s.Snapshot(2)
+	want := map[string]int64{
+		"secret_2_connections":        1,
+		"secret_2_bytes_in":           100,
+		"secret_2_bytes_out":          40,
+		"secret_2_handshake_failures": 2,
+		"secret_1_connections":        0,
+		"secret_1_bytes_in":           0,
+	}
+	for k, v := range want {
+		got, ok := snap[k]
+		if !ok || got != v {
+			t.Errorf("%s = %d (present %v), want %d", k, got, ok, v)
+		}
+	}
+}
+
+// TestStats_SecretReorder checks that per-secret counters follow the secret
+// when a reload reorders or removes secrets.
+func TestStats_SecretReorder(t *testing.T) {
+	s := NewStats()
+	a, b := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	s.SetSecrets([][]byte{a, b})
+	s.IncSecretConnections(secretFingerprint(b))
+	s.secretTrafficFor(secretFingerprint(b)).add(100, 0)
+
+	s.SetSecrets([][]byte{b})
+	snap := s.Snapshot(1)
+	if snap["secret_1_active_connections"] != 1 || snap["secret_1_bytes_in"] != 100 {
+		t.Errorf("after removing the first secret: %d connections, %d bytes in, want 1 and 100",
+			snap["secret_1_active_connections"], snap["secret_1_bytes_in"])
+	}
+
+	// the connection of b ends after a reload that put a back in front
+	s.SetSecrets([][]byte{a, b})
+	s.DecSecretConnections(secretFingerprint(b))
+	snap = s.Snapshot(2)
+	if snap["secret_1_active_connections"] != 0 || snap["secret_2_active_connections"] != 0 {
+		t.Errorf("active connections: secret_1=%d secret_2=%d, want 0 and 0",
+			snap["secret_1_active_connections"], snap["secret_2_active_connections"])
+	}
+}
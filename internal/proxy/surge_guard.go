@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// surgeWindow is how many of the most recent seconds of accepts are
+	// compared with the baseline.
+	surgeWindow = 10
+
+	// surgeAllowance is the accept rate allowed while tightened, as a
+	// multiple of the baseline rate.
+	surgeAllowance = 2
+
+	// surgeHeaderTimeout replaces clientHeaderTimeout while tightened, so
+	// connections that never send a header release their slot sooner.
+	surgeHeaderTimeout = 5 * time.Second
+
+	// surgeBaselineWeight is the weight of the latest minute in the
+	// baseline moving average.
+	surgeBaselineWeight = 0.2
+)
+
+// SurgeGuard damps connection floods without external tooling. It learns a
+// baseline of accepted connections per minute and, when the rate over the
+// last surgeWindow seconds exceeds factor times that baseline, tightens
+// admission for a cool-down period: new connections beyond twice the
+// baseline rate are closed at accept time and clients get a shorter
+// deadline for their handshake header. The cool-down restarts while the
+// spike lasts, and the baseline is not updated while tightened so the
+// attack does not become the new normal. A nil *SurgeGuard admits
+// everything.
+type SurgeGuard struct {
+	factor   float64
+	minRate  float64 // connections per minute below which no surge is declared
+	cooldown time.Duration
+	stats    *Stats
+	stop     chan struct{}
+
+	arrivals atomic.Int64 // accepts in the current second
+	tokens   atomic.Int64 // accepts left in the current second while tightened
+	active   atomic.Bool
+
+	// Only tick touches the fields below.
+	secs     [60]int64 // accepts per second, ring
+	pos      int
+	filled   int
+	baseline float64 // connections per minute; 0 until the first full minute
+	until    time.Time
+}
+
+// NewSurgeGuard creates a guard that tightens admission for cooldown once
+// the connection rate reaches factor times the baseline and at least
+// minRate connections per minute.
+func NewSurgeGuard(factor float64, minRate int, cooldown time.Duration, stats *Stats) *SurgeGuard {
+	return &SurgeGuard{
+		factor:   factor,
+		minRate:  float64(minRate),
+		cooldown: cooldown,
+		stats:    stats,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start begins the once-a-second rate evaluation.
+func (g *SurgeGuard) Start() {
+	go runEvery(time.Second, g.stop, func() { g.tick(time.Now()) })
+}
+
+// Stop ends the rate evaluation.
+func (g *SurgeGuard) Stop() {
+	close(g.stop)
+}
+
+// Admit counts a freshly accepted connection and reports whether it may
+// proceed.
+func (g *SurgeGuard) Admit() bool {
+	if g == nil {
+		return true
+	}
+	g.arrivals.Add(1)
+	if !g.active.Load() || g.tokens.Add(-1) >= 0 {
+		return true
+	}
+	if g.stats != nil {
+		atomic.AddInt64(&g.stats.SurgeRejected, 1)
+	}
+	return false
+}
+
+// HeaderTimeout returns d, or surgeHeaderTimeout if that is shorter and
+// admission is tightened.
+func (g *SurgeGuard) HeaderTimeout(d time.Duration) time.Duration {
+	if g == nil || !g.active.Load() {
+		return d
+	}
+	return min(d, surgeHeaderTimeout)
+}
+
+// Active reports whether admission is tightened.
+func (g *SurgeGuard) Active() bool {
+	return g != nil && g.active.Load()
+}
+
+// tick closes the current second: it records its accepts, updates the
+// baseline once a minute and enters or leaves the tightened state.
+func (g *SurgeGuard) tick(now time.Time) {
+	g.secs[g.pos] = g.arrivals.Swap(0)
+	g.pos = (g.pos + 1) % len(g.secs)
+	g.filled = min(g.filled+1, len(g.secs))
+
+	active := g.active.Load()
+	if g.pos == 0 && g.filled == len(g.secs) && !active {
+		var minute int64
+		for _, n := range g.secs {
+			minute += n
+		}
+		if g.baseline == 0 {
+			g.baseline = float64(minute)
+		} else {
+			g.baseline += surgeBaselineWeight * (float64(minute) - g.baseline)
+		}
+	}
+
+	var recent int64
+	for i := 1; i <= min(surgeWindow, g.filled); i++ {
+		recent += g.secs[(g.pos-i+len(g.secs))%len(g.secs)]
+	}
+	rate := float64(recent) * 60 / surgeWindow
+	threshold := max(g.factor*g.baseline, g.minRate)
+
+	switch {
+	case g.baseline > 0 && rate >= threshold:
+		if !active {
+			log.Printf("surge guard: ALERT %.0f connections/min, baseline %.0f/min; tightening admission for %s",
+				rate, g.baseline, g.cooldown)
+			g.active.Store(true)
+			active = true
+			if g.stats != nil {
+				atomic.AddInt64(&g.stats.SurgeEvents, 1)
+				atomic.StoreInt64(&g.stats.SurgeActive, 1)
+			}
+		}
+		g.until = now.Add(g.cooldown)
+	case active && !now.Before(g.until):
+		log.Printf("surge guard: rate back to %.0f connections/min, baseline %.0f/min; admission restored", rate, g.baseline)
+		g.active.Store(false)
+		active = false
+		if g.stats != nil {
+			atomic.StoreInt64(&g.stats.SurgeActive, 0)
+		}
+	}
+	if active {
+		g.tokens.Store(max(int64(g.baseline*surgeAllowance/60), 1))
+	}
+	if g.stats != nil {
+		atomic.StoreInt64(&g.stats.SurgeBaseline, int64(g.baseline))
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// feed admits n connections and closes the second at now.
+func feed(g *SurgeGuard, n int, now time.Time) (rejected int) {
+	for i := 0; i < n; i++ {
+		if !g.Admit() {
+			rejected++
+		}
+	}
+	g.tick(now)
+	return rejected
+}
+
+func TestSurgeGuard(t *testing.T) {
+	stats := NewStats()
+	g := NewSurgeGuard(10, 60, 30*time.Second, stats)
+	now := time.Unix(1700000000, 0)
+
+	// One minute at 2 connections per second sets a 120/min baseline.
+	for i := 0; i < 60; i++ {
+		now = now.Add(time.Second)
+		feed(g, 2, now)
+	}
+	if g.baseline != 120 || g.Active() {
+		t.Fatalf("after first minute: baseline %v, active %v", g.baseline, g.Active())
+	}
+
+	// 300 connections in one second is 1800/min over the 10s window,
+	// above 10x the baseline.
+	now = now.Add(time.Second)
+	feed(g, 300, now)
+	if !g.Active() {
+		t.Fatal("spike did not tighten admission")
+	}
+	if got := g.HeaderTimeout(clientHeaderTimeout); got != surgeHeaderTimeout {
+		t.Errorf("HeaderTimeout = %s, want %s", got, surgeHeaderTimeout)
+	}
+
+	// Twice the baseline is 4 connections per second.
+	now = now.Add(time.Second)
+	if rejected := feed(g, 10, now); rejected != 6 {
+		t.Errorf("rejected %d of 10, want 6", rejected)
+	}
+
+	// Back to normal: the cool-down runs from the last second over the
+	// threshold, and the spike stays in the 10s window for a while.
+	for i := 0; i < 40 && g.Active(); i++ {
+		now = now.Add(time.Second)
+		feed(g, 2, now)
+	}
+	if g.Active() {
+		t.Fatal("admission still tightened after the cool-down")
+	}
+	if g.HeaderTimeout(clientHeaderTimeout) != clientHeaderTimeout {
+		t.Error("header timeout not restored")
+	}
+	snap := stats.Snapshot(0)
+	if snap["surge_events"] != 1 || snap["surge_rejected"] != 6 || snap["surge_active"] != 0 || snap["conn_rate_baseline_per_min"] != 120 {
+		t.Errorf("stats: events %d, rejected %d, active %d, baseline %d", snap["surge_events"], snap["surge_rejected"],
+			snap["surge_active"], snap["conn_rate_baseline_per_min"])
+	}
+}
+
+func TestSurgeGuard_NoBaselineNoSurge(t *testing.T) {
+	g := NewSurgeGuard(2, 0, time.Minute, nil)
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 30; i++ {
+		now = now.Add(time.Second)
+		feed(g, 1000, now)
+	}
+	if g.Active() {
+		t.Error("surge declared before a baseline was learned")
+	}
+	var nilGuard *SurgeGuard
+	if !nilGuard.Admit() || nilGuard.HeaderTimeout(time.Second) != time.Second {
+		t.Error("nil guard restricts admission")
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Circuit breaker states of a target, reported as circuit.
+const (
+	CircuitClosed   = "closed"    // connects go ahead
+	CircuitOpen     = "open"      // connects are refused until the backoff ends
+	CircuitHalfOpen = "half-open" // the backoff ended; the next connect is a trial
+)
+
+// Dial backoff defaults (--dial-backoff-max).
+const (
+	DefaultDialBackoffInitial = time.Second
+	DefaultDialBackoffMax     = time.Minute
+)
+
+// dialBackoffJitter spreads each backoff by up to ±20%, so targets that
+// failed together are not retried in lockstep.
+const dialBackoffJitter = 0.2
+
+// ErrCircuitOpen is returned instead of connecting to a target whose
+// circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitOpenError tells until when connects to Addr are refused.
+type CircuitOpenError struct {
+	Addr    string
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %v until %s", e.Addr, ErrCircuitOpen, e.RetryAt.UTC().Format(time.RFC3339))
+}
+
+func (e *CircuitOpenError) Unwrap() error { return ErrCircuitOpen }
+
+// SetDialBackoff enables the per-target circuit breaker: a failed connect
+// opens the target's circuit for initial, doubling with every further
+// failed connect up to maxBackoff, and a successful one closes it. With
+// maxBackoff 0 the breaker is off and every connect goes ahead. Must be
+// called before the first connect.
+func (h *TargetHealth) SetDialBackoff(initial, maxBackoff time.Duration) {
+	h.backoffInitial = min(initial, maxBackoff)
+	h.backoffMax = maxBackoff
+}
+
+// allowDial reports whether a connect to addr may go ahead at now, turning
+// an open circuit whose backoff ended half-open. Otherwise it returns a
+// *CircuitOpenError.
+func (h *TargetHealth) allowDial(addr string, now time.Time) error {
+	if h.backoffMax <= 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.targets[addr]
+	if !ok || st.Circuit != CircuitOpen {
+		return nil
+	}
+	if now.Before(st.CircuitRetryAt) {
+		return &CircuitOpenError{Addr: addr, RetryAt: st.CircuitRetryAt}
+	}
+	st.Circuit = CircuitHalfOpen
+	return nil
+}
+
+// dialFailed opens the circuit of addr after a failed connect at now, for
+// twice the previous backoff (initial after a success), and marks the
+// target unhealthy. It returns the backoff and whether the circuit was
+// closed before.
+func (h *TargetHealth) dialFailed(addr string, now time.Time) (time.Duration, bool) {
+	if h.backoffMax <= 0 {
+		return 0, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.status(addr)
+	backoff := h.backoffInitial
+	if st.BackoffMs > 0 {
+		backoff = min(2*time.Duration(st.BackoffMs)*time.Millisecond, h.backoffMax)
+	}
+	wasClosed := st.Circuit != CircuitOpen && st.Circuit != CircuitHalfOpen
+	h.setHealthy(st, false)
+	st.Circuit = CircuitOpen
+	st.BackoffMs = backoff.Milliseconds()
+	jitter := 1 + dialBackoffJitter*(2*rand.Float64()-1)
+	st.CircuitRetryAt = now.Add(time.Duration(float64(backoff) * jitter))
+	return backoff, wasClosed
+}
+
+// dialSucceeded closes the circuit of addr and resets its backoff.
+func (h *TargetHealth) dialSucceeded(addr string) {
+	if h.backoffMax <= 0 {
+		return
+	}
+	h.mu.Lock()
+	st := h.status(addr)
+	st.Circuit = CircuitClosed
+	st.BackoffMs = 0
+	st.CircuitRetryAt = time.Time{}
+	h.mu.Unlock()
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTargetHealth_DialBackoff(t *testing.T) {
+	h := NewTargetHealth()
+	h.SetDialBackoff(time.Second, 4*time.Second)
+	at := time.Unix(1700000000, 0)
+	addr := "10.0.0.1:8888"
+
+	if err := h.allowDial(addr, at); err != nil {
+		t.Fatalf("unknown target refused: %v", err)
+	}
+	backoff, opened := h.dialFailed(addr, at)
+	if backoff != time.Second || !opened {
+		t.Fatalf("first failure: backoff %s, opened %v", backoff, opened)
+	}
+	st := h.Targets()[0]
+	if st.Circuit != CircuitOpen || st.Healthy || st.BackoffMs != 1000 {
+		t.Fatalf("after first failure: %+v", st)
+	}
+	if d := st.CircuitRetryAt.Sub(at); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+		t.Errorf("retry after %s, want 1s ±20%%", d)
+	}
+	var open *CircuitOpenError
+	if err := h.allowDial(addr, at.Add(500*time.Millisecond)); !errors.As(err, &open) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("dial during backoff: %v", err)
+	}
+
+	// The backoff ended: one trial goes ahead, and its failure doubles it.
+	if err := h.allowDial(addr, at.Add(2*time.Second)); err != nil {
+		t.Fatalf("dial after backoff: %v", err)
+	}
+	if st := h.Targets()[0]; st.Circuit != CircuitHalfOpen {
+		t.Fatalf("after backoff: circuit %s, want %s", st.Circuit, CircuitHalfOpen)
+	}
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if backoff, opened := h.dialFailed(addr, at); backoff != want || opened {
+			t.Errorf("backoff %s, opened %v; want %s, false", backoff, opened, want)
+		}
+	}
+
+	// A refused dial keeps the error that opened the circuit.
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	h.Failure(addr, refused, at)
+	h.Failure(addr, h.allowDial(addr, at), at)
+	if st := h.Targets()[0]; st.LastErrorKind != TargetErrRefused || st.ConsecutiveFailures != 2 {
+		t.Errorf("after a refused dial: %+v", st)
+	}
+
+	h.dialSucceeded(addr)
+	if st := h.Targets()[0]; st.Circuit != CircuitClosed || st.BackoffMs != 0 || !st.CircuitRetryAt.IsZero() {
+		t.Errorf("after a connect: %+v", st)
+	}
+	if _, opened := h.dialFailed(addr, at); !opened {
+		t.Error("failure after a connect did not open the circuit")
+	}
+
+	off := NewTargetHealth()
+	off.dialFailed(addr, at)
+	if err := off.allowDial(addr, at); err != nil || len(off.Targets()) != 0 {
+		t.Errorf("breaker off: %v, %+v", err, off.Targets())
+	}
+}
+
+func TestOutboundProxy_CircuitBreaker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	stats := &Stats{}
+	p := NewOutboundProxy(OutboundConfig{Secret: make([]byte, 32)})
+	p.SetStats(stats)
+	p.Health().SetDialBackoff(time.Minute, time.Minute)
+	defer p.Close()
+
+	if _, err := p.reconnect(addr); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("first dial: %v", err)
+	}
+	start := time.Now()
+	if _, err := p.reconnect(addr); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second dial: %v, want %v", err, ErrCircuitOpen)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("refused dial took %s", d)
+	}
+	if stats.CircuitOpens != 1 || stats.CircuitRejects != 1 {
+		t.Errorf("circuit_opens %d, circuit_rejects %d; want 1, 1", stats.CircuitOpens, stats.CircuitRejects)
+	}
+}
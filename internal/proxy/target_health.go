@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Kinds of outbound errors reported as last_error_kind.
+const (
+	TargetErrRefused  = "refused"
+	TargetErrTimeout  = "timeout"
+	TargetErrReset    = "reset"
+	TargetErrClosed   = "closed"
+	TargetErrDNS      = "dns"
+	TargetErrStall    = "stall"
+	TargetErrOversize = "oversize"
+	TargetErrOther    = "other"
+)
+
+// TargetStatus is the health of one target address as seen by outbound
+// requests and, with --health-check-interval, by active probes.
+type TargetStatus struct {
+	Addr                 string    `json:"addr"`
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveFailures  int64     `json:"consecutive_failures"`
+	ConsecutiveSuccesses int64     `json:"consecutive_successes"`
+	LastError            string    `json:"last_error,omitempty"`
+	LastErrorKind        string    `json:"last_error_kind,omitempty"`
+	LastErrorAt          time.Time `json:"last_error_at,omitzero"`
+	LastProbeAt          time.Time `json:"last_probe_at,omitzero"`
+	LastProbeLatencyUs   int64     `json:"last_probe_latency_us,omitempty"` // of the last successful probe
+	Circuit              string    `json:"circuit,omitempty"`               // with --dial-backoff-max: closed, open or half-open
+	CircuitRetryAt       time.Time `json:"circuit_retry_at,omitzero"`       // while open: when the next connect is tried
+	BackoffMs            int64     `json:"backoff_ms,omitempty"`            // current backoff, doubled by each failed connect
+
+	judged bool // Healthy has been set at least once
+}
+
+// TargetHealth records the outcome of outbound requests per target: whether
+// the last one succeeded, the last error with its time, and how many
+// requests in a row have failed. Safe for concurrent use.
+type TargetHealth struct {
+	mu      sync.Mutex
+	targets map[string]*TargetStatus
+
+	// dial backoff of the circuit breaker (see SetDialBackoff); 0 = off
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+
+	events *EventLog // optional; records healthy/unhealthy transitions
+}
+
+// NewTargetHealth creates an empty tracker.
+func NewTargetHealth() *TargetHealth {
+	return &TargetHealth{targets: make(map[string]*TargetStatus)}
+}
+
+// SetEventLog records every healthy/unhealthy transition of a target in l,
+// with the target address as the reason. Must be called before use.
+func (h *TargetHealth) SetEventLog(l *EventLog) {
+	h.events = l
+}
+
+// setHealthy sets st.Healthy and records the transition, including the
+// first verdict on a target. Caller holds h.mu.
+func (h *TargetHealth) setHealthy(st *TargetStatus, healthy bool) {
+	if st.judged && st.Healthy == healthy {
+		return
+	}
+	st.Healthy, st.judged = healthy, true
+	kind := EventTargetUnhealthy
+	if healthy {
+		kind = EventTargetHealthy
+	}
+	h.events.Record(kind, "", netip.AddrPort{}, st.Addr)
+}
+
+// status returns the entry for addr, creating it. Caller holds h.mu.
+func (h *TargetHealth) status(addr string) *TargetStatus {
+	st, ok := h.targets[addr]
+	if !ok {
+		st = &TargetStatus{Addr: addr}
+		h.targets[addr] = st
+	}
+	return st
+}
+
+// Success marks addr healthy and resets its failure streak. The last error
+// is kept for reference.
+func (h *TargetHealth) Success(addr string) {
+	h.mu.Lock()
+	st := h.status(addr)
+	h.setHealthy(st, true)
+	st.ConsecutiveFailures = 0
+	st.ConsecutiveSuccesses++
+	h.mu.Unlock()
+}
+
+// Failure records err as the last error of addr at now.
+func (h *TargetHealth) Failure(addr string, err error, now time.Time) {
+	h.mu.Lock()
+	st := h.status(addr)
+	h.setHealthy(st, false)
+	st.fail(err, now)
+	h.mu.Unlock()
+}
+
+// fail counts a failure and records err. A connect refused by the open
+// circuit keeps the error that opened it. Caller holds h.mu.
+func (st *TargetStatus) fail(err error, now time.Time) {
+	st.ConsecutiveFailures++
+	st.ConsecutiveSuccesses = 0
+	if errors.Is(err, ErrCircuitOpen) && st.LastError != "" {
+		return
+	}
+	st.LastError = err.Error()
+	st.LastErrorKind = targetErrorKind(err)
+	st.LastErrorAt = now
+}
+
+// RecordProbe records the outcome of an active probe of addr at now. Unlike
+// a request, one probe does not flip the target: it turns healthy after
+// rise successful probes in a row and unhealthy after fall failures in a
+// row (failed requests count towards fall). It reports whether Healthy
+// changed.
+func (h *TargetHealth) RecordProbe(addr string, latency time.Duration, err error, now time.Time, rise, fall int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.status(addr)
+	st.LastProbeAt = now
+	was := st.Healthy
+	if err != nil {
+		st.fail(err, now)
+		if st.ConsecutiveFailures >= int64(max(fall, 1)) {
+			h.setHealthy(st, false)
+		}
+	} else {
+		st.ConsecutiveFailures = 0
+		st.ConsecutiveSuccesses++
+		st.LastProbeLatencyUs = latency.Microseconds()
+		if st.ConsecutiveSuccesses >= int64(max(rise, 1)) {
+			h.setHealthy(st, true)
+		}
+	}
+	return st.Healthy != was
+}
+
+// Failing reports whether addr is known to be unhealthy; a target never
+// judged is not.
+func (h *TargetHealth) Failing(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.targets[addr]
+	return ok && st.judged && !st.Healthy
+}
+
+// Targets returns a copy of every entry, sorted by address.
+func (h *TargetHealth) Targets() []TargetStatus {
+	h.mu.Lock()
+	out := make([]TargetStatus, 0, len(h.targets))
+	for _, st := range h.targets {
+		out = append(out, *st)
+	}
+	h.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
+
+// targetErrorKind classifies an outbound error so a refused connection can
+// be told from a timeout without reading the message.
+func targetErrorKind(err error) string {
+	var (
+		dnsErr   *net.DNSError
+		stall    *ResponseStallError
+		tooLarge *ResponseTooLargeError
+		netErr   net.Error
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return TargetErrDNS
+	case errors.As(err, &stall):
+		return TargetErrStall
+	case errors.As(err, &tooLarge):
+		return TargetErrOversize
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return TargetErrRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return TargetErrReset
+	case errors.Is(err, ErrNoResponse), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return TargetErrTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return TargetErrClosed
+	}
+	return TargetErrOther
+}
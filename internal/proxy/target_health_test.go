@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTargetHealth(t *testing.T) {
+	h := NewTargetHealth()
+	at := time.Unix(1700000000, 0)
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	h.Failure("10.0.0.1:8888", fmt.Errorf("connect: %w", refused), at)
+	h.Failure("10.0.0.1:8888", fmt.Errorf("outbound: %w from 10.0.0.1:8888", ErrNoResponse), at.Add(time.Second))
+	h.Success("10.0.0.2:8888")
+
+	got := h.Targets()
+	if len(got) != 2 {
+		t.Fatalf("got %d targets, want 2", len(got))
+	}
+	bad := got[0]
+	if bad.Healthy || bad.ConsecutiveFailures != 2 || bad.LastErrorKind != TargetErrTimeout || !bad.LastErrorAt.Equal(at.Add(time.Second)) {
+		t.Errorf("failing target: %+v", bad)
+	}
+	if !got[1].Healthy || got[1].LastError != "" {
+		t.Errorf("healthy target: %+v", got[1])
+	}
+
+	h.Success("10.0.0.1:8888")
+	if st := h.Targets()[0]; !st.Healthy || st.ConsecutiveFailures != 0 || st.LastError == "" {
+		t.Errorf("after recovery: %+v", st)
+	}
+
+	stats := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+	stats.SetTargetHealth(h)
+	h.Failure("10.0.0.2:8888", refused, at)
+	rec := httptest.NewRecorder()
+	stats.handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	for _, line := range []string{
+		"target_10.0.0.1:8888_healthy\t1\n",
+		"target_10.0.0.2:8888_consecutive_failures\t1\n",
+		"target_10.0.0.2:8888_last_error_kind\trefused\n",
+		"target_10.0.0.2:8888_last_error_at\t1700000000\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("/stats missing %q", line)
+		}
+	}
+}
+
+func TestTargetHealth_Events(t *testing.T) {
+	h := NewTargetHealth()
+	events := NewEventLog(16)
+	h.SetEventLog(events)
+	at := time.Unix(1700000000, 0)
+	down := errors.New("down")
+
+	if h.Failing("10.0.0.1:8888") {
+		t.Error("target never tried reported as failing")
+	}
+	h.Failure("10.0.0.1:8888", down, at) // first verdict
+	h.Failure("10.0.0.1:8888", down, at) // no change
+	if !h.Failing("10.0.0.1:8888") {
+		t.Error("failed target not reported as failing")
+	}
+	h.Success("10.0.0.1:8888")
+	h.Success("10.0.0.1:8888")
+	h.RecordProbe("10.0.0.1:8888", 0, down, at, 2, 2)
+	h.RecordProbe("10.0.0.1:8888", 0, down, at, 2, 2)
+
+	var got []string
+	for _, e := range events.Events(0) {
+		got = append(got, e.Kind.String()+" "+e.Reason)
+	}
+	want := "target_unhealthy 10.0.0.1:8888,target_healthy 10.0.0.1:8888,target_unhealthy 10.0.0.1:8888"
+	if strings.Join(got, ",") != want {
+		t.Errorf("events %q, want %q", got, want)
+	}
+}
+
+func TestTargetErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "dc.example.org"}, TargetErrDNS},
+		{fmt.Errorf("closed: %w", &ResponseStallError{Timeout: time.Second}), TargetErrStall},
+		{&ResponseTooLargeError{Size: 10, Limit: 1}, TargetErrOversize},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), TargetErrReset},
+		{fmt.Errorf("handshake: %w", net.ErrClosed), TargetErrClosed},
+		{errors.New("CRC32 mismatch"), TargetErrOther},
+	}
+	for _, tt := range tests {
+		if got := targetErrorKind(tt.err); got != tt.want {
+			t.Errorf("targetErrorKind(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestTargetHealth_RecordProbe(t *testing.T) {
+	h := NewTargetHealth()
+	at := time.Unix(1700000000, 0)
+	addr := "10.0.0.1:8888"
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	probe := func(err error) bool { return h.RecordProbe(addr, 3*time.Millisecond, err, at, 2, 3) }
+
+	if probe(nil) || h.Targets()[0].Healthy {
+		t.Fatal("healthy after 1 of rise 2 probes")
+	}
+	if !probe(nil) || !h.Targets()[0].Healthy {
+		t.Fatal("not healthy after rise 2 probes")
+	}
+	if st := h.Targets()[0]; st.LastProbeLatencyUs != 3000 || !st.LastProbeAt.Equal(at) || st.ConsecutiveSuccesses != 2 {
+		t.Errorf("after successful probes: %+v", st)
+	}
+	if probe(refused) || probe(refused) || !h.Targets()[0].Healthy {
+		t.Fatal("unhealthy after 2 of fall 3 failed probes")
+	}
+	if !probe(refused) || h.Targets()[0].Healthy {
+		t.Fatal("still healthy after fall 3 failed probes")
+	}
+	if st := h.Targets()[0]; st.ConsecutiveFailures != 3 || st.ConsecutiveSuccesses != 0 || st.LastErrorKind != TargetErrRefused {
+		t.Errorf("after failed probes: %+v", st)
+	}
+
+	// A failed request flips the target at once and counts towards fall.
+	probe(nil)
+	probe(nil)
+	h.Failure(addr, refused, at)
+	if h.Targets()[0].Healthy {
+		t.Error("healthy after a failed request")
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+)
+
+// Defaults of the active target prober (--health-check-*).
+const (
+	DefaultHealthCheckTimeout = 5 * time.Second
+	DefaultHealthCheckRise    = 2
+	DefaultHealthCheckFall    = 3
+)
+
+// TargetProber checks every target of the current config on a timer, so a
+// dead middle proxy is noticed before a client is routed to it and a
+// recovered one before the next client retries it. A target with a live
+// connection is pinged over it (RPC_PING/RPC_PONG); one without is dialled
+// and handshaked, and the connection stays in the pool. Results go to
+// TargetHealth with rise/fall thresholds, so a single lost probe does not
+// flip a target.
+type TargetProber struct {
+	interval time.Duration
+	timeout  time.Duration
+	rise     int
+	fall     int
+	config   func() *config.Config
+	check    func(addr string, timeout time.Duration) (time.Duration, error)
+	health   *TargetHealth
+	stats    *Stats
+	stopCh   chan struct{}
+	running  atomic.Bool // a sweep is in progress; the next tick is skipped
+}
+
+// NewTargetProber creates a prober that checks the targets of cfg() every
+// interval through out. timeout bounds each probe; rise and fall are the
+// successful and failed probes in a row that turn a target healthy and
+// unhealthy (0 = defaults).
+func NewTargetProber(interval, timeout time.Duration, rise, fall int, cfg func() *config.Config, out *OutboundProxy, stats *Stats) *TargetProber {
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	if rise <= 0 {
+		rise = DefaultHealthCheckRise
+	}
+	if fall <= 0 {
+		fall = DefaultHealthCheckFall
+	}
+	return &TargetProber{
+		interval: interval,
+		timeout:  timeout,
+		rise:     rise,
+		fall:     fall,
+		config:   cfg,
+		check:    out.CheckTarget,
+		health:   out.Health(),
+		stats:    stats,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start runs a first sweep right away and then one every interval.
+func (p *TargetProber) Start() {
+	go p.sweep()
+	go runEvery(p.interval, p.stopCh, func() { go p.sweep() })
+}
+
+// Stop ends the periodic sweeps; one in progress finishes on its own.
+func (p *TargetProber) Stop() {
+	close(p.stopCh)
+}
+
+// sweep probes every target once, concurrently, and records the results.
+func (p *TargetProber) sweep() {
+	defer processCrash.Load().Recover()
+	if p.running.Swap(true) {
+		return
+	}
+	defer p.running.Store(false)
+	results := probeTargets(p.config(), func(addr string) error {
+		_, err := p.check(addr, p.timeout)
+		return err
+	}, p.timeout)
+	now := time.Now()
+	for _, r := range results {
+		if p.stats != nil {
+			p.stats.IncHealthCheck(r.Err != nil)
+		}
+		if !p.health.RecordProbe(r.Addr, r.Latency, r.Err, now, p.rise, p.fall) {
+			continue
+		}
+		if r.Err != nil {
+			log.Printf("health-check: target %s (DC %v) unhealthy after %d failures in a row: %v", r.Addr, r.DCs, p.fall, r.Err)
+		} else {
+			log.Printf("health-check: target %s (DC %v) healthy after %d probes (%s)", r.Addr, r.DCs, p.rise, r.Latency.Round(time.Microsecond))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skrashevich/MTProxy/internal/config"
+	"github.com/skrashevich/MTProxy/internal/protocol"
+)
+
+// TestTargetProber probes a fake middle proxy that answers pings and an
+// address that refuses connections: the first sweep dials the live target,
+// the second pings it over the pooled connection.
+func TestTargetProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	pings := make(chan struct{}, 4)
+	go func() {
+		mp, err := fakeMiddleProxy(ln, secret)
+		if err != nil {
+			t.Errorf("middle proxy: %v", err)
+			return
+		}
+		defer mp.Close()
+		for {
+			_, frame, err := mp.readEncryptedFrame()
+			if err != nil {
+				return
+			}
+			if binary.LittleEndian.Uint32(frame[0:4]) == protocol.RPCPing {
+				pong := binary.LittleEndian.AppendUint32(nil, protocol.RPCPong)
+				mp.writeEncryptedFrame(append(pong, frame[4:12]...))
+				pings <- struct{}{}
+			}
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "proxy-multi.conf")
+	os.WriteFile(path, fmt.Appendf(nil, "proxy_for 2 %s;\nproxy_for 3 %s;\n", ln.Addr(), deadAddr), 0o644)
+	mgr := config.NewManager(path)
+	if err := mgr.Load(); err != nil {
+		t.Fatal(err)
+	}
+	out := NewOutboundProxy(OutboundConfig{Secret: secret})
+	defer out.Close()
+	stats := NewStats()
+	p := NewTargetProber(time.Hour, 2*time.Second, 2, 1, mgr.Get, out, stats)
+
+	p.sweep()
+	if len(out.Conns()) != 1 {
+		t.Fatalf("first sweep left %d connections, want the live target's", len(out.Conns()))
+	}
+	p.sweep()
+	select {
+	case <-pings:
+	default:
+		t.Error("second sweep did not ping the pooled connection")
+	}
+
+	byAddr := make(map[string]TargetStatus)
+	for _, st := range out.Health().Targets() {
+		byAddr[st.Addr] = st
+	}
+	if st := byAddr[ln.Addr().String()]; !st.Healthy || st.ConsecutiveSuccesses != 2 || st.LastProbeAt.IsZero() || st.LastProbeLatencyUs <= 0 {
+		t.Errorf("live target: %+v", st)
+	}
+	if st := byAddr[deadAddr]; st.Healthy || st.ConsecutiveFailures != 2 || st.LastErrorKind != TargetErrRefused {
+		t.Errorf("dead target: %+v", st)
+	}
+	snap := stats.Snapshot(0)
+	if snap["health_checks"] != 4 || snap["health_check_failures"] != 2 {
+		t.Errorf("health_checks %d, health_check_failures %d; want 4 and 2", snap["health_checks"], snap["health_check_failures"])
+	}
+}
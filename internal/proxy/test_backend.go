@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/skrashevich/MTProxy/internal/crypto"
+	"github.com/skrashevich/MTProxy/internal/protocol"
+)
+
+// testBackendDCs is how many DCs the config of a TestBackend lists; their
+// media DCs fall back to them.
+const testBackendDCs = 5
+
+// TestBackend is an in-process stand-in for the Telegram middle proxies
+// (--test-backend, selftest): it accepts RPC connections on a loopback
+// port, completes the nonce exchange and handshake with the proxy secret,
+// answers RPC_PING with RPC_PONG and every RPC_PROXY_REQ with an
+// RPC_PROXY_ANS carrying the client packet back. Unlike --loopback-backend
+// the whole outbound path — dial, AES-CBC, RPC framing — is exercised.
+type TestBackend struct {
+	ln     net.Listener
+	secret []byte
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+
+	handshakes atomic.Int64
+	requests   atomic.Int64
+}
+
+// NewTestBackend starts a TestBackend on a free loopback port. secret is
+// the proxy secret (--aes-pwd) the proxy will use; it must be at least 4
+// bytes.
+func NewTestBackend(secret []byte) (*TestBackend, error) {
+	if len(secret) < 4 {
+		return nil, fmt.Errorf("test backend: secret of %d bytes, need at least 4", len(secret))
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("test backend: %w", err)
+	}
+	b := &TestBackend{ln: ln, secret: secret, conns: make(map[net.Conn]struct{})}
+	b.wg.Add(1)
+	go b.serve()
+	return b, nil
+}
+
+// NewTestBackendSecret returns a random proxy secret for a TestBackend
+// when no --aes-pwd is given.
+func NewTestBackendSecret() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}
+
+// Addr returns the host:port the backend listens on.
+func (b *TestBackend) Addr() string {
+	return b.ln.Addr().String()
+}
+
+// Config returns a proxy-multi.conf that sends DCs 1 to 5, and so their
+// media DCs, to the backend, with DC 2 as the default.
+func (b *TestBackend) Config() string {
+	var sb strings.Builder
+	sb.WriteString("# generated for --test-backend\ndefault 2;\n")
+	for dc := 1; dc <= testBackendDCs; dc++ {
+		fmt.Fprintf(&sb, "proxy_for %d %s;\n", dc, b.Addr())
+	}
+	return sb.String()
+}
+
+// Handshakes returns the RPC handshakes completed with the proxy.
+func (b *TestBackend) Handshakes() int64 {
+	return b.handshakes.Load()
+}
+
+// Requests returns the RPC_PROXY_REQ frames answered.
+func (b *TestBackend) Requests() int64 {
+	return b.requests.Load()
+}
+
+// Close stops accepting, closes the open connections and waits for their
+// goroutines.
+func (b *TestBackend) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	for c := range b.conns {
+		c.Close()
+	}
+	b.mu.Unlock()
+	err := b.ln.Close()
+	b.wg.Wait()
+	return err
+}
+
+func (b *TestBackend) serve() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			conn.Close()
+			return
+		}
+		b.conns[conn] = struct{}{}
+		b.wg.Add(1)
+		b.mu.Unlock()
+		go b.serveConn(conn)
+	}
+}
+
+// serveConn answers one proxy connection until it closes.
+func (b *TestBackend) serveConn(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+	mp, err := acceptRPC(conn, b.secret)
+	if err != nil {
+		log.Printf("test backend: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	b.handshakes.Add(1)
+	for {
+		_, frame, err := mp.readEncryptedFrame()
+		if err != nil || len(frame) < 4 {
+			return
+		}
+		var ans []byte
+		switch binary.LittleEndian.Uint32(frame[0:4]) {
+		case protocol.RPCPing:
+			ans = binary.LittleEndian.AppendUint32(nil, protocol.RPCPong)
+			ans = append(ans, frame[4:]...)
+		case protocol.RPCProxyReq:
+			data, err := loopbackAnswer(frame)
+			if err != nil {
+				log.Printf("test backend: %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			ans = binary.LittleEndian.AppendUint32(nil, protocol.RPCProxyAns)
+			ans = binary.LittleEndian.AppendUint32(ans, 0)
+			ans = append(ans, frame[8:16]...) // ext_conn_id
+			ans = append(ans, data...)
+			b.requests.Add(1)
+		default:
+			continue
+		}
+		if err := mp.writeEncryptedFrame(ans); err != nil {
+			return
+		}
+	}
+}
+
+// acceptRPC plays the middle-proxy side of the RPC protocol on conn: the
+// nonce exchange, AES-CBC key derivation with the server's view of the
+// addresses, and the handshake. It returns the link ready for encrypted
+// frames.
+func acceptRPC(conn net.Conn, secret []byte) (*rpcOutboundConn, error) {
+	mp := newRPCOutboundConn("client", secret, false, nil)
+	mp.conn = conn
+
+	_, nonce, err := mp.readRawFrame()
+	if err != nil {
+		return nil, fmt.Errorf("read nonce: %w", err)
+	}
+	if len(nonce) != 32 || int32(binary.LittleEndian.Uint32(nonce[0:4])) != rpcNonce {
+		return nil, fmt.Errorf("bad RPC_NONCE % x", nonce)
+	}
+	if binary.LittleEndian.Uint32(nonce[4:8]) != binary.LittleEndian.Uint32(secret[0:4]) {
+		return nil, fmt.Errorf("key_select does not match the secret")
+	}
+	if schema := binary.LittleEndian.Uint32(nonce[8:12]); schema != rpccCryptoAES {
+		return nil, fmt.Errorf("crypto schema %d", schema)
+	}
+	ts := binary.LittleEndian.Uint32(nonce[12:16])
+	var clientNonce, serverNonce [16]byte
+	copy(clientNonce[:], nonce[16:32])
+	rand.Read(serverNonce[:])
+
+	reply := make([]byte, 32)
+	copy(reply, nonce[:16])
+	copy(reply[16:], serverNonce[:])
+	if err := mp.writeRawFrame(reply); err != nil {
+		return nil, err
+	}
+
+	serverIP, serverPort, serverIPv6 := extractConnAddr(conn.LocalAddr())
+	clientIP, clientPort, clientIPv6 := extractConnAddr(conn.RemoteAddr())
+	keys, err := crypto.AESCreateKeys(false, serverNonce, clientNonce, ts,
+		serverIP, serverPort, serverIPv6, clientIP, clientPort, clientIPv6, secret, nil)
+	if err != nil {
+		return nil, err
+	}
+	mp.cbcEnc, _ = crypto.NewAESCBCEncryptor(keys.WriteKey, keys.WriteIV)
+	dec, _ := crypto.NewAESCBCDecryptor(keys.ReadKey, keys.ReadIV)
+	mp.cbcReader = &cbcDecryptReader{r: conn, dec: dec}
+
+	_, hs, err := mp.readEncryptedFrame()
+	if err != nil {
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+	if len(hs) < 4 || int32(binary.LittleEndian.Uint32(hs[0:4])) != rpcHandshake {
+		return nil, fmt.Errorf("expected RPC_HANDSHAKE, got % x", hs[:min(len(hs), 4)])
+	}
+	return mp, mp.sendHandshake()
+}
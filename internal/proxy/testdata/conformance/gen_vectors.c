@@ -0,0 +1,496 @@
+/*
+    Generates the protocol conformance vectors in this directory from the C
+    implementation in c-original. Framing is produced by the C functions
+    themselves (tcp_rpc_write_packet, tcp_rpc_write_packet_compact,
+    tcp_rpc_flush, the tl_store_* calls of forward_mtproto_packet) on a
+    connection that exists only in memory; key derivation calls
+    aes_create_keys and sha256, and encryption uses the same EVP contexts as
+    aes_crypto_init / aes_crypto_ctr128_init.
+
+    Build and run from the repository root:
+
+      make -C c-original
+      cc -O2 -std=gnu11 -D_GNU_SOURCE -DAES=1 -iquote c-original -iquote c-original/common \
+        -o /tmp/gen_vectors internal/proxy/testdata/conformance/gen_vectors.c \
+        c-original/objs/lib/libkdb.a -lcrypto -lz -lm -lrt -lpthread
+      /tmp/gen_vectors internal/proxy/testdata/conformance
+
+    The output is deterministic; regenerate only when a vector is added.
+*/
+
+#include <assert.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <arpa/inet.h>
+
+#include "common/crc32.h"
+#include "common/sha256.h"
+#include "common/tl-parse.h"
+#include "crypto/aesni256.h"
+#include "jobs/jobs.h"
+#include "net/net-connections.h"
+#include "net/net-crypto-aes.h"
+#include "net/net-msg.h"
+#include "net/net-msg-buffers.h"
+#include "net/net-tcp-connections.h"
+#include "net/net-tcp-rpc-common.h"
+
+#define RPC_PROXY_REQ 0x36cef1ee
+#define TL_PROXY_TAG 0xdb1e26ae
+
+static FILE *out;
+static int first_case;
+
+static void fill (unsigned char *buf, int len, int seed) {
+  int i;
+  for (i = 0; i < len; i++) {
+    buf[i] = (unsigned char) (seed + i * 7);
+  }
+}
+
+static void put_hex (const char *name, const void *data, int len) {
+  const unsigned char *p = data;
+  int i;
+  fprintf (out, "\"%s\": \"", name);
+  for (i = 0; i < len; i++) {
+    fprintf (out, "%02x", p[i]);
+  }
+  fprintf (out, "\"");
+}
+
+static void begin_file (const char *dir, const char *kind) {
+  char path[1024];
+  snprintf (path, sizeof (path), "%s/%s.json", dir, kind);
+  out = fopen (path, "w");
+  assert (out);
+  fprintf (out, "{\n  \"kind\": \"%s\",\n  \"source\": \"c-original, gen_vectors.c\",\n  \"cases\": [", kind);
+  first_case = 1;
+}
+
+static void begin_case (const char *name) {
+  fprintf (out, "%s\n    {\"name\": \"%s\"", first_case ? "" : ",", name);
+  first_case = 0;
+}
+
+static void field_hex (const char *name, const void *data, int len) {
+  fprintf (out, ", ");
+  put_hex (name, data, len);
+}
+
+static void field_int (const char *name, long long v) {
+  fprintf (out, ", \"%s\": %lld", name, v);
+}
+
+static void field_str (const char *name, const char *v) {
+  fprintf (out, ", \"%s\": \"%s\"", name, v);
+}
+
+static void end_case (void) {
+  fprintf (out, "}");
+}
+
+static void end_file (void) {
+  fprintf (out, "\n  ]\n}\n");
+  fclose (out);
+}
+
+/* An in-memory connection: enough of connection_info and tcp_rpc_data for
+   the framing functions, which only append to c->out. */
+static conn_type_t mem_conn_type = {
+  .crypto_needed_output_bytes = cpu_tcp_aes_crypto_needed_output_bytes,
+};
+
+static connection_job_t mem_conn (int rpc_flags, int out_packet_num, int with_crypto) {
+  connection_job_t C;
+  int size = sizeof (struct async_job) + sizeof (struct connection_info);
+  assert (!posix_memalign ((void **) &C, 64, size));
+  memset (C, 0, size);
+  struct connection_info *c = CONN_INFO (C);
+  c->type = &mem_conn_type;
+  c->crypto = with_crypto ? (void *) 1 : NULL;
+  rwm_init (&c->out, 0);
+  TCP_RPC_DATA (C)->flags = rpc_flags;
+  TCP_RPC_DATA (C)->out_packet_num = out_packet_num;
+  TCP_RPC_DATA (C)->custom_crc_partial = crc32_partial;
+  return C;
+}
+
+/* take_out moves everything written to C so far into buf. */
+static int take_out (connection_job_t C, unsigned char *buf, int max) {
+  struct raw_message *r = &CONN_INFO (C)->out;
+  int n = r->total_bytes;
+  assert (n <= max);
+  assert (rwm_fetch_data (r, buf, n) == n);
+  return n;
+}
+
+static void write_compact (connection_job_t C, const unsigned char *data, int len) {
+  struct raw_message raw;
+  assert (rwm_create (&raw, data, len) == len);
+  tcp_rpc_write_packet_compact (C, &raw);
+}
+
+/* {{{ aes_create_keys */
+
+static void gen_aes_keys (const char *dir) {
+  begin_file (dir, "aes_create_keys");
+  int v;
+  for (v = 0; v < 4; v++) {
+    unsigned char nonce_server[16], nonce_client[16], server_ipv6[16], client_ipv6[16], temp_key[64];
+    aes_secret_t secret;
+    memset (&secret, 0, sizeof (secret));
+    fill (nonce_server, 16, 1 + v);
+    fill (nonce_client, 16, 17 + v);
+    memset (server_ipv6, 0, 16);
+    memset (client_ipv6, 0, 16);
+    secret.secret_len = v == 2 ? 128 : 32;
+    fill ((unsigned char *) secret.secret, secret.secret_len, 50 + v);
+    int am_client = v != 1;
+    unsigned server_ip = 0x0a0b0c0d, client_ip = 0x01020304;
+    unsigned short server_port = 8888, client_port = 54321 - v;
+    int temp_key_len = 0;
+    const char *name = "ipv4_client";
+    if (v == 1) {
+      name = "ipv4_server";
+    } else if (v == 2) {
+      name = "ipv4_long_secret";
+    } else if (v == 3) {
+      name = "ipv6_temp_key";
+      server_ip = client_ip = 0;
+      fill (server_ipv6, 16, 0x20);
+      fill (client_ipv6, 16, 0x40);
+      temp_key_len = 64;
+      fill (temp_key, temp_key_len, 0x80);
+    }
+    struct aes_key_data R;
+    assert (aes_create_keys (&R, am_client, (char *) nonce_server, (char *) nonce_client, 111111111 + v,
+                             server_ip, server_port, server_ipv6, client_ip, client_port, client_ipv6,
+                             &secret, temp_key, temp_key_len) == 1);
+    begin_case (name);
+    field_int ("am_client", am_client);
+    field_hex ("nonce_server", nonce_server, 16);
+    field_hex ("nonce_client", nonce_client, 16);
+    field_int ("client_timestamp", 111111111 + v);
+    field_int ("server_ip", server_ip);
+    field_int ("server_port", server_port);
+    field_hex ("server_ipv6", server_ipv6, 16);
+    field_int ("client_ip", client_ip);
+    field_int ("client_port", client_port);
+    field_hex ("client_ipv6", client_ipv6, 16);
+    field_hex ("secret", secret.secret, secret.secret_len);
+    field_hex ("temp_key", temp_key, temp_key_len);
+    field_hex ("write_key", R.write_key, 32);
+    field_hex ("write_iv", R.write_iv, 16);
+    field_hex ("read_key", R.read_key, 32);
+    field_hex ("read_iv", R.read_iv, 16);
+    end_case ();
+  }
+  end_file ();
+}
+
+/* }}} */
+/* {{{ obfuscated2 client transport */
+
+/* derive_obfs2_keys mirrors the key setup of tcp_rpcs_compact_parse_execute
+   for one secret (secret == NULL: no -S configured). */
+static void derive_obfs2_keys (const unsigned char header[64], const unsigned char *secret, struct aes_key_data *K) {
+  unsigned char k[48];
+  int i;
+  if (secret) {
+    memcpy (k, header + 8, 32);
+    memcpy (k + 32, secret, 16);
+    sha256 (k, 48, K->read_key);
+  } else {
+    memcpy (K->read_key, header + 8, 32);
+  }
+  memcpy (K->read_iv, header + 40, 16);
+  for (i = 0; i < 32; i++) {
+    K->write_key[i] = header[55 - i];
+  }
+  for (i = 0; i < 16; i++) {
+    K->write_iv[i] = header[23 - i];
+  }
+  if (secret) {
+    memcpy (k, K->write_key, 32);
+    sha256 (k, 48, K->write_key);
+  }
+}
+
+static void gen_obfs2 (const char *dir) {
+  static const struct {
+    const char *name;
+    unsigned tag;
+    int rpc_flags;
+    int dc;
+    int with_secret;
+  } modes[] = {
+    {"abridged", 0xefefefef, RPC_F_COMPACT | RPC_F_EXTMODE2, 2, 1},
+    {"intermediate", 0xeeeeeeee, RPC_F_MEDIUM | RPC_F_EXTMODE2, -4, 1},
+    {"padded", 0xdddddddd, RPC_F_MEDIUM | RPC_F_EXTMODE2 | RPC_F_PAD, 5, 1},
+    {"abridged_no_secret", 0xefefefef, RPC_F_COMPACT | RPC_F_EXTMODE2, 1, 0},
+  };
+  /* packet sizes: short, the largest with a 1-byte abridged length, the
+     smallest with a 4-byte one */
+  static const int sizes[] = {8, 0x7e * 4, 0x7f * 4, 1024};
+  const int nsizes = sizeof (sizes) / sizeof (sizes[0]);
+
+  begin_file (dir, "obfs2");
+  int m;
+  for (m = 0; m < (int) (sizeof (modes) / sizeof (modes[0])); m++) {
+    unsigned char secret[16], header[64], plain[64];
+    struct aes_key_data K;
+    fill (secret, 16, 0xa0 + m);
+    fill (header, 64, 0x10 + m);
+
+    /* choose header[56..61] so that it decrypts to the tag and DC */
+    const unsigned char *sec = modes[m].with_secret ? secret : NULL;
+    derive_obfs2_keys (header, sec, &K);
+    EVP_CIPHER_CTX *ks = evp_cipher_ctx_init (EVP_aes_256_ctr (), K.read_key, K.read_iv, 1);
+    unsigned char zero[64] = {0}, stream[64];
+    evp_crypt (ks, zero, stream, 64);
+    EVP_CIPHER_CTX_free (ks);
+    memcpy (plain, header, 64);
+    *(unsigned *) (plain + 56) = modes[m].tag;
+    *(short *) (plain + 60) = modes[m].dc;
+    int i;
+    for (i = 56; i < 62; i++) {
+      header[i] = plain[i] ^ stream[i];
+    }
+
+    /* the server side, as tcp_rpcs_compact_parse_execute sets it up */
+    derive_obfs2_keys (header, sec, &K);
+    EVP_CIPHER_CTX *rd = evp_cipher_ctx_init (EVP_aes_256_ctr (), K.read_key, K.read_iv, 1);
+    EVP_CIPHER_CTX *wr = evp_cipher_ctx_init (EVP_aes_256_ctr (), K.write_key, K.write_iv, 1);
+    unsigned char check[64];
+    evp_crypt (rd, header, check, 64);
+    assert (*(unsigned *) (check + 56) == modes[m].tag);
+
+    static unsigned char packets[8][2048], wire[65536], buf[65536];
+    int total = 0, s;
+
+    /* client → proxy: the client frames packets the way the parser reads
+       them; the wire continues the read stream after the header */
+    connection_job_t C = mem_conn (modes[m].rpc_flags, 0, 0);
+    for (s = 0; s < nsizes; s++) {
+      fill (packets[s], sizes[s], 0x30 * (s + 1) + m);
+      write_compact (C, packets[s], sizes[s]);
+    }
+    int n = take_out (C, buf, sizeof (buf));
+    evp_crypt (rd, buf, wire, n);
+    total = n;
+
+    begin_case (modes[m].name);
+    if (sec) {
+      field_hex ("secret", secret, 16);
+    }
+    field_hex ("header", header, 64);
+    field_str ("transport", modes[m].name[0] == 'a' ? "abridged" : modes[m].name);
+    field_int ("dc", modes[m].dc);
+    fprintf (out, ", \"client_packets\": [");
+    for (s = 0; s < nsizes; s++) {
+      fprintf (out, "%s{", s ? ", " : "");
+      put_hex ("data", packets[s], sizes[s]);
+      fprintf (out, "}");
+    }
+    fprintf (out, "]");
+    field_hex ("client_wire", wire, total);
+
+    /* proxy → client: tcp_rpc_write_packet_compact, then the write stream
+       from its start. Padded framing appends random bytes, so only the
+       packets are recorded for it. */
+    if (!(modes[m].rpc_flags & RPC_F_PAD)) {
+      for (s = 0; s < nsizes; s++) {
+        fill (packets[s], sizes[s], 0x90 + 0x11 * s + m);
+        write_compact (C, packets[s], sizes[s]);
+      }
+      n = take_out (C, buf, sizeof (buf));
+      evp_crypt (wr, buf, wire, n);
+      fprintf (out, ", \"server_packets\": [");
+      for (s = 0; s < nsizes; s++) {
+        fprintf (out, "%s{", s ? ", " : "");
+        put_hex ("data", packets[s], sizes[s]);
+        fprintf (out, "}");
+      }
+      fprintf (out, "]");
+      field_hex ("server_wire", wire, n);
+    }
+    end_case ();
+    EVP_CIPHER_CTX_free (rd);
+    EVP_CIPHER_CTX_free (wr);
+  }
+  end_file ();
+}
+
+/* }}} */
+/* {{{ RPC frames to the middle proxy */
+
+static void gen_rpc_frames (const char *dir) {
+  static const int sizes[] = {4, 12, 16, 20, 1000};
+  const int nsizes = sizeof (sizes) / sizeof (sizes[0]);
+  static unsigned char payload[2048], buf[65536], wire[65536];
+
+  begin_file (dir, "rpc_frames");
+  int encrypted;
+  for (encrypted = 0; encrypted < 2; encrypted++) {
+    unsigned char key[32], iv[16];
+    fill (key, 32, 0x55);
+    fill (iv, 16, 0x66);
+    int seq = encrypted ? 0 : -2;
+    connection_job_t C = mem_conn (0, seq, encrypted);
+    EVP_CIPHER_CTX *enc = encrypted ? evp_cipher_ctx_init (EVP_aes_256_cbc (), key, iv, 1) : NULL;
+
+    begin_case (encrypted ? "aes_cbc" : "plain");
+    if (encrypted) {
+      field_hex ("key", key, 32);
+      field_hex ("iv", iv, 16);
+    }
+    field_int ("first_seqno", seq);
+    fprintf (out, ", \"frames\": [");
+    int s;
+    for (s = 0; s < nsizes; s++) {
+      fill (payload, sizes[s], 0x70 + s);
+      struct raw_message raw;
+      assert (rwm_create (&raw, payload, sizes[s]) == sizes[s]);
+      tcp_rpc_write_packet (C, &raw);
+      /* every frame is flushed on its own, as the proxy writes it */
+      tcp_rpc_flush (C);
+      int n = take_out (C, buf, sizeof (buf));
+      if (enc) {
+        assert (!(n & 15));
+        evp_crypt (enc, buf, wire, n);
+      } else {
+        memcpy (wire, buf, n);
+      }
+      fprintf (out, "%s{", s ? ", " : "");
+      put_hex ("payload", payload, sizes[s]);
+      fprintf (out, ", ");
+      put_hex ("wire", wire, n);
+      fprintf (out, "}");
+    }
+    fprintf (out, "]");
+    end_case ();
+    if (enc) {
+      EVP_CIPHER_CTX_free (enc);
+    }
+  }
+  end_file ();
+}
+
+/* }}} */
+/* {{{ RPC_PROXY_REQ */
+
+/* proxy_req stores the request the way forward_mtproto_packet does for a
+   connection with remote/our addresses from the socket. */
+static int proxy_req (unsigned char *res, int flags, long long ext_conn_id, unsigned remote_ip, const unsigned char remote_ipv6[16],
+                      int remote_port, unsigned our_ip, const unsigned char our_ipv6[16], int our_port,
+                      const unsigned char *proxy_tag, const unsigned char *data, int len) {
+  struct tl_out_state *tlio_out = tl_out_state_alloc ();
+  struct process_id pid;
+  memset (&pid, 0, sizeof (pid));
+  tls_init_raw_msg (tlio_out, &pid, 0);
+
+  if (proxy_tag) {
+    flags |= 8;
+  }
+  tl_store_int (RPC_PROXY_REQ);
+  tl_store_int (flags);
+  tl_store_long (ext_conn_id);
+  if (remote_ip) {
+    tl_store_long (0);
+    tl_store_int (-0x10000);
+    tl_store_int (htonl (remote_ip));
+  } else {
+    tl_store_raw_data (remote_ipv6, 16);
+  }
+  tl_store_int (remote_port);
+  if (our_ip) {
+    tl_store_long (0);
+    tl_store_int (-0x10000);
+    tl_store_int (htonl (our_ip));
+  } else {
+    tl_store_raw_data (our_ipv6, 16);
+  }
+  tl_store_int (our_port);
+  if (flags & 12) {
+    int *extra_size_ptr = tl_store_get_ptr (4);
+    int pos = TL_OUT_POS;
+    if (flags & 8) {
+      tl_store_int (TL_PROXY_TAG);
+      tl_store_string ((const char *) proxy_tag, 16);
+    }
+    *extra_size_ptr = TL_OUT_POS - pos;
+  }
+  tl_store_raw_data (data, len);
+
+  struct raw_message *r = TL_OUT_RAW_MSG;
+  int skip = r->total_bytes - TL_OUT_POS;
+  assert (rwm_skip_data (r, skip) == skip);
+  int n = r->total_bytes;
+  assert (rwm_fetch_data (r, res, n) == n);
+  return n;
+}
+
+static void gen_proxy_req (const char *dir) {
+  static unsigned char data[64], tag[16], res[4096], remote_ipv6[16], our_ipv6[16];
+  fill (data, sizeof (data), 0x11);
+  fill (tag, sizeof (tag), 0xc0);
+  fill (remote_ipv6, 16, 0x20);
+  fill (our_ipv6, 16, 0x40);
+  /* flags as forward_tcp_query gets them: a DH handshake (2) from an
+     abridged client (RPC_F_COMPACT), encrypted packets (0x1000) from an
+     intermediate (RPC_F_MEDIUM) and a padded (| RPC_F_PAD) one */
+  static const struct {
+    const char *name;
+    int flags;
+    int ipv6;
+    int tag;
+  } cases[] = {
+    {"ipv4", 0x40000002, 0, 0},
+    {"ipv4_proxy_tag", 0x20001000, 0, 1},
+    {"ipv6_proxy_tag", 0x28001000, 1, 1},
+  };
+
+  begin_file (dir, "proxy_req");
+  int i;
+  for (i = 0; i < (int) (sizeof (cases) / sizeof (cases[0])); i++) {
+    unsigned remote_ip = cases[i].ipv6 ? 0 : 0xc0a80105, our_ip = cases[i].ipv6 ? 0 : 0x0a000001;
+    int n = proxy_req (res, cases[i].flags, 0x1122334455667788LL + i, remote_ip, remote_ipv6, 40000 + i,
+                       our_ip, our_ipv6, 443, cases[i].tag ? tag : NULL, data, sizeof (data));
+    begin_case (cases[i].name);
+    field_int ("flags", cases[i].flags | (cases[i].tag ? 8 : 0));
+    field_int ("ext_conn_id", 0x1122334455667788LL + i);
+    if (remote_ip) {
+      field_int ("remote_ip", remote_ip);
+      field_int ("our_ip", our_ip);
+    } else {
+      field_hex ("remote_ipv6", remote_ipv6, 16);
+      field_hex ("our_ipv6", our_ipv6, 16);
+    }
+    field_int ("remote_port", 40000 + i);
+    field_int ("our_port", 443);
+    if (cases[i].tag) {
+      field_hex ("proxy_tag", tag, 16);
+    }
+    field_hex ("data", data, sizeof (data));
+    field_hex ("wire", res, n);
+    end_case ();
+  }
+  end_file ();
+}
+
+/* }}} */
+
+int main (int argc, char *argv[]) {
+  if (argc != 2) {
+    fprintf (stderr, "usage: %s <output directory>\n", argv[0]);
+    return 2;
+  }
+  srand48 (1);
+  init_msg_buffers (0);
+  gen_aes_keys (argv[1]);
+  gen_obfs2 (argv[1]);
+  gen_rpc_frames (argv[1]);
+  gen_proxy_req (argv[1]);
+  return 0;
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// wheelTick is the resolution of the shared timer wheel: idle timeouts
+	// fire up to one tick late.
+	wheelTick = time.Second
+
+	// wheelSlots covers timeouts up to this many ticks without a second lap.
+	wheelSlots = 128
+)
+
+// TimerWheel is a coarse hashed timer wheel. One goroutine advances it every
+// tick, so thousands of idle connections and periodic sweeps share a single
+// wakeup instead of each arming a runtime timer.
+//
+// Idle timers are rescheduled lazily: Touch only records the current tick,
+// and the wheel moves the entry forward when its slot comes up.
+type TimerWheel struct {
+	tick  time.Duration
+	ticks atomic.Int64 // ticks since the wheel started; the coarse clock
+
+	mu    sync.Mutex
+	slots [][]*IdleTimer
+	tasks map[*WheelTask]struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// IdleTimer calls its expire function once no Touch has happened for the
+// timeout. It fires at most once, unless Restart re-arms it.
+type IdleTimer struct {
+	w       *TimerWheel
+	expire  func()
+	timeout atomic.Int64 // in ticks
+	last    atomic.Int64 // tick of the last Touch
+	stopped atomic.Bool
+	due     int64 // tick of the slot holding the live entry; guarded by w.mu
+
+	// fireMu is held while expire runs, so Restart waits for it
+	fireMu sync.Mutex
+}
+
+// WheelTask is a periodic function registered with Every.
+type WheelTask struct {
+	every   int64 // in ticks
+	next    int64 // guarded by w.mu
+	fn      func()
+	running atomic.Bool
+	wg      sync.WaitGroup // the call in flight
+}
+
+// NewTimerWheel starts a wheel advancing every tick.
+func NewTimerWheel(tick time.Duration) *TimerWheel {
+	w := &TimerWheel{
+		tick:  tick,
+		slots: make([][]*IdleTimer, wheelSlots),
+		tasks: make(map[*WheelTask]struct{}),
+		stop:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+var (
+	sharedWheelOnce sync.Once
+	sharedWheel     *TimerWheel
+)
+
+// sharedTimerWheel returns the process-wide wheel used for connection idle
+// tracking and periodic sweeps.
+func sharedTimerWheel() *TimerWheel {
+	sharedWheelOnce.Do(func() { sharedWheel = NewTimerWheel(wheelTick) })
+	return sharedWheel
+}
+
+// Stop halts the wheel; pending timers and tasks never fire.
+func (w *TimerWheel) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// ticksFor converts d to whole ticks, rounding up.
+func (w *TimerWheel) ticksFor(d time.Duration) int64 {
+	return max(int64((d+w.tick-1)/w.tick), 1)
+}
+
+// Watch returns a timer that calls expire after timeout without a Touch.
+// expire runs on the wheel goroutine and must not block.
+func (w *TimerWheel) Watch(timeout time.Duration, expire func()) *IdleTimer {
+	t := &IdleTimer{w: w, expire: expire}
+	t.timeout.Store(w.ticksFor(timeout))
+	t.last.Store(w.ticks.Load())
+	w.mu.Lock()
+	w.schedule(t, t.last.Load()+t.timeout.Load())
+	w.mu.Unlock()
+	return t
+}
+
+// schedule places t in the slot for tick due. A due tick more than one lap
+// ahead is clamped to the last slot of the current lap, where the entry is
+// moved on again. Caller holds w.mu.
+func (w *TimerWheel) schedule(t *IdleTimer, due int64) {
+	now := w.ticks.Load()
+	due = min(max(due, now+1), now+wheelSlots-1)
+	t.due = due
+	slot := due % wheelSlots
+	w.slots[slot] = append(w.slots[slot], t)
+}
+
+// Touch records activity, pushing expiry a full timeout into the future.
+// It is a single atomic store.
+func (t *IdleTimer) Touch() {
+	t.last.Store(t.w.ticks.Load())
+}
+
+// Reset changes the timeout and records activity. A shorter timeout takes
+// effect immediately; a longer one when the current slot comes up.
+func (t *IdleTimer) Reset(timeout time.Duration) {
+	w := t.w
+	ticks := w.ticksFor(timeout)
+	t.timeout.Store(ticks)
+	t.last.Store(w.ticks.Load())
+	w.mu.Lock()
+	if due := t.last.Load() + ticks; due < t.due && !t.stopped.Load() {
+		w.schedule(t, due)
+	}
+	w.mu.Unlock()
+}
+
+// Stop cancels the timer. The entry is dropped when its slot comes up.
+func (t *IdleTimer) Stop() {
+	t.stopped.Store(true)
+}
+
+// Restart re-arms a timer that has fired (or was stopped) as if it had just
+// been created, and reports whether it had. An expire call in progress
+// completes first; a timer still running is left alone, at the cost of one
+// atomic load.
+func (t *IdleTimer) Restart() bool {
+	if !t.stopped.Load() {
+		return false
+	}
+	t.fireMu.Lock()
+	defer t.fireMu.Unlock()
+	w := t.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !t.stopped.Load() {
+		return false
+	}
+	t.stopped.Store(false)
+	t.last.Store(w.ticks.Load())
+	w.schedule(t, t.last.Load()+t.timeout.Load())
+	return true
+}
+
+// Every calls fn every interval (rounded up to whole ticks) until the task
+// is stopped. Each call runs in its own goroutine; a call is skipped while
+// the previous one is still running.
+func (w *TimerWheel) Every(interval time.Duration, fn func()) *WheelTask {
+	task := &WheelTask{every: w.ticksFor(interval), fn: fn}
+	w.mu.Lock()
+	task.next = w.ticks.Load() + task.every
+	w.tasks[task] = struct{}{}
+	w.mu.Unlock()
+	return task
+}
+
+// StopTask unregisters a periodic task and waits for a call already running
+// to return.
+func (w *TimerWheel) StopTask(task *WheelTask) {
+	w.mu.Lock()
+	delete(w.tasks, task)
+	w.mu.Unlock()
+	task.wg.Wait()
+}
+
+func (w *TimerWheel) run() {
+	defer processCrash.Load().Recover()
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.advance()
+		}
+	}
+}
+
+// advance moves the wheel one tick: expired idle timers fire, live ones are
+// moved to the slot of their current deadline, and due tasks start.
+func (w *TimerWheel) advance() {
+	now := w.ticks.Add(1)
+
+	var expired []*IdleTimer
+	w.mu.Lock()
+	slot := now % wheelSlots
+	entries := w.slots[slot]
+	for _, t := range entries {
+		if t.due != now || t.stopped.Load() {
+			continue // superseded by a reschedule
+		}
+		if deadline := t.last.Load() + t.timeout.Load(); deadline > now {
+			w.schedule(t, deadline)
+			continue
+		}
+		t.stopped.Store(true)
+		expired = append(expired, t)
+	}
+	// Entries are never rescheduled into the current slot, so its backing
+	// array is reused for the next lap.
+	clear(entries)
+	w.slots[slot] = entries[:0]
+	for task := range w.tasks {
+		if now < task.next {
+			continue
+		}
+		task.next = now + task.every
+		if task.running.CompareAndSwap(false, true) {
+			task.wg.Add(1)
+			go func(task *WheelTask) {
+				defer processCrash.Load().Recover()
+				defer task.wg.Done()
+				defer task.running.Store(false)
+				task.fn()
+			}(task)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, t := range expired {
+		t.fireMu.Lock()
+		if t.stopped.Load() { // not restarted in the meantime
+			t.expire()
+		}
+		t.fireMu.Unlock()
+	}
+}
+
+// runEvery calls fn every interval until stop is closed, then returns.
+// Intervals of at least one wheel tick run on the shared timer wheel; shorter
+// ones keep a dedicated ticker.
+func runEvery(interval time.Duration, stop <-chan struct{}, fn func()) {
+	defer processCrash.Load().Recover()
+	if interval >= wheelTick {
+		w := sharedTimerWheel()
+		task := w.Every(interval, fn)
+		<-stop
+		w.StopTask(task)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// manualWheel returns a wheel whose own ticker never fires within a test, so
+// the test drives it with advance.
+func manualWheel(t testing.TB) *TimerWheel {
+	w := NewTimerWheel(time.Hour)
+	t.Cleanup(w.Stop)
+	return w
+}
+
+func advanceN(w *TimerWheel, n int) {
+	for range n {
+		w.advance()
+	}
+}
+
+func TestTimerWheel_Expire(t *testing.T) {
+	w := manualWheel(t)
+	var fired atomic.Int32
+	w.Watch(3*time.Hour, func() { fired.Add(1) })
+
+	advanceN(w, 2)
+	if fired.Load() != 0 {
+		t.Fatal("fired before the timeout")
+	}
+	advanceN(w, 1)
+	if fired.Load() != 1 {
+		t.Fatalf("fired %d times after the timeout, want 1", fired.Load())
+	}
+	advanceN(w, 10)
+	if fired.Load() != 1 {
+		t.Fatalf("fired %d times, want exactly 1", fired.Load())
+	}
+}
+
+func TestTimerWheel_TouchDefers(t *testing.T) {
+	w := manualWheel(t)
+	var fired atomic.Int32
+	idle := w.Watch(3*time.Hour, func() { fired.Add(1) })
+
+	for range 10 {
+		advanceN(w, 2)
+		idle.Touch()
+	}
+	if fired.Load() != 0 {
+		t.Fatal("fired despite regular touches")
+	}
+	advanceN(w, 3)
+	if fired.Load() != 1 {
+		t.Fatal("did not fire after touches stopped")
+	}
+}
+
+func TestTimerWheel_Stop(t *testing.T) {
+	w := manualWheel(t)
+	var fired atomic.Int32
+	idle := w.Watch(time.Hour, func() { fired.Add(1) })
+	idle.Stop()
+	advanceN(w, 5)
+	if fired.Load() != 0 {
+		t.Fatal("stopped timer fired")
+	}
+}
+
+func TestTimerWheel_Restart(t *testing.T) {
+	w := manualWheel(t)
+	var fired atomic.Int32
+	idle := w.Watch(2*time.Hour, func() { fired.Add(1) })
+
+	if idle.Restart() {
+		t.Error("Restart of a running timer reported it had fired")
+	}
+	advanceN(w, 2)
+	if fired.Load() != 1 {
+		t.Fatalf("fired %d times, want 1", fired.Load())
+	}
+	if !idle.Restart() {
+		t.Fatal("Restart of a fired timer reported it had not")
+	}
+	advanceN(w, 1)
+	idle.Touch()
+	advanceN(w, 1)
+	if fired.Load() != 1 {
+		t.Fatal("restarted timer ignored a touch")
+	}
+	advanceN(w, 1)
+	if fired.Load() != 2 {
+		t.Fatalf("restarted timer fired %d times in all, want 2", fired.Load())
+	}
+}
+
+func TestTimerWheel_Reset(t *testing.T) {
+	w := manualWheel(t)
+
+	var shorter atomic.Int32
+	idle := w.Watch(30*time.Hour, func() { shorter.Add(1) })
+	idle.Reset(2 * time.Hour)
+	advanceN(w, 2)
+	if shorter.Load() != 1 {
+		t.Fatal("shorter timeout did not take effect")
+	}
+	advanceN(w, 30)
+	if shorter.Load() != 1 {
+		t.Fatalf("fired %d times, want 1", shorter.Load())
+	}
+
+	var longer atomic.Int32
+	idle = w.Watch(2*time.Hour, func() { longer.Add(1) })
+	idle.Reset(5 * time.Hour)
+	advanceN(w, 4)
+	if longer.Load() != 0 {
+		t.Fatal("fired before the longer timeout")
+	}
+	advanceN(w, 1)
+	if longer.Load() != 1 {
+		t.Fatal("longer timeout did not fire")
+	}
+}
+
+func TestTimerWheel_BeyondOneLap(t *testing.T) {
+	w := manualWheel(t)
+	var fired atomic.Int32
+	w.Watch(3*wheelSlots*time.Hour, func() { fired.Add(1) })
+
+	advanceN(w, 3*wheelSlots-1)
+	if fired.Load() != 0 {
+		t.Fatal("fired on an earlier lap")
+	}
+	advanceN(w, 1)
+	if fired.Load() != 1 {
+		t.Fatal("timeout longer than one lap never fired")
+	}
+}
+
+func TestTimerWheel_Every(t *testing.T) {
+	w := manualWheel(t)
+	calls := make(chan struct{}, 10)
+	task := w.Every(2*time.Hour, func() { calls <- struct{}{} })
+
+	advanceN(w, 1)
+	select {
+	case <-calls:
+		t.Fatal("task ran before its interval")
+	case <-time.After(20 * time.Millisecond):
+	}
+	advanceN(w, 1)
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("task did not run")
+	}
+
+	w.StopTask(task)
+	advanceN(w, 4)
+	select {
+	case <-calls:
+		t.Fatal("task ran after StopTask")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestTimerWheel_UnblocksRead(t *testing.T) {
+	w := NewTimerWheel(10 * time.Millisecond)
+	defer w.Stop()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	idle := w.Watch(30*time.Millisecond, func() { server.SetReadDeadline(time.Now()) })
+	defer idle.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := server.Read(b[:])
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("read error = %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle timer did not unblock the read")
+	}
+}
+
+func TestRunEvery_ShortIntervalFallback(t *testing.T) {
+	stop := make(chan struct{})
+	var calls atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		runEvery(5*time.Millisecond, stop, func() { calls.Add(1) })
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	if calls.Load() < 3 {
+		t.Fatalf("calls = %d, want at least 3", calls.Load())
+	}
+}
+
+// benchIdleConns is the number of idle connections in the idle-CPU
+// benchmarks, matching a heavily loaded instance.
+const benchIdleConns = 50000
+
+// BenchmarkIdleTouch compares the per-packet cost of pushing an idle timeout
+// forward: a wheel Touch against re-arming a runtime timer.
+func BenchmarkIdleTouch(b *testing.B) {
+	b.Run("wheel", func(b *testing.B) {
+		w := manualWheel(b)
+		idle := w.Watch(time.Minute, func() {})
+		b.ReportAllocs()
+		for b.Loop() {
+			idle.Touch()
+		}
+	})
+	b.Run("timer", func(b *testing.B) {
+		timer := time.AfterFunc(time.Minute, func() {})
+		defer timer.Stop()
+		b.ReportAllocs()
+		for b.Loop() {
+			timer.Reset(time.Minute)
+		}
+	})
+}
+
+// BenchmarkIdleSweep measures one wheel tick with benchIdleConns idle
+// connections that never time out: the CPU the process spends per second on
+// idle tracking once nothing else happens.
+func BenchmarkIdleSweep(b *testing.B) {
+	w := manualWheel(b)
+	for i := range benchIdleConns {
+		w.Watch(time.Duration(1<<21+i)*time.Hour, func() {})
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		w.advance()
+	}
+}
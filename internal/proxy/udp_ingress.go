@@ -0,0 +1,565 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP ingress framing. A client session is the same byte stream a TCP
+// client sends (obfuscated2 header or fake TLS, then transport frames),
+// cut into datagrams that each start with a 4-byte little-endian sequence
+// number counting from 0 in each direction. A datagram with an empty
+// payload closes the session.
+//
+// A session is keyed by the client address and opened by its datagram 0,
+// whose payload starts with a cookie proving the client receives at that
+// address. Datagram 0 without a valid cookie only gets a cookie datagram
+// (sequence number udpCookieSeq, then the cookie) back, no larger than
+// itself, so a spoofed source can neither open sessions nor have the proxy
+// send it more than it sent; the client repeats datagram 0 with the cookie.
+//
+// Datagrams arriving out of order are held until the gap is filled, up to
+// udpReorderWindow ahead; the stream cipher cannot skip bytes, so a gap
+// that outgrows the window ends the session. Duplicates are dropped, so a
+// client may retransmit a datagram it believes lost.
+const (
+	udpHeaderSize = 4
+
+	// udpCookieSeq is the sequence number of cookie datagrams.
+	udpCookieSeq = 0xFFFFFFFF
+	// udpCookieSize is the length of a cookie.
+	udpCookieSize = 16
+	// udpCookieEpoch is how long a cookie is issued with the same key
+	// input; the current and the previous epoch's cookies are accepted.
+	udpCookieEpoch = 30 * time.Second
+
+	// udpReorderWindow is how far ahead of the next expected datagram a
+	// session holds early ones.
+	udpReorderWindow = 32
+
+	// udpMaxDatagram is the largest datagram the proxy sends; it stays
+	// under the IPv6 minimum MTU so answers are never fragmented.
+	udpMaxDatagram = 1200
+
+	// udpInboxSize is how many datagrams a session queues for its handler;
+	// one more ends the session, since it cannot be dropped silently.
+	udpInboxSize = 256
+)
+
+// UDPIngressServer serves client sessions carried over UDP (--udp-ports)
+// for networks that throttle long-lived TCP connections. It demultiplexes
+// datagrams by client address and hands every new session to handler as a
+// net.Conn, so the MTProto handshake and transport are the same as on TCP.
+type UDPIngressServer struct {
+	addr    string
+	handler func(conn net.Conn)
+
+	// filter, budget, stats, reusePort and gate are as in IngressServer.
+	filter    func(conn net.Conn) bool
+	budget    *HandlerBudget
+	stats     *Stats
+	reusePort bool
+	gate      <-chan struct{}
+
+	pc net.PacketConn
+
+	// cookieKey keys the cookies of this server instance
+	cookieKey [32]byte
+
+	// sessions is keyed by client address; closing is set once ctx is done
+	// so no new sessions open and the socket closes with the last one.
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*udpConn
+	closing  bool
+}
+
+// NewUDPIngressServer creates a UDPIngressServer listening on addr.
+// handler is called in a new goroutine for every new session.
+func NewUDPIngressServer(addr string, handler func(conn net.Conn)) *UDPIngressServer {
+	s := &UDPIngressServer{
+		addr:     addr,
+		handler:  handler,
+		sessions: make(map[netip.AddrPort]*udpConn),
+	}
+	rand.Read(s.cookieKey[:])
+	return s
+}
+
+// SetAcceptFilter installs a check run on every new session before the
+// handler. Must be called before ListenAndServe.
+func (s *UDPIngressServer) SetAcceptFilter(f func(conn net.Conn) bool) {
+	s.filter = f
+}
+
+// SetHandlerBudget makes the server reject new sessions while budget is
+// exhausted. Must be called before ListenAndServe.
+func (s *UDPIngressServer) SetHandlerBudget(budget *HandlerBudget) {
+	s.budget = budget
+}
+
+// SetStats attaches the Stats instance for the udp_* counters. Must be
+// called before ListenAndServe.
+func (s *UDPIngressServer) SetStats(stats *Stats) {
+	s.stats = stats
+}
+
+// SetReusePort makes Listen bind with SO_REUSEPORT. Must be called before
+// Listen.
+func (s *UDPIngressServer) SetReusePort(on bool) {
+	s.reusePort = on
+}
+
+// SetStandby makes ListenAndServe bind the socket but not read until gate
+// is closed. Must be called before ListenAndServe.
+func (s *UDPIngressServer) SetStandby(gate <-chan struct{}) {
+	s.gate = gate
+}
+
+// Addr returns the address the server was created for.
+func (s *UDPIngressServer) Addr() string {
+	return s.addr
+}
+
+// Listen binds addr now rather than in ListenAndServe, so the caller can
+// drop privileges before serving. It does nothing if already bound.
+func (s *UDPIngressServer) Listen(ctx context.Context) error {
+	if s.pc != nil {
+		return nil
+	}
+	lc := net.ListenConfig{}
+	if s.reusePort {
+		lc.Control = reusePortControl
+	}
+	pc, err := lc.ListenPacket(ctx, "udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("udp ingress listen %s: %w", s.addr, err)
+	}
+	s.pc = pc
+	return nil
+}
+
+// close releases a socket bound by Listen that will not be served, so a
+// later Listen binds afresh.
+func (s *UDPIngressServer) close() {
+	if s.pc != nil {
+		s.pc.Close()
+		s.pc = nil
+	}
+}
+
+// ListenAndServe reads datagrams until ctx is cancelled. Once it is, new
+// sessions are refused while open ones run to completion, and the socket
+// is closed with the last of them.
+func (s *UDPIngressServer) ListenAndServe(ctx context.Context) error {
+	if err := s.Listen(ctx); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.closing = true
+		idle := len(s.sessions) == 0
+		s.mu.Unlock()
+		if idle {
+			s.pc.Close()
+		}
+	}()
+
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return fmt.Errorf("udp ingress read %s: %w", s.addr, err)
+		}
+		if s.stats != nil {
+			atomic.AddInt64(&s.stats.UDPDatagramsIn, 1)
+		}
+		if peer, ok := from.(*net.UDPAddr); ok {
+			s.dispatch(buf[:n], peer)
+		}
+	}
+}
+
+// dispatch passes one datagram to its session, opening the session on
+// datagram 0 with a valid cookie from an unknown address.
+func (s *UDPIngressServer) dispatch(b []byte, peer *net.UDPAddr) {
+	if len(b) < udpHeaderSize {
+		s.drop()
+		return
+	}
+	seq, payload := binary.LittleEndian.Uint32(b), b[udpHeaderSize:]
+	key := netip.AddrPortFrom(peer.AddrPort().Addr().Unmap(), peer.AddrPort().Port())
+
+	s.mu.Lock()
+	c := s.sessions[key]
+	if c == nil {
+		closing := s.closing
+		s.mu.Unlock()
+		if closing || seq != 0 {
+			s.drop()
+			return
+		}
+		now := time.Now()
+		if len(payload) < udpCookieSize || !s.validCookie(key, payload[:udpCookieSize], now) {
+			s.sendCookie(key, peer, len(b), now)
+			return
+		}
+		if payload = payload[udpCookieSize:]; len(payload) == 0 {
+			s.drop()
+			return
+		}
+		s.mu.Lock()
+		if s.closing || s.sessions[key] != nil {
+			// a repeat of datagram 0 raced the first one
+			s.mu.Unlock()
+			s.drop()
+			return
+		}
+		c = newUDPConn(s, peer, key)
+		s.sessions[key] = c
+		s.mu.Unlock()
+		if s.stats != nil {
+			atomic.AddInt64(&s.stats.UDPSessionsTotal, 1)
+			atomic.AddInt64(&s.stats.UDPSessionsActive, 1)
+		}
+		c.deliver(seq, payload)
+		s.start(c)
+		return
+	}
+	s.mu.Unlock()
+	c.deliver(seq, payload)
+}
+
+// cookie returns the cookie of key in the given epoch.
+func (s *UDPIngressServer) cookie(key netip.AddrPort, epoch int64) []byte {
+	mac := hmac.New(sha256.New, s.cookieKey[:])
+	b, _ := key.MarshalBinary()
+	mac.Write(b)
+	mac.Write(binary.LittleEndian.AppendUint64(nil, uint64(epoch)))
+	return mac.Sum(nil)[:udpCookieSize]
+}
+
+// validCookie reports whether c is the cookie of key in the current or the
+// previous epoch.
+func (s *UDPIngressServer) validCookie(key netip.AddrPort, c []byte, now time.Time) bool {
+	epoch := now.UnixNano() / int64(udpCookieEpoch)
+	return hmac.Equal(c, s.cookie(key, epoch)) || hmac.Equal(c, s.cookie(key, epoch-1))
+}
+
+// sendCookie answers a datagram 0 of size bytes without a valid cookie.
+// Shorter datagrams are dropped: the answer is never larger than what
+// the unverified source sent.
+func (s *UDPIngressServer) sendCookie(key netip.AddrPort, peer *net.UDPAddr, size int, now time.Time) {
+	if size < udpHeaderSize+udpCookieSize {
+		s.drop()
+		return
+	}
+	pkt := binary.LittleEndian.AppendUint32(nil, udpCookieSeq)
+	pkt = append(pkt, s.cookie(key, now.UnixNano()/int64(udpCookieEpoch))...)
+	if _, err := s.pc.WriteTo(pkt, peer); err == nil && s.stats != nil {
+		atomic.AddInt64(&s.stats.UDPCookiesSent, 1)
+	}
+}
+
+// start runs the handler for a new session, unless the handler budget or
+// the accept filter turns it away.
+func (s *UDPIngressServer) start(c *udpConn) {
+	if !s.budget.Acquire() {
+		c.Close()
+		return
+	}
+	if s.filter != nil && !s.filter(c) {
+		s.budget.Release()
+		c.Close()
+		return
+	}
+	go func() {
+		defer s.budget.Release()
+		defer c.Close()
+		s.handler(c)
+	}()
+}
+
+// remove forgets a closed session and closes the socket after the last
+// session once the server is shutting down.
+func (s *UDPIngressServer) remove(c *udpConn) {
+	s.mu.Lock()
+	delete(s.sessions, c.key)
+	last := s.closing && len(s.sessions) == 0
+	s.mu.Unlock()
+	if s.stats != nil {
+		atomic.AddInt64(&s.stats.UDPSessionsActive, -1)
+	}
+	if last {
+		s.pc.Close()
+	}
+}
+
+// drop counts a datagram that belongs to no session or breaks one.
+func (s *UDPIngressServer) drop() {
+	if s.stats != nil {
+		atomic.AddInt64(&s.stats.UDPDatagramsDropped, 1)
+	}
+}
+
+// udpConn is one client session seen as a net.Conn. Reads return the
+// session's payloads in order; writes are cut into datagrams. Write
+// deadlines are ignored: sending a datagram never waits for the client.
+type udpConn struct {
+	srv  *UDPIngressServer
+	peer *net.UDPAddr
+	key  netip.AddrPort
+
+	inbox chan []byte
+	buf   []byte // unread rest of the current payload
+
+	// nextIn is the next datagram to deliver, early holds the ones that
+	// arrived ahead of it; only the server's read loop touches them
+	nextIn uint32
+	early  map[uint32][]byte
+
+	wmu     sync.Mutex
+	nextOut uint32
+
+	eof       chan struct{} // closed when the client closes the session
+	eofOnce   sync.Once
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+
+	readDeadline udpDeadline
+}
+
+func newUDPConn(srv *UDPIngressServer, peer *net.UDPAddr, key netip.AddrPort) *udpConn {
+	return &udpConn{
+		srv:          srv,
+		peer:         peer,
+		key:          key,
+		inbox:        make(chan []byte, udpInboxSize),
+		eof:          make(chan struct{}),
+		done:         make(chan struct{}),
+		readDeadline: makeUDPDeadline(),
+	}
+}
+
+// deliver queues the payload of datagram seq, holding it back while
+// earlier ones are missing. Called only from the read loop, in arrival
+// order.
+func (c *udpConn) deliver(seq uint32, payload []byte) {
+	switch {
+	case seq < c.nextIn:
+		c.srv.drop() // duplicate
+		return
+	case seq-c.nextIn >= udpReorderWindow:
+		c.srv.drop()
+		c.Close()
+		return
+	case seq > c.nextIn:
+		if _, ok := c.early[seq]; ok {
+			c.srv.drop() // duplicate
+			return
+		}
+		if c.early == nil {
+			c.early = make(map[uint32][]byte)
+		}
+		c.early[seq] = append([]byte(nil), payload...)
+		return
+	}
+	c.accept(append([]byte(nil), payload...))
+	for {
+		p, ok := c.early[c.nextIn]
+		if !ok {
+			return
+		}
+		delete(c.early, c.nextIn)
+		c.accept(p)
+	}
+}
+
+// accept queues the payload of datagram nextIn for Read.
+func (c *udpConn) accept(payload []byte) {
+	c.nextIn++
+	if len(payload) == 0 {
+		c.eofOnce.Do(func() { close(c.eof) })
+		return
+	}
+	select {
+	case c.inbox <- payload:
+	default:
+		c.srv.drop()
+		c.Close()
+	}
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(c.buf) == 0 {
+		select {
+		case c.buf = <-c.inbox:
+		default:
+			select {
+			case c.buf = <-c.inbox:
+			case <-c.eof:
+				// Payloads sent before the close are queued already.
+				select {
+				case c.buf = <-c.inbox:
+				default:
+					return 0, io.EOF
+				}
+			case <-c.done:
+				return 0, net.ErrClosed
+			case <-c.readDeadline.wait():
+				return 0, os.ErrDeadlineExceeded
+			}
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	pkt := make([]byte, min(udpHeaderSize+len(b), udpMaxDatagram))
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), udpMaxDatagram-udpHeaderSize)
+		copy(pkt[udpHeaderSize:], b[:n])
+		if err := c.send(pkt[:udpHeaderSize+n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// send numbers and sends one datagram. Must be called with wmu held.
+func (c *udpConn) send(pkt []byte) error {
+	binary.LittleEndian.PutUint32(pkt, c.nextOut)
+	c.nextOut++
+	if _, err := c.srv.pc.WriteTo(pkt, c.peer); err != nil {
+		return err
+	}
+	if c.srv.stats != nil {
+		atomic.AddInt64(&c.srv.stats.UDPDatagramsOut, 1)
+	}
+	return nil
+}
+
+// Close ends the session and tells the client with an empty datagram.
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.wmu.Lock()
+		close(c.done)
+		c.send(make([]byte, udpHeaderSize))
+		c.wmu.Unlock()
+		c.srv.remove(c)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr  { return c.srv.pc.LocalAddr() }
+func (c *udpConn) RemoteAddr() net.Addr { return c.peer }
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// udpDeadline is a read deadline that can be moved while a Read waits on
+// it, as the idle timer does to unblock a silent session; it works like
+// the deadlines of net.Pipe.
+type udpDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline passes
+}
+
+func makeUDPDeadline() udpDeadline {
+	return udpDeadline{cancel: make(chan struct{})}
+}
+
+// set moves the deadline to t; the zero time removes it.
+func (d *udpDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired; wait until it has closed cancel
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed once the deadline passes.
+func (d *udpDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// startUDPEcho serves sessions that echo everything until the client closes.
+func startUDPEcho(t *testing.T, stats *Stats) *UDPIngressServer {
+	t.Helper()
+	s := NewUDPIngressServer("127.0.0.1:0", func(conn net.Conn) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+		}
+	})
+	s.SetStats(stats)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.Listen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go s.ListenAndServe(ctx)
+	return s
+}
+
+func udpDatagram(seq uint32, payload []byte) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, seq)
+	return append(b, payload...)
+}
+
+// udpOpen opens a session on c with payload: datagram 0 without a cookie,
+// the cookie answer, then datagram 0 with it.
+func udpOpen(t *testing.T, c net.Conn, payload []byte) {
+	t.Helper()
+	c.Write(udpDatagram(0, append(make([]byte, udpCookieSize), payload...)))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("no cookie: %v", err)
+	}
+	if n != udpHeaderSize+udpCookieSize || binary.LittleEndian.Uint32(buf) != udpCookieSeq {
+		t.Fatalf("cookie datagram %x", buf[:n])
+	}
+	c.Write(udpDatagram(0, append(buf[udpHeaderSize:n:n], payload...)))
+}
+
+// readUDPStream reads datagrams until the server's close datagram and
+// returns the payloads joined, checking they arrive numbered from 0.
+func readUDPStream(t *testing.T, c net.Conn) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var out []byte
+	buf := make([]byte, 2048)
+	for seq := uint32(0); ; seq++ {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v (got %d bytes)", err, len(out))
+		}
+		if n < udpHeaderSize || n > udpMaxDatagram {
+			t.Fatalf("datagram of %d bytes", n)
+		}
+		if got := binary.LittleEndian.Uint32(buf); got != seq {
+			t.Fatalf("datagram seq %d, want %d", got, seq)
+		}
+		if n == udpHeaderSize {
+			return out
+		}
+		out = append(out, buf[udpHeaderSize:n]...)
+	}
+}
+
+func TestUDPIngressServer_Session(t *testing.T) {
+	stats := NewStats()
+	s := startUDPEcho(t, stats)
+	c, err := net.Dial("udp", s.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	udpOpen(t, c, []byte("hello"))
+	c.Write(udpDatagram(0, []byte("hello"))) // duplicate, dropped
+	c.Write(udpDatagram(1, big))
+	c.Write(udpDatagram(2, nil))
+
+	if got, want := readUDPStream(t, c), append([]byte("hello"), big...); !bytes.Equal(got, want) {
+		t.Fatalf("echoed %d bytes, want %d", len(got), len(want))
+	}
+	snap := stats.Snapshot(0)
+	if snap["udp_sessions_total"] != 1 || snap["udp_datagrams_in"] != 5 || snap["udp_datagrams_dropped"] != 1 ||
+		snap["udp_cookies_sent"] != 1 {
+		t.Errorf("sessions_total=%d datagrams_in=%d dropped=%d cookies_sent=%d, want 1, 5, 1, 1",
+			snap["udp_sessions_total"], snap["udp_datagrams_in"], snap["udp_datagrams_dropped"], snap["udp_cookies_sent"])
+	}
+	// One datagram for "hello", three for the 3000 bytes, one close.
+	if got := snap["udp_datagrams_out"]; got != 5 {
+		t.Errorf("udp_datagrams_out = %d, want 5", got)
+	}
+	// The session is forgotten right after its close datagram is sent.
+	for deadline := time.Now().Add(time.Second); stats.Snapshot(0)["udp_sessions_active"] != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("udp_sessions_active not back to 0 after close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestUDPIngressServer_Cookie checks that no session opens and nothing
+// larger than the request is sent back before the cookie round trip.
+func TestUDPIngressServer_Cookie(t *testing.T) {
+	stats := NewStats()
+	s := startUDPEcho(t, stats)
+	c, err := net.Dial("udp", s.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Too short to be answered with a cookie.
+	c.Write(udpDatagram(0, []byte("hi")))
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := c.Read(make([]byte, 64)); err == nil {
+		t.Errorf("short datagram 0 got a %d-byte answer", n)
+	}
+	// A wrong cookie only gets a cookie back.
+	c.Write(udpDatagram(0, bytes.Repeat([]byte("x"), 40)))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	if n, err := c.Read(buf); err != nil || binary.LittleEndian.Uint32(buf) != udpCookieSeq {
+		t.Fatalf("answer %x, %v; want a cookie", buf[:n], err)
+	}
+	// A cookie is bound to the address it was sent to.
+	other, err := net.Dial("udp", s.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write(udpDatagram(0, append(buf[udpHeaderSize:udpHeaderSize+udpCookieSize:udpHeaderSize+udpCookieSize], "x"...)))
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := other.Read(buf); err != nil || binary.LittleEndian.Uint32(buf) != udpCookieSeq {
+		t.Fatalf("borrowed cookie answered %x, %v; want a new cookie", buf[:n], err)
+	}
+
+	snap := stats.Snapshot(0)
+	if snap["udp_sessions_total"] != 0 || snap["udp_cookies_sent"] != 2 || snap["udp_datagrams_dropped"] != 1 {
+		t.Errorf("sessions_total=%d cookies_sent=%d dropped=%d, want 0, 2, 1",
+			snap["udp_sessions_total"], snap["udp_cookies_sent"], snap["udp_datagrams_dropped"])
+	}
+}
+
+// TestUDPIngressServer_Reorder checks that datagrams arriving out of order
+// are delivered in order, that a gap past the window ends the session and
+// that a session cannot be opened mid-stream.
+func TestUDPIngressServer_Reorder(t *testing.T) {
+	stats := NewStats()
+	s := startUDPEcho(t, stats)
+	c, err := net.Dial("udp", s.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	udpOpen(t, c, []byte("a"))
+	c.Write(udpDatagram(3, nil))
+	c.Write(udpDatagram(2, []byte("c")))
+	c.Write(udpDatagram(2, []byte("c"))) // duplicate of an early one
+	c.Write(udpDatagram(1, []byte("b")))
+	if got := readUDPStream(t, c); string(got) != "abc" {
+		t.Errorf("echoed %q, want \"abc\"", got)
+	}
+
+	far, err := net.Dial("udp", s.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer far.Close()
+	udpOpen(t, far, []byte("a"))
+	far.Write(udpDatagram(1+udpReorderWindow, []byte("z")))
+	if got := readUDPStream(t, far); len(got) > 1 {
+		t.Errorf("echoed %q past the window", got)
+	}
+
+	other, err := net.Dial("udp", s.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write(udpDatagram(5, []byte("x")))
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := other.Read(make([]byte, 64)); err == nil {
+		t.Errorf("mid-stream datagram got a %d-byte answer", n)
+	}
+
+	snap := stats.Snapshot(0)
+	if snap["udp_sessions_total"] != 2 || snap["udp_datagrams_dropped"] != 3 {
+		t.Errorf("sessions_total=%d dropped=%d, want 2 and 3",
+			snap["udp_sessions_total"], snap["udp_datagrams_dropped"])
+	}
+}
+
+func TestUDPConn_ReadDeadline(t *testing.T) {
+	s := NewUDPIngressServer("127.0.0.1:0", nil)
+	c := newUDPConn(s, &net.UDPAddr{}, netip.AddrPort{})
+	c.SetReadDeadline(time.Now().Add(time.Hour))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	// Moving the deadline into the past unblocks the pending read, as the
+	// idle timer in handleConn does.
+	time.Sleep(10 * time.Millisecond)
+	c.SetReadDeadline(time.Now())
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("read error %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read not unblocked by the deadline")
+	}
+}
+
+// TestClientIngressServer_UDP checks that UDP sessions go through the same
+// handshake as TCP connections.
+func TestClientIngressServer_UDP(t *testing.T) {
+	secrets := [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)}
+	stats := NewStats()
+	stats.SetSecrets(secrets)
+	s := NewClientIngressServer("127.0.0.1:0", secrets, nil, nil)
+	s.AddUDPListener("127.0.0.1:0")
+	s.SetStats(stats)
+	s.SetSecretWindowCheck(func(secret []byte, now time.Time) bool { return false })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Listen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go s.ListenAndServe(ctx)
+
+	c, err := net.Dial("udp", s.udp[0].pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	raw := buildRawHeader(t, secrets[1], TransportMagicIntermediate, 2)
+	udpOpen(t, c, raw[:])
+	if got := readUDPStream(t, c); len(got) != 0 {
+		t.Errorf("refused session got %d bytes", len(got))
+	}
+
+	snap := stats.Snapshot(len(secrets))
+	if snap["secret_2_handshake_failures"] != 1 {
+		t.Errorf("secret_2_handshake_failures = %d, want 1", snap["secret_2_handshake_failures"])
+	}
+	if _, ok := snap["listener_udp_127_0_0_1_0_handshakes"]; !ok {
+		t.Error("no handshake stats for the UDP listener")
+	}
+}
@@ -0,0 +1,576 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workerStatsTimeout bounds one fetch of a worker's /stats.
+const workerStatsTimeout = 2 * time.Second
+
+// workerReloadTimeout bounds one worker's config reload; a DC config
+// fetch or a slow secret directory can take a while.
+const workerReloadTimeout = time.Minute
+
+// workerClient returns an HTTP client that dials the worker's stats socket.
+func workerClient(socket string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// WorkerStatsServer serves /stats and /stats.json for the supervisor (-M > 1). Every worker
+// binds the client ports with SO_REUSEPORT and keeps its own counters; the
+// supervisor owns the stats address, fetches each worker's /stats over the
+// worker's unix socket and answers with the totals followed by the ingress
+// counters of every worker, prefixed worker_<id>_. /healthz and /readyz
+// are answered from the workers' reports the same way.
+type WorkerStatsServer struct {
+	addr    string
+	workers []*http.Client // indexed by worker id, each dials its socket
+	server  *http.Server
+}
+
+// NewWorkerStatsServer creates a server on addr aggregating the workers
+// whose stats sockets are given, in worker id order.
+func NewWorkerStatsServer(addr string, sockets []string) *WorkerStatsServer {
+	s := &WorkerStatsServer{addr: addr}
+	for _, socket := range sockets {
+		s.workers = append(s.workers, workerClient(socket, workerStatsTimeout))
+	}
+	return s
+}
+
+// WorkerControl lets the supervisor ask its workers, over their stats
+// sockets, whether they listen and answer, and reload their config. It is
+// what the supervisor reports to systemd.
+type WorkerControl struct {
+	workers []*http.Client
+	reload  []*http.Client
+}
+
+// NewWorkerControl returns a WorkerControl for the workers whose stats
+// sockets are given, in worker id order.
+func NewWorkerControl(sockets []string) *WorkerControl {
+	c := &WorkerControl{}
+	for _, socket := range sockets {
+		c.workers = append(c.workers, workerClient(socket, workerStatsTimeout))
+		c.reload = append(c.reload, workerClient(socket, workerReloadTimeout))
+	}
+	return c
+}
+
+// count runs check for every worker concurrently and returns for how many
+// it passed.
+func count(clients []*http.Client, check func(*http.Client) bool) int {
+	var n atomic.Int32
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if check(client) {
+				n.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(n.Load())
+}
+
+// Listening returns how many workers have bound their client listeners.
+func (c *WorkerControl) Listening() int {
+	return count(c.workers, func(client *http.Client) bool {
+		resp, err := client.Get("http://worker/admin/listeners")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return false
+		}
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if line := sc.Text(); line != "" && !strings.HasPrefix(line, "#") {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Answering returns how many workers answer /healthz.
+func (c *WorkerControl) Answering() int {
+	return count(c.workers, func(client *http.Client) bool {
+		return fetchWorkerHealth(client, "/healthz") == ""
+	})
+}
+
+// Reload reloads the config of every running worker, as SIGHUP does, and
+// returns once all of them are done. A worker that is down or restarting
+// is skipped: it reads the new config when it starts.
+func (c *WorkerControl) Reload() (reloaded int) {
+	return count(c.reload, func(client *http.Client) bool {
+		resp, err := client.Post("http://worker/reload", "", nil)
+		if err != nil {
+			return false
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+}
+
+// Start begins serving in the background.
+func (s *WorkerStatsServer) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("worker stats listen %s: %w", s.addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/stats.json", s.handleStatsJSON)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/admin/drain", handleDrainUnsupported)
+	mux.HandleFunc("/admin/secrets/reload", s.handleSecretsReload)
+	mux.HandleFunc("/ui", serveDashboard)
+	mux.HandleFunc("/", s.handleRoot) // like a single process, any GET gets /stats
+	s.server = newStatsHTTPServer(loopbackOnly(mux))
+	go s.server.Serve(ln)
+	return nil
+}
+
+// Stop closes the listener.
+func (s *WorkerStatsServer) Stop() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// workerSnapshot is one worker's /stats, in the order the worker wrote it.
+type workerSnapshot struct {
+	keys   []string
+	values map[string]string
+}
+
+// fetchWorkerStats reads one worker's /stats.
+func fetchWorkerStats(client *http.Client) (*workerSnapshot, error) {
+	resp, err := client.Get("http://worker/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return parseStatsText(resp.Body)
+}
+
+// parseStatsText parses the "key\tvalue\n" format written by handleStats.
+func parseStatsText(r io.Reader) (*workerSnapshot, error) {
+	snap := &workerSnapshot{values: make(map[string]string)}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), "\t")
+		if !ok {
+			continue
+		}
+		if _, dup := snap.values[key]; !dup {
+			snap.keys = append(snap.keys, key)
+		}
+		snap.values[key] = value
+	}
+	return snap, sc.Err()
+}
+
+// fetchWorkerStatsJSON reads one worker's /stats.json.
+func fetchWorkerStatsJSON(client *http.Client) (*statsJSON, error) {
+	resp, err := client.Get("http://worker/stats.json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var snap statsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// fetchAll calls fetch for every worker concurrently and returns the
+// results in worker id order, nil for a worker that did not answer (a
+// restarting worker is reported as down).
+func fetchAll[T any](s *WorkerStatsServer, fetch func(*http.Client) (*T, error)) []*T {
+	snaps := make([]*T, len(s.workers))
+	var wg sync.WaitGroup
+	for i, client := range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snaps[i], _ = fetch(client)
+		}()
+	}
+	wg.Wait()
+	return snaps
+}
+
+// workerSecretReload is one worker's answer to /admin/secrets/reload:
+// the counts, or failed if the worker refused the new list.
+type workerSecretReload struct {
+	res    SecretReload
+	failed *apiError
+}
+
+// reloadWorkerSecrets asks one worker to reload its secrets.
+func reloadWorkerSecrets(client *http.Client) (*workerSecretReload, error) {
+	resp, err := client.Post("http://worker/admin/secrets/reload", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		failed := &apiError{Code: errCodeInternal, Message: "status " + resp.Status}
+		json.NewDecoder(resp.Body).Decode(failed)
+		return &workerSecretReload{failed: failed}, nil
+	}
+	snap, err := parseStatsText(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var reply workerSecretReload
+	reply.res.Secrets, _ = strconv.Atoi(snap.values["secrets"])
+	reply.res.Added, _ = strconv.Atoi(snap.values["added"])
+	reply.res.Removed, _ = strconv.Atoi(snap.values["removed"])
+	return &reply, nil
+}
+
+// handleSecretsReload reloads the secrets of every running worker, so a
+// removed secret stops being accepted on all of them. A worker that is
+// down reads the new list when it starts. The answer is the single-process
+// one, with the largest count of any worker, plus how many workers
+// reloaded; if a worker refused the list, its error is returned.
+func (s *WorkerStatsServer) handleSecretsReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var res SecretReload
+	reloaded := 0
+	for id, reply := range fetchAll(s, reloadWorkerSecrets) {
+		switch {
+		case reply == nil:
+			continue
+		case reply.failed != nil:
+			writeAPIError(w, http.StatusUnprocessableEntity, reply.failed.Code, "worker "+strconv.Itoa(id)+": "+reply.failed.Message)
+			return
+		}
+		reloaded++
+		res.Secrets = max(res.Secrets, reply.res.Secrets)
+		res.Added = max(res.Added, reply.res.Added)
+		res.Removed = max(res.Removed, reply.res.Removed)
+	}
+	if reloaded == 0 {
+		writeAPIError(w, http.StatusServiceUnavailable, errCodeReloadFailed, "no worker answered")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "secrets\t%d\nadded\t%d\nremoved\t%d\nworkers\t%d\n", res.Secrets, res.Added, res.Removed, reloaded)
+}
+
+func (s *WorkerStatsServer) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if wantsDashboard(r) {
+		serveDashboard(w, r)
+		return
+	}
+	s.handleStats(w, r)
+}
+
+func (s *WorkerStatsServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		s.handleStatsJSON(w, r)
+		return
+	case "", "text":
+	default:
+		writeAPIError(w, http.StatusBadRequest, errCodeBadRequest, "format must be text or json")
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	snaps := fetchAll(s, fetchWorkerStats)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, renderWorkerStats(snaps))
+}
+
+func (s *WorkerStatsServer) handleStatsJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	snaps := fetchAll(s, fetchWorkerStatsJSON)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(mergeWorkerStatsJSON(snaps))
+}
+
+// mergeWorkerStatsJSON merges the workers' /stats.json (nil for a worker
+// that did not answer) the way renderWorkerStats merges /stats: counters
+// are combined with the same rules and joined by workers, workers_up and
+// the per-worker ingress counters. Version, config, reload history and
+// per-target details are the same on every worker up to timing and are
+// taken from the first worker that answered.
+func mergeWorkerStatsJSON(snaps []*statsJSON) statsJSON {
+	resp := statsJSON{
+		Implementation: implementationName,
+		Counters:       make(map[string]int64),
+		ReloadHistory:  []ReloadEvent{},
+		Targets:        []TargetStatus{},
+		Clusters:       []clusterJSON{},
+		LocalAddrs:     []LocalAddrStatus{},
+	}
+	up := 0
+	for id, snap := range snaps {
+		prefix := "worker_" + strconv.Itoa(id) + "_"
+		if snap == nil {
+			resp.Counters[prefix+"up"] = 0
+			continue
+		}
+		if up == 0 {
+			counters := resp.Counters
+			resp = *snap
+			resp.Counters = counters
+		}
+		up++
+		resp.Uptime = max(resp.Uptime, snap.Uptime)
+		resp.Counters[prefix+"up"] = 1
+		for k, v := range snap.Counters {
+			if workerIngressStat(k) {
+				resp.Counters[prefix+k] = v
+			}
+			cur, seen := resp.Counters[k]
+			switch {
+			case !seen:
+				resp.Counters[k] = v
+			case workerStatMax(k):
+				resp.Counters[k] = max(cur, v)
+			default:
+				resp.Counters[k] = cur + v
+			}
+		}
+	}
+	resp.Counters["workers"] = int64(len(snaps))
+	resp.Counters["workers_up"] = int64(up)
+	return resp
+}
+
+// fetchWorkerHealth asks one worker for its /healthz or /readyz report.
+// It returns "" when the worker passes, otherwise why it does not: the
+// detail of its first failed check, or the fetch error.
+func fetchWorkerHealth(client *http.Client, path string) string {
+	resp, err := client.Get("http://worker" + path)
+	if err != nil {
+		return "not answering"
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return ""
+	}
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		name, rest, ok := strings.Cut(sc.Text(), "\t")
+		if state, detail, _ := strings.Cut(rest, "\t"); ok && state == "fail" {
+			return name + ": " + detail
+		}
+	}
+	return "status " + resp.Status
+}
+
+// workersHealth checks path on every worker. The report has one check,
+// "workers", which passes while at least one worker passes; its detail
+// counts them and says why each failing worker fails.
+func (s *WorkerStatsServer) workersHealth(path string) HealthReport {
+	failures := make([]string, len(s.workers))
+	var wg sync.WaitGroup
+	for i, client := range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failures[i] = fetchWorkerHealth(client, path)
+		}()
+	}
+	wg.Wait()
+
+	passing := 0
+	var why []string
+	for id, f := range failures {
+		if f == "" {
+			passing++
+			continue
+		}
+		why = append(why, "worker "+strconv.Itoa(id)+": "+f)
+	}
+	detail := fmt.Sprintf("%d of %d passing", passing, len(s.workers))
+	if len(why) > 0 {
+		detail += "; " + strings.Join(why, "; ")
+	}
+	return HealthReport{{Name: "workers", OK: passing > 0, Detail: detail}}
+}
+
+// handleHealthz passes while at least one worker is alive.
+func (s *WorkerStatsServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	serveHealthReport(w, r, func() HealthReport { return s.workersHealth("/healthz") })
+}
+
+// handleReadyz passes while at least one worker is ready to accept
+// clients; with every worker down or restarting it answers 503.
+func (s *WorkerStatsServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	serveHealthReport(w, r, func() HealthReport { return s.workersHealth("/readyz") })
+}
+
+// renderWorkerStats merges the worker snapshots (nil for a worker that did
+// not answer) into one /stats body: first workers and workers_up, then
+// every key in the order the first answering worker wrote it, merged
+// across workers, then the per-worker ingress counters.
+func renderWorkerStats(snaps []*workerSnapshot) string {
+	var sb strings.Builder
+	up := 0
+	var order []string
+	seen := make(map[string]bool)
+	for _, snap := range snaps {
+		if snap == nil {
+			continue
+		}
+		up++
+		for _, k := range snap.keys {
+			if !seen[k] {
+				seen[k] = true
+				order = append(order, k)
+			}
+		}
+	}
+	fmt.Fprintf(&sb, "workers\t%d\n", len(snaps))
+	fmt.Fprintf(&sb, "workers_up\t%d\n", up)
+	for _, k := range order {
+		fmt.Fprintf(&sb, "%s\t%s\n", k, mergeWorkerStat(k, snaps))
+	}
+
+	for id, snap := range snaps {
+		prefix := "worker_" + strconv.Itoa(id) + "_"
+		if snap == nil {
+			sb.WriteString(prefix + "up\t0\n")
+			continue
+		}
+		sb.WriteString(prefix + "up\t1\n")
+		var keys []string
+		for _, k := range snap.keys {
+			if workerIngressStat(k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, "%s%s\t%s\n", prefix, k, snap.values[k])
+		}
+	}
+	return sb.String()
+}
+
+// workerIngressStat reports whether key is broken down per worker in the
+// supervisor's /stats.
+func workerIngressStat(key string) bool {
+	switch key {
+	case "uptime", "total_connections", "handlers_active", "handler_budget_rejected", "overload_shed_accept":
+		return true
+	}
+	return strings.HasPrefix(key, "accept_loop_") || strings.HasPrefix(key, "listener_")
+}
+
+// mergeWorkerStat combines one key across workers. Counters and gauges
+// are summed; values that describe the whole host or a distribution
+// (uptime, state flags, latency percentiles and averages, conntrack, clock
+// and per-target health) take the maximum; text takes the first worker's value.
+func mergeWorkerStat(key string, snaps []*workerSnapshot) string {
+	useMax := workerStatMax(key)
+	var sumInt, maxInt int64
+	var sumFloat, maxFloat float64
+	isFloat, first, text := false, "", false
+	for _, snap := range snaps {
+		if snap == nil {
+			continue
+		}
+		v, ok := snap.values[key]
+		if !ok {
+			continue
+		}
+		if first == "" {
+			first = v
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			sumInt += n
+			maxInt = max(maxInt, n)
+			sumFloat += float64(n)
+			maxFloat = max(maxFloat, float64(n))
+			continue
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			isFloat = true
+			sumFloat += f
+			maxFloat = max(maxFloat, f)
+			continue
+		}
+		text = true
+	}
+	switch {
+	case text:
+		return first
+	case isFloat && useMax:
+		return strconv.FormatFloat(maxFloat, 'f', 6, 64)
+	case isFloat:
+		return strconv.FormatFloat(sumFloat, 'f', 6, 64)
+	case useMax:
+		return strconv.FormatInt(maxInt, 10)
+	}
+	return strconv.FormatInt(sumInt, 10)
+}
+
+// workerStatMax reports whether key is merged with max instead of a sum.
+func workerStatMax(key string) bool {
+	switch key {
+	case "uptime", "standby", "draining", "proxy_tag_set", "loopback_backend", "conntrack_count", "conntrack_max",
+		"config_generation":
+		return true
+	}
+	return strings.HasPrefix(key, "target_") || strings.HasPrefix(key, "clock_") ||
+		strings.HasSuffix(key, "_p50_us") || strings.HasSuffix(key, "_p95_us") ||
+		strings.HasSuffix(key, "_p99_us") || strings.HasSuffix(key, "_avg_latency_us")
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// serveWorkerStub serves body as /stats on a unix socket at path.
+func serveWorkerStub(t *testing.T, path, body string) {
+	t.Helper()
+	serveWorkerHandler(t, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+}
+
+// serveWorkerHandler serves h on a unix socket at path.
+func serveWorkerHandler(t *testing.T, path string, h http.Handler) {
+	t.Helper()
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func TestWorkerStatsServer(t *testing.T) {
+	dir := t.TempDir()
+	sockets := []string{
+		filepath.Join(dir, "worker-0.sock"),
+		filepath.Join(dir, "worker-1.sock"),
+		filepath.Join(dir, "worker-2.sock"), // never started
+	}
+	serveWorkerStub(t, sockets[0], "uptime\t100\nconfig_generation\t2\ntotal_connections\t3\nhttp_qps\t0.500000\nversion\tmtproxy-go-0.1\nlistener_443_handshake_p95_us\t900\naccept_loop_0_accepted\t10\n")
+	serveWorkerStub(t, sockets[1], "uptime\t40\nconfig_generation\t2\ntotal_connections\t5\nhttp_qps\t0.250000\nversion\tmtproxy-go-0.1\nlistener_443_handshake_p95_us\t1200\naccept_loop_0_accepted\t7\n")
+
+	addr := freeAddr(t)
+	srv := NewWorkerStatsServer(addr, sockets)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	resp, err := http.Get("http://" + addr + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	got, _ := parseStatsText(strings.NewReader(string(raw)))
+
+	want := map[string]string{
+		"workers":                         "3",
+		"workers_up":                      "2",
+		"uptime":                          "100",
+		"config_generation":               "2",
+		"total_connections":               "8",
+		"http_qps":                        "0.750000",
+		"version":                         "mtproxy-go-0.1",
+		"listener_443_handshake_p95_us":   "1200",
+		"accept_loop_0_accepted":          "17",
+		"worker_0_up":                     "1",
+		"worker_0_total_connections":      "3",
+		"worker_1_accept_loop_0_accepted": "7",
+		"worker_2_up":                     "0",
+	}
+	for k, v := range want {
+		if got.values[k] != v {
+			t.Errorf("%s = %q, want %q", k, got.values[k], v)
+		}
+	}
+	if _, ok := got.values["worker_0_version"]; ok {
+		t.Error("non-ingress key broken down per worker")
+	}
+}
+
+// TestWorkerStatsServer_Drain checks that draining is refused under -M
+// rather than falling through to /stats.
+func TestWorkerStatsServer_Drain(t *testing.T) {
+	addr := freeAddr(t)
+	srv := NewWorkerStatsServer(addr, []string{filepath.Join(t.TempDir(), "worker-0.sock")})
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	resp, err := http.Post("http://"+addr+"/admin/drain?listener=:443", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got apiError
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusConflict || got.Code != errCodeUnsupported {
+		t.Errorf("drain: %d %+v, want %d %q", resp.StatusCode, got, http.StatusConflict, errCodeUnsupported)
+	}
+}
+
+func TestWorkerStatsServer_SecretsReload(t *testing.T) {
+	dir := t.TempDir()
+	sockets := []string{
+		filepath.Join(dir, "worker-0.sock"),
+		filepath.Join(dir, "worker-1.sock"),
+		filepath.Join(dir, "worker-2.sock"), // never started
+	}
+	var reloads atomic.Int32
+	var refuse atomic.Bool
+	for _, socket := range sockets[:2] {
+		h := NewHTTPStatsServer("", NewStats(), 0, nil, proxyVersion)
+		h.SetSecretReloader(func() (SecretReload, error) {
+			if refuse.Load() {
+				return SecretReload{}, errors.New("secrets.txt: bad secret")
+			}
+			reloads.Add(1)
+			return SecretReload{Secrets: 2, Added: 1, Removed: 1}, nil
+		})
+		serveWorkerHandler(t, socket, http.HandlerFunc(h.handleSecretsReload))
+	}
+	srv := NewWorkerStatsServer("", sockets)
+
+	rec := httptest.NewRecorder()
+	srv.handleSecretsReload(rec, httptest.NewRequest(http.MethodPost, "/admin/secrets/reload", nil))
+	if want := "secrets\t2\nadded\t1\nremoved\t1\nworkers\t2\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("reload: %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+	if n := reloads.Load(); n != 2 {
+		t.Errorf("%d workers reloaded, want 2", n)
+	}
+
+	refuse.Store(true)
+	rec = httptest.NewRecorder()
+	srv.handleSecretsReload(rec, httptest.NewRequest(http.MethodPost, "/admin/secrets/reload", nil))
+	var got apiError
+	json.NewDecoder(rec.Body).Decode(&got)
+	if rec.Code != http.StatusUnprocessableEntity || got.Code != errCodeReloadFailed || !strings.HasPrefix(got.Message, "worker 0: ") {
+		t.Errorf("refused reload: %d %+v", rec.Code, got)
+	}
+}
+
+func TestWorkerStatsServer_Readyz(t *testing.T) {
+	dir := t.TempDir()
+	sockets := []string{
+		filepath.Join(dir, "worker-0.sock"),
+		filepath.Join(dir, "worker-1.sock"), // never started
+	}
+	var ready atomic.Bool
+	serveWorkerHandler(t, sockets[0], http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/healthz" || ready.Load():
+			io.WriteString(w, "ok\n")
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "fail\nconfig\tok\t1 clusters\ningress\tfail\twarm standby\n")
+		}
+	}))
+	srv := NewWorkerStatsServer("", sockets)
+
+	for _, tc := range []struct {
+		path   string
+		ready  bool
+		code   int
+		detail string
+	}{
+		{"/healthz", false, http.StatusOK, "workers\tok\t1 of 2 passing; worker 1: not answering\n"},
+		{"/readyz", false, http.StatusServiceUnavailable, "workers\tfail\t0 of 2 passing; worker 0: ingress: warm standby; worker 1: not answering\n"},
+		{"/readyz", true, http.StatusOK, "workers\tok\t1 of 2 passing; worker 1: not answering\n"},
+	} {
+		ready.Store(tc.ready)
+		rec := httptest.NewRecorder()
+		if tc.path == "/healthz" {
+			srv.handleHealthz(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		} else {
+			srv.handleReadyz(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		}
+		if rec.Code != tc.code || !strings.HasSuffix(rec.Body.String(), tc.detail) {
+			t.Errorf("%s (ready=%v): %d %q, want %d ...%q", tc.path, tc.ready, rec.Code, rec.Body.String(), tc.code, tc.detail)
+		}
+	}
+}
+
+func TestMergeWorkerStatsJSON(t *testing.T) {
+	snaps := []*statsJSON{
+		{Uptime: 100, Version: "mtproxy-go-0.1", Counters: map[string]int64{"total_connections": 3, "standby": 0, "config_generation": 2}, Targets: []TargetStatus{{Addr: "149.154.175.50:8888", Healthy: true}}},
+		nil,
+		{Uptime: 40, Version: "mtproxy-go-0.1", Counters: map[string]int64{"total_connections": 5, "standby": 1, "config_generation": 1}},
+	}
+	got := mergeWorkerStatsJSON(snaps)
+	if got.Uptime != 100 || got.Version != "mtproxy-go-0.1" || len(got.Targets) != 1 {
+		t.Errorf("uptime %d, version %q, %d targets", got.Uptime, got.Version, len(got.Targets))
+	}
+	want := map[string]int64{
+		"workers":                    3,
+		"workers_up":                 2,
+		"total_connections":          8,
+		"standby":                    1,
+		"config_generation":          2,
+		"worker_0_up":                1,
+		"worker_0_total_connections": 3,
+		"worker_1_up":                0,
+		"worker_2_total_connections": 5,
+	}
+	for k, v := range want {
+		if got.Counters[k] != v {
+			t.Errorf("%s = %d, want %d", k, got.Counters[k], v)
+		}
+	}
+	if _, ok := got.Counters["worker_0_standby"]; ok {
+		t.Error("non-ingress counter broken down per worker")
+	}
+	if snaps[0].Counters["total_connections"] != 3 {
+		t.Error("merge modified a worker snapshot")
+	}
+
+	if none := mergeWorkerStatsJSON([]*statsJSON{nil}); none.Counters["workers_up"] != 0 || none.Targets == nil {
+		t.Errorf("no worker up: %+v", none)
+	}
+}
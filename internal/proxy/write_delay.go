@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// WriteDelay is artificial latency added to every frame written to a
+// client, for reproducing slow networks against a real client. Each frame
+// is held until Base plus a uniformly random share of Jitter has passed
+// since it was queued; frames never overtake each other, so a short delay
+// drawn after a long one waits for the long one.
+type WriteDelay struct {
+	Base   time.Duration
+	Jitter time.Duration
+}
+
+// enabled reports whether d delays anything; a nil WriteDelay does not.
+func (d *WriteDelay) enabled() bool {
+	return d != nil && (d.Base > 0 || d.Jitter > 0)
+}
+
+// next draws the delay for one frame.
+func (d *WriteDelay) next() time.Duration {
+	if d.Jitter <= 0 {
+		return d.Base
+	}
+	return d.Base + rand.N(d.Jitter+1)
+}
+
+// wait blocks until the frame queued at queued is due. A closed stop cuts
+// the wait short, so closing a writer flushes its queue without the delay.
+func (d *WriteDelay) wait(queued time.Time, stop <-chan struct{}) {
+	left := time.Until(queued.Add(d.next()))
+	if left <= 0 {
+		return
+	}
+	t := time.NewTimer(left)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-stop:
+	}
+}